@@ -40,11 +40,14 @@ var NoopSampleIterator = noOpIterator[logproto.Sample]{}
 type errorIterator[T logprotoType] struct{}
 
 func (errorIterator[T]) Next() bool         { return false }
-func (errorIterator[T]) Err() error         { return errors.New("error") }
+func (errorIterator[T]) Err() error         { return ErrIterator }
 func (errorIterator[T]) At() (zero T)       { return zero }
 func (errorIterator[T]) Labels() string     { return "" }
 func (errorIterator[T]) StreamHash() uint64 { return 0 }
 func (errorIterator[T]) Close() error       { return errors.New("close") }
 
+// ErrIterator is the error of ErrorEntryIterator and ErrorSampleIterator.
+var ErrIterator = errors.New("error")
+
 var ErrorEntryIterator = errorIterator[logproto.Entry]{}
 var ErrorSampleIterator = errorIterator[logproto.Sample]{}
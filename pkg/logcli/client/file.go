@@ -254,6 +254,18 @@ func (l *limiter) EnableMultiVariantQueries(_ string) bool {
 	return false // Multi-variant queries disabled by default for file client
 }
 
+func (l *limiter) MinStep(_ string) time.Duration {
+	return 0
+}
+
+func (l *limiter) JSONSchemas(_ string) map[string]string {
+	return nil
+}
+
+func (l *limiter) MaxDistinctValues(_ string) int {
+	return 0
+}
+
 type querier struct {
 	r      io.Reader
 	labels labels.Labels
@@ -2,7 +2,6 @@ package logproto
 
 import (
 	"encoding/binary"
-	stdjson "encoding/json"
 	"fmt"
 	"math"
 	"slices"
@@ -160,18 +159,22 @@ func (s LegacySample) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("[%s,%s]", t, v)), nil
 }
 
-// UnmarshalJSON implements json.Unmarshaler.
+// UnmarshalJSON implements json.Unmarshaler. A null value is decoded as NaN,
+// see httpreq.FlagNonFiniteNull.
 func (s *LegacySample) UnmarshalJSON(b []byte) error {
 	var t model.Time
-	var v model.SampleValue
-	vs := [...]stdjson.Unmarshaler{&t, &v}
+	var v *model.SampleValue
+	vs := [...]any{&t, &v}
 	if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(b, &vs); err != nil {
 		return err
 	}
 	s.TimestampMs = int64(t)
-	s.Value = float64(v)
+	s.Value = math.NaN()
+	if v != nil {
+		s.Value = float64(*v)
+	}
 
-	if isTesting && math.IsNaN(float64(v)) {
+	if isTesting && math.IsNaN(s.Value) {
 		return fmt.Errorf("test sample")
 	}
 	return nil
@@ -205,12 +208,18 @@ func SampleJsoniterDecode(ptr unsafe.Pointer, iter *jsoniter.Iterator) {
 		return
 	}
 
-	bs := iter.ReadStringAsSlice()
-	ss := *(*string)(unsafe.Pointer(&bs)) // #nosec G103 -- we know the string is not mutated -- nosemgrep: use-of-unsafe-block
-	v, err := strconv.ParseFloat(ss, 64)
-	if err != nil {
-		iter.ReportError("logproto.LegacySample", err.Error())
-		return
+	// Queriers encode NaN and infinite values as null with the
+	// httpreq.FlagNonFiniteNull encoding flag.
+	v := math.NaN()
+	if !iter.ReadNil() {
+		bs := iter.ReadStringAsSlice()
+		ss := *(*string)(unsafe.Pointer(&bs)) // #nosec G103 -- we know the string is not mutated -- nosemgrep: use-of-unsafe-block
+		var err error
+		v, err = strconv.ParseFloat(ss, 64)
+		if err != nil {
+			iter.ReportError("logproto.LegacySample", err.Error())
+			return
+		}
 	}
 
 	if isTesting && math.IsNaN(v) {
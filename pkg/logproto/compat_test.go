@@ -76,6 +76,11 @@ func testUnmarshalling(t *testing.T, unmarshalFn func(data []byte, v interface{}
 	require.NoError(t, err)
 	require.Equal(t, int64(0), sample.TimestampMs)
 	require.True(t, math.IsNaN(sample.Value))
+
+	err = unmarshalFn([]byte(`[1.0,null]`), &sample)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), sample.TimestampMs)
+	require.True(t, math.IsNaN(sample.Value))
 }
 
 func TestLegacySampleCompatibilityMarshalling(t *testing.T) {
@@ -0,0 +1,107 @@
+package logql
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/grafana/loki/v3/pkg/iter"
+	"github.com/grafana/loki/v3/pkg/logqlmodel/metadata"
+)
+
+// newCountValuesOverTimeIterator returns an iterator that counts the
+// occurrences of each distinct value within the window of every series. If
+// maxDistinct is positive, only the first maxDistinct distinct values of a
+// window are counted and a warning reports the number of dropped values once
+// the iterator is closed.
+func newCountValuesOverTimeIterator(
+	ctx context.Context,
+	it iter.PeekingSampleIterator,
+	label string,
+	maxDistinct int,
+	selRange, step, start, end, offset int64,
+) RangeVectorIterator {
+	// forces at least one step.
+	if step == 0 {
+		step = 1
+	}
+	if offset != 0 {
+		start = start - offset
+		end = end - offset
+	}
+
+	inner := &batchRangeVectorIterator{
+		iter:     it,
+		step:     step,
+		end:      end,
+		selRange: selRange,
+		metrics:  map[string]labels.Labels{},
+		window:   map[string]*promql.Series{},
+		agg:      nil,
+		current:  start - step, // first loop iteration will set it to start
+		offset:   offset,
+	}
+	return &countValuesOverTimeBatchRangeVectorIterator{
+		batchRangeVectorIterator: inner,
+		label:                    label,
+		maxDistinct:              maxDistinct,
+		ctx:                      ctx,
+	}
+}
+
+// countValuesOverTimeBatchRangeVectorIterator produces one sample per distinct
+// value of each series in the window. The value is carried by the configured
+// label and the sample holds the number of its occurrences.
+type countValuesOverTimeBatchRangeVectorIterator struct {
+	*batchRangeVectorIterator
+	label       string
+	maxDistinct int
+	// dropped is the number of distinct values dropped over all windows.
+	dropped int
+	ctx     context.Context
+	at      []promql.Sample
+}
+
+func (r *countValuesOverTimeBatchRangeVectorIterator) At() (int64, StepResult) {
+	if r.at == nil {
+		r.at = make([]promql.Sample, 0, len(r.window))
+	}
+	r.at = r.at[:0]
+	// convert ts from nano to milli seconds as the iterator work with nanoseconds
+	ts := r.current/1e+6 + r.offset/1e+6
+	for _, series := range r.window {
+		counts := map[string]float64{}
+		values := make([]string, 0, len(series.Floats))
+		for _, p := range series.Floats {
+			v := strconv.FormatFloat(p.F, 'f', -1, 64)
+			if _, ok := counts[v]; !ok {
+				if r.maxDistinct > 0 && len(values) == r.maxDistinct {
+					// seen, so that the value is dropped only once.
+					counts[v] = 0
+					r.dropped++
+					continue
+				}
+				values = append(values, v)
+			}
+			counts[v]++
+		}
+		lb := labels.NewBuilder(series.Metric)
+		for _, v := range values {
+			r.at = append(r.at, promql.Sample{
+				F:      counts[v],
+				T:      ts,
+				Metric: lb.Set(r.label, v).Labels(),
+			})
+		}
+	}
+	return ts, SampleVector(r.at)
+}
+
+func (r *countValuesOverTimeBatchRangeVectorIterator) Close() error {
+	if r.dropped > 0 {
+		metadata.FromContext(r.ctx).AddStructuredWarning(metadata.MaxDistinctValuesWarning(r.maxDistinct, r.dropped))
+	}
+	return r.batchRangeVectorIterator.Close()
+}
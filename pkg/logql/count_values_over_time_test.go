@@ -0,0 +1,83 @@
+package logql
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logqlmodel/metadata"
+)
+
+func TestEngine_CountValuesOverTime_InstantQuery(t *testing.T) {
+	const qs = `count_values_over_time("val", {app="foo"} | unwrap x [5m])`
+	ts := time.Unix(5*60, 0)
+
+	samples := make([]logproto.Sample, 0, 6)
+	for i, v := range []float64{1, 1, 2, 3, 3, 3} {
+		samples = append(samples, logproto.Sample{
+			Timestamp: time.Unix(int64(i+1)*10, 0).UnixNano(),
+			Value:     v,
+			Hash:      uint64(i),
+		})
+	}
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: samples}}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: qs}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+
+	params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+
+	require.Equal(t, promql.Vector{
+		{T: ts.UnixMilli(), F: 2, Metric: labels.FromStrings("app", "foo", "val", "1")},
+		{T: ts.UnixMilli(), F: 1, Metric: labels.FromStrings("app", "foo", "val", "2")},
+		{T: ts.UnixMilli(), F: 3, Metric: labels.FromStrings("app", "foo", "val", "3")},
+	}, res.Data)
+}
+
+func TestEngine_CountValuesOverTime_MaxDistinctValues(t *testing.T) {
+	const qs = `count_values_over_time("val", {app="foo"} | unwrap x [5m])`
+	ts := time.Unix(5*60, 0)
+
+	samples := make([]logproto.Sample, 0, 6)
+	for i, v := range []float64{1, 2, 2, 3, 4, 5} {
+		samples = append(samples, logproto.Sample{
+			Timestamp: time.Unix(int64(i+1)*10, 0).UnixNano(),
+			Value:     v,
+			Hash:      uint64(i),
+		})
+	}
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: samples}}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: qs}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, &fakeLimits{maxSeries: math.MaxInt32, maxDistinctValues: 3}, log.NewNopLogger())
+
+	params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+
+	require.Equal(t, promql.Vector{
+		{T: ts.UnixMilli(), F: 1, Metric: labels.FromStrings("app", "foo", "val", "1")},
+		{T: ts.UnixMilli(), F: 2, Metric: labels.FromStrings("app", "foo", "val", "2")},
+		{T: ts.UnixMilli(), F: 1, Metric: labels.FromStrings("app", "foo", "val", "3")},
+	}, res.Data)
+	require.Equal(t, []string{metadata.MaxDistinctValuesWarning(3, 2).Message}, res.Warnings)
+	require.Contains(t, res.Warnings[0], "2 distinct values were dropped")
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 
 	"github.com/grafana/loki/v3/pkg/iter"
@@ -68,8 +69,20 @@ func (ng *DownstreamEngine) Query(ctx context.Context, p Params) Query {
 	return &query{
 		logger:    ng.logger,
 		params:    p,
-		evaluator: NewDownstreamEvaluator(ng.downstreamable.Downstreamer(ctx)),
+		evaluator: NewDownstreamEvaluator(ng.downstreamable.Downstreamer(ctx), ng.opts),
 		limits:    ng.limits,
+		clock:     ng.opts.Now,
+
+		negativeOffsets:        ng.opts.EnableNegativeOffsets,
+		maxPipelineStages:      ng.opts.MaxPipelineStages,
+		requiredLabels:         ng.opts.RequiredLabels,
+		forbiddenLabelMatchers: ng.opts.ForbiddenLabelMatchers,
+		selectorRewriter:       ng.opts.SelectorRewriter,
+		resultSortStable:       ng.opts.ResultSortStable,
+		sampleRounding:         ng.opts.SampleRounding,
+		maxLabelNameLength:     ng.opts.MaxLabelNameLength,
+		maxLabelValueLength:    ng.opts.MaxLabelValueLength,
+		labelLengthPolicy:      ng.opts.LabelLengthPolicy,
 	}
 }
 
@@ -462,10 +475,27 @@ type Accumulator interface {
 type DownstreamEvaluator struct {
 	Downstreamer
 	defaultEvaluator EvaluatorFactory
+	selectorRewriter func([]*labels.Matcher) []*labels.Matcher
+}
+
+type downstreamQueryCtxKey struct{}
+
+// isDownstreamQuery tells whether the query evaluated with ctx is sent
+// downstream by another query its result is merged into.
+func isDownstreamQuery(ctx context.Context) bool {
+	return ctx.Value(downstreamQueryCtxKey{}) != nil
 }
 
 // Downstream runs queries and collects stats from the embedded Downstreamer
 func (ev DownstreamEvaluator) Downstream(ctx context.Context, queries []DownstreamQuery, acc Accumulator) ([]logqlmodel.Result, error) {
+	ctx = context.WithValue(ctx, downstreamQueryCtxKey{}, struct{}{})
+	if ev.selectorRewriter != nil {
+		rewritten, err := ev.rewriteSelectors(queries)
+		if err != nil {
+			return nil, err
+		}
+		queries = rewritten
+	}
 	results, err := ev.Downstreamer.Downstream(ctx, queries, acc)
 	if err != nil {
 		return nil, err
@@ -507,10 +537,32 @@ func (errorQuerier) SelectSamples(_ context.Context, _ SelectSampleParams) (iter
 	return nil, errors.New("SelectSamples unimplemented: the query-frontend cannot evaluate an expression that selects samples. this is likely a bug in the query engine. please contact your system operator")
 }
 
-func NewDownstreamEvaluator(downstreamer Downstreamer) *DownstreamEvaluator {
+// rewriteSelectors returns copies of the queries with the matchers of each of
+// their log selectors rewritten by the selector rewriter.
+func (ev DownstreamEvaluator) rewriteSelectors(queries []DownstreamQuery) ([]DownstreamQuery, error) {
+	rewritten := make([]DownstreamQuery, 0, len(queries))
+	for _, qry := range queries {
+		expr, err := rewriteSelectors(qry.Params.GetExpression(), ev.selectorRewriter)
+		if err != nil {
+			return nil, err
+		}
+		rewritten = append(rewritten, DownstreamQuery{
+			Params: ParamsWithExpressionOverride{Params: qry.Params, ExpressionOverride: expr},
+		})
+	}
+	return rewritten, nil
+}
+
+// NewDownstreamEvaluator returns an evaluator sending the downstream
+// expressions of queries to the downstreamer and evaluating the expressions
+// around them, such as binary operations, with opts.
+func NewDownstreamEvaluator(downstreamer Downstreamer, opts EngineOpts) *DownstreamEvaluator {
+	ev := NewDefaultEvaluator(&errorQuerier{}, 0, 0)
+	ev.binOpOpts = newBinOpOptions(opts)
 	return &DownstreamEvaluator{
 		Downstreamer:     downstreamer,
-		defaultEvaluator: NewDefaultEvaluator(&errorQuerier{}, 0, 0),
+		defaultEvaluator: ev,
+		selectorRewriter: opts.SelectorRewriter,
 	}
 }
 
@@ -16,6 +16,7 @@ import (
 
 	"github.com/grafana/loki/v3/pkg/logproto"
 	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/grafana/loki/v3/pkg/logqlmodel"
 	"github.com/grafana/loki/v3/pkg/storage/stores/shipper/indexshipper/tsdb/index"
 )
 
@@ -56,6 +57,8 @@ func TestMappingEquivalence(t *testing.T) {
 		{`1 + sum by (cluster) (rate({a=~".+"}[1s]))`, false, nil},
 		{`sum(max(rate({a=~".+"}[1s])))`, false, nil},
 		{`max(count(rate({a=~".+"}[1s])))`, false, nil},
+		{`quantile(0.9, sum by (a) (rate({a=~".+"}[1s])))`, false, nil},
+		{`rate({a=~".+"}[1s]) / scalar(sum(rate({a=~".+"}[1s])))`, false, nil},
 		{`max(sum by (cluster) (rate({a=~".+"}[1s]))) / count(rate({a=~".+"}[1s]))`, false, nil},
 		{`sum(rate({a=~".+"} |= "foo" != "foo"[1s]) or vector(1))`, false, nil},
 		{`avg_over_time({a=~".+"} | logfmt | unwrap value [1s])`, false, nil},
@@ -93,7 +96,7 @@ func TestMappingEquivalence(t *testing.T) {
 			streams,
 		)
 
-		opts := EngineOpts{}
+		opts := EngineOpts{EnableNegativeOffsets: true}
 		regular := NewEngine(opts, q, NoLimits, log.NewNopLogger())
 		sharded := NewDownstreamEngine(opts, MockDownstreamer{regular}, NoLimits, log.NewNopLogger())
 
@@ -176,6 +179,121 @@ func TestMappingEquivalence(t *testing.T) {
 	}
 }
 
+// TestDownstreamEngine_Opts checks that the options of the engine apply to
+// sharded queries evaluated by the downstream engine, whose downstream
+// queries are evaluated without them.
+func TestDownstreamEngine_Opts(t *testing.T) {
+	var (
+		shards  = 3
+		rounds  = 20
+		streams = randomStreams(60, rounds+1, shards, []string{"a", "b", "c", "d"}, true)
+		start   = time.Unix(0, 0)
+		end     = time.Unix(0, int64(time.Second*time.Duration(rounds)))
+	)
+
+	for _, tc := range []struct {
+		name    string
+		query   string
+		opts    EngineOpts
+		instant bool
+	}{
+		{"sample rounding", `sum by (a) (rate({a=~".+"}[1s])) / 3`, EngineOpts{SampleRounding: 2}, false},
+		{"result sort stable", `sum by (a) (rate({a=~".+"}[1s])) or sum by (a, b) (rate({a=~".+"}[1s]))`, EngineOpts{ResultSortStable: true}, true},
+		{
+			"label length",
+			`label_replace(sum by (a) (rate({a=~".+"}[1s])), "b", "value-of-a-$1", "a", "(.*)")`,
+			EngineOpts{MaxLabelValueLength: 8, LabelLengthPolicy: LabelLengthTruncate},
+			false,
+		},
+		{
+			"div by zero policy",
+			`sum by (a) (rate({a=~".+"}[1s])) / (sum by (a) (rate({a=~".+"}[1s])) - sum by (a) (rate({a=~".+"}[1s])))`,
+			EngineOpts{DivByZeroPolicy: DivByZeroDrop},
+			false,
+		},
+		{"max pipeline stages", `sum by (a) (rate({a=~".+"} |= "level" | logfmt [1s]))`, EngineOpts{MaxPipelineStages: 1}, false},
+		{"required labels", `sum by (a) (rate({a=~".+"}[1s]))`, EngineOpts{RequiredLabels: []string{"b"}}, false},
+		{
+			"selector rewriter",
+			`sum by (a) (rate({a=~".+"}[1s]))`,
+			EngineOpts{SelectorRewriter: func(mts []*labels.Matcher) []*labels.Matcher {
+				return append(mts, labels.MustNewMatcher(labels.MatchEqual, "b", "1"))
+			}},
+			false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewMockQuerier(shards, streams)
+			ctx := user.InjectOrgID(context.Background(), "fake")
+			params, err := NewLiteralParams(tc.query, start, end, time.Second, 0, logproto.FORWARD, 100, nil, nil)
+			if tc.instant {
+				params, err = NewLiteralParams(tc.query, end, end, 0, 0, logproto.FORWARD, 100, nil, nil)
+			}
+			require.NoError(t, err)
+
+			mapper := NewShardMapper(NewPowerOfTwoStrategy(ConstantShards(shards)), nilShardMetrics, nil)
+			_, _, mapped, err := mapper.Parse(params.GetExpression())
+			require.NoError(t, err)
+			shardedParams := ParamsWithExpressionOverride{Params: params, ExpressionOverride: mapped}
+
+			// the downstream queries are evaluated without the options.
+			regular := NewEngine(EngineOpts{}, q, NoLimits, log.NewNopLogger())
+			without, err := NewDownstreamEngine(EngineOpts{}, MockDownstreamer{regular}, NoLimits, log.NewNopLogger()).Query(ctx, shardedParams).Exec(ctx)
+			require.NoError(t, err)
+			expected, expectedErr := NewEngine(tc.opts, q, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+			if expectedErr == nil {
+				require.NotEqual(t, without.Data, expected.Data)
+			}
+
+			sharded := NewDownstreamEngine(tc.opts, MockDownstreamer{regular}, NoLimits, log.NewNopLogger())
+			res, err := sharded.Query(ctx, shardedParams).Exec(ctx)
+			if expectedErr != nil {
+				require.EqualError(t, err, expectedErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, expected.Data, res.Data)
+		})
+	}
+}
+
+func TestDownstreamEngine_ZeroOnEmptyAggregation(t *testing.T) {
+	var (
+		shards = 3
+		rounds = 20
+		// a single stream leaves the other shards empty.
+		streams = randomStreams(1, rounds+1, shards, []string{"a"}, true)
+		start   = time.Unix(0, 0)
+		end     = time.Unix(0, int64(time.Second*time.Duration(rounds)))
+	)
+	q := NewMockQuerier(shards, streams)
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	for _, query := range []string{
+		`sum by (a) (count_over_time({a=~".+"}[1s]))`,
+		`count(count_over_time({a=~".+"}[1s]))`,
+		`sum by (a) (count_over_time({a="none"}[1s]))`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			params, err := NewLiteralParams(query, start, end, time.Second, 0, logproto.FORWARD, 100, nil, nil)
+			require.NoError(t, err)
+			params = params.WithZeroOnEmptyAggregation(true)
+
+			regular := NewEngine(EngineOpts{}, q, NoLimits, log.NewNopLogger())
+			expected, err := regular.Query(params).Exec(ctx)
+			require.NoError(t, err)
+
+			mapper := NewShardMapper(NewPowerOfTwoStrategy(ConstantShards(shards)), nilShardMetrics, nil)
+			_, _, mapped, err := mapper.Parse(params.GetExpression())
+			require.NoError(t, err)
+			sharded := NewDownstreamEngine(EngineOpts{}, MockDownstreamer{regular}, NoLimits, log.NewNopLogger())
+			res, err := sharded.Query(ctx, ParamsWithExpressionOverride{Params: params, ExpressionOverride: mapped}).Exec(ctx)
+			require.NoError(t, err)
+			require.Equal(t, expected.Data, res.Data)
+		})
+	}
+}
+
 func TestMappingEquivalenceSketches(t *testing.T) {
 	var (
 		shards   = 3
@@ -695,7 +813,7 @@ func TestRangeMappingEquivalence(t *testing.T) {
 			streams,
 		)
 
-		opts := EngineOpts{}
+		opts := EngineOpts{EnableNegativeOffsets: true}
 		regularEngine := NewEngine(opts, q, NoLimits, log.NewNopLogger())
 		downstreamEngine := NewDownstreamEngine(opts, MockDownstreamer{regularEngine}, NoLimits, log.NewNopLogger())
 
@@ -951,3 +1069,72 @@ and
     10`
 	assert.Equal(t, expected, got)
 }
+
+func TestConcatSampleExprShards(t *testing.T) {
+	const shards = 3
+	var (
+		streams = randomStreams(60, 21, shards, []string{"a", "b"}, true)
+		start   = time.Unix(0, 0)
+		end     = time.Unix(20, 0)
+		ctx     = user.InjectOrgID(context.Background(), "fake")
+	)
+	regular := NewEngine(EngineOpts{}, NewMockQuerier(shards, streams), NoLimits, log.NewNopLogger())
+	downstreamer := &countingDownstreamer{MockDownstreamer: MockDownstreamer{regular}}
+	sharded := NewDownstreamEngine(EngineOpts{}, downstreamer, NoLimits, log.NewNopLogger())
+
+	for _, tc := range []struct {
+		qs          string
+		approximate bool
+	}{
+		{`sum by (a) (count_over_time({a=~".+"}[2s]))`, false},
+		// sums of float values differ by the order they are added in.
+		{`sum(sum_over_time({a=~".+"} | logfmt | unwrap value [2s]))`, true},
+	} {
+		qs := tc.qs
+		t.Run(qs, func(t *testing.T) {
+			// the sum of the sums of each shard, in a single concatenation of
+			// downstream legs.
+			var concat *ConcatSampleExpr
+			for i := shards - 1; i >= 0; i-- {
+				concat = &ConcatSampleExpr{
+					DownstreamSampleExpr: DownstreamSampleExpr{
+						shard:      NewPowerOfTwoShard(index.ShardAnnotation{Shard: uint32(i), Of: shards}).Bind(nil),
+						SampleExpr: syntax.MustParseExpr(qs).(syntax.SampleExpr),
+					},
+					next: concat,
+				}
+			}
+			merge := syntax.MustParseExpr(qs).(*syntax.VectorAggregationExpr)
+			merge.Left = concat
+
+			params, err := NewLiteralParams(qs, start, end, time.Second, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := regular.Query(params).Exec(ctx)
+			require.NoError(t, err)
+
+			downstreamer.queries = 0
+			shardedRes, err := sharded.Query(ctx, ParamsWithExpressionOverride{Params: params, ExpressionOverride: merge}).Exec(ctx)
+			require.NoError(t, err)
+			require.Equal(t, shards, downstreamer.queries)
+			require.NotEmpty(t, res.Data)
+			if tc.approximate {
+				approximatelyEquals(t, res.Data.(promql.Matrix), shardedRes.Data.(promql.Matrix))
+			} else {
+				require.Equal(t, res.Data, shardedRes.Data)
+			}
+		})
+	}
+}
+
+// countingDownstreamer counts the downstream queries it executes.
+type countingDownstreamer struct {
+	MockDownstreamer
+	queries int
+}
+
+func (d *countingDownstreamer) Downstreamer(_ context.Context) Downstreamer { return d }
+
+func (d *countingDownstreamer) Downstream(ctx context.Context, queries []DownstreamQuery, acc Accumulator) ([]logqlmodel.Result, error) {
+	d.queries += len(queries)
+	return d.MockDownstreamer.Downstream(ctx, queries, acc)
+}
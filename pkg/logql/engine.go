@@ -5,6 +5,8 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"maps"
+	"math"
 	"slices"
 	"sort"
 	"strconv"
@@ -17,6 +19,7 @@ import (
 	"github.com/grafana/loki/v3/pkg/logqlmodel/metadata"
 	"github.com/grafana/loki/v3/pkg/tracing"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/flagext"
@@ -28,12 +31,15 @@ import (
 	promql_parser "github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/grafana/dskit/tenant"
+	"github.com/grafana/dskit/user"
 
 	"github.com/grafana/loki/v3/pkg/iter"
 	"github.com/grafana/loki/v3/pkg/logproto"
 	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/grafana/loki/v3/pkg/logql/vector"
 	"github.com/grafana/loki/v3/pkg/logqlmodel"
 	"github.com/grafana/loki/v3/pkg/logqlmodel/stats"
+	"github.com/grafana/loki/v3/pkg/querier/plan"
 	"github.com/grafana/loki/v3/pkg/util"
 	"github.com/grafana/loki/v3/pkg/util/constants"
 	"github.com/grafana/loki/v3/pkg/util/httpreq"
@@ -145,6 +151,22 @@ type Querier interface {
 	SelectSamples(context.Context, SelectSampleParams) (iter.SampleIterator, error)
 }
 
+// SeriesCardinalityQuerier is implemented by queriers able to estimate the
+// number of series a sample request selects without fetching it. When the
+// query has a series limit the engine checks the estimate before building any
+// iterator, failing fast instead of after the samples were read.
+type SeriesCardinalityQuerier interface {
+	SeriesCardinality(context.Context, SelectSampleParams) (int, error)
+}
+
+// LabelFilterQuerier is implemented by queriers able to pre-filter the lines of
+// a sample request by label equality filters, e.g. with an index of the values
+// of the labels. The engine sends the requests having pushable filters, see
+// SelectSampleParams.LabelFilters, with these filters to the querier.
+type LabelFilterQuerier interface {
+	SelectSamplesWithLabelFilters(context.Context, SelectSampleParams, []*labels.Matcher) (iter.SampleIterator, error)
+}
+
 type Engine interface {
 	Query(Params) Query
 }
@@ -175,6 +197,180 @@ type EngineOpts struct {
 	//
 	// This setting is only used when the v2 engine is being used.
 	DataobjScanPageCacheSize flagext.Bytes `yaml:"dataobjscan_page_cache_size" category:"experimental"`
+
+	// AbsentLookback keeps absent_over_time reporting series as present for
+	// this long after the last step they had samples at.
+	AbsentLookback time.Duration `yaml:"absent_lookback"`
+
+	// RejectStepBelowMinStep rejects range queries with a step below the
+	// minimum step of the tenant instead of rounding the step up.
+	RejectStepBelowMinStep bool `yaml:"reject_step_below_min_step"`
+
+	// MaxLookbackPerSelector is the maximum range of a single range selector,
+	// checked in addition to the maximum query range of the tenant.
+	MaxLookbackPerSelector time.Duration `yaml:"max_lookback_per_selector"`
+
+	// PrometheusRateCompat makes rate over unwrapped values treat them as a
+	// counter and extrapolate to the boundaries of the range like PromQL does.
+	PrometheusRateCompat bool `yaml:"prometheus_rate_compat"`
+
+	// SoftTimeout is the time budget for evaluating the steps of a range
+	// query. Once exhausted, the steps evaluated so far are returned with a
+	// warning instead of failing like the query timeout does.
+	SoftTimeout time.Duration `yaml:"soft_timeout"`
+
+	// ZScoreZeroStddevNaN makes zscore_over_time return NaN instead of 0 for
+	// windows with a standard deviation of zero.
+	ZScoreZeroStddevNaN bool `yaml:"zscore_zero_stddev_nan"`
+
+	// QuantileDownsampleTarget caps the samples buffered per series and window
+	// by quantile_over_time by uniformly downsampling them, trading accuracy for
+	// memory. 0 disables downsampling.
+	QuantileDownsampleTarget int `yaml:"quantile_downsample_target"`
+
+	// PropagateNaNInExtremes makes min_over_time and max_over_time return NaN
+	// for windows with a NaN sample. By default NaN samples are skipped and
+	// NaN is only returned for windows without any other sample.
+	PropagateNaNInExtremes bool `yaml:"propagate_nan_in_extremes"`
+
+	// EstimateCost fills the estimate of the statistics of queries with the
+	// selectors, distinct series, samples and evaluators they execute.
+	EstimateCost bool `yaml:"estimate_cost"`
+
+	// DeduplicateSelects sends identical sample requests of a query to the
+	// querier once and shares their samples between the evaluators.
+	DeduplicateSelects bool `yaml:"deduplicate_selects"`
+
+	// MaxConcurrentSelects is the maximum number of legs of binary operations
+	// evaluated concurrently with the other leg across all queries.
+	MaxConcurrentSelects int `yaml:"max_concurrent_selects"`
+
+	// MaxEvaluatedSteps is the maximum number of steps a range query is
+	// evaluated at. Queries with more steps are evaluated at a multiple of
+	// their step and linearly interpolated to it. 0 disables interpolation.
+	MaxEvaluatedSteps int `yaml:"max_evaluated_steps"`
+
+	// EvaluatePerTenant evaluates metric queries of multiple tenants
+	// separately for each tenant and merges the results, labeling the series
+	// of each tenant with its ID in the __tenant__ label.
+	EvaluatePerTenant bool `yaml:"evaluate_per_tenant"`
+
+	// MaxSeriesPerStep is the maximum number of series at any single step of
+	// a range query, in addition to the maximum number of series of the whole
+	// query. 0 disables the limit.
+	MaxSeriesPerStep int `yaml:"max_series_per_step"`
+
+	// ResultLimit is the maximum number of data points, series times steps,
+	// of the result of a range query. It is enforced by the query frontend on
+	// the result merged from the split and sharded queries. 0 disables the
+	// limit.
+	ResultLimit int `yaml:"result_limit"`
+
+	// UnpackedBytes makes bytes_over_time and bytes_rate over an unpack stage
+	// count the bytes of the unpacked lines when wrapped in a sum. The labels
+	// of the series are then only reduced by the engine and not at the source.
+	UnpackedBytes bool `yaml:"unpacked_bytes"`
+
+	// InstantAsMatrix returns the vector result of instant queries as a matrix
+	// with a single point per series at the evaluation timestamp.
+	InstantAsMatrix bool `yaml:"instant_as_matrix"`
+
+	// NormalizeQueryHash hashes queries in their canonical form, so that
+	// semantically equal queries share the query hash of logs.
+	NormalizeQueryHash bool `yaml:"normalize_query_hash"`
+
+	// IncludeSampleSources captures, for debugging, a few of the log lines
+	// that contributed to each sample of instant metric query results with
+	// few series.
+	IncludeSampleSources bool `yaml:"include_sample_sources"`
+
+	// MaxExpressionDepth is the maximum nesting of the metric expressions of a
+	// query, e.g. 3 for `sum(rate({app="foo"}[1m]) / 2)`. Deeper queries are
+	// rejected before they are evaluated. 0 to disable.
+	MaxExpressionDepth int `yaml:"max_expression_depth"`
+
+	// MaxPipelineStages is the maximum number of stages of each log pipeline
+	// of a query, such as line filters, parsers and formatters. Queries with
+	// longer pipelines are rejected before they are evaluated. 0 to disable.
+	MaxPipelineStages int `yaml:"max_pipeline_stages"`
+
+	// RequiredLabels are the labels every selector of a query must have a
+	// matcher restricting the values of, e.g. namespace="prod" but not
+	// namespace=~".*". Queries with a selector missing one are rejected before
+	// they are evaluated.
+	RequiredLabels flagext.StringSliceCSV `yaml:"required_labels"`
+
+	// ForbiddenLabelMatchers are the labels no selector of a query may have a
+	// matcher on, such as high cardinality labels. Queries with a selector
+	// using one are rejected before they are evaluated.
+	ForbiddenLabelMatchers flagext.StringSliceCSV `yaml:"forbidden_label_matchers"`
+
+	// WarnUnderSampling warns about range queries whose step exceeds the
+	// range of one of their range aggregations, e.g. `[30s]` at a step of
+	// 1m, whose windows skip the logs between them.
+	WarnUnderSampling bool `yaml:"warn_under_sampling"`
+
+	// MaxStepsPerQuery is the maximum number of steps of a range query, its
+	// range divided by its step. Queries with more steps are rejected before
+	// they are evaluated. 0 disables the limit.
+	MaxStepsPerQuery int `yaml:"max_steps_per_query"`
+
+	// EnableNegativeOffsets allows negative offsets such as `offset -5m`,
+	// which shift the range of a selector forward past the end of the query.
+	EnableNegativeOffsets bool `yaml:"enable_negative_offsets"`
+
+	// ResultSortStable sorts the series of vector and matrix results by their
+	// label string, so that results can be compared across versions. Results
+	// of queries ordering their series, such as topk and sort, keep their
+	// order.
+	ResultSortStable bool `yaml:"result_sort_stable"`
+
+	// DivByZeroPolicy is how binary operations with a vector divide a sample
+	// by zero: inf returns +Inf or -Inf by the sign of the dividend, nan
+	// returns NaN and drop drops the sample.
+	DivByZeroPolicy string `yaml:"div_by_zero_policy"`
+
+	// NonFiniteJSON is how NaN and infinite sample values of results are
+	// encoded in JSON by default: as strings like Prometheus does, or as null.
+	// See EncodingFlags.
+	NonFiniteJSON string `yaml:"non_finite_json"`
+
+	// SampleRounding is the number of significant digits the sample values of
+	// metric query results are rounded to, so that results do not differ in
+	// their last digits across platforms. 0 disables rounding.
+	SampleRounding int `yaml:"sample_rounding"`
+
+	// MaxLabelNameLength and MaxLabelValueLength are the maximum lengths, in
+	// bytes, of the label names and values of the series and streams of
+	// results, e.g. values generated by label_replace or label_format. Longer
+	// labels are handled by LabelLengthPolicy with a warning. 0 disables the
+	// limit.
+	MaxLabelNameLength  int `yaml:"max_label_name_length"`
+	MaxLabelValueLength int `yaml:"max_label_value_length"`
+
+	// LabelLengthPolicy is how labels exceeding the maximum lengths are
+	// handled: truncate truncates them to the maximum length and drop drops
+	// them.
+	LabelLengthPolicy string `yaml:"label_length_policy"`
+
+	// LabelTransforms derive labels of the series of one side of binary
+	// operations before they are matched with the other side.
+	LabelTransforms []LabelTransform `yaml:"-"`
+
+	// SelectorRewriter, if set, rewrites the matchers of each log selector of
+	// queries before they are evaluated, e.g. to enforce a label matcher on
+	// all queries. The rewritten matchers are sent to the queriers.
+	SelectorRewriter func(matchers []*labels.Matcher) []*labels.Matcher `yaml:"-"`
+
+	// StepCallback, if set, is called by range queries after each step has been
+	// joined into the result, with the index and timestamp (in milliseconds) of
+	// the step. It is never called for instant queries.
+	StepCallback func(stepIndex int, ts int64) `yaml:"-"`
+
+	// Now, if set, replaces the wall clock read by queries, e.g. for the soft
+	// timeout deadline and the execution time of their statistics, so that
+	// tests can evaluate them deterministically.
+	Now func() time.Time `yaml:"-"`
 }
 
 func (opts *EngineOpts) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
@@ -182,6 +378,39 @@ func (opts *EngineOpts) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet)
 
 	f.DurationVar(&opts.MaxLookBackPeriod, prefix+"max-lookback-period", 30*time.Second, "The maximum amount of time to look back for log lines. Used only for instant log queries.")
 	f.IntVar(&opts.MaxCountMinSketchHeapSize, prefix+"max-count-min-sketch-heap-size", 10_000, "The maximum number of labels the heap of a topk query using a count min sketch can track.")
+	f.DurationVar(&opts.AbsentLookback, prefix+"absent-lookback", 0, "Grace period during which absent_over_time still considers series present after the last step they had samples at. 0 to disable.")
+	f.BoolVar(&opts.RejectStepBelowMinStep, prefix+"reject-step-below-min-step", false, "Reject range queries with a step below the minimum query step of the tenant instead of rounding the step up to the minimum.")
+	f.DurationVar(&opts.MaxLookbackPerSelector, prefix+"max-lookback-per-selector", 0, "Maximum range of a single range selector such as [30d]. 0 to disable.")
+	f.BoolVar(&opts.PrometheusRateCompat, prefix+"prometheus-rate-compat", false, "Compute rate over unwrapped values like PromQL does: the values are treated as a counter and the increase is extrapolated to the boundaries of the range.")
+	f.IntVar(&opts.MaxConcurrentSelects, prefix+"max-concurrent-selects", 0, "Maximum number of legs of binary operations evaluated concurrently with the other leg, across all queries. 0 to evaluate the legs sequentially.")
+	f.BoolVar(&opts.PropagateNaNInExtremes, prefix+"propagate-nan-in-extremes", false, "Return NaN from min_over_time and max_over_time for windows with a NaN sample instead of skipping NaN samples.")
+	f.BoolVar(&opts.EstimateCost, prefix+"estimate-cost", false, "Fill the estimate of the statistics of queries with the selectors, distinct series, samples and evaluators they execute.")
+	f.BoolVar(&opts.DeduplicateSelects, prefix+"deduplicate-selects", false, "Send identical sample requests of a query, such as the same range selector on both sides of a binary operation, to the queriers once.")
+	f.DurationVar(&opts.SoftTimeout, prefix+"soft-timeout", 0, "Time budget for evaluating the steps of a range query, after which the steps evaluated so far are returned with a warning. 0 to disable.")
+	f.BoolVar(&opts.ZScoreZeroStddevNaN, prefix+"zscore-zero-stddev-nan", false, "Return NaN instead of 0 from zscore_over_time for windows with a standard deviation of zero.")
+	f.IntVar(&opts.QuantileDownsampleTarget, prefix+"quantile-downsample-target", 0, "Maximum number of samples quantile_over_time buffers per series and window. Above it, the samples are uniformly downsampled and a warning is returned. 0 to disable.")
+	f.BoolVar(&opts.EvaluatePerTenant, prefix+"evaluate-per-tenant", false, "Evaluate metric queries of multiple tenants separately for each tenant and merge the results, labeling the series of each tenant with its ID in the __tenant__ label.")
+	f.IntVar(&opts.MaxSeriesPerStep, prefix+"max-series-per-step", 0, "Maximum number of series at any single step of a range query. Logs Drilldown queries keep the series with the lowest labels at such steps with a warning, other queries fail. 0 to disable.")
+	f.IntVar(&opts.ResultLimit, prefix+"result-limit", 0, "Maximum number of data points (series times steps) of the result of a range query. Enforced by the query frontend. Logs Drilldown queries are downsampled to a coarser step with a warning, other queries fail. 0 to disable.")
+	f.IntVar(&opts.MaxEvaluatedSteps, prefix+"max-evaluated-steps", 0, "Maximum number of steps a range query is evaluated at. Queries with more steps are evaluated at a coarser step and linearly interpolated to the requested step with a warning. 0 to disable.")
+	f.BoolVar(&opts.UnpackedBytes, prefix+"unpacked-bytes", false, "Count the bytes of the unpacked lines in bytes_over_time and bytes_rate over an unpack stage wrapped in a sum, instead of the bytes of the packed lines.")
+	f.BoolVar(&opts.NormalizeQueryHash, prefix+"normalize-query-hash", false, "Hash queries in their canonical form, so that semantically equal queries such as 'sum by (a) (...)' and 'sum(...) by (a)' share the same query hash in logs.")
+	f.BoolVar(&opts.InstantAsMatrix, prefix+"instant-as-matrix", false, "Return the vector result of instant metric queries as a matrix with a single point per series at the evaluation timestamp.")
+	f.IntVar(&opts.MaxStepsPerQuery, prefix+"max-steps-per-query", 0, "Maximum number of steps of a range query, its range divided by its step. Queries with more steps are rejected before they are evaluated. 0 to disable.")
+	f.IntVar(&opts.MaxExpressionDepth, prefix+"max-expression-depth", 50, "Maximum nesting of the metric expressions of a query, such as aggregations and binary operations. Deeper queries are rejected before they are evaluated. 0 to disable.")
+	f.IntVar(&opts.MaxPipelineStages, prefix+"max-pipeline-stages", 0, "Maximum number of stages of each log pipeline of a query, such as line filters, parsers and formatters. Queries with longer pipelines are rejected before they are evaluated. 0 to disable.")
+	f.Var(&opts.RequiredLabels, prefix+"required-labels", "Comma-separated list of labels every selector of a query must have a matcher restricting the values of, such as an equality but not a negative matcher or a regular expression matching any value. Queries with a selector missing one are rejected before they are evaluated.")
+	f.Var(&opts.ForbiddenLabelMatchers, prefix+"forbidden-label-matchers", "Comma-separated list of labels no selector of a query may have a matcher on, such as high cardinality labels. Queries with a selector using one are rejected before they are evaluated.")
+	f.BoolVar(&opts.WarnUnderSampling, prefix+"warn-under-sampling", false, "Warn about range queries whose step exceeds the range of one of their range aggregations, so that the logs between the windows of consecutive steps are not sampled.")
+	f.BoolVar(&opts.EnableNegativeOffsets, prefix+"enable-negative-offsets", false, "Allow negative offsets such as 'offset -5m', which shift the range of a selector forward past the end of the query. Queries with negative offsets are rejected otherwise.")
+	f.BoolVar(&opts.ResultSortStable, prefix+"result-sort-stable", false, "Sort the series of vector and matrix results by their label string, unless the query orders them as with topk, bottomk, sort and sort_desc.")
+	f.StringVar(&opts.DivByZeroPolicy, prefix+"div-by-zero-policy", DivByZeroInf, "How binary operations with a vector divide a sample by zero: 'inf' returns +Inf or -Inf by the sign of the dividend, 'nan' returns NaN, 'drop' drops the sample.")
+	f.StringVar(&opts.NonFiniteJSON, prefix+"non-finite-json", logqlmodel.NonFiniteString, "How NaN and infinite sample values of results are encoded in JSON with sample values as numbers: 'string' for the \"NaN\", \"+Inf\" and \"-Inf\" strings like Prometheus, or 'null'.")
+	f.IntVar(&opts.SampleRounding, prefix+"sample-rounding", 0, "Number of significant digits the sample values of metric query results are rounded to. 0 to disable.")
+	f.IntVar(&opts.MaxLabelNameLength, prefix+"max-label-name-length", 0, "Maximum length in bytes of the label names of the series and streams of query results. Longer labels are handled by the label length policy with a warning. 0 to disable.")
+	f.IntVar(&opts.MaxLabelValueLength, prefix+"max-label-value-length", 0, "Maximum length in bytes of the label values of the series and streams of query results, such as values generated by label_replace or label_format. Longer labels are handled by the label length policy with a warning. 0 to disable.")
+	f.StringVar(&opts.LabelLengthPolicy, prefix+"label-length-policy", LabelLengthTruncate, "How labels of query results exceeding the maximum label name or value length are handled: 'truncate' truncates them to the maximum length, 'drop' drops them.")
+	f.BoolVar(&opts.IncludeSampleSources, prefix+"include-sample-sources", false, "Debug: Return the first log lines that contributed to each sample of instant metric queries with up to 10 series, up to 10 lines per sample.")
 	f.BoolVar(&opts.EnableV2Engine, prefix+"enable-v2-engine", false, "Experimental: Enable next generation query engine for supported queries.")
 	f.IntVar(&opts.BatchSize, prefix+"batch-size", 100, "Experimental: Batch size of the next generation query engine.")
 	f.Var(&opts.DataobjScanPageCacheSize, prefix+"dataobjscan-page-cache-size", "Experimental: Maximum total size of future pages for DataObjScan to download before they are needed, for roundtrip reduction to object storage. Setting to zero disables downloading future pages. Only used in the next generation query engine.")
@@ -190,6 +419,26 @@ func (opts *EngineOpts) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet)
 	opts.LogExecutingQuery = true
 }
 
+// Validate returns an error if one of the options is invalid.
+func (opts *EngineOpts) Validate() error {
+	if err := ValidateDivByZeroPolicy(opts.DivByZeroPolicy); err != nil {
+		return err
+	}
+	if err := logqlmodel.ValidateNonFiniteEncoding(opts.NonFiniteJSON); err != nil {
+		return err
+	}
+	return ValidateLabelLengthPolicy(opts.LabelLengthPolicy)
+}
+
+// EncodingFlags returns the encoding flags query responses are encoded with
+// by default, in addition to the flags a request asks for.
+func (opts *EngineOpts) EncodingFlags() []httpreq.EncodingFlag {
+	if opts.NonFiniteJSON == logqlmodel.NonFiniteNull {
+		return []httpreq.EncodingFlag{httpreq.FlagNonFiniteNull}
+	}
+	return nil
+}
+
 func (opts *EngineOpts) applyDefault() {
 	if opts.MaxLookBackPeriod == 0 {
 		opts.MaxLookBackPeriod = 30 * time.Second
@@ -207,26 +456,75 @@ type QueryEngine struct {
 // NewEngine creates a new LogQL [QueryEngine].
 func NewEngine(opts EngineOpts, q Querier, l Limits, logger log.Logger) *QueryEngine {
 	opts.applyDefault()
+	ev := NewDefaultEvaluator(q, opts.MaxLookBackPeriod, opts.MaxCountMinSketchHeapSize)
+	ev.rangeOpts = rangeAggOptions{
+		absentLookback:         opts.AbsentLookback,
+		prometheusRateCompat:   opts.PrometheusRateCompat,
+		zscoreZeroStddevNaN:    opts.ZScoreZeroStddevNaN,
+		downsampleTarget:       opts.QuantileDownsampleTarget,
+		propagateNaNInExtremes: opts.PropagateNaNInExtremes,
+	}
+	ev.unpackedBytes = opts.UnpackedBytes
+	ev.binOpOpts = newBinOpOptions(opts)
+	if opts.MaxConcurrentSelects > 0 {
+		ev.binOpOpts.legs = make(chan struct{}, opts.MaxConcurrentSelects)
+	}
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 	return &QueryEngine{
 		logger:           logger,
-		evaluatorFactory: NewDefaultEvaluator(q, opts.MaxLookBackPeriod, opts.MaxCountMinSketchHeapSize),
+		evaluatorFactory: ev,
 		limits:           l,
 		opts:             opts,
 	}
 }
 
+// newBinOpOptions returns the options of the binary operations evaluated
+// with opts.
+func newBinOpOptions(opts EngineOpts) binOpOptions {
+	return binOpOptions{
+		transforms: opts.LabelTransforms,
+		divByZero:  opts.DivByZeroPolicy,
+	}
+}
+
 // Query creates a new LogQL query. Instant/Range type is derived from the parameters.
 func (qe *QueryEngine) Query(params Params) Query {
 	return &query{
-		logger:       qe.logger,
-		params:       params,
-		evaluator:    qe.evaluatorFactory,
-		record:       true,
-		logExecQuery: qe.opts.LogExecutingQuery,
-		limits:       qe.limits,
+		logger:        qe.logger,
+		params:        params,
+		evaluator:     qe.evaluatorFactory,
+		record:        true,
+		logExecQuery:  qe.opts.LogExecutingQuery,
+		normalizeHash: qe.opts.NormalizeQueryHash,
+		limits:        qe.limits,
+		stepCallback:  qe.opts.StepCallback,
+		rejectMinStep: qe.opts.RejectStepBelowMinStep,
+
+		maxLookbackPerSelector: qe.opts.MaxLookbackPerSelector,
+		softTimeout:            qe.opts.SoftTimeout,
+		dedupSelects:           qe.opts.DeduplicateSelects,
+		estimateCost:           qe.opts.EstimateCost,
+		maxEvaluatedSteps:      qe.opts.MaxEvaluatedSteps,
+		maxSeriesPerStep:       qe.opts.MaxSeriesPerStep,
+		evaluatePerTenant:      qe.opts.EvaluatePerTenant,
+		instantAsMatrix:        qe.opts.InstantAsMatrix,
+		clock:                  qe.opts.Now,
+		includeSampleSources:   qe.opts.IncludeSampleSources,
+		maxExpressionDepth:     qe.opts.MaxExpressionDepth,
+		maxPipelineStages:      qe.opts.MaxPipelineStages,
+		requiredLabels:         qe.opts.RequiredLabels,
+		forbiddenLabelMatchers: qe.opts.ForbiddenLabelMatchers,
+		warnUnderSampling:      qe.opts.WarnUnderSampling,
+		maxStepsPerQuery:       qe.opts.MaxStepsPerQuery,
+		negativeOffsets:        qe.opts.EnableNegativeOffsets,
+		resultSortStable:       qe.opts.ResultSortStable,
+		sampleRounding:         qe.opts.SampleRounding,
+		maxLabelNameLength:     qe.opts.MaxLabelNameLength,
+		maxLabelValueLength:    qe.opts.MaxLabelValueLength,
+		labelLengthPolicy:      qe.opts.LabelLengthPolicy,
+		selectorRewriter:       qe.opts.SelectorRewriter,
 	}
 }
 
@@ -236,13 +534,78 @@ type Query interface {
 	Exec(ctx context.Context) (logqlmodel.Result, error)
 }
 
+// LogicalPlanner is implemented by queries exposing the plan they execute,
+// e.g. to key caches on the plan instead of the query string.
+type LogicalPlanner interface {
+	// LogicalPlan returns the canonical plan of the expression of the query.
+	LogicalPlan() (plan.QueryPlan, error)
+}
+
+// CacheKeyer is implemented by queries exposing a key for caching their
+// results.
+type CacheKeyer interface {
+	// CacheKey returns a stable key shared by semantically equal queries
+	// with the same bounds. The key does NOT include the tenant: callers
+	// caching results across tenants must add the tenant IDs of the query to
+	// it, or they will serve the results of a tenant to another.
+	CacheKey() string
+}
+
 type query struct {
-	logger       log.Logger
-	params       Params
-	limits       Limits
-	evaluator    EvaluatorFactory
-	record       bool
-	logExecQuery bool
+	logger        log.Logger
+	params        Params
+	limits        Limits
+	evaluator     EvaluatorFactory
+	record        bool
+	logExecQuery  bool
+	normalizeHash bool
+	stepCallback  func(stepIndex int, ts int64)
+	rejectMinStep bool
+
+	maxLookbackPerSelector time.Duration
+	softTimeout            time.Duration
+	dedupSelects           bool
+	estimateCost           bool
+	maxEvaluatedSteps      int
+	maxSeriesPerStep       int
+	evaluatePerTenant      bool
+	instantAsMatrix        bool
+	clock                  func() time.Time
+	includeSampleSources   bool
+	maxExpressionDepth     int
+	maxPipelineStages      int
+	requiredLabels         []string
+	forbiddenLabelMatchers []string
+	warnUnderSampling      bool
+	maxStepsPerQuery       int
+	negativeOffsets        bool
+	resultSortStable       bool
+	sampleRounding         int
+	maxLabelNameLength     int
+	maxLabelValueLength    int
+	labelLengthPolicy      string
+	selectorRewriter       func([]*labels.Matcher) []*labels.Matcher
+
+	// The following fields are set on the copy of the query made for each
+	// execution, see execution.
+
+	// statsOnly discards the samples of a metric query as they are evaluated,
+	// counting them in discarded, see ExecStats.
+	statsOnly bool
+	discarded int
+	// requested are the params of a range query before its step is coarsened
+	// by stepFactor, see onStep.
+	requested  Params
+	stepFactor int
+}
+
+// now returns the current time of the clock of the query, the wall clock
+// unless the engine was given one.
+func (q *query) now() time.Time {
+	if q.clock != nil {
+		return q.clock()
+	}
+	return time.Now()
 }
 
 func (q *query) resultLength(res promql_parser.Value) int {
@@ -261,8 +624,109 @@ func (q *query) resultLength(res promql_parser.Value) int {
 	}
 }
 
+// resultLabelNames returns the sorted and de-duplicated names of the labels
+// of all series of a vector or matrix result.
+func resultLabelNames(res promql_parser.Value) []string {
+	names := map[string]struct{}{}
+	add := func(l labels.Label) { names[l.Name] = struct{}{} }
+	switch r := res.(type) {
+	case promql.Vector:
+		for _, s := range r {
+			s.Metric.Range(add)
+		}
+	case promql.Matrix:
+		for _, s := range r {
+			s.Metric.Range(add)
+		}
+	default:
+		return nil
+	}
+	return slices.Sorted(maps.Keys(names))
+}
+
+// resultUnit returns the declared unit of the samples of a metric query.
+func (q *query) resultUnit() string {
+	expr, ok := q.params.GetExpression().(syntax.SampleExpr)
+	if !ok {
+		return ""
+	}
+	return syntax.Unit(expr)
+}
+
+// LogicalPlan implements LogicalPlanner. The plan holds the expression of the
+// query with the matchers injected by the selector rewriter and with its
+// sample expression optimized, so that queries differing only in formatting or
+// in rewritten operations have the same plan. The @ and offset modifiers are
+// kept as written and resolved during the evaluation. The plan does not
+// reflect what the engine decides when the query is executed: the step
+// rounded up to the minimum step of the tenants or coarsened to the maximum
+// evaluated steps, the JSON schemas of the tenants and the label length
+// policy. Caches keyed on the plan must key on the tenants and the params too,
+// see CacheKey.
+func (q *query) LogicalPlan() (plan.QueryPlan, error) {
+	expr, err := q.rewriteSelectors(q.params.GetExpression())
+	if err != nil {
+		return plan.QueryPlan{}, err
+	}
+	if _, ok := expr.(syntax.VariantsExpr); ok {
+		return plan.QueryPlan{AST: expr}, nil
+	}
+	if e, ok := expr.(syntax.SampleExpr); ok {
+		optimized, err := optimizeSampleExpr(e)
+		if err != nil {
+			return plan.QueryPlan{}, err
+		}
+		expr = optimized
+	}
+	return plan.QueryPlan{AST: expr}, nil
+}
+
+// CacheKey implements CacheKeyer. The key combines the 64-bit hash of the
+// logical plan with the time bounds, step, direction, limit and shards of the
+// query and with the result options of its params, so that queries differing
+// only in their form share the key. It falls back to the hash of the query
+// string if the query cannot be planned. The key does not include the tenant,
+// see CacheKeyer.
+func (q *query) CacheKey() string {
+	expr := q.params.QueryString()
+	if p, err := q.LogicalPlan(); err == nil && p.AST != nil {
+		expr = p.String()
+	}
+	var opts resultOptions
+	if p, ok := findParams[resultOptionsParams](q.params); ok {
+		opts = p.resultOptions()
+	}
+	return fmt.Sprintf("%d:%d:%d:%d:%s:%d:%s:%x",
+		xxhash.Sum64String(expr),
+		q.params.Start().UnixNano(),
+		q.params.End().UnixNano(),
+		q.params.Step().Nanoseconds(),
+		q.params.Direction(),
+		q.params.Limit(),
+		strings.Join(q.params.Shards(), ","),
+		xxhash.Sum64String(fmt.Sprintf("%+v", opts)),
+	)
+}
+
 // Exec Implements `Query`. It handles instrumentation & defers to Eval.
 func (q *query) Exec(ctx context.Context) (logqlmodel.Result, error) {
+	e := q.execution()
+	return e.exec(ctx)
+}
+
+// execution returns a copy of the query for a single execution. The
+// execution overrides the params and counts the samples it discards
+// on its copy, so that the query can be executed several times, concurrently
+// or after a failure, without any state leaking between executions.
+func (q *query) execution() *query {
+	e := *q
+	return &e
+}
+
+func (q *query) exec(ctx context.Context) (logqlmodel.Result, error) {
+	if q.normalizeHash {
+		ctx = util.InjectQueryNormalizer(ctx, syntax.NormalizeQuery)
+	}
 	ctx, sp := tracer.Start(ctx, "query.Exec")
 	defer sp.End()
 
@@ -276,7 +740,7 @@ func (q *query) Exec(ctx context.Context) (logqlmodel.Result, error) {
 	)
 
 	if q.logExecQuery {
-		queryHash := util.HashedQuery(q.params.QueryString())
+		queryHash := util.HashedNormalizedQuery(ctx, q.params.QueryString())
 
 		logValues := []interface{}{
 			"msg", "executing query",
@@ -299,15 +763,42 @@ func (q *query) Exec(ctx context.Context) (logqlmodel.Result, error) {
 	defer timer.ObserveDuration()
 
 	// records query statistics
-	start := time.Now()
+	start := q.now()
 	statsCtx, ctx := stats.NewContext(ctx)
 	metadataCtx, ctx := metadata.NewContext(ctx)
+	if seed, ok := GetSeed(q.params); ok {
+		ctx = InjectSeed(ctx, seed)
+		metadataCtx.SetSeed(seed)
+	}
+	if q.dedupSelects {
+		ctx = withSelectCache(ctx)
+	}
+	var estimate *costEstimate
+	if q.estimateCost {
+		estimate, ctx = withCostEstimate(ctx)
+	}
 
-	data, err := q.Eval(ctx)
+	data, err := q.evaluate(ctx)
+	if (q.maxLabelNameLength > 0 || q.maxLabelValueLength > 0) && err == nil {
+		data, err = q.limitLabelLengths(ctx, data)
+	}
+	if q.resultSortStable && err == nil {
+		data = q.sortStable(data)
+	}
+	if q.sampleRounding > 0 && err == nil {
+		data = roundSamples(data, q.sampleRounding)
+	}
 
 	queueTime, _ := ctx.Value(httpreq.QueryQueueTimeHTTPHeader).(time.Duration)
 
-	statResult := statsCtx.Result(time.Since(start), queueTime, q.resultLength(data))
+	resultLength := q.resultLength(data)
+	if q.statsOnly && data == nil {
+		resultLength = q.discarded
+	}
+	if estimate != nil {
+		estimate.report(statsCtx)
+	}
+	statResult := statsCtx.Result(q.now().Sub(start), queueTime, resultLength)
 	sp.SetAttributes(tracing.KeyValuesToOTelAttributes(statResult.KVList())...)
 
 	status, _ := server.ClientHTTPStatusAndError(err)
@@ -316,21 +807,394 @@ func (q *query) Exec(ctx context.Context) (logqlmodel.Result, error) {
 		RecordRangeAndInstantQueryMetrics(ctx, q.logger, q.params, strconv.Itoa(status), statResult, data)
 	}
 
+	var sampleSources map[string][]logproto.Entry
+	if q.includeSampleSources && err == nil {
+		var sourcesErr error
+		if sampleSources, sourcesErr = q.sampleSources(ctx, data); sourcesErr != nil {
+			level.Warn(logutil.WithContext(ctx, q.logger)).Log("msg", "failed to capture sample sources", "err", sourcesErr)
+		}
+	}
+
 	return logqlmodel.Result{
-		Data:       data,
-		Statistics: statResult,
-		Headers:    metadataCtx.Headers(),
-		Warnings:   metadataCtx.Warnings(),
+		Data:               data,
+		Statistics:         statResult,
+		Headers:            metadataCtx.Headers(),
+		Warnings:           metadataCtx.Warnings(),
+		StructuredWarnings: metadataCtx.StructuredWarnings(),
+		LabelNames:         resultLabelNames(data),
+		Unit:               q.resultUnit(),
+		SampleSources:      sampleSources,
+		EmptyReason:        emptyReason(data, resultLength, statResult),
 	}, err
 }
 
+// emptyReason tells why a result is empty from the lines processed by the
+// queriers: if they processed none, no streams matched the selectors.
+func emptyReason(data promql_parser.Value, resultLength int, st stats.Result) logqlmodel.EmptyReason {
+	switch data.(type) {
+	case promql.Scalar, promql.String:
+		return logqlmodel.EmptyReasonNotEmpty
+	}
+	switch {
+	case resultLength > 0:
+		return logqlmodel.EmptyReasonNotEmpty
+	case st.Summary.TotalLinesProcessed > 0:
+		return logqlmodel.EmptyReasonFilteredOut
+	default:
+		return logqlmodel.EmptyReasonNoStreams
+	}
+}
+
+// ResultSink receives the series or streams of the result of a query one at a
+// time, e.g. to write them to a gRPC stream instead of a single response.
+type ResultSink interface {
+	SendSeries(promql.Series) error
+	SendStream(logproto.Stream) error
+}
+
+// SinkExecutor is implemented by queries able to send their result to a
+// ResultSink instead of returning it.
+type SinkExecutor interface {
+	ExecToSink(ctx context.Context, sink ResultSink) (logqlmodel.Result, error)
+}
+
+// ExecToSink executes the query like Exec and sends its result to the sink.
+// Each series or stream is sent exactly once, complete, as Exec returns it;
+// vectors and scalars are sent as series with a single point. The returned
+// result has the statistics and warnings of the query but no data.
+func (q *query) ExecToSink(ctx context.Context, sink ResultSink) (logqlmodel.Result, error) {
+	res, err := q.Exec(ctx)
+	if err != nil {
+		return res, err
+	}
+	data := res.Data
+	res.Data = nil
+	return res, sendToSink(data, sink)
+}
+
+// StatsExecutor is implemented by queries able to compute the statistics of
+// their execution without building their result.
+type StatsExecutor interface {
+	ExecStats(ctx context.Context) (stats.Result, error)
+}
+
+// ExecStats executes the query like Exec but returns only the statistics of
+// the execution. The samples of a metric query are discarded as they are
+// evaluated instead of being joined into series, so that queries with huge
+// results can be run for capacity planning. The statistics count the
+// discarded samples as returned.
+func (q *query) ExecStats(ctx context.Context) (stats.Result, error) {
+	e := q.execution()
+	e.statsOnly = true
+	res, err := e.exec(ctx)
+	return res.Statistics, err
+}
+
+// RangeExecutor is implemented by queries able to execute their expression
+// over other ranges than the one of their params.
+type RangeExecutor interface {
+	ExecRange(ctx context.Context, start, end time.Time, step time.Duration) (logqlmodel.Result, error)
+}
+
+// ExecRange executes the query over the given range instead of the range of
+// its params, reusing its parsed expression, e.g. for the pages of a
+// dashboard. Each execution returns its own statistics.
+func (q *query) ExecRange(ctx context.Context, start, end time.Time, step time.Duration) (logqlmodel.Result, error) {
+	e := q.execution()
+	e.params = ParamsWithRangeOverride{Params: q.params, StartOverride: start, EndOverride: end, StepOverride: step}
+	return e.exec(ctx)
+}
+
+// BaselineExecutor is implemented by queries able to compare their result to
+// a baseline supplied by the caller.
+type BaselineExecutor interface {
+	ExecWithBaseline(ctx context.Context, baseline promql.Matrix) (logqlmodel.Result, error)
+}
+
+// ExecWithBaseline executes a metric query and returns the difference between
+// its result and the baseline, matching series by labels and points by step.
+// See SubtractBaseline for the handling of unmatched series and points. The
+// vector of an instant query is compared to the baseline points at its
+// evaluation time.
+func (q *query) ExecWithBaseline(ctx context.Context, baseline promql.Matrix) (logqlmodel.Result, error) {
+	res, err := q.Exec(ctx)
+	if err != nil {
+		return res, err
+	}
+	switch v := res.Data.(type) {
+	case promql.Matrix:
+		res.Data = SubtractBaseline(v, baseline)
+	case promql.Vector:
+		vec := promql.Vector{}
+		for _, s := range SubtractBaseline(VectorToMatrix(v), baseline) {
+			vec = append(vec, promql.Sample{Metric: s.Metric, T: s.Floats[0].T, F: s.Floats[0].F})
+		}
+		res.Data = vec
+	default:
+		return res, fmt.Errorf("comparing a baseline requires a metric query, got a result of type %s", res.Data.Type())
+	}
+	return res, nil
+}
+
+func sendToSink(data promql_parser.Value, sink ResultSink) error {
+	var series promql.Matrix
+	switch v := data.(type) {
+	case promql.Matrix:
+		series = v
+	case promql.Vector:
+		series = VectorToMatrix(v)
+	case promql.Scalar:
+		series = promql.Matrix{{Metric: labels.EmptyLabels(), Floats: []promql.FPoint{{T: v.T, F: v.V}}}}
+	case logqlmodel.Streams:
+		for _, s := range v {
+			if err := sink.SendStream(s); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range series {
+		if err := sink.SendSeries(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Eval evaluates the query and returns its data.
 func (q *query) Eval(ctx context.Context) (promql_parser.Value, error) {
+	return q.execution().evaluate(ctx)
+}
+
+// evaluate evaluates the query, overriding its params with the step and
+// expression it is evaluated with.
+func (q *query) evaluate(ctx context.Context) (promql_parser.Value, error) {
+	if err := q.checkExpressionDepth(); err != nil {
+		return nil, err
+	}
+	if err := q.checkPipelineStages(); err != nil {
+		return nil, err
+	}
+	if err := q.checkOffsets(); err != nil {
+		return nil, err
+	}
+	if err := q.checkSelectorLabels(); err != nil {
+		return nil, err
+	}
 	tenants, _ := tenant.TenantIDs(ctx)
+	if err := q.applyMinStep(ctx, tenants); err != nil {
+		return nil, err
+	}
+	if err := q.checkSteps(); err != nil {
+		return nil, err
+	}
+	q.warnUnderSampled(ctx)
+	if err := q.resolveJSONSchemas(tenants); err != nil {
+		return nil, err
+	}
+
+	requested := q.params
+	if q.selectorRewriter != nil {
+		expr, err := q.rewriteSelectors(q.params.GetExpression())
+		if err != nil {
+			return nil, err
+		}
+		q.params = ParamsWithExpressionOverride{Params: q.params, ExpressionOverride: expr}
+	}
+	factor := q.coarsenStep(ctx)
+	q.requested, q.stepFactor = requested, factor
+
 	timeoutCapture := func(id string) time.Duration { return q.limits.QueryTimeout(ctx, id) }
 	queryTimeout := validation.SmallestPositiveNonZeroDurationPerTenant(tenants, timeoutCapture)
-	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+
+	value, err := WithTimeout(ctx, queryTimeout, func(ctx context.Context) (promql_parser.Value, error) {
+		if q.evaluatePerTenant && len(tenants) > 1 {
+			return q.evalPerTenant(ctx, tenants)
+		}
+		return q.eval(ctx, tenants)
+	})
+	q.params = requested
+	if err != nil {
+		return value, err
+	}
+	if v, ok := value.(promql.Vector); ok && q.instantAsMatrix {
+		return VectorToMatrix(v), nil
+	}
+	m, ok := value.(promql.Matrix)
+	if !ok {
+		return value, nil
+	}
+	if factor > 1 {
+		m = Interpolate(m, factor, q.params.Step(), q.resultEnd())
+	}
+	if hold := GetHold(q.params); hold > 0 {
+		m = Hold(m, hold, q.params.Step(), q.params.End())
+	}
+	if GetResultTransform(q.params) == ResultTransformStepDelta {
+		m = StepDelta(m)
+	}
+	return m, nil
+}
+
+// rewriteSelectors returns a copy of expr with the matchers of each of its
+// log selectors rewritten by the selector rewriter, or expr if there is none.
+func (q *query) rewriteSelectors(expr syntax.Expr) (syntax.Expr, error) {
+	if q.selectorRewriter == nil || expr == nil {
+		return expr, nil
+	}
+	if _, ok := q.evaluator.(*DownstreamEvaluator); ok {
+		// the expressions mapped for the downstream engine cannot be cloned,
+		// its evaluator rewrites the queries it sends downstream instead.
+		return expr, nil
+	}
+	return rewriteSelectors(expr, q.selectorRewriter)
+}
+
+// rewriteSelectors returns a copy of expr with the matchers of each of its
+// log selectors rewritten by rewriter.
+func rewriteSelectors(expr syntax.Expr, rewriter func([]*labels.Matcher) []*labels.Matcher) (syntax.Expr, error) {
+	rewritten, err := syntax.Clone(expr)
+	if err != nil {
+		return nil, err
+	}
+	rewritten.Walk(func(e syntax.Expr) bool {
+		if m, ok := e.(*syntax.MatchersExpr); ok {
+			m.Mts = rewriter(m.Mts)
+		}
+		return true
+	})
+	return rewritten, nil
+}
+
+// resolveJSONSchemas sets the schemas of the json_schema stages of the query
+// from the limits of the tenants. A schema must be the same for all tenants.
+func (q *query) resolveJSONSchemas(tenants []string) error {
+	return syntax.ResolveJSONSchemas(q.params.GetExpression(), func(name string) (string, bool) {
+		var schema string
+		for i, id := range tenants {
+			s, ok := q.limits.JSONSchemas(id)[name]
+			if !ok || (i > 0 && s != schema) {
+				return "", false
+			}
+			schema = s
+		}
+		return schema, schema != ""
+	})
+}
+
+// applyMinStep enforces the minimum step of the tenants on range queries.
+// A smaller step is rounded up to the minimum with a warning, or rejected if
+// configured to do so.
+func (q *query) applyMinStep(ctx context.Context, tenants []string) error {
+	if GetRangeType(q.params) != RangeType {
+		return nil
+	}
+	minStepCapture := func(id string) time.Duration { return q.limits.MinStep(id) }
+	minStep := validation.MaxDurationPerTenant(tenants, minStepCapture)
+	step := q.params.Step()
+	if minStep <= 0 || step >= minStep {
+		return nil
+	}
+	if q.rejectMinStep {
+		return fmt.Errorf("%w: query step [%s] is below the minimum step [%s]", logqlmodel.ErrLimit, model.Duration(step), model.Duration(minStep))
+	}
+	q.params = ParamsWithStepOverride{Params: q.params, StepOverride: minStep}
+	metadata.FromContext(ctx).AddStructuredWarning(metadata.MinStepWarning(step, minStep))
+	return nil
+}
+
+// warnUnderSampled warns about the range aggregations of range queries with a
+// range shorter than the step, whose windows leave gaps between steps.
+func (q *query) warnUnderSampled(ctx context.Context) {
+	if !q.warnUnderSampling || GetRangeType(q.params) != RangeType {
+		return
+	}
+	step := q.params.Step()
+	warned := map[time.Duration]struct{}{}
+	q.params.GetExpression().Walk(func(e syntax.Expr) bool {
+		r, ok := e.(*syntax.LogRangeExpr)
+		if !ok || r.Interval >= step {
+			return true
+		}
+		if _, ok := warned[r.Interval]; !ok {
+			warned[r.Interval] = struct{}{}
+			metadata.FromContext(ctx).AddStructuredWarning(metadata.UnderSampledWarning(step, r.Interval))
+		}
+		return true
+	})
+}
+
+// coarsenStep makes range metric queries with more steps than the maximum be
+// evaluated at the smallest multiple of their step within the maximum, up to
+// the first coarse step at or after their end. It returns that multiple, or 1
+// if the query is evaluated at its step.
+func (q *query) coarsenStep(ctx context.Context) int {
+	if q.maxEvaluatedSteps <= 0 || GetRangeType(q.params) != RangeType {
+		return 1
+	}
+	if _, ok := q.params.GetExpression().(syntax.SampleExpr); !ok {
+		return 1
+	}
+	step := q.params.Step()
+	if step <= 0 {
+		return 1
+	}
+	intervals := int(q.params.End().Sub(q.params.Start()) / step)
+	if intervals < q.maxEvaluatedSteps {
+		return 1
+	}
+	// interpolating requires at least two coarse steps.
+	maxIntervals := max(q.maxEvaluatedSteps-1, 1)
+	factor := (intervals + maxIntervals - 1) / maxIntervals
+	coarse := time.Duration(factor) * step
+	coarseIntervals := (intervals + factor - 1) / factor
+	q.params = coarseStepParams{
+		ParamsWithStepOverride: ParamsWithStepOverride{Params: q.params, StepOverride: coarse},
+		EndOverride:            q.params.Start().Add(time.Duration(coarseIntervals) * coarse),
+	}
+	metadata.FromContext(ctx).AddStructuredWarning(metadata.InterpolatedWarning(step, coarse))
+	return factor
+}
+
+// coarseStepParams evaluates a range query at a coarser step, extending its
+// end to the next coarse step so that interpolation covers the whole range.
+type coarseStepParams struct {
+	ParamsWithStepOverride
+	EndOverride time.Time
+}
+
+// End returns the overriding end.
+func (p coarseStepParams) End() time.Time {
+	return p.EndOverride
+}
+
+// resultEnd returns the timestamp in milliseconds of the last step of the
+// result of a range query, after step alignment.
+func (q *query) resultEnd() int64 {
+	end := q.params.End().UnixMilli()
+	if expr, ok := q.params.GetExpression().(syntax.SampleExpr); ok {
+		end += stepAlignmentOffset(expr, GetStepAlignment(q.params))
+	}
+	return end
+}
+
+// WithTimeout runs fn with a context bounded by timeout.
+// If fn fails because that timeout elapsed, the error is replaced by a
+// logqlmodel.QueryTimeoutError carrying the elapsed time and the limit.
+// Deadlines inherited from the parent context are returned untouched.
+func WithTimeout(ctx context.Context, timeout time.Duration, fn func(context.Context) (promql_parser.Value, error)) (promql_parser.Value, error) {
+	start := time.Now()
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
+	value, err := fn(timeoutCtx)
+	if err != nil && timeout > 0 && errors.Is(err, context.DeadlineExceeded) &&
+		errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return value, logqlmodel.NewQueryTimeoutError(time.Since(start), timeout)
+	}
+	return value, err
+}
+
+func (q *query) eval(ctx context.Context, tenants []string) (promql_parser.Value, error) {
 	if q.checkBlocked(ctx, tenants) {
 		return nil, logqlmodel.ErrBlocked
 	}
@@ -355,6 +1219,9 @@ func (q *query) Eval(ctx context.Context) (promql_parser.Value, error) {
 		return value, err
 	case syntax.SampleExpr:
 		value, err := q.evalSample(ctx, e)
+		if s, ok := e.(*syntax.ScalarExpr); ok && !s.Vector && err == nil {
+			return scalarResult(value), nil
+		}
 		return value, err
 
 	case syntax.LogSelectorExpr:
@@ -376,6 +1243,69 @@ func (q *query) Eval(ctx context.Context) (promql_parser.Value, error) {
 	}
 }
 
+// evalPerTenant evaluates a metric query separately for each of the tenants,
+// with the org ID of the context set to the tenant, and merges the results,
+// labeling the series of each tenant with its ID. Log queries and queries
+// without selectors are evaluated once for all tenants.
+func (q *query) evalPerTenant(ctx context.Context, tenants []string) (promql_parser.Value, error) {
+	expr, ok := q.params.GetExpression().(syntax.SampleExpr)
+	if !ok || isSelectorFree(expr) {
+		return q.eval(ctx, tenants)
+	}
+
+	// each tenant is evaluated with its own limits, so the merged result is
+	// held to the smallest series limit of the tenants like a multi-tenant
+	// query is.
+	maxSeriesCapture := func(id string) int { return q.limits.MaxQuerySeries(ctx, id) }
+	maxSeries := validation.SmallestPositiveIntPerTenant(tenants, maxSeriesCapture)
+	drilldown := httpreq.IsLogsDrilldownRequest(ctx)
+
+	vec, matrix := promql.Vector{}, promql.Matrix{}
+	isMatrix := false
+	for _, id := range tenants {
+		value, err := q.eval(user.InjectOrgID(ctx, id), []string{id})
+		if err != nil {
+			return nil, err
+		}
+		switch v := value.(type) {
+		case promql.Vector:
+			for _, s := range v {
+				s.Metric = labels.NewBuilder(s.Metric).Set(constants.TenantLabel, id).Labels()
+				vec = append(vec, s)
+			}
+		case promql.Matrix:
+			isMatrix = true
+			for _, s := range v {
+				s.Metric = labels.NewBuilder(s.Metric).Set(constants.TenantLabel, id).Labels()
+				matrix = append(matrix, s)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported result type for evaluation per tenant: %s", value.Type())
+		}
+
+		if n := len(vec) + len(matrix); n > maxSeries {
+			if !drilldown {
+				return nil, logqlmodel.NewSeriesLimitError(maxSeries)
+			}
+			// For Logs Drilldown requests, return the series of the first tenants with a warning
+			stats.FromContext(ctx).AddDroppedSeries(int64(n - maxSeries))
+			metadata.FromContext(ctx).AddStructuredWarning(metadata.MaxSeriesWarning(maxSeries))
+			if isMatrix {
+				matrix = matrix[:maxSeries]
+			} else {
+				vec = vec[:maxSeries]
+			}
+			break
+		}
+	}
+
+	if !isMatrix {
+		return vec, nil
+	}
+	sort.Sort(matrix)
+	return matrix, nil
+}
+
 func (q *query) checkBlocked(ctx context.Context, tenants []string) bool {
 	blocker := newQueryBlocker(ctx, q)
 
@@ -390,6 +1320,31 @@ func (q *query) checkBlocked(ctx context.Context, tenants []string) bool {
 }
 
 // evalSample evaluate a sampleExpr
+// selectsResultSeries reports whether expr returns at least one series per
+// selected stream, so that the querier's cardinality estimate can be checked
+// against the series limit before selecting samples. This is the case of a
+// range aggregation without grouping whose pipeline only adds labels; other
+// expressions may aggregate or filter out the selected streams.
+func selectsResultSeries(expr syntax.SampleExpr) bool {
+	rae, ok := expr.(*syntax.RangeAggregationExpr)
+	if !ok || rae.Grouping != nil || rae.Operation == syntax.OpRangeTypeAbsent || rae.Left.Unwrap != nil {
+		return false
+	}
+	p, ok := rae.Left.Left.(*syntax.PipelineExpr)
+	if !ok {
+		return true
+	}
+	for _, stage := range p.MultiStages {
+		switch stage.(type) {
+		case *syntax.LogfmtParserExpr, *syntax.LineParserExpr, *syntax.JSONExpressionParserExpr,
+			*syntax.LogfmtExpressionParserExpr, *syntax.LineFmtExpr, *syntax.DecolorizeExpr:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func (q *query) evalSample(ctx context.Context, expr syntax.SampleExpr) (promql_parser.Value, error) {
 	if lit, ok := expr.(*syntax.LiteralExpr); ok {
 		return q.evalLiteral(ctx, lit)
@@ -397,6 +1352,9 @@ func (q *query) evalSample(ctx context.Context, expr syntax.SampleExpr) (promql_
 	if vec, ok := expr.(*syntax.VectorExpr); ok {
 		return q.evalVector(ctx, vec)
 	}
+	if isSelectorFree(expr) {
+		return q.evalSelectorFree(ctx, expr)
+	}
 
 	tenantIDs, err := tenant.TenantIDs(ctx)
 	if err != nil {
@@ -411,17 +1369,37 @@ func (q *query) evalSample(ctx context.Context, expr syntax.SampleExpr) (promql_
 			return nil, err
 		}
 	}
+	if err = q.checkSelectorLookback(expr); err != nil {
+		return nil, err
+	}
 
 	expr, err = optimizeSampleExpr(expr)
 	if err != nil {
 		return nil, err
 	}
 
+	maxSeriesCapture := func(id string) int { return q.limits.MaxQuerySeries(ctx, id) }
+	maxSeries := validation.SmallestPositiveIntPerTenant(tenantIDs, maxSeriesCapture)
+	if !httpreq.IsLogsDrilldownRequest(ctx) && selectsResultSeries(expr) {
+		// Logs Drilldown requests get partial results rather than failing on the limit.
+		ctx = withMaxSeries(ctx, maxSeries)
+	}
+	maxDistinctValuesCapture := func(id string) int { return q.limits.MaxDistinctValues(id) }
+	ctx = withMaxDistinctValues(ctx, validation.SmallestPositiveNonZeroIntPerTenant(tenantIDs, maxDistinctValuesCapture))
+
 	stepEvaluator, err := q.evaluator.NewStepEvaluator(ctx, q.evaluator, expr, q.params)
 	if err != nil {
 		return nil, err
 	}
 	defer util.LogErrorWithContext(ctx, "closing SampleExpr", stepEvaluator.Close)
+	if GetZeroOnEmptyAggregation(q.params) && !isDownstreamQuery(ctx) && zeroOnEmptyAggregation(expr) {
+		stepEvaluator = &ZeroOnEmptyEvaluator{StepEvaluator: stepEvaluator}
+	}
+
+	if q.statsOnly {
+		q.discarded, err = discardSamples(stepEvaluator)
+		return nil, err
+	}
 
 	next, _, r := stepEvaluator.Next()
 	if stepEvaluator.Error() != nil {
@@ -431,13 +1409,7 @@ func (q *query) evalSample(ctx context.Context, expr syntax.SampleExpr) (promql_
 	if next && r != nil {
 		switch vec := r.(type) {
 		case SampleVector:
-			maxSeriesCapture := func(id string) int { return q.limits.MaxQuerySeries(ctx, id) }
-			maxSeries := validation.SmallestPositiveIntPerTenant(tenantIDs, maxSeriesCapture)
-			mfl := false
-			if rae, ok := expr.(*syntax.RangeAggregationExpr); ok && (rae.Operation == syntax.OpRangeTypeFirstWithTimestamp || rae.Operation == syntax.OpRangeTypeLastWithTimestamp) {
-				mfl = true
-			}
-			return q.JoinSampleVector(ctx, next, vec, stepEvaluator, maxSeries, mfl)
+			return q.JoinSampleVector(ctx, next, vec, stepEvaluator, maxSeries, mergesFirstLast(expr))
 		case ProbabilisticQuantileVector:
 			return JoinQuantileSketchVector(next, vec, stepEvaluator, q.params)
 		case CountMinSketchVector:
@@ -451,12 +1423,33 @@ func (q *query) evalSample(ctx context.Context, expr syntax.SampleExpr) (promql_
 	return nil, errors.New("unexpected empty result")
 }
 
+// discardSamples evaluates all steps of the step evaluator without keeping
+// their samples and returns the number of samples.
+func discardSamples(stepEvaluator StepEvaluator) (int, error) {
+	n := 0
+	for next, _, r := stepEvaluator.Next(); next; next, _, r = stepEvaluator.Next() {
+		if r != nil {
+			n += len(r.SampleVector())
+		}
+	}
+	return n, stepEvaluator.Error()
+}
+
+// mergesFirstLast tells if the series of the sample expression are the first
+// or last samples with their timestamps, merged across the steps.
+func mergesFirstLast(expr syntax.SampleExpr) bool {
+	rae, ok := expr.(*syntax.RangeAggregationExpr)
+	return ok && (rae.Operation == syntax.OpRangeTypeFirstWithTimestamp || rae.Operation == syntax.OpRangeTypeLastWithTimestamp)
+}
+
 func vectorsToSeries(vec promql.Vector, sm map[uint64]promql.Series) {
 	vectorsToSeriesWithLimit(vec, sm, 0) // 0 means no limit
 }
 
-func vectorsToSeriesWithLimit(vec promql.Vector, sm map[uint64]promql.Series, maxSeries int) bool {
-	limitExceeded := false
+// vectorsToSeriesWithLimit appends the samples to their series, creating at
+// most maxSeries series, and returns the number of series it did not create.
+func vectorsToSeriesWithLimit(vec promql.Vector, sm map[uint64]promql.Series, maxSeries int) int {
+	dropped := 0
 	for _, p := range vec {
 		var (
 			series promql.Series
@@ -467,11 +1460,11 @@ func vectorsToSeriesWithLimit(vec promql.Vector, sm map[uint64]promql.Series, ma
 		series, ok = sm[hash]
 
 		// create a new series if under the limit
-		if !ok && !limitExceeded {
+		if !ok {
 			// Check if adding a new series would exceed the limit
 			if maxSeries > 0 && len(sm) >= maxSeries {
 				// We've reached the series limit, skip adding new series
-				limitExceeded = true
+				dropped++
 				continue
 			}
 			series = promql.Series{
@@ -486,7 +1479,7 @@ func vectorsToSeriesWithLimit(vec promql.Vector, sm map[uint64]promql.Series, ma
 		})
 		sm[hash] = series
 	}
-	return limitExceeded
+	return dropped
 }
 
 func multiVariantVectorsToSeries(ctx context.Context, maxSeries int, vec promql.Vector, sm map[string]map[uint64]promql.Series, skippedVariants map[string]struct{}) int {
@@ -520,8 +1513,9 @@ func multiVariantVectorsToSeries(ctx context.Context, maxSeries int, vec promql.
 			// This can cause count to be negative, as we may be removing series added in a previous iteration
 			// However, since we sum this value across all iterations, a negative will make sure the total series count is correct
 			count = count - len(sm[variantLabel])
+			stats.FromContext(ctx).AddDroppedSeries(int64(len(sm[variantLabel])))
 			delete(sm, variantLabel)
-			metadataCtx.AddWarning(fmt.Sprintf("maximum of series (%d) reached for variant (%s)", maxSeries, variantLabel))
+			metadataCtx.AddStructuredWarning(metadata.MaxSeriesPerVariantWarning(maxSeries, variantLabel))
 			continue
 		}
 
@@ -556,8 +1550,9 @@ func (q *query) JoinSampleVector(ctx context.Context, next bool, r StepResult, s
 	if len(vec) > maxSeries {
 		if httpreq.IsLogsDrilldownRequest(ctx) {
 			// For Logs Drilldown requests, return partial results with warning
+			stats.FromContext(ctx).AddDroppedSeries(int64(len(vec) - maxSeries))
 			vec = vec[:maxSeries]
-			metadata.FromContext(ctx).AddWarning(fmt.Sprintf("maximum number of series (%d) reached for a single query; returning partial results", maxSeries))
+			metadata.FromContext(ctx).AddStructuredWarning(metadata.MaxSeriesWarning(maxSeries))
 			// Since we've already reached the series limit, skip processing additional steps and add the initial vector to seriesIndex
 			next = false
 			vectorsToSeries(vec, seriesIndex)
@@ -589,15 +1584,31 @@ func (q *query) JoinSampleVector(ctx context.Context, next bool, r StepResult, s
 		return vec, nil
 	}
 
-	for next {
+	deadline := q.softDeadline()
+	perStepTruncated := false
+	for stepIndex := 0; next; stepIndex++ {
 		vec = r.SampleVector()
 
+		if q.maxSeriesPerStep > 0 && len(vec) > q.maxSeriesPerStep {
+			if !httpreq.IsLogsDrilldownRequest(ctx) {
+				return nil, logqlmodel.NewSeriesPerStepLimitError(q.maxSeriesPerStep)
+			}
+			// For Logs Drilldown requests, keep the series with the lowest labels at this step
+			sort.Slice(vec, func(i, j int) bool { return labels.Compare(vec[i].Metric, vec[j].Metric) < 0 })
+			vec = vec[:q.maxSeriesPerStep]
+			if !perStepTruncated {
+				perStepTruncated = true
+				metadata.FromContext(ctx).AddStructuredWarning(metadata.MaxSeriesPerStepWarning(q.maxSeriesPerStep))
+			}
+		}
+
 		if httpreq.IsLogsDrilldownRequest(ctx) {
 			// For Logs Drilldown requests, use limited vectorsToSeries to prevent exceeding maxSeries
-			limitExceeded := vectorsToSeriesWithLimit(vec, seriesIndex, maxSeries)
+			dropped := vectorsToSeriesWithLimit(vec, seriesIndex, maxSeries)
 			// If the limit was exceeded (series were skipped), add warning and break
-			if limitExceeded {
-				metadata.FromContext(ctx).AddWarning(fmt.Sprintf("maximum number of series (%d) reached for a single query; returning partial results", maxSeries))
+			if dropped > 0 {
+				stats.FromContext(ctx).AddDroppedSeries(int64(dropped))
+				metadata.FromContext(ctx).AddStructuredWarning(metadata.MaxSeriesWarning(maxSeries))
 				break // Break out of the loop to return partial results
 			}
 		} else {
@@ -607,6 +1618,10 @@ func (q *query) JoinSampleVector(ctx context.Context, next bool, r StepResult, s
 				return nil, logqlmodel.NewSeriesLimitError(maxSeries)
 			}
 		}
+		q.onStep(stepIndex)
+		if q.softTimeoutExceeded(ctx, deadline, stepIndex) {
+			break
+		}
 
 		next, _, r = stepEvaluator.Next()
 		if stepEvaluator.Error() != nil {
@@ -614,6 +1629,10 @@ func (q *query) JoinSampleVector(ctx context.Context, next bool, r StepResult, s
 		}
 	}
 
+	if expr, ok := q.params.GetExpression().(syntax.SampleExpr); ok {
+		alignSteps(seriesIndex, stepAlignmentOffset(expr, GetStepAlignment(q.params)))
+	}
+
 	series := make([]promql.Series, 0, len(seriesIndex))
 	for _, s := range seriesIndex {
 		series = append(series, s)
@@ -624,6 +1643,65 @@ func (q *query) JoinSampleVector(ctx context.Context, next bool, r StepResult, s
 	return result, stepEvaluator.Error()
 }
 
+// onStep notifies the configured step callback that the step with the given
+// index has been joined into the result of a range query. If the query is
+// evaluated at a coarser step, the requested steps up to the coarse step, which
+// are interpolated from it and the previous one, are notified instead.
+func (q *query) onStep(stepIndex int) {
+	if q.stepCallback == nil {
+		return
+	}
+	if q.stepFactor <= 1 || q.requested == nil {
+		ts := q.params.Start().Add(time.Duration(stepIndex) * q.params.Step())
+		q.stepCallback(stepIndex, ts.UnixMilli())
+		return
+	}
+	start, step := q.requested.Start(), q.requested.Step()
+	last := int(q.requested.End().Sub(start) / step)
+	from := 0
+	if stepIndex > 0 {
+		from = (stepIndex-1)*q.stepFactor + 1
+	}
+	for i := from; i <= min(stepIndex*q.stepFactor, last); i++ {
+		q.stepCallback(i, start.Add(time.Duration(i)*step).UnixMilli())
+	}
+}
+
+// softDeadline returns when the time budget of the steps of a range query
+// starting now is exhausted, or the zero time if there is no budget.
+func (q *query) softDeadline() time.Time {
+	if q.softTimeout <= 0 {
+		return time.Time{}
+	}
+	return q.now().Add(q.softTimeout)
+}
+
+// softTimeoutExceeded reports whether the deadline passed once the step with
+// the given index has been joined and steps remain, in which case it warns
+// that the result is partial.
+func (q *query) softTimeoutExceeded(ctx context.Context, deadline time.Time, stepIndex int) bool {
+	if deadline.IsZero() || q.now().Before(deadline) {
+		return false
+	}
+	if last := q.params.Start().Add(time.Duration(stepIndex) * q.params.Step()); !last.Before(q.params.End()) {
+		return false
+	}
+	metadata.FromContext(ctx).AddStructuredWarning(metadata.SoftTimeoutWarning(q.softTimeout, stepIndex+1))
+	return true
+}
+
+// alignSteps shifts the timestamps of all points by offset milliseconds.
+func alignSteps(sm map[uint64]promql.Series, offset int64) {
+	if offset == 0 {
+		return
+	}
+	for _, s := range sm {
+		for i := range s.Floats {
+			s.Floats[i].T += offset
+		}
+	}
+}
+
 func (q *query) JoinMultiVariantSampleVector(ctx context.Context, next bool, r StepResult, stepEvaluator StepEvaluator, maxSeries int) (promql_parser.Value, error) {
 	vec := promql.Vector{}
 	if next {
@@ -653,11 +1731,16 @@ func (q *query) JoinMultiVariantSampleVector(ctx context.Context, next bool, r S
 	}
 
 	seriesCount := 0
-	for next {
+	deadline := q.softDeadline()
+	for stepIndex := 0; next; stepIndex++ {
 		vec = r.SampleVector()
 		// Filter out any samples from variants we've already skipped
 		filterVariantVector(&vec, skippedVariants)
 		seriesCount += multiVariantVectorsToSeries(ctx, maxSeries, vec, seriesIndex, skippedVariants)
+		q.onStep(stepIndex)
+		if q.softTimeoutExceeded(ctx, deadline, stepIndex) {
+			break
+		}
 
 		next, _, r = stepEvaluator.Next()
 		if stepEvaluator.Error() != nil {
@@ -710,6 +1793,232 @@ func (q *query) checkIntervalLimit(expr syntax.SampleExpr, limit time.Duration)
 	return err
 }
 
+// sortStable sorts the series of a vector or matrix result by their label
+// string unless the query orders them.
+func (q *query) sortStable(data promql_parser.Value) promql_parser.Value {
+	if ordersSeries(q.params.GetExpression()) {
+		return data
+	}
+	switch v := data.(type) {
+	case promql.Vector:
+		sort.SliceStable(v, func(i, j int) bool { return v[i].Metric.String() < v[j].Metric.String() })
+	case promql.Matrix:
+		sort.SliceStable(v, func(i, j int) bool { return v[i].Metric.String() < v[j].Metric.String() })
+	}
+	return data
+}
+
+// limitLabelLengths truncates or drops the labels of the result exceeding the
+// maximum label name or value length, with a warning.
+func (q *query) limitLabelLengths(ctx context.Context, data promql_parser.Value) (promql_parser.Value, error) {
+	l := &labelLengthLimiter{
+		maxName:   q.maxLabelNameLength,
+		maxValue:  q.maxLabelValueLength,
+		drop:      q.labelLengthPolicy == LabelLengthDrop,
+		direction: q.params.Direction(),
+	}
+	data, err := l.apply(data)
+	if err != nil {
+		return nil, err
+	}
+	if l.limited > 0 {
+		metadata.FromContext(ctx).AddStructuredWarning(metadata.LabelLengthWarning(l.maxName, l.maxValue, l.limited, l.drop))
+	}
+	return data, nil
+}
+
+// roundSamples rounds the sample values of a vector, matrix or scalar result
+// to the given number of significant digits.
+func roundSamples(data promql_parser.Value, digits int) promql_parser.Value {
+	switch v := data.(type) {
+	case promql.Vector:
+		for i := range v {
+			v[i].F = roundSignificant(v[i].F, digits)
+		}
+	case promql.Matrix:
+		for _, s := range v {
+			for i := range s.Floats {
+				s.Floats[i].F = roundSignificant(s.Floats[i].F, digits)
+			}
+		}
+	case promql.Scalar:
+		v.V = roundSignificant(v.V, digits)
+		return v
+	}
+	return data
+}
+
+// roundSignificant rounds f to the given number of significant digits. The
+// value is rounded in decimal, so that the result is the same on all
+// platforms.
+func roundSignificant(f float64, digits int) float64 {
+	if f == 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		return f
+	}
+	r, err := strconv.ParseFloat(strconv.FormatFloat(f, 'g', digits, 64), 64)
+	if err != nil {
+		return f
+	}
+	return r
+}
+
+// ordersSeries reports whether expr has an aggregation whose result order is
+// significant, i.e. topk, bottomk, sort or sort_desc.
+func ordersSeries(expr syntax.Expr) bool {
+	var ordered bool
+	expr.Walk(func(e syntax.Expr) bool {
+		if agg, ok := e.(*syntax.VectorAggregationExpr); ok {
+			switch agg.Operation {
+			case syntax.OpTypeTopK, syntax.OpTypeBottomK, syntax.OpTypeSort, syntax.OpTypeSortDesc:
+				ordered = true
+			}
+		}
+		return !ordered
+	})
+	return ordered
+}
+
+// checkExpressionDepth rejects queries nesting more metric expressions than
+// the maximum expression depth.
+func (q *query) checkExpressionDepth() error {
+	if q.maxExpressionDepth <= 0 {
+		return nil
+	}
+	if depth := sampleExprDepth(q.params.GetExpression()); depth > q.maxExpressionDepth {
+		return fmt.Errorf("%w: expression depth %d exceeds the maximum of %d", logqlmodel.ErrQueryTooComplex, depth, q.maxExpressionDepth)
+	}
+	return nil
+}
+
+// checkPipelineStages rejects queries with a log pipeline of more stages than
+// the maximum.
+func (q *query) checkPipelineStages() error {
+	if q.maxPipelineStages <= 0 {
+		return nil
+	}
+	var err error
+	q.params.GetExpression().Walk(func(e syntax.Expr) bool {
+		if p, ok := e.(*syntax.PipelineExpr); ok && len(p.MultiStages) > q.maxPipelineStages {
+			err = fmt.Errorf("%w: %d pipeline stages exceed the maximum of %d in %s", logqlmodel.ErrQueryTooComplex, len(p.MultiStages), q.maxPipelineStages, p.String())
+		}
+		return err == nil
+	})
+	return err
+}
+
+// checkSelectorLabels rejects queries with a selector without a matcher on one
+// of the required labels or with a matcher on one of the forbidden labels.
+func (q *query) checkSelectorLabels() error {
+	if len(q.requiredLabels) == 0 && len(q.forbiddenLabelMatchers) == 0 {
+		return nil
+	}
+	var err error
+	q.params.GetExpression().Walk(func(e syntax.Expr) bool {
+		m, ok := e.(*syntax.MatchersExpr)
+		if !ok {
+			return err == nil
+		}
+		for _, name := range q.requiredLabels {
+			if !slices.ContainsFunc(m.Mts, func(mt *labels.Matcher) bool { return mt.Name == name && restrictsValues(mt) }) {
+				err = fmt.Errorf("%w: selector %s has no matcher restricting the values of the required label %s", logqlmodel.ErrLabelPolicy, m.String(), name)
+				return false
+			}
+		}
+		for _, mt := range m.Mts {
+			if slices.Contains(q.forbiddenLabelMatchers, mt.Name) {
+				err = fmt.Errorf("%w: selector %s has a matcher on the forbidden label %s", logqlmodel.ErrLabelPolicy, m.String(), mt.Name)
+				return false
+			}
+		}
+		return true
+	})
+	return err
+}
+
+// anyLabelValue is a label value only matched by matchers matching any value.
+const anyLabelValue = "\x00any"
+
+// restrictsValues reports whether the matcher selects some values of its label
+// only: it is an equality or a regular expression matching neither the empty
+// value nor any value, unlike `=~".*"`, `=~".+"` or the negative matchers.
+func restrictsValues(m *labels.Matcher) bool {
+	switch m.Type {
+	case labels.MatchEqual:
+		return m.Value != ""
+	case labels.MatchRegexp:
+		return !m.Matches("") && !m.Matches(anyLabelValue)
+	default:
+		return false
+	}
+}
+
+// checkOffsets rejects the first range selector with a negative offset, which
+// moves its range past the end of the query, unless negative offsets are
+// enabled.
+func (q *query) checkOffsets() error {
+	if q.negativeOffsets {
+		return nil
+	}
+	var err error
+	q.params.GetExpression().Walk(func(e syntax.Expr) bool {
+		if r, ok := e.(*syntax.LogRangeExpr); ok && r.Offset < 0 {
+			err = fmt.Errorf("%w: offset [%s] in %s moves the range past the end of the query", logqlmodel.ErrNegativeOffset, model.Duration(r.Offset), r.String())
+		}
+		return err == nil
+	})
+	return err
+}
+
+// checkSteps rejects range queries with more steps than the maximum number of
+// steps per query.
+func (q *query) checkSteps() error {
+	if q.maxStepsPerQuery <= 0 || GetRangeType(q.params) != RangeType || q.params.Step() <= 0 {
+		return nil
+	}
+	if steps := int64(q.params.End().Sub(q.params.Start()) / q.params.Step()); steps > int64(q.maxStepsPerQuery) {
+		return fmt.Errorf("%w: %d steps exceed the maximum of %d, increase the step or reduce the time range", logqlmodel.ErrQueryTooComplex, steps, q.maxStepsPerQuery)
+	}
+	return nil
+}
+
+// sampleExprDepth returns the number of nested metric expressions on the
+// deepest path of expr.
+func sampleExprDepth(expr syntax.Expr) int {
+	depth, root := 0, true
+	expr.Walk(func(e syntax.Expr) bool {
+		// the walk starts with expr itself.
+		if root {
+			root = false
+			return true
+		}
+		depth = max(depth, sampleExprDepth(e))
+		return false
+	})
+	if _, ok := expr.(syntax.SampleExpr); ok {
+		depth++
+	}
+	return depth
+}
+
+// checkSelectorLookback rejects the first range selector of expr with a range
+// above the maximum lookback per selector.
+func (q *query) checkSelectorLookback(expr syntax.Expr) error {
+	if q.maxLookbackPerSelector <= 0 {
+		return nil
+	}
+	var err error
+	expr.Walk(func(e syntax.Expr) bool {
+		if err != nil {
+			return false
+		}
+		if r, ok := e.(*syntax.LogRangeExpr); ok && r.Interval > q.maxLookbackPerSelector {
+			err = fmt.Errorf("%w: [%s] > [%s] per selector in %s", logqlmodel.ErrIntervalLimit, model.Duration(r.Interval), model.Duration(q.maxLookbackPerSelector), r.String())
+		}
+		return err == nil
+	})
+	return err
+}
+
 func (q *query) evalLiteral(_ context.Context, expr *syntax.LiteralExpr) (promql_parser.Value, error) {
 	value, err := expr.Value()
 	if err != nil {
@@ -727,6 +2036,16 @@ func (q *query) evalLiteral(_ context.Context, expr *syntax.LiteralExpr) (promql
 	return PopulateMatrixFromScalar(s, q.params), nil
 }
 
+// scalarResult returns the single sample of the vector result of an instant
+// scalar() query as a scalar. Range results are returned as is.
+func scalarResult(value promql_parser.Value) promql_parser.Value {
+	vec, ok := value.(promql.Vector)
+	if !ok || len(vec) != 1 {
+		return value
+	}
+	return promql.Scalar{T: vec[0].T, V: vec[0].F}
+}
+
 func (q *query) evalVector(_ context.Context, expr *syntax.VectorExpr) (promql_parser.Value, error) {
 	value, err := expr.Value()
 	if err != nil {
@@ -748,6 +2067,36 @@ func (q *query) evalVector(_ context.Context, expr *syntax.VectorExpr) (promql_p
 	return PopulateMatrixFromScalar(s, q.params), nil
 }
 
+// evalSelectorFree evaluates an expression that doesn't select any logs, such
+// as `vector(1) + vector(2)`, in-process. Tenant limits don't apply since the
+// Querier is never called and the result has at most a single series.
+func (q *query) evalSelectorFree(ctx context.Context, expr syntax.SampleExpr) (promql_parser.Value, error) {
+	stepEvaluator, err := q.evaluator.NewStepEvaluator(ctx, q.evaluator, expr, q.params)
+	if err != nil {
+		return nil, err
+	}
+	defer util.LogErrorWithContext(ctx, "closing SampleExpr", stepEvaluator.Close)
+
+	next, _, r := stepEvaluator.Next()
+	if stepEvaluator.Error() != nil {
+		return nil, stepEvaluator.Error()
+	}
+	return q.JoinSampleVector(ctx, next, r, stepEvaluator, math.MaxInt, false)
+}
+
+// isSelectorFree tells whether a sample expression can be evaluated without
+// selecting any logs.
+func isSelectorFree(expr syntax.SampleExpr) bool {
+	free := true
+	expr.Walk(func(e syntax.Expr) bool {
+		if _, ok := e.(*syntax.LogRangeExpr); ok {
+			free = false
+		}
+		return free
+	})
+	return free
+}
+
 func PopulateMatrixFromScalar(data promql.Scalar, params Params) promql.Matrix {
 	var (
 		start  = params.Start()
@@ -777,7 +2126,14 @@ func PopulateMatrixFromScalar(data promql.Scalar, params Params) promql.Matrix {
 // structuredMetadata and parsed fields populated with structured metadata labels plus the parsed labels respectively.
 // Otherwise, the stream labels are the whole series labels including the stream labels, structured metadata labels and parsed labels.
 func readStreams(i iter.EntryIterator, size uint32, dir logproto.Direction, interval time.Duration) (logqlmodel.Streams, error) {
-	streams := map[string]*logproto.Stream{}
+	var (
+		result = logqlmodel.Streams{}
+		// most log queries return a single stream, so its entries are appended
+		// to the result directly and the index of the streams by their labels
+		// is only built once a second stream shows up.
+		index map[string]int
+		cur   = -1
+	)
 	respSize := uint32(0)
 	// lastEntry should be a really old time so that the first comparison is always true, we use a negative
 	// value here because many unit tests start at time.Unix(0,0)
@@ -794,24 +2150,28 @@ func readStreams(i iter.EntryIterator, size uint32, dir logproto.Direction, inte
 		// If lastEntry.Unix < 0 this is the first pass through the loop and we should output the line.
 		// Then check to see if the entry is equal to, or past a forward or reverse step
 		if interval == 0 || lastEntry.Unix() < 0 || forwardShouldOutput || backwardShouldOutput {
-			stream, ok := streams[streamLabels]
-			if !ok {
-				stream = &logproto.Stream{
-					Labels: streamLabels,
+			if cur < 0 || result[cur].Labels != streamLabels {
+				if index == nil && len(result) == 1 {
+					index = map[string]int{result[0].Labels: 0}
+				}
+				var ok bool
+				if cur, ok = index[streamLabels]; !ok {
+					cur = len(result)
+					result = append(result, logproto.Stream{Labels: streamLabels})
+					if index != nil {
+						index[streamLabels] = cur
+					}
 				}
-				streams[streamLabels] = stream
 			}
-			stream.Entries = append(stream.Entries, entry)
+			result[cur].Entries = append(result[cur].Entries, entry)
 			lastEntry = i.At().Timestamp
 			respSize++
 		}
 	}
 
-	result := make(logqlmodel.Streams, 0, len(streams))
-	for _, stream := range streams {
-		result = append(result, *stream)
+	if len(result) > 1 {
+		sort.Sort(result)
 	}
-	sort.Sort(result)
 	return result, i.Err()
 }
 
@@ -822,6 +2182,7 @@ type groupedAggregation struct {
 	groupCount  int
 	heap        vectorByValueHeap
 	reverseHeap vectorByReverseValueHeap
+	values      vector.HeapByMaxValue
 }
 
 func (q *query) evalVariants(
@@ -855,6 +2216,9 @@ func (q *query) evalVariants(
 			}
 		}
 	}
+	if err = q.checkSelectorLookback(expr); err != nil {
+		return nil, err
+	}
 
 	stepEvaluator, err := q.evaluator.NewVariantsStepEvaluator(ctx, expr, q.params)
 	if err != nil {
@@ -872,10 +2236,31 @@ func (q *query) evalVariants(
 		case SampleVector:
 			maxSeriesCapture := func(id string) int { return q.limits.MaxQuerySeries(ctx, id) }
 			maxSeries := validation.SmallestPositiveIntPerTenant(tenantIDs, maxSeriesCapture)
-			return q.JoinMultiVariantSampleVector(ctx, next, vec, stepEvaluator, maxSeries)
+			res, err := q.JoinMultiVariantSampleVector(ctx, next, vec, stepEvaluator, maxSeries)
+			if err != nil || expr.Merge() == "" {
+				return res, err
+			}
+			return mergeVariants(res, expr.Merge(), expr.Grouping()), nil
 		default:
 			return nil, fmt.Errorf("unsupported result type: %T", r)
 		}
 	}
 	return nil, errors.New("unexpected empty result")
 }
+
+// mergeVariants merges the series of the vector or matrix result of a variants
+// query with op, by the grouping if any.
+func mergeVariants(res promql_parser.Value, op string, grouping *syntax.Grouping) promql_parser.Value {
+	switch v := res.(type) {
+	case promql.Vector:
+		merged := MergeVariants(VectorToMatrix(v), op, grouping)
+		vec := make(promql.Vector, 0, len(merged))
+		for _, s := range merged {
+			vec = append(vec, promql.Sample{T: s.Floats[0].T, F: s.Floats[0].F, Metric: s.Metric})
+		}
+		return vec
+	case promql.Matrix:
+		return MergeVariants(v, op, grouping)
+	}
+	return res
+}
@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -35,7 +40,7 @@ import (
 
 var (
 	testSize        = int64(300)
-	ErrMock         = errors.New("error")
+	ErrMock         = iter.ErrIterator
 	ErrMockMultiple = util.MultiError{ErrMock, ErrMock}
 )
 
@@ -52,8 +57,12 @@ func TestEngine_checkIntervalLimit(t *testing.T) {
 		{query: `rate({app="foo"} [1h])`, expErr: "[1h] > [10m]"},
 		{query: `sum(rate({app="foo"} [1h]))`, expErr: "[1h] > [10m]"},
 		{query: `sum_over_time({app="foo"} |= "foo" | json | unwrap bar [1h])`, expErr: "[1h] > [10m]"},
+		{query: `deriv({app="foo"} | unwrap bar [1h])`, expErr: "[1h] > [10m]"},
+		{query: `delta({app="foo"} | unwrap bar [5m])`, expErr: ""},
 		{query: `variants(rate({app="foo"}[5m])) of ({app="foo"}[5m])`, expErr: ""},
 		{query: `variants(rate({app="foo"}[1h])) of ({app="foo"}[1h])`, expErr: "[1h] > [10m]"},
+		{query: `variants(rate({app="foo"}[5m]), rate({app="foo"}[1m])) of ({app="foo"}[5m])`, expErr: ""},
+		{query: `variants(rate({app="foo"}[5m]), rate({app="foo"}[1h])) of ({app="foo"}[5m])`, expErr: "[1h] > [10m]"},
 	} {
 		for _, downstream := range []bool{true, false} {
 			t.Run(fmt.Sprintf("%v/downstream=%v", tc.query, downstream), func(t *testing.T) {
@@ -993,6 +1002,42 @@ func TestEngine_InstantQuery(t *testing.T) {
 				{T: 60 * 1000, F: 0, Metric: labels.FromStrings("app", "foo", "machine", "fuzz", "pool", "foo")},
 			},
 		},
+		{
+			`sum by (app,pool) (count_over_time({app="foo"}[1m])) + on (app) group_right (pool) sum by (app,machine) (count_over_time({app="foo"}[1m]))`,
+			time.Unix(60, 0),
+			logproto.FORWARD,
+			0,
+			[][]logproto.Series{
+				{newSeries(testSize, identity, `{app="foo",pool="foo"}`)},
+				{newSeries(testSize, identity, `{app="foo",machine="fuzz"}`), newSeries(testSize, identity, `{app="foo",machine="buzz"}`)},
+			},
+			[]SelectSampleParams{
+				{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(60, 0), Selector: `sum by (app,pool) (count_over_time({app="foo"}[1m]))`}},
+				{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(60, 0), Selector: `sum by (app,machine) (count_over_time({app="foo"}[1m]))`}},
+			},
+			promql.Vector{
+				{T: 60 * 1000, F: 120, Metric: labels.FromStrings("app", "foo", "machine", "buzz", "pool", "foo")},
+				{T: 60 * 1000, F: 120, Metric: labels.FromStrings("app", "foo", "machine", "fuzz", "pool", "foo")},
+			},
+		},
+		{
+			`sum by (app,pool) (count_over_time({app="foo"}[1m])) * on (app) group_right (pool) sum by (app,machine) (count_over_time({app="foo"}[1m]))`,
+			time.Unix(60, 0),
+			logproto.FORWARD,
+			0,
+			[][]logproto.Series{
+				{newSeries(testSize, identity, `{app="foo",pool="foo"}`)},
+				{newSeries(testSize, identity, `{app="foo",machine="fuzz"}`), newSeries(testSize, identity, `{app="foo",machine="buzz"}`)},
+			},
+			[]SelectSampleParams{
+				{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(60, 0), Selector: `sum by (app,pool) (count_over_time({app="foo"}[1m]))`}},
+				{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(60, 0), Selector: `sum by (app,machine) (count_over_time({app="foo"}[1m]))`}},
+			},
+			promql.Vector{
+				{T: 60 * 1000, F: 3600, Metric: labels.FromStrings("app", "foo", "machine", "buzz", "pool", "foo")},
+				{T: 60 * 1000, F: 3600, Metric: labels.FromStrings("app", "foo", "machine", "fuzz", "pool", "foo")},
+			},
+		},
 	} {
 		t.Run(fmt.Sprintf("%s %s", test.qs, test.direction), func(t *testing.T) {
 			eng := NewEngine(EngineOpts{}, newQuerierRecorder(t, test.data, test.params), NoLimits, log.NewNopLogger())
@@ -1689,6 +1734,62 @@ func TestEngine_RangeQuery(t *testing.T) {
 				},
 			},
 		},
+		{
+			`
+			rate({app=~"foo|bar"}[1m]) unless on (app)
+			rate({app="bar"}[1m])
+			`,
+			time.Unix(60, 0), time.Unix(180, 0), 30 * time.Second, 0, logproto.FORWARD, 100,
+			[][]logproto.Series{
+				{
+					newSeries(testSize, factor(5, identity), `{app="foo", pod="a"}`),
+					newSeries(testSize, factor(5, identity), `{app="bar", pod="a"}`),
+				},
+				{
+					newSeries(testSize, factor(5, identity), `{app="bar", pod="b"}`),
+				},
+			},
+			[]SelectSampleParams{
+				{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(180, 0), Selector: `rate({app=~"foo|bar"}[1m])`}},
+				{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(180, 0), Selector: `rate({app="bar"}[1m])`}},
+			},
+			promql.Matrix{
+				promql.Series{
+					Metric: labels.FromStrings("app", "foo", "pod", "a"),
+					Floats: []promql.FPoint{{T: 60 * 1000, F: 0.2}, {T: 90 * 1000, F: 0.2}, {T: 120 * 1000, F: 0.2}, {T: 150 * 1000, F: 0.2}, {T: 180 * 1000, F: 0.2}},
+				},
+			},
+		},
+		{
+			`
+			rate({app=~"foo|bar"}[1m]) or ignoring (pod)
+			rate({app="bar"}[1m])
+			`,
+			time.Unix(60, 0), time.Unix(180, 0), 30 * time.Second, 0, logproto.FORWARD, 100,
+			[][]logproto.Series{
+				{
+					newSeries(testSize, factor(5, identity), `{app="foo", pod="a"}`),
+				},
+				{
+					newSeries(testSize, factor(10, identity), `{app="foo", pod="b"}`),
+					newSeries(testSize, factor(10, identity), `{app="bar", pod="b"}`),
+				},
+			},
+			[]SelectSampleParams{
+				{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(180, 0), Selector: `rate({app=~"foo|bar"}[1m])`}},
+				{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(180, 0), Selector: `rate({app="bar"}[1m])`}},
+			},
+			promql.Matrix{
+				promql.Series{
+					Metric: labels.FromStrings("app", "bar", "pod", "b"),
+					Floats: []promql.FPoint{{T: 60 * 1000, F: 0.1}, {T: 90 * 1000, F: 0.1}, {T: 120 * 1000, F: 0.1}, {T: 150 * 1000, F: 0.1}, {T: 180 * 1000, F: 0.1}},
+				},
+				promql.Series{
+					Metric: labels.FromStrings("app", "foo", "pod", "a"),
+					Floats: []promql.FPoint{{T: 60 * 1000, F: 0.2}, {T: 90 * 1000, F: 0.2}, {T: 120 * 1000, F: 0.2}, {T: 150 * 1000, F: 0.2}, {T: 180 * 1000, F: 0.2}},
+				},
+			},
+		},
 		{
 			`
 			rate({app=~"foo|bar"}[1m]) +
@@ -2513,6 +2614,8 @@ func TestJoinMultiVariantSampleVector(t *testing.T) {
 		stepResults      []StepResult
 		expectedResult   promql_parser.Value
 		expectedWarnings []string
+		// expectedCodes holds the code and fields of the expected warnings.
+		expectedCodes []metadata.Warning
 	}{
 		{
 			name:      "instant query within limits",
@@ -2561,6 +2664,10 @@ func TestJoinMultiVariantSampleVector(t *testing.T) {
 				{T: 60 * 1000, F: 1, Metric: labels.FromStrings(constants.VariantLabel, "1", "app", "foo")},
 			},
 			expectedWarnings: []string{"maximum of series (3) reached for variant (0)"},
+			expectedCodes: []metadata.Warning{{
+				Code:   metadata.WarningCodeMaxSeriesPerVariant,
+				Fields: map[string]string{"limit": "3", "variant": "0"},
+			}},
 		},
 		{
 			name:      "range query with multiple steps within limits",
@@ -2669,6 +2776,10 @@ func TestJoinMultiVariantSampleVector(t *testing.T) {
 				},
 			},
 			expectedWarnings: []string{"maximum of series (3) reached for variant (1)"},
+			expectedCodes: []metadata.Warning{{
+				Code:   metadata.WarningCodeMaxSeriesPerVariant,
+				Fields: map[string]string{"limit": "3", "variant": "1"},
+			}},
 		},
 	}
 
@@ -2691,6 +2802,15 @@ func TestJoinMultiVariantSampleVector(t *testing.T) {
 			if tc.expectedWarnings != nil {
 				require.Equal(t, tc.expectedWarnings, metadataCtx.Warnings())
 			}
+			if tc.expectedCodes != nil {
+				structured := metadataCtx.StructuredWarnings()
+				require.Len(t, structured, len(tc.expectedCodes))
+				for i, w := range tc.expectedCodes {
+					require.Equal(t, w.Code, structured[i].Code)
+					require.Equal(t, w.Fields, structured[i].Fields)
+					require.Equal(t, tc.expectedWarnings[i], structured[i].Message)
+				}
+			}
 		})
 	}
 }
@@ -2971,6 +3091,124 @@ func TestEngine_Stats(t *testing.T) {
 	require.Equal(t, queueTime.Seconds(), r.Statistics.Summary.QueueTime)
 }
 
+// decompressingQuerier records a decompressed byte for every select.
+type decompressingQuerier struct {
+	Querier
+}
+
+func (q decompressingQuerier) SelectSamples(ctx context.Context, params SelectSampleParams) (iter.SampleIterator, error) {
+	stats.FromContext(ctx).AddDecompressedBytes(1)
+	return q.Querier.SelectSamples(ctx, params)
+}
+
+func TestEngine_ExecStats(t *testing.T) {
+	querier := decompressingQuerier{NewMockQuerier(0, []logproto.Stream{newStream(600, identity, `{app="foo"}`)})}
+	params, err := NewLiteralParams(`count_over_time({app="foo"}[1m])`, time.Unix(60, 0), time.Unix(600, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	// a frozen clock measures no execution time, so that the statistics of
+	// both executions are equal.
+	frozen := time.Unix(1000, 0)
+	eng := NewEngine(EngineOpts{Now: func() time.Time { return frozen }}, querier, NoLimits, log.NewNopLogger())
+
+	res, err := eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Len(t, res.Data.(promql.Matrix)[0].Floats, 10)
+
+	st, err := eng.Query(params).(StatsExecutor).ExecStats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, res.Statistics, st)
+	require.Equal(t, int64(1), st.TotalDecompressedBytes())
+	require.Equal(t, int64(10), st.Summary.TotalEntriesReturned)
+
+	q := eng.Query(params).(*query)
+	q.statsOnly = true
+	res, err = q.Exec(ctx)
+	require.NoError(t, err)
+	require.Nil(t, res.Data)
+	require.Equal(t, st, res.Statistics)
+}
+
+func TestEngine_ExecRange(t *testing.T) {
+	querier := decompressingQuerier{NewMockQuerier(0, []logproto.Stream{newStream(600, identity, `{app="foo"}`)})}
+	const qs = `sum(count_over_time({app="foo"}[1m]))`
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	frozen := time.Unix(1000, 0)
+	eng := NewEngine(EngineOpts{Now: func() time.Time { return frozen }}, querier, NoLimits, log.NewNopLogger())
+
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	q := eng.Query(params).(RangeExecutor)
+
+	for _, start := range []time.Time{time.Unix(60, 0), time.Unix(240, 0), time.Unix(420, 0)} {
+		end := start.Add(2 * time.Minute)
+		res, err := q.ExecRange(ctx, start, end, 30*time.Second)
+		require.NoError(t, err)
+
+		fresh, err := NewLiteralParams(qs, start, end, 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		expected, err := eng.Query(fresh).Exec(ctx)
+		require.NoError(t, err)
+
+		require.Equal(t, expected.Data, res.Data)
+		require.Equal(t, expected.Statistics, res.Statistics)
+		require.Equal(t, start.UnixMilli(), res.Data.(promql.Matrix)[0].Floats[0].T)
+	}
+}
+
+func TestQuery_Executions(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{newStream(600, identity, `{app="foo"}`)})
+	const qs = `sum(count_over_time({app="foo"}[1m]))`
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	frozen := time.Unix(1000, 0)
+	// the minimum step overrides the step of the params during each execution.
+	limits := &fakeLimits{maxSeries: math.MaxInt32, timeout: time.Hour, minStep: 30 * time.Second}
+	eng := NewEngine(EngineOpts{Now: func() time.Time { return frozen }}, querier, limits, log.NewNopLogger())
+
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	expected, err := eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	other, err := eng.Query(params.WithRange(time.Unix(240, 0), time.Unix(360, 0), time.Second)).Exec(ctx)
+	require.NoError(t, err)
+
+	q := eng.Query(params).(*query)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			res, err := q.Exec(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, expected.Data, res.Data)
+		}()
+		go func() {
+			defer wg.Done()
+			st, err := q.ExecStats(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, expected.Statistics.Summary.TotalEntriesReturned, st.Summary.TotalEntriesReturned)
+		}()
+		go func() {
+			defer wg.Done()
+			res, err := q.ExecRange(ctx, time.Unix(240, 0), time.Unix(360, 0), time.Second)
+			assert.NoError(t, err)
+			assert.Equal(t, other.Data, res.Data)
+		}()
+		go func() {
+			defer wg.Done()
+			sink := &memorySink{}
+			_, err := q.ExecToSink(ctx, sink)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, expected.Data.(promql.Matrix), sink.series)
+		}()
+	}
+	wg.Wait()
+
+	// the executions left the query untouched.
+	require.Equal(t, params, q.params)
+	require.False(t, q.statsOnly)
+}
+
 type metaQuerier struct{}
 
 func (metaQuerier) SelectLogs(ctx context.Context, _ SelectLogParams) (iter.EntryIterator, error) {
@@ -3138,6 +3376,8 @@ func TestStepEvaluator_Error(t *testing.T) {
 		qs      string
 		querier Querier
 		err     error
+		// expr is the subexpression named in the error message.
+		expr string
 	}{
 		{
 			"rangeAggEvaluator",
@@ -3151,6 +3391,7 @@ func TestStepEvaluator_Error(t *testing.T) {
 				},
 			},
 			ErrMock,
+			`count_over_time({app="foo"}[1m])`,
 		},
 		{
 			"stream",
@@ -3164,6 +3405,7 @@ func TestStepEvaluator_Error(t *testing.T) {
 				},
 			},
 			ErrMock,
+			"",
 		},
 		{
 			"binOpStepEvaluator",
@@ -3177,6 +3419,7 @@ func TestStepEvaluator_Error(t *testing.T) {
 				},
 			},
 			ErrMockMultiple,
+			`count_over_time({app="foo"}[1m])`,
 		},
 	}
 
@@ -3188,7 +3431,16 @@ func TestStepEvaluator_Error(t *testing.T) {
 			require.NoError(t, err)
 			q := eng.Query(params)
 			_, err = q.Exec(user.InjectOrgID(context.Background(), "fake"))
-			require.Equal(t, tc.err, err)
+			require.ErrorIs(t, err, ErrMock)
+			if tc.expr == "" {
+				require.Equal(t, tc.err, err)
+				return
+			}
+			require.ErrorContains(t, err, "error evaluating "+tc.expr+": ")
+			if multi, ok := tc.err.(util.MultiError); ok {
+				require.IsType(t, multi, err)
+				require.Len(t, err, len(multi))
+			}
 		})
 	}
 }
@@ -3235,6 +3487,7 @@ func TestEngine_MaxRangeInterval(t *testing.T) {
 		{`topk(1,rate(({app=~"foo|bar"})[2d]))`, logproto.FORWARD, true},
 		{`topk(1,rate(({app=~"foo|bar"})[1d]))`, logproto.FORWARD, false},
 		{`topk(1,rate({app=~"foo|bar"}[12h]) / (rate({app="baz"}[23h]) + rate({app="fiz"}[25h])))`, logproto.FORWARD, true},
+		{`count_values_over_time("val", {app=~"foo|bar"} | unwrap foo [2d])`, logproto.FORWARD, true},
 	} {
 		t.Run(test.qs, func(t *testing.T) {
 			params, err := NewLiteralParams(test.qs, time.Unix(0, 0), time.Unix(100000, 0), 60*time.Second, 0, test.direction, 1000, nil, nil)
@@ -3252,509 +3505,1147 @@ func TestEngine_MaxRangeInterval(t *testing.T) {
 	}
 }
 
-// go test -mod=vendor ./pkg/logql/ -bench=.  -benchmem -memprofile memprofile.out -cpuprofile cpuprofile.out
-func BenchmarkRangeQuery100000(b *testing.B) {
-	benchmarkRangeQuery(int64(100000), b)
-}
+func TestEngine_MaxLookbackPerSelector(t *testing.T) {
+	// the maximum query range of the tenant lets every selector below through.
+	eng := NewEngine(EngineOpts{MaxLookbackPerSelector: 24 * time.Hour}, getLocalQuerier(100000), &fakeLimits{rangeLimit: 72 * time.Hour, maxSeries: 100000, multiVariantQueryEnable: true}, log.NewNopLogger())
 
-func BenchmarkRangeQuery200000(b *testing.B) {
-	benchmarkRangeQuery(int64(200000), b)
-}
+	for _, test := range []struct {
+		qs          string
+		expectedErr string
+	}{
+		{`topk(1,rate(({app=~"foo|bar"})[2d]))`, `[interval] value exceeds limit: [2d] > [1d] per selector in {app=~"foo|bar"}[2d]`},
+		{`topk(1,rate(({app=~"foo|bar"})[1d]))`, ``},
+		{
+			`topk(1,rate({app=~"foo|bar"}[12h]) / (rate({app="baz"}[2d]) + rate({app="fiz"}[3d])))`,
+			`[interval] value exceeds limit: [2d] > [1d] per selector in {app="baz"}[2d]`,
+		},
+		{
+			`variants(count_over_time({app="foo"}[2d])) of ({app="foo"}[2d])`,
+			`[interval] value exceeds limit: [2d] > [1d] per selector in {app="foo"}[2d]`,
+		},
+	} {
+		t.Run(test.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(test.qs, time.Unix(0, 0), time.Unix(100000, 0), 60*time.Second, 0, logproto.FORWARD, 1000, nil, nil)
+			require.NoError(t, err)
 
-func BenchmarkRangeQuery500000(b *testing.B) {
-	benchmarkRangeQuery(int64(500000), b)
+			_, err = eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			if test.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, logqlmodel.ErrIntervalLimit)
+			require.EqualError(t, err, test.expectedErr)
+		})
+	}
 }
 
-func BenchmarkRangeQuery1000000(b *testing.B) {
-	benchmarkRangeQuery(int64(1000000), b)
+type blockingQuerier struct {
+	wait time.Duration
 }
 
-var result promql_parser.Value
-
-func benchmarkRangeQuery(testsize int64, b *testing.B) {
-	b.ReportAllocs()
-	eng := NewEngine(EngineOpts{}, getLocalQuerier(testsize), NoLimits, log.NewNopLogger())
-	start := time.Unix(0, 0)
-	end := time.Unix(testsize, 0)
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		for _, test := range []struct {
-			qs        string
-			direction logproto.Direction
-		}{
-			{`{app="foo"}`, logproto.FORWARD},
-			{`{app="bar"} |= "foo" |~ ".+bar"`, logproto.BACKWARD},
-			{`rate({app="foo"} |~".+bar" [1m])`, logproto.BACKWARD},
-			{`rate({app="foo"}[30s])`, logproto.FORWARD},
-			{`count_over_time({app="foo"} |~".+bar" [1m])`, logproto.BACKWARD},
-			{`count_over_time(({app="foo"} |~".+bar")[5m])`, logproto.BACKWARD},
-			{`avg(count_over_time({app=~"foo|bar"} |~".+bar" [1m]))`, logproto.FORWARD},
-			{`min(rate({app=~"foo|bar"} |~".+bar" [1m]))`, logproto.FORWARD},
-			{`max by (app) (rate({app=~"foo|bar"} |~".+bar" [1m]))`, logproto.FORWARD},
-			{`max(rate({app=~"foo|bar"} |~".+bar" [1m]))`, logproto.FORWARD},
-			{`sum(rate({app=~"foo|bar"} |~".+bar" [1m]))`, logproto.FORWARD},
-			{`sum(count_over_time({app=~"foo|bar"} |~".+bar" [1m])) by (app)`, logproto.FORWARD},
-			{`count(count_over_time({app=~"foo|bar"} |~".+bar" [1m])) without (app)`, logproto.FORWARD},
-			{`stdvar without (app) (count_over_time(({app=~"foo|bar"} |~".+bar")[1m])) `, logproto.FORWARD},
-			{`stddev(count_over_time(({app=~"foo|bar"} |~".+bar")[1m])) `, logproto.FORWARD},
-			{`rate(({app=~"foo|bar"} |~".+bar")[1m])`, logproto.FORWARD},
-			{`topk(2,rate(({app=~"foo|bar"} |~".+bar")[1m]))`, logproto.FORWARD},
-			{`topk(1,rate(({app=~"foo|bar"} |~".+bar")[1m]))`, logproto.FORWARD},
-			{`topk(1,rate(({app=~"foo|bar"} |~".+bar")[1m])) by (app)`, logproto.FORWARD},
-			{`bottomk(2,rate(({app=~"foo|bar"} |~".+bar")[1m]))`, logproto.FORWARD},
-			{`bottomk(3,rate(({app=~"foo|bar"} |~".+bar")[1m])) without (app)`, logproto.FORWARD},
-		} {
-			params, err := NewLiteralParams(test.qs, start, end, 60*time.Second, 0, logproto.BACKWARD, 1000, nil, nil)
-			require.NoError(b, err)
-			q := eng.Query(params)
+func (b blockingQuerier) block(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(b.wait):
+		return nil
+	}
+}
 
-			res, err := q.Exec(user.InjectOrgID(context.Background(), "fake"))
-			if err != nil {
-				b.Fatal(err)
-			}
-			result = res.Data
-			if result == nil {
-				b.Fatal("unexpected nil result")
-			}
-		}
+func (b blockingQuerier) SelectLogs(ctx context.Context, _ SelectLogParams) (iter.EntryIterator, error) {
+	if err := b.block(ctx); err != nil {
+		return nil, err
 	}
+	return iter.NoopEntryIterator, nil
 }
 
-// TestHashingStability tests logging stability between engine and RecordRangeAndInstantQueryMetrics methods.
-func TestHashingStability(t *testing.T) {
-	ctx := user.InjectOrgID(context.Background(), "fake")
-	params := LiteralParams{
-		start:     time.Unix(0, 0),
-		end:       time.Unix(5, 0),
-		step:      60 * time.Second,
-		direction: logproto.FORWARD,
-		limit:     1000,
+func (b blockingQuerier) SelectSamples(ctx context.Context, _ SelectSampleParams) (iter.SampleIterator, error) {
+	if err := b.block(ctx); err != nil {
+		return nil, err
 	}
+	return iter.NoopSampleIterator, nil
+}
 
-	queryWithEngine := func() string {
-		buf := bytes.NewBufferString("")
-		logger := log.NewLogfmtLogger(buf)
-		eng := NewEngine(EngineOpts{LogExecutingQuery: true}, getLocalQuerier(4), NoLimits, logger)
+func TestEngine_QueryTimeout(t *testing.T) {
+	timeout := 10 * time.Millisecond
+	eng := NewEngine(EngineOpts{}, blockingQuerier{wait: time.Second}, &fakeLimits{maxSeries: 100, timeout: timeout}, log.NewNopLogger())
 
-		parsed, err := syntax.ParseExpr(params.QueryString())
+	for _, qs := range []string{
+		`{app="foo"}`,
+		`count_over_time({app="foo"}[1m])`,
+	} {
+		t.Run(qs, func(t *testing.T) {
+			params, err := NewLiteralParams(qs, time.Unix(0, 0), time.Unix(60, 0), 10*time.Second, 0, logproto.BACKWARD, 100, nil, nil)
+			require.NoError(t, err)
+
+			_, err = eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.ErrorIs(t, err, logqlmodel.ErrQueryTimeout)
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+
+			var timeoutErr *logqlmodel.QueryTimeoutError
+			require.ErrorAs(t, err, &timeoutErr)
+			require.Equal(t, timeout, timeoutErr.Limit)
+			require.GreaterOrEqual(t, timeoutErr.Elapsed, timeout)
+			require.Equal(t, fmt.Sprintf("query timed out after %s: the configured query timeout is 10ms", timeoutErr.Elapsed), err.Error())
+		})
+	}
+
+	t.Run("parent deadline", func(t *testing.T) {
+		params, err := NewLiteralParams(`{app="foo"}`, time.Unix(0, 0), time.Unix(60, 0), 0, 0, logproto.BACKWARD, 100, nil, nil)
 		require.NoError(t, err)
-		params.queryExpr = parsed
 
-		query := eng.Query(params)
-		_, err = query.Exec(ctx)
+		eng := NewEngine(EngineOpts{}, blockingQuerier{wait: time.Second}, &fakeLimits{maxSeries: 100, timeout: time.Hour}, log.NewNopLogger())
+		ctx, cancel := context.WithTimeout(user.InjectOrgID(context.Background(), "fake"), timeout)
+		defer cancel()
+
+		_, err = eng.Query(params).Exec(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NotErrorIs(t, err, logqlmodel.ErrQueryTimeout)
+	})
+}
+
+func TestEngine_StepAlignment(t *testing.T) {
+	const qs = `count_over_time({app="foo"}[1m])`
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{newSeries(testSize, factor(10, identity), `{app="foo"}`)}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(180, 0), Selector: qs}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+
+	exec := func(t *testing.T, alignment StepAlignment) promql.Matrix {
+		params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
 		require.NoError(t, err)
-		return buf.String()
+		res, err := eng.Query(params.WithStepAlignment(alignment)).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.NoError(t, err)
+		m, ok := res.Data.(promql.Matrix)
+		require.True(t, ok)
+		return m
 	}
 
-	queryDirectly := func() string {
-		statsResult := stats.Result{
-			Summary: stats.Summary{
-				BytesProcessedPerSecond: 100000,
-				QueueTime:               0.000000002,
-				ExecTime:                25.25,
-				TotalBytesProcessed:     100000,
-				TotalEntriesReturned:    10,
-			},
-		}
-		buf := bytes.NewBufferString("")
-		logger := log.NewLogfmtLogger(buf)
-		RecordRangeAndInstantQueryMetrics(ctx, logger, params, "200", statsResult, logqlmodel.Streams{logproto.Stream{Entries: make([]logproto.Entry, 10)}})
-		return buf.String()
-	}
+	end := exec(t, StepAlignmentEnd)
+	require.Len(t, end, 1)
+	require.Equal(t, []promql.FPoint{{T: 60 * 1000, F: 6}, {T: 90 * 1000, F: 6}, {T: 120 * 1000, F: 6}, {T: 150 * 1000, F: 6}, {T: 180 * 1000, F: 6}}, end[0].Floats)
 
-	for _, test := range []struct {
-		qs string
+	for _, tc := range []struct {
+		alignment StepAlignment
+		offset    int64
 	}{
-		{`sum by(query_hash) (count_over_time({app="myapp",env="myenv"} |= "error" |= "metrics.go" | logfmt [10s]))`},
-		{`sum (count_over_time({app="myapp",env="myenv"} |= "error" |= "metrics.go" | logfmt [10s])) by(query_hash)`},
+		{"", 0},
+		{StepAlignmentStart, -60 * 1000},
+		{StepAlignmentCenter, -30 * 1000},
 	} {
-		params.queryString = test.qs
-		expectedQueryHash := util.HashedQuery(test.qs)
+		t.Run(string(tc.alignment), func(t *testing.T) {
+			actual := exec(t, tc.alignment)
+			require.Len(t, actual, 1)
+			require.Equal(t, end[0].Metric, actual[0].Metric)
+			require.Len(t, actual[0].Floats, len(end[0].Floats))
+			for i, p := range actual[0].Floats {
+				require.Equal(t, end[0].Floats[i].T+tc.offset, p.T)
+				require.Equal(t, end[0].Floats[i].F, p.F)
+			}
+		})
+	}
+}
 
-		// check that both places will end up having the same query hash, even though they're emitting different log lines.
-		withEngine := queryWithEngine()
-		require.Contains(t, withEngine, fmt.Sprintf("query_hash=%d", expectedQueryHash))
-		require.Contains(t, withEngine, "step=1m0s")
+func TestEngine_ResultTransform(t *testing.T) {
+	const qs = `count_over_time({app="foo"}[10m])`
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{newSeries(testSize, factor(10, identity), `{app="foo"}`)}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(180, 0), Selector: qs}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
 
-		directly := queryDirectly()
-		require.Contains(t, directly, fmt.Sprintf("query_hash=%d", expectedQueryHash))
-		require.Contains(t, directly, "length=5s")
-		require.Contains(t, directly, "latency=slow")
-	}
-}
+	// the window fills up, so the counts increase monotonically.
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{
+		promql.Series{
+			Metric: labels.FromStrings("app", "foo"),
+			Floats: []promql.FPoint{{T: 60_000, F: 7}, {T: 90_000, F: 10}, {T: 120_000, F: 13}, {T: 150_000, F: 16}, {T: 180_000, F: 19}},
+		},
+	}, res.Data)
 
-func TestUnexpectedEmptyResults(t *testing.T) {
-	ctx := user.InjectOrgID(context.Background(), "fake")
+	res, err = eng.Query(params.WithResultTransform(ResultTransformStepDelta)).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{
+		promql.Series{
+			Metric: labels.FromStrings("app", "foo"),
+			Floats: []promql.FPoint{{T: 90_000, F: 3}, {T: 120_000, F: 3}, {T: 150_000, F: 3}, {T: 180_000, F: 3}},
+		},
+	}, res.Data)
+}
 
-	mock := &mockEvaluatorFactory{
-		SampleEvaluatorFunc(
-			func(context.Context, SampleEvaluatorFactory, syntax.SampleExpr, Params) (StepEvaluator, error) {
-				return EmptyEvaluator[SampleVector]{value: nil}, nil
-			},
-		),
-		VariantsEvaluatorFunc(
-			func(context.Context, syntax.VariantsExpr, Params) (StepEvaluator, error) {
-				return EmptyEvaluator[SampleVector]{value: nil}, nil
-			},
-		),
-	}
+func TestEngine_Hold(t *testing.T) {
+	const qs = `count_over_time({app="foo"}[30s])`
+	// no samples within (60s, 90s].
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: []logproto.Sample{
+			{Timestamp: time.Unix(40, 0).UnixNano(), Value: 1, Hash: 1},
+			{Timestamp: time.Unix(50, 0).UnixNano(), Value: 1, Hash: 2},
+			{Timestamp: time.Unix(100, 0).UnixNano(), Value: 1, Hash: 3},
+		}}}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(120, 0), Selector: qs}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(120, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
 
-	eng := NewEngine(EngineOpts{}, nil, NoLimits, log.NewNopLogger())
-	params, err := NewLiteralParams(`first_over_time({a=~".+"} | logfmt | unwrap value [1s])`, time.Now(), time.Now(), 0, 0, logproto.BACKWARD, 0, nil, nil)
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
 	require.NoError(t, err)
-	q := eng.Query(params).(*query)
-	q.evaluator = mock
+	require.Equal(t, promql.Matrix{
+		promql.Series{
+			Metric: labels.FromStrings("app", "foo"),
+			Floats: []promql.FPoint{{T: 60_000, F: 2}, {T: 120_000, F: 1}},
+		},
+	}, res.Data)
 
-	_, err = q.Exec(ctx)
-	require.Error(t, err)
+	res, err = eng.Query(params.WithHold(30 * time.Second)).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{
+		promql.Series{
+			Metric: labels.FromStrings("app", "foo"),
+			Floats: []promql.FPoint{{T: 60_000, F: 2}, {T: 90_000, F: 2}, {T: 120_000, F: 1}},
+		},
+	}, res.Data)
 }
 
-type mockEvaluatorFactory struct {
-	sampleEvalFunc  SampleEvaluatorFunc
-	variantEvalFunc VariantsEvaluatorFunc
-}
+func TestEngine_ZeroOnEmptyAggregation(t *testing.T) {
+	const qs = `sum by (app) (count_over_time({app="foo"}[30s]))`
+	// the selector matches no data.
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(30, 0), End: time.Unix(90, 0), Selector: qs}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(90, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
 
-func (m *mockEvaluatorFactory) NewStepEvaluator(ctx context.Context, nextEvaluatorFactory SampleEvaluatorFactory, expr syntax.SampleExpr, p Params) (StepEvaluator, error) {
-	if m.sampleEvalFunc != nil {
-		return m.sampleEvalFunc(ctx, nextEvaluatorFactory, expr, p)
-	}
-	return nil, errors.New("unimplemented mock SampleEvaluatorFactory")
-}
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Empty(t, res.Data)
 
-func (m *mockEvaluatorFactory) NewVariantsStepEvaluator(ctx context.Context, expr syntax.VariantsExpr, p Params) (StepEvaluator, error) {
-	if m.variantEvalFunc != nil {
-		return m.variantEvalFunc(ctx, expr, p)
-	}
-	return nil, errors.New("unimplemented mock VariantEvaluatorFactory")
+	res, err = eng.Query(params.WithZeroOnEmptyAggregation(true)).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{
+		promql.Series{
+			Metric: labels.EmptyLabels(),
+			Floats: []promql.FPoint{{T: 60_000, F: 0}, {T: 90_000, F: 0}},
+		},
+	}, res.Data)
+
+	// only the outermost aggregation is filled.
+	const nested = `count(sum by (app) (count_over_time({app="foo"}[30s])))`
+	querier = newQuerierRecorder(t,
+		[][]logproto.Series{{}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(30, 0), End: time.Unix(90, 0), Selector: qs}},
+		},
+	)
+	eng = NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err = NewLiteralParams(nested, time.Unix(60, 0), time.Unix(90, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err = eng.Query(params.WithZeroOnEmptyAggregation(true)).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{
+		promql.Series{
+			Metric: labels.EmptyLabels(),
+			Floats: []promql.FPoint{{T: 60_000, F: 0}, {T: 90_000, F: 0}},
+		},
+	}, res.Data)
 }
 
-func (m *mockEvaluatorFactory) NewIterator(context.Context, syntax.LogSelectorExpr, Params) (iter.EntryIterator, error) {
-	return nil, errors.New("unimplemented mock EntryEvaluatorFactory")
-}
+func TestEngine_MaxEvaluatedSteps(t *testing.T) {
+	const qs = `count_over_time({app="foo"}[40s])`
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: []logproto.Sample{
+			{Timestamp: time.Unix(10, 0).UnixNano(), Value: 1, Hash: 1},
+			{Timestamp: time.Unix(20, 0).UnixNano(), Value: 1, Hash: 2},
+			{Timestamp: time.Unix(30, 0).UnixNano(), Value: 1, Hash: 3},
+			{Timestamp: time.Unix(70, 0).UnixNano(), Value: 1, Hash: 4},
+			{Timestamp: time.Unix(100, 0).UnixNano(), Value: 1, Hash: 5},
+			{Timestamp: time.Unix(110, 0).UnixNano(), Value: 1, Hash: 6},
+		}}}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(120, 0), Selector: qs}},
+		},
+	)
+	// the 12 steps are evaluated as 4 steps of 40s at 10s, 50s, 90s and 130s.
+	eng := NewEngine(EngineOpts{MaxEvaluatedSteps: 4}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(qs, time.Unix(10, 0), time.Unix(120, 0), 10*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
 
-func getLocalQuerier(size int64) Querier {
-	return &querierRecorder{
-		series: map[string][]logproto.Series{
-			"": {
-				newSeries(size, identity, `{app="foo"}`),
-				newSeries(size, identity, `{app="foo",bar="foo"}`),
-				newSeries(size, identity, `{app="foo",bar="bazz"}`),
-				newSeries(size, identity, `{app="foo",bar="fuzz"}`),
-				newSeries(size, identity, `{app="bar"}`),
-				newSeries(size, identity, `{app="bar",bar="foo"}`),
-				newSeries(size, identity, `{app="bar",bar="bazz"}`),
-				newSeries(size, identity, `{app="bar",bar="fuzz"}`),
-			},
-		},
-		streams: map[string][]logproto.Stream{
-			"": {
-				newStream(size, identity, `{app="foo"}`),
-				newStream(size, identity, `{app="foo",bar="foo"}`),
-				newStream(size, identity, `{app="foo",bar="bazz"}`),
-				newStream(size, identity, `{app="foo",bar="fuzz"}`),
-				newStream(size, identity, `{app="bar"}`),
-				newStream(size, identity, `{app="bar",bar="foo"}`),
-				newStream(size, identity, `{app="bar",bar="bazz"}`),
-				newStream(size, identity, `{app="bar",bar="fuzz"}`),
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{
+		promql.Series{
+			Metric: labels.FromStrings("app", "foo"),
+			Floats: []promql.FPoint{
+				{T: 10_000, F: 1}, {T: 20_000, F: 1.25}, {T: 30_000, F: 1.5}, {T: 40_000, F: 1.75},
+				{T: 50_000, F: 2}, {T: 60_000, F: 1.75}, {T: 70_000, F: 1.5}, {T: 80_000, F: 1.25},
+				{T: 90_000, F: 1}, {T: 100_000, F: 1.25}, {T: 110_000, F: 1.5}, {T: 120_000, F: 1.75},
 			},
 		},
-	}
+	}, res.Data)
+	require.Equal(t, []metadata.Warning{metadata.InterpolatedWarning(10*time.Second, 40*time.Second)}, res.StructuredWarnings)
 }
 
-type querierRecorder struct {
-	streams map[string][]logproto.Stream
-	series  map[string][]logproto.Series
-	match   bool
+func TestLiteralParams_WithRange(t *testing.T) {
+	const qs = `count_over_time({app="foo"}[30s])`
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: []logproto.Sample{
+			{Timestamp: time.Unix(40, 0).UnixNano(), Value: 1, Hash: 1},
+			{Timestamp: time.Unix(50, 0).UnixNano(), Value: 1, Hash: 2},
+			{Timestamp: time.Unix(100, 0).UnixNano(), Value: 1, Hash: 3},
+		}}}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(120, 0), Selector: qs}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(qs, time.Unix(0, 0), time.Unix(300, 0), time.Minute, 0, logproto.BACKWARD, 100, nil, nil)
+	require.NoError(t, err)
+	reparsed, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(120, 0), 30*time.Second, 0, logproto.BACKWARD, 100, nil, nil)
+	require.NoError(t, err)
+
+	split := params.WithRange(time.Unix(60, 0), time.Unix(120, 0), 30*time.Second)
+	require.Same(t, params.GetExpression(), split.GetExpression())
+	require.Equal(t, reparsed.Start(), split.Start())
+	require.Equal(t, reparsed.End(), split.End())
+	require.Equal(t, reparsed.Step(), split.Step())
+	require.Equal(t, params.Direction(), split.Direction())
+	require.Equal(t, params.Limit(), split.Limit())
+
+	exp, err := eng.Query(reparsed).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.NotEmpty(t, exp.Data)
+	res, err := eng.Query(split).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Equal(t, exp.Data, res.Data)
 }
 
-func newQuerierRecorder(t *testing.T, data interface{}, params interface{}) *querierRecorder {
-	t.Helper()
-	streams := map[string][]logproto.Stream{}
-	if streamsIn, ok := data.([][]logproto.Stream); ok {
-		if paramsIn, ok2 := params.([]SelectLogParams); ok2 {
-			for i, p := range paramsIn {
-				p.Plan = &plan.QueryPlan{
-					AST: syntax.MustParseExpr(p.Selector),
-				}
-				streams[paramsID(p)] = streamsIn[i]
-			}
-		}
+func TestParseResultTransform(t *testing.T) {
+	for _, s := range []string{"", "step_delta"} {
+		transform, err := ParseResultTransform(s)
+		require.NoError(t, err)
+		require.Equal(t, ResultTransform(s), transform)
 	}
+	_, err := ParseResultTransform("irate")
+	require.EqualError(t, err, `invalid result transform "irate", must be empty or "step_delta"`)
+}
 
-	series := map[string][]logproto.Series{}
-	if seriesIn, ok := data.([][]logproto.Series); ok {
-		if paramsIn, ok2 := params.([]SelectSampleParams); ok2 {
-			for i, p := range paramsIn {
-				expr, ok3 := syntax.MustParseExpr(p.Selector).(syntax.VariantsExpr)
-				if ok3 {
-					if p.Plan == nil {
-						p.Plan = &plan.QueryPlan{
-							AST: expr,
-						}
-					}
+func TestParseStepAlignment(t *testing.T) {
+	for in, expected := range map[string]StepAlignment{
+		"":       StepAlignmentEnd,
+		"start":  StepAlignmentStart,
+		"center": StepAlignmentCenter,
+		"end":    StepAlignmentEnd,
+	} {
+		actual, err := ParseStepAlignment(in)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+	_, err := ParseStepAlignment("middle")
+	require.Error(t, err)
+}
 
-					curSeries := seriesIn[i]
-					variants := expr.Variants()
-					newSeries := make([]logproto.Series, len(curSeries)*len(variants))
+func TestEngine_AbsentLookback(t *testing.T) {
+	const qs = `absent_over_time(({app="foo"} |~".+bar")[1m])`
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{newSeries(1, constant(50), `{app="foo"}`)}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(180, 0), Selector: `absent_over_time({app="foo"}|~".+bar"[1m])`}},
+		},
+	)
 
-					for vi := range variants {
-						for si, s := range curSeries {
-							lbls, err := promql_parser.ParseMetric(s.Labels)
-							if err != nil {
-								return nil
-							}
+	for _, tc := range []struct {
+		lookback time.Duration
+		expected []promql.FPoint
+	}{
+		{0, []promql.FPoint{{T: 120000, F: 1}, {T: 150000, F: 1}, {T: 180000, F: 1}}},
+		{30 * time.Second, []promql.FPoint{{T: 150000, F: 1}, {T: 180000, F: 1}}},
+		{time.Minute, []promql.FPoint{{T: 180000, F: 1}}},
+	} {
+		t.Run(tc.lookback.String(), func(t *testing.T) {
+			eng := NewEngine(EngineOpts{AbsentLookback: tc.lookback}, querier, NoLimits, log.NewNopLogger())
+			params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), 30*time.Second, 0, logproto.FORWARD, 100, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, promql.Matrix{
+				promql.Series{Metric: labels.FromStrings("app", "foo"), Floats: tc.expected},
+			}, res.Data)
+		})
+	}
+}
 
-							// Add variant label
-							b := labels.NewBuilder(lbls)
-							b.Set(constants.VariantLabel, fmt.Sprintf("%d", vi))
-							lbls = b.Labels()
+func TestEngine_CVOverTime(t *testing.T) {
+	const qs = `cv_over_time({app="foo"} | unwrap v [5m])`
+	ts := time.Unix(5*60, 0)
 
-							// Copy series with new labels
-							idx := vi*len(curSeries) + si
-							newSeries[idx] = logproto.Series{
-								Labels:  lbls.String(),
-								Samples: s.Samples,
-							}
-						}
-					}
-					series[paramsID(p)] = newSeries
-				} else {
-					for i, p := range paramsIn {
-						if p.Plan == nil {
-							p.Plan = &plan.QueryPlan{
-								AST: syntax.MustParseExpr(p.Selector),
-							}
-						}
-						series[paramsID(p)] = seriesIn[i]
-					}
-				}
+	for _, tc := range []struct {
+		name     string
+		values   []float64
+		expected float64
+		warnings []string
+	}{
+		{"constant window", []float64{2, 2, 2}, 0, nil},
+		{"variable window", []float64{1, 2, 3}, math.Sqrt(2./3) / 2, nil},
+		{"zero mean window", []float64{-1, 1}, math.NaN(), []string{"cv_over_time is NaN for windows with a mean of zero"}},
+		{"NaN sample", []float64{1, math.NaN(), 3}, math.NaN(), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			samples := make([]logproto.Sample, 0, len(tc.values))
+			for i, v := range tc.values {
+				samples = append(samples, logproto.Sample{Timestamp: time.Unix(int64(i+1)*10, 0).UnixNano(), Value: v, Hash: uint64(i)})
 			}
-		}
+			querier := newQuerierRecorder(t,
+				[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: samples}}},
+				[]SelectSampleParams{
+					{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: qs}},
+				},
+			)
+			eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+			params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, tc.warnings, res.Warnings)
+
+			vec, ok := res.Data.(promql.Vector)
+			require.True(t, ok)
+			require.Len(t, vec, 1)
+			require.Equal(t, labels.FromStrings("app", "foo"), vec[0].Metric)
+			if math.IsNaN(tc.expected) {
+				require.True(t, math.IsNaN(vec[0].F))
+				return
+			}
+			require.InDelta(t, tc.expected, vec[0].F, 1e-12)
+		})
 	}
+}
 
-	return &querierRecorder{
-		streams: streams,
-		series:  series,
-		match:   true,
-	}
+// selectBoundsRecorder records the bounds of the sample queries it receives.
+type selectBoundsRecorder struct {
+	Querier
+	bounds [][2]time.Time
 }
 
-func (q *querierRecorder) SelectLogs(_ context.Context, p SelectLogParams) (iter.EntryIterator, error) {
-	if !q.match {
-		for _, s := range q.streams {
-			return iter.NewStreamsIterator(s, p.Direction), nil
-		}
-	}
-	recordID := paramsID(p)
-	streams, ok := q.streams[recordID]
-	if !ok {
-		return nil, fmt.Errorf("no streams found for id: %s has: %+v", recordID, q.streams)
-	}
-	return iter.NewStreamsIterator(streams, p.Direction), nil
+func (q *selectBoundsRecorder) SelectSamples(ctx context.Context, p SelectSampleParams) (iter.SampleIterator, error) {
+	q.bounds = append(q.bounds, [2]time.Time{p.Start, p.End})
+	return q.Querier.SelectSamples(ctx, p)
 }
 
-func (q *querierRecorder) SelectSamples(
-	_ context.Context,
-	p SelectSampleParams,
-) (iter.SampleIterator, error) {
-	if !q.match {
-		for _, s := range q.series {
-			return iter.NewMultiSeriesIterator(s), nil
+func TestEngine_AtModifier(t *testing.T) {
+	const qs = `count_over_time({app="foo"}[1m] @ 60)`
+	newQuerier := func(t *testing.T) *selectBoundsRecorder {
+		return &selectBoundsRecorder{
+			Querier: newQuerierRecorder(t,
+				// samples every 10s up to 60s only, later steps would be empty without the @ modifier.
+				[][]logproto.Series{{newSeries(7, factor(10, identity), `{app="foo"}`)}},
+				[]SelectSampleParams{
+					{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(60, 0), Selector: qs}},
+				},
+			),
 		}
 	}
-	recordID := paramsID(p)
-	if len(q.series) == 0 {
-		return iter.NoopSampleIterator, nil
-	}
-	series, ok := q.series[recordID]
-	if !ok {
-		return nil, fmt.Errorf("no series found for id: %s has: %+v", recordID, q.series)
-	}
-	return iter.NewMultiSeriesIterator(series), nil
+	// the bounds of the selected samples only depend on the anchored timestamp.
+	expectedBounds := [][2]time.Time{{time.Unix(0, 0), time.Unix(60, 0).Add(time.Nanosecond)}}
+
+	t.Run("instant", func(t *testing.T) {
+		querier := newQuerier(t)
+		params, err := NewLiteralParams(qs, time.Unix(300, 0), time.Unix(300, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		res, err := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.NoError(t, err)
+		require.Equal(t, expectedBounds, querier.bounds)
+		require.Equal(t, promql.Vector{
+			{T: 300_000, F: 6, Metric: labels.FromStrings("app", "foo")},
+		}, res.Data)
+	})
+
+	t.Run("range", func(t *testing.T) {
+		querier := newQuerier(t)
+		params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		res, err := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.NoError(t, err)
+		require.Equal(t, expectedBounds, querier.bounds)
+		require.Equal(t, promql.Matrix{
+			promql.Series{
+				Metric: labels.FromStrings("app", "foo"),
+				Floats: []promql.FPoint{{T: 60_000, F: 6}, {T: 90_000, F: 6}, {T: 120_000, F: 6}, {T: 150_000, F: 6}, {T: 180_000, F: 6}},
+			},
+		}, res.Data)
+	})
 }
 
-func paramsID(p interface{}) string {
-	switch params := p.(type) {
-	case SelectLogParams:
-	case SelectSampleParams:
-		return fmt.Sprintf("%d", params.Plan.Hash())
-	}
-	b, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
+func TestEngine_MinStep(t *testing.T) {
+	const qs = `count_over_time({app="foo"}[1m])`
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{newSeries(testSize, factor(10, identity), `{app="foo"}`)}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(180, 0), Selector: qs}},
+		},
+	)
+	limits := &fakeLimits{maxSeries: math.MaxInt32, timeout: time.Hour, minStep: 30 * time.Second}
+
+	exec := func(t *testing.T, opts EngineOpts, step time.Duration) (logqlmodel.Result, error) {
+		params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), step, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		return NewEngine(opts, querier, limits, log.NewNopLogger()).Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
 	}
-	return strings.ReplaceAll(string(b), " ", "")
-}
 
-type logData struct {
-	logproto.Entry
-	// nolint
-	logproto.Sample
+	t.Run("step is rounded up", func(t *testing.T) {
+		res, err := exec(t, EngineOpts{}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []string{"query step [1s] is below the minimum step [30s] and has been rounded up"}, res.Warnings)
+		require.Equal(t, []metadata.Warning{metadata.MinStepWarning(time.Second, 30*time.Second)}, res.StructuredWarnings)
+		require.Equal(t, map[string]string{"step": "1s", "min_step": "30s"}, res.StructuredWarnings[0].Fields)
+
+		m, ok := res.Data.(promql.Matrix)
+		require.True(t, ok)
+		require.Len(t, m, 1)
+		require.Len(t, m[0].Floats, 5)
+		for i, p := range m[0].Floats {
+			require.Equal(t, int64(60_000+i*30_000), p.T)
+		}
+	})
+
+	t.Run("step is rejected", func(t *testing.T) {
+		_, err := exec(t, EngineOpts{RejectStepBelowMinStep: true}, time.Second)
+		require.ErrorIs(t, err, logqlmodel.ErrLimit)
+		require.EqualError(t, err, "limit reached while evaluating the query: query step [1s] is below the minimum step [30s]")
+	})
+
+	t.Run("step above the minimum is untouched", func(t *testing.T) {
+		res, err := exec(t, EngineOpts{RejectStepBelowMinStep: true}, time.Minute)
+		require.NoError(t, err)
+		require.Empty(t, res.Warnings)
+		require.Len(t, res.Data.(promql.Matrix)[0].Floats, 3)
+	})
 }
 
-type generator func(i int64) logData
+func TestEngine_StepCallback(t *testing.T) {
+	const qs = `count_over_time({app="foo"}[1m])`
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{newSeries(testSize, factor(10, identity), `{app="foo"}`)}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(180, 0), Selector: qs}},
+		},
+	)
 
-func newStream(n int64, f generator, lbsString string) logproto.Stream {
-	labels, err := syntax.ParseLabels(lbsString)
-	if err != nil {
-		panic(err)
-	}
-	entries := []logproto.Entry{}
-	for i := int64(0); i < n; i++ {
-		entries = append(entries, f(i).Entry)
-	}
-	return logproto.Stream{
-		Entries: entries,
-		Labels:  labels.String(),
+	type step struct {
+		index int
+		ts    int64
 	}
+	var steps []step
+	eng := NewEngine(EngineOpts{
+		StepCallback: func(stepIndex int, ts int64) {
+			steps = append(steps, step{stepIndex, ts})
+		},
+	}, querier, NoLimits, log.NewNopLogger())
+
+	t.Run("range", func(t *testing.T) {
+		steps = nil
+		params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		_, err = eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.NoError(t, err)
+		require.Equal(t, []step{{0, 60_000}, {1, 90_000}, {2, 120_000}, {3, 150_000}, {4, 180_000}}, steps)
+	})
+
+	t.Run("coarse step", func(t *testing.T) {
+		steps = nil
+		coarse := NewEngine(EngineOpts{
+			MaxEvaluatedSteps: 3,
+			StepCallback: func(stepIndex int, ts int64) {
+				steps = append(steps, step{stepIndex, ts})
+			},
+		}, querier, NoLimits, log.NewNopLogger())
+		params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		res, err := coarse.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.NoError(t, err)
+		require.NotEmpty(t, res.StructuredWarnings)
+		require.Equal(t, []step{{0, 60_000}, {1, 90_000}, {2, 120_000}, {3, 150_000}, {4, 180_000}}, steps)
+	})
+
+	t.Run("instant", func(t *testing.T) {
+		steps = nil
+		params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		_, err = eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.NoError(t, err)
+		require.Empty(t, steps)
+	})
 }
 
-func newSeries(n int64, f generator, lbsString string) logproto.Series {
-	labels, err := syntax.ParseLabels(lbsString)
-	if err != nil {
-		panic(err)
-	}
-	samples := []logproto.Sample{}
-	for i := int64(0); i < n; i++ {
-		samples = append(samples, f(i).Sample)
-	}
-	return logproto.Series{
-		Samples: samples,
-		Labels:  labels.String(),
-	}
+// go test -mod=vendor ./pkg/logql/ -bench=.  -benchmem -memprofile memprofile.out -cpuprofile cpuprofile.out
+func BenchmarkRangeQuery100000(b *testing.B) {
+	benchmarkRangeQuery(int64(100000), b)
 }
 
-func newIntervalStream(n int64, step time.Duration, f generator, labels string) logproto.Stream {
-	entries := []logproto.Entry{}
-	lastEntry := int64(-100) // Start with a really small value (negative) so we always output the first item
-	for i := int64(0); int64(len(entries)) < n; i++ {
-		if float64(lastEntry)+step.Seconds() <= float64(i) {
-			entries = append(entries, f(i).Entry)
-			lastEntry = i
-		}
-	}
-	return logproto.Stream{
-		Entries: entries,
-		Labels:  labels,
-	}
+func BenchmarkRangeQuery200000(b *testing.B) {
+	benchmarkRangeQuery(int64(200000), b)
 }
 
-func newBackwardStream(n int64, f generator, labels string) logproto.Stream {
-	entries := []logproto.Entry{}
-	for i := n - 1; i > 0; i-- {
-		entries = append(entries, f(i).Entry)
-	}
-	return logproto.Stream{
-		Entries: entries,
-		Labels:  labels,
-	}
+func BenchmarkRangeQuery500000(b *testing.B) {
+	benchmarkRangeQuery(int64(500000), b)
 }
 
-func newBackwardIntervalStream(n, expectedResults int64, step time.Duration, f generator, labels string) logproto.Stream {
-	entries := []logproto.Entry{}
-	lastEntry := int64(100000) // Start with some really big value so that we always output the first item
-	for i := n - 1; int64(len(entries)) < expectedResults; i-- {
-		if float64(lastEntry)-step.Seconds() >= float64(i) {
-			entries = append(entries, f(i).Entry)
-			lastEntry = i
-		}
-	}
-	return logproto.Stream{
-		Entries: entries,
-		Labels:  labels,
-	}
+func BenchmarkRangeQuery1000000(b *testing.B) {
+	benchmarkRangeQuery(int64(1000000), b)
 }
 
-func identity(i int64) logData {
-	return logData{
-		Entry: logproto.Entry{
-			Timestamp: time.Unix(i, 0),
-			Line:      fmt.Sprintf("%d", i),
-		},
-		Sample: logproto.Sample{
-			Timestamp: time.Unix(i, 0).UnixNano(),
-			Value:     1.,
-			Hash:      uint64(i),
-		},
+var result promql_parser.Value
+
+func benchmarkRangeQuery(testsize int64, b *testing.B) {
+	b.ReportAllocs()
+	eng := NewEngine(EngineOpts{}, getLocalQuerier(testsize), NoLimits, log.NewNopLogger())
+	start := time.Unix(0, 0)
+	end := time.Unix(testsize, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, test := range []struct {
+			qs        string
+			direction logproto.Direction
+		}{
+			{`{app="foo"}`, logproto.FORWARD},
+			{`{app="bar"} |= "foo" |~ ".+bar"`, logproto.BACKWARD},
+			{`rate({app="foo"} |~".+bar" [1m])`, logproto.BACKWARD},
+			{`rate({app="foo"}[30s])`, logproto.FORWARD},
+			{`count_over_time({app="foo"} |~".+bar" [1m])`, logproto.BACKWARD},
+			{`count_over_time(({app="foo"} |~".+bar")[5m])`, logproto.BACKWARD},
+			{`avg(count_over_time({app=~"foo|bar"} |~".+bar" [1m]))`, logproto.FORWARD},
+			{`min(rate({app=~"foo|bar"} |~".+bar" [1m]))`, logproto.FORWARD},
+			{`max by (app) (rate({app=~"foo|bar"} |~".+bar" [1m]))`, logproto.FORWARD},
+			{`max(rate({app=~"foo|bar"} |~".+bar" [1m]))`, logproto.FORWARD},
+			{`sum(rate({app=~"foo|bar"} |~".+bar" [1m]))`, logproto.FORWARD},
+			{`sum(count_over_time({app=~"foo|bar"} |~".+bar" [1m])) by (app)`, logproto.FORWARD},
+			{`count(count_over_time({app=~"foo|bar"} |~".+bar" [1m])) without (app)`, logproto.FORWARD},
+			{`stdvar without (app) (count_over_time(({app=~"foo|bar"} |~".+bar")[1m])) `, logproto.FORWARD},
+			{`stddev(count_over_time(({app=~"foo|bar"} |~".+bar")[1m])) `, logproto.FORWARD},
+			{`rate(({app=~"foo|bar"} |~".+bar")[1m])`, logproto.FORWARD},
+			{`topk(2,rate(({app=~"foo|bar"} |~".+bar")[1m]))`, logproto.FORWARD},
+			{`topk(1,rate(({app=~"foo|bar"} |~".+bar")[1m]))`, logproto.FORWARD},
+			{`topk(1,rate(({app=~"foo|bar"} |~".+bar")[1m])) by (app)`, logproto.FORWARD},
+			{`bottomk(2,rate(({app=~"foo|bar"} |~".+bar")[1m]))`, logproto.FORWARD},
+			{`bottomk(3,rate(({app=~"foo|bar"} |~".+bar")[1m])) without (app)`, logproto.FORWARD},
+		} {
+			params, err := NewLiteralParams(test.qs, start, end, 60*time.Second, 0, logproto.BACKWARD, 1000, nil, nil)
+			require.NoError(b, err)
+			q := eng.Query(params)
+
+			res, err := q.Exec(user.InjectOrgID(context.Background(), "fake"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			result = res.Data
+			if result == nil {
+				b.Fatal("unexpected nil result")
+			}
+		}
 	}
 }
 
-// nolint
-func factor(j int64, g generator) generator {
-	return func(i int64) logData {
-		return g(i * j)
+// go test ./pkg/logql/ -run=^$ -bench=BenchmarkReadStreams -benchmem
+// drainEntries collects the entries of it the way a reader knowing that they
+// belong to a single stream would, as the baseline of readStreams.
+func drainEntries(it iter.EntryIterator) ([]logproto.Entry, error) {
+	var entries []logproto.Entry
+	for it.Next() {
+		entries = append(entries, it.At())
 	}
+	return entries, it.Err()
 }
 
-// nolint
-func offset(j int64, g generator) generator {
-	return func(i int64) logData {
-		return g(i + j)
-	}
+func TestReadStreams_SingleStreamAllocs(t *testing.T) {
+	streams := []logproto.Stream{newStream(1000, identity, `{app="foo"}`)}
+	baseline := testing.AllocsPerRun(10, func() {
+		_, _ = drainEntries(iter.NewStreamsIterator(streams, logproto.FORWARD))
+	})
+	allocs := testing.AllocsPerRun(10, func() {
+		_, _ = readStreams(iter.NewStreamsIterator(streams, logproto.FORWARD), 1000, logproto.FORWARD, 0)
+	})
+	// a single stream costs the result slice on top of the entries.
+	require.LessOrEqual(t, allocs, baseline+1)
 }
 
-// nolint
-func constant(t int64) generator {
-	return func(i int64) logData {
-		return logData{
-			Entry: logproto.Entry{
-				Timestamp: time.Unix(t, 0),
-				Line:      fmt.Sprintf("%d", i),
-			},
-			Sample: logproto.Sample{
-				Timestamp: time.Unix(t, 0).UnixNano(),
-				Hash:      uint64(i),
-				Value:     1.0,
-			},
+func BenchmarkReadStreams(b *testing.B) {
+	b.Run("baseline", func(b *testing.B) {
+		streams := []logproto.Stream{newStream(1000, identity, `{app="foo"}`)}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := drainEntries(iter.NewStreamsIterator(streams, logproto.FORWARD)); err != nil {
+				b.Fatal(err)
+			}
 		}
+	})
+	for _, bc := range []struct {
+		name    string
+		streams []logproto.Stream
+	}{
+		{"single stream", []logproto.Stream{newStream(1000, identity, `{app="foo"}`)}},
+		{"two streams", []logproto.Stream{newStream(500, identity, `{app="foo"}`), newStream(500, identity, `{app="bar"}`)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				streams, err := readStreams(iter.NewStreamsIterator(bc.streams, logproto.FORWARD), 1000, logproto.FORWARD, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				result = streams
+			}
+		})
 	}
 }
 
-// nolint
-func constantValue(t int64) generator {
-	return func(i int64) logData {
-		return logData{
-			Entry: logproto.Entry{
-				Timestamp: time.Unix(i, 0),
-				Line:      fmt.Sprintf("%d", i),
-			},
-			Sample: logproto.Sample{
-				Timestamp: time.Unix(i, 0).UnixNano(),
-				Hash:      uint64(i),
-				Value:     float64(t),
-			},
-		}
+// TestHashingStability tests logging stability between engine and RecordRangeAndInstantQueryMetrics methods.
+func TestHashingStability(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	params := LiteralParams{
+		start:     time.Unix(0, 0),
+		end:       time.Unix(5, 0),
+		step:      60 * time.Second,
+		direction: logproto.FORWARD,
+		limit:     1000,
 	}
-}
 
-// nolint
-func incValue(val int64) generator {
-	return func(i int64) logData {
-		return logData{
-			Entry: logproto.Entry{
-				Timestamp: time.Unix(i, 0),
-				Line:      fmt.Sprintf("%d", i),
-			},
-			Sample: logproto.Sample{
-				Timestamp: time.Unix(i, 0).UnixNano(),
-				Hash:      uint64(i),
-				Value:     float64(val + i),
-			},
-		}
+	queryWithEngine := func() string {
+		buf := bytes.NewBufferString("")
+		logger := log.NewLogfmtLogger(buf)
+		eng := NewEngine(EngineOpts{LogExecutingQuery: true}, getLocalQuerier(4), NoLimits, logger)
+
+		parsed, err := syntax.ParseExpr(params.QueryString())
+		require.NoError(t, err)
+		params.queryExpr = parsed
+
+		query := eng.Query(params)
+		_, err = query.Exec(ctx)
+		require.NoError(t, err)
+		return buf.String()
 	}
-}
 
-// nolint
-func inverse(g generator) generator {
-	return func(i int64) logData {
-		return g(-i)
+	queryDirectly := func() string {
+		statsResult := stats.Result{
+			Summary: stats.Summary{
+				BytesProcessedPerSecond: 100000,
+				QueueTime:               0.000000002,
+				ExecTime:                25.25,
+				TotalBytesProcessed:     100000,
+				TotalEntriesReturned:    10,
+			},
+		}
+		buf := bytes.NewBufferString("")
+		logger := log.NewLogfmtLogger(buf)
+		RecordRangeAndInstantQueryMetrics(ctx, logger, params, "200", statsResult, logqlmodel.Streams{logproto.Stream{Entries: make([]logproto.Entry, 10)}})
+		return buf.String()
 	}
-}
 
-func TestJoinSampleVector_LogsDrilldownBehavior(t *testing.T) {
-	t.Parallel()
+	for _, test := range []struct {
+		qs string
+	}{
+		{`sum by(query_hash) (count_over_time({app="myapp",env="myenv"} |= "error" |= "metrics.go" | logfmt [10s]))`},
+		{`sum (count_over_time({app="myapp",env="myenv"} |= "error" |= "metrics.go" | logfmt [10s])) by(query_hash)`},
+	} {
+		params.queryString = test.qs
+		expectedQueryHash := util.HashedQuery(test.qs)
 
-	// Test the JoinSampleVector method directly to test both code paths
+		// check that both places will end up having the same query hash, even though they're emitting different log lines.
+		withEngine := queryWithEngine()
+		require.Contains(t, withEngine, fmt.Sprintf("query_hash=%d", expectedQueryHash))
+		require.Contains(t, withEngine, "step=1m0s")
+
+		directly := queryDirectly()
+		require.Contains(t, directly, fmt.Sprintf("query_hash=%d", expectedQueryHash))
+		require.Contains(t, directly, "length=5s")
+		require.Contains(t, directly, "latency=slow")
+	}
+}
+
+func TestUnexpectedEmptyResults(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	mock := &mockEvaluatorFactory{
+		SampleEvaluatorFunc(
+			func(context.Context, SampleEvaluatorFactory, syntax.SampleExpr, Params) (StepEvaluator, error) {
+				return EmptyEvaluator[SampleVector]{value: nil}, nil
+			},
+		),
+		VariantsEvaluatorFunc(
+			func(context.Context, syntax.VariantsExpr, Params) (StepEvaluator, error) {
+				return EmptyEvaluator[SampleVector]{value: nil}, nil
+			},
+		),
+	}
+
+	eng := NewEngine(EngineOpts{}, nil, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(`first_over_time({a=~".+"} | logfmt | unwrap value [1s])`, time.Now(), time.Now(), 0, 0, logproto.BACKWARD, 0, nil, nil)
+	require.NoError(t, err)
+	q := eng.Query(params).(*query)
+	q.evaluator = mock
+
+	_, err = q.Exec(ctx)
+	require.Error(t, err)
+}
+
+type mockEvaluatorFactory struct {
+	sampleEvalFunc  SampleEvaluatorFunc
+	variantEvalFunc VariantsEvaluatorFunc
+}
+
+func (m *mockEvaluatorFactory) NewStepEvaluator(ctx context.Context, nextEvaluatorFactory SampleEvaluatorFactory, expr syntax.SampleExpr, p Params) (StepEvaluator, error) {
+	if m.sampleEvalFunc != nil {
+		return m.sampleEvalFunc(ctx, nextEvaluatorFactory, expr, p)
+	}
+	return nil, errors.New("unimplemented mock SampleEvaluatorFactory")
+}
+
+func (m *mockEvaluatorFactory) NewVariantsStepEvaluator(ctx context.Context, expr syntax.VariantsExpr, p Params) (StepEvaluator, error) {
+	if m.variantEvalFunc != nil {
+		return m.variantEvalFunc(ctx, expr, p)
+	}
+	return nil, errors.New("unimplemented mock VariantEvaluatorFactory")
+}
+
+func (m *mockEvaluatorFactory) NewIterator(context.Context, syntax.LogSelectorExpr, Params) (iter.EntryIterator, error) {
+	return nil, errors.New("unimplemented mock EntryEvaluatorFactory")
+}
+
+func getLocalQuerier(size int64) Querier {
+	return &querierRecorder{
+		series: map[string][]logproto.Series{
+			"": {
+				newSeries(size, identity, `{app="foo"}`),
+				newSeries(size, identity, `{app="foo",bar="foo"}`),
+				newSeries(size, identity, `{app="foo",bar="bazz"}`),
+				newSeries(size, identity, `{app="foo",bar="fuzz"}`),
+				newSeries(size, identity, `{app="bar"}`),
+				newSeries(size, identity, `{app="bar",bar="foo"}`),
+				newSeries(size, identity, `{app="bar",bar="bazz"}`),
+				newSeries(size, identity, `{app="bar",bar="fuzz"}`),
+			},
+		},
+		streams: map[string][]logproto.Stream{
+			"": {
+				newStream(size, identity, `{app="foo"}`),
+				newStream(size, identity, `{app="foo",bar="foo"}`),
+				newStream(size, identity, `{app="foo",bar="bazz"}`),
+				newStream(size, identity, `{app="foo",bar="fuzz"}`),
+				newStream(size, identity, `{app="bar"}`),
+				newStream(size, identity, `{app="bar",bar="foo"}`),
+				newStream(size, identity, `{app="bar",bar="bazz"}`),
+				newStream(size, identity, `{app="bar",bar="fuzz"}`),
+			},
+		},
+	}
+}
+
+type querierRecorder struct {
+	streams map[string][]logproto.Stream
+	series  map[string][]logproto.Series
+	match   bool
+}
+
+func newQuerierRecorder(t *testing.T, data interface{}, params interface{}) *querierRecorder {
+	t.Helper()
+	streams := map[string][]logproto.Stream{}
+	if streamsIn, ok := data.([][]logproto.Stream); ok {
+		if paramsIn, ok2 := params.([]SelectLogParams); ok2 {
+			for i, p := range paramsIn {
+				p.Plan = &plan.QueryPlan{
+					AST: syntax.MustParseExpr(p.Selector),
+				}
+				streams[paramsID(p)] = streamsIn[i]
+			}
+		}
+	}
+
+	series := map[string][]logproto.Series{}
+	if seriesIn, ok := data.([][]logproto.Series); ok {
+		if paramsIn, ok2 := params.([]SelectSampleParams); ok2 {
+			for i, p := range paramsIn {
+				expr, ok3 := syntax.MustParseExpr(p.Selector).(syntax.VariantsExpr)
+				if ok3 {
+					if p.Plan == nil {
+						p.Plan = &plan.QueryPlan{
+							AST: expr,
+						}
+					}
+
+					curSeries := seriesIn[i]
+					variants := expr.Variants()
+					newSeries := make([]logproto.Series, len(curSeries)*len(variants))
+
+					for vi := range variants {
+						for si, s := range curSeries {
+							lbls, err := promql_parser.ParseMetric(s.Labels)
+							if err != nil {
+								return nil
+							}
+
+							// Add variant label
+							b := labels.NewBuilder(lbls)
+							b.Set(constants.VariantLabel, fmt.Sprintf("%d", vi))
+							lbls = b.Labels()
+
+							// Copy series with new labels
+							idx := vi*len(curSeries) + si
+							newSeries[idx] = logproto.Series{
+								Labels:  lbls.String(),
+								Samples: s.Samples,
+							}
+						}
+					}
+					series[paramsID(p)] = newSeries
+				} else {
+					for i, p := range paramsIn {
+						if p.Plan == nil {
+							p.Plan = &plan.QueryPlan{
+								AST: syntax.MustParseExpr(p.Selector),
+							}
+						}
+						series[paramsID(p)] = seriesIn[i]
+					}
+				}
+			}
+		}
+	}
+
+	return &querierRecorder{
+		streams: streams,
+		series:  series,
+		match:   true,
+	}
+}
+
+func (q *querierRecorder) SelectLogs(_ context.Context, p SelectLogParams) (iter.EntryIterator, error) {
+	if !q.match {
+		for _, s := range q.streams {
+			return iter.NewStreamsIterator(s, p.Direction), nil
+		}
+	}
+	recordID := paramsID(p)
+	streams, ok := q.streams[recordID]
+	if !ok {
+		return nil, fmt.Errorf("no streams found for id: %s has: %+v", recordID, q.streams)
+	}
+	return iter.NewStreamsIterator(streams, p.Direction), nil
+}
+
+func (q *querierRecorder) SelectSamples(
+	_ context.Context,
+	p SelectSampleParams,
+) (iter.SampleIterator, error) {
+	if !q.match {
+		for _, s := range q.series {
+			return iter.NewMultiSeriesIterator(s), nil
+		}
+	}
+	recordID := paramsID(p)
+	if len(q.series) == 0 {
+		return iter.NoopSampleIterator, nil
+	}
+	series, ok := q.series[recordID]
+	if !ok {
+		return nil, fmt.Errorf("no series found for id: %s has: %+v", recordID, q.series)
+	}
+	return iter.NewMultiSeriesIterator(series), nil
+}
+
+func paramsID(p interface{}) string {
+	switch params := p.(type) {
+	case SelectLogParams:
+	case SelectSampleParams:
+		return fmt.Sprintf("%d", params.Plan.Hash())
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	return strings.ReplaceAll(string(b), " ", "")
+}
+
+type logData struct {
+	logproto.Entry
+	// nolint
+	logproto.Sample
+}
+
+type generator func(i int64) logData
+
+func newStream(n int64, f generator, lbsString string) logproto.Stream {
+	labels, err := syntax.ParseLabels(lbsString)
+	if err != nil {
+		panic(err)
+	}
+	entries := []logproto.Entry{}
+	for i := int64(0); i < n; i++ {
+		entries = append(entries, f(i).Entry)
+	}
+	return logproto.Stream{
+		Entries: entries,
+		Labels:  labels.String(),
+	}
+}
+
+func newSeries(n int64, f generator, lbsString string) logproto.Series {
+	labels, err := syntax.ParseLabels(lbsString)
+	if err != nil {
+		panic(err)
+	}
+	samples := []logproto.Sample{}
+	for i := int64(0); i < n; i++ {
+		samples = append(samples, f(i).Sample)
+	}
+	return logproto.Series{
+		Samples: samples,
+		Labels:  labels.String(),
+	}
+}
+
+func newIntervalStream(n int64, step time.Duration, f generator, labels string) logproto.Stream {
+	entries := []logproto.Entry{}
+	lastEntry := int64(-100) // Start with a really small value (negative) so we always output the first item
+	for i := int64(0); int64(len(entries)) < n; i++ {
+		if float64(lastEntry)+step.Seconds() <= float64(i) {
+			entries = append(entries, f(i).Entry)
+			lastEntry = i
+		}
+	}
+	return logproto.Stream{
+		Entries: entries,
+		Labels:  labels,
+	}
+}
+
+func newBackwardStream(n int64, f generator, labels string) logproto.Stream {
+	entries := []logproto.Entry{}
+	for i := n - 1; i > 0; i-- {
+		entries = append(entries, f(i).Entry)
+	}
+	return logproto.Stream{
+		Entries: entries,
+		Labels:  labels,
+	}
+}
+
+func newBackwardIntervalStream(n, expectedResults int64, step time.Duration, f generator, labels string) logproto.Stream {
+	entries := []logproto.Entry{}
+	lastEntry := int64(100000) // Start with some really big value so that we always output the first item
+	for i := n - 1; int64(len(entries)) < expectedResults; i-- {
+		if float64(lastEntry)-step.Seconds() >= float64(i) {
+			entries = append(entries, f(i).Entry)
+			lastEntry = i
+		}
+	}
+	return logproto.Stream{
+		Entries: entries,
+		Labels:  labels,
+	}
+}
+
+func identity(i int64) logData {
+	return logData{
+		Entry: logproto.Entry{
+			Timestamp: time.Unix(i, 0),
+			Line:      fmt.Sprintf("%d", i),
+		},
+		Sample: logproto.Sample{
+			Timestamp: time.Unix(i, 0).UnixNano(),
+			Value:     1.,
+			Hash:      uint64(i),
+		},
+	}
+}
+
+// nolint
+func factor(j int64, g generator) generator {
+	return func(i int64) logData {
+		return g(i * j)
+	}
+}
+
+// nolint
+func offset(j int64, g generator) generator {
+	return func(i int64) logData {
+		return g(i + j)
+	}
+}
+
+// nolint
+func constant(t int64) generator {
+	return func(i int64) logData {
+		return logData{
+			Entry: logproto.Entry{
+				Timestamp: time.Unix(t, 0),
+				Line:      fmt.Sprintf("%d", i),
+			},
+			Sample: logproto.Sample{
+				Timestamp: time.Unix(t, 0).UnixNano(),
+				Hash:      uint64(i),
+				Value:     1.0,
+			},
+		}
+	}
+}
+
+// nolint
+func constantValue(t int64) generator {
+	return func(i int64) logData {
+		return logData{
+			Entry: logproto.Entry{
+				Timestamp: time.Unix(i, 0),
+				Line:      fmt.Sprintf("%d", i),
+			},
+			Sample: logproto.Sample{
+				Timestamp: time.Unix(i, 0).UnixNano(),
+				Hash:      uint64(i),
+				Value:     float64(t),
+			},
+		}
+	}
+}
+
+// nolint
+func incValue(val int64) generator {
+	return func(i int64) logData {
+		return logData{
+			Entry: logproto.Entry{
+				Timestamp: time.Unix(i, 0),
+				Line:      fmt.Sprintf("%d", i),
+			},
+			Sample: logproto.Sample{
+				Timestamp: time.Unix(i, 0).UnixNano(),
+				Hash:      uint64(i),
+				Value:     float64(val + i),
+			},
+		}
+	}
+}
+
+// nolint
+func inverse(g generator) generator {
+	return func(i int64) logData {
+		return g(-i)
+	}
+}
+
+func TestJoinSampleVector_LogsDrilldownBehavior(t *testing.T) {
+	t.Parallel()
+
+	// Test the JoinSampleVector method directly to test both code paths
 	tests := []struct {
 		name               string
 		queryTags          string
@@ -3765,356 +4656,2774 @@ func TestJoinSampleVector_LogsDrilldownBehavior(t *testing.T) {
 		expectError        bool
 		expectTruncation   bool
 		expectedWarningMsg string
+		expectedDropped    int64
+	}{
+		{
+			name:               "Drilldown - immediate limit exceeded in first vector",
+			queryTags:          "Source=grafana-lokiexplore-app",
+			maxSeries:          2,
+			vectorSize:         3,
+			isRangeQuery:       false,
+			expectError:        false,
+			expectTruncation:   true,
+			expectedWarningMsg: "maximum number of series (2) reached for a single query; returning partial results",
+			expectedDropped:    1,
+		},
+		{
+			name:               "Non-drilldown - immediate limit exceeded in first vector",
+			queryTags:          "Source=grafana",
+			maxSeries:          2,
+			vectorSize:         3,
+			isRangeQuery:       false,
+			expectError:        true,
+			expectTruncation:   false,
+			expectedWarningMsg: "",
+		},
+		{
+			name:               "Drilldown - limit NOT exceeded",
+			queryTags:          "Source=grafana-lokiexplore-app",
+			maxSeries:          5,
+			vectorSize:         3,
+			isRangeQuery:       false,
+			expectError:        false,
+			expectTruncation:   false,
+			expectedWarningMsg: "",
+		},
+		{
+			name:               "Non-drilldown - limit NOT exceeded",
+			queryTags:          "Source=grafana",
+			maxSeries:          5,
+			vectorSize:         3,
+			isRangeQuery:       false,
+			expectError:        false,
+			expectTruncation:   false,
+			expectedWarningMsg: "",
+		},
+		{
+			name:               "Drilldown - range query limit exceeded in second vector",
+			queryTags:          "Source=grafana-lokiexplore-app",
+			maxSeries:          3,
+			vectorSize:         2, // First vector has 2 series
+			isRangeQuery:       true,
+			additionalVectors:  []int{2}, // Second vector has 2 more unique series (total 4 > limit 3)
+			expectError:        false,
+			expectTruncation:   true,
+			expectedWarningMsg: "maximum number of series (3) reached for a single query; returning partial results",
+			expectedDropped:    1,
+		},
+		{
+			name:               "Non-drilldown - range query limit exceeded in second vector",
+			queryTags:          "Source=grafana",
+			maxSeries:          3,
+			vectorSize:         2, // First vector has 2 series
+			isRangeQuery:       true,
+			additionalVectors:  []int{2}, // Second vector has 2 more unique series (total 4 > limit 3)
+			expectError:        true,
+			expectTruncation:   false,
+			expectedWarningMsg: "",
+		},
+		{
+			name:               "Drilldown - range query limit NOT exceeded across multiple vectors",
+			queryTags:          "Source=grafana-lokiexplore-app",
+			maxSeries:          5,
+			vectorSize:         2, // First vector has 2 series
+			isRangeQuery:       true,
+			additionalVectors:  []int{2, 1}, // Second has 2, third has 1 (total 5 = limit)
+			expectError:        false,
+			expectTruncation:   false,
+			expectedWarningMsg: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Create a mock query with the necessary context
+			ctx := context.Background()
+			if test.queryTags != "" {
+				ctx = httpreq.InjectQueryTags(ctx, test.queryTags)
+			}
+			_, ctx = metadata.NewContext(ctx)
+			statsCtx, ctx := stats.NewContext(ctx)
+
+			// Create mock params - adjust for range vs instant query
+			var params *LiteralParams
+			if test.isRangeQuery {
+				params = &LiteralParams{
+					queryString: `rate({app="foo"}[1m])`,
+					start:       time.Unix(0, 0),
+					end:         time.Unix(120, 0), // Range query: multiple steps
+					step:        60 * time.Second,
+					interval:    0,
+					direction:   logproto.FORWARD,
+					limit:       100,
+				}
+			} else {
+				params = &LiteralParams{
+					queryString: `rate({app="foo"}[1m])`,
+					start:       time.Unix(0, 0),
+					end:         time.Unix(60, 0), // Instant query: single step
+					step:        30 * time.Second,
+					interval:    0,
+					direction:   logproto.FORWARD,
+					limit:       100,
+				}
+			}
+
+			q := &query{
+				params: params,
+			}
+
+			// Create the initial vector with the specified number of series
+			vec := make(promql.Vector, test.vectorSize)
+			for i := 0; i < test.vectorSize; i++ {
+				vec[i] = promql.Sample{
+					T:      60 * 1000,
+					F:      float64(i + 1),
+					Metric: labels.FromStrings("app", fmt.Sprintf("app%d", i)),
+				}
+			}
+
+			// Create additional vectors for range query testing
+			var stepResults []StepResult
+			if test.isRangeQuery && len(test.additionalVectors) > 0 {
+				seriesOffset := test.vectorSize // Start naming series after the initial vector
+				for _, additionalSize := range test.additionalVectors {
+					additionalVec := make(promql.Vector, additionalSize)
+					for i := 0; i < additionalSize; i++ {
+						additionalVec[i] = promql.Sample{
+							T:      120 * 1000, // Different timestamp for subsequent steps
+							F:      float64(seriesOffset + i + 1),
+							Metric: labels.FromStrings("app", fmt.Sprintf("app%d", seriesOffset+i)),
+						}
+					}
+					stepResults = append(stepResults, &storeSampleResult{vector: additionalVec})
+					seriesOffset += additionalSize
+				}
+			}
+
+			// Create a mock step evaluator
+			stepEvaluator := &mockStepEvaluator{
+				results: stepResults,
+				current: 0,
+				t:       t,
+			}
+
+			// Call JoinSampleVector with context
+			result, err := q.JoinSampleVector(ctx, true, &storeSampleResult{vector: vec}, stepEvaluator, test.maxSeries, false)
+
+			if test.expectError {
+				require.Error(t, err)
+				require.True(t, errors.Is(err, logqlmodel.ErrLimit))
+				require.Nil(t, result)
+			} else {
+				require.NoError(t, err)
+				require.NotNil(t, result)
+
+				if test.expectTruncation {
+					// Check that the result was truncated to maxSeries
+					var actualSeriesCount int
+					if vec, ok := result.(promql.Vector); ok {
+						// Instant query result
+						actualSeriesCount = len(vec)
+					} else if matrix, ok := result.(promql.Matrix); ok {
+						// Range query result - count unique series
+						seriesMap := make(map[string]bool)
+						for _, series := range matrix {
+							seriesMap[series.Metric.String()] = true
+						}
+						actualSeriesCount = len(seriesMap)
+					} else {
+						t.Fatalf("Unexpected result type: %T", result)
+					}
+
+					require.LessOrEqual(t, actualSeriesCount, test.maxSeries,
+						"Expected result to be truncated to maxSeries (%d), but got %d series",
+						test.maxSeries, actualSeriesCount)
+
+					// Check for warning
+					meta := metadata.FromContext(ctx)
+					warnings := meta.Warnings()
+					require.NotEmpty(t, warnings, "Expected warnings but got none")
+					require.Contains(t, warnings[0], test.expectedWarningMsg)
+					require.Equal(t, test.expectedDropped, statsCtx.Result(0, 0, 0).Summary.DroppedSeries)
+				} else {
+					// No truncation expected - verify no warnings
+					meta := metadata.FromContext(ctx)
+					warnings := meta.Warnings()
+					if test.expectedWarningMsg == "" {
+						require.Empty(t, warnings, "Expected no warnings but got: %v", warnings)
+					}
+					require.Zero(t, statsCtx.Result(0, 0, 0).Summary.DroppedSeries)
+				}
+			}
+		})
+	}
+}
+
+func TestJoinSampleVector_MaxSeriesPerStep(t *testing.T) {
+	// every step has 2 series, under the total limit of 3.
+	step := func(ts int64) *storeSampleResult {
+		return &storeSampleResult{vector: promql.Vector{
+			{T: ts, F: 2, Metric: labels.FromStrings("app", "bar")},
+			{T: ts, F: 1, Metric: labels.FromStrings("app", "foo")},
+		}}
+	}
+	params := &LiteralParams{
+		queryString: `rate({app=~"foo|bar"}[1m])`,
+		start:       time.Unix(60, 0),
+		end:         time.Unix(120, 0),
+		step:        time.Minute,
+		direction:   logproto.FORWARD,
+		limit:       100,
+	}
+
+	for _, tc := range []struct {
+		name        string
+		queryTags   string
+		expectError bool
+	}{
+		{"drilldown", "Source=grafana-lokiexplore-app", false},
+		{"non-drilldown", "Source=grafana", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			metadataCtx, ctx := metadata.NewContext(httpreq.InjectQueryTags(context.Background(), tc.queryTags))
+			q := &query{params: params, maxSeriesPerStep: 1}
+			stepEvaluator := &mockStepEvaluator{results: []StepResult{step(120000)}, t: t}
+
+			result, err := q.JoinSampleVector(ctx, true, step(60000), stepEvaluator, 3, false)
+			if tc.expectError {
+				require.ErrorIs(t, err, logqlmodel.ErrLimit)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, promql.Matrix{{
+				Metric: labels.FromStrings("app", "bar"),
+				Floats: []promql.FPoint{{T: 60000, F: 2}, {T: 120000, F: 2}},
+			}}, result)
+			require.Equal(t, []metadata.Warning{metadata.MaxSeriesPerStepWarning(1)}, metadataCtx.StructuredWarnings())
+		})
+	}
+}
+
+func TestHttpreqIsLogsDrilldownRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		queryTags string
+		expected  bool
+	}{
+		{
+			name:      "Valid Logs Drilldown request",
+			queryTags: "Source=grafana-lokiexplore-app,Feature=patterns",
+			expected:  true,
+		},
+		{
+			name:      "Case insensitive source matching",
+			queryTags: "Source=GRAFANA-LOKIEXPLORE-APP,Feature=patterns",
+			expected:  true,
+		},
+		{
+			name:      "Different source",
+			queryTags: "Source=grafana,Feature=explore",
+			expected:  false,
+		},
+		{
+			name:      "No source tag",
+			queryTags: "Feature=patterns,User=test",
+			expected:  false,
+		},
+		{
+			name:      "Empty query tags",
+			queryTags: "",
+			expected:  false,
+		},
+		{
+			name:      "Malformed tags",
+			queryTags: "invalid_tags_format",
+			expected:  false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.queryTags != "" {
+				ctx = httpreq.InjectQueryTags(ctx, test.queryTags)
+			}
+
+			result := httpreq.IsLogsDrilldownRequest(ctx)
+			require.Equal(t, test.expected, result, "Expected %v, got %v for queryTags: %s", test.expected, result, test.queryTags)
+		})
+	}
+}
+
+func TestJoinSampleVector_RangeQueryVectorOverwrite(t *testing.T) {
+	t.Parallel()
+
+	// This test covers a vector overwrite issue in range queries for Logs Drilldown.
+	// The problem was that after truncating the first vector due to series limit,
+	// subsequent steps in the range query can overwrite the truncated vector with larger vectors,
+	// causing the final result to exceed the intended series limit.
+
+	ctx := context.Background()
+	ctx = httpreq.InjectQueryTags(ctx, "Source=grafana-lokiexplore-app")
+	_, ctx = metadata.NewContext(ctx)
+
+	// Create mock params for a range query (multiple steps)
+	params := &LiteralParams{
+		queryString: `rate({app="foo"}[1m])`,
+		start:       time.Unix(0, 0),
+		end:         time.Unix(120, 0), // 3 steps with 60s step
+		step:        60 * time.Second,
+		interval:    0,
+		direction:   logproto.FORWARD,
+		limit:       100,
+	}
+
+	q := &query{
+		params: params,
+	}
+
+	maxSeries := 2 // Limit to 2 series
+
+	// Create first vector that exceeds the limit (3 series)
+	firstVec := make(promql.Vector, 3)
+	for i := range 3 {
+		firstVec[i] = promql.Sample{
+			T:      0 * 1000, // First time step
+			F:      float64(i + 1),
+			Metric: labels.FromStrings("app", fmt.Sprintf("app%d", i)),
+		}
+	}
+
+	// Create second vector that also exceeds the limit (4 series)
+	// This simulates the case where subsequent steps return even more series
+	secondVec := make(promql.Vector, 4)
+	for i := range 4 {
+		secondVec[i] = promql.Sample{
+			T:      60 * 1000, // Second time step
+			F:      float64(i + 10),
+			Metric: labels.FromStrings("app", fmt.Sprintf("app%d", i)),
+		}
+	}
+
+	// Create third vector that also exceeds the limit (5 series)
+	thirdVec := make(promql.Vector, 5)
+	for i := range 5 {
+		thirdVec[i] = promql.Sample{
+			T:      120 * 1000, // Third time step
+			F:      float64(i + 20),
+			Metric: labels.FromStrings("app", fmt.Sprintf("app%d", i)),
+		}
+	}
+
+	// Create a mock step evaluator that returns vectors exceeding the limit on each call
+	stepEvaluator := &mockStepEvaluator{
+		results: []StepResult{
+			&storeSampleResult{vector: secondVec}, // Second call will return 4 series
+			&storeSampleResult{vector: thirdVec},  // Third call will return 5 series
+		},
+		current: 0,
+		t:       t,
+	}
+
+	// Call JoinSampleVector with the first vector (3 series) and step evaluator
+	// that will return even larger vectors in subsequent steps
+	result, err := q.JoinSampleVector(ctx, true, &storeSampleResult{vector: firstVec}, stepEvaluator, maxSeries, false)
+
+	require.NoError(t, err)
+	require.NotNil(t, result)
+
+	// This test expects the CORRECT behavior: series limit should be respected
+	// across all steps of a range query for Logs Drilldown requests
+	if matrix, ok := result.(promql.Matrix); ok {
+		// Count total unique series across all steps
+		seriesMap := make(map[string]bool)
+		for _, series := range matrix {
+			seriesMap[series.Metric.String()] = true
+		}
+
+		// The correct behavior: final result should never exceed maxSeries
+		// This assertion will FAIL initially, demonstrating the bug exists
+		require.LessOrEqual(t, len(seriesMap), maxSeries,
+			"Expected series limit to be respected across all range query steps. "+
+				"Found %d series but limit is %d. This indicates the vector overwrite bug exists.",
+			len(seriesMap), maxSeries)
+
+		t.Logf("Correct behavior: found %d unique series (within limit of %d)", len(seriesMap), maxSeries)
+	} else {
+		t.Fatalf("Expected Matrix result, got %T", result)
+	}
+
+	// Verify that warnings were still added for the first truncation
+	meta := metadata.FromContext(ctx)
+	warnings := meta.Warnings()
+	require.NotEmpty(t, warnings, "Expected warnings due to series limit exceeded")
+	require.Contains(t, warnings[0], "maximum number of series")
+}
+
+func TestEngine_LabelTransforms(t *testing.T) {
+	const (
+		qs    = `sum by (host) (count_over_time({app="foo"}[1m])) * on (host) group_left sum by (pod) (count_over_time({app="bar"}[1m]))`
+		left  = `sum by (host) (count_over_time({app="foo"}[1m]))`
+		right = `sum by (pod) (count_over_time({app="bar"}[1m]))`
+	)
+	ts := time.Unix(60, 0)
+
+	// pods are named after the host they run on plus a random suffix.
+	podToHost, err := NewLabelTransform(BinOpSideRight, "pod", "host", `(.*)-[a-z0-9]+`, "$1")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name       string
+		transforms []LabelTransform
+		expected   promql.Vector
+	}{
+		{"without transform", nil, promql.Vector{}},
+		{
+			"with transform",
+			[]LabelTransform{podToHost},
+			promql.Vector{{T: 60 * 1000, F: 36, Metric: labels.FromStrings("host", "web-1")}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			querier := newQuerierRecorder(t,
+				[][]logproto.Series{
+					{newSeries(testSize, factor(10, identity), `{host="web-1"}`)},
+					{newSeries(testSize, factor(10, identity), `{pod="web-1-abc12"}`)},
+				},
+				[]SelectSampleParams{
+					{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: left}},
+					{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: right}},
+				},
+			)
+			eng := NewEngine(EngineOpts{LabelTransforms: tc.transforms}, querier, NoLimits, log.NewNopLogger())
+			params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, res.Data)
+		})
+	}
+}
+
+func TestNewLabelTransform(t *testing.T) {
+	_, err := NewLabelTransform(BinOpSideLeft, "pod", "host", `(.*`, "$1")
+	require.Error(t, err)
+	_, err = NewLabelTransform("middle", "pod", "host", `(.*)`, "$1")
+	require.Error(t, err)
+}
+
+func TestEngine_LabelDropRegex(t *testing.T) {
+	const (
+		qs       = `label_drop_regex(count_over_time({app="foo"}[1m]), "tmp_.*")`
+		selector = `count_over_time({app="foo"}[1m])`
+	)
+	ts := time.Unix(60, 0)
+
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{
+			newSeries(testSize, factor(10, identity), `{app="foo", pod="p1", tmp_a="1", tmp_b="2", tmp_request_id="abc"}`),
+			newSeries(testSize, factor(10, identity), `{app="foo", pod="p2", tmp="3", my_tmp_c="4", tmp_d="5"}`),
+		}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: selector}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+
+	vec, ok := res.Data.(promql.Vector)
+	require.True(t, ok)
+	actual := make([]labels.Labels, 0, len(vec))
+	for _, s := range vec {
+		require.Equal(t, 6., s.F)
+		actual = append(actual, s.Metric)
+	}
+	require.ElementsMatch(t, []labels.Labels{
+		labels.FromStrings("app", "foo", "pod", "p1"),
+		labels.FromStrings("app", "foo", "pod", "p2", "tmp", "3", "my_tmp_c", "4"),
+	}, actual)
+}
+
+func TestEngine_MatchedBytesOverTime(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{{
+		Labels: `{app="foo"}`,
+		Entries: []logproto.Entry{
+			{Timestamp: time.Unix(1, 0), Line: "a token here"},
+			{Timestamp: time.Unix(2, 0), Line: "token token"},
+			{Timestamp: time.Unix(3, 0), Line: "tokenizer tokens"},
+			{Timestamp: time.Unix(4, 0), Line: "nothing to see"},
+		},
+	}})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+
+	for _, tc := range []struct {
+		qs       string
+		expected float64
+	}{
+		// 5 + 10 + 5 + 5
+		{`matched_bytes_over_time({app="foo"} |= "token" [1m])`, 25},
+		// 5 + 10 + 9 + 6
+		{`matched_bytes_over_time({app="foo"} |~ "tok[a-z]*" [1m])`, 30},
+		// "here" and "see" are matched in addition to the tokens.
+		{`matched_bytes_over_time({app="foo"} |= "token" or "here" or "see" [1m])`, 32},
+		// lines are filtered but "nothing" is the only match.
+		{`matched_bytes_over_time({app="foo"} != "token" |= "nothing" [1m])`, 7},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, promql.Vector{{T: 60 * 1000, F: tc.expected, Metric: labels.FromStrings("app", "foo")}}, res.Data)
+		})
+	}
+}
+
+func TestEngine_InstantAsMatrix(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{{
+		Labels: `{app="foo"}`,
+		Entries: []logproto.Entry{
+			{Timestamp: time.Unix(1, 0), Line: "a"},
+			{Timestamp: time.Unix(2, 0), Line: "b"},
+		},
+	}})
+	for _, qs := range []string{`vector(5)`, `sum(count_over_time({app="foo"}[1m]))`} {
+		t.Run(qs, func(t *testing.T) {
+			params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			ctx := user.InjectOrgID(context.Background(), "fake")
+
+			vec, err := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+			require.NoError(t, err)
+			require.IsType(t, promql.Vector{}, vec.Data)
+
+			mat, err := NewEngine(EngineOpts{InstantAsMatrix: true}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+			require.NoError(t, err)
+			require.Equal(t, VectorToMatrix(vec.Data.(promql.Vector)), mat.Data)
+			require.Equal(t, promql.Matrix{{
+				Metric: labels.EmptyLabels(),
+				Floats: []promql.FPoint{{T: 60 * 1000, F: vec.Data.(promql.Vector)[0].F}},
+			}}, mat.Data)
+		})
+	}
+}
+
+type memorySink struct {
+	series  []promql.Series
+	streams []logproto.Stream
+}
+
+func (s *memorySink) SendSeries(series promql.Series) error {
+	s.series = append(s.series, series)
+	return nil
+}
+
+func (s *memorySink) SendStream(stream logproto.Stream) error {
+	s.streams = append(s.streams, stream)
+	return nil
+}
+
+func TestEngine_ExecToSink(t *testing.T) {
+	var streams []logproto.Stream
+	for _, app := range []string{"a", "b", "c"} {
+		last := int64(120)
+		if app == "c" {
+			last = 75
+		}
+		var entries []logproto.Entry
+		for i := int64(1); i <= last; i++ {
+			entries = append(entries, logproto.Entry{Timestamp: time.Unix(i, 0), Line: fmt.Sprintf("%s %d", app, i)})
+		}
+		streams = append(streams, logproto.Stream{Labels: fmt.Sprintf(`{app=%q}`, app), Entries: entries})
+	}
+	eng := NewEngine(EngineOpts{}, NewMockQuerier(0, streams), NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	t.Run("series", func(t *testing.T) {
+		// the range query has 7 steps, the last ones of c are empty and held.
+		params, err := NewLiteralParams(`count_over_time({app=~".+"}[10s])`, time.Unix(60, 0), time.Unix(120, 0), 10*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		for name, tc := range map[string]struct {
+			opts   EngineOpts
+			params Params
+		}{
+			"plain":         {params: params},
+			"hold":          {params: params.WithHold(time.Minute)},
+			"step delta":    {params: params.WithResultTransform(ResultTransformStepDelta)},
+			"interpolation": {opts: EngineOpts{MaxEvaluatedSteps: 4}, params: params},
+		} {
+			t.Run(name, func(t *testing.T) {
+				eng := NewEngine(tc.opts, NewMockQuerier(0, streams), NoLimits, log.NewNopLogger())
+				expected, err := eng.Query(tc.params).Exec(ctx)
+				require.NoError(t, err)
+
+				sink := &memorySink{}
+				res, err := eng.Query(tc.params).(SinkExecutor).ExecToSink(ctx, sink)
+				require.NoError(t, err)
+				require.Nil(t, res.Data)
+				// each series is sent once, complete.
+				require.Len(t, sink.series, 3)
+				require.Equal(t, expected.Data, promql.Matrix(sink.series))
+				require.Equal(t, expected.Statistics.Summary.TotalEntriesReturned, res.Statistics.Summary.TotalEntriesReturned)
+			})
+		}
+	})
+
+	t.Run("streams", func(t *testing.T) {
+		params, err := NewLiteralParams(`{app=~".+"}`, time.Unix(0, 0), time.Unix(121, 0), 0, 0, logproto.FORWARD, 1000, nil, nil)
+		require.NoError(t, err)
+
+		sink := &memorySink{}
+		_, err = eng.Query(params).(SinkExecutor).ExecToSink(ctx, sink)
+		require.NoError(t, err)
+		require.Len(t, sink.streams, 3)
+		require.ElementsMatch(t, streams, sink.streams)
+	})
+}
+
+func TestEngine_ExecWithBaseline(t *testing.T) {
+	var streams []logproto.Stream
+	for _, app := range []string{"a", "b"} {
+		var entries []logproto.Entry
+		for i := int64(1); i <= 120; i++ {
+			entries = append(entries, logproto.Entry{Timestamp: time.Unix(i, 0), Line: "line"})
+		}
+		streams = append(streams, logproto.Stream{Labels: fmt.Sprintf(`{app=%q}`, app), Entries: entries})
+	}
+	eng := NewEngine(EngineOpts{}, NewMockQuerier(0, streams), NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	// every step counts 30 lines.
+	params, err := NewLiteralParams(`count_over_time({app=~".+"}[30s])`, time.Unix(60, 0), time.Unix(120, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+
+	baseline := promql.Matrix{
+		{Metric: labels.FromStrings("app", "a"), Floats: []promql.FPoint{{T: 60_000, F: 20}, {T: 90_000, F: 30}, {T: 120_000, F: 40}}},
+		{Metric: labels.FromStrings("app", "c"), Floats: []promql.FPoint{{T: 60_000, F: 1}}},
+	}
+	res, err := eng.Query(params).(BaselineExecutor).ExecWithBaseline(ctx, baseline)
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{
+		{Metric: labels.FromStrings("app", "a"), Floats: []promql.FPoint{{T: 60_000, F: 10}, {T: 90_000, F: 0}, {T: 120_000, F: -10}}},
+	}, res.Data)
+
+	params, err = NewLiteralParams(`{app="a"}`, time.Unix(0, 0), time.Unix(120, 0), 0, 0, logproto.FORWARD, 10, nil, nil)
+	require.NoError(t, err)
+	_, err = eng.Query(params).(BaselineExecutor).ExecWithBaseline(ctx, baseline)
+	require.Error(t, err)
+}
+
+func TestEngine_UnwrapArithmetic(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{{
+		Labels: `{app="foo"}`,
+		Entries: []logproto.Entry{
+			{Timestamp: time.Unix(1, 0), Line: `bytes_sent=1000 duration=2`},
+			{Timestamp: time.Unix(2, 0), Line: `bytes_sent=3000 duration=2`},
+			{Timestamp: time.Unix(3, 0), Line: `bytes_sent=3000 duration=0`},
+		},
+	}})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	// the division by zero sample is dropped with the __error__ filter.
+	params, err := NewLiteralParams(`avg_over_time({app="foo"} | logfmt | unwrap (bytes_sent / duration) | __error__="" [1m])`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Equal(t, promql.Vector{{T: 60 * 1000, F: 1000, Metric: labels.FromStrings("app", "foo")}}, res.Data)
+
+	params, err = NewLiteralParams(`avg_over_time({app="foo"} | logfmt | unwrap (bytes_sent / duration) [1m])`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	_, err = eng.Query(params).Exec(ctx)
+	require.Error(t, err)
+}
+
+func TestEngine_SetBool(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{
+		newStream(120, identity, `{app="foo"}`),
+		newStream(120, identity, `{app="bar"}`),
+	})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	points := func(v float64) []promql.FPoint {
+		return []promql.FPoint{{T: 60 * 1000, F: v}, {T: 90 * 1000, F: v}, {T: 120 * 1000, F: v}}
+	}
+
+	for _, tc := range []struct {
+		qs       string
+		expected promql.Matrix
+	}{
+		{
+			`rate({app=~"foo|bar"}[1m]) and bool rate({app="bar"}[1m])`,
+			promql.Matrix{
+				{Metric: labels.FromStrings("app", "bar"), Floats: points(1)},
+				{Metric: labels.FromStrings("app", "foo"), Floats: points(0)},
+			},
+		},
+		{
+			`rate({app=~"foo|bar"}[1m]) unless bool rate({app="bar"}[1m])`,
+			promql.Matrix{
+				{Metric: labels.FromStrings("app", "bar"), Floats: points(0)},
+				{Metric: labels.FromStrings("app", "foo"), Floats: points(1)},
+			},
+		},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(60, 0), time.Unix(120, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, res.Data)
+		})
+	}
+}
+
+func TestEngine_UnwrapRegex(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{{
+		Labels: `{app="foo"}`,
+		Entries: []logproto.Entry{
+			{Timestamp: time.Unix(1, 0), Line: `request served in a hurry, latency_p99=100ms`},
+			{Timestamp: time.Unix(2, 0), Line: `cache warmed up`},
+			{Timestamp: time.Unix(3, 0), Line: `latency_p99=250.5ms for GET /api`},
+			{Timestamp: time.Unix(4, 0), Line: `latency_p50=1000ms`},
+		},
+	}})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+
+	// lines without the capture are dropped.
+	params, err := NewLiteralParams(`avg_over_time({app="foo"} | unwrap_regex "latency_p99=(?P<v>[0-9.]+)" as v [1m])`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Equal(t, promql.Vector{{T: 60 * 1000, F: 175.25, Metric: labels.FromStrings("app", "foo")}}, res.Data)
+}
+
+type cardinalityQuerier struct {
+	Querier
+	cardinality int
+	selected    int
+}
+
+func (q *cardinalityQuerier) SeriesCardinality(_ context.Context, _ SelectSampleParams) (int, error) {
+	return q.cardinality, nil
+}
+
+func (q *cardinalityQuerier) SelectSamples(ctx context.Context, params SelectSampleParams) (iter.SampleIterator, error) {
+	q.selected++
+	return q.Querier.SelectSamples(ctx, params)
+}
+
+type labelFilterQuerier struct {
+	Querier
+	selector string
+	filters  []*labels.Matcher
+}
+
+func (q *labelFilterQuerier) SelectSamplesWithLabelFilters(ctx context.Context, params SelectSampleParams, filters []*labels.Matcher) (iter.SampleIterator, error) {
+	q.selector, q.filters = params.Selector, filters
+	return q.Querier.SelectSamples(ctx, params)
+}
+
+func TestEngine_LabelFilterPushdown(t *testing.T) {
+	var entries []logproto.Entry
+	for i := int64(1); i <= 60; i++ {
+		level := "info"
+		if i%3 == 0 {
+			level = "error"
+		}
+		entries = append(entries, logproto.Entry{Timestamp: time.Unix(i, 0), Line: fmt.Sprintf(`{"level":"%s","latency":%d}`, level, i)})
+	}
+	streams := []logproto.Stream{{Labels: `{app="foo"}`, Entries: entries}}
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	for _, tc := range []struct {
+		qs      string
+		filters []*labels.Matcher
+	}{
+		{`count_over_time({app="foo"} | json | level="error" [1m])`, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "level", "error")}},
+		{`sum(count_over_time({app="foo"} | json | level="error" [1m]))`, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "level", "error")}},
+		{`count_over_time({app="foo"} | json | level=~"err.*" [1m])`, nil},
+		{`count_over_time({app="foo"} | json | level="error" or level="warn" [1m])`, nil},
+		{`sum_over_time({app="foo"} | json | level="error" | unwrap latency [1m])`, nil},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			expected, err := NewEngine(EngineOpts{}, NewMockQuerier(0, streams), NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+			require.NoError(t, err)
+
+			q := &labelFilterQuerier{Querier: NewMockQuerier(0, streams)}
+			res, err := NewEngine(EngineOpts{}, q, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+			require.NoError(t, err)
+			require.Equal(t, expected.Data, res.Data)
+
+			require.Equal(t, tc.filters, q.filters)
+			if tc.filters != nil {
+				require.Contains(t, q.selector, `level="error"`)
+			} else {
+				require.Empty(t, q.selector)
+			}
+		})
+	}
+}
+
+func TestEngine_SeriesCardinalityPreCheck(t *testing.T) {
+	streams := []logproto.Stream{{
+		Labels:  `{app="foo"}`,
+		Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "line"}},
+	}}
+	params, err := NewLiteralParams(`count_over_time({app="foo"}[1m])`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	querier := &cardinalityQuerier{Querier: NewMockQuerier(0, streams), cardinality: 1000}
+	eng := NewEngine(EngineOpts{}, querier, &fakeLimits{maxSeries: 1}, log.NewNopLogger())
+	_, err = eng.Query(params).Exec(ctx)
+	require.ErrorIs(t, err, logqlmodel.ErrLimit)
+	require.Zero(t, querier.selected)
+
+	querier.cardinality = 1
+	res, err := eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Equal(t, promql.Vector{{T: 60 * 1000, F: 1, Metric: labels.FromStrings("app", "foo")}}, res.Data)
+	require.Equal(t, 1, querier.selected)
+
+	// the limit applies to the result series, not to the selected streams
+	// aggregated or filtered out.
+	querier.cardinality = 1000
+	for _, query := range []string{
+		`sum(count_over_time({app="foo"}[1m]))`,
+		`count_over_time({app="foo"} |= "line"[1m])`,
+		`count_over_time({app="foo"} | logfmt | app="foo"[1m])`,
+	} {
+		params, err := NewLiteralParams(query, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		_, err = eng.Query(params).Exec(ctx)
+		require.NoError(t, err, query)
+	}
+	params, err = NewLiteralParams(`count_over_time({app="foo"} | logfmt[1m])`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	_, err = eng.Query(params).Exec(ctx)
+	require.ErrorIs(t, err, logqlmodel.ErrLimit)
+}
+
+func TestEngine_UnpackedBytes(t *testing.T) {
+	const (
+		packed   = `{"_entry":"hello world","pod":"p1"}`
+		unpacked = `hello world`
+	)
+	querier := NewMockQuerier(0, []logproto.Stream{{
+		Labels: `{app="foo"}`,
+		Entries: []logproto.Entry{
+			{Timestamp: time.Unix(1, 0), Line: packed},
+			{Timestamp: time.Unix(2, 0), Line: packed},
+		},
+	}})
+	const qs = `sum(bytes_over_time({app="foo"} | unpack [1m]))`
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		unpackedBytes bool
+		expected      float64
+	}{
+		{false, 2 * float64(len(packed))},
+		{true, 2 * float64(len(unpacked))},
+	} {
+		t.Run(fmt.Sprintf("unpacked_bytes=%v", tc.unpackedBytes), func(t *testing.T) {
+			eng := NewEngine(EngineOpts{UnpackedBytes: tc.unpackedBytes}, querier, NoLimits, log.NewNopLogger())
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, promql.Vector{{T: 60 * 1000, F: tc.expected, Metric: labels.EmptyLabels()}}, res.Data)
+		})
+	}
+}
+
+func TestEngine_JSONSchema(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{{
+		Labels: `{app="foo"}`,
+		Entries: []logproto.Entry{
+			{Timestamp: time.Unix(1, 0), Line: `{"status": 200}`},
+			{Timestamp: time.Unix(2, 0), Line: `{"status": "ok"}`},
+			{Timestamp: time.Unix(3, 0), Line: `{"status": 500}`},
+		},
+	}})
+	limits := &fakeLimits{maxSeries: 10, jsonSchemas: map[string]string{
+		"access_log": `{"type": "object", "properties": {"status": {"type": "integer"}}}`,
+	}}
+	eng := NewEngine(EngineOpts{}, querier, limits, log.NewNopLogger())
+
+	t.Run("labels non-conforming lines", func(t *testing.T) {
+		params, err := NewLiteralParams(`sum by (__error__) (count_over_time({app="foo"} | json_schema "access_log" [1m]))`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.NoError(t, err)
+		require.Equal(t, promql.Vector{
+			{T: 60 * 1000, F: 2, Metric: labels.EmptyLabels()},
+			{T: 60 * 1000, F: 1, Metric: labels.FromStrings(logqlmodel.ErrorLabel, "JSONSchemaValidationErr")},
+		}, res.Data)
+	})
+
+	t.Run("unknown schema", func(t *testing.T) {
+		params, err := NewLiteralParams(`{app="foo"} | json_schema "audit_log"`, time.Unix(0, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 100, nil, nil)
+		require.NoError(t, err)
+		_, err = eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.EqualError(t, err, `parse error : unknown json schema "audit_log"`)
+	})
+}
+
+func TestEngine_WarningsDeduplicated(t *testing.T) {
+	entries := make([]logproto.Entry, 0, 180)
+	for i := 1; i <= 180; i++ {
+		entries = append(entries, logproto.Entry{Timestamp: time.Unix(int64(i), 0), Line: "v=0"})
+	}
+	querier := NewMockQuerier(0, []logproto.Stream{{Labels: `{app="foo"}`, Entries: entries}})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	// the mean of every window is zero, which warns at every step.
+	params, err := NewLiteralParams(`cv_over_time({app="foo"} | logfmt | unwrap v [1m])`, time.Unix(60, 0), time.Unix(180, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Len(t, res.Data.(promql.Matrix)[0].Floats, 3)
+	require.Equal(t, []string{"cv_over_time is NaN for windows with a mean of zero"}, res.Warnings)
+}
+
+func TestEngine_ResultLabelNames(t *testing.T) {
+	const (
+		qs       = `sum by (cluster,namespace,app) (count_over_time({app=~"foo|bar"}[1m]))`
+		selector = `sum by (cluster, namespace, app) (count_over_time({app=~"foo|bar"}[1m]))`
+	)
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{
+			newSeries(testSize, factor(10, identity), `{app="foo", cluster="b", namespace="a", pod="p1"}`),
+			newSeries(testSize, factor(10, identity), `{app="bar", cluster="a", pod="p2"}`),
+		}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(180, 0), Selector: selector}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"app", "cluster", "namespace"}, res.LabelNames)
+}
+
+func TestResultLabelNames(t *testing.T) {
+	require.Nil(t, resultLabelNames(logqlmodel.Streams{}))
+	require.Empty(t, resultLabelNames(promql.Vector{}))
+	require.Equal(t, []string{constants.VariantLabel, "app", "job"}, resultLabelNames(promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo", constants.VariantLabel, "0")},
+		{Metric: labels.FromStrings("app", "foo", "job", "a", constants.VariantLabel, "1")},
+	}))
+}
+
+func TestEngine_Units(t *testing.T) {
+	eng := NewEngine(EngineOpts{}, getLocalQuerier(10), NoLimits, log.NewNopLogger())
+
+	for _, tc := range []struct {
+		name     string
+		qs       string
+		unit     string
+		warnings []metadata.Warning
+	}{
+		{
+			name: "consistent units",
+			qs:   `sum(bytes_over_time({app="foo"} | __unit__("bytes") [1m])) + sum(bytes_over_time({app="bar"} | __unit__("bytes") [1m]))`,
+			unit: "bytes",
+		},
+		{
+			name: "combined units",
+			qs:   `sum(bytes_over_time({app="foo"} | __unit__("bytes") [1m])) / sum(count_over_time({app="bar"} | __unit__("lines") [1m]))`,
+			unit: "bytes/lines",
+		},
+		{
+			name:     "mismatched units",
+			qs:       `sum(bytes_over_time({app="foo"} | __unit__("bytes") [1m])) + sum(count_over_time({app="bar"} | __unit__("s") [1m]))`,
+			unit:     "bytes",
+			warnings: []metadata.Warning{metadata.UnitMismatchWarning("+", "bytes", "s")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(30, 0), time.Unix(30, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, tc.unit, res.Unit)
+			require.Equal(t, tc.warnings, res.StructuredWarnings)
+		})
+	}
+}
+
+// panickingQuerier fails the test if it's ever called.
+type panickingQuerier struct{}
+
+func (panickingQuerier) SelectLogs(context.Context, SelectLogParams) (iter.EntryIterator, error) {
+	panic("SelectLogs must not be called")
+}
+
+func (panickingQuerier) SelectSamples(context.Context, SelectSampleParams) (iter.SampleIterator, error) {
+	panic("SelectSamples must not be called")
+}
+
+func TestEngine_SelectorFreeQueries(t *testing.T) {
+	eng := NewEngine(EngineOpts{}, panickingQuerier{}, NoLimits, log.NewNopLogger())
+
+	for _, tc := range []struct {
+		qs       string
+		expected float64
+	}{
+		{`10 / (5 / 2)`, 4},
+		{`1 == bool 1`, 1},
+		{`vector(2)`, 2},
+		{`vector(1) + vector(2)`, 3},
+		{`sum(vector(3)) * 2`, 6},
+		{`vector(1) > bool 0`, 1},
+		{`label_replace(vector(1), "foo", "bar", "", "")`, 1},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			// without a tenant since no tenant limits apply.
+			ctx := context.Background()
+
+			params, err := NewLiteralParams(tc.qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(ctx)
+			require.NoError(t, err)
+			switch data := res.Data.(type) {
+			case promql.Scalar:
+				require.Equal(t, tc.expected, data.V)
+			case promql.Vector:
+				require.Len(t, data, 1)
+				require.Equal(t, tc.expected, data[0].F)
+			default:
+				t.Fatalf("unexpected result type %T", data)
+			}
+
+			params, err = NewLiteralParams(tc.qs, time.Unix(60, 0), time.Unix(300, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err = eng.Query(params).Exec(ctx)
+			require.NoError(t, err)
+			matrix, ok := res.Data.(promql.Matrix)
+			require.True(t, ok)
+			require.Len(t, matrix, 1)
+			require.Len(t, matrix[0].Floats, 5)
+			for _, p := range matrix[0].Floats {
+				require.Equal(t, tc.expected, p.F)
+			}
+		})
+	}
+}
+
+func TestEngine_LabelMode(t *testing.T) {
+	const (
+		qs       = `label_mode(count_over_time({app="foo"}[1m]), "version")`
+		selector = `count_over_time({app="foo"}[1m])`
+	)
+	ts := time.Unix(60, 0)
+
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{
+			newSeries(testSize, factor(10, identity), `{app="foo", pod="p1", version="v1"}`),
+			newSeries(testSize, factor(10, identity), `{app="foo", pod="p2", version="v2"}`),
+			newSeries(testSize, factor(10, identity), `{app="foo", pod="p3", version="v2"}`),
+			newSeries(testSize, factor(10, identity), `{app="foo", pod="p4", version="v3"}`),
+			newSeries(testSize, factor(10, identity), `{app="foo", pod="p5", version="v2"}`),
+			newSeries(testSize, factor(10, identity), `{app="foo", pod="p6"}`),
+		}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: selector}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Equal(t, promql.Vector{{T: 60 * 1000, F: 3, Metric: labels.FromStrings("version", "v2")}}, res.Data)
+}
+
+func TestEngine_Round(t *testing.T) {
+	var entries []logproto.Entry
+	for i := int64(1); i <= 28; i++ {
+		entries = append(entries, logproto.Entry{Timestamp: time.Unix(i, 0), Line: "line"})
+	}
+	eng := NewEngine(EngineOpts{}, NewMockQuerier(0, []logproto.Stream{{Labels: `{app="foo"}`, Entries: entries}}), NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	// 28 lines over a minute is a rate of 0.4666...
+	const qs = `round(rate({app="foo"}[1m]), 0.01)`
+
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Equal(t, promql.Vector{{T: 60 * 1000, F: 0.47, Metric: labels.FromStrings("app", "foo")}}, res.Data)
+
+	params, err = NewLiteralParams(qs, time.Unix(60, 0), time.Unix(90, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err = eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	// no line falls in the range of the second step.
+	require.Equal(t, promql.Matrix{{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 60 * 1000, F: 0.47}}}}, res.Data)
+}
+
+func TestEngine_Absent(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{{
+		Labels:  `{app="foo"}`,
+		Entries: []logproto.Entry{{Timestamp: time.Unix(30, 0), Line: "line"}},
+	}})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	for _, tc := range []struct {
+		qs       string
+		expected promql.Vector
+	}{
+		{`absent(sum(rate({app="bar"}[1m])))`, promql.Vector{{T: 60 * 1000, F: 1, Metric: labels.EmptyLabels()}}},
+		{`absent(rate({app="bar", env=~"prod.*"}[1m]))`, promql.Vector{{T: 60 * 1000, F: 1, Metric: labels.FromStrings("app", "bar")}}},
+		{`absent(sum(rate({app="foo"}[1m])))`, promql.Vector{}},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(ctx)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, res.Data)
+		})
+	}
+}
+
+func TestEngine_IncludeSampleSources(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{
+		{
+			Labels: `{app="foo", pod="a"}`,
+			Entries: []logproto.Entry{
+				{Timestamp: time.Unix(0, 0), Line: "out of range"},
+				{Timestamp: time.Unix(10, 0), Line: "a1"},
+				{Timestamp: time.Unix(20, 0), Line: "a2"},
+			},
+		},
+		{
+			Labels:  `{app="foo", pod="b"}`,
+			Entries: []logproto.Entry{{Timestamp: time.Unix(30, 0), Line: "b1"}},
+		},
+	})
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	params, err := NewLiteralParams(`count_over_time({app="foo"}[1m])`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+
+	res, err := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Nil(t, res.SampleSources)
+
+	res, err = NewEngine(EngineOpts{IncludeSampleSources: true}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]logproto.Entry{
+		`{app="foo", pod="a"}`: {{Timestamp: time.Unix(10, 0), Line: "a1"}, {Timestamp: time.Unix(20, 0), Line: "a2"}},
+		`{app="foo", pod="b"}`: {{Timestamp: time.Unix(30, 0), Line: "b1"}},
+	}, res.SampleSources)
+
+	params, err = NewLiteralParams(`sum(count_over_time({app="foo"}[1m]))`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err = NewEngine(EngineOpts{IncludeSampleSources: true}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Len(t, res.SampleSources[`{}`], 3)
+}
+
+func TestEngine_MaxStepsPerQuery(t *testing.T) {
+	eng := NewEngine(EngineOpts{MaxStepsPerQuery: 100000}, NewMockQuerier(0, nil), NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	const qs = `rate({app="foo"}[1m])`
+
+	params, err := NewLiteralParams(qs, time.Unix(0, 0), time.Unix(100000, 0), time.Millisecond, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	_, err = eng.Query(params).Exec(ctx)
+	require.ErrorIs(t, err, logqlmodel.ErrQueryTooComplex)
+
+	params, err = NewLiteralParams(qs, time.Unix(0, 0), time.Unix(100000, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	_, err = eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+}
+
+func TestEngine_MaxExpressionDepth(t *testing.T) {
+	eng := NewEngine(EngineOpts{MaxExpressionDepth: 3}, NewMockQuerier(0, nil), NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	for _, tc := range []struct {
+		qs    string
+		depth int
+	}{
+		{`rate({app="foo"}[1m])`, 1},
+		{`sum by (app) (rate({app="foo"}[1m]) / 2)`, 3},
+		{`avg by (app) (sum by (app) (rate({app="foo"}[1m])) + sum by (app) (rate({app="bar"}[1m])) / sum by (app) (rate({app="baz"}[1m])))`, 5},
+		{`max(sum by (app) (avg by (app) (rate({app="foo"}[1m]))))`, 4},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			expr, err := syntax.ParseExpr(tc.qs)
+			require.NoError(t, err)
+			require.Equal(t, tc.depth, sampleExprDepth(expr))
+
+			params, err := NewLiteralParams(tc.qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			_, err = eng.Query(params).Exec(ctx)
+			if tc.depth > 3 {
+				require.ErrorIs(t, err, logqlmodel.ErrQueryTooComplex)
+			} else {
+				require.False(t, errors.Is(err, logqlmodel.ErrQueryTooComplex))
+			}
+		})
+	}
+
+	// the default maximum depth accepts common nested queries.
+	var opts EngineOpts
+	opts.RegisterFlagsWithPrefix("", flag.NewFlagSet("", flag.PanicOnError))
+	params, err := NewLiteralParams(`avg by (app) (sum by (app) (rate({app="foo"}[1m])) + sum by (app) (rate({app="bar"}[1m])) / sum by (app) (rate({app="baz"}[1m])))`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	_, err = NewEngine(opts, NewMockQuerier(0, nil), NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+	require.False(t, errors.Is(err, logqlmodel.ErrQueryTooComplex))
+}
+
+func TestEngine_MergedVariants(t *testing.T) {
+	var entries []logproto.Entry
+	for i := int64(1); i <= 120; i++ {
+		line := "info"
+		if i%4 == 0 {
+			line = "error"
+		}
+		entries = append(entries, logproto.Entry{Timestamp: time.Unix(i, 0), Line: line})
+	}
+	querier := NewMockQuerier(0, []logproto.Stream{{Labels: `{app="foo"}`, Entries: entries}})
+	limits := &fakeLimits{maxSeries: math.MaxInt32, timeout: time.Hour, multiVariantQueryEnable: true}
+	eng := NewEngine(EngineOpts{}, querier, limits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	const qs = `variants(count_over_time({app="foo"}[1m]), bytes_over_time({app="foo"}[1m])) of ({app="foo"}[1m]) merged(sum)`
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(120, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	// 60 lines of 255 bytes per minute.
+	require.Equal(t, promql.Matrix{{
+		Metric: labels.FromStrings("app", "foo"),
+		Floats: []promql.FPoint{{T: 60 * 1000, F: 315}, {T: 120 * 1000, F: 315}},
+	}}, res.Data)
+
+	params, err = NewLiteralParams(qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err = eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Equal(t, promql.Vector{{T: 60 * 1000, F: 315, Metric: labels.FromStrings("app", "foo")}}, res.Data)
+}
+
+func TestEngine_GroupedVariants(t *testing.T) {
+	entries := func(n, every int64) []logproto.Entry {
+		var entries []logproto.Entry
+		for i := every; i <= n; i += every {
+			entries = append(entries, logproto.Entry{Timestamp: time.Unix(i, 0), Line: "line"})
+		}
+		return entries
+	}
+	querier := NewMockQuerier(0, []logproto.Stream{
+		{Labels: `{app="foo", host="a"}`, Entries: entries(60, 1)},
+		{Labels: `{app="foo", host="b"}`, Entries: entries(60, 2)},
+		{Labels: `{app="bar", host="a"}`, Entries: entries(60, 5)},
+	})
+	limits := &fakeLimits{maxSeries: math.MaxInt32, timeout: time.Hour, multiVariantQueryEnable: true}
+	eng := NewEngine(EngineOpts{}, querier, limits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	params, err := NewLiteralParams(
+		`sum by (app) (variants(count_over_time({app=~"foo|bar"}[1m]), bytes_over_time({app=~"foo|bar"}[1m])) of ({app=~"foo|bar"}[1m]))`,
+		time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil,
+	)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	// 90 lines of 4 bytes for foo and 12 for bar, summed across hosts and variants.
+	require.Equal(t, promql.Vector{
+		{T: 60 * 1000, F: 60, Metric: labels.FromStrings("app", "bar")},
+		{T: 60 * 1000, F: 450, Metric: labels.FromStrings("app", "foo")},
+	}, res.Data)
+}
+
+func TestEngine_UnwrapDefault(t *testing.T) {
+	var foo, bar []logproto.Entry
+	for i := int64(1); i <= 60; i++ {
+		// every other line of foo lacks the latency.
+		line := "path=/"
+		if i%2 == 1 {
+			line = "latency=2 path=/"
+		}
+		foo = append(foo, logproto.Entry{Timestamp: time.Unix(i, 0), Line: line})
+		bar = append(bar, logproto.Entry{Timestamp: time.Unix(i, 0), Line: "path=/"})
+	}
+	querier := NewMockQuerier(0, []logproto.Stream{
+		{Labels: `{app="foo"}`, Entries: foo},
+		{Labels: `{app="bar"}`, Entries: bar},
+	})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	for _, tc := range []struct {
+		query    string
+		expected promql.Vector
+	}{
+		{
+			// lines without latency are dropped, and so is bar.
+			`sum by (app) (rate({app=~"foo|bar"} | logfmt | unwrap latency [1m]))`,
+			promql.Vector{{T: 60 * 1000, F: 1, Metric: labels.FromStrings("app", "foo")}},
+		},
+		{
+			`sum by (app) (rate({app=~"foo|bar"} | logfmt | unwrap latency default 0 [1m]))`,
+			promql.Vector{
+				{T: 60 * 1000, F: 0, Metric: labels.FromStrings("app", "bar")},
+				{T: 60 * 1000, F: 1, Metric: labels.FromStrings("app", "foo")},
+			},
+		},
+		{
+			`avg_over_time({app="foo"} | logfmt | unwrap latency [1m]) by (app)`,
+			promql.Vector{{T: 60 * 1000, F: 2, Metric: labels.FromStrings("app", "foo")}},
+		},
+		{
+			`avg_over_time({app="foo"} | logfmt | unwrap latency default 0 [1m]) by (app)`,
+			promql.Vector{{T: 60 * 1000, F: 1, Metric: labels.FromStrings("app", "foo")}},
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.query, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(ctx)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, res.Data)
+		})
+	}
+}
+
+func TestEngine_ChainedNumericLabelFilters(t *testing.T) {
+	var entries []logproto.Entry
+	for i, line := range []string{
+		`a=1 b=5 c=3`,
+		`a=x b=5 c=4`,     // a is not a number.
+		`a=2 b=20 c=5`,    // dropped by b.
+		`a=3 b=y c=6`,     // b is not a number.
+		`a=-1 b=1 c=7`,    // dropped by a.
+		`a=" 2" b=9 c=10`, // a is not a number either.
+	} {
+		entries = append(entries, logproto.Entry{Timestamp: time.Unix(int64(i+1), 0), Line: line})
+	}
+	querier := NewMockQuerier(0, []logproto.Stream{{Labels: `{app="foo"}`, Entries: entries}})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	exec := func(query string) (promql_parser.Value, error) {
+		params, err := NewLiteralParams(query, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		res, err := eng.Query(params).Exec(ctx)
+		return res.Data, err
+	}
+
+	// the lines with non-numeric values get the __error__ label.
+	_, err := exec(`sum(sum_over_time({app="foo"} | logfmt | a > 0 | b < 10 | unwrap c [1m]))`)
+	require.ErrorIs(t, err, logqlmodel.ErrPipeline)
+
+	res, err := exec(`sum(sum_over_time({app="foo"} | logfmt | a > 0 | b < 10 | __error__="" | unwrap c [1m]))`)
+	require.NoError(t, err)
+	require.Equal(t, promql.Vector{{T: 60 * 1000, F: 3, Metric: labels.EmptyLabels()}}, res)
+}
+
+func TestEngine_Scalar(t *testing.T) {
+	var foo, bar []logproto.Entry
+	for i := int64(1); i <= 60; i++ {
+		foo = append(foo, logproto.Entry{Timestamp: time.Unix(i, 0), Line: "line"})
+		if i%2 == 0 {
+			bar = append(bar, logproto.Entry{Timestamp: time.Unix(i, 0), Line: "line"})
+		}
+	}
+	querier := NewMockQuerier(0, []logproto.Stream{
+		{Labels: `{app="foo"}`, Entries: foo},
+		{Labels: `{app="bar"}`, Entries: bar},
+	})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	exec := func(t *testing.T, query string) promql_parser.Value {
+		params, err := NewLiteralParams(query, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		res, err := eng.Query(params).Exec(ctx)
+		require.NoError(t, err)
+		return res.Data
+	}
+
+	t.Run("single series", func(t *testing.T) {
+		require.Equal(t, promql.Scalar{T: 60 * 1000, V: 1}, exec(t, `scalar(sum(rate({app="foo"}[1m])))`))
+	})
+
+	t.Run("multiple series", func(t *testing.T) {
+		res := exec(t, `scalar(sum by (app) (rate({app=~"foo|bar"}[1m])))`)
+		require.IsType(t, promql.Scalar{}, res)
+		require.Equal(t, int64(60*1000), res.(promql.Scalar).T)
+		require.True(t, math.IsNaN(res.(promql.Scalar).V))
+	})
+
+	t.Run("binary operation with a vector", func(t *testing.T) {
+		require.Equal(t,
+			promql.Vector{{T: 60 * 1000, F: 1, Metric: labels.FromStrings("app", "foo")}},
+			exec(t, `rate({app="foo"}[1m]) / scalar(sum(rate({app="foo"}[1m])))`),
+		)
+		require.Equal(t,
+			promql.Vector{
+				{T: 60 * 1000, F: 0.5, Metric: labels.FromStrings("app", "bar")},
+				{T: 60 * 1000, F: 0, Metric: labels.FromStrings("app", "foo")},
+			},
+			exec(t, `scalar(sum(rate({app="foo"}[1m]))) - sum by (app) (rate({app=~"foo|bar"}[1m]))`),
+		)
+		require.Equal(t,
+			promql.Vector{{T: 60 * 1000, F: 1, Metric: labels.FromStrings("app", "foo")}},
+			exec(t, `sum by (app) (rate({app=~"foo|bar"}[1m])) > scalar(sum(rate({app="bar"}[1m])))`),
+		)
+	})
+
+	t.Run("vector of scalar", func(t *testing.T) {
+		require.Equal(t,
+			promql.Vector{{T: 60 * 1000, F: 1.5, Metric: labels.EmptyLabels()}},
+			exec(t, `vector(scalar(sum(rate({app=~"foo|bar"}[1m]))))`),
+		)
+	})
+}
+
+func TestEngine_ResultSortStable(t *testing.T) {
+	entries := func(n int) []logproto.Entry {
+		var entries []logproto.Entry
+		for i := 1; i <= n; i++ {
+			entries = append(entries, logproto.Entry{Timestamp: time.Unix(int64(i), 0), Line: "line"})
+		}
+		return entries
+	}
+	querier := NewMockQuerier(0, []logproto.Stream{
+		{Labels: `{app="foo", env="prod"}`, Entries: entries(60)},
+		{Labels: `{app="bar"}`, Entries: entries(30)},
+		{Labels: `{app="foo"}`, Entries: entries(6)},
+		{Labels: `{app="bar", env="dev"}`, Entries: entries(12)},
+	})
+	eng := NewEngine(EngineOpts{ResultSortStable: true}, querier, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	expected := []string{`{app="bar", env="dev"}`, `{app="bar"}`, `{app="foo", env="prod"}`, `{app="foo"}`}
+
+	for _, tc := range []struct {
+		name string
+		step time.Duration
+		end  time.Time
+	}{
+		{"range", time.Minute, time.Unix(120, 0)},
+		{"instant", 0, time.Unix(60, 0)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := NewLiteralParams(`rate({app=~"foo|bar"}[1m])`, time.Unix(60, 0), tc.end, tc.step, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(ctx)
+			require.NoError(t, err)
+
+			var actual []string
+			switch v := res.Data.(type) {
+			case promql.Vector:
+				for _, s := range v {
+					actual = append(actual, s.Metric.String())
+				}
+			case promql.Matrix:
+				for _, s := range v {
+					actual = append(actual, s.Metric.String())
+				}
+			}
+			require.Equal(t, expected, actual)
+		})
+	}
+
+	t.Run("order significant", func(t *testing.T) {
+		params, err := NewLiteralParams(`sort_desc(rate({app=~"foo|bar"}[1m]))`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		res, err := eng.Query(params).Exec(ctx)
+		require.NoError(t, err)
+		vec := res.Data.(promql.Vector)
+		require.Len(t, vec, 4)
+		for i := 1; i < len(vec); i++ {
+			require.GreaterOrEqual(t, vec[i-1].F, vec[i].F)
+		}
+	})
+}
+
+func TestEngineOpts_NonFiniteJSON(t *testing.T) {
+	require.Empty(t, (&EngineOpts{}).EncodingFlags())
+	require.Empty(t, (&EngineOpts{NonFiniteJSON: logqlmodel.NonFiniteString}).EncodingFlags())
+	require.Equal(t, []httpreq.EncodingFlag{httpreq.FlagNonFiniteNull}, (&EngineOpts{NonFiniteJSON: logqlmodel.NonFiniteNull}).EncodingFlags())
+
+	require.NoError(t, (&EngineOpts{NonFiniteJSON: logqlmodel.NonFiniteNull}).Validate())
+	require.Error(t, (&EngineOpts{NonFiniteJSON: "zero"}).Validate())
+}
+
+func TestEngine_DivByZeroPolicy(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{
+		newStream(120, identity, `{app="foo"}`),
+		newStream(120, identity, `{app="bar"}`),
+	})
+
+	for _, qs := range []string{
+		// The denominator series are zero at every step.
+		`sum by (app) (count_over_time({app=~"foo|bar"}[1m])) / (sum by (app) (count_over_time({app=~"foo|bar"}[1m])) * 0)`,
+		`sum by (app) (count_over_time({app=~"foo|bar"}[1m])) / 0`,
+		`60 / (sum by (app) (count_over_time({app=~"foo|bar"}[1m])) * 0)`,
+	} {
+		params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(120, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+
+		for _, tc := range []struct {
+			policy   string
+			expected []float64
+		}{
+			{"", []float64{math.Inf(1), math.Inf(1)}},
+			{DivByZeroInf, []float64{math.Inf(1), math.Inf(1)}},
+			{DivByZeroNaN, []float64{math.NaN(), math.NaN()}},
+			{DivByZeroDrop, nil},
+		} {
+			t.Run(qs+"/"+tc.policy, func(t *testing.T) {
+				eng := NewEngine(EngineOpts{DivByZeroPolicy: tc.policy}, querier, NoLimits, log.NewNopLogger())
+				res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+				require.NoError(t, err)
+
+				m := res.Data.(promql.Matrix)
+				if tc.expected == nil {
+					require.Empty(t, m)
+					return
+				}
+				require.Len(t, m, 2)
+				for i, app := range []string{"bar", "foo"} {
+					require.Equal(t, labels.FromStrings("app", app), m[i].Metric)
+					require.Len(t, m[i].Floats, len(tc.expected))
+					for j, p := range m[i].Floats {
+						require.Equal(t, int64(60*(j+1)*1000), p.T)
+						if math.IsNaN(tc.expected[j]) {
+							require.True(t, math.IsNaN(p.F))
+						} else {
+							require.Equal(t, tc.expected[j], p.F)
+						}
+					}
+				}
+			})
+		}
+	}
+
+	t.Run("zero dividend", func(t *testing.T) {
+		params, err := NewLiteralParams(`sum by (app) (count_over_time({app=~"foo|bar"}[1m])) * 0 / 0`, time.Unix(60, 0), time.Unix(120, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		res, err := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.NoError(t, err)
+		for _, series := range res.Data.(promql.Matrix) {
+			for _, p := range series.Floats {
+				require.True(t, math.IsNaN(p.F))
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		require.NoError(t, (&EngineOpts{DivByZeroPolicy: DivByZeroDrop}).Validate())
+		require.Error(t, (&EngineOpts{DivByZeroPolicy: "zero"}).Validate())
+	})
+}
+
+func TestEngine_EncodeCSV(t *testing.T) {
+	const qs = `max by (app) (rate({app=~"foo|bar"} |~".+bar" [1m]))`
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(120, 0), 30*time.Second, 0, logproto.FORWARD, 100, nil, nil)
+	require.NoError(t, err)
+	querier := newQuerierRecorder(t, [][]logproto.Series{
+		{newSeries(testSize, factor(10, identity), `{app="foo"}`), newSeries(testSize, factor(5, identity), `{app="bar"}`)},
+	}, []SelectSampleParams{
+		{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: time.Unix(120, 0), Selector: `rate({app=~"foo|bar"}|~".+bar"[1m])`}},
+	})
+	res, err := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+
+	b, err := res.Encode(logqlmodel.EncodingCSV)
+	require.NoError(t, err)
+	require.Equal(t, `series,1970-01-01T00:01:00Z,1970-01-01T00:01:30Z,1970-01-01T00:02:00Z
+"{app=""bar""}",0.2,0.2,0.2
+"{app=""foo""}",0.1,0.1,0.1
+`, string(b))
+
+	t.Run("sparse series", func(t *testing.T) {
+		b, err := logqlmodel.Result{Data: promql.Matrix{
+			{Metric: labels.FromStrings("app", "bar"), Floats: []promql.FPoint{{T: 60 * 1000, F: 1}}},
+			{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 0, F: 2}, {T: 120 * 1000, F: 3}}},
+		}}.Encode(logqlmodel.EncodingCSV)
+		require.NoError(t, err)
+		require.Equal(t, `series,1970-01-01T00:00:00Z,1970-01-01T00:01:00Z,1970-01-01T00:02:00Z
+"{app=""bar""}",,1,
+"{app=""foo""}",2,,3
+`, string(b))
+	})
+
+	t.Run("no data", func(t *testing.T) {
+		_, err := logqlmodel.Result{}.Encode(logqlmodel.EncodingCSV)
+		require.Error(t, err)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := res.Encode("xlsx")
+		require.Error(t, err)
+		_, err = logqlmodel.Result{Data: promql.Vector{}}.Encode(logqlmodel.EncodingCSV)
+		require.Error(t, err)
+	})
+}
+
+func TestEngine_MetricLabelFormat(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{
+		newStream(60, identity, `{app="foo", namespace="prod", pod="a"}`),
+		newStream(60, identity, `{app="foo", namespace="prod", pod="b"}`),
+		newStream(60, identity, `{app="bar", namespace="dev", pod="c"}`),
+	})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	for _, tc := range []struct {
+		qs       string
+		expected promql.Vector
+	}{
+		{
+			`sum by (app, namespace) (count_over_time({namespace=~".+"}[1m])) | label_format app_ns="{{.app}}-{{.namespace}}", ns=namespace`,
+			promql.Vector{
+				{T: 60 * 1000, F: 59, Metric: labels.FromStrings("app", "bar", "app_ns", "bar-dev", "ns", "dev")},
+				{T: 60 * 1000, F: 118, Metric: labels.FromStrings("app", "foo", "app_ns", "foo-prod", "ns", "prod")},
+			},
+		},
+		{
+			`sum by (app) (count_over_time({namespace=~".+"}[1m])) | label_format app="{{ regexReplaceAll \"(\" .app \"x\" }}"`,
+			promql.Vector{
+				{T: 60 * 1000, F: 59, Metric: labels.FromStrings("__error__", "TemplateFormatErr", "__error_details__", "template: label:1:3: executing \"label\" at <regexReplaceAll \"(\" .app \"x\">: error calling regexReplaceAll: error parsing regexp: missing closing ): `(`", "app", "bar")},
+				{T: 60 * 1000, F: 118, Metric: labels.FromStrings("__error__", "TemplateFormatErr", "__error_details__", "template: label:1:3: executing \"label\" at <regexReplaceAll \"(\" .app \"x\">: error calling regexReplaceAll: error parsing regexp: missing closing ): `(`", "app", "foo")},
+			},
+		},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(ctx)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, res.Data)
+		})
+	}
+}
+
+// tenantQuerier selects from the querier of the org ID of the context.
+type tenantQuerier map[string]Querier
+
+func (q tenantQuerier) SelectLogs(ctx context.Context, params SelectLogParams) (iter.EntryIterator, error) {
+	id, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return q[id].SelectLogs(ctx, params)
+}
+
+func (q tenantQuerier) SelectSamples(ctx context.Context, params SelectSampleParams) (iter.SampleIterator, error) {
+	id, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return q[id].SelectSamples(ctx, params)
+}
+
+func TestEngine_EvaluatePerTenant(t *testing.T) {
+	querier := tenantQuerier{
+		"a": NewMockQuerier(0, []logproto.Stream{newStream(60, identity, `{app="foo"}`)}),
+		"b": NewMockQuerier(0, []logproto.Stream{newStream(60, identity, `{app="foo"}`), newStream(60, identity, `{app="bar"}`)}),
+	}
+	eng := NewEngine(EngineOpts{EvaluatePerTenant: true}, querier, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "b|a")
+
+	params, err := NewLiteralParams(`sum(count_over_time({app=~"foo|bar"}[1m]))`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Equal(t, promql.Vector{
+		{T: 60 * 1000, F: 59, Metric: labels.FromStrings(constants.TenantLabel, "a")},
+		{T: 60 * 1000, F: 118, Metric: labels.FromStrings(constants.TenantLabel, "b")},
+	}, res.Data)
+
+	params, err = NewLiteralParams(`count_over_time({app="foo"}[1m])`, time.Unix(60, 0), time.Unix(60, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err = eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{
+		{Metric: labels.FromStrings(constants.TenantLabel, "a", "app", "foo"), Floats: []promql.FPoint{{T: 60 * 1000, F: 59}}},
+		{Metric: labels.FromStrings(constants.TenantLabel, "b", "app", "foo"), Floats: []promql.FPoint{{T: 60 * 1000, F: 59}}},
+	}, res.Data)
+
+	// each tenant is within the series limit, but not their combined series.
+	eng = NewEngine(EngineOpts{EvaluatePerTenant: true}, querier, &fakeLimits{maxSeries: 2}, log.NewNopLogger())
+	params, err = NewLiteralParams(`sum by (app) (count_over_time({app=~"foo|bar"}[1m]))`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	_, err = eng.Query(params).Exec(ctx)
+	require.Equal(t, logqlmodel.NewSeriesLimitError(2), err)
+}
+
+func TestEngine_Estimate(t *testing.T) {
+	const qs = `sum by (app)(count_over_time({app=~"foo|bar"}[1m]))`
+	// 8 series of 10 samples, all within the window.
+	eng := NewEngine(EngineOpts{EstimateCost: true}, getLocalQuerier(10), NoLimits, log.NewNopLogger())
+	exec := func(t *testing.T, eng *QueryEngine, qs string) stats.Estimate {
+		params, err := NewLiteralParams(qs, time.Unix(30, 0), time.Unix(30, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.NoError(t, err)
+		return res.Statistics.Estimate
+	}
+
+	require.Equal(t, stats.Estimate{
+		Selectors:      1,
+		Series:         8,
+		Samples:        80,
+		EvaluatorNodes: 2,
+	}, exec(t, eng, qs))
+
+	// the series selected by both selectors are counted once.
+	require.Equal(t, stats.Estimate{
+		Selectors:      2,
+		Series:         8,
+		Samples:        160,
+		EvaluatorNodes: 5,
+	}, exec(t, eng, qs+" + "+qs))
+
+	// the cost is only estimated when enabled.
+	require.Equal(t, stats.Estimate{}, exec(t, NewEngine(EngineOpts{}, getLocalQuerier(10), NoLimits, log.NewNopLogger()), qs))
+}
+
+func TestEngine_ZScoreOverTime(t *testing.T) {
+	const qs = `zscore_over_time({app="foo"} | unwrap v [5m])`
+	ts := time.Unix(5*60, 0)
+
+	for _, tc := range []struct {
+		name          string
+		values        []float64
+		zeroStddevNaN bool
+		expected      float64
+	}{
+		{"spike at the window end", []float64{10, 10, 10, 10, 10, 10, 10, 10, 10, 100}, false, 3},
+		{"flat window", []float64{10, 10, 10}, false, 0},
+		{"flat window with NaN", []float64{10, 10, 10}, true, math.NaN()},
+		{"NaN sample", []float64{10, math.NaN(), 10}, false, math.NaN()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			samples := make([]logproto.Sample, 0, len(tc.values))
+			for i, v := range tc.values {
+				samples = append(samples, logproto.Sample{Timestamp: time.Unix(int64(i+1)*10, 0).UnixNano(), Value: v, Hash: uint64(i)})
+			}
+			querier := newQuerierRecorder(t,
+				[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: samples}}},
+				[]SelectSampleParams{
+					{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: qs}},
+				},
+			)
+			eng := NewEngine(EngineOpts{ZScoreZeroStddevNaN: tc.zeroStddevNaN}, querier, NoLimits, log.NewNopLogger())
+			params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+
+			vec, ok := res.Data.(promql.Vector)
+			require.True(t, ok)
+			require.Len(t, vec, 1)
+			if math.IsNaN(tc.expected) {
+				require.True(t, math.IsNaN(vec[0].F))
+				return
+			}
+			require.InDelta(t, tc.expected, vec[0].F, 1e-12)
+		})
+	}
+}
+
+func TestEngine_ChangesOverTime(t *testing.T) {
+	const qs = `changes_over_time({app="foo"} | unwrap v [5m])`
+	ts := time.Unix(5*60, 0)
+
+	values := []float64{1, 1, 2, 2, 3}
+	samples := make([]logproto.Sample, 0, len(values))
+	for i, v := range values {
+		samples = append(samples, logproto.Sample{Timestamp: time.Unix(int64(i+1)*10, 0).UnixNano(), Value: v, Hash: uint64(i)})
+	}
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: samples}}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: qs}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+
+	vec, ok := res.Data.(promql.Vector)
+	require.True(t, ok)
+	require.Len(t, vec, 1)
+	require.Equal(t, 2.0, vec[0].F)
+}
+
+func TestEngine_ResetsOverTime(t *testing.T) {
+	const qs = `resets_over_time({app="foo"} | unwrap v [5m])`
+	ts := time.Unix(5*60, 0)
+
+	values := []float64{1, 2, 1, 2, 1}
+	samples := make([]logproto.Sample, 0, len(values))
+	for i, v := range values {
+		samples = append(samples, logproto.Sample{Timestamp: time.Unix(int64(i+1)*10, 0).UnixNano(), Value: v, Hash: uint64(i)})
+	}
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: samples}}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: qs}},
+		},
+	)
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+
+	vec, ok := res.Data.(promql.Vector)
+	require.True(t, ok)
+	require.Len(t, vec, 1)
+	require.Equal(t, 2.0, vec[0].F)
+}
+
+func TestEngine_StddevOverTime(t *testing.T) {
+	ts := time.Unix(5*60, 0)
+	values := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	samples := make([]logproto.Sample, 0, len(values))
+	for i, v := range values {
+		samples = append(samples, logproto.Sample{Timestamp: time.Unix(int64(i+1)*10, 0).UnixNano(), Value: v, Hash: uint64(i)})
+	}
+
+	for _, tc := range []struct {
+		qs       string
+		expected float64
+	}{
+		{`stdvar_over_time({app="foo"} | unwrap v [5m])`, 4},
+		{`stddev_over_time({app="foo"} | unwrap v [5m])`, 2},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			querier := newQuerierRecorder(t,
+				[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: samples}}},
+				[]SelectSampleParams{
+					{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: tc.qs}},
+				},
+			)
+			eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+			params, err := NewLiteralParams(tc.qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, promql.Vector{{T: ts.UnixMilli(), F: tc.expected, Metric: labels.FromStrings("app", "foo")}}, res.Data)
+		})
+	}
+}
+
+// slowStepEvaluator delays every step of the wrapped evaluator.
+type slowStepEvaluator struct {
+	StepEvaluator
+	delay time.Duration
+}
+
+func (s *slowStepEvaluator) Next() (bool, int64, StepResult) {
+	time.Sleep(s.delay)
+	return s.StepEvaluator.Next()
+}
+
+func TestJoinSampleVector_SoftTimeout(t *testing.T) {
+	metadataCtx, ctx := metadata.NewContext(context.Background())
+	params := &LiteralParams{
+		queryString: `rate({app="foo"}[1m])`,
+		start:       time.Unix(0, 0),
+		end:         time.Unix(600, 0), // 11 steps with 60s step
+		step:        60 * time.Second,
+		direction:   logproto.FORWARD,
+		limit:       100,
+	}
+	q := &query{params: params, softTimeout: 50 * time.Millisecond}
+
+	results := make([]StepResult, 0, 10)
+	for i := 1; i <= 10; i++ {
+		results = append(results, &storeSampleResult{vector: promql.Vector{
+			{T: int64(i) * 60 * 1000, F: float64(i), Metric: labels.FromStrings("app", "foo")},
+		}})
+	}
+	stepEvaluator := &slowStepEvaluator{StepEvaluator: &mockStepEvaluator{results: results, t: t}, delay: 20 * time.Millisecond}
+	first := &storeSampleResult{vector: promql.Vector{{T: 0, F: 0, Metric: labels.FromStrings("app", "foo")}}}
+
+	result, err := q.JoinSampleVector(ctx, true, first, stepEvaluator, 100, false)
+	require.NoError(t, err)
+	matrix, ok := result.(promql.Matrix)
+	require.True(t, ok)
+	require.Len(t, matrix, 1)
+	points := len(matrix[0].Floats)
+	require.Greater(t, points, 1)
+	require.Less(t, points, 11)
+
+	warnings := metadataCtx.StructuredWarnings()
+	require.Len(t, warnings, 1)
+	require.Equal(t, metadata.WarningCodeSoftTimeout, warnings[0].Code)
+	require.Equal(t, strconv.Itoa(points), warnings[0].Fields["steps"])
+}
+
+func TestEngine_Clock(t *testing.T) {
+	var entries []logproto.Entry
+	for i := int64(1); i <= 600; i++ {
+		entries = append(entries, logproto.Entry{Timestamp: time.Unix(i, 0), Line: "line"})
+	}
+	querier := NewMockQuerier(0, []logproto.Stream{{Labels: `{app="foo"}`, Entries: entries}})
+	params, err := NewLiteralParams(`count_over_time({app="foo"}[1m])`, time.Unix(60, 0), time.Unix(600, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	frozen := time.Unix(1000, 0)
+
+	// a frozen clock never reaches the soft deadline and measures no execution time.
+	eng := NewEngine(EngineOpts{SoftTimeout: time.Nanosecond, Now: func() time.Time { return frozen }}, querier, NoLimits, log.NewNopLogger())
+	for i := 0; i < 2; i++ {
+		res, err := eng.Query(params).Exec(ctx)
+		require.NoError(t, err)
+		require.Len(t, res.Data.(promql.Matrix)[0].Floats, 10)
+		require.Zero(t, res.Statistics.Summary.ExecTime)
+	}
+
+	// a clock advancing by an hour at every read exceeds the deadline at the first step.
+	var reads int
+	eng = NewEngine(EngineOpts{SoftTimeout: time.Minute, Now: func() time.Time {
+		reads++
+		return frozen.Add(time.Duration(reads) * time.Hour)
+	}}, querier, NoLimits, log.NewNopLogger())
+	res, err := eng.Query(params).Exec(ctx)
+	require.NoError(t, err)
+	require.Equal(t, promql.Matrix{{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 60 * 1000, F: 60}}}}, res.Data)
+	require.Len(t, res.Warnings, 1)
+}
+
+func TestEngine_ConcurrentBinOpLegs(t *testing.T) {
+	for _, qs := range []string{
+		`rate({app="foo"}[1m]) or rate({app="bar"}[1m])`,
+		`rate({app="foo"}[1m]) and on (bar) rate({app="bar"}[1m])`,
+		`rate({app="foo"}[1m]) unless on (app) rate({app="bar"}[1m])`,
+		`sum by (bar) (rate({app="foo"}[1m])) / sum by (bar) (rate({app="bar"}[1m])) or sum by (bar) (rate({app="bar"}[1m]))`,
+	} {
+		t.Run(qs, func(t *testing.T) {
+			params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+
+			sequential, err := NewEngine(EngineOpts{}, getLocalQuerier(1000), NoLimits, log.NewNopLogger()).
+				Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			concurrent, err := NewEngine(EngineOpts{MaxConcurrentSelects: 2}, getLocalQuerier(1000), NoLimits, log.NewNopLogger()).
+				Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, sequential.Data, concurrent.Data)
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		eng := NewEngine(EngineOpts{MaxConcurrentSelects: 2}, &errorIteratorQuerier{
+			samples: func() []iter.SampleIterator {
+				return []iter.SampleIterator{
+					iter.NewSeriesIterator(newSeries(testSize, identity, `{app="foo"}`)),
+					iter.ErrorSampleIterator,
+				}
+			},
+		}, NoLimits, log.NewNopLogger())
+		params, err := NewLiteralParams(`count_over_time({app="foo"}[1m]) / count_over_time({app="foo"}[1m])`, time.Unix(0, 0), time.Unix(180, 0), 1*time.Second, 0, logproto.BACKWARD, 1, nil, nil)
+		require.NoError(t, err)
+		_, err = eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.ErrorIs(t, err, ErrMock)
+		require.IsType(t, ErrMockMultiple, err)
+	})
+}
+
+// slowQuerier delays every sample it returns.
+type slowQuerier struct {
+	Querier
+	delay time.Duration
+}
+
+func (q slowQuerier) SelectSamples(ctx context.Context, p SelectSampleParams) (iter.SampleIterator, error) {
+	it, err := q.Querier.SelectSamples(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &slowSampleIterator{SampleIterator: it, delay: q.delay}, nil
+}
+
+type slowSampleIterator struct {
+	iter.SampleIterator
+	delay time.Duration
+}
+
+func (it *slowSampleIterator) Next() bool {
+	time.Sleep(it.delay)
+	return it.SampleIterator.Next()
+}
+
+func BenchmarkBinOpLegs(b *testing.B) {
+	const qs = `rate({app="foo"}[1m]) or rate({app="bar"}[1m])`
+	params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(180, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(b, err)
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	for _, bc := range []struct {
+		name                 string
+		maxConcurrentSelects int
+	}{
+		{"sequential", 0},
+		{"concurrent", 2},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			eng := NewEngine(EngineOpts{MaxConcurrentSelects: bc.maxConcurrentSelects}, slowQuerier{Querier: getLocalQuerier(10), delay: 10 * time.Microsecond}, NoLimits, log.NewNopLogger())
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := eng.Query(params).Exec(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type countingQuerier struct {
+	Querier
+	samples atomic.Int64
+}
+
+func (q *countingQuerier) SelectSamples(ctx context.Context, p SelectSampleParams) (iter.SampleIterator, error) {
+	q.samples.Add(1)
+	return q.Querier.SelectSamples(ctx, p)
+}
+
+func TestEngine_DeduplicateSelects(t *testing.T) {
+	const qs = `sum by(app)(count_over_time({app="foo"}[1m])) + sum by(app)(count_over_time({app="foo"}[1m]))`
+	// enough samples for the shared buffer to be trimmed.
+	streams := []logproto.Stream{newStream(3601, identity, `{app="foo"}`)}
+	for _, tc := range []struct {
+		dedup bool
+		calls int64
+	}{
+		{false, 2},
+		{true, 1},
+	} {
+		t.Run(fmt.Sprintf("dedup=%v", tc.dedup), func(t *testing.T) {
+			q := &countingQuerier{Querier: NewMockQuerier(0, streams)}
+			eng := NewEngine(EngineOpts{DeduplicateSelects: tc.dedup}, q, NoLimits, log.NewNopLogger())
+			params, err := NewLiteralParams(qs, time.Unix(60, 0), time.Unix(3600, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, tc.calls, q.samples.Load())
+
+			matrix := res.Data.(promql.Matrix)
+			require.Len(t, matrix, 1)
+			require.Len(t, matrix[0].Floats, 60)
+			for _, p := range matrix[0].Floats {
+				require.Equal(t, 120., p.F)
+			}
+		})
+	}
+}
+
+func TestQuery_LogicalPlan(t *testing.T) {
+	eng := NewEngine(EngineOpts{}, NewMockQuerier(0, nil), NoLimits, log.NewNopLogger())
+	planOf := func(qs string) plan.QueryPlan {
+		params, err := NewLiteralParams(qs, time.Unix(0, 0), time.Unix(100, 0), time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		q, ok := eng.Query(params).(LogicalPlanner)
+		require.True(t, ok)
+		p, err := q.LogicalPlan()
+		require.NoError(t, err)
+		return p
+	}
+
+	for _, tc := range []struct {
+		name string
+		a, b string
 	}{
 		{
-			name:               "Drilldown - immediate limit exceeded in first vector",
-			queryTags:          "Source=grafana-lokiexplore-app",
-			maxSeries:          2,
-			vectorSize:         3,
-			isRangeQuery:       false,
-			expectError:        false,
-			expectTruncation:   true,
-			expectedWarningMsg: "maximum number of series (2) reached for a single query; returning partial results",
-		},
-		{
-			name:               "Non-drilldown - immediate limit exceeded in first vector",
-			queryTags:          "Source=grafana",
-			maxSeries:          2,
-			vectorSize:         3,
-			isRangeQuery:       false,
-			expectError:        true,
-			expectTruncation:   false,
-			expectedWarningMsg: "",
-		},
-		{
-			name:               "Drilldown - limit NOT exceeded",
-			queryTags:          "Source=grafana-lokiexplore-app",
-			maxSeries:          5,
-			vectorSize:         3,
-			isRangeQuery:       false,
-			expectError:        false,
-			expectTruncation:   false,
-			expectedWarningMsg: "",
-		},
-		{
-			name:               "Non-drilldown - limit NOT exceeded",
-			queryTags:          "Source=grafana",
-			maxSeries:          5,
-			vectorSize:         3,
-			isRangeQuery:       false,
-			expectError:        false,
-			expectTruncation:   false,
-			expectedWarningMsg: "",
-		},
-		{
-			name:               "Drilldown - range query limit exceeded in second vector",
-			queryTags:          "Source=grafana-lokiexplore-app",
-			maxSeries:          3,
-			vectorSize:         2, // First vector has 2 series
-			isRangeQuery:       true,
-			additionalVectors:  []int{2}, // Second vector has 2 more unique series (total 4 > limit 3)
-			expectError:        false,
-			expectTruncation:   true,
-			expectedWarningMsg: "maximum number of series (3) reached for a single query; returning partial results",
+			name: "whitespace",
+			a:    `sum by (app) (rate({app="foo"} |= "bar" [1m]))`,
+			b:    "sum by(app)(\n\trate(\n\t\t{app = \"foo\"} |=\"bar\"[1m]\n\t)\n)",
 		},
 		{
-			name:               "Non-drilldown - range query limit exceeded in second vector",
-			queryTags:          "Source=grafana",
-			maxSeries:          3,
-			vectorSize:         2, // First vector has 2 series
-			isRangeQuery:       true,
-			additionalVectors:  []int{2}, // Second vector has 2 more unique series (total 4 > limit 3)
-			expectError:        true,
-			expectTruncation:   false,
-			expectedWarningMsg: "",
+			name: "rewritten line_format",
+			a:    `count_over_time({app="foo"} | line_format "{{.foo}}" [1m])`,
+			b:    `count_over_time({app="foo"}[1m])`,
 		},
 		{
-			name:               "Drilldown - range query limit NOT exceeded across multiple vectors",
-			queryTags:          "Source=grafana-lokiexplore-app",
-			maxSeries:          5,
-			vectorSize:         2, // First vector has 2 series
-			isRangeQuery:       true,
-			additionalVectors:  []int{2, 1}, // Second has 2, third has 1 (total 5 = limit)
-			expectError:        false,
-			expectTruncation:   false,
-			expectedWarningMsg: "",
+			name: "log selector",
+			a:    `{app="foo"}|="bar"`,
+			b:    `{ app="foo" } |= "bar"`,
 		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := planOf(tc.a), planOf(tc.b)
+			require.Equal(t, a.String(), b.String())
+			require.Equal(t, a.Hash(), b.Hash())
+		})
 	}
 
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			// Create a mock query with the necessary context
-			ctx := context.Background()
-			if test.queryTags != "" {
-				ctx = httpreq.InjectQueryTags(ctx, test.queryTags)
-			}
-			_, ctx = metadata.NewContext(ctx)
+	a, b := planOf(`count_over_time({app="foo"}[1m])`), planOf(`count_over_time({app="foo"}[5m])`)
+	require.NotEqual(t, a.Hash(), b.Hash())
+}
 
-			// Create mock params - adjust for range vs instant query
-			var params *LiteralParams
-			if test.isRangeQuery {
-				params = &LiteralParams{
-					queryString: `rate({app="foo"}[1m])`,
-					start:       time.Unix(0, 0),
-					end:         time.Unix(120, 0), // Range query: multiple steps
-					step:        60 * time.Second,
-					interval:    0,
-					direction:   logproto.FORWARD,
-					limit:       100,
-				}
-			} else {
-				params = &LiteralParams{
-					queryString: `rate({app="foo"}[1m])`,
-					start:       time.Unix(0, 0),
-					end:         time.Unix(60, 0), // Instant query: single step
-					step:        30 * time.Second,
-					interval:    0,
-					direction:   logproto.FORWARD,
-					limit:       100,
-				}
-			}
+func TestQuery_CacheKey(t *testing.T) {
+	eng := NewEngine(EngineOpts{}, NewMockQuerier(0, nil), NoLimits, log.NewNopLogger())
+	keyOf := func(qs string, start, end time.Time, step time.Duration, limit uint32) string {
+		params, err := NewLiteralParams(qs, start, end, step, 0, logproto.FORWARD, limit, nil, nil)
+		require.NoError(t, err)
+		q, ok := eng.Query(params).(CacheKeyer)
+		require.True(t, ok)
+		return q.CacheKey()
+	}
+	start, end := time.Unix(0, 0), time.Unix(100, 0)
+
+	key := keyOf(`sum by (app) (rate({app="foo"}[1m]))`, start, end, time.Minute, 0)
+	require.Equal(t, key, keyOf(`sum(rate({app="foo"}[1m])) by (app)`, start, end, time.Minute, 0))
+	require.Equal(t, key, keyOf(`sum by (app) (rate({app="foo"}[1m]))`, start, end, time.Minute, 0))
+
+	for _, other := range []string{
+		keyOf(`sum by (app) (rate({app="bar"}[1m]))`, start, end, time.Minute, 0),
+		keyOf(`sum by (app) (rate({app="foo"}[1m]))`, start.Add(time.Second), end, time.Minute, 0),
+		keyOf(`sum by (app) (rate({app="foo"}[1m]))`, start, end.Add(time.Second), time.Minute, 0),
+		keyOf(`sum by (app) (rate({app="foo"}[1m]))`, start, end, 30*time.Second, 0),
+		keyOf(`sum by (app) (rate({app="foo"}[1m]))`, start, end, time.Minute, 10),
+	} {
+		require.NotEqual(t, key, other)
+	}
 
-			q := &query{
-				params: params,
-			}
+	literal, err := NewLiteralParams(`sum by (app) (rate({app="foo"}[1m]))`, start, end, time.Minute, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	for name, params := range map[string]Params{
+		"step alignment": literal.WithStepAlignment(StepAlignmentStart),
+		"transform":      literal.WithResultTransform(ResultTransformStepDelta),
+		"hold":           literal.WithHold(time.Minute),
+		"zero on empty":  literal.WithZeroOnEmptyAggregation(true),
+		"seed":           literal.WithSeed(42),
+		"wrapped seed":   ParamsWithShardsOverride{Params: literal.WithSeed(42)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			q, ok := eng.Query(params).(CacheKeyer)
+			require.True(t, ok)
+			require.NotEqual(t, key, q.CacheKey())
+		})
+	}
 
-			// Create the initial vector with the specified number of series
-			vec := make(promql.Vector, test.vectorSize)
-			for i := 0; i < test.vectorSize; i++ {
-				vec[i] = promql.Sample{
-					T:      60 * 1000,
-					F:      float64(i + 1),
-					Metric: labels.FromStrings("app", fmt.Sprintf("app%d", i)),
-				}
-			}
+	// the default step alignment is the end of the window.
+	q, ok := eng.Query(literal.WithStepAlignment(StepAlignmentEnd)).(CacheKeyer)
+	require.True(t, ok)
+	require.Equal(t, key, q.CacheKey())
+}
 
-			// Create additional vectors for range query testing
-			var stepResults []StepResult
-			if test.isRangeQuery && len(test.additionalVectors) > 0 {
-				seriesOffset := test.vectorSize // Start naming series after the initial vector
-				for _, additionalSize := range test.additionalVectors {
-					additionalVec := make(promql.Vector, additionalSize)
-					for i := 0; i < additionalSize; i++ {
-						additionalVec[i] = promql.Sample{
-							T:      120 * 1000, // Different timestamp for subsequent steps
-							F:      float64(seriesOffset + i + 1),
-							Metric: labels.FromStrings("app", fmt.Sprintf("app%d", seriesOffset+i)),
-						}
-					}
-					stepResults = append(stepResults, &storeSampleResult{vector: additionalVec})
-					seriesOffset += additionalSize
-				}
-			}
+func TestEngine_SubSecondStep(t *testing.T) {
+	// a line every 125ms.
+	var entries []logproto.Entry
+	for ts := time.Unix(60, 0); ts.Before(time.Unix(63, 0)); ts = ts.Add(125 * time.Millisecond) {
+		entries = append(entries, logproto.Entry{Timestamp: ts, Line: "line"})
+	}
+	querier := NewMockQuerier(0, []logproto.Stream{{Labels: `{app="foo"}`, Entries: entries}})
+	params, err := NewLiteralParams(`sum(count_over_time({app="foo"}[250ms]))`, time.Unix(61, 0), time.Unix(62, 750*int64(time.Millisecond)), 250*time.Millisecond, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
 
-			// Create a mock step evaluator
-			stepEvaluator := &mockStepEvaluator{
-				results: stepResults,
-				current: 0,
-				t:       t,
+	res, err := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+
+	var expected []promql.FPoint
+	for ts := int64(61000); ts <= 62750; ts += 250 {
+		expected = append(expected, promql.FPoint{T: ts, F: 2})
+	}
+	require.Equal(t, promql.Matrix{{Metric: labels.EmptyLabels(), Floats: expected}}, res.Data)
+}
+
+func TestEngine_SampleRounding(t *testing.T) {
+	const qs = `rate_counter({app="foo"} | unwrap foo [30s])`
+	ts := time.Unix(60, 0)
+
+	for _, tc := range []struct {
+		digits   int
+		expected float64
+	}{
+		{0, 0.46666766666666665},
+		{3, 0.467},
+		{6, 0.466668},
+	} {
+		t.Run(fmt.Sprintf("digits=%d", tc.digits), func(t *testing.T) {
+			querier := newQuerierRecorder(t,
+				[][]logproto.Series{{newSeries(testSize, offset(46, incValue(1)), `{app="foo"}`)}},
+				[]SelectSampleParams{
+					{&logproto.SampleQueryRequest{Start: time.Unix(30, 0), End: ts, Selector: `rate_counter({app="foo"} | unwrap foo[30s])`}},
+				},
+			)
+			eng := NewEngine(EngineOpts{SampleRounding: tc.digits}, querier, NoLimits, log.NewNopLogger())
+			params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 10, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, promql.Vector{{T: ts.UnixMilli(), F: tc.expected, Metric: labels.FromStrings("app", "foo")}}, res.Data)
+		})
+	}
+}
+
+func TestEngine_ResultType(t *testing.T) {
+	for _, tc := range []struct {
+		qs        string
+		step      time.Duration
+		expected  logqlmodel.ResultType
+		valueType string
+	}{
+		{`{app="foo"}`, 0, logqlmodel.ResultTypeStreams, "streams"},
+		{`count_over_time({app="foo"}[1m])`, 0, logqlmodel.ResultTypeVector, "vector"},
+		{`count_over_time({app="foo"}[1m])`, 30 * time.Second, logqlmodel.ResultTypeMatrix, "matrix"},
+		{`1 + 1`, 0, logqlmodel.ResultTypeScalar, "scalar"},
+	} {
+		t.Run(fmt.Sprintf("%s step=%s", tc.qs, tc.step), func(t *testing.T) {
+			end := time.Unix(60, 0)
+			if tc.step > 0 {
+				end = time.Unix(180, 0)
 			}
+			params, err := NewLiteralParams(tc.qs, time.Unix(60, 0), end, tc.step, 0, logproto.FORWARD, 10, nil, nil)
+			require.NoError(t, err)
+			res, err := NewEngine(EngineOpts{}, getLocalQuerier(100), NoLimits, log.NewNopLogger()).
+				Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, res.Type())
+			require.Equal(t, tc.valueType, res.ValueType())
+			require.Equal(t, tc.valueType, string(res.Data.Type()))
+		})
+	}
 
-			// Call JoinSampleVector with context
-			result, err := q.JoinSampleVector(ctx, true, &storeSampleResult{vector: vec}, stepEvaluator, test.maxSeries, false)
+	require.Equal(t, logqlmodel.ResultTypeUnknown, logqlmodel.Result{}.Type())
+	require.Equal(t, "", logqlmodel.Result{}.ValueType())
+}
 
-			if test.expectError {
-				require.Error(t, err)
-				require.True(t, errors.Is(err, logqlmodel.ErrLimit))
-				require.Nil(t, result)
-			} else {
-				require.NoError(t, err)
-				require.NotNil(t, result)
+func TestResult_TypedAccessors(t *testing.T) {
+	streams := logqlmodel.Streams{{Labels: `{app="foo"}`, Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "line"}}}}
+	vector := promql.Vector{{T: 1000, F: 1, Metric: labels.FromStrings("app", "foo")}}
+	matrix := promql.Matrix{{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 1000, F: 1}}}}
 
-				if test.expectTruncation {
-					// Check that the result was truncated to maxSeries
-					var actualSeriesCount int
-					if vec, ok := result.(promql.Vector); ok {
-						// Instant query result
-						actualSeriesCount = len(vec)
-					} else if matrix, ok := result.(promql.Matrix); ok {
-						// Range query result - count unique series
-						seriesMap := make(map[string]bool)
-						for _, series := range matrix {
-							seriesMap[series.Metric.String()] = true
-						}
-						actualSeriesCount = len(seriesMap)
-					} else {
-						t.Fatalf("Unexpected result type: %T", result)
-					}
+	s, err := logqlmodel.Result{Data: streams}.Streams()
+	require.NoError(t, err)
+	require.Equal(t, streams, s)
+	_, err = logqlmodel.Result{Data: matrix}.Streams()
+	require.EqualError(t, err, "result of type matrix, expected streams")
 
-					require.LessOrEqual(t, actualSeriesCount, test.maxSeries,
-						"Expected result to be truncated to maxSeries (%d), but got %d series",
-						test.maxSeries, actualSeriesCount)
+	v, err := logqlmodel.Result{Data: vector}.Vector()
+	require.NoError(t, err)
+	require.Equal(t, vector, v)
+	_, err = logqlmodel.Result{Data: matrix}.Vector()
+	require.EqualError(t, err, "result of type matrix, expected vector")
 
-					// Check for warning
-					meta := metadata.FromContext(ctx)
-					warnings := meta.Warnings()
-					require.NotEmpty(t, warnings, "Expected warnings but got none")
-					require.Contains(t, warnings[0], test.expectedWarningMsg)
-				} else {
-					// No truncation expected - verify no warnings
-					meta := metadata.FromContext(ctx)
-					warnings := meta.Warnings()
-					if test.expectedWarningMsg == "" {
-						require.Empty(t, warnings, "Expected no warnings but got: %v", warnings)
-					}
-				}
-			}
+	m, err := logqlmodel.Result{Data: matrix}.Matrix()
+	require.NoError(t, err)
+	require.Equal(t, matrix, m)
+	_, err = logqlmodel.Result{Data: streams}.Matrix()
+	require.EqualError(t, err, "result of type streams, expected matrix")
+
+	_, err = logqlmodel.Result{}.Vector()
+	require.EqualError(t, err, "result has no data, expected vector")
+}
+
+func TestEngine_MaxLabelValueLength(t *testing.T) {
+	big := strings.Repeat("x", 10*1024)
+	qs := fmt.Sprintf(`label_replace(count_over_time({app="foo"}[1m]), "big", "%s", "app", "(.*)")`, big)
+	ts := time.Unix(60, 0)
+
+	for _, tc := range []struct {
+		policy   string
+		expected labels.Labels
+		warning  string
+	}{
+		{LabelLengthTruncate, labels.FromStrings("app", "foo", "big", big[:1024]), "1 labels exceeded the maximum label name length (0) or value length (1024) and were truncated"},
+		{LabelLengthDrop, labels.FromStrings("app", "foo"), "1 labels exceeded the maximum label name length (0) or value length (1024) and were dropped"},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			querier := newQuerierRecorder(t,
+				[][]logproto.Series{{newSeries(testSize, identity, `{app="foo"}`)}},
+				[]SelectSampleParams{
+					{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: `count_over_time({app="foo"}[1m])`}},
+				},
+			)
+			eng := NewEngine(EngineOpts{MaxLabelValueLength: 1024, LabelLengthPolicy: tc.policy}, querier, NoLimits, log.NewNopLogger())
+			params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 10, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+
+			vec, ok := res.Data.(promql.Vector)
+			require.True(t, ok)
+			require.Len(t, vec, 1)
+			require.Equal(t, tc.expected, vec[0].Metric)
+			require.Equal(t, []string{tc.warning}, res.Warnings)
+			require.Equal(t, metadata.WarningCodeLabelLength, res.StructuredWarnings[0].Code)
+		})
+	}
+}
+
+func Test_truncateUTF8(t *testing.T) {
+	require.Equal(t, "abc", truncateUTF8("abc", 5))
+	require.Equal(t, "ab", truncateUTF8("abc", 2))
+	require.Equal(t, "a", truncateUTF8("aé", 2))
+	require.Equal(t, "aé", truncateUTF8("aéb", 3))
+}
+
+func TestLabelLengthLimiter_Duplicates(t *testing.T) {
+	l := &labelLengthLimiter{maxValue: 3, direction: logproto.BACKWARD}
+
+	// series with the same limited labels fail the query.
+	_, err := l.apply(promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo1"), Floats: []promql.FPoint{{T: 1, F: 1}}},
+		{Metric: labels.FromStrings("app", "foo2"), Floats: []promql.FPoint{{T: 1, F: 2}}},
+	})
+	require.ErrorIs(t, err, logqlmodel.ErrLimit)
+
+	// streams with the same limited labels are merged.
+	res, err := l.apply(logqlmodel.Streams{
+		{Labels: `{app="foo1"}`, Entries: []logproto.Entry{{Timestamp: time.Unix(3, 0), Line: "c"}, {Timestamp: time.Unix(1, 0), Line: "a"}}},
+		{Labels: `{app="bar"}`, Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "x"}}},
+		{Labels: `{app="foo2"}`, Entries: []logproto.Entry{{Timestamp: time.Unix(2, 0), Line: "b"}}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, logqlmodel.Streams{
+		{Labels: `{app="foo"}`, Entries: []logproto.Entry{{Timestamp: time.Unix(3, 0), Line: "c"}, {Timestamp: time.Unix(2, 0), Line: "b"}, {Timestamp: time.Unix(1, 0), Line: "a"}}},
+		{Labels: `{app="bar"}`, Entries: []logproto.Entry{{Timestamp: time.Unix(1, 0), Line: "x"}}},
+	}, res)
+}
+
+func TestEngineOpts_ValidateLabelLengthPolicy(t *testing.T) {
+	for _, policy := range []string{"", LabelLengthTruncate, LabelLengthDrop} {
+		require.NoError(t, (&EngineOpts{LabelLengthPolicy: policy}).Validate())
+	}
+	require.Error(t, (&EngineOpts{LabelLengthPolicy: "shorten"}).Validate())
+}
+
+func TestEngine_VariantsRanges(t *testing.T) {
+	ts := time.Unix(300, 0)
+	// one sample per second during the last minute
+	samples := make([]logproto.Sample, 0, 60)
+	for i := int64(241); i <= 300; i++ {
+		samples = append(samples, logproto.Sample{Timestamp: time.Unix(i, 0).UnixNano(), Value: 1, Hash: uint64(i)})
+	}
+
+	for _, qs := range []string{
+		`variants(rate({app="foo"}[5m]), rate({app="foo"}[1m])) of ({app="foo"}[5m])`,
+		// the samples of the longer range of a variant are selected too
+		`variants(rate({app="foo"}[5m]), rate({app="foo"}[1m])) of ({app="foo"}[1m])`,
+	} {
+		t.Run(qs, func(t *testing.T) {
+			querier := &timeRangedQuerier{Querier: newQuerierRecorder(t,
+				[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: samples}}},
+				[]SelectSampleParams{
+					{&logproto.SampleQueryRequest{Start: ts.Add(-5 * time.Minute), End: ts.Add(time.Nanosecond), Selector: qs}},
+				},
+			)}
+			eng := NewEngine(EngineOpts{}, querier, &fakeLimits{maxSeries: math.MaxInt32, timeout: time.Hour, multiVariantQueryEnable: true}, log.NewNopLogger())
+			params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+
+			vec, ok := res.Data.(promql.Vector)
+			require.True(t, ok)
+			sort.Slice(vec, func(i, j int) bool {
+				return vec[i].Metric.Get(constants.VariantLabel) < vec[j].Metric.Get(constants.VariantLabel)
+			})
+			require.Equal(t, promql.Vector{
+				{T: ts.UnixMilli(), F: 60.0 / 300, Metric: labels.FromStrings("app", "foo", constants.VariantLabel, "0")},
+				{T: ts.UnixMilli(), F: 1, Metric: labels.FromStrings("app", "foo", constants.VariantLabel, "1")},
+			}, vec)
+
+			require.Len(t, querier.requests, 1)
+			require.Equal(t, ts.Add(-5*time.Minute), querier.requests[0].Start)
+			require.Equal(t, ts.Add(time.Nanosecond), querier.requests[0].End)
 		})
 	}
 }
 
-func TestHttpreqIsLogsDrilldownRequest(t *testing.T) {
-	tests := []struct {
-		name      string
-		queryTags string
-		expected  bool
+// timeRangedQuerier records the sample requests and only returns the samples
+// within their bounds, like the stores do.
+type timeRangedQuerier struct {
+	Querier
+	requests []*logproto.SampleQueryRequest
+}
+
+func (q *timeRangedQuerier) SelectSamples(ctx context.Context, p SelectSampleParams) (iter.SampleIterator, error) {
+	q.requests = append(q.requests, p.SampleQueryRequest)
+	it, err := q.Querier.SelectSamples(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return iter.NewTimeRangedSampleIterator(it, p.Start.UnixNano(), p.End.UnixNano()), nil
+}
+
+func TestEngine_NegativeOffsets(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{{Labels: `{app="foo"}`, Entries: []logproto.Entry{
+		{Timestamp: time.Unix(30, 0), Line: "before"},
+		{Timestamp: time.Unix(90, 0), Line: "after"},
+		{Timestamp: time.Unix(100, 0), Line: "after"},
+	}}})
+	params, err := NewLiteralParams(`count_over_time({app="foo"}[1m] offset -1m)`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+	require.NoError(t, err)
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	t.Run("disabled", func(t *testing.T) {
+		_, err := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+		require.ErrorIs(t, err, logqlmodel.ErrNegativeOffset)
+		require.ErrorContains(t, err, "offset [-1m]")
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		res, err := NewEngine(EngineOpts{EnableNegativeOffsets: true}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+		require.NoError(t, err)
+		// the range (60s, 120s] is counted instead of (0s, 60s].
+		require.Equal(t, promql.Vector{{T: 60 * 1000, F: 2, Metric: labels.FromStrings("app", "foo")}}, res.Data)
+	})
+
+	t.Run("positive offsets", func(t *testing.T) {
+		params, err := NewLiteralParams(`count_over_time({app="foo"}[1m] offset 1m)`, time.Unix(120, 0), time.Unix(120, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		res, err := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+		require.NoError(t, err)
+		require.Equal(t, promql.Vector{{T: 120 * 1000, F: 1, Metric: labels.FromStrings("app", "foo")}}, res.Data)
+	})
+}
+
+func TestEngine_Quantile(t *testing.T) {
+	// series with 1 to 5 lines in the range, in two environments.
+	var streams []logproto.Stream
+	for i, lbs := range []string{
+		`{app="a", env="prod"}`, `{app="b", env="prod"}`, `{app="c", env="prod"}`, `{app="d", env="dev"}`, `{app="e", env="dev"}`,
+	} {
+		stream := logproto.Stream{Labels: lbs}
+		for j := 0; j <= i; j++ {
+			stream.Entries = append(stream.Entries, logproto.Entry{Timestamp: time.Unix(int64(10+j), 0), Line: "line"})
+		}
+		streams = append(streams, stream)
+	}
+	eng := NewEngine(EngineOpts{}, NewMockQuerier(0, streams), NoLimits, log.NewNopLogger())
+	ts := time.Unix(60, 0)
+
+	for _, tc := range []struct {
+		qs       string
+		expected promql.Vector
 	}{
 		{
-			name:      "Valid Logs Drilldown request",
-			queryTags: "Source=grafana-lokiexplore-app,Feature=patterns",
-			expected:  true,
-		},
-		{
-			name:      "Case insensitive source matching",
-			queryTags: "Source=GRAFANA-LOKIEXPLORE-APP,Feature=patterns",
-			expected:  true,
-		},
-		{
-			name:      "Different source",
-			queryTags: "Source=grafana,Feature=explore",
-			expected:  false,
+			`quantile(0.5, count_over_time({app=~".+"}[1m]))`,
+			promql.Vector{{T: ts.UnixMilli(), F: 3, Metric: labels.EmptyLabels()}},
 		},
 		{
-			name:      "No source tag",
-			queryTags: "Feature=patterns,User=test",
-			expected:  false,
+			`quantile(0.9, count_over_time({app=~".+"}[1m]))`,
+			promql.Vector{{T: ts.UnixMilli(), F: 4.6, Metric: labels.EmptyLabels()}},
 		},
 		{
-			name:      "Empty query tags",
-			queryTags: "",
-			expected:  false,
+			`quantile by (env) (0.5, count_over_time({app=~".+"}[1m]))`,
+			promql.Vector{
+				{T: ts.UnixMilli(), F: 4.5, Metric: labels.FromStrings("env", "dev")},
+				{T: ts.UnixMilli(), F: 2, Metric: labels.FromStrings("env", "prod")},
+			},
 		},
 		{
-			name:      "Malformed tags",
-			queryTags: "invalid_tags_format",
-			expected:  false,
+			`quantile without (app) (2, count_over_time({app=~".+"}[1m]))`,
+			promql.Vector{
+				{T: ts.UnixMilli(), F: math.Inf(1), Metric: labels.FromStrings("env", "dev")},
+				{T: ts.UnixMilli(), F: math.Inf(1), Metric: labels.FromStrings("env", "prod")},
+			},
 		},
-	}
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
 
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			ctx := context.Background()
-			if test.queryTags != "" {
-				ctx = httpreq.InjectQueryTags(ctx, test.queryTags)
+			vec, ok := res.Data.(promql.Vector)
+			require.True(t, ok)
+			sort.Slice(vec, func(i, j int) bool { return vec[i].Metric.String() < vec[j].Metric.String() })
+			require.Len(t, vec, len(tc.expected))
+			for i := range vec {
+				require.Equal(t, tc.expected[i].Metric, vec[i].Metric)
+				require.InDelta(t, tc.expected[i].F, vec[i].F, 1e-9)
 			}
-
-			result := httpreq.IsLogsDrilldownRequest(ctx)
-			require.Equal(t, test.expected, result, "Expected %v, got %v for queryTags: %s", test.expected, result, test.queryTags)
 		})
 	}
 }
 
-func TestJoinSampleVector_RangeQueryVectorOverwrite(t *testing.T) {
-	t.Parallel()
+func TestEngine_SelectorRewriter(t *testing.T) {
+	rewriter := func(matchers []*labels.Matcher) []*labels.Matcher {
+		return append(matchers, labels.MustNewMatcher(labels.MatchEqual, "cluster", "prod"))
+	}
+	ctx := user.InjectOrgID(context.Background(), "fake")
 
-	// This test covers a vector overwrite issue in range queries for Logs Drilldown.
-	// The problem was that after truncating the first vector due to series limit,
-	// subsequent steps in the range query can overwrite the truncated vector with larger vectors,
-	// causing the final result to exceed the intended series limit.
+	t.Run("logs", func(t *testing.T) {
+		// the recorder only returns streams for the rewritten selector.
+		querier := newQuerierRecorder(t,
+			[][]logproto.Stream{{newStream(testSize, identity, `{app="foo", cluster="prod"}`)}},
+			[]SelectLogParams{
+				{&logproto.QueryRequest{Direction: logproto.FORWARD, Start: time.Unix(0, 0), End: time.Unix(30, 0), Limit: 10, Selector: `{app="foo", cluster="prod"}`}},
+			},
+		)
+		eng := NewEngine(EngineOpts{SelectorRewriter: rewriter}, querier, NoLimits, log.NewNopLogger())
+		params, err := NewLiteralParams(`{app="foo"}`, time.Unix(0, 0), time.Unix(30, 0), 0, 0, logproto.FORWARD, 10, nil, nil)
+		require.NoError(t, err)
+		res, err := eng.Query(params).Exec(ctx)
+		require.NoError(t, err)
+		require.Equal(t, logqlmodel.Streams([]logproto.Stream{newStream(10, identity, `{app="foo", cluster="prod"}`)}), res.Data)
+	})
 
-	ctx := context.Background()
-	ctx = httpreq.InjectQueryTags(ctx, "Source=grafana-lokiexplore-app")
-	_, ctx = metadata.NewContext(ctx)
+	t.Run("metrics", func(t *testing.T) {
+		querier := newQuerierRecorder(t,
+			[][]logproto.Series{{newSeries(testSize, identity, `{app="foo", cluster="prod"}`)}},
+			[]SelectSampleParams{
+				{&logproto.SampleQueryRequest{Start: time.Unix(30, 0), End: time.Unix(60, 0), Selector: `sum(count_over_time({app="foo", cluster="prod"}[30s]))`}},
+			},
+		)
+		eng := NewEngine(EngineOpts{SelectorRewriter: rewriter}, querier, NoLimits, log.NewNopLogger())
+		params, err := NewLiteralParams(`sum(count_over_time({app="foo"}[30s]))`, time.Unix(60, 0), time.Unix(60, 0), 0, 0, logproto.FORWARD, 0, nil, nil)
+		require.NoError(t, err)
+		q := eng.Query(params)
+		res, err := q.Exec(ctx)
+		require.NoError(t, err)
+		require.Equal(t, promql.Vector{{T: 60 * 1000, F: 30, Metric: labels.EmptyLabels()}}, res.Data)
 
-	// Create mock params for a range query (multiple steps)
-	params := &LiteralParams{
-		queryString: `rate({app="foo"}[1m])`,
-		start:       time.Unix(0, 0),
-		end:         time.Unix(120, 0), // 3 steps with 60s step
-		step:        60 * time.Second,
-		interval:    0,
-		direction:   logproto.FORWARD,
-		limit:       100,
-	}
+		plan, err := q.(*query).LogicalPlan()
+		require.NoError(t, err)
+		require.Equal(t, `sum(count_over_time({app="foo", cluster="prod"}[30s]))`, plan.String())
+	})
+}
 
-	q := &query{
-		params: params,
+func TestEngine_EmptyReason(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{newStream(testSize, identity, `{app="foo"}`)})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+
+	for _, tc := range []struct {
+		qs       string
+		expected logqlmodel.EmptyReason
+	}{
+		{`{app="foo"}`, logqlmodel.EmptyReasonNotEmpty},
+		{`{app="foo"} |= "nomatch"`, logqlmodel.EmptyReasonFilteredOut},
+		{`{app="nope"}`, logqlmodel.EmptyReasonNoStreams},
+		{`count_over_time({app="foo"} |= "nomatch" [1m])`, logqlmodel.EmptyReasonFilteredOut},
+		{`count_over_time({app="nope"}[1m])`, logqlmodel.EmptyReasonNoStreams},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(0, 0), time.Unix(60, 0), time.Minute, 0, logproto.FORWARD, 10, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, res.EmptyReason)
+		})
 	}
+}
 
-	maxSeries := 2 // Limit to 2 series
+func TestEngine_LogQueryStopsAtLimit(t *testing.T) {
+	querier := &entriesReadQuerier{Querier: NewMockQuerier(0, []logproto.Stream{newStream(testSize, identity, `{app="foo"}`)})}
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(`{app="foo"}`, time.Unix(0, 0), time.Unix(int64(testSize), 0), 0, 0, logproto.FORWARD, 10, nil, nil)
+	require.NoError(t, err)
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
 
-	// Create first vector that exceeds the limit (3 series)
-	firstVec := make(promql.Vector, 3)
-	for i := range 3 {
-		firstVec[i] = promql.Sample{
-			T:      0 * 1000, // First time step
-			F:      float64(i + 1),
-			Metric: labels.FromStrings("app", fmt.Sprintf("app%d", i)),
-		}
+	require.Equal(t, int64(10), res.Data.(logqlmodel.Streams).Lines())
+	require.Equal(t, 10, querier.read)
+	require.True(t, querier.closed)
+}
+
+// entriesReadQuerier counts the entries read from the iterators it returns
+// and whether they were closed.
+type entriesReadQuerier struct {
+	Querier
+	read   int
+	closed bool
+}
+
+func (q *entriesReadQuerier) SelectLogs(ctx context.Context, p SelectLogParams) (iter.EntryIterator, error) {
+	it, err := q.Querier.SelectLogs(ctx, p)
+	if err != nil {
+		return nil, err
 	}
+	return &entriesReadIterator{EntryIterator: it, q: q}, nil
+}
 
-	// Create second vector that also exceeds the limit (4 series)
-	// This simulates the case where subsequent steps return even more series
-	secondVec := make(promql.Vector, 4)
-	for i := range 4 {
-		secondVec[i] = promql.Sample{
-			T:      60 * 1000, // Second time step
-			F:      float64(i + 10),
-			Metric: labels.FromStrings("app", fmt.Sprintf("app%d", i)),
-		}
+type entriesReadIterator struct {
+	iter.EntryIterator
+	q *entriesReadQuerier
+}
+
+func (it *entriesReadIterator) Next() bool {
+	if !it.EntryIterator.Next() {
+		return false
 	}
+	it.q.read++
+	return true
+}
 
-	// Create third vector that also exceeds the limit (5 series)
-	thirdVec := make(promql.Vector, 5)
-	for i := range 5 {
-		thirdVec[i] = promql.Sample{
-			T:      120 * 1000, // Third time step
-			F:      float64(i + 20),
-			Metric: labels.FromStrings("app", fmt.Sprintf("app%d", i)),
-		}
+func (it *entriesReadIterator) Close() error {
+	it.q.closed = true
+	return it.EntryIterator.Close()
+}
+
+func TestEngine_MaxPipelineStages(t *testing.T) {
+	eng := NewEngine(EngineOpts{MaxPipelineStages: 5}, NewMockQuerier(0, nil), NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	for _, tc := range []struct {
+		qs      string
+		tooLong bool
+	}{
+		{`{app="foo"} | json | line_format "{{.a}}" | label_format b=a | logfmt | drop c`, false},
+		{`{app="foo"} | json | line_format "{{.a}}" | label_format b=a | logfmt | drop c | keep b`, true},
+		{`count_over_time({app="foo"} | json | line_format "{{.a}}" | label_format b=a | logfmt | drop c [1m])`, false},
+		{`count_over_time({app="foo"} | json | line_format "{{.a}}" | label_format b=a | logfmt | drop c | keep b [1m])`, true},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(0, 0), time.Unix(60, 0), time.Minute, 0, logproto.FORWARD, 10, nil, nil)
+			require.NoError(t, err)
+			_, err = eng.Query(params).Exec(ctx)
+			if tc.tooLong {
+				require.ErrorIs(t, err, logqlmodel.ErrQueryTooComplex)
+				require.ErrorContains(t, err, "6 pipeline stages exceed the maximum of 5")
+			} else {
+				require.NoError(t, err)
+			}
+		})
 	}
+}
 
-	// Create a mock step evaluator that returns vectors exceeding the limit on each call
-	stepEvaluator := &mockStepEvaluator{
-		results: []StepResult{
-			&storeSampleResult{vector: secondVec}, // Second call will return 4 series
-			&storeSampleResult{vector: thirdVec},  // Third call will return 5 series
-		},
-		current: 0,
-		t:       t,
+func TestEngine_SelectorLabelPolicy(t *testing.T) {
+	eng := NewEngine(EngineOpts{
+		RequiredLabels:         []string{"namespace"},
+		ForbiddenLabelMatchers: []string{"trace_id"},
+	}, NewMockQuerier(0, nil), NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	for _, tc := range []struct {
+		qs  string
+		err string
+	}{
+		{`{namespace="prod", app="foo"}`, ""},
+		{`sum(count_over_time({namespace=~"prod|dev"} |= "error" [1m]))`, ""},
+		{`{app="foo"}`, `selector {app="foo"} has no matcher restricting the values of the required label namespace`},
+		{
+			`count_over_time({namespace="prod"}[1m]) / count_over_time({app="foo"} | json [1m])`,
+			`selector {app="foo"} has no matcher restricting the values of the required label namespace`,
+		},
+		{`{namespace="prod", trace_id="abc"}`, `selector {namespace="prod", trace_id="abc"} has a matcher on the forbidden label trace_id`},
+		{`1 + 1`, ""},
+		{`{namespace=~".*", app="foo"}`, `selector {namespace=~".*", app="foo"} has no matcher restricting the values of the required label namespace`},
+		{`{namespace=~".+", app="foo"}`, `selector {namespace=~".+", app="foo"} has no matcher restricting the values of the required label namespace`},
+		{`{namespace!="", app="foo"}`, `selector {namespace!="", app="foo"} has no matcher restricting the values of the required label namespace`},
+		{`{namespace!="prod", app="foo"}`, `selector {namespace!="prod", app="foo"} has no matcher restricting the values of the required label namespace`},
+		{`{namespace=~"prod|", app="foo"}`, `selector {namespace=~"prod|", app="foo"} has no matcher restricting the values of the required label namespace`},
+		{`{namespace=~"prod-.+", app="foo"}`, ""},
+		{`{namespace!="", namespace="prod"}`, ""},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(0, 0), time.Unix(60, 0), time.Minute, 0, logproto.FORWARD, 10, nil, nil)
+			require.NoError(t, err)
+			_, err = eng.Query(params).Exec(ctx)
+			if tc.err != "" {
+				require.ErrorIs(t, err, logqlmodel.ErrLabelPolicy)
+				require.NotErrorIs(t, err, logqlmodel.ErrBlocked)
+				require.ErrorContains(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
 	}
+}
 
-	// Call JoinSampleVector with the first vector (3 series) and step evaluator
-	// that will return even larger vectors in subsequent steps
-	result, err := q.JoinSampleVector(ctx, true, &storeSampleResult{vector: firstVec}, stepEvaluator, maxSeries, false)
+func TestEngine_WarnUnderSampling(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{newStream(testSize, identity, `{app="foo"}`)})
+	ctx := user.InjectOrgID(context.Background(), "fake")
 
-	require.NoError(t, err)
-	require.NotNil(t, result)
+	for _, tc := range []struct {
+		name     string
+		opts     EngineOpts
+		step     time.Duration
+		expected []metadata.Warning
+	}{
+		{"step exceeds range", EngineOpts{WarnUnderSampling: true}, time.Minute, []metadata.Warning{metadata.UnderSampledWarning(time.Minute, 30*time.Second)}},
+		{"step within range", EngineOpts{WarnUnderSampling: true}, 30 * time.Second, nil},
+		{"disabled", EngineOpts{}, time.Minute, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := NewLiteralParams(`count_over_time({app="foo"}[30s])`, time.Unix(60, 0), time.Unix(240, 0), tc.step, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := NewEngine(tc.opts, querier, NoLimits, log.NewNopLogger()).Query(params).Exec(ctx)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, res.StructuredWarnings)
+		})
+	}
 
-	// This test expects the CORRECT behavior: series limit should be respected
-	// across all steps of a range query for Logs Drilldown requests
-	if matrix, ok := result.(promql.Matrix); ok {
-		// Count total unique series across all steps
-		seriesMap := make(map[string]bool)
-		for _, series := range matrix {
-			seriesMap[series.Metric.String()] = true
-		}
+	require.Equal(t, "30s", metadata.UnderSampledWarning(time.Minute, 30*time.Second).Fields["gap"])
+}
 
-		// The correct behavior: final result should never exceed maxSeries
-		// This assertion will FAIL initially, demonstrating the bug exists
-		require.LessOrEqual(t, len(seriesMap), maxSeries,
-			"Expected series limit to be respected across all range query steps. "+
-				"Found %d series but limit is %d. This indicates the vector overwrite bug exists.",
-			len(seriesMap), maxSeries)
+func TestEngine_LastOverTimeDefault(t *testing.T) {
+	querier := NewMockQuerier(0, []logproto.Stream{
+		{Labels: `{app="a"}`, Entries: []logproto.Entry{
+			{Timestamp: time.Unix(10, 0), Line: "v=1"},
+			{Timestamp: time.Unix(100, 0), Line: "v=2"},
+		}},
+		{Labels: `{app="b"}`, Entries: []logproto.Entry{
+			{Timestamp: time.Unix(140, 0), Line: "v=5"},
+		}},
+	})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
 
-		t.Logf("Correct behavior: found %d unique series (within limit of %d)", len(seriesMap), maxSeries)
-	} else {
-		t.Fatalf("Expected Matrix result, got %T", result)
+	for _, tc := range []struct {
+		qs       string
+		expected promql.Matrix
+	}{
+		{
+			// the windows without samples have no points.
+			`last_over_time({app=~"a|b"} | logfmt | unwrap v [30s])`,
+			promql.Matrix{
+				{Metric: labels.FromStrings("app", "a"), Floats: []promql.FPoint{{T: 30 * 1000, F: 1}, {T: 120 * 1000, F: 2}}},
+				{Metric: labels.FromStrings("app", "b"), Floats: []promql.FPoint{{T: 150 * 1000, F: 5}}},
+			},
+		},
+		{
+			`last_over_time({app=~"a|b"} | logfmt | unwrap v [30s], default=0)`,
+			promql.Matrix{
+				{Metric: labels.FromStrings("app", "a"), Floats: []promql.FPoint{
+					{T: 30 * 1000, F: 1}, {T: 60 * 1000, F: 0}, {T: 90 * 1000, F: 0}, {T: 120 * 1000, F: 2}, {T: 150 * 1000, F: 0},
+				}},
+				{Metric: labels.FromStrings("app", "b"), Floats: []promql.FPoint{
+					{T: 30 * 1000, F: 0}, {T: 60 * 1000, F: 0}, {T: 90 * 1000, F: 0}, {T: 120 * 1000, F: 0}, {T: 150 * 1000, F: 5},
+				}},
+			},
+		},
+		{
+			// with overlapping windows.
+			`last_over_time({app=~"a|b"} | logfmt | unwrap v [1m], default=7)`,
+			promql.Matrix{
+				{Metric: labels.FromStrings("app", "a"), Floats: []promql.FPoint{
+					{T: 30 * 1000, F: 1}, {T: 60 * 1000, F: 1}, {T: 90 * 1000, F: 7}, {T: 120 * 1000, F: 2}, {T: 150 * 1000, F: 2},
+				}},
+				{Metric: labels.FromStrings("app", "b"), Floats: []promql.FPoint{
+					{T: 30 * 1000, F: 7}, {T: 60 * 1000, F: 7}, {T: 90 * 1000, F: 7}, {T: 120 * 1000, F: 7}, {T: 150 * 1000, F: 5},
+				}},
+			},
+		},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(30, 0), time.Unix(150, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(ctx)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, res.Data)
+		})
 	}
-
-	// Verify that warnings were still added for the first truncation
-	meta := metadata.FromContext(ctx)
-	warnings := meta.Warnings()
-	require.NotEmpty(t, warnings, "Expected warnings due to series limit exceeded")
-	require.Contains(t, warnings[0], "maximum number of series")
 }
@@ -0,0 +1,115 @@
+package logql
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/loki/v3/pkg/iter"
+	"github.com/grafana/loki/v3/pkg/logqlmodel/stats"
+)
+
+type costEstimateCtxKey struct{}
+
+// costEstimate collects the estimate of the cost of a query in its
+// statistics while it is executed, see EngineOpts.EstimateCost. The series
+// selected by all selectors of the query are counted once.
+type costEstimate struct {
+	mtx    sync.Mutex
+	series map[string]struct{}
+}
+
+// withCostEstimate returns a context estimating the cost of the query
+// executed with it.
+func withCostEstimate(ctx context.Context) (*costEstimate, context.Context) {
+	e := &costEstimate{series: map[string]struct{}{}}
+	return e, context.WithValue(ctx, costEstimateCtxKey{}, e)
+}
+
+func costEstimateFromContext(ctx context.Context) (*costEstimate, bool) {
+	e, ok := ctx.Value(costEstimateCtxKey{}).(*costEstimate)
+	return e, ok
+}
+
+// estimateSelector counts a selector of the query, if its cost is estimated.
+func estimateSelector(ctx context.Context) {
+	if _, ok := costEstimateFromContext(ctx); ok {
+		stats.FromContext(ctx).AddEstimateSelectors(1)
+	}
+}
+
+// estimateEvaluatorNode counts an evaluator of the query, if its cost is
+// estimated.
+func estimateEvaluatorNode(ctx context.Context) {
+	if _, ok := costEstimateFromContext(ctx); ok {
+		stats.FromContext(ctx).AddEstimateEvaluatorNodes(1)
+	}
+}
+
+// estimateSamples counts the selector of the iterator and wraps it to count
+// its series and samples, if the cost of the query is estimated.
+func estimateSamples(ctx context.Context, it iter.SampleIterator) iter.SampleIterator {
+	e, ok := costEstimateFromContext(ctx)
+	if !ok {
+		return it
+	}
+	statsCtx := stats.FromContext(ctx)
+	statsCtx.AddEstimateSelectors(1)
+	return &estimateSampleIterator{
+		SampleIterator: it,
+		estimate:       e,
+		stats:          statsCtx,
+	}
+}
+
+func (e *costEstimate) addSeries(labels string) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.series[labels] = struct{}{}
+}
+
+// report adds the distinct series selected by the query to its statistics.
+func (e *costEstimate) report(statsCtx *stats.Context) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	statsCtx.AddEstimateSeries(int64(len(e.series)))
+}
+
+// estimateSampleIterator counts the series and samples read from a selector
+// into the estimate of the query statistics. Consecutive samples of the same
+// series are only counted once in the series of the estimate.
+type estimateSampleIterator struct {
+	iter.SampleIterator
+
+	estimate *costEstimate
+	stats    *stats.Context
+	last     string
+	started  bool
+	samples  int64
+	reported bool
+}
+
+func (it *estimateSampleIterator) Next() bool {
+	if !it.SampleIterator.Next() {
+		it.report()
+		return false
+	}
+	it.samples++
+	if labels := it.Labels(); !it.started || labels != it.last {
+		it.started, it.last = true, labels
+		it.estimate.addSeries(labels)
+	}
+	return true
+}
+
+func (it *estimateSampleIterator) Close() error {
+	it.report()
+	return it.SampleIterator.Close()
+}
+
+func (it *estimateSampleIterator) report() {
+	if it.reported {
+		return
+	}
+	it.reported = true
+	it.stats.AddEstimateSamples(it.samples)
+}
@@ -5,8 +5,10 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"slices"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -18,8 +20,11 @@ import (
 
 	"github.com/grafana/loki/v3/pkg/iter"
 	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logql/log"
 	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/grafana/loki/v3/pkg/logql/vector"
 	"github.com/grafana/loki/v3/pkg/logqlmodel"
+	"github.com/grafana/loki/v3/pkg/logqlmodel/metadata"
 	"github.com/grafana/loki/v3/pkg/querier/plan"
 	"github.com/grafana/loki/v3/pkg/storage/chunk/cache/resultscache"
 	"github.com/grafana/loki/v3/pkg/util"
@@ -35,6 +40,51 @@ var (
 	RangeType   QueryRangeType = "range"
 )
 
+// StepAlignment selects which point of the range window the value computed
+// for a step is timestamped with.
+type StepAlignment string
+
+const (
+	StepAlignmentStart  StepAlignment = "start"
+	StepAlignmentCenter StepAlignment = "center"
+	StepAlignmentEnd    StepAlignment = "end"
+)
+
+// ParseStepAlignment parses a step alignment. An empty string defaults to
+// StepAlignmentEnd.
+func ParseStepAlignment(s string) (StepAlignment, error) {
+	switch a := StepAlignment(s); a {
+	case "":
+		return StepAlignmentEnd, nil
+	case StepAlignmentStart, StepAlignmentCenter, StepAlignmentEnd:
+		return a, nil
+	default:
+		return "", fmt.Errorf("invalid step alignment %q, must be one of %q, %q or %q", s, StepAlignmentStart, StepAlignmentCenter, StepAlignmentEnd)
+	}
+}
+
+// ResultTransform selects a transformation applied to the finalized matrix of
+// a range query.
+type ResultTransform string
+
+const (
+	ResultTransformNone ResultTransform = ""
+	// ResultTransformStepDelta replaces each point by its difference with the
+	// previous point of the series.
+	ResultTransformStepDelta ResultTransform = "step_delta"
+)
+
+// ParseResultTransform parses a result transform. An empty string means no
+// transform.
+func ParseResultTransform(s string) (ResultTransform, error) {
+	switch t := ResultTransform(s); t {
+	case ResultTransformNone, ResultTransformStepDelta:
+		return t, nil
+	default:
+		return "", fmt.Errorf("invalid result transform %q, must be empty or %q", s, ResultTransformStepDelta)
+	}
+}
+
 // Params details the parameters associated with a loki request
 type Params interface {
 	QueryString() string
@@ -135,10 +185,104 @@ type LiteralParams struct {
 	queryExpr      syntax.Expr
 	storeChunks    *logproto.ChunkRefGroup
 	cachingOptions resultscache.CachingOptions
+	options        resultOptions
+}
+
+// resultOptions are the optional params changing the result of a query
+// besides its expression, bounds, step, direction, limit and shards. They are
+// part of the cache key of the query as a whole, so that an option added here
+// is keyed too.
+type resultOptions struct {
+	stepAlignment StepAlignment
+	transform     ResultTransform
+	hold          time.Duration
+	zeroOnEmpty   bool
+	seed          int64
+	seeded        bool
+}
+
+// resultOptionsParams is implemented by Params with result options.
+type resultOptionsParams interface {
+	resultOptions() resultOptions
+}
+
+// resultOptions impls resultOptionsParams
+func (p LiteralParams) resultOptions() resultOptions {
+	o := p.options
+	o.stepAlignment = p.StepAlignment()
+	return o
 }
 
 func (p LiteralParams) Copy() LiteralParams { return p }
 
+// WithRange returns a copy of the params evaluated over the given bounds and
+// step, e.g. for a split of a range query. The parsed expression is shared
+// instead of parsing the query again.
+func (p LiteralParams) WithRange(start, end time.Time, step time.Duration) LiteralParams {
+	p.start = start
+	p.end = end
+	p.step = step
+	return p
+}
+
+// WithSeed returns a copy of the params carrying the given seed. The engine
+// records it in the metadata of the result and passes it to the querier in the
+// context of the query, see RandFromContext.
+func (p LiteralParams) WithSeed(seed int64) LiteralParams {
+	p.options.seed, p.options.seeded = seed, true
+	return p
+}
+
+// Seed impls SeedParams
+func (p LiteralParams) Seed() (int64, bool) {
+	return p.options.seed, p.options.seeded
+}
+
+// WithStepAlignment returns a copy of the params using the given step alignment.
+func (p LiteralParams) WithStepAlignment(a StepAlignment) LiteralParams {
+	p.options.stepAlignment = a
+	return p
+}
+
+// StepAlignment impls StepAlignmentParams
+func (p LiteralParams) StepAlignment() StepAlignment {
+	if p.options.stepAlignment == "" {
+		return StepAlignmentEnd
+	}
+	return p.options.stepAlignment
+}
+
+// WithResultTransform returns a copy of the params applying the given
+// transform to the result.
+func (p LiteralParams) WithResultTransform(t ResultTransform) LiteralParams {
+	p.options.transform = t
+	return p
+}
+
+// ResultTransform impls ResultTransformParams
+func (p LiteralParams) ResultTransform() ResultTransform { return p.options.transform }
+
+// WithHold returns a copy of the params filling the empty steps of each series
+// of a range query with its previous value for up to the given duration.
+func (p LiteralParams) WithHold(d time.Duration) LiteralParams {
+	p.options.hold = d
+	return p
+}
+
+// Hold impls HoldParams
+func (p LiteralParams) Hold() time.Duration { return p.options.hold }
+
+// WithZeroOnEmptyAggregation returns a copy of the params making the sum or
+// count aggregation of the query, when it is the outermost expression, emit a
+// zero-valued series without labels at the steps it aggregates no samples.
+func (p LiteralParams) WithZeroOnEmptyAggregation(zero bool) LiteralParams {
+	p.options.zeroOnEmpty = zero
+	return p
+}
+
+// ZeroOnEmptyAggregation impls ZeroOnEmptyAggregationParams
+func (p LiteralParams) ZeroOnEmptyAggregation() bool { return p.options.zeroOnEmpty }
+
 // String impls Params
 func (p LiteralParams) QueryString() string { return p.queryString }
 
@@ -182,6 +326,127 @@ func GetRangeType(q Params) QueryRangeType {
 	return RangeType
 }
 
+// StepAlignmentParams is implemented by Params that choose where in the range
+// window the points of a range query are timestamped.
+type StepAlignmentParams interface {
+	StepAlignment() StepAlignment
+}
+
+// GetStepAlignment returns the step alignment of the params, defaulting to
+// StepAlignmentEnd.
+func GetStepAlignment(q Params) StepAlignment {
+	if p, ok := findParams[StepAlignmentParams](q); ok {
+		return p.StepAlignment()
+	}
+	return StepAlignmentEnd
+}
+
+// ResultTransformParams is implemented by Params that transform the result
+// of a range query.
+type ResultTransformParams interface {
+	ResultTransform() ResultTransform
+}
+
+// GetResultTransform returns the result transform of the params, if any.
+func GetResultTransform(q Params) ResultTransform {
+	if p, ok := findParams[ResultTransformParams](q); ok {
+		return p.ResultTransform()
+	}
+	return ResultTransformNone
+}
+
+// HoldParams is implemented by Params that hold the last value of each series
+// of a range query over its empty steps.
+type HoldParams interface {
+	Hold() time.Duration
+}
+
+// GetHold returns how long the params hold the last value of a series, if at all.
+func GetHold(q Params) time.Duration {
+	if p, ok := findParams[HoldParams](q); ok {
+		return p.Hold()
+	}
+	return 0
+}
+
+// ZeroOnEmptyAggregationParams is implemented by Params that make the sum and
+// count aggregation of a query emit a zero-valued series when it is empty.
+type ZeroOnEmptyAggregationParams interface {
+	ZeroOnEmptyAggregation() bool
+}
+
+// GetZeroOnEmptyAggregation returns whether empty sum and count aggregations
+// emit a zero-valued series instead of nothing.
+func GetZeroOnEmptyAggregation(q Params) bool {
+	if p, ok := findParams[ZeroOnEmptyAggregationParams](q); ok {
+		return p.ZeroOnEmptyAggregation()
+	}
+	return false
+}
+
+// SeedParams is implemented by Params carrying a seed for the randomized
+// decisions of the querier.
+type SeedParams interface {
+	Seed() (int64, bool)
+}
+
+// GetSeed returns the seed of the params, if any.
+func GetSeed(q Params) (int64, bool) {
+	if p, ok := findParams[SeedParams](q); ok {
+		return p.Seed()
+	}
+	return 0, false
+}
+
+// ParamsWrapper is implemented by Params wrapping other Params to override
+// some of their values. The optional params, such as the StepAlignmentParams,
+// are looked up along the chain of wrapped params so that the wrappers do not
+// have to forward them.
+type ParamsWrapper interface {
+	Unwrap() Params
+}
+
+// findParams returns the first params implementing T along the chain of
+// wrapped params starting at q.
+func findParams[T any](q Params) (T, bool) {
+	for q != nil {
+		if p, ok := q.(T); ok {
+			return p, true
+		}
+		w, ok := q.(ParamsWrapper)
+		if !ok {
+			break
+		}
+		q = w.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// stepAlignmentOffset returns the offset to add to the timestamp of each step
+// so that it matches the requested alignment within the range window of expr.
+// The window is the largest range interval found in the expression.
+func stepAlignmentOffset(expr syntax.SampleExpr, alignment StepAlignment) int64 {
+	if alignment == StepAlignmentEnd || alignment == "" {
+		return 0
+	}
+	var window time.Duration
+	expr.Walk(func(e syntax.Expr) bool {
+		if r, ok := e.(*syntax.RangeAggregationExpr); ok && r.Left != nil && r.Left.Interval > window {
+			window = r.Left.Interval
+		}
+		return true
+	})
+	switch alignment {
+	case StepAlignmentStart:
+		return -window.Milliseconds()
+	case StepAlignmentCenter:
+		return -window.Milliseconds() / 2
+	default:
+		return 0
+	}
+}
+
 // ParamsWithExpressionOverride overrides the query expression so that the query
 // string and the expression can differ. This is useful for for query planning
 // when plan my not match externally available logql syntax
@@ -195,6 +460,11 @@ func (p ParamsWithExpressionOverride) GetExpression() syntax.Expr {
 	return p.ExpressionOverride
 }
 
+// Unwrap impls ParamsWrapper
+func (p ParamsWithExpressionOverride) Unwrap() Params {
+	return p.Params
+}
+
 // ParamsWithExpressionOverride overrides the shards. Since the backing
 // implementation of the Params interface is unknown they are embedded and the
 // original shards are shadowed.
@@ -208,6 +478,92 @@ func (p ParamsWithShardsOverride) Shards() []string {
 	return p.ShardsOverride
 }
 
+// Unwrap impls ParamsWrapper
+func (p ParamsWithShardsOverride) Unwrap() Params {
+	return p.Params
+}
+
+// ParamsWithStepOverride overrides the step, e.g. when the requested step is
+// below the minimum step of the tenant.
+type ParamsWithStepOverride struct {
+	Params
+	StepOverride time.Duration
+}
+
+// Step returns the overriding step.
+func (p ParamsWithStepOverride) Step() time.Duration {
+	return p.StepOverride
+}
+
+// Unwrap impls ParamsWrapper
+func (p ParamsWithStepOverride) Unwrap() Params {
+	return p.Params
+}
+
+// ParamsWithAtOverride anchors the evaluation to a single step at the
+// timestamp of an @ modifier.
+type ParamsWithAtOverride struct {
+	Params
+	AtOverride time.Time
+}
+
+// Start returns the anchored timestamp.
+func (p ParamsWithAtOverride) Start() time.Time {
+	return p.AtOverride
+}
+
+// End returns the anchored timestamp.
+func (p ParamsWithAtOverride) End() time.Time {
+	return p.AtOverride
+}
+
+// Step returns a zero step as only the anchored timestamp is evaluated.
+func (p ParamsWithAtOverride) Step() time.Duration {
+	return 0
+}
+
+// Unwrap impls ParamsWrapper
+func (p ParamsWithAtOverride) Unwrap() Params {
+	return p.Params
+}
+
+// ParamsWithRangeOverride overrides the start, end and step, e.g. to execute
+// a query over another range than the one it was created for.
+type ParamsWithRangeOverride struct {
+	Params
+	StartOverride, EndOverride time.Time
+	StepOverride               time.Duration
+}
+
+// Start returns the overriding start.
+func (p ParamsWithRangeOverride) Start() time.Time {
+	return p.StartOverride
+}
+
+// End returns the overriding end.
+func (p ParamsWithRangeOverride) End() time.Time {
+	return p.EndOverride
+}
+
+// Step returns the overriding step.
+func (p ParamsWithRangeOverride) Step() time.Duration {
+	return p.StepOverride
+}
+
+// Unwrap impls ParamsWrapper
+func (p ParamsWithRangeOverride) Unwrap() Params {
+	return p.Params
+}
+
+// anchoredParams returns the params a log range is evaluated with, anchored
+// to the timestamp of its @ modifier if it has one.
+func anchoredParams(q Params, r *syntax.LogRangeExpr) Params {
+	if r.At == nil {
+		return q
+	}
+	return ParamsWithAtOverride{Params: q, AtOverride: time.UnixMilli(*r.At)}
+}
+
 type ParamsWithChunkOverrides struct {
 	Params
 	StoreChunksOverride *logproto.ChunkRefGroup
@@ -217,6 +573,11 @@ func (p ParamsWithChunkOverrides) GetStoreChunks() *logproto.ChunkRefGroup {
 	return p.StoreChunksOverride
 }
 
+// Unwrap impls ParamsWrapper
+func (p ParamsWithChunkOverrides) Unwrap() Params {
+	return p.Params
+}
+
 func ParamOverridesFromShard(base Params, shard *ShardWithChunkRefs) (result Params) {
 	if shard == nil {
 		return base
@@ -290,7 +651,79 @@ func EvaluatorUnsupportedType(expr syntax.Expr, ev EvaluatorFactory) error {
 type DefaultEvaluator struct {
 	maxLookBackPeriod         time.Duration
 	maxCountMinSketchHeapSize int
+	rangeOpts                 rangeAggOptions
+	binOpOpts                 binOpOptions
 	querier                   Querier
+	// unpackedBytes keeps sum from pushing its grouping down to bytes
+	// aggregations over an unpack stage, so that they count unpacked lines.
+	unpackedBytes bool
+}
+
+// rangeAggOptions tunes the evaluation of range aggregations.
+type rangeAggOptions struct {
+	// absentLookback keeps absent_over_time reporting series as present for
+	// this long after the last step they had samples at.
+	absentLookback time.Duration
+	// prometheusRateCompat extrapolates unwrapped rate like PromQL does.
+	prometheusRateCompat bool
+	// zscoreZeroStddevNaN makes zscore_over_time return NaN instead of 0 for
+	// windows with a standard deviation of zero.
+	zscoreZeroStddevNaN bool
+	// propagateNaNInExtremes makes min_over_time and max_over_time return NaN
+	// for windows with a NaN sample instead of skipping NaN samples.
+	propagateNaNInExtremes bool
+	// downsampleTarget caps the samples buffered per series and window by
+	// quantile_over_time. Zero buffers all samples.
+	downsampleTarget int
+}
+
+// binOpOptions tunes the evaluation of binary operations between two vectors.
+type binOpOptions struct {
+	// transforms derive labels of one side before matching it with the other.
+	transforms []LabelTransform
+	// legs holds a slot per leg evaluated concurrently with the other leg of
+	// its binary operation. A nil channel evaluates the legs sequentially.
+	legs chan struct{}
+	// divByZero is the policy for the division of a sample by a zero sample
+	// of the other vector.
+	divByZero string
+}
+
+// Policies for the division of a sample by zero in a binary operation with a
+// vector or a literal.
+const (
+	// DivByZeroInf returns +Inf or -Inf by the sign of the dividend, and NaN
+	// for 0/0. It is the default.
+	DivByZeroInf = "inf"
+	// DivByZeroNaN returns NaN.
+	DivByZeroNaN = "nan"
+	// DivByZeroDrop drops the sample.
+	DivByZeroDrop = "drop"
+)
+
+// ValidateDivByZeroPolicy returns an error if policy is not one of the
+// division by zero policies. An empty policy defaults to DivByZeroInf.
+func ValidateDivByZeroPolicy(policy string) error {
+	switch policy {
+	case "", DivByZeroInf, DivByZeroNaN, DivByZeroDrop:
+		return nil
+	default:
+		return fmt.Errorf("invalid division by zero policy %q, must be one of %q, %q or %q", policy, DivByZeroInf, DivByZeroNaN, DivByZeroDrop)
+	}
+}
+
+// divideByZero returns the sample s, whose value is the dividend, divided by
+// zero with the policy, or false if the policy drops it.
+func divideByZero(policy string, s promql.Sample) (promql.Sample, bool) {
+	switch {
+	case policy == DivByZeroDrop:
+		return s, false
+	case policy == DivByZeroNaN, s.F == 0, math.IsNaN(s.F):
+		s.F = math.NaN()
+	default:
+		s.F = math.Inf(int(math.Copysign(1, s.F)))
+	}
+	return s, true
 }
 
 // NewDefaultEvaluator constructs a DefaultEvaluator
@@ -322,27 +755,106 @@ func (ev *DefaultEvaluator) NewIterator(ctx context.Context, expr syntax.LogSele
 		params.Start = params.Start.Add(-ev.maxLookBackPeriod)
 	}
 
+	estimateSelector(ctx)
 	return ev.querier.SelectLogs(ctx, params)
 }
 
+type maxSeriesCtxKey struct{}
+
+// withMaxSeries returns a context carrying the series limit of the query
+// evaluated with it, checked against the querier's cardinality estimate
+// before selecting samples.
+func withMaxSeries(ctx context.Context, maxSeries int) context.Context {
+	if maxSeries <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, maxSeriesCtxKey{}, maxSeries)
+}
+
+type maxDistinctValuesCtxKey struct{}
+
+// withMaxDistinctValues returns a context carrying the maximum number of
+// distinct values count_values_over_time counts per series and window in the
+// query evaluated with it.
+func withMaxDistinctValues(ctx context.Context, maxDistinctValues int) context.Context {
+	if maxDistinctValues <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, maxDistinctValuesCtxKey{}, maxDistinctValues)
+}
+
+// maxDistinctValues returns the maximum number of distinct values carried by
+// the context, or 0 if there is none.
+func maxDistinctValues(ctx context.Context) int {
+	v, _ := ctx.Value(maxDistinctValuesCtxKey{}).(int)
+	return v
+}
+
+// checkSeriesCardinality fails with a series limit error when the querier
+// estimates params to select more series than the limit of the query. Queriers
+// without an estimate are left to the check on the evaluated result.
+func (ev *DefaultEvaluator) checkSeriesCardinality(ctx context.Context, params SelectSampleParams) error {
+	maxSeries, ok := ctx.Value(maxSeriesCtxKey{}).(int)
+	if !ok {
+		return nil
+	}
+	cq, ok := ev.querier.(SeriesCardinalityQuerier)
+	if !ok {
+		return nil
+	}
+	n, err := cq.SeriesCardinality(ctx, params)
+	if err != nil {
+		return err
+	}
+	if n > maxSeries {
+		return logqlmodel.NewSeriesLimitError(maxSeries)
+	}
+	return nil
+}
+
+// selectSamples sends a sample request to the querier, once per query if
+// the requests of the query are de-duplicated.
+func (ev *DefaultEvaluator) selectSamples(ctx context.Context, params SelectSampleParams) (iter.SampleIterator, error) {
+	if err := ev.checkSeriesCardinality(ctx, params); err != nil {
+		return nil, err
+	}
+	if c, ok := selectCacheFromContext(ctx); ok {
+		return c.selectSamples(ctx, ev.querySamples, params)
+	}
+	return ev.querySamples(ctx, params)
+}
+
+// querySamples sends a sample request to the querier, with its label filters
+// if the querier can pre-filter lines by them.
+func (ev *DefaultEvaluator) querySamples(ctx context.Context, params SelectSampleParams) (iter.SampleIterator, error) {
+	if fq, ok := ev.querier.(LabelFilterQuerier); ok {
+		if filters := params.LabelFilters(); len(filters) > 0 {
+			return fq.SelectSamplesWithLabelFilters(ctx, params, filters)
+		}
+	}
+	return ev.querier.SelectSamples(ctx, params)
+}
+
 func (ev *DefaultEvaluator) NewStepEvaluator(
 	ctx context.Context,
 	nextEvFactory SampleEvaluatorFactory,
 	expr syntax.SampleExpr,
 	q Params,
 ) (StepEvaluator, error) {
+	estimateEvaluatorNode(ctx)
 	switch e := expr.(type) {
 	case *syntax.VectorAggregationExpr:
-		if rangExpr, ok := e.Left.(*syntax.RangeAggregationExpr); ok && e.Operation == syntax.OpTypeSum {
+		if rangExpr, ok := e.Left.(*syntax.RangeAggregationExpr); ok && e.Operation == syntax.OpTypeSum && !(ev.unpackedBytes && countsUnpackedBytes(rangExpr)) {
 			// if range expression is wrapped with a vector expression
 			// we should send the vector expression for allowing reducing labels at the source.
 			nextEvFactory = SampleEvaluatorFunc(func(ctx context.Context, _ SampleEvaluatorFactory, _ syntax.SampleExpr, _ Params) (StepEvaluator, error) {
-				it, err := ev.querier.SelectSamples(ctx, SelectSampleParams{
+				bounds := anchoredParams(q, rangExpr.Left)
+				it, err := ev.selectSamples(ctx, SelectSampleParams{
 					&logproto.SampleQueryRequest{
 						// extend startTs backwards by step
-						Start: q.Start().Add(-rangExpr.Left.Interval).Add(-rangExpr.Left.Offset),
+						Start: bounds.Start().Add(-rangExpr.Left.Interval).Add(-rangExpr.Left.Offset),
 						// add leap nanosecond to endTs to include lines exactly at endTs. range iterators work on start exclusive, end inclusive ranges
-						End: q.End().Add(-rangExpr.Left.Offset).Add(time.Nanosecond),
+						End: bounds.End().Add(-rangExpr.Left.Offset).Add(time.Nanosecond),
 						// intentionally send the vector for reducing labels.
 						Selector: e.String(),
 						Shards:   q.Shards(),
@@ -355,19 +867,21 @@ func (ev *DefaultEvaluator) NewStepEvaluator(
 				if err != nil {
 					return nil, err
 				}
-				return newRangeAggEvaluator(iter.NewPeekingSampleIterator(it), rangExpr, q, rangExpr.Left.Offset)
+				estimateEvaluatorNode(ctx)
+				return newRangeAggEvaluator(ctx, iter.NewPeekingSampleIterator(estimateSamples(ctx, it)), rangExpr, q, rangExpr.Left.Offset, ev.rangeOpts)
 			})
 		}
 		return newVectorAggEvaluator(ctx, nextEvFactory, e, q, ev.maxCountMinSketchHeapSize)
 	case *CountMinSketchEvalExpr:
 		return NewCountMinSketchEvalStepEvaluator(ctx, nextEvFactory, e, q)
 	case *syntax.RangeAggregationExpr:
-		it, err := ev.querier.SelectSamples(ctx, SelectSampleParams{
+		bounds := anchoredParams(q, e.Left)
+		it, err := ev.selectSamples(ctx, SelectSampleParams{
 			&logproto.SampleQueryRequest{
 				// extend startTs backwards by step
-				Start: q.Start().Add(-e.Left.Interval).Add(-e.Left.Offset),
+				Start: bounds.Start().Add(-e.Left.Interval).Add(-e.Left.Offset),
 				// add leap nanosecond to endTs to include lines exactly at endTs. range iterators work on start exclusive, end inclusive ranges
-				End: q.End().Add(-e.Left.Offset).Add(time.Nanosecond),
+				End: bounds.End().Add(-e.Left.Offset).Add(time.Nanosecond),
 				// intentionally send the vector for reducing labels.
 				Selector: e.String(),
 				Shards:   q.Shards(),
@@ -380,11 +894,25 @@ func (ev *DefaultEvaluator) NewStepEvaluator(
 		if err != nil {
 			return nil, err
 		}
-		return newRangeAggEvaluator(iter.NewPeekingSampleIterator(it), e, q, e.Left.Offset)
+		return newRangeAggEvaluator(ctx, iter.NewPeekingSampleIterator(estimateSamples(ctx, it)), e, q, e.Left.Offset, ev.rangeOpts)
 	case *syntax.BinOpExpr:
-		return newBinOpStepEvaluator(ctx, nextEvFactory, e, q)
+		return newBinOpStepEvaluator(ctx, nextEvFactory, e, q, ev.binOpOpts)
 	case *syntax.LabelReplaceExpr:
 		return newLabelReplaceEvaluator(ctx, nextEvFactory, e, q)
+	case *syntax.HistogramQuantileExpr:
+		return newHistogramQuantileEvaluator(ctx, nextEvFactory, e, q)
+	case *syntax.LabelDropRegexExpr:
+		return newLabelDropRegexEvaluator(ctx, nextEvFactory, e, q)
+	case *syntax.LabelModeExpr:
+		return newLabelModeEvaluator(ctx, nextEvFactory, e, q)
+	case *syntax.RoundExpr:
+		return newRoundEvaluator(ctx, nextEvFactory, e, q)
+	case *syntax.AbsentExpr:
+		return newAbsentEvaluator(ctx, nextEvFactory, e, q)
+	case *syntax.ScalarExpr:
+		return newScalarEvaluator(ctx, nextEvFactory, e, q)
+	case *syntax.MetricLabelFmtExpr:
+		return newMetricLabelFmtEvaluator(ctx, nextEvFactory, e, q)
 	case *syntax.VectorExpr:
 		val, err := e.Value()
 		if err != nil {
@@ -396,6 +924,26 @@ func (ev *DefaultEvaluator) NewStepEvaluator(
 	}
 }
 
+// countsUnpackedBytes reports whether r sums the bytes of lines rewritten by
+// an unpack stage. Pushing a grouping without labels down to r makes the
+// unpack stage skip the lines, as no label is required, so the packed bytes
+// are counted instead.
+func countsUnpackedBytes(r *syntax.RangeAggregationExpr) bool {
+	if r.Operation != syntax.OpRangeTypeBytes && r.Operation != syntax.OpRangeTypeBytesRate {
+		return false
+	}
+	p, ok := r.Left.Left.(*syntax.PipelineExpr)
+	if !ok {
+		return false
+	}
+	for _, s := range p.MultiStages {
+		if l, ok := s.(*syntax.LineParserExpr); ok && l.Op == syntax.OpParserTypeUnpack {
+			return true
+		}
+	}
+	return false
+}
+
 func newVectorAggEvaluator(
 	ctx context.Context,
 	evFactory SampleEvaluatorFactory,
@@ -410,7 +958,10 @@ func newVectorAggEvaluator(
 	if err != nil {
 		return nil, err
 	}
+	// grouping labels are canonicalized since hashing requires sorted,
+	// unique names.
 	sort.Strings(expr.Grouping.Groups)
+	expr.Grouping.Groups = slices.Compact(expr.Grouping.Groups)
 
 	if expr.Operation == syntax.OpTypeCountMinSketch {
 		return newCountMinSketchVectorAggEvaluator(nextEvaluator, expr, maxCountMinSketchHeapSize)
@@ -431,6 +982,24 @@ type VectorAggEvaluator struct {
 	lb            *labels.Builder
 }
 
+// normalizeLabels drops the labels with an empty value from metric. An empty
+// label is equivalent to a missing one and must not split otherwise equal
+// groups.
+func (e *VectorAggEvaluator) normalizeLabels(metric labels.Labels) labels.Labels {
+	var empty []string
+	metric.Range(func(l labels.Label) {
+		if l.Value == "" {
+			empty = append(empty, l.Name)
+		}
+	})
+	if len(empty) == 0 {
+		return metric
+	}
+	e.lb.Reset(metric)
+	e.lb.Del(empty...)
+	return e.lb.Labels()
+}
+
 func (e *VectorAggEvaluator) Next() (bool, int64, StepResult) {
 	next, ts, r := e.nextEvaluator.Next()
 
@@ -445,7 +1014,7 @@ func (e *VectorAggEvaluator) Next() (bool, int64, StepResult) {
 		}
 	}
 	for _, s := range vec {
-		metric := s.Metric
+		metric := e.normalizeLabels(s.Metric)
 
 		var groupingKey uint64
 		if e.expr.Grouping.Without {
@@ -513,6 +1082,8 @@ func (e *VectorAggEvaluator) Next() (bool, int64, StepResult) {
 					F:      s.F,
 					Metric: s.Metric,
 				})
+			} else if e.expr.Operation == syntax.OpTypeQuantile {
+				result[groupingKey].values = vector.HeapByMaxValue{{F: s.F}}
 			}
 			continue
 		}
@@ -574,6 +1145,8 @@ func (e *VectorAggEvaluator) Next() (bool, int64, StepResult) {
 				F:      s.F,
 				Metric: s.Metric,
 			})
+		case syntax.OpTypeQuantile:
+			group.values = append(group.values, promql.Sample{F: s.F})
 		default:
 			panic(errors.Errorf("expected aggregation operator but got %q", e.expr.Operation))
 		}
@@ -593,6 +1166,9 @@ func (e *VectorAggEvaluator) Next() (bool, int64, StepResult) {
 		case syntax.OpTypeStdvar:
 			aggr.value = aggr.value / float64(aggr.groupCount)
 
+		case syntax.OpTypeQuantile:
+			aggr.value = Quantile(e.expr.Quantile, aggr.values)
+
 		case syntax.OpTypeTopK, syntax.OpTypeSortDesc:
 			// The heap keeps the lowest value on top, so reverse it.
 			sort.Sort(sort.Reverse(aggr.heap))
@@ -636,12 +1212,124 @@ func (e *VectorAggEvaluator) Error() error {
 }
 
 func newRangeAggEvaluator(
+	ctx context.Context,
+	it iter.PeekingSampleIterator,
+	expr *syntax.RangeAggregationExpr,
+	q Params,
+	o time.Duration,
+	opts rangeAggOptions,
+) (StepEvaluator, error) {
+	var ev StepEvaluator
+	if expr.Left.At == nil {
+		unanchored, err := newUnanchoredRangeAggEvaluator(ctx, it, expr, q, o, opts)
+		if err != nil {
+			return nil, err
+		}
+		ev = unanchored
+	} else {
+		anchored, err := newUnanchoredRangeAggEvaluator(ctx, it, expr, anchoredParams(q, expr.Left), o, opts)
+		if err != nil {
+			return nil, err
+		}
+		ev = &AtModifierEvaluator{
+			nextEvaluator: anchored,
+			current:       q.Start().UnixMilli(),
+			end:           q.End().UnixMilli(),
+			step:          q.Step().Milliseconds(),
+		}
+	}
+	if expr.Default != nil {
+		ev = &DefaultFillEvaluator{
+			nextEvaluator: ev,
+			value:         *expr.Default,
+			start:         q.Start().UnixMilli(),
+			end:           q.End().UnixMilli(),
+			step:          q.Step().Milliseconds(),
+		}
+	}
+	return &ExprErrorEvaluator{StepEvaluator: ev, expr: expr}, nil
+}
+
+// ZeroOnEmptyEvaluator emits a zero-valued series without labels at the steps
+// its inner evaluator returns no sample at. It wraps the top-level sum and
+// count aggregations of queries with ZeroOnEmptyAggregation, so that nested
+// and downstream aggregations are not filled.
+type ZeroOnEmptyEvaluator struct {
+	StepEvaluator
+}
+
+func (e *ZeroOnEmptyEvaluator) Next() (bool, int64, StepResult) {
+	next, ts, r := e.StepEvaluator.Next()
+	if next && len(r.SampleVector()) == 0 {
+		return next, ts, SampleVector{{Metric: labels.EmptyLabels(), T: ts, F: 0}}
+	}
+	return next, ts, r
+}
+
+// zeroOnEmptyAggregation reports whether expr is a sum or count aggregation,
+// possibly sent downstream as a whole, filled by a ZeroOnEmptyEvaluator.
+func zeroOnEmptyAggregation(expr syntax.SampleExpr) bool {
+	if d, ok := expr.(DownstreamSampleExpr); ok {
+		expr = d.SampleExpr
+	}
+	agg, ok := expr.(*syntax.VectorAggregationExpr)
+	return ok && (agg.Operation == syntax.OpTypeSum || agg.Operation == syntax.OpTypeCount)
+}
+
+// ExprErrorEvaluator names the expression it evaluates in the errors of the
+// wrapped evaluator, so that the failing subexpression of a query is known.
+type ExprErrorEvaluator struct {
+	StepEvaluator
+	expr syntax.SampleExpr
+}
+
+func (e *ExprErrorEvaluator) Error() error {
+	if err := e.StepEvaluator.Error(); err != nil {
+		return fmt.Errorf("error evaluating %s: %w", e.expr, err)
+	}
+	return nil
+}
+
+func newUnanchoredRangeAggEvaluator(
+	ctx context.Context,
 	it iter.PeekingSampleIterator,
 	expr *syntax.RangeAggregationExpr,
 	q Params,
 	o time.Duration,
+	opts rangeAggOptions,
 ) (StepEvaluator, error) {
+	if opts.prometheusRateCompat && expr.Operation == syntax.OpRangeTypeRate && expr.Left.Unwrap != nil {
+		iter := newPrometheusRateIterator(
+			it,
+			expr.Left.Interval.Nanoseconds(),
+			q.Step().Nanoseconds(),
+			q.Start().UnixNano(), q.End().UnixNano(), o.Nanoseconds(),
+		)
+
+		return &RangeVectorEvaluator{
+			iter: iter,
+		}, nil
+	}
+
 	switch expr.Operation {
+	case syntax.OpRangeTypeDelta, syntax.OpRangeTypeIdelta, syntax.OpRangeTypeDeriv:
+		fn := prometheusDelta
+		switch expr.Operation {
+		case syntax.OpRangeTypeIdelta:
+			fn = prometheusIdelta
+		case syntax.OpRangeTypeDeriv:
+			fn = prometheusDeriv
+		}
+		iter := newPrometheusRangeIterator(
+			it, fn,
+			expr.Left.Interval.Nanoseconds(),
+			q.Step().Nanoseconds(),
+			q.Start().UnixNano(), q.End().UnixNano(), o.Nanoseconds(),
+		)
+
+		return &RangeVectorEvaluator{
+			iter: iter,
+		}, nil
 	case syntax.OpRangeTypeAbsent:
 		iter, err := newRangeVectorIterator(
 			it, expr,
@@ -653,13 +1341,15 @@ func newRangeAggEvaluator(
 			return nil, err
 		}
 
-		absentLabels, err := absentLabels(expr)
+		absentLabels, err := syntax.AbsentLabels(expr)
 		if err != nil {
 			return nil, err
 		}
 		return &AbsentRangeVectorEvaluator{
-			iter: iter,
-			lbs:  absentLabels,
+			iter:     iter,
+			lbs:      absentLabels,
+			lookback: opts.absentLookback.Milliseconds(),
+			lastSeen: math.MinInt64,
 		}, nil
 	case syntax.OpRangeTypeQuantileSketch:
 		iter := newQuantileSketchIterator(
@@ -683,9 +1373,11 @@ func newRangeAggEvaluator(
 		return &RangeVectorEvaluator{
 			iter: iter,
 		}, nil
-	case syntax.OpRangeTypeLastWithTimestamp:
-		iter := newLastWithTimestampIterator(
-			it,
+	case syntax.OpRangeTypeCountValues:
+		iter := newCountValuesOverTimeIterator(
+			ctx, it,
+			expr.Label,
+			maxDistinctValues(ctx),
 			expr.Left.Interval.Nanoseconds(),
 			q.Step().Nanoseconds(),
 			q.Start().UnixNano(), q.End().UnixNano(), o.Nanoseconds(),
@@ -694,7 +1386,7 @@ func newRangeAggEvaluator(
 		return &RangeVectorEvaluator{
 			iter: iter,
 		}, nil
-	default:
+	case syntax.OpRangeTypeCV:
 		iter, err := newRangeVectorIterator(
 			it, expr,
 			expr.Left.Interval.Nanoseconds(),
@@ -704,21 +1396,110 @@ func newRangeAggEvaluator(
 		if err != nil {
 			return nil, err
 		}
+		var once sync.Once
+		setDegenerateWindows(iter, syntax.OpRangeTypeCV, degenerateWindows{
+			value: math.NaN(),
+			seen: func() {
+				once.Do(func() {
+					metadata.FromContext(ctx).AddStructuredWarning(metadata.ZeroMeanWarning(syntax.OpRangeTypeCV))
+				})
+			},
+		})
 
 		return &RangeVectorEvaluator{
 			iter: iter,
 		}, nil
-	}
-}
-
-type RangeVectorEvaluator struct {
-	iter RangeVectorIterator
+	case syntax.OpRangeTypeZScore:
+		iter, err := newRangeVectorIterator(
+			it, expr,
+			expr.Left.Interval.Nanoseconds(),
+			q.Step().Nanoseconds(),
+			q.Start().UnixNano(), q.End().UnixNano(), o.Nanoseconds(),
+		)
+		if err != nil {
+			return nil, err
+		}
 
-	err error
-}
+		// flat windows are not anomalous, unless configured otherwise.
+		flat := degenerateWindows{}
+		if opts.zscoreZeroStddevNaN {
+			flat = nanDegenerateWindows
+		}
+		setDegenerateWindows(iter, syntax.OpRangeTypeZScore, flat)
 
-func (r *RangeVectorEvaluator) Next() (bool, int64, StepResult) {
-	next := r.iter.Next()
+		return &RangeVectorEvaluator{
+			iter: iter,
+		}, nil
+	case syntax.OpRangeTypeQuantile:
+		iter, err := newRangeVectorIterator(
+			it, expr,
+			expr.Left.Interval.Nanoseconds(),
+			q.Step().Nanoseconds(),
+			q.Start().UnixNano(), q.End().UnixNano(), o.Nanoseconds(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if batch, ok := iter.(*batchRangeVectorIterator); ok && opts.downsampleTarget > 0 {
+			batch.downsample(ctx, opts.downsampleTarget)
+		}
+
+		return &RangeVectorEvaluator{
+			iter: iter,
+		}, nil
+	case syntax.OpRangeTypeMax, syntax.OpRangeTypeMin:
+		iter, err := newRangeVectorIterator(
+			it, expr,
+			expr.Left.Interval.Nanoseconds(),
+			q.Step().Nanoseconds(),
+			q.Start().UnixNano(), q.End().UnixNano(), o.Nanoseconds(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if opts.propagateNaNInExtremes {
+			propagateNaN(iter)
+		}
+
+		return &RangeVectorEvaluator{
+			iter: iter,
+		}, nil
+	case syntax.OpRangeTypeLastWithTimestamp:
+		iter := newLastWithTimestampIterator(
+			it,
+			expr.Left.Interval.Nanoseconds(),
+			q.Step().Nanoseconds(),
+			q.Start().UnixNano(), q.End().UnixNano(), o.Nanoseconds(),
+		)
+
+		return &RangeVectorEvaluator{
+			iter: iter,
+		}, nil
+	default:
+		iter, err := newRangeVectorIterator(
+			it, expr,
+			expr.Left.Interval.Nanoseconds(),
+			q.Step().Nanoseconds(),
+			q.Start().UnixNano(), q.End().UnixNano(), o.Nanoseconds(),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return &RangeVectorEvaluator{
+			iter: iter,
+		}, nil
+	}
+}
+
+type RangeVectorEvaluator struct {
+	iter RangeVectorIterator
+
+	err error
+}
+
+func (r *RangeVectorEvaluator) Next() (bool, int64, StepResult) {
+	next := r.iter.Next()
 	if !next {
 		return false, 0, SampleVector{}
 	}
@@ -742,10 +1523,129 @@ func (r *RangeVectorEvaluator) Error() error {
 	return r.iter.Error()
 }
 
+// AtModifierEvaluator evaluates a range aggregation with an @ modifier once, at
+// the anchored timestamp, and returns that result at every step of the query.
+type AtModifierEvaluator struct {
+	nextEvaluator StepEvaluator
+
+	anchored  SampleVector
+	evaluated bool
+
+	current, end, step int64
+}
+
+func (e *AtModifierEvaluator) Next() (bool, int64, StepResult) {
+	if !e.evaluated {
+		e.evaluated = true
+		next, _, r := e.nextEvaluator.Next()
+		if !next {
+			return false, 0, SampleVector{}
+		}
+		// the result of the next evaluator can be reused by it, so keep a copy.
+		e.anchored = append(SampleVector{}, r.SampleVector()...)
+	} else {
+		if e.step == 0 {
+			return false, 0, SampleVector{}
+		}
+		e.current += e.step
+	}
+	if e.current > e.end {
+		return false, 0, SampleVector{}
+	}
+
+	vec := make(SampleVector, 0, len(e.anchored))
+	for _, s := range e.anchored {
+		s.T = e.current
+		vec = append(vec, s)
+	}
+	return true, e.current, vec
+}
+
+func (e *AtModifierEvaluator) Close() error { return e.nextEvaluator.Close() }
+
+func (e *AtModifierEvaluator) Error() error { return e.nextEvaluator.Error() }
+
+// DefaultFillEvaluator returns a default value for the series of a range
+// aggregation at the steps it has no sample at, such as the windows without
+// samples of last_over_time. It evaluates all steps first, as a series may
+// only have samples at later steps. The series filled are the ones of the
+// evaluated range, so the query frontend does not split these queries by time.
+type DefaultFillEvaluator struct {
+	nextEvaluator StepEvaluator
+	value         float64
+
+	evaluated bool
+	series    []labels.Labels
+	steps     map[int64]promql.Vector
+
+	start, end, step, current int64
+}
+
+func (e *DefaultFillEvaluator) Next() (bool, int64, StepResult) {
+	if !e.evaluated {
+		e.evaluated = true
+		e.evaluate()
+		e.current = e.start
+	} else {
+		if e.step == 0 {
+			return false, 0, SampleVector{}
+		}
+		e.current += e.step
+	}
+	if e.current > e.end {
+		return false, 0, SampleVector{}
+	}
+
+	samples := e.steps[e.current]
+	present := make(map[uint64]struct{}, len(samples))
+	vec := make(SampleVector, 0, len(e.series))
+	for _, s := range samples {
+		present[s.Metric.Hash()] = struct{}{}
+		vec = append(vec, s)
+	}
+	for _, lbs := range e.series {
+		if _, ok := present[lbs.Hash()]; !ok {
+			vec = append(vec, promql.Sample{Metric: lbs, T: e.current, F: e.value})
+		}
+	}
+	return true, e.current, vec
+}
+
+// evaluate reads the samples of all steps of the next evaluator and the
+// series they belong to.
+func (e *DefaultFillEvaluator) evaluate() {
+	e.steps = map[int64]promql.Vector{}
+	seen := map[uint64]struct{}{}
+	for {
+		next, ts, r := e.nextEvaluator.Next()
+		if !next {
+			return
+		}
+		// the result of the next evaluator can be reused by it, so keep a copy.
+		vec := append(promql.Vector{}, r.SampleVector()...)
+		e.steps[ts] = vec
+		for _, s := range vec {
+			if _, ok := seen[s.Metric.Hash()]; !ok {
+				seen[s.Metric.Hash()] = struct{}{}
+				e.series = append(e.series, s.Metric)
+			}
+		}
+	}
+}
+
+func (e *DefaultFillEvaluator) Close() error { return e.nextEvaluator.Close() }
+
+func (e *DefaultFillEvaluator) Error() error { return e.nextEvaluator.Error() }
+
+// AbsentRangeVectorEvaluator returns a sample with the value 1 for each step
+// without samples. Once samples were seen at a step, absence is only reported
+// after the lookback has elapsed since that step.
 type AbsentRangeVectorEvaluator struct {
 	iter RangeVectorIterator
 	lbs  labels.Labels
 
+	lookback, lastSeen int64
+
 	err error
 }
 
@@ -763,6 +1663,11 @@ func (r *AbsentRangeVectorEvaluator) Next() (bool, int64, StepResult) {
 		}
 	}
 	if len(vec.SampleVector()) > 0 {
+		r.lastSeen = ts
+		return next, ts, SampleVector{}
+	}
+	if r.lookback > 0 && r.lastSeen != math.MinInt64 && ts-r.lastSeen <= r.lookback {
+		// values were seen recently enough to be considered present.
 		return next, ts, SampleVector{}
 	}
 	// values are missing.
@@ -791,6 +1696,7 @@ func newBinOpStepEvaluator(
 	evFactory SampleEvaluatorFactory,
 	expr *syntax.BinOpExpr,
 	q Params,
+	opts binOpOptions,
 ) (StepEvaluator, error) {
 	// first check if either side is a literal
 	leftLit, lOk := expr.SampleExpr.(*syntax.LiteralExpr)
@@ -808,6 +1714,7 @@ func newBinOpStepEvaluator(
 			rhs,
 			false,
 			expr.Opts.ReturnBool,
+			opts.divByZero,
 		)
 	}
 	if rOk {
@@ -821,9 +1728,41 @@ func newBinOpStepEvaluator(
 			lhs,
 			true,
 			expr.Opts.ReturnBool,
+			opts.divByZero,
 		)
 	}
 
+	// match a scalar() leg with all labels in the other leg like a literal,
+	// with its value at each step. A binary operation between two scalars
+	// matches their series without labels.
+	if lOk, rOk := isScalarExpr(expr.SampleExpr), isScalarExpr(expr.RHS); lOk != rOk {
+		scalar, other := expr.SampleExpr, expr.RHS
+		if rOk {
+			scalar, other = other, scalar
+		}
+		scalarEv, err := evFactory.NewStepEvaluator(ctx, evFactory, scalar, q)
+		if err != nil {
+			return nil, err
+		}
+		nextEv, err := evFactory.NewStepEvaluator(ctx, evFactory, other, q)
+		if err != nil {
+			return nil, err
+		}
+		return &LiteralStepEvaluator{
+			nextEv:     nextEv,
+			scalarEv:   scalarEv,
+			inverted:   rOk,
+			op:         expr.Op,
+			returnBool: expr.Opts.ReturnBool,
+			divByZero:  opts.divByZero,
+		}, nil
+	}
+
+	left, right := syntax.Unit(expr.SampleExpr), syntax.Unit(expr.RHS)
+	if _, ok := syntax.BinOpUnit(expr.Op, left, right); !ok {
+		metadata.FromContext(ctx).AddStructuredWarning(metadata.UnitMismatchWarning(expr.Op, left, right))
+	}
+
 	var lse, rse StepEvaluator
 
 	ctx, cancel := context.WithCancelCause(ctx)
@@ -854,59 +1793,102 @@ func newBinOpStepEvaluator(
 	}
 
 	return &BinOpStepEvaluator{
-		rse:  rse,
-		lse:  lse,
-		expr: expr,
+		rse:        rse,
+		lse:        lse,
+		expr:       expr,
+		transforms: opts.transforms,
+		legs:       opts.legs,
+		divByZero:  opts.divByZero,
 	}, nil
 }
 
 type BinOpStepEvaluator struct {
-	rse     StepEvaluator
-	lse     StepEvaluator
-	expr    *syntax.BinOpExpr
-	lastErr error
+	rse        StepEvaluator
+	lse        StepEvaluator
+	expr       *syntax.BinOpExpr
+	transforms []LabelTransform
+	legs       chan struct{}
+	divByZero  string
+	lastErr    error
+}
+
+// stepOutput is the output of a call to StepEvaluator.Next.
+type stepOutput struct {
+	next bool
+	ts   int64
+	r    StepResult
+}
+
+// nextLegs steps both legs, concurrently if a slot is free.
+func (e *BinOpStepEvaluator) nextLegs() (l, r stepOutput) {
+	select {
+	case e.legs <- struct{}{}:
+	default:
+		r.next, r.ts, r.r = e.rse.Next()
+		// These should _always_ happen at the same step on each evaluator.
+		if r.next {
+			l.next, l.ts, l.r = e.lse.Next()
+		}
+		return l, r
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer func() {
+			<-e.legs
+			wg.Done()
+		}()
+		r.next, r.ts, r.r = e.rse.Next()
+	}()
+	l.next, l.ts, l.r = e.lse.Next()
+	wg.Wait()
+	return l, r
 }
 
 func (e *BinOpStepEvaluator) Next() (bool, int64, StepResult) {
-	var (
-		ts       int64
-		next     bool
-		lhs, rhs promql.Vector
-		r        StepResult
-	)
-	next, ts, r = e.rse.Next()
-	// These should _always_ happen at the same step on each evaluator.
-	if !next {
-		return next, ts, nil
+	l, r := e.nextLegs()
+	if !r.next {
+		return false, r.ts, nil
 	}
-	rhs = r.SampleVector()
+	rhs := r.r.SampleVector()
 	// build matching signature for each sample in right vector
 	rsigs := make([]uint64, len(rhs))
 	for i, sample := range rhs {
+		sample.Metric = applyLabelTransforms(e.transforms, BinOpSideRight, sample.Metric)
 		rsigs[i] = matchingSignature(sample, e.expr.Opts)
 	}
 
-	next, ts, r = e.lse.Next()
-	if !next {
-		return next, ts, nil
+	if !l.next {
+		return false, l.ts, nil
 	}
-	lhs = r.SampleVector()
+	ts := l.ts
+	lhs := l.r.SampleVector()
 	// build matching signature for each sample in left vector
 	lsigs := make([]uint64, len(lhs))
 	for i, sample := range lhs {
+		sample.Metric = applyLabelTransforms(e.transforms, BinOpSideLeft, sample.Metric)
 		lsigs[i] = matchingSignature(sample, e.expr.Opts)
 	}
 
 	var results promql.Vector
 	switch e.expr.Op {
 	case syntax.OpTypeAnd:
+		if e.expr.Opts != nil && e.expr.Opts.ReturnBool {
+			results = vectorSetBool(lhs, lsigs, rsigs, true)
+			break
+		}
 		results = vectorAnd(lhs, rhs, lsigs, rsigs)
 	case syntax.OpTypeOr:
 		results = vectorOr(lhs, rhs, lsigs, rsigs)
 	case syntax.OpTypeUnless:
+		if e.expr.Opts != nil && e.expr.Opts.ReturnBool {
+			results = vectorSetBool(lhs, lsigs, rsigs, false)
+			break
+		}
 		results = vectorUnless(lhs, rhs, lsigs, rsigs)
 	default:
-		results, e.lastErr = vectorBinop(e.expr.Op, e.expr.Opts, lhs, rhs, lsigs, rsigs)
+		results, e.lastErr = vectorBinop(e.expr.Op, e.expr.Opts, lhs, rhs, lsigs, rsigs, e.divByZero)
 	}
 	return true, ts, SampleVector(results)
 }
@@ -950,7 +1932,7 @@ func matchingSignature(sample promql.Sample, opts *syntax.BinOpOptions) uint64 {
 	return labels.StableHash(labels.NewBuilder(sample.Metric).Del(opts.VectorMatching.MatchingLabels...).Labels())
 }
 
-func vectorBinop(op string, opts *syntax.BinOpOptions, lhs, rhs promql.Vector, lsigs, rsigs []uint64) (promql.Vector, error) {
+func vectorBinop(op string, opts *syntax.BinOpOptions, lhs, rhs promql.Vector, lsigs, rsigs []uint64, divByZero string) (promql.Vector, error) {
 	// handle one-to-one or many-to-one matching
 	// for one-to-many, swap
 	if opts != nil && opts.VectorMatching.Card == syntax.CardOneToMany {
@@ -1015,6 +1997,14 @@ func vectorBinop(op string, opts *syntax.BinOpOptions, lhs, rhs promql.Vector, l
 				ls, rs = rs, ls
 			}
 		}
+		if op == syntax.OpTypeDiv && rs.F == 0 {
+			res := *ls
+			res.Metric = metric
+			if res, ok := divideByZero(divByZero, res); ok {
+				results = append(results, res)
+			}
+			continue
+		}
 		merged, err := syntax.MergeBinOp(op, ls, rs, false, filter, syntax.IsComparisonOperator(op))
 		if err != nil {
 			return nil, err
@@ -1047,6 +2037,26 @@ func vectorAnd(lhs, rhs promql.Vector, lsigs, rsigs []uint64) promql.Vector {
 	return results
 }
 
+// vectorSetBool returns the samples of lhs with a value of 1 if their
+// membership in rhs is the one given, i.e. `and bool` if member is true and
+// `unless bool` otherwise, and 0 if not.
+func vectorSetBool(lhs promql.Vector, lsigs, rsigs []uint64, member bool) promql.Vector {
+	rightSigs := make(map[uint64]struct{}, len(rsigs))
+	for _, sig := range rsigs {
+		rightSigs[sig] = struct{}{}
+	}
+
+	results := make(promql.Vector, 0, len(lhs))
+	for i, ls := range lhs {
+		ls.F = 0
+		if _, ok := rightSigs[lsigs[i]]; ok == member {
+			ls.F = 1
+		}
+		results = append(results, ls)
+	}
+	return results
+}
+
 func vectorOr(lhs, rhs promql.Vector, lsigs, rsigs []uint64) promql.Vector {
 	if len(lhs) == 0 {
 		return rhs
@@ -1131,6 +2141,7 @@ func newLiteralStepEvaluator(
 	nextEv StepEvaluator,
 	inverted bool,
 	returnBool bool,
+	divByZero string,
 ) (*LiteralStepEvaluator, error) {
 	val, err := lit.Value()
 	if err != nil {
@@ -1143,16 +2154,21 @@ func newLiteralStepEvaluator(
 		inverted:   inverted,
 		op:         op,
 		returnBool: returnBool,
+		divByZero:  divByZero,
 	}, nil
 }
 
 type LiteralStepEvaluator struct {
-	nextEv     StepEvaluator
+	nextEv StepEvaluator
+	// scalarEv evaluates the scalar() leg the value is read from at each
+	// step, if the value is not a literal.
+	scalarEv   StepEvaluator
 	mergeErr   error
 	val        float64
 	inverted   bool
 	op         string
 	returnBool bool
+	divByZero  string
 }
 
 func (e *LiteralStepEvaluator) Next() (bool, int64, StepResult) {
@@ -1160,6 +2176,15 @@ func (e *LiteralStepEvaluator) Next() (bool, int64, StepResult) {
 	if !ok {
 		return ok, ts, r
 	}
+	if e.scalarEv != nil {
+		// both legs are evaluated at the same steps, and scalar() returns a
+		// single sample per step.
+		next, _, sr := e.scalarEv.Next()
+		if !next || len(sr.SampleVector()) != 1 {
+			return false, 0, nil
+		}
+		e.val = sr.SampleVector()[0].F
+	}
 	vec := r.SampleVector()
 	results := make(promql.Vector, 0, len(vec))
 	for _, sample := range vec {
@@ -1174,6 +2199,14 @@ func (e *LiteralStepEvaluator) Next() (bool, int64, StepResult) {
 		if e.inverted {
 			left, right = right, left
 		}
+		if e.op == syntax.OpTypeDiv && right.F == 0 {
+			res := sample
+			res.F = left.F
+			if res, ok := divideByZero(e.divByZero, res); ok {
+				results = append(results, res)
+			}
+			continue
+		}
 		merged, err := syntax.MergeBinOp(
 			e.op,
 			left,
@@ -1194,17 +2227,35 @@ func (e *LiteralStepEvaluator) Next() (bool, int64, StepResult) {
 	return ok, ts, SampleVector(results)
 }
 
-func (e *LiteralStepEvaluator) Close() error {
-	return e.nextEv.Close()
+func (e *LiteralStepEvaluator) Close() (lastError error) {
+	for _, ev := range []StepEvaluator{e.nextEv, e.scalarEv} {
+		if ev == nil {
+			continue
+		}
+		if err := ev.Close(); err != nil {
+			lastError = err
+		}
+	}
+	return lastError
 }
 
 func (e *LiteralStepEvaluator) Error() error {
 	if e.mergeErr != nil {
 		return e.mergeErr
 	}
+	if e.scalarEv != nil && e.scalarEv.Error() != nil {
+		return e.scalarEv.Error()
+	}
 	return e.nextEv.Error()
 }
 
+// isScalarExpr tells whether expr is a scalar() expression not converted back
+// to a vector.
+func isScalarExpr(expr syntax.SampleExpr) bool {
+	s, ok := expr.(*syntax.ScalarExpr)
+	return ok && !s.Vector
+}
+
 // VectorIterator return simple vector like (1).
 type VectorIterator struct {
 	stepMs, endMs, currentMs int64
@@ -1314,35 +2365,334 @@ func (e *LabelReplaceEvaluator) Error() error {
 	return e.nextEvaluator.Error()
 }
 
-// This is to replace missing timeseries during absent_over_time aggregation.
-func absentLabels(expr syntax.SampleExpr) (labels.Labels, error) {
-	m := labels.Labels{}
-
-	selector, err := expr.Selector()
+func newLabelDropRegexEvaluator(
+	ctx context.Context,
+	evFactory SampleEvaluatorFactory,
+	expr *syntax.LabelDropRegexExpr,
+	q Params,
+) (*LabelDropRegexEvaluator, error) {
+	nextEvaluator, err := evFactory.NewStepEvaluator(ctx, evFactory, expr.Left, q)
 	if err != nil {
-		return labels.EmptyLabels(), err
+		return nil, err
 	}
-	lm := selector.Matchers()
-	if len(lm) == 0 {
-		return m, nil
+
+	return &LabelDropRegexEvaluator{
+		nextEvaluator: nextEvaluator,
+		expr:          expr,
+		buf:           make([]byte, 0, 1024),
+	}, nil
+}
+
+// LabelDropRegexEvaluator removes the labels whose names match the regex of
+// its expression from every sample.
+type LabelDropRegexEvaluator struct {
+	nextEvaluator StepEvaluator
+	labelCache    map[uint64]labels.Labels
+	expr          *syntax.LabelDropRegexExpr
+	buf           []byte
+}
+
+func (e *LabelDropRegexEvaluator) Next() (bool, int64, StepResult) {
+	next, ts, r := e.nextEvaluator.Next()
+	if !next {
+		return false, 0, SampleVector{}
+	}
+	vec := r.SampleVector()
+	if e.labelCache == nil {
+		e.labelCache = make(map[uint64]labels.Labels, len(vec))
 	}
+	var hash uint64
+	for i, s := range vec {
+		hash, e.buf = s.Metric.HashWithoutLabels(e.buf)
+		if lbs, ok := e.labelCache[hash]; ok {
+			vec[i].Metric = lbs
+			continue
+		}
+		lb := labels.NewBuilder(s.Metric)
+		s.Metric.Range(func(l labels.Label) {
+			if e.expr.Re.MatchString(l.Name) {
+				lb.Del(l.Name)
+			}
+		})
+		outLbs := lb.Labels()
+		e.labelCache[hash] = outLbs
+		vec[i].Metric = outLbs
+	}
+	return next, ts, SampleVector(vec)
+}
+
+func (e *LabelDropRegexEvaluator) Close() error {
+	return e.nextEvaluator.Close()
+}
+
+func (e *LabelDropRegexEvaluator) Error() error {
+	return e.nextEvaluator.Error()
+}
 
-	empty := []string{}
-	for _, ma := range lm {
-		if ma.Name == labels.MetricName {
+func newLabelModeEvaluator(
+	ctx context.Context,
+	evFactory SampleEvaluatorFactory,
+	expr *syntax.LabelModeExpr,
+	q Params,
+) (*LabelModeEvaluator, error) {
+	nextEvaluator, err := evFactory.NewStepEvaluator(ctx, evFactory, expr.Left, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LabelModeEvaluator{
+		nextEvaluator: nextEvaluator,
+		expr:          expr,
+	}, nil
+}
+
+// LabelModeEvaluator reduces every step to a single sample labeled with the
+// value of the label of its expression held by the most series, counting
+// them. Ties are broken by the smallest value and series without the label
+// are ignored.
+type LabelModeEvaluator struct {
+	nextEvaluator StepEvaluator
+	expr          *syntax.LabelModeExpr
+}
+
+func (e *LabelModeEvaluator) Next() (bool, int64, StepResult) {
+	next, ts, r := e.nextEvaluator.Next()
+	if !next {
+		return false, 0, SampleVector{}
+	}
+	counts := map[string]int{}
+	var mode string
+	for _, s := range r.SampleVector() {
+		v := s.Metric.Get(e.expr.Label)
+		if v == "" {
 			continue
 		}
-		if ma.Type == labels.MatchEqual && !m.Has(ma.Name) {
-			m = labels.NewBuilder(m).Set(ma.Name, ma.Value).Labels()
-		} else {
-			empty = append(empty, ma.Name)
+		counts[v]++
+		if counts[v] > counts[mode] || (counts[v] == counts[mode] && v < mode) {
+			mode = v
 		}
 	}
+	if mode == "" {
+		return next, ts, SampleVector{}
+	}
+	return next, ts, SampleVector{{
+		Metric: labels.FromStrings(e.expr.Label, mode),
+		T:      ts,
+		F:      float64(counts[mode]),
+	}}
+}
+
+func (e *LabelModeEvaluator) Close() error {
+	return e.nextEvaluator.Close()
+}
+
+func (e *LabelModeEvaluator) Error() error {
+	return e.nextEvaluator.Error()
+}
+
+func newRoundEvaluator(
+	ctx context.Context,
+	evFactory SampleEvaluatorFactory,
+	expr *syntax.RoundExpr,
+	q Params,
+) (*RoundEvaluator, error) {
+	nextEvaluator, err := evFactory.NewStepEvaluator(ctx, evFactory, expr.Left, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RoundEvaluator{
+		nextEvaluator: nextEvaluator,
+		expr:          expr,
+	}, nil
+}
+
+// RoundEvaluator rounds every sample to the nearest multiple of the step of
+// its expression.
+type RoundEvaluator struct {
+	nextEvaluator StepEvaluator
+	expr          *syntax.RoundExpr
+}
 
-	for _, v := range empty {
-		m = labels.NewBuilder(m).Del(v).Labels()
+func (e *RoundEvaluator) Next() (bool, int64, StepResult) {
+	next, ts, r := e.nextEvaluator.Next()
+	if !next {
+		return false, 0, SampleVector{}
 	}
-	return m, nil
+	vec := r.SampleVector()
+	for i := range vec {
+		vec[i].F = round(vec[i].F, e.expr.ToNearest)
+	}
+	return next, ts, SampleVector(vec)
+}
+
+func (e *RoundEvaluator) Close() error {
+	return e.nextEvaluator.Close()
+}
+
+func (e *RoundEvaluator) Error() error {
+	return e.nextEvaluator.Error()
+}
+
+// round rounds v to the nearest multiple of toNearest, ties rounding up, the
+// same way as the Prometheus round function.
+func round(v, toNearest float64) float64 {
+	// dividing by the inverse is more precise than multiplying by toNearest,
+	// e.g. for 0.1.
+	toNearestInverse := 1.0 / toNearest
+	return math.Floor(v*toNearestInverse+0.5) / toNearestInverse
+}
+
+func newAbsentEvaluator(
+	ctx context.Context,
+	evFactory SampleEvaluatorFactory,
+	expr *syntax.AbsentExpr,
+	q Params,
+) (*AbsentEvaluator, error) {
+	nextEvaluator, err := evFactory.NewStepEvaluator(ctx, evFactory, expr.Left, q)
+	if err != nil {
+		return nil, err
+	}
+	return &AbsentEvaluator{
+		nextEvaluator: nextEvaluator,
+		lbs:           expr.Labels,
+	}, nil
+}
+
+// AbsentEvaluator returns a single sample of value 1 at the steps its inner
+// evaluator returns no sample at.
+type AbsentEvaluator struct {
+	nextEvaluator StepEvaluator
+	lbs           labels.Labels
+}
+
+func (e *AbsentEvaluator) Next() (bool, int64, StepResult) {
+	next, ts, r := e.nextEvaluator.Next()
+	if !next {
+		return false, 0, SampleVector{}
+	}
+	if len(r.SampleVector()) > 0 {
+		return next, ts, SampleVector{}
+	}
+	return next, ts, SampleVector{{T: ts, F: 1, Metric: e.lbs}}
+}
+
+func (e *AbsentEvaluator) Close() error {
+	return e.nextEvaluator.Close()
+}
+
+func (e *AbsentEvaluator) Error() error {
+	return e.nextEvaluator.Error()
+}
+
+func newScalarEvaluator(
+	ctx context.Context,
+	evFactory SampleEvaluatorFactory,
+	expr *syntax.ScalarExpr,
+	q Params,
+) (*ScalarEvaluator, error) {
+	nextEvaluator, err := evFactory.NewStepEvaluator(ctx, evFactory, expr.Left, q)
+	if err != nil {
+		return nil, err
+	}
+	return &ScalarEvaluator{nextEvaluator: nextEvaluator}, nil
+}
+
+// ScalarEvaluator returns a single sample without labels per step, with the
+// value of the only sample its inner evaluator returns at the step, or NaN
+// when it returns none or more than one, like the Prometheus scalar function.
+type ScalarEvaluator struct {
+	nextEvaluator StepEvaluator
+}
+
+func (e *ScalarEvaluator) Next() (bool, int64, StepResult) {
+	next, ts, r := e.nextEvaluator.Next()
+	if !next {
+		return false, 0, SampleVector{}
+	}
+	v := math.NaN()
+	if vec := r.SampleVector(); len(vec) == 1 {
+		v = vec[0].F
+	}
+	return next, ts, SampleVector{{T: ts, F: v, Metric: labels.EmptyLabels()}}
+}
+
+func (e *ScalarEvaluator) Close() error {
+	return e.nextEvaluator.Close()
+}
+
+func (e *ScalarEvaluator) Error() error {
+	return e.nextEvaluator.Error()
+}
+
+func newMetricLabelFmtEvaluator(
+	ctx context.Context,
+	evFactory SampleEvaluatorFactory,
+	expr *syntax.MetricLabelFmtExpr,
+	q Params,
+) (*MetricLabelFmtEvaluator, error) {
+	formatter, err := log.NewLabelsFormatter(expr.Fmt.Formats)
+	if err != nil {
+		return nil, err
+	}
+	nextEvaluator, err := evFactory.NewStepEvaluator(ctx, evFactory, expr.Left, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetricLabelFmtEvaluator{
+		nextEvaluator: nextEvaluator,
+		expr:          expr,
+		formatter:     formatter,
+		builder:       log.NewBaseLabelsBuilder(),
+		buf:           make([]byte, 0, 1024),
+	}, nil
+}
+
+// MetricLabelFmtEvaluator formats the labels of every series with the
+// label_format stage of its expression. The templates see the labels of the
+// series only, without a log line and timestamp.
+type MetricLabelFmtEvaluator struct {
+	nextEvaluator StepEvaluator
+	labelCache    map[uint64]labels.Labels
+	expr          *syntax.MetricLabelFmtExpr
+	formatter     *log.LabelsFormatter
+	builder       *log.BaseLabelsBuilder
+	buf           []byte
+}
+
+func (e *MetricLabelFmtEvaluator) Next() (bool, int64, StepResult) {
+	next, ts, r := e.nextEvaluator.Next()
+	if !next {
+		return false, 0, SampleVector{}
+	}
+	vec := r.SampleVector()
+	if e.labelCache == nil {
+		e.labelCache = make(map[uint64]labels.Labels, len(vec))
+	}
+	var hash uint64
+	for i, s := range vec {
+		hash, e.buf = s.Metric.HashWithoutLabels(e.buf)
+		if lbs, ok := e.labelCache[hash]; ok {
+			vec[i].Metric = lbs
+			continue
+		}
+		lb := e.builder.ForLabels(s.Metric, hash)
+		lb.Reset()
+		e.formatter.Process(0, nil, lb)
+		outLbs := lb.LabelsResult().Labels()
+		e.labelCache[hash] = outLbs
+		vec[i].Metric = outLbs
+	}
+	return next, ts, SampleVector(vec)
+}
+
+func (e *MetricLabelFmtEvaluator) Close() error {
+	return e.nextEvaluator.Close()
+}
+
+func (e *MetricLabelFmtEvaluator) Error() error {
+	return e.nextEvaluator.Error()
 }
 
 type VariantEvaluatorFactory interface {
@@ -1368,18 +2718,21 @@ func (ev *DefaultEvaluator) NewVariantsStepEvaluator(
 	expr syntax.VariantsExpr,
 	q Params,
 ) (StepEvaluator, error) {
+	estimateEvaluatorNode(ctx)
 	switch e := expr.(type) {
 	case *syntax.MultiVariantExpr:
 		logRange := e.LogRange()
+		bounds := anchoredParams(q, logRange)
+		lookback, offset := variantsLookback(e)
 
 		// We don't have the benefit of sending the vector expression to the source for reducing labels
 		// Since multiple samples are allowed, and they may not share the same labels to reduce by
-		it, err := ev.querier.SelectSamples(ctx, SelectSampleParams{
+		it, err := ev.selectSamples(ctx, SelectSampleParams{
 			&logproto.SampleQueryRequest{
-				// extend startTs backwards by step
-				Start: q.Start().Add(-logRange.Interval).Add(-logRange.Offset),
+				// extend startTs backwards by the longest range of the variants
+				Start: bounds.Start().Add(-lookback),
 				// add leap nanosecond to endTs to include lines exactly at endTs. range iterators work on start exclusive, end inclusive ranges
-				End:      q.End().Add(-logRange.Offset).Add(time.Nanosecond),
+				End:      bounds.End().Add(-offset).Add(time.Nanosecond),
 				Selector: expr.String(),
 				Shards:   q.Shards(),
 				Plan: &plan.QueryPlan{
@@ -1391,14 +2744,33 @@ func (ev *DefaultEvaluator) NewVariantsStepEvaluator(
 		if err != nil {
 			return nil, err
 		}
-		return ev.newVariantsEvaluator(ctx, iter.NewPeekingSampleIterator(it), e, q)
+		return ev.newVariantsEvaluator(ctx, iter.NewPeekingSampleIterator(estimateSamples(ctx, it)), e, q)
 	default:
 		return nil, EvaluatorUnsupportedType(e, ev)
 	}
 }
 
+// variantsLookback returns how far before the start of the query the samples
+// of the variants are selected from, the longest range plus offset of the
+// variants and of the log range they are selected from, and the shortest
+// offset, so that each variant can use its own range.
+func variantsLookback(e *syntax.MultiVariantExpr) (lookback, offset time.Duration) {
+	logRange := e.LogRange()
+	lookback, offset = logRange.Interval+logRange.Offset, logRange.Offset
+	for _, v := range e.Variants() {
+		v.Walk(func(e syntax.Expr) bool {
+			if r, ok := e.(*syntax.LogRangeExpr); ok {
+				lookback = max(lookback, r.Interval+r.Offset)
+				offset = min(offset, r.Offset)
+			}
+			return true
+		})
+	}
+	return lookback, offset
+}
+
 func (ev *DefaultEvaluator) newVariantsEvaluator(
-	_ context.Context,
+	ctx context.Context,
 	it iter.PeekingSampleIterator,
 	expr *syntax.MultiVariantExpr,
 	q Params,
@@ -1429,7 +2801,7 @@ func (ev *DefaultEvaluator) newVariantsEvaluator(
 			switch e := variant.(type) {
 			case *syntax.VectorAggregationExpr:
 				if rangExpr, ok := e.Left.(*syntax.RangeAggregationExpr); ok {
-					rangeEvaluator, err := newRangeAggEvaluator(iter.NewPeekingSampleIterator(variantIterator), rangExpr, q, rangExpr.Left.Offset)
+					rangeEvaluator, err := newRangeAggEvaluator(ctx, iter.NewPeekingSampleIterator(variantIterator), rangExpr, q, rangExpr.Left.Offset, ev.rangeOpts)
 					if err != nil {
 						return nil, err
 					}
@@ -1447,7 +2819,7 @@ func (ev *DefaultEvaluator) newVariantsEvaluator(
 					return nil, fmt.Errorf("expected range aggregation expression but got %T", e.Left)
 				}
 			case *syntax.RangeAggregationExpr:
-				variantEvaluator, err = newRangeAggEvaluator(iter.NewPeekingSampleIterator(variantIterator), e, q, e.Left.Offset)
+				variantEvaluator, err = newRangeAggEvaluator(ctx, iter.NewPeekingSampleIterator(variantIterator), e, q, e.Left.Offset, ev.rangeOpts)
 			}
 
 			if err != nil {
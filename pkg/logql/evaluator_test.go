@@ -1,6 +1,7 @@
 package logql
 
 import (
+	"context"
 	"math"
 	"testing"
 	"time"
@@ -386,3 +387,68 @@ func newReturnVectorEvaluator(vec []float64) *returnVectorEvaluator {
 		vec: pvec,
 	}
 }
+
+func TestVectorAggEvaluator_NormalizesGroupingLabels(t *testing.T) {
+	for _, tc := range []struct {
+		qs       string
+		expected promql.Vector
+	}{
+		{
+			qs: `sum by (app) (count_over_time({app=~".+"}[1m]))`,
+			expected: promql.Vector{
+				{F: 3, Metric: labels.FromStrings("app", "foo")},
+				{F: 4, Metric: labels.FromStrings("app", "bar")},
+			},
+		},
+		{
+			qs: `sum by (extra, app, app) (count_over_time({app=~".+"}[1m]))`,
+			expected: promql.Vector{
+				{F: 3, Metric: labels.FromStrings("app", "foo")},
+				{F: 4, Metric: labels.FromStrings("app", "bar")},
+			},
+		},
+		{
+			qs: `sum without (pod) (count_over_time({app=~".+"}[1m]))`,
+			expected: promql.Vector{
+				{F: 3, Metric: labels.FromStrings("app", "foo")},
+				{F: 4, Metric: labels.FromStrings("app", "bar")},
+			},
+		},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			expr, err := syntax.ParseSampleExpr(tc.qs)
+			require.NoError(t, err)
+			input := SampleVector{
+				{F: 1, Metric: labels.FromStrings("app", "foo", "extra", "")},
+				{F: 2, Metric: labels.FromStrings("app", "foo")},
+				{F: 4, Metric: labels.FromStrings("app", "bar", "extra", "")},
+			}
+			factory := SampleEvaluatorFunc(func(_ context.Context, _ SampleEvaluatorFactory, _ syntax.SampleExpr, _ Params) (StepEvaluator, error) {
+				return &mockStepEvaluator{results: []StepResult{input}, t: t}, nil
+			})
+			ev, err := newVectorAggEvaluator(context.Background(), factory, expr.(*syntax.VectorAggregationExpr), nil, 0)
+			require.NoError(t, err)
+
+			ok, _, r := ev.Next()
+			require.True(t, ok)
+			require.ElementsMatch(t, tc.expected, []promql.Sample(r.SampleVector()))
+		})
+	}
+}
+
+func Test_round(t *testing.T) {
+	for _, tc := range []struct {
+		v, toNearest, want float64
+	}{
+		{0.46666, 0.01, 0.47},
+		{2.5, 1, 3},
+		{-2.5, 1, -2},
+		{-2.6, 1, -3},
+		{17, 5, 15},
+		{18, 5, 20},
+		{0.12, 0.1, 0.1},
+	} {
+		require.Equal(t, tc.want, round(tc.v, tc.toNearest), "round(%v, %v)", tc.v, tc.toNearest)
+	}
+	require.True(t, math.IsNaN(round(math.NaN(), 1)))
+}
@@ -7,6 +7,9 @@ const MaxChildrenDisplay = 3
 func (e *LiteralStepEvaluator) Explain(parent Node) {
 	b := parent.Child("Literal")
 	e.nextEv.Explain(b)
+	if e.scalarEv != nil {
+		e.scalarEv.Explain(b)
+	}
 }
 
 func (e *LabelReplaceEvaluator) Explain(parent Node) {
@@ -14,6 +17,41 @@ func (e *LabelReplaceEvaluator) Explain(parent Node) {
 	e.nextEvaluator.Explain(b)
 }
 
+func (e *HistogramQuantileEvaluator) Explain(parent Node) {
+	b := parent.Childf("%v HistogramQuantile", e.expr.Quantile)
+	e.nextEvaluator.Explain(b)
+}
+
+func (e *LabelDropRegexEvaluator) Explain(parent Node) {
+	b := parent.Childf("%s LabelDropRegex", e.expr.Regex)
+	e.nextEvaluator.Explain(b)
+}
+
+func (e *LabelModeEvaluator) Explain(parent Node) {
+	b := parent.Childf("%s LabelMode", e.expr.Label)
+	e.nextEvaluator.Explain(b)
+}
+
+func (e *RoundEvaluator) Explain(parent Node) {
+	b := parent.Childf("%v Round", e.expr.ToNearest)
+	e.nextEvaluator.Explain(b)
+}
+
+func (e *AbsentEvaluator) Explain(parent Node) {
+	b := parent.Child("Absent")
+	e.nextEvaluator.Explain(b)
+}
+
+func (e *ScalarEvaluator) Explain(parent Node) {
+	b := parent.Child("Scalar")
+	e.nextEvaluator.Explain(b)
+}
+
+func (e *MetricLabelFmtEvaluator) Explain(parent Node) {
+	b := parent.Child("LabelFormat")
+	e.nextEvaluator.Explain(b)
+}
+
 func (e *VectorAggEvaluator) Explain(parent Node) {
 	b := parent.Childf("[%s, %s] VectorAgg", e.expr.Operation, e.expr.Grouping)
 	e.nextEvaluator.Explain(b)
@@ -44,6 +82,16 @@ func (r *RangeVectorEvaluator) Explain(parent Node) {
 	parent.Child("RangeVectorAgg")
 }
 
+func (e *AtModifierEvaluator) Explain(parent Node) {
+	b := parent.Child("AtModifier")
+	e.nextEvaluator.Explain(b)
+}
+
+func (e *DefaultFillEvaluator) Explain(parent Node) {
+	b := parent.Child("DefaultFill")
+	e.nextEvaluator.Explain(b)
+}
+
 func (e *AbsentRangeVectorEvaluator) Explain(parent Node) {
 	parent.Child("Absent RangeVectorAgg")
 }
@@ -0,0 +1,194 @@
+package logql
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+)
+
+// BucketLabel is the label carrying the upper bound of a histogram bucket.
+const BucketLabel = "le"
+
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+type buckets []bucket
+
+func (b buckets) Len() int           { return len(b) }
+func (b buckets) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b buckets) Less(i, j int) bool { return b[i].upperBound < b[j].upperBound }
+
+// bucketQuantile calculates the quantile 'q' based on the given buckets,
+// following the semantics of the Prometheus `histogram_quantile` function.
+// The buckets are cumulative and sorted in place by their upper bound.
+//
+// If q<0, -Inf is returned and if q>1, +Inf is returned.
+// If there is no bucket with an upper bound of +Inf, or if there are fewer
+// than two buckets, NaN is returned.
+// If the highest bucket with an upper bound other than +Inf is the bucket
+// the quantile falls into, its upper bound is returned.
+func bucketQuantile(q float64, b buckets) float64 {
+	if math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(+1)
+	}
+	sort.Sort(b)
+	if len(b) == 0 || !math.IsInf(b[len(b)-1].upperBound, +1) {
+		return math.NaN()
+	}
+
+	b = coalesceBuckets(b)
+	ensureMonotonic(b)
+
+	if len(b) < 2 {
+		return math.NaN()
+	}
+	observations := b[len(b)-1].count
+	if observations == 0 {
+		return math.NaN()
+	}
+	rank := q * observations
+	i := sort.Search(len(b)-1, func(i int) bool { return b[i].count >= rank })
+
+	if i == len(b)-1 {
+		return b[len(b)-2].upperBound
+	}
+	if i == 0 && b[0].upperBound <= 0 {
+		return b[0].upperBound
+	}
+	var (
+		bucketStart float64
+		bucketEnd   = b[i].upperBound
+		count       = b[i].count
+	)
+	if i > 0 {
+		bucketStart = b[i-1].upperBound
+		count -= b[i-1].count
+		rank -= b[i-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+// coalesceBuckets merges buckets with the same upper bound.
+// The input buckets must be sorted.
+func coalesceBuckets(b buckets) buckets {
+	last := b[0]
+	i := 0
+	for _, cur := range b[1:] {
+		if cur.upperBound == last.upperBound {
+			last.count += cur.count
+		} else {
+			b[i] = last
+			last = cur
+			i++
+		}
+	}
+	b[i] = last
+	return b[:i+1]
+}
+
+// ensureMonotonic makes sure bucket counts never decrease, which can happen
+// when the buckets are scraped or computed at slightly different times.
+func ensureMonotonic(b buckets) {
+	maxCount := math.Inf(-1)
+	for i := range b {
+		switch {
+		case b[i].count > maxCount:
+			maxCount = b[i].count
+		case b[i].count < maxCount:
+			b[i].count = maxCount
+		}
+	}
+}
+
+func newHistogramQuantileEvaluator(
+	ctx context.Context,
+	evFactory SampleEvaluatorFactory,
+	expr *syntax.HistogramQuantileExpr,
+	q Params,
+) (*HistogramQuantileEvaluator, error) {
+	nextEvaluator, err := evFactory.NewStepEvaluator(ctx, evFactory, expr.Left, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HistogramQuantileEvaluator{
+		nextEvaluator: nextEvaluator,
+		expr:          expr,
+		buf:           make([]byte, 0, 1024),
+	}, nil
+}
+
+// HistogramQuantileEvaluator groups the samples of each step by their labels
+// without the `le` label and computes the requested quantile of every group.
+// Samples without a valid `le` label are ignored.
+type HistogramQuantileEvaluator struct {
+	nextEvaluator StepEvaluator
+	expr          *syntax.HistogramQuantileExpr
+	buf           []byte
+}
+
+type histogramGroup struct {
+	labels  labels.Labels
+	buckets buckets
+}
+
+func (e *HistogramQuantileEvaluator) Next() (bool, int64, StepResult) {
+	next, ts, r := e.nextEvaluator.Next()
+	if !next {
+		return false, 0, SampleVector{}
+	}
+	vec := r.SampleVector()
+
+	groups := map[uint64]*histogramGroup{}
+	order := make([]uint64, 0, len(vec))
+	for _, s := range vec {
+		upperBound, err := strconv.ParseFloat(s.Metric.Get(BucketLabel), 64)
+		if err != nil {
+			continue
+		}
+		var hash uint64
+		hash, e.buf = s.Metric.HashWithoutLabels(e.buf, BucketLabel)
+		group, ok := groups[hash]
+		if !ok {
+			group = &histogramGroup{
+				labels: labels.NewBuilder(s.Metric).Del(BucketLabel).Labels(),
+			}
+			groups[hash] = group
+			order = append(order, hash)
+		}
+		group.buckets = append(group.buckets, bucket{upperBound: upperBound, count: s.F})
+	}
+
+	result := make(promql.Vector, 0, len(groups))
+	for _, hash := range order {
+		group := groups[hash]
+		result = append(result, promql.Sample{
+			T:      ts,
+			F:      bucketQuantile(e.expr.Quantile, group.buckets),
+			Metric: group.labels,
+		})
+	}
+	return next, ts, SampleVector(result)
+}
+
+func (e *HistogramQuantileEvaluator) Close() error {
+	return e.nextEvaluator.Close()
+}
+
+func (e *HistogramQuantileEvaluator) Error() error {
+	return e.nextEvaluator.Error()
+}
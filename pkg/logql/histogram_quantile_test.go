@@ -0,0 +1,156 @@
+package logql
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+func TestBucketQuantile(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		q        float64
+		buckets  buckets
+		expected float64
+	}{
+		{
+			name:     "interpolates within bucket",
+			q:        0.5,
+			buckets:  buckets{{0.1, 1}, {0.5, 3}, {1, 8}, {math.Inf(1), 10}},
+			expected: 0.7,
+		},
+		{
+			name:     "unsorted buckets",
+			q:        0.5,
+			buckets:  buckets{{math.Inf(1), 10}, {1, 8}, {0.1, 1}, {0.5, 3}},
+			expected: 0.7,
+		},
+		{
+			name:     "falls into +Inf bucket",
+			q:        0.99,
+			buckets:  buckets{{0.1, 1}, {0.5, 3}, {1, 8}, {math.Inf(1), 10}},
+			expected: 1,
+		},
+		{
+			name:     "missing +Inf bucket",
+			q:        0.5,
+			buckets:  buckets{{0.1, 1}, {0.5, 3}, {1, 8}},
+			expected: math.NaN(),
+		},
+		{
+			name:     "single bucket",
+			q:        0.5,
+			buckets:  buckets{{math.Inf(1), 10}},
+			expected: math.NaN(),
+		},
+		{
+			name:     "no observations",
+			q:        0.5,
+			buckets:  buckets{{1, 0}, {math.Inf(1), 0}},
+			expected: math.NaN(),
+		},
+		{
+			name:     "non monotonic counts",
+			q:        0.5,
+			buckets:  buckets{{0.1, 1}, {0.5, 3}, {1, 2}, {math.Inf(1), 6}},
+			expected: 0.5,
+		},
+		{
+			name:     "negative quantile",
+			q:        -1,
+			buckets:  buckets{{1, 8}, {math.Inf(1), 10}},
+			expected: math.Inf(-1),
+		},
+		{
+			name:     "quantile above one",
+			q:        2,
+			buckets:  buckets{{1, 8}, {math.Inf(1), 10}},
+			expected: math.Inf(1),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := bucketQuantile(tc.q, tc.buckets)
+			if math.IsNaN(tc.expected) {
+				require.True(t, math.IsNaN(actual), "expected NaN, got %f", actual)
+				return
+			}
+			require.InDelta(t, tc.expected, actual, 1e-9)
+		})
+	}
+}
+
+func TestEngine_HistogramQuantile_InstantQuery(t *testing.T) {
+	const (
+		qs       = `histogram_quantile(0.9, sum by (le) (rate({app="foo"} | unwrap count [5m])))`
+		selector = `sum by (le) (rate({app="foo"} | unwrap count [5m]))`
+	)
+	ts := time.Unix(5*60, 0)
+
+	// Each series yields 30 samples in the 5m window, so the rate is value/10.
+	bucketSeries := func(le string, value int64) logproto.Series {
+		return newSeries(testSize, factor(10, constantValue(value)), `{app="foo", le="`+le+`"}`)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		series   []logproto.Series
+		expected float64
+	}{
+		{
+			name: "buckets with +Inf",
+			// cumulative rates: 0.1 => 2, 0.5 => 10, 1 => 20, +Inf => 20
+			series: []logproto.Series{
+				bucketSeries("0.1", 20),
+				bucketSeries("0.5", 100),
+				bucketSeries("1", 200),
+				bucketSeries("+Inf", 200),
+			},
+			// rank 18 falls into the (0.5, 1] bucket: 0.5 + 0.5 * (18-10)/(20-10)
+			expected: 0.9,
+		},
+		{
+			name: "missing +Inf bucket",
+			series: []logproto.Series{
+				bucketSeries("0.1", 20),
+				bucketSeries("0.5", 100),
+				bucketSeries("1", 200),
+			},
+			expected: math.NaN(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			querier := newQuerierRecorder(t,
+				[][]logproto.Series{tc.series},
+				[]SelectSampleParams{
+					{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: selector}},
+				},
+			)
+			eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+
+			params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+
+			vec, ok := res.Data.(promql.Vector)
+			require.True(t, ok)
+			require.Len(t, vec, 1)
+			require.Equal(t, ts.UnixMilli(), vec[0].T)
+			require.Equal(t, labels.EmptyLabels(), vec[0].Metric)
+			if math.IsNaN(tc.expected) {
+				require.True(t, math.IsNaN(vec[0].F), "expected NaN, got %f", vec[0].F)
+				return
+			}
+			require.InDelta(t, tc.expected, vec[0].F, 1e-9)
+		})
+	}
+}
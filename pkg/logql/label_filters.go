@@ -0,0 +1,54 @@
+package logql
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/loki/v3/pkg/logql/log"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+)
+
+// LabelFilters returns the label equality filters of the pipeline of a
+// count_over_time request, optionally wrapped in a sum, that all lines it
+// counts pass, so that queriers can pre-filter lines by them. Each filter
+// holds for the labels at its position in the pipeline. Filters combined
+// with other filters, non-equality filters and requests unwrapping labels are
+// not pushed down, and the pipeline of the request still applies all filters.
+func (s SelectSampleParams) LabelFilters() []*labels.Matcher {
+	expr, err := s.Expr()
+	if err != nil {
+		return nil
+	}
+	var r *syntax.RangeAggregationExpr
+	switch e := expr.(type) {
+	case *syntax.RangeAggregationExpr:
+		r = e
+	case *syntax.VectorAggregationExpr:
+		r, _ = e.Left.(*syntax.RangeAggregationExpr)
+	}
+	if r == nil || r.Operation != syntax.OpRangeTypeCount || r.Left.Unwrap != nil {
+		return nil
+	}
+	p, ok := r.Left.Left.(*syntax.PipelineExpr)
+	if !ok {
+		return nil
+	}
+
+	var filters []*labels.Matcher
+	for _, stage := range p.MultiStages {
+		f, ok := stage.(*syntax.LabelFilterExpr)
+		if !ok {
+			continue
+		}
+		var m *labels.Matcher
+		switch lf := f.LabelFilterer.(type) {
+		case *log.StringLabelFilter:
+			m = lf.Matcher
+		case *log.LineFilterLabelFilter:
+			m = lf.Matcher
+		}
+		if m != nil && m.Type == labels.MatchEqual {
+			filters = append(filters, m)
+		}
+	}
+	return filters
+}
@@ -0,0 +1,171 @@
+package logql
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	promql_parser "github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/grafana/loki/v3/pkg/logqlmodel"
+)
+
+// Policies for the labels of results exceeding the maximum label name or
+// value length.
+const (
+	// LabelLengthTruncate truncates the name or value to the maximum length.
+	LabelLengthTruncate = "truncate"
+	// LabelLengthDrop drops the label.
+	LabelLengthDrop = "drop"
+)
+
+// ValidateLabelLengthPolicy returns an error if policy is not a known policy
+// for the labels exceeding the maximum lengths. The empty policy truncates.
+func ValidateLabelLengthPolicy(policy string) error {
+	switch policy {
+	case "", LabelLengthTruncate, LabelLengthDrop:
+		return nil
+	default:
+		return fmt.Errorf("invalid label length policy %q, must be one of %q or %q", policy, LabelLengthTruncate, LabelLengthDrop)
+	}
+}
+
+// labelLengthLimiter enforces the maximum label name and value lengths on the
+// series and streams of a result. Streams whose labels only differ after the
+// maximum lengths are merged, series fail the query.
+type labelLengthLimiter struct {
+	maxName, maxValue int
+	drop              bool
+	// direction is the order of the entries of merged streams.
+	direction logproto.Direction
+	// limited counts the labels truncated or dropped so far.
+	limited int
+}
+
+func (l *labelLengthLimiter) apply(data promql_parser.Value) (promql_parser.Value, error) {
+	switch v := data.(type) {
+	case promql.Vector:
+		seen := make(map[uint64]struct{}, len(v))
+		for i := range v {
+			v[i].Metric = l.limit(v[i].Metric)
+			if err := checkLimitedLabels(seen, v[i].Metric); err != nil {
+				return nil, err
+			}
+		}
+	case promql.Matrix:
+		seen := make(map[uint64]struct{}, len(v))
+		for i := range v {
+			v[i].Metric = l.limit(v[i].Metric)
+			if err := checkLimitedLabels(seen, v[i].Metric); err != nil {
+				return nil, err
+			}
+		}
+	case logqlmodel.Streams:
+		merged := false
+		for i := range v {
+			lbs, err := syntax.ParseLabels(v[i].Labels)
+			if err != nil {
+				continue
+			}
+			if limited := l.limit(lbs); !labels.Equal(limited, lbs) {
+				v[i].Labels = limited.String()
+				merged = true
+			}
+		}
+		if merged {
+			return l.mergeStreams(v), nil
+		}
+	}
+	return data, nil
+}
+
+// checkLimitedLabels fails when the limited labels lbs of a series are the
+// ones of a series seen before.
+func checkLimitedLabels(seen map[uint64]struct{}, lbs labels.Labels) error {
+	h := lbs.Hash()
+	if _, ok := seen[h]; ok {
+		return logqlmodel.NewLabelLengthLimitError(lbs.String())
+	}
+	seen[h] = struct{}{}
+	return nil
+}
+
+// mergeStreams merges the streams with the same labels, keeping the entries
+// ordered in the direction of the query.
+func (l *labelLengthLimiter) mergeStreams(streams logqlmodel.Streams) logqlmodel.Streams {
+	byLabels := make(map[string]int, len(streams))
+	result := streams[:0]
+	for _, s := range streams {
+		i, ok := byLabels[s.Labels]
+		if !ok {
+			byLabels[s.Labels] = len(result)
+			result = append(result, s)
+			continue
+		}
+		entries := append(result[i].Entries, s.Entries...)
+		sort.SliceStable(entries, func(a, b int) bool {
+			if l.direction == logproto.BACKWARD {
+				return entries[a].Timestamp.After(entries[b].Timestamp)
+			}
+			return entries[a].Timestamp.Before(entries[b].Timestamp)
+		})
+		result[i].Entries = entries
+	}
+	return result
+}
+
+// limit returns lbs with the labels exceeding the maximum lengths truncated or
+// dropped. A label whose truncated name is the name of another label is
+// dropped.
+func (l *labelLengthLimiter) limit(lbs labels.Labels) labels.Labels {
+	exceeds := false
+	lbs.Range(func(lbl labels.Label) {
+		exceeds = exceeds || l.exceeds(lbl.Name, l.maxName) || l.exceeds(lbl.Value, l.maxValue)
+	})
+	if !exceeds {
+		return lbs
+	}
+
+	b := labels.NewBuilder(lbs)
+	lbs.Range(func(lbl labels.Label) {
+		nameExceeds, valueExceeds := l.exceeds(lbl.Name, l.maxName), l.exceeds(lbl.Value, l.maxValue)
+		if !nameExceeds && !valueExceeds {
+			return
+		}
+		l.limited++
+		b.Del(lbl.Name)
+		if l.drop {
+			return
+		}
+		name, value := lbl.Name, lbl.Value
+		if nameExceeds {
+			if name = truncateUTF8(name, l.maxName); lbs.Has(name) {
+				return
+			}
+		}
+		if valueExceeds {
+			value = truncateUTF8(value, l.maxValue)
+		}
+		b.Set(name, value)
+	})
+	return b.Labels()
+}
+
+func (l *labelLengthLimiter) exceeds(s string, limit int) bool {
+	return limit > 0 && len(s) > limit
+}
+
+// truncateUTF8 truncates s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,74 @@
+package logql
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// BinOpSide is a side of a binary operation.
+type BinOpSide string
+
+const (
+	BinOpSideLeft  BinOpSide = "left"
+	BinOpSideRight BinOpSide = "right"
+)
+
+// LabelTransform derives a label from another label of the series of one side
+// of a binary operation before they are matched with the other side, the way
+// label_replace does. It lets series whose labels only differ by a pattern,
+// e.g. a suffix, be matched. The labels of the result are left untouched.
+type LabelTransform struct {
+	Side        BinOpSide
+	Src, Dst    string
+	Replacement string
+	re          *regexp.Regexp
+}
+
+// NewLabelTransform returns a transform setting dst to the expansion of
+// replacement when the value of src matches the anchored regex.
+func NewLabelTransform(side BinOpSide, src, dst, regex, replacement string) (LabelTransform, error) {
+	if side != BinOpSideLeft && side != BinOpSideRight {
+		return LabelTransform{}, fmt.Errorf("invalid binary operation side %q, must be %q or %q", side, BinOpSideLeft, BinOpSideRight)
+	}
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return LabelTransform{}, fmt.Errorf("invalid label transform regex %q: %w", regex, err)
+	}
+	return LabelTransform{
+		Side:        side,
+		Src:         src,
+		Dst:         dst,
+		Replacement: replacement,
+		re:          re,
+	}, nil
+}
+
+// applyLabelTransforms returns the labels transformed by every transform of the given side.
+func applyLabelTransforms(transforms []LabelTransform, side BinOpSide, lbs labels.Labels) labels.Labels {
+	var lb *labels.Builder
+	for _, t := range transforms {
+		if t.Side != side {
+			continue
+		}
+		if lb == nil {
+			lb = labels.NewBuilder(lbs)
+		}
+		src := lb.Get(t.Src)
+		indexes := t.re.FindStringSubmatchIndex(src)
+		if indexes == nil {
+			// If there is no match, no replacement should take place.
+			continue
+		}
+		res := t.re.ExpandString([]byte{}, t.Replacement, src, indexes)
+		lb.Del(t.Dst)
+		if len(res) > 0 {
+			lb.Set(t.Dst, string(res))
+		}
+	}
+	if lb == nil {
+		return lbs
+	}
+	return lb.Labels()
+}
@@ -21,6 +21,9 @@ type Limits interface {
 	QueryTimeout(context.Context, string) time.Duration
 	BlockedQueries(context.Context, string) []*validation.BlockedQuery
 	EnableMultiVariantQueries(string) bool
+	MinStep(userID string) time.Duration
+	JSONSchemas(userID string) map[string]string
+	MaxDistinctValues(userID string) int
 }
 
 type fakeLimits struct {
@@ -30,6 +33,9 @@ type fakeLimits struct {
 	rangeLimit              time.Duration
 	requiredLabels          []string
 	multiVariantQueryEnable bool
+	minStep                 time.Duration
+	jsonSchemas             map[string]string
+	maxDistinctValues       int
 }
 
 func (f fakeLimits) MaxQuerySeries(_ context.Context, _ string) int {
@@ -55,3 +61,15 @@ func (f fakeLimits) RequiredLabels(_ context.Context, _ string) []string {
 func (f fakeLimits) EnableMultiVariantQueries(_ string) bool {
 	return f.multiVariantQueryEnable
 }
+
+func (f fakeLimits) MinStep(_ string) time.Duration {
+	return f.minStep
+}
+
+func (f fakeLimits) JSONSchemas(_ string) map[string]string {
+	return f.jsonSchemas
+}
+
+func (f fakeLimits) MaxDistinctValues(_ string) int {
+	return f.maxDistinctValues
+}
@@ -7,4 +7,5 @@ var (
 	errSampleExtraction = "SampleExtractionErr"
 	errLabelFilter      = "LabelFilterErr"
 	errTemplateFormat   = "TemplateFormatErr"
+	errJSONSchema       = "JSONSchemaValidationErr"
 )
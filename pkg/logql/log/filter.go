@@ -624,6 +624,20 @@ func NewFilter(match string, mt LineMatchType) (Filterer, error) {
 	}
 }
 
+// NewSubstringMatcher creates a Matcher for a line filter that matches
+// substrings of a line, i.e. `|=` and `|~`. Unlike NewFilter, regexps are
+// not simplified so that a Checker sees the expression as written.
+func NewSubstringMatcher(match string, mt LineMatchType) (Matcher, error) {
+	switch mt {
+	case LineMatchRegexp:
+		return newRegexpFilter(match, match, true)
+	case LineMatchEqual:
+		return newContainsFilter([]byte(match), false), nil
+	default:
+		return nil, fmt.Errorf("line filter %s does not match substrings", mt)
+	}
+}
+
 // NewLabelFilter creates a new filter that has label regex semantics
 func NewLabelFilter(match string, mt labels.MatchType) (Filterer, error) {
 	switch mt {
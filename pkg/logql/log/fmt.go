@@ -19,6 +19,8 @@ import (
 const (
 	functionLineName      = "__line__"
 	functionTimestampName = "__timestamp__"
+	// functionDropName drops the line being formatted by line_format.
+	functionDropName = "__drop__"
 )
 
 var (
@@ -195,6 +197,7 @@ type LineFormatter struct {
 	currentLine []byte
 	currentTs   int64
 	simpleKey   string
+	drop        bool
 }
 
 // NewFormatter creates a new log line formatter from a given text template.
@@ -208,6 +211,10 @@ func NewFormatter(tmpl string) (*LineFormatter, error) {
 	}, func() int64 {
 		return lf.currentTs
 	})
+	functions[functionDropName] = func() string {
+		lf.drop = true
+		return ""
+	}
 
 	t, err := template.New("line").Option("missingkey=zero").Funcs(functions).Parse(tmpl)
 	if err != nil {
@@ -241,6 +248,7 @@ func (lf *LineFormatter) Process(ts int64, line []byte, lbs *LabelsBuilder) ([]b
 	lf.buf.Reset()
 	lf.currentLine = line
 	lf.currentTs = ts
+	lf.drop = false
 
 	// map now is taking from a pool
 	m, ret := lbs.Map()
@@ -254,6 +262,9 @@ func (lf *LineFormatter) Process(ts int64, line []byte, lbs *LabelsBuilder) ([]b
 		lbs.SetErrorDetails(err.Error())
 		return line, true
 	}
+	if lf.drop {
+		return nil, false
+	}
 	return lf.buf.Bytes(), true
 }
 
@@ -518,6 +518,28 @@ func Test_lineFormatter_Format(t *testing.T) {
 	}
 }
 
+func Test_lineFormatter_Drop(t *testing.T) {
+	fmter := newMustLineFormatter(`{{ if eq .level "debug" }}{{ __drop__ }}{{ else }}{{ .level }}: {{ __line__ }}{{ end }}`)
+
+	for _, tt := range []struct {
+		level  string
+		want   []byte
+		wantOk bool
+	}{
+		{"debug", nil, false},
+		{"info", []byte("info: hello"), true},
+		{"debug", nil, false},
+		{"error", []byte("error: hello"), true},
+	} {
+		lbs := labels.FromStrings("level", tt.level)
+		builder := NewBaseLabelsBuilder().ForLabels(lbs, labels.StableHash(lbs))
+		builder.Reset()
+		outLine, ok := fmter.Process(0, []byte("hello"), builder)
+		require.Equal(t, tt.wantOk, ok)
+		require.Equal(t, tt.want, outLine)
+	}
+}
+
 func newMustLineFormatter(tmpl string) *LineFormatter {
 	l, err := NewFormatter(tmpl)
 	if err != nil {
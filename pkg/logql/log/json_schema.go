@@ -0,0 +1,62 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	openapi "github.com/go-openapi/validate"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var jsonSchemaViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "loki",
+	Name:      "logql_json_schema_violations_total",
+	Help:      "Total number of log lines that failed the validation of a json_schema stage.",
+}, []string{"schema"})
+
+// JSONSchemaValidator validates log lines against a JSON schema. Lines that
+// are not valid JSON or violate the schema are labeled with an error and
+// counted as violations of the schema.
+type JSONSchemaValidator struct {
+	validator  *openapi.SchemaValidator
+	violations prometheus.Counter
+}
+
+// NewJSONSchemaValidator creates a new JSONSchemaValidator validating lines
+// against the named JSON schema.
+func NewJSONSchemaValidator(name, schema string) (v *JSONSchemaValidator, err error) {
+	var s spec.Schema
+	if err := s.UnmarshalJSON([]byte(schema)); err != nil {
+		return nil, fmt.Errorf("invalid json schema %q: %w", name, err)
+	}
+	// the validator panics on schemas with references it can't expand.
+	defer func() {
+		if r := recover(); r != nil {
+			v, err = nil, fmt.Errorf("invalid json schema %q: %v", name, r)
+		}
+	}()
+	return &JSONSchemaValidator{
+		validator:  openapi.NewSchemaValidator(&s, nil, "", strfmt.Default),
+		violations: jsonSchemaViolations.WithLabelValues(name),
+	}, nil
+}
+
+func (j *JSONSchemaValidator) Process(_ int64, line []byte, lbs *LabelsBuilder) ([]byte, bool) {
+	var data interface{}
+	if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(line, &data); err != nil {
+		j.violations.Inc()
+		addErrLabel(errJSONSchema, err, lbs)
+		return line, true
+	}
+	if res := j.validator.Validate(data); res.HasErrors() {
+		j.violations.Inc()
+		addErrLabel(errJSONSchema, errors.Join(res.Errors...), lbs)
+	}
+	return line, true
+}
+
+func (j *JSONSchemaValidator) RequiredLabelNames() []string { return []string{} }
@@ -0,0 +1,61 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+const testAccessLogSchema = `{
+	"type": "object",
+	"required": ["status", "path"],
+	"properties": {
+		"status": {"type": "integer"},
+		"path": {"type": "string"}
+	}
+}`
+
+func Test_JSONSchemaValidator(t *testing.T) {
+	v, err := NewJSONSchemaValidator("access_log", testAccessLogSchema)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		line    string
+		wantErr bool
+	}{
+		{"conforming", `{"status": 200, "path": "/api"}`, false},
+		{"conforming with extra fields", `{"status": 404, "path": "/", "user": "me"}`, false},
+		{"missing field", `{"status": 200}`, true},
+		{"wrong type", `{"status": "ok", "path": "/api"}`, true},
+		{"not json", `level=info msg="hello"`, true},
+	}
+
+	violations := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lbs := labels.FromStrings("app", "foo")
+			b := NewBaseLabelsBuilder().ForLabels(lbs, labels.StableHash(lbs))
+
+			line, ok := v.Process(0, []byte(tt.line), b)
+			require.True(t, ok)
+			require.Equal(t, tt.line, string(line))
+
+			if !tt.wantErr {
+				require.False(t, b.HasErr())
+				return
+			}
+			violations++
+			require.Equal(t, errJSONSchema, b.GetErr())
+			require.NotEmpty(t, b.GetErrorDetails())
+		})
+	}
+	require.Equal(t, float64(violations), testutil.ToFloat64(jsonSchemaViolations.WithLabelValues("access_log")))
+}
+
+func Test_JSONSchemaValidator_InvalidSchema(t *testing.T) {
+	_, err := NewJSONSchemaValidator("broken", `{"type": `)
+	require.Error(t, err)
+}
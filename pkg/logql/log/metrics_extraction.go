@@ -1,11 +1,13 @@
 package log
 
 import (
+	"bytes"
 	"context"
 	"sort"
 	"strconv"
 	"time"
 
+	"github.com/grafana/regexp"
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/model/labels"
 
@@ -26,6 +28,84 @@ var (
 	BytesExtractor LineExtractor = func(line []byte) float64 { return float64(len(line)) }
 )
 
+// NewMatchedBytesExtractor returns a LineExtractor summing the byte length of
+// all substrings of a line matched by the given matchers. Bytes matched by
+// more than one matcher are counted once.
+func NewMatchedBytesExtractor(matchers []Matcher) LineExtractor {
+	return func(line []byte) float64 {
+		c := matchPositions{line: line}
+		for _, m := range matchers {
+			m.Matches(&c)
+		}
+		return float64(c.size())
+	}
+}
+
+// matchPositions is a Checker recording the positions of all matches within a
+// line.
+type matchPositions struct {
+	line      []byte
+	lowerLine []byte
+	positions [][2]int
+}
+
+func (c *matchPositions) Test(match []byte, caseInsensitive bool, equal bool) bool {
+	if len(match) == 0 {
+		return true
+	}
+	line := c.line
+	if caseInsensitive {
+		// the match of case insensitive filters is already lower cased.
+		if c.lowerLine == nil {
+			c.lowerLine = bytes.ToLower(c.line)
+		}
+		line = c.lowerLine
+	}
+	if equal {
+		if !bytes.Equal(line, match) {
+			return false
+		}
+		c.positions = append(c.positions, [2]int{0, len(line)})
+		return true
+	}
+	found := false
+	for offset := 0; offset < len(line); {
+		i := bytes.Index(line[offset:], match)
+		if i < 0 {
+			break
+		}
+		start := offset + i
+		offset = start + len(match)
+		c.positions = append(c.positions, [2]int{start, offset})
+		found = true
+	}
+	return found
+}
+
+func (c *matchPositions) TestRegex(reg *regexp.Regexp) bool {
+	locs := reg.FindAllIndex(c.line, -1)
+	for _, loc := range locs {
+		c.positions = append(c.positions, [2]int{loc[0], loc[1]})
+	}
+	return len(locs) > 0
+}
+
+// size returns the number of bytes covered by the recorded positions.
+func (c *matchPositions) size() int {
+	sort.Slice(c.positions, func(i, j int) bool { return c.positions[i][0] < c.positions[j][0] })
+	var total, end int
+	for _, p := range c.positions {
+		if p[0] < end {
+			p[0] = end
+		}
+		if p[1] > p[0] {
+			total += p[1] - p[0]
+			end = p[1]
+		}
+	}
+	return total
+}
+
 // SampleExtractor creates StreamSampleExtractor that can extract samples for a given log stream.
 type SampleExtractor interface {
 	ForStream(labels labels.Labels) StreamSampleExtractor
@@ -129,12 +209,36 @@ func (l *streamLineSampleExtractor) BaseLabels() LabelsResult { return l.builder
 
 type convertionFn func(value string) (float64, error)
 
+type arithmeticFn func(lhs, rhs float64) (float64, error)
+
+var errDivisionByZero = errors.New("division by zero")
+
+var arithmeticFns = map[string]arithmeticFn{
+	"+": func(lhs, rhs float64) (float64, error) { return lhs + rhs, nil },
+	"-": func(lhs, rhs float64) (float64, error) { return lhs - rhs, nil },
+	"*": func(lhs, rhs float64) (float64, error) { return lhs * rhs, nil },
+	"/": func(lhs, rhs float64) (float64, error) {
+		if rhs == 0 {
+			return 0, errDivisionByZero
+		}
+		return lhs / rhs, nil
+	},
+}
+
 type labelSampleExtractor struct {
 	preStage     Stage
 	postFilter   Stage
 	labelName    string
 	conversionFn convertionFn
 
+	// rhsLabelName is the label the value of labelName is combined with by
+	// arithmeticFn, if set.
+	rhsLabelName string
+	arithmeticFn arithmeticFn
+
+	// defaultValue, if set, is extracted from lines without the label.
+	defaultValue *float64
+
 	baseBuilder      *BaseLabelsBuilder
 	streamExtractors map[uint64]StreamSampleExtractor
 }
@@ -148,32 +252,91 @@ func LabelExtractorWithStages(
 	preStages []Stage,
 	postFilter Stage,
 ) (SampleExtractor, error) {
-	var convFn convertionFn
+	convFn, err := conversionFn(conversion)
+	if err != nil {
+		return nil, err
+	}
+	return newLabelSampleExtractor(labelName, convFn, "", nil, groups, without, noLabels, preStages, postFilter), nil
+}
+
+// LabelExtractorWithDefault creates a SampleExtractor like
+// LabelExtractorWithStages that extracts the default value from lines without
+// the label instead of skipping them.
+func LabelExtractorWithDefault(
+	labelName, conversion string, defaultValue float64,
+	groups []string, without, noLabels bool,
+	preStages []Stage,
+	postFilter Stage,
+) (SampleExtractor, error) {
+	convFn, err := conversionFn(conversion)
+	if err != nil {
+		return nil, err
+	}
+	e := newLabelSampleExtractor(labelName, convFn, "", nil, groups, without, noLabels, preStages, postFilter)
+	e.defaultValue = &defaultValue
+	return e, nil
+}
+
+func conversionFn(conversion string) (convertionFn, error) {
 	switch conversion {
 	case ConvertBytes:
-		convFn = convertBytes
+		return convertBytes, nil
 	case ConvertDuration:
-		convFn = convertDuration
+		return convertDuration, nil
 	case ConvertFloat:
-		convFn = convertFloat
-	default:
-		return nil, errors.Errorf("unsupported conversion operation %s", conversion)
+		return convertFloat, nil
+	}
+	return nil, errors.Errorf("unsupported conversion operation %s", conversion)
+}
+
+// LabelArithmeticExtractorWithStages creates a SampleExtractor that extracts
+// the result of an arithmetic operation (+, -, * or /) between the float values
+// of two labels. Samples missing either label are skipped, and a division by
+// zero sets the __error__ label of the sample like a failed conversion does.
+func LabelArithmeticExtractorWithStages(
+	lhs, op, rhs string,
+	groups []string, without, noLabels bool,
+	preStages []Stage,
+	postFilter Stage,
+) (SampleExtractor, error) {
+	fn, ok := arithmeticFns[op]
+	if !ok {
+		return nil, errors.Errorf("unsupported arithmetic operation %s", op)
 	}
+	return newLabelSampleExtractor(lhs, convertFloat, rhs, fn, groups, without, noLabels, preStages, postFilter), nil
+}
+
+func newLabelSampleExtractor(
+	labelName string, convFn convertionFn,
+	rhsLabelName string, arithFn arithmeticFn,
+	groups []string, without, noLabels bool,
+	preStages []Stage,
+	postFilter Stage,
+) *labelSampleExtractor {
 	if len(groups) == 0 || without {
 		without = true
 		groups = append(groups, labelName)
+		if rhsLabelName != "" {
+			groups = append(groups, rhsLabelName)
+		}
 		sort.Strings(groups)
 	}
 	preStage := ReduceStages(preStages)
-	hints := NewParserHint(append(preStage.RequiredLabelNames(), postFilter.RequiredLabelNames()...), groups, without, noLabels, labelName, append(preStages, postFilter))
+	required := append(preStage.RequiredLabelNames(), postFilter.RequiredLabelNames()...)
+	if rhsLabelName != "" {
+		required = append(required, rhsLabelName)
+	}
+	hints := NewParserHint(required, groups, without, noLabels, labelName, append(preStages, postFilter))
 	return &labelSampleExtractor{
 		preStage:         preStage,
 		conversionFn:     convFn,
 		labelName:        labelName,
+		rhsLabelName:     rhsLabelName,
+		arithmeticFn:     arithFn,
 		postFilter:       postFilter,
 		baseBuilder:      NewBaseLabelsBuilderWithGrouping(groups, hints, without, noLabels),
 		streamExtractors: make(map[uint64]StreamSampleExtractor),
-	}, nil
+	}
 }
 
 type streamLabelSampleExtractor struct {
@@ -210,14 +373,28 @@ func (l *streamLabelSampleExtractor) Process(ts int64, line []byte, structuredMe
 	// convert the label value.
 	var v float64
 	stringValue, _ := l.builder.Get(l.labelName)
-	if stringValue == "" {
+	if stringValue == "" && l.defaultValue == nil {
 		// NOTE: It's totally fine for log line to not have this particular label.
 		// See Issue: https://github.com/grafana/loki/issues/6713
 		return nil, false
 	}
 
 	var err error
-	v, err = l.conversionFn(stringValue)
+	if stringValue == "" {
+		v = *l.defaultValue
+	} else {
+		v, err = l.conversionFn(stringValue)
+	}
+	if err == nil && l.arithmeticFn != nil {
+		rhsValue, _ := l.builder.Get(l.rhsLabelName)
+		if rhsValue == "" {
+			return nil, false
+		}
+		var rhs float64
+		if rhs, err = l.conversionFn(rhsValue); err == nil {
+			v, err = l.arithmeticFn(v, rhs)
+		}
+	}
 	if err != nil {
 		l.builder.SetErr(errSampleExtraction)
 		l.builder.SetErrorDetails(err.Error())
@@ -7,6 +7,8 @@ import (
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/v3/pkg/logqlmodel"
 )
 
 func Test_labelSampleExtractor_Extract(t *testing.T) {
@@ -344,6 +346,47 @@ func TestLabelExtractorWithStages(t *testing.T) {
 	}
 }
 
+func TestLabelArithmeticExtractorWithStages(t *testing.T) {
+	ex := mustSampleExtractor(LabelArithmeticExtractorWithStages("bytes_sent", "/", "duration", nil, false, false, []Stage{NewLogfmtParser(false, false)}, NoopStage))
+	stream := ex.ForStream(labels.FromStrings("app", "foo"))
+
+	samples, ok := stream.ProcessString(0, "bytes_sent=1000 duration=4 path=/", labels.EmptyLabels())
+	require.True(t, ok)
+	require.Len(t, samples, 1)
+	require.Equal(t, 250., samples[0].Value)
+	require.Equal(t, labels.FromStrings("app", "foo", "path", "/"), samples[0].Labels.Labels())
+
+	// a missing label skips the line.
+	_, ok = stream.ProcessString(0, "bytes_sent=1000", labels.EmptyLabels())
+	require.False(t, ok)
+
+	samples, ok = stream.ProcessString(0, "bytes_sent=1000 duration=0", labels.EmptyLabels())
+	require.True(t, ok)
+	require.Equal(t, labels.FromStrings("app", "foo", "bytes_sent", "1000", "duration", "0", logqlmodel.ErrorLabel, errSampleExtraction, logqlmodel.ErrorDetailsLabel, "division by zero"), samples[0].Labels.Labels())
+
+	_, err := LabelArithmeticExtractorWithStages("a", "%", "b", nil, false, false, nil, NoopStage)
+	require.Error(t, err)
+}
+
+func TestLabelExtractorWithDefault(t *testing.T) {
+	ex := mustSampleExtractor(LabelExtractorWithDefault("latency", ConvertFloat, 0, nil, false, false, []Stage{NewLogfmtParser(false, false)}, NoopStage))
+	stream := ex.ForStream(labels.FromStrings("app", "foo"))
+
+	samples, ok := stream.ProcessString(0, "latency=4 path=/", labels.EmptyLabels())
+	require.True(t, ok)
+	require.Equal(t, 4., samples[0].Value)
+	require.Equal(t, labels.FromStrings("app", "foo", "path", "/"), samples[0].Labels.Labels())
+
+	// a missing label extracts the default.
+	samples, ok = stream.ProcessString(0, "path=/", labels.EmptyLabels())
+	require.True(t, ok)
+	require.Equal(t, 0., samples[0].Value)
+	require.Equal(t, labels.FromStrings("app", "foo", "path", "/"), samples[0].Labels.Labels())
+
+	_, err := LabelExtractorWithDefault("latency", "seconds", 0, nil, false, false, nil, NoopStage)
+	require.Error(t, err)
+}
+
 func mustSampleExtractor(ex SampleExtractor, err error) SampleExtractor {
 	if err != nil {
 		panic(err)
@@ -388,6 +431,35 @@ func TestNewLineSampleExtractor(t *testing.T) {
 	require.False(t, ok)
 }
 
+func TestMatchedBytesExtractor(t *testing.T) {
+	token, err := NewSubstringMatcher("token", LineMatchEqual)
+	require.NoError(t, err)
+	tokRegexp, err := NewSubstringMatcher("tok[a-z]*", LineMatchRegexp)
+	require.NoError(t, err)
+	ken, err := NewSubstringMatcher("ken", LineMatchEqual)
+	require.NoError(t, err)
+	_, err = NewSubstringMatcher("token", LineMatchNotEqual)
+	require.Error(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		matchers []Matcher
+		line     string
+		expected float64
+	}{
+		{"no match", []Matcher{token}, "nothing here", 0},
+		{"single match", []Matcher{token}, "a token here", 5},
+		{"several matches", []Matcher{token}, "token token tokentoken", 20},
+		{"regexp matches of varying size", []Matcher{tokRegexp}, "tokenizer tokens tok", 18},
+		{"overlapping matches are counted once", []Matcher{token, ken}, "token broken", 8},
+		{"no matchers", nil, "token", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, NewMatchedBytesExtractor(tc.matchers)([]byte(tc.line)))
+		})
+	}
+}
+
 func TestNewLineSampleExtractorWithStructuredMetadata(t *testing.T) {
 	lbs := labels.FromStrings("foo", "bar")
 	structuredMetadata := labels.FromStrings("user", "bob")
@@ -1,9 +1,16 @@
 package logql
 
 import (
+	"math"
+	"sort"
+	"strconv"
 	"time"
 
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
+
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/grafana/loki/v3/pkg/util/constants"
 )
 
 // MatrixStepEvaluator exposes a promql.Matrix as a StepEvaluator.
@@ -61,3 +68,331 @@ func (m *MatrixStepEvaluator) Next() (bool, int64, StepResult) {
 func (m *MatrixStepEvaluator) Close() error { return nil }
 
 func (m *MatrixStepEvaluator) Error() error { return nil }
+
+// Hold fills the empty steps of each series of the matrix with the previous
+// point of the series, for up to hold after that point and up to end.
+func Hold(m promql.Matrix, hold, step time.Duration, end time.Time) promql.Matrix {
+	holdMs, stepMs, endMs := hold.Milliseconds(), step.Milliseconds(), end.UnixMilli()
+	if holdMs <= 0 || stepMs <= 0 {
+		return m
+	}
+	for i, series := range m {
+		floats := make([]promql.FPoint, 0, len(series.Floats))
+		for j, p := range series.Floats {
+			floats = append(floats, p)
+			next := endMs + 1
+			if j+1 < len(series.Floats) {
+				next = series.Floats[j+1].T
+			}
+			for ts := p.T + stepMs; ts < next && ts-p.T <= holdMs; ts += stepMs {
+				floats = append(floats, promql.FPoint{T: ts, F: p.F})
+			}
+		}
+		m[i].Floats = floats
+	}
+	return m
+}
+
+// Interpolate fills the points of each series of a matrix evaluated at factor
+// times the step by linearly interpolating between its adjacent points, and
+// drops the points after end. Gaps of the series are not filled.
+func Interpolate(m promql.Matrix, factor int, step time.Duration, end int64) promql.Matrix {
+	stepMs := step.Milliseconds()
+	coarseMs := stepMs * int64(factor)
+	result := m[:0]
+	for _, series := range m {
+		floats := make([]promql.FPoint, 0, len(series.Floats)*factor)
+		for j, p := range series.Floats {
+			if p.T > end {
+				break
+			}
+			floats = append(floats, p)
+			if j+1 == len(series.Floats) || series.Floats[j+1].T-p.T != coarseMs {
+				continue
+			}
+			next := series.Floats[j+1]
+			for k := 1; k < factor && p.T+int64(k)*stepMs <= end; k++ {
+				floats = append(floats, promql.FPoint{
+					T: p.T + int64(k)*stepMs,
+					F: p.F + (next.F-p.F)*float64(k)/float64(factor),
+				})
+			}
+		}
+		if len(floats) == 0 {
+			continue
+		}
+		result = append(result, promql.Series{Metric: series.Metric, Floats: floats})
+	}
+	return result
+}
+
+// StepDelta returns the matrix with each point replaced by its difference
+// with the previous point of its series. The first point of each series has
+// no previous point and is dropped, as are series left without points.
+func StepDelta(m promql.Matrix) promql.Matrix {
+	result := make(promql.Matrix, 0, len(m))
+	for _, series := range m {
+		if len(series.Floats) < 2 {
+			continue
+		}
+		floats := make([]promql.FPoint, 0, len(series.Floats)-1)
+		for i := 1; i < len(series.Floats); i++ {
+			floats = append(floats, promql.FPoint{
+				T: series.Floats[i].T,
+				F: series.Floats[i].F - series.Floats[i-1].F,
+			})
+		}
+		result = append(result, promql.Series{Metric: series.Metric, Floats: floats})
+	}
+	return result
+}
+
+// MatrixPoints returns the total number of points of the series of a matrix.
+func MatrixPoints(m promql.Matrix) int {
+	n := 0
+	for _, series := range m {
+		n += len(series.Floats)
+	}
+	return n
+}
+
+// DownsampleMatrix downsamples a range query result evaluated from start at
+// step onto a coarser step, a multiple of step for which the matrix
+// has at most limit points. Only the points at the steps of the coarser step,
+// which are the same for all series, are kept, and series left without points
+// are dropped. It returns the downsampled matrix and the factor step was
+// multiplied by. A limit smaller than the number of series keeps the points
+// at start.
+func DownsampleMatrix(m promql.Matrix, limit int, start time.Time, step time.Duration) (promql.Matrix, int) {
+	startMs, stepMs := start.UnixMilli(), step.Milliseconds()
+	if stepMs <= 0 || MatrixPoints(m) <= limit {
+		return m, 1
+	}
+	var last int64
+	for _, series := range m {
+		if n := len(series.Floats); n > 0 {
+			last = max(last, (series.Floats[n-1].T-startMs)/stepMs)
+		}
+	}
+	keep := func(p promql.FPoint, every int64) bool {
+		return ((p.T-startMs)/stepMs)%every == 0
+	}
+	every := int64(max((MatrixPoints(m)+limit-1)/max(limit, 1), 1))
+	// the series may miss points at some steps, so fewer points than one out
+	// of every can be kept.
+	for ; every <= last; every++ {
+		kept := 0
+		for _, series := range m {
+			for _, p := range series.Floats {
+				if keep(p, every) {
+					kept++
+				}
+			}
+		}
+		if kept <= limit {
+			break
+		}
+	}
+	result := make(promql.Matrix, 0, len(m))
+	for _, series := range m {
+		var floats []promql.FPoint
+		for _, p := range series.Floats {
+			if keep(p, every) {
+				floats = append(floats, p)
+			}
+		}
+		if len(floats) > 0 {
+			result = append(result, promql.Series{Metric: series.Metric, Floats: floats})
+		}
+	}
+	return result, int(every)
+}
+
+// VectorToMatrix returns the vector as a matrix with a single point per
+// series, at the timestamp of its sample. The order of the vector is kept.
+func VectorToMatrix(v promql.Vector) promql.Matrix {
+	result := make(promql.Matrix, 0, len(v))
+	for _, s := range v {
+		series := promql.Series{Metric: s.Metric}
+		if s.H != nil {
+			series.Histograms = []promql.HPoint{{T: s.T, H: s.H}}
+		} else {
+			series.Floats = []promql.FPoint{{T: s.T, F: s.F}}
+		}
+		result = append(result, series)
+	}
+	return result
+}
+
+// SubtractBaseline returns the difference between each point of the matrix
+// and the point of the baseline series with the same labels at the same
+// timestamp. Points without a baseline point, and so series without a
+// baseline series, are dropped. Baseline series without a match are ignored.
+func SubtractBaseline(m, baseline promql.Matrix) promql.Matrix {
+	byLabels := make(map[uint64]map[int64]float64, len(baseline))
+	for _, series := range baseline {
+		points := make(map[int64]float64, len(series.Floats))
+		for _, p := range series.Floats {
+			points[p.T] = p.F
+		}
+		byLabels[series.Metric.Hash()] = points
+	}
+
+	result := make(promql.Matrix, 0, len(m))
+	for _, series := range m {
+		points, ok := byLabels[series.Metric.Hash()]
+		if !ok {
+			continue
+		}
+		floats := make([]promql.FPoint, 0, len(series.Floats))
+		for _, p := range series.Floats {
+			if b, ok := points[p.T]; ok {
+				floats = append(floats, promql.FPoint{T: p.T, F: p.F - b})
+			}
+		}
+		if len(floats) > 0 {
+			result = append(result, promql.Series{Metric: series.Metric, Floats: floats})
+		}
+	}
+	return result
+}
+
+// MergeVariants merges the series of a variants query sharing the same labels
+// apart from the variant label into a single series without it. The points of
+// the merged series at the same timestamp are aggregated with op, one of sum,
+// avg, min, max and count. A non-nil grouping first reduces the labels of the
+// series to the ones it keeps, so the series are merged across variants by
+// them; the variant label is dropped either way.
+func MergeVariants(m promql.Matrix, op string, grouping *syntax.Grouping) promql.Matrix {
+	if grouping != nil {
+		m = groupVariants(m, grouping)
+	}
+	groups := GroupMatrixBy(m, constants.VariantLabel)
+	result := make(promql.Matrix, 0, len(groups))
+	for _, g := range groups {
+		values := map[int64][]float64{}
+		for _, b := range g.Buckets {
+			for _, p := range b.Floats {
+				values[p.T] = append(values[p.T], p.F)
+			}
+		}
+		floats := make([]promql.FPoint, 0, len(values))
+		for t, vs := range values {
+			floats = append(floats, promql.FPoint{T: t, F: mergeValues(vs, op)})
+		}
+		sort.Slice(floats, func(i, j int) bool { return floats[i].T < floats[j].T })
+		result = append(result, promql.Series{Metric: g.Metric, Floats: floats})
+	}
+	return result
+}
+
+// groupVariants returns the series of the matrix with only the labels kept by
+// the grouping.
+func groupVariants(m promql.Matrix, grouping *syntax.Grouping) promql.Matrix {
+	result := make(promql.Matrix, 0, len(m))
+	for _, series := range m {
+		b := labels.NewBuilder(series.Metric)
+		if grouping.Without {
+			b.Del(grouping.Groups...)
+		} else {
+			b.Keep(grouping.Groups...)
+		}
+		result = append(result, promql.Series{Metric: b.Labels(), Floats: series.Floats})
+	}
+	return result
+}
+
+func mergeValues(vs []float64, op string) float64 {
+	switch op {
+	case syntax.OpTypeCount:
+		return float64(len(vs))
+	case syntax.OpTypeMin:
+		m := vs[0]
+		for _, v := range vs[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	case syntax.OpTypeMax:
+		m := vs[0]
+		for _, v := range vs[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	}
+	var sum float64
+	for _, v := range vs {
+		sum += v
+	}
+	if op == syntax.OpTypeAvg {
+		return sum / float64(len(vs))
+	}
+	return sum
+}
+
+// MatrixGroup is a set of series sharing the same labels apart from the
+// grouping label. Each series of the group is a bucket keyed by its value of
+// the grouping label.
+type MatrixGroup struct {
+	Metric  labels.Labels
+	Buckets []MatrixBucket
+}
+
+// MatrixBucket holds the points of a single series of a MatrixGroup.
+type MatrixBucket struct {
+	Value  string
+	Floats []promql.FPoint
+}
+
+// GroupMatrixBy reshapes a flat matrix, e.g. the result of
+// `sum by (app, le) (...)`, into groups nested by the given label.
+// Series are grouped by their labels without the grouping label and each
+// series becomes a bucket of its group. Series without the label end up in a
+// bucket with an empty value.
+//
+// Groups are ordered by their labels. Buckets are ordered by their numeric
+// value when both values are numbers (including +Inf), numbers first, and
+// lexicographically otherwise.
+func GroupMatrixBy(m promql.Matrix, label string) []MatrixGroup {
+	var (
+		groups = make([]MatrixGroup, 0, len(m))
+		index  = make(map[uint64]int, len(m))
+		buf    = make([]byte, 0, 1024)
+		hash   uint64
+	)
+	for _, series := range m {
+		hash, buf = series.Metric.HashWithoutLabels(buf, label)
+		i, ok := index[hash]
+		if !ok {
+			i = len(groups)
+			index[hash] = i
+			groups = append(groups, MatrixGroup{
+				Metric: labels.NewBuilder(series.Metric).Del(label).Labels(),
+			})
+		}
+		groups[i].Buckets = append(groups[i].Buckets, MatrixBucket{
+			Value:  series.Metric.Get(label),
+			Floats: series.Floats,
+		})
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return labels.Compare(groups[i].Metric, groups[j].Metric) < 0 })
+	for _, g := range groups {
+		sort.SliceStable(g.Buckets, func(i, j int) bool { return lessBucketValue(g.Buckets[i].Value, g.Buckets[j].Value) })
+	}
+	return groups
+}
+
+func lessBucketValue(a, b string) bool {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	switch {
+	case errA == nil && errB == nil:
+		return fa < fb
+	case errA == nil:
+		return true
+	case errB == nil:
+		return false
+	default:
+		return a < b
+	}
+}
@@ -1,12 +1,15 @@
 package logql
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
 )
 
 func TestMatrixStepper(t *testing.T) {
@@ -128,3 +131,190 @@ func Test_SingleStepMatrix(t *testing.T) {
 	ok, _, _ = s.Next()
 	require.False(t, ok)
 }
+
+func TestGroupMatrixBy(t *testing.T) {
+	points := func(v float64) []promql.FPoint { return []promql.FPoint{{T: 1000, F: v}} }
+
+	m := promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo", "le", "+Inf"), Floats: points(4)},
+		{Metric: labels.FromStrings("app", "bar", "le", "0.5"), Floats: points(5)},
+		{Metric: labels.FromStrings("app", "foo", "le", "10"), Floats: points(3)},
+		{Metric: labels.FromStrings("app", "foo", "le", "2"), Floats: points(2)},
+		{Metric: labels.FromStrings("app", "bar"), Floats: points(7)},
+		{Metric: labels.FromStrings("app", "foo", "le", "0.5"), Floats: points(1)},
+		{Metric: labels.FromStrings("app", "bar", "le", "+Inf"), Floats: points(6)},
+	}
+
+	require.Equal(t, []MatrixGroup{
+		{
+			Metric: labels.FromStrings("app", "bar"),
+			Buckets: []MatrixBucket{
+				{Value: "0.5", Floats: points(5)},
+				{Value: "+Inf", Floats: points(6)},
+				{Value: "", Floats: points(7)},
+			},
+		},
+		{
+			Metric: labels.FromStrings("app", "foo"),
+			Buckets: []MatrixBucket{
+				{Value: "0.5", Floats: points(1)},
+				{Value: "2", Floats: points(2)},
+				{Value: "10", Floats: points(3)},
+				{Value: "+Inf", Floats: points(4)},
+			},
+		},
+	}, GroupMatrixBy(m, "le"))
+
+	t.Run("label not present", func(t *testing.T) {
+		groups := GroupMatrixBy(promql.Matrix{
+			{Metric: labels.FromStrings("app", "foo"), Floats: points(1)},
+			{Metric: labels.FromStrings("app", "bar"), Floats: points(2)},
+		}, "le")
+		require.Equal(t, []MatrixGroup{
+			{Metric: labels.FromStrings("app", "bar"), Buckets: []MatrixBucket{{Value: "", Floats: points(2)}}},
+			{Metric: labels.FromStrings("app", "foo"), Buckets: []MatrixBucket{{Value: "", Floats: points(1)}}},
+		}, groups)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		require.Empty(t, GroupMatrixBy(nil, "le"))
+	})
+}
+
+func TestMergeVariants(t *testing.T) {
+	m := promql.Matrix{
+		{Metric: labels.FromStrings("__variant__", "0", "app", "foo"), Floats: []promql.FPoint{{T: 0, F: 1}, {T: 60, F: 2}}},
+		{Metric: labels.FromStrings("__variant__", "1", "app", "foo"), Floats: []promql.FPoint{{T: 60, F: 6}}},
+		{Metric: labels.FromStrings("__variant__", "0", "app", "bar"), Floats: []promql.FPoint{{T: 0, F: 3}}},
+	}
+	for _, tc := range []struct {
+		op       string
+		foo, bar []promql.FPoint
+	}{
+		{"sum", []promql.FPoint{{T: 0, F: 1}, {T: 60, F: 8}}, []promql.FPoint{{T: 0, F: 3}}},
+		{"avg", []promql.FPoint{{T: 0, F: 1}, {T: 60, F: 4}}, []promql.FPoint{{T: 0, F: 3}}},
+		{"min", []promql.FPoint{{T: 0, F: 1}, {T: 60, F: 2}}, []promql.FPoint{{T: 0, F: 3}}},
+		{"max", []promql.FPoint{{T: 0, F: 1}, {T: 60, F: 6}}, []promql.FPoint{{T: 0, F: 3}}},
+		{"count", []promql.FPoint{{T: 0, F: 1}, {T: 60, F: 2}}, []promql.FPoint{{T: 0, F: 1}}},
+	} {
+		t.Run(tc.op, func(t *testing.T) {
+			require.Equal(t, promql.Matrix{
+				{Metric: labels.FromStrings("app", "bar"), Floats: tc.bar},
+				{Metric: labels.FromStrings("app", "foo"), Floats: tc.foo},
+			}, MergeVariants(m, tc.op, nil))
+		})
+	}
+}
+
+func TestMergeVariants_Grouping(t *testing.T) {
+	m := promql.Matrix{
+		{Metric: labels.FromStrings("__variant__", "0", "app", "foo", "host", "a"), Floats: []promql.FPoint{{T: 0, F: 1}}},
+		{Metric: labels.FromStrings("__variant__", "1", "app", "foo", "host", "b"), Floats: []promql.FPoint{{T: 0, F: 2}}},
+		{Metric: labels.FromStrings("__variant__", "0", "app", "bar", "host", "a"), Floats: []promql.FPoint{{T: 0, F: 4}}},
+	}
+	require.Equal(t, promql.Matrix{
+		{Metric: labels.FromStrings("app", "bar"), Floats: []promql.FPoint{{T: 0, F: 4}}},
+		{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 0, F: 3}}},
+	}, MergeVariants(m, syntax.OpTypeSum, &syntax.Grouping{Groups: []string{"host"}, Without: true}))
+	require.Equal(t, promql.Matrix{
+		{Metric: labels.EmptyLabels(), Floats: []promql.FPoint{{T: 0, F: 3}}},
+	}, MergeVariants(m, syntax.OpTypeCount, &syntax.Grouping{}))
+}
+
+func TestHold(t *testing.T) {
+	m := promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 0, F: 1}, {T: 90, F: 4}}},
+		{Metric: labels.FromStrings("app", "bar"), Floats: []promql.FPoint{{T: 60, F: 5}}},
+	}
+	// gaps are only filled for up to 30ms and up to the end.
+	require.Equal(t, promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 0, F: 1}, {T: 30, F: 1}, {T: 90, F: 4}, {T: 120, F: 4}}},
+		{Metric: labels.FromStrings("app", "bar"), Floats: []promql.FPoint{{T: 60, F: 5}, {T: 90, F: 5}}},
+	}, Hold(m, 30*time.Millisecond, 30*time.Millisecond, time.UnixMilli(120)))
+}
+
+func TestInterpolate(t *testing.T) {
+	m := promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 0, F: 1}, {T: 30, F: 4}, {T: 90, F: 10}, {T: 120, F: 7}}},
+		{Metric: labels.FromStrings("app", "bar"), Floats: []promql.FPoint{{T: 150, F: 5}}},
+	}
+	// the gap between 30 and 90 is not filled and points after 100 are dropped.
+	require.Equal(t, promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 0, F: 1}, {T: 10, F: 2}, {T: 20, F: 3}, {T: 30, F: 4}, {T: 90, F: 10}, {T: 100, F: 9}}},
+	}, Interpolate(m, 3, 10*time.Millisecond, 100))
+}
+
+func TestSubtractBaseline(t *testing.T) {
+	m := promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 0, F: 10}, {T: 30, F: 12}, {T: 60, F: 9}}},
+		{Metric: labels.FromStrings("app", "bar"), Floats: []promql.FPoint{{T: 0, F: 5}, {T: 30, F: 7}}},
+		{Metric: labels.FromStrings("app", "baz"), Floats: []promql.FPoint{{T: 0, F: 1}}},
+	}
+	baseline := promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 0, F: 8}, {T: 30, F: 12}, {T: 60, F: 10}}},
+		// the point at 30 is missing from the baseline.
+		{Metric: labels.FromStrings("app", "bar"), Floats: []promql.FPoint{{T: 0, F: 2}}},
+		// baz has no baseline and qux no result.
+		{Metric: labels.FromStrings("app", "qux"), Floats: []promql.FPoint{{T: 0, F: 3}}},
+	}
+	require.Equal(t, promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 0, F: 2}, {T: 30, F: 0}, {T: 60, F: -1}}},
+		{Metric: labels.FromStrings("app", "bar"), Floats: []promql.FPoint{{T: 0, F: 3}}},
+	}, SubtractBaseline(m, baseline))
+}
+
+func TestStepDelta(t *testing.T) {
+	m := promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 0, F: 1}, {T: 30, F: 3}, {T: 60, F: 6}, {T: 90, F: 10}}},
+		{Metric: labels.FromStrings("app", "bar"), Floats: []promql.FPoint{{T: 0, F: 5}}},
+	}
+	require.Equal(t, promql.Matrix{
+		{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 30, F: 2}, {T: 60, F: 3}, {T: 90, F: 4}}},
+	}, StepDelta(m))
+}
+
+func TestDownsampleMatrix(t *testing.T) {
+	points := func(ts ...int64) []promql.FPoint {
+		var floats []promql.FPoint
+		for _, t := range ts {
+			floats = append(floats, promql.FPoint{T: t, F: float64(t)})
+		}
+		return floats
+	}
+	// b has no point at the first step.
+	m := promql.Matrix{
+		{Metric: labels.FromStrings("app", "a"), Floats: points(1, 2, 3, 4, 5)},
+		{Metric: labels.FromStrings("app", "b"), Floats: points(2, 3, 4, 5)},
+	}
+
+	for _, tc := range []struct {
+		limit         int
+		expected      promql.Matrix
+		expectedEvery int
+	}{
+		{limit: 9, expected: m, expectedEvery: 1},
+		{
+			// the steps at 1 and 4 are kept for both series, a 2 times coarser
+			// step would keep 5 points.
+			limit: 4,
+			expected: promql.Matrix{
+				{Metric: labels.FromStrings("app", "a"), Floats: points(1, 4)},
+				{Metric: labels.FromStrings("app", "b"), Floats: points(4)},
+			},
+			expectedEvery: 3,
+		},
+		{
+			limit: 1,
+			expected: promql.Matrix{
+				{Metric: labels.FromStrings("app", "a"), Floats: points(1)},
+			},
+			expectedEvery: 9,
+		},
+	} {
+		t.Run(strconv.Itoa(tc.limit), func(t *testing.T) {
+			result, every := DownsampleMatrix(m, tc.limit, time.UnixMilli(1), time.Millisecond)
+			require.Equal(t, tc.expected, result)
+			require.Equal(t, tc.expectedEvery, every)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package logql
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/grafana/loki/v3/pkg/logqlmodel"
+)
+
+// MetricPointExplainer returns the log lines behind a point of a metric query.
+type MetricPointExplainer interface {
+	// ExplainMetricPoint returns up to n lines that contributed to the value of
+	// series at time t.
+	ExplainMetricPoint(ctx context.Context, series labels.Labels, t time.Time, n int) (logqlmodel.Streams, error)
+}
+
+var errNotMetricQuery = errors.New("only metric queries can be explained by lines")
+
+// ExplainMetricPoint implements MetricPointExplainer. It selects again the
+// window of every range selector of the query ending at t, keeping only the
+// lines whose labels, including the extracted ones, match those of series.
+func (q *query) ExplainMetricPoint(ctx context.Context, series labels.Labels, t time.Time, n int) (logqlmodel.Streams, error) {
+	expr, ok := q.params.GetExpression().(syntax.SampleExpr)
+	if !ok {
+		return nil, errNotMetricQuery
+	}
+
+	var ranges []*syntax.LogRangeExpr
+	expr.Walk(func(e syntax.Expr) bool {
+		if r, ok := e.(*syntax.LogRangeExpr); ok {
+			ranges = append(ranges, r)
+		}
+		return true
+	})
+
+	result := logqlmodel.Streams{}
+	for _, r := range ranges {
+		if n <= 0 {
+			break
+		}
+		selector, err := seriesSelector(r.Left, series)
+		if err != nil {
+			return nil, err
+		}
+
+		end := t
+		if r.At != nil {
+			end = time.UnixMilli(*r.At)
+		}
+		end = end.Add(-r.Offset)
+		// windows are left-open and right-closed, like those of range aggregations.
+		params, err := NewLiteralParams(selector.String(), end.Add(-r.Interval+1), end.Add(1), 0, 0, logproto.FORWARD, uint32(n), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		it, err := q.evaluator.NewIterator(ctx, selector, params)
+		if err != nil {
+			return nil, err
+		}
+		streams, err := readStreams(it, uint32(n), logproto.FORWARD, 0)
+		it.Close()
+		if err != nil {
+			return nil, err
+		}
+		n -= int(streams.Lines())
+		result = append(result, streams...)
+	}
+	return result, nil
+}
+
+// seriesSelector appends a label filter for every label of series to the
+// pipeline of selector.
+func seriesSelector(selector syntax.LogSelectorExpr, series labels.Labels) (syntax.LogSelectorExpr, error) {
+	var sb strings.Builder
+	sb.WriteString(selector.String())
+	series.Range(func(l labels.Label) {
+		sb.WriteString(" | ")
+		sb.WriteString(l.Name)
+		sb.WriteString("=")
+		sb.WriteString(strconv.Quote(l.Value))
+	})
+	return syntax.ParseLogSelector(sb.String(), true)
+}
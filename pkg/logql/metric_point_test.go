@@ -0,0 +1,63 @@
+package logql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+)
+
+func TestQuery_ExplainMetricPoint(t *testing.T) {
+	// lines every 10s from 0 to 290s.
+	querier := NewMockQuerier(0, []logproto.Stream{
+		newStream(30, factor(10, identity), `{app="foo",bar="fuzz"}`),
+		newStream(30, factor(10, identity), `{app="bar",bar="fuzz"}`),
+	})
+	eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+
+	for _, tc := range []struct {
+		qs       string
+		t        time.Time
+		n        int
+		from, to time.Time
+		lines    int
+	}{
+		{`sum by (app) (count_over_time({app=~"foo|bar"}[1m]))`, time.Unix(120, 0), 100, time.Unix(70, 0), time.Unix(120, 0), 6},
+		{`sum by (app) (count_over_time({app=~"foo|bar"}[1m]))`, time.Unix(120, 0), 2, time.Unix(70, 0), time.Unix(80, 0), 2},
+		{`sum by (app) (count_over_time({app=~"foo|bar"}[1m] offset 1m))`, time.Unix(120, 0), 100, time.Unix(10, 0), time.Unix(60, 0), 6},
+		{`sum by (app) (count_over_time({app=~"foo|bar"}[1m] @ 200))`, time.Unix(120, 0), 100, time.Unix(150, 0), time.Unix(200, 0), 6},
+	} {
+		t.Run(tc.qs, func(t *testing.T) {
+			params, err := NewLiteralParams(tc.qs, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			explainer, ok := eng.Query(params).(MetricPointExplainer)
+			require.True(t, ok)
+
+			streams, err := explainer.ExplainMetricPoint(ctx, labels.FromStrings("app", "foo"), tc.t, tc.n)
+			require.NoError(t, err)
+			require.Equal(t, tc.lines, int(streams.Lines()))
+			for _, s := range streams {
+				lbs, err := syntax.ParseLabels(s.Labels)
+				require.NoError(t, err)
+				require.Equal(t, "foo", lbs.Get("app"))
+				require.Equal(t, tc.from, s.Entries[0].Timestamp)
+				require.Equal(t, tc.to, s.Entries[len(s.Entries)-1].Timestamp)
+			}
+		})
+	}
+
+	t.Run("log query", func(t *testing.T) {
+		params, err := NewLiteralParams(`{app="foo"}`, time.Unix(0, 0), time.Unix(300, 0), 0, 0, logproto.FORWARD, 100, nil, nil)
+		require.NoError(t, err)
+		_, err = eng.Query(params).(MetricPointExplainer).ExplainMetricPoint(ctx, labels.FromStrings("app", "foo"), time.Unix(120, 0), 10)
+		require.ErrorIs(t, err, errNotMetricQuery)
+	})
+}
@@ -132,7 +132,7 @@ func RecordRangeAndInstantQueryMetrics(
 
 	var (
 		query       = p.QueryString()
-		hashedQuery = util.HashedQuery(query)
+		hashedQuery = util.HashedNormalizedQuery(ctx, query)
 	)
 
 	logValues := make([]interface{}, 0, 50)
@@ -59,7 +59,8 @@ func removeLineformat(expr syntax.SampleExpr) {
 		}
 		// bytes operation count bytes of the log line so line_format changes the result.
 		if rangeExpr.Operation == syntax.OpRangeTypeBytes ||
-			rangeExpr.Operation == syntax.OpRangeTypeBytesRate {
+			rangeExpr.Operation == syntax.OpRangeTypeBytesRate ||
+			rangeExpr.Operation == syntax.OpRangeTypeMatchedBytes {
 			return true
 		}
 		pipelineExpr, ok := rangeExpr.Left.Left.(*syntax.PipelineExpr)
@@ -0,0 +1,134 @@
+package logql
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/grafana/loki/v3/pkg/iter"
+)
+
+// prometheusRangeFunc computes the value of a window of samples given the
+// boundaries of the window in nanoseconds. It reports false if the window has
+// no result.
+type prometheusRangeFunc func(samples []promql.FPoint, rangeStart, rangeEnd int64) (float64, bool)
+
+// newPrometheusRateIterator returns an iterator computing the rate of
+// unwrapped values like PromQL does.
+func newPrometheusRateIterator(
+	it iter.PeekingSampleIterator,
+	selRange, step, start, end, offset int64,
+) RangeVectorIterator {
+	return newPrometheusRangeIterator(it, prometheusRate, selRange, step, start, end, offset)
+}
+
+// newPrometheusRangeIterator returns an iterator computing fn over the window
+// of each series at every step.
+func newPrometheusRangeIterator(
+	it iter.PeekingSampleIterator,
+	fn prometheusRangeFunc,
+	selRange, step, start, end, offset int64,
+) RangeVectorIterator {
+	// forces at least one step.
+	if step == 0 {
+		step = 1
+	}
+	if offset != 0 {
+		start = start - offset
+		end = end - offset
+	}
+
+	inner := &batchRangeVectorIterator{
+		iter:     it,
+		step:     step,
+		end:      end,
+		selRange: selRange,
+		metrics:  map[string]labels.Labels{},
+		window:   map[string]*promql.Series{},
+		agg:      nil,
+		current:  start - step, // first loop iteration will set it to start
+		offset:   offset,
+	}
+	return &prometheusBatchRangeVectorIterator{
+		batchRangeVectorIterator: inner,
+		fn:                       fn,
+	}
+}
+
+// prometheusBatchRangeVectorIterator passes the boundaries of the window to
+// its function to extrapolate, which a BatchRangeVectorAggregator does not get.
+type prometheusBatchRangeVectorIterator struct {
+	*batchRangeVectorIterator
+	fn prometheusRangeFunc
+	at []promql.Sample
+}
+
+func (r *prometheusBatchRangeVectorIterator) At() (int64, StepResult) {
+	if r.at == nil {
+		r.at = make([]promql.Sample, 0, len(r.window))
+	}
+	r.at = r.at[:0]
+	// convert ts from nano to milli seconds as the iterator work with nanoseconds
+	ts := r.current/1e+6 + r.offset/1e+6
+	for _, series := range r.window {
+		v, ok := r.fn(series.Floats, r.current-r.selRange, r.current)
+		if !ok {
+			continue
+		}
+		r.at = append(r.at, promql.Sample{
+			F:      v,
+			T:      ts,
+			Metric: series.Metric,
+		})
+	}
+	return ts, SampleVector(r.at)
+}
+
+// prometheusRate is the counter rate of PromQL. Unlike rate_counter, the
+// increase of the samples is extrapolated to the real boundaries of the
+// window, given in nanoseconds. Like in PromQL, there is no result for less
+// than two samples.
+func prometheusRate(samples []promql.FPoint, rangeStart, rangeEnd int64) (float64, bool) {
+	v, ok := extrapolatedRate(samples, rangeStart, rangeEnd, true)
+	if !ok {
+		return 0, false
+	}
+	return v / (float64(rangeEnd-rangeStart) / 1e9), true
+}
+
+// prometheusDelta is the delta of PromQL: the difference between the last and
+// the first sample of a gauge, extrapolated to the boundaries of the window.
+func prometheusDelta(samples []promql.FPoint, rangeStart, rangeEnd int64) (float64, bool) {
+	return extrapolatedRate(samples, rangeStart, rangeEnd, false)
+}
+
+// prometheusIdelta is the idelta of PromQL: the difference between the last
+// two samples of a gauge.
+func prometheusIdelta(samples []promql.FPoint, _, _ int64) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	return samples[len(samples)-1].F - samples[len(samples)-2].F, true
+}
+
+// prometheusDeriv is the deriv of PromQL: the per-second slope of the least
+// squares fit of a line through the samples of a gauge.
+func prometheusDeriv(samples []promql.FPoint, _, _ int64) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	// timestamps relative to the first sample keep the sums precise.
+	var sumX, sumY, sumXY, sumX2 float64
+	for _, s := range samples {
+		x := float64(s.T-samples[0].T) / 1e9
+		sumX += x
+		sumY += s.F
+		sumXY += x * s.F
+		sumX2 += x * x
+	}
+	n := float64(len(samples))
+	varX := sumX2 - sumX*sumX/n
+	if varX == 0 {
+		return 0, false
+	}
+	return (sumXY - sumX*sumY/n) / varX, true
+}
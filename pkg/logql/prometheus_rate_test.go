@@ -0,0 +1,136 @@
+package logql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+func TestEngine_PrometheusRateCompat(t *testing.T) {
+	const qs = `rate({app="foo"} | unwrap x [1m])`
+	ts := time.Unix(60, 0)
+
+	// a sparse series close to the start of the window.
+	querier := newQuerierRecorder(t,
+		[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: []logproto.Sample{
+			{Timestamp: time.Unix(5, 0).UnixNano(), Value: 10, Hash: 1},
+			{Timestamp: time.Unix(15, 0).UnixNano(), Value: 20, Hash: 2},
+		}}}},
+		[]SelectSampleParams{
+			{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: qs}},
+		},
+	)
+
+	for _, tc := range []struct {
+		name     string
+		compat   bool
+		expected float64
+	}{
+		// (10 + 20) / 60s
+		{"logql", false, 0.5},
+		// the increase of 10 over 10s is extrapolated by 5s to the start of
+		// the window, being close to it, and by half the average interval
+		// between samples (5s) to its end: 10 * 20s/10s / 60s
+		{"prometheus", true, 1. / 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			eng := NewEngine(EngineOpts{PrometheusRateCompat: tc.compat}, querier, NoLimits, log.NewNopLogger())
+			params, err := NewLiteralParams(qs, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+
+			vec, ok := res.Data.(promql.Vector)
+			require.True(t, ok)
+			require.Len(t, vec, 1)
+			require.Equal(t, labels.FromStrings("app", "foo"), vec[0].Metric)
+			require.InDelta(t, tc.expected, vec[0].F, 1e-12)
+		})
+	}
+}
+
+func TestPrometheusRate(t *testing.T) {
+	second := int64(time.Second)
+
+	_, ok := prometheusRate([]promql.FPoint{{T: 10 * second, F: 1}}, 0, 60*second)
+	require.False(t, ok, "a single sample has no rate")
+
+	// a counter reset is accounted for, and the samples close to both
+	// boundaries are extrapolated to them: (2 + 3) * 60s/40s / 60s
+	v, ok := prometheusRate([]promql.FPoint{{T: 10 * second, F: 4}, {T: 30 * second, F: 6}, {T: 50 * second, F: 3}}, 0, 60*second)
+	require.True(t, ok)
+	require.InDelta(t, 5./40, v, 1e-12)
+}
+
+func TestEngine_GaugeFunctions(t *testing.T) {
+	ts := time.Unix(300, 0)
+
+	// a sample every 10s of a gauge increasing by 2 per second.
+	var samples []logproto.Sample
+	for s := int64(10); s <= 300; s += 10 {
+		samples = append(samples, logproto.Sample{Timestamp: time.Unix(s, 0).UnixNano(), Value: float64(2 * s), Hash: uint64(s)})
+	}
+
+	for _, tc := range []struct {
+		query    string
+		expected float64
+	}{
+		// the difference of 580 over 290s is extrapolated by 10s to the
+		// start of the window.
+		{`delta({app="foo"} | unwrap x [5m])`, 600},
+		{`idelta({app="foo"} | unwrap x [5m])`, 20},
+		{`deriv({app="foo"} | unwrap x [5m])`, 2},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			querier := newQuerierRecorder(t,
+				[][]logproto.Series{{{Labels: `{app="foo"}`, Samples: samples}}},
+				[]SelectSampleParams{
+					{&logproto.SampleQueryRequest{Start: time.Unix(0, 0), End: ts, Selector: tc.query}},
+				},
+			)
+			eng := NewEngine(EngineOpts{}, querier, NoLimits, log.NewNopLogger())
+			params, err := NewLiteralParams(tc.query, ts, ts, 0, 0, logproto.FORWARD, 0, nil, nil)
+			require.NoError(t, err)
+			res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+			require.NoError(t, err)
+
+			vec, ok := res.Data.(promql.Vector)
+			require.True(t, ok)
+			require.Len(t, vec, 1)
+			require.Equal(t, labels.FromStrings("app", "foo"), vec[0].Metric)
+			require.InDelta(t, tc.expected, vec[0].F, 1e-9)
+		})
+	}
+}
+
+func TestPrometheusGaugeFunctions(t *testing.T) {
+	second := int64(time.Second)
+	single := []promql.FPoint{{T: 10 * second, F: 1}}
+	for name, fn := range map[string]prometheusRangeFunc{"delta": prometheusDelta, "idelta": prometheusIdelta, "deriv": prometheusDeriv} {
+		_, ok := fn(single, 0, 60*second)
+		require.False(t, ok, "%s of a single sample", name)
+	}
+
+	// a gauge going down is not treated as a counter reset: (3 - 4) * 60s/40s
+	samples := []promql.FPoint{{T: 10 * second, F: 4}, {T: 30 * second, F: 6}, {T: 50 * second, F: 3}}
+	v, ok := prometheusDelta(samples, 0, 60*second)
+	require.True(t, ok)
+	require.InDelta(t, -1.5, v, 1e-12)
+
+	v, ok = prometheusIdelta(samples, 0, 60*second)
+	require.True(t, ok)
+	require.Equal(t, -3., v)
+
+	// the least squares line through (0, 4), (20, 6) and (40, 3).
+	v, ok = prometheusDeriv(samples, 0, 60*second)
+	require.True(t, ok)
+	require.InDelta(t, -1./40, v, 1e-12)
+}
@@ -1,6 +1,7 @@
 package logql
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"sort"
@@ -14,6 +15,7 @@ import (
 	"github.com/grafana/loki/v3/pkg/iter"
 	"github.com/grafana/loki/v3/pkg/logql/syntax"
 	"github.com/grafana/loki/v3/pkg/logql/vector"
+	"github.com/grafana/loki/v3/pkg/logqlmodel/metadata"
 )
 
 // BatchRangeVectorAggregator aggregates samples for a given range of samples.
@@ -97,6 +99,93 @@ type batchRangeVectorIterator struct {
 	metrics                              map[string]labels.Labels
 	at                                   []promql.Sample
 	agg                                  BatchRangeVectorAggregator
+
+	// maxSamples caps the samples buffered per series when non-zero.
+	maxSamples   int
+	strides      map[string]*stride
+	onDownsample func()
+}
+
+// stride keeps one out of every `every` samples of a series.
+type stride struct {
+	every int
+	// since is the number of samples received since the last kept one.
+	since int
+}
+
+// downsample caps the samples buffered per series to maxSamples. Once a series
+// buffers more samples, every other sample is dropped and only every other
+// incoming sample is kept from then on, so the buffered samples stay uniformly
+// spread. A warning is added to the context the first time it happens.
+func (r *batchRangeVectorIterator) downsample(ctx context.Context, maxSamples int) {
+	r.maxSamples = maxSamples
+	r.strides = map[string]*stride{}
+	var once sync.Once
+	r.onDownsample = func() {
+		once.Do(func() {
+			metadata.FromContext(ctx).AddStructuredWarning(metadata.DownsampledWarning(maxSamples))
+		})
+	}
+}
+
+// keep tells whether the next sample of a series must be buffered.
+func (r *batchRangeVectorIterator) keep(lbs string) bool {
+	if r.maxSamples == 0 {
+		return true
+	}
+	s, ok := r.strides[lbs]
+	if !ok {
+		s = &stride{every: 1}
+		r.strides[lbs] = s
+	}
+	s.since++
+	if s.since < s.every {
+		return false
+	}
+	s.since = 0
+	return true
+}
+
+// shrink halves the samples of a series exceeding maxSamples.
+func (r *batchRangeVectorIterator) shrink(lbs string, series *promql.Series) {
+	if r.maxSamples == 0 || len(series.Floats) <= r.maxSamples {
+		return
+	}
+	s := r.strides[lbs]
+	if len(series.Floats)%2 == 0 {
+		// the last sample is dropped, so the last kept one is a stride earlier.
+		s.since += s.every
+	}
+	kept := series.Floats[:0]
+	for i := 0; i < len(series.Floats); i += 2 {
+		kept = append(kept, series.Floats[i])
+	}
+	series.Floats = kept
+	s.every *= 2
+	r.onDownsample()
+}
+
+// restride recomputes the stride of a series from the samples left in its
+// window once older ones left it, so that a stride grown for a dense window
+// shrinks back as the window thins out.
+func (r *batchRangeVectorIterator) restride(lbs string, series *promql.Series) {
+	if r.maxSamples == 0 {
+		return
+	}
+	s, ok := r.strides[lbs]
+	if !ok {
+		return
+	}
+	// every buffered sample stands for about every samples of the window.
+	spanned := len(series.Floats) * s.every
+	every := 1
+	for spanned > every*r.maxSamples {
+		every *= 2
+	}
+	s.every = every
+	if s.since >= every {
+		s.since = every - 1
+	}
 }
 
 func (r *batchRangeVectorIterator) Next() bool {
@@ -142,6 +231,13 @@ func (r *batchRangeVectorIterator) popBack(newStart int64) {
 			s := r.window[fp]
 			delete(r.window, fp)
 			putSeries(s)
+			if r.maxSamples != 0 {
+				delete(r.strides, fp)
+			}
+			continue
+		}
+		if remove {
+			r.restride(fp, r.window[fp])
 		}
 	}
 }
@@ -178,11 +274,16 @@ func (r *batchRangeVectorIterator) load(start, end int64) {
 			series.Metric = metric
 			r.window[lbs] = series
 		}
+		if !r.keep(lbs) {
+			_ = r.iter.Next()
+			continue
+		}
 		p := promql.FPoint{
 			T: sample.Timestamp,
 			F: sample.Value,
 		}
 		series.Floats = append(series.Floats, p)
+		r.shrink(lbs, series)
 		_ = r.iter.Next()
 	}
 }
@@ -230,7 +331,7 @@ func aggregator(r *syntax.RangeAggregationExpr) (BatchRangeVectorAggregator, err
 		return countOverTime, nil
 	case syntax.OpRangeTypeBytesRate:
 		return rateLogBytes(r.Left.Interval), nil
-	case syntax.OpRangeTypeBytes, syntax.OpRangeTypeSum:
+	case syntax.OpRangeTypeBytes, syntax.OpRangeTypeSum, syntax.OpRangeTypeMatchedBytes:
 		return sumOverTime, nil
 	case syntax.OpRangeTypeAvg:
 		return avgOverTime, nil
@@ -242,8 +343,18 @@ func aggregator(r *syntax.RangeAggregationExpr) (BatchRangeVectorAggregator, err
 		return stddevOverTime, nil
 	case syntax.OpRangeTypeStdvar:
 		return stdvarOverTime, nil
+	case syntax.OpRangeTypeCV:
+		return cvOverTime(nanDegenerateWindows), nil
+	case syntax.OpRangeTypeZScore:
+		return zscoreOverTime(nanDegenerateWindows), nil
 	case syntax.OpRangeTypeQuantile:
 		return quantileOverTime(*r.Params), nil
+	case syntax.OpRangeTypeAutocorr:
+		return autocorrOverTime(*r.Params), nil
+	case syntax.OpRangeTypeChanges:
+		return changesOverTime, nil
+	case syntax.OpRangeTypeResets:
+		return resetsOverTime, nil
 	case syntax.OpRangeTypeFirst:
 		return first, nil
 	case syntax.OpRangeTypeLast:
@@ -274,27 +385,40 @@ func rateLogs(selRange time.Duration, computeValues bool) func(samples []promql.
 // and treat them like a "counter" metric.
 func rateCounter(selRange time.Duration) func(samples []promql.FPoint) float64 {
 	return func(samples []promql.FPoint) float64 {
-		return extrapolatedRate(samples, selRange, true, true)
+		return rateCounterValue(samples, selRange)
 	}
 }
 
-// extrapolatedRate function is taken from prometheus code promql/functions.go:59
-// extrapolatedRate is a utility function for rate/increase/delta.
-// It calculates the rate (allowing for counter resets if isCounter is true),
-// extrapolates if the first/last sample is close to the boundary, and returns
-// the result as either per-second (if isRate is true) or overall.
-func extrapolatedRate(samples []promql.FPoint, selRange time.Duration, isCounter, isRate bool) float64 {
-	// No sense in trying to compute a rate without at least two points. Drop
-	// this Vector element.
-	if len(samples) < 2 {
+// rateCounterValue is the rate of a counter whose window is assumed to end at
+// its last sample.
+func rateCounterValue(samples []promql.FPoint, selRange time.Duration) float64 {
+	if len(samples) == 0 {
 		return 0
 	}
 	var (
 		rangeStart = samples[0].T - durationMilliseconds(selRange)
 		rangeEnd   = samples[len(samples)-1].T
 	)
+	v, _ := extrapolatedRate(samples, rangeStart, rangeEnd, true)
+	return v / selRange.Seconds()
+}
 
-	resultValue := samples[len(samples)-1].F - samples[0].F
+// extrapolatedRate function is taken from prometheus code promql/functions.go:72
+// extrapolatedRate is a utility function for rate/increase/delta.
+// It calculates the increase (allowing for counter resets if isCounter is
+// true) and extrapolates it if the first/last sample is close to the boundary
+// of the window from rangeStart to rangeEnd, in nanoseconds. Callers divide the
+// result by the range for a per-second rate. There is no result for less than
+// two samples.
+func extrapolatedRate(samples []promql.FPoint, rangeStart, rangeEnd int64, isCounter bool) (float64, bool) {
+	// No sense in trying to compute a rate without at least two points. Drop
+	// this Vector element.
+	if len(samples) < 2 {
+		return 0, false
+	}
+	first, last := samples[0], samples[len(samples)-1]
+
+	resultValue := last.F - first.F
 	if isCounter {
 		var lastValue float64
 		for _, sample := range samples {
@@ -306,13 +430,22 @@ func extrapolatedRate(samples []promql.FPoint, selRange time.Duration, isCounter
 	}
 
 	// Duration between first/last samples and boundary of range.
-	durationToStart := float64(samples[0].T-rangeStart) / 1000
-	durationToEnd := float64(rangeEnd-samples[len(samples)-1].T) / 1000
+	durationToStart := float64(first.T-rangeStart) / 1e9
+	durationToEnd := float64(rangeEnd-last.T) / 1e9
 
-	sampledInterval := float64(samples[len(samples)-1].T-samples[0].T) / 1000
+	sampledInterval := float64(last.T-first.T) / 1e9
 	averageDurationBetweenSamples := sampledInterval / float64(len(samples)-1)
 
-	if isCounter && resultValue > 0 && samples[0].F >= 0 {
+	// If the first/last samples are close to the boundaries of the range,
+	// extrapolate the result. This is as we expect that another sample
+	// will exist given the spacing between samples we've seen thus far,
+	// with an allowance for noise. Otherwise extrapolate by half the
+	// average duration between samples.
+	extrapolationThreshold := averageDurationBetweenSamples * 1.1
+	if durationToStart >= extrapolationThreshold {
+		durationToStart = averageDurationBetweenSamples / 2
+	}
+	if isCounter && resultValue > 0 && first.F >= 0 {
 		// Counters cannot be negative. If we have any slope at
 		// all (i.e. resultValue went up), we can extrapolate
 		// the zero point of the counter. If the duration to the
@@ -320,36 +453,16 @@ func extrapolatedRate(samples []promql.FPoint, selRange time.Duration, isCounter
 		// take the zero point as the start of the series,
 		// thereby avoiding extrapolation to negative counter
 		// values.
-		durationToZero := sampledInterval * (samples[0].F / resultValue)
+		durationToZero := sampledInterval * (first.F / resultValue)
 		if durationToZero < durationToStart {
 			durationToStart = durationToZero
 		}
 	}
-
-	// If the first/last samples are close to the boundaries of the range,
-	// extrapolate the result. This is as we expect that another sample
-	// will exist given the spacing between samples we've seen thus far,
-	// with an allowance for noise.
-	extrapolationThreshold := averageDurationBetweenSamples * 1.1
-	extrapolateToInterval := sampledInterval
-
-	if durationToStart < extrapolationThreshold {
-		extrapolateToInterval += durationToStart
-	} else {
-		extrapolateToInterval += averageDurationBetweenSamples / 2
-	}
-	if durationToEnd < extrapolationThreshold {
-		extrapolateToInterval += durationToEnd
-	} else {
-		extrapolateToInterval += averageDurationBetweenSamples / 2
-	}
-	resultValue = resultValue * (extrapolateToInterval / sampledInterval)
-	if isRate {
-		seconds := selRange.Seconds()
-		resultValue = resultValue / seconds
+	if durationToEnd >= extrapolationThreshold {
+		durationToEnd = averageDurationBetweenSamples / 2
 	}
 
-	return resultValue
+	return resultValue * ((sampledInterval + durationToStart + durationToEnd) / sampledInterval), true
 }
 
 func durationMilliseconds(d time.Duration) int64 {
@@ -369,37 +482,36 @@ func countOverTime(samples []promql.FPoint) float64 {
 }
 
 func sumOverTime(samples []promql.FPoint) float64 {
-	var sum float64
+	var sum, c float64
 	for _, v := range samples {
-		sum += v.F
+		sum, c = kahanSumInc(v.F, sum, c)
 	}
-	return sum
+	return sum + c
+}
+
+// kahanSumInc adds inc to sum using the Kahan-Babuska-Neumaier compensated
+// summation and returns the new sum together with the new compensation term.
+// The final result is sum + c.
+// See https://en.wikipedia.org/wiki/Kahan_summation_algorithm#Further_enhancements
+func kahanSumInc(inc, sum, c float64) (newSum, newC float64) {
+	t := sum + inc
+	switch {
+	case math.IsInf(t, 0):
+		c = 0
+	case math.Abs(sum) >= math.Abs(inc):
+		c += (sum - t) + inc
+	default:
+		c += (inc - t) + sum
+	}
+	return t, c
 }
 
 func avgOverTime(samples []promql.FPoint) float64 {
-	var mean, count float64
+	a := &AvgOverTime{}
 	for _, v := range samples {
-		count++
-		if math.IsInf(mean, 0) {
-			if math.IsInf(v.F, 0) && (mean > 0) == (v.F > 0) {
-				// The `mean` and `v.V` values are `Inf` of the same sign.  They
-				// can't be subtracted, but the value of `mean` is correct
-				// already.
-				continue
-			}
-			if !math.IsInf(v.F, 0) && !math.IsNaN(v.F) {
-				// At this stage, the mean is an infinite. If the added
-				// value is neither an Inf or a Nan, we can keep that mean
-				// value.
-				// This is required because our calculation below removes
-				// the mean value, which would look like Inf += x - Inf and
-				// end up as a NaN.
-				continue
-			}
-		}
-		mean += v.F/count - mean/count
+		a.agg(v)
 	}
-	return mean
+	return a.at()
 }
 
 func maxOverTime(samples []promql.FPoint) float64 {
@@ -422,28 +534,141 @@ func minOverTime(samples []promql.FPoint) float64 {
 	return minVal
 }
 
-// stdvarOverTime calculates the variance using Welford's online algorithm.
+// welford calculates the mean and the variance using Welford's online algorithm.
 // See https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm
-func stdvarOverTime(samples []promql.FPoint) float64 {
-	var aux, count, mean float64
+func welford(samples []promql.FPoint) (mean, variance float64) {
+	var aux, count float64
 	for _, v := range samples {
 		count++
 		delta := v.F - mean
 		mean += delta / count
 		aux += delta * (v.F - mean)
 	}
-	return aux / count
+	return mean, aux / count
+}
+
+func stdvarOverTime(samples []promql.FPoint) float64 {
+	_, variance := welford(samples)
+	return variance
 }
 
 func stddevOverTime(samples []promql.FPoint) float64 {
-	var aux, count, mean float64
-	for _, v := range samples {
-		count++
-		delta := v.F - mean
-		mean += delta / count
-		aux += delta * (v.F - mean)
+	_, variance := welford(samples)
+	return math.Sqrt(variance)
+}
+
+// degenerateWindows configures the windows of cv_over_time and
+// zscore_over_time whose ratio is undefined, those with a mean of zero and a
+// standard deviation of zero respectively.
+type degenerateWindows struct {
+	// value is the result of these windows.
+	value float64
+	// seen is called for each of these windows, if set.
+	seen func()
+}
+
+var nanDegenerateWindows = degenerateWindows{value: math.NaN()}
+
+func (d degenerateWindows) result() float64 {
+	if d.seen != nil {
+		d.seen()
+	}
+	return d.value
+}
+
+// cvOverTime calculates the coefficient of variation, the standard deviation
+// relative to the mean. A mean of zero yields the value of d.
+func cvOverTime(d degenerateWindows) BatchRangeVectorAggregator {
+	return func(samples []promql.FPoint) float64 {
+		mean, variance := welford(samples)
+		return d.coefficientOfVariation(mean, variance)
+	}
+}
+
+func (d degenerateWindows) coefficientOfVariation(mean, variance float64) float64 {
+	if mean == 0 {
+		return d.result()
+	}
+	return math.Sqrt(variance) / mean
+}
+
+// zscoreOverTime calculates how many standard deviations the last value is
+// away from the mean. A standard deviation of zero yields the value of d.
+func zscoreOverTime(d degenerateWindows) BatchRangeVectorAggregator {
+	return func(samples []promql.FPoint) float64 {
+		mean, variance := welford(samples)
+		return d.zscore(samples[len(samples)-1].F, mean, variance)
+	}
+}
+
+func (d degenerateWindows) zscore(last, mean, variance float64) float64 {
+	if variance == 0 {
+		return d.result()
+	}
+	return (last - mean) / math.Sqrt(variance)
+}
+
+// autocorrOverTime calculates the autocorrelation of the samples at the lag
+// in seconds. Each sample is paired with the last sample at least lag before
+// it, and the mean product of the deviations of the pairs is normalized by the
+// variance of the window. It is NaN without pairs or for a flat window.
+func autocorrOverTime(lag float64) func(samples []promql.FPoint) float64 {
+	lagNanos := int64(lag * float64(time.Second))
+	return func(samples []promql.FPoint) float64 {
+		return autocorr(samples, lagNanos)
+	}
+}
+
+func autocorr(samples []promql.FPoint, lag int64) float64 {
+	mean, variance := welford(samples)
+	if variance == 0 {
+		return math.NaN()
+	}
+	var sum float64
+	var pairs, j int
+	for _, s := range samples {
+		target := s.T - lag
+		if target < samples[0].T {
+			continue
+		}
+		for j+1 < len(samples) && samples[j+1].T <= target {
+			j++
+		}
+		sum += (samples[j].F - mean) * (s.F - mean)
+		pairs++
+	}
+	if pairs == 0 {
+		return math.NaN()
+	}
+	return sum / float64(pairs) / variance
+}
+
+// changesOverTime counts how often the value changes between consecutive
+// samples like PromQL changes does. Consecutive NaN values are no change.
+func changesOverTime(samples []promql.FPoint) float64 {
+	var changes float64
+	for i := 1; i < len(samples); i++ {
+		if changed(samples[i-1].F, samples[i].F) {
+			changes++
+		}
+	}
+	return changes
+}
+
+func changed(prev, cur float64) bool {
+	return prev != cur && !(math.IsNaN(prev) && math.IsNaN(cur))
+}
+
+// resetsOverTime counts the counter resets, the decreases of the value between
+// consecutive samples, like PromQL resets does.
+func resetsOverTime(samples []promql.FPoint) float64 {
+	var resets float64
+	for i := 1; i < len(samples); i++ {
+		if samples[i].F < samples[i-1].F {
+			resets++
+		}
 	}
-	return math.Sqrt(aux / count)
+	return resets
 }
 
 func quantileOverTime(q float64) func(samples []promql.FPoint) float64 {
@@ -513,6 +738,12 @@ type streamRangeVectorIterator struct {
 	metrics                              map[string]labels.Labels
 	at                                   []promql.Sample
 	agg                                  BatchRangeVectorAggregator
+
+	// nanPropagating makes windows with a NaN sample aggregate to NaN.
+	nanPropagating bool
+	// degenerate configures the windows of the aggregation with an undefined
+	// ratio, if set.
+	degenerate *degenerateWindows
 }
 
 func (r *streamRangeVectorIterator) Next() bool {
@@ -569,6 +800,17 @@ func (r *streamRangeVectorIterator) load(start, end int64) {
 
 			// never err here ,we have check error at evaluator.go rangeAggEvaluator() func
 			rangeAgg, _ = streamingAggregator(r.r)
+			if r.degenerate != nil {
+				switch a := rangeAgg.(type) {
+				case *CVOverTime:
+					a.degenerate = *r.degenerate
+				case *ZScoreOverTime:
+					a.degenerate = *r.degenerate
+				}
+			}
+			if r.nanPropagating {
+				rangeAgg = &nanPropagatingAgg{RangeStreamingAgg: rangeAgg}
+			}
 			r.windowRangeAgg[lbs] = rangeAgg
 		}
 		p := promql.FPoint{
@@ -597,6 +839,63 @@ func (r *streamRangeVectorIterator) At() (int64, StepResult) {
 	return ts, SampleVector(r.at)
 }
 
+// propagateNaN makes the windows of a range vector iterator with a NaN sample
+// aggregate to NaN instead of letting the aggregation skip NaN samples.
+func propagateNaN(it RangeVectorIterator) {
+	switch r := it.(type) {
+	case *batchRangeVectorIterator:
+		agg := r.agg
+		r.agg = func(samples []promql.FPoint) float64 {
+			for _, s := range samples {
+				if math.IsNaN(s.F) {
+					return math.NaN()
+				}
+			}
+			return agg(samples)
+		}
+	case *streamRangeVectorIterator:
+		r.nanPropagating = true
+	}
+}
+
+// setDegenerateWindows makes the windows of a cv_over_time or
+// zscore_over_time range vector iterator whose ratio is undefined evaluate as
+// configured by d.
+func setDegenerateWindows(it RangeVectorIterator, op string, d degenerateWindows) {
+	switch r := it.(type) {
+	case *batchRangeVectorIterator:
+		switch op {
+		case syntax.OpRangeTypeCV:
+			r.agg = cvOverTime(d)
+		case syntax.OpRangeTypeZScore:
+			r.agg = zscoreOverTime(d)
+		}
+	case *streamRangeVectorIterator:
+		r.degenerate = &d
+	}
+}
+
+// nanPropagatingAgg aggregates to NaN once it received a NaN sample.
+type nanPropagatingAgg struct {
+	RangeStreamingAgg
+	nan bool
+}
+
+func (a *nanPropagatingAgg) agg(sample promql.FPoint) {
+	if math.IsNaN(sample.F) {
+		a.nan = true
+		return
+	}
+	a.RangeStreamingAgg.agg(sample)
+}
+
+func (a *nanPropagatingAgg) at() float64 {
+	if a.nan {
+		return math.NaN()
+	}
+	return a.RangeStreamingAgg.at()
+}
+
 func streamingAggregator(r *syntax.RangeAggregationExpr) (RangeStreamingAgg, error) {
 	switch r.Operation {
 	case syntax.OpRangeTypeRate:
@@ -607,7 +906,7 @@ func streamingAggregator(r *syntax.RangeAggregationExpr) (RangeStreamingAgg, err
 		return &CountOverTime{}, nil
 	case syntax.OpRangeTypeBytesRate:
 		return &RateLogBytesOverTime{selRange: r.Left.Interval}, nil
-	case syntax.OpRangeTypeBytes, syntax.OpRangeTypeSum:
+	case syntax.OpRangeTypeBytes, syntax.OpRangeTypeSum, syntax.OpRangeTypeMatchedBytes:
 		return &SumOverTime{}, nil
 	case syntax.OpRangeTypeAvg:
 		return &AvgOverTime{}, nil
@@ -619,8 +918,18 @@ func streamingAggregator(r *syntax.RangeAggregationExpr) (RangeStreamingAgg, err
 		return &StddevOverTime{}, nil
 	case syntax.OpRangeTypeStdvar:
 		return &StdvarOverTime{}, nil
+	case syntax.OpRangeTypeCV:
+		return &CVOverTime{degenerate: nanDegenerateWindows}, nil
+	case syntax.OpRangeTypeZScore:
+		return &ZScoreOverTime{degenerate: nanDegenerateWindows}, nil
 	case syntax.OpRangeTypeQuantile:
 		return &QuantileOverTime{q: *r.Params, values: make(vector.HeapByMaxValue, 0)}, nil
+	case syntax.OpRangeTypeAutocorr:
+		return &AutocorrOverTime{lag: int64(*r.Params * float64(time.Second))}, nil
+	case syntax.OpRangeTypeChanges:
+		return &ChangesOverTime{}, nil
+	case syntax.OpRangeTypeResets:
+		return &ResetsOverTime{}, nil
 	case syntax.OpRangeTypeFirst:
 		return &FirstOverTime{}, nil
 	case syntax.OpRangeTypeLast:
@@ -672,7 +981,7 @@ func (a *RateCounterOverTime) agg(sample promql.FPoint) {
 }
 
 func (a *RateCounterOverTime) at() float64 {
-	return extrapolatedRate(a.samples, a.selRange, true, true)
+	return rateCounterValue(a.samples, a.selRange)
 }
 
 // rateLogBytes calculates the per-second rate of log bytes.
@@ -702,23 +1011,38 @@ func (a *CountOverTime) at() float64 {
 }
 
 type SumOverTime struct {
-	sum float64
+	sum, c float64
 }
 
 func (a *SumOverTime) agg(sample promql.FPoint) {
-	a.sum += sample.F
+	a.sum, a.c = kahanSumInc(sample.F, a.sum, a.c)
 }
 
 func (a *SumOverTime) at() float64 {
-	return a.sum
+	return a.sum + a.c
 }
 
+// AvgOverTime computes the mean using a compensated sum of the samples and
+// switches to an incremental, compensated mean once the sum overflows.
 type AvgOverTime struct {
-	mean, count float64
+	sum, mean, count, c float64
+	incrementalMean     bool
 }
 
 func (a *AvgOverTime) agg(sample promql.FPoint) {
 	a.count++
+	if !a.incrementalMean {
+		sum, c := kahanSumInc(sample.F, a.sum, a.c)
+		// Keep summing as long as the sum does not overflow. The first sample
+		// is always summed, even if it's an Inf, to avoid dividing by zero below.
+		if a.count == 1 || !math.IsInf(sum, 0) {
+			a.sum, a.c = sum, c
+			return
+		}
+		a.incrementalMean = true
+		a.mean = a.sum / (a.count - 1)
+		a.c /= a.count - 1
+	}
 	if math.IsInf(a.mean, 0) {
 		if math.IsInf(sample.F, 0) && (a.mean > 0) == (sample.F > 0) {
 			// The `mean` and `v.V` values are `Inf` of the same sign.  They
@@ -736,11 +1060,15 @@ func (a *AvgOverTime) agg(sample promql.FPoint) {
 			return
 		}
 	}
-	a.mean += sample.F/a.count - a.mean/a.count
+	correctedMean := a.mean + a.c
+	a.mean, a.c = kahanSumInc(sample.F/a.count-correctedMean/a.count, a.mean, a.c)
 }
 
 func (a *AvgOverTime) at() float64 {
-	return a.mean
+	if a.incrementalMean {
+		return a.mean + a.c
+	}
+	return (a.sum + a.c) / a.count
 }
 
 type MaxOverTime struct {
@@ -801,6 +1129,79 @@ func (a *StddevOverTime) at() float64 {
 	return math.Sqrt(a.aux / a.count)
 }
 
+type CVOverTime struct {
+	StdvarOverTime
+	degenerate degenerateWindows
+}
+
+func (a *CVOverTime) at() float64 {
+	return a.degenerate.coefficientOfVariation(a.mean, a.StdvarOverTime.at())
+}
+
+type ZScoreOverTime struct {
+	StdvarOverTime
+	last       float64
+	degenerate degenerateWindows
+}
+
+func (a *ZScoreOverTime) agg(sample promql.FPoint) {
+	a.StdvarOverTime.agg(sample)
+	a.last = sample.F
+}
+
+func (a *ZScoreOverTime) at() float64 {
+	return a.degenerate.zscore(a.last, a.mean, a.StdvarOverTime.at())
+}
+
+type AutocorrOverTime struct {
+	lag     int64
+	samples []promql.FPoint
+}
+
+func (a *AutocorrOverTime) agg(sample promql.FPoint) {
+	a.samples = append(a.samples, sample)
+}
+
+func (a *AutocorrOverTime) at() float64 {
+	return autocorr(a.samples, a.lag)
+}
+
+type ChangesOverTime struct {
+	changes float64
+	prev    float64
+	hasData bool
+}
+
+func (a *ChangesOverTime) agg(sample promql.FPoint) {
+	if a.hasData && changed(a.prev, sample.F) {
+		a.changes++
+	}
+	a.prev = sample.F
+	a.hasData = true
+}
+
+func (a *ChangesOverTime) at() float64 {
+	return a.changes
+}
+
+type ResetsOverTime struct {
+	resets  float64
+	prev    float64
+	hasData bool
+}
+
+func (a *ResetsOverTime) agg(sample promql.FPoint) {
+	if a.hasData && sample.F < a.prev {
+		a.resets++
+	}
+	a.prev = sample.F
+	a.hasData = true
+}
+
+func (a *ResetsOverTime) at() float64 {
+	return a.resets
+}
+
 type QuantileOverTime struct {
 	q      float64
 	values vector.HeapByMaxValue
@@ -3,6 +3,7 @@ package logql
 import (
 	"context"
 	"fmt"
+	"math"
 	"math/rand"
 	"sort"
 	"testing"
@@ -18,6 +19,7 @@ import (
 	"github.com/grafana/loki/v3/pkg/logql/sketch"
 	"github.com/grafana/loki/v3/pkg/logql/syntax"
 	"github.com/grafana/loki/v3/pkg/logql/vector"
+	"github.com/grafana/loki/v3/pkg/logqlmodel/metadata"
 )
 
 var samples = []logproto.Sample{
@@ -554,6 +556,331 @@ func Test_InstantQueryRangeVectorAggregations(t *testing.T) {
 	}
 }
 
+func Test_CompensatedSummation(t *testing.T) {
+	tenths := make([]promql.FPoint, 10)
+	for i := range tenths {
+		tenths[i] = promql.FPoint{T: int64(i), F: 0.1}
+	}
+	cancelling := []promql.FPoint{{T: 1, F: 1e100}, {T: 2, F: 1}, {T: 3, F: -1e100}}
+
+	for _, tc := range []struct {
+		name     string
+		op       string
+		samples  []promql.FPoint
+		expected float64
+	}{
+		// naive summation yields 0.9999999999999999
+		{"sum of tenths", syntax.OpRangeTypeSum, tenths, 1},
+		// naive summation yields 0
+		{"sum of cancelling values", syntax.OpRangeTypeSum, cancelling, 1},
+		{"avg of tenths", syntax.OpRangeTypeAvg, tenths, 0.1},
+		{"avg of cancelling values", syntax.OpRangeTypeAvg, cancelling, 1. / 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expr := &syntax.RangeAggregationExpr{Left: &syntax.LogRangeExpr{Interval: time.Minute}, Operation: tc.op}
+
+			batch, err := aggregator(expr)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, batch(tc.samples))
+
+			streaming, err := streamingAggregator(expr)
+			require.NoError(t, err)
+			for _, s := range tc.samples {
+				streaming.agg(s)
+			}
+			require.Equal(t, tc.expected, streaming.at())
+		})
+	}
+}
+
+func Test_CVOverTime(t *testing.T) {
+	points := func(values ...float64) []promql.FPoint {
+		samples := make([]promql.FPoint, 0, len(values))
+		for i, v := range values {
+			samples = append(samples, promql.FPoint{T: int64(i), F: v})
+		}
+		return samples
+	}
+
+	for _, tc := range []struct {
+		name     string
+		samples  []promql.FPoint
+		expected float64
+	}{
+		{"constant window", points(5, 5, 5), 0},
+		{"variable window", points(1, 2, 3), math.Sqrt(2./3) / 2},
+		{"zero mean window", points(-1, 1), math.NaN()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expr := &syntax.RangeAggregationExpr{Left: &syntax.LogRangeExpr{Interval: time.Minute}, Operation: syntax.OpRangeTypeCV}
+
+			batch, err := aggregator(expr)
+			require.NoError(t, err)
+
+			streaming, err := streamingAggregator(expr)
+			require.NoError(t, err)
+			for _, s := range tc.samples {
+				streaming.agg(s)
+			}
+
+			if math.IsNaN(tc.expected) {
+				require.True(t, math.IsNaN(batch(tc.samples)))
+				require.True(t, math.IsNaN(streaming.at()))
+				return
+			}
+			require.InDelta(t, tc.expected, batch(tc.samples), 1e-12)
+			require.InDelta(t, tc.expected, streaming.at(), 1e-12)
+		})
+	}
+}
+
+func Test_ZScoreOverTime(t *testing.T) {
+	points := func(values ...float64) []promql.FPoint {
+		samples := make([]promql.FPoint, 0, len(values))
+		for i, v := range values {
+			samples = append(samples, promql.FPoint{T: int64(i), F: v})
+		}
+		return samples
+	}
+
+	for _, tc := range []struct {
+		name     string
+		samples  []promql.FPoint
+		expected float64
+	}{
+		// mean 1.8, stddev 1.6.
+		{"spike at the end", points(1, 1, 1, 1, 5), 2},
+		{"last at the mean", points(1, 3, 2), 0},
+		{"flat window", points(5, 5, 5), math.NaN()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expr := &syntax.RangeAggregationExpr{Left: &syntax.LogRangeExpr{Interval: time.Minute}, Operation: syntax.OpRangeTypeZScore}
+
+			batch, err := aggregator(expr)
+			require.NoError(t, err)
+
+			streaming, err := streamingAggregator(expr)
+			require.NoError(t, err)
+			for _, s := range tc.samples {
+				streaming.agg(s)
+			}
+
+			if math.IsNaN(tc.expected) {
+				require.True(t, math.IsNaN(batch(tc.samples)))
+				require.True(t, math.IsNaN(streaming.at()))
+				return
+			}
+			require.InDelta(t, tc.expected, batch(tc.samples), 1e-12)
+			require.InDelta(t, tc.expected, streaming.at(), 1e-12)
+		})
+	}
+}
+
+func Test_AutocorrOverTime(t *testing.T) {
+	// a sample every 10s over an hour of a signal with a period of 5m.
+	var samples []promql.FPoint
+	for ts := 10 * time.Second; ts <= time.Hour; ts += 10 * time.Second {
+		samples = append(samples, promql.FPoint{
+			T: ts.Nanoseconds(),
+			F: math.Sin(2 * math.Pi * ts.Seconds() / 300),
+		})
+	}
+
+	for _, tc := range []struct {
+		lag      float64
+		min, max float64
+	}{
+		{lag: 300, min: 0.9, max: 1.01},   // one period
+		{lag: 600, min: 0.9, max: 1.01},   // two periods
+		{lag: 75, min: -0.1, max: 0.1},    // a quarter of a period
+		{lag: 150, min: -1.01, max: -0.9}, // half a period
+	} {
+		t.Run(fmt.Sprintf("lag=%v", tc.lag), func(t *testing.T) {
+			expr, err := syntax.ParseSampleExpr(fmt.Sprintf(`autocorr_over_time({app="foo"} | unwrap v [1h], %v)`, tc.lag))
+			require.NoError(t, err)
+			rangeExpr := expr.(*syntax.RangeAggregationExpr)
+
+			batch, err := aggregator(rangeExpr)
+			require.NoError(t, err)
+
+			streaming, err := streamingAggregator(rangeExpr)
+			require.NoError(t, err)
+			for _, s := range samples {
+				streaming.agg(s)
+			}
+
+			for _, v := range []float64{batch(samples), streaming.at()} {
+				require.GreaterOrEqual(t, v, tc.min)
+				require.LessOrEqual(t, v, tc.max)
+			}
+		})
+	}
+
+	t.Run("flat window", func(t *testing.T) {
+		require.True(t, math.IsNaN(autocorr([]promql.FPoint{{T: 0, F: 1}, {T: 1e9, F: 1}}, 1e9)))
+	})
+}
+
+func Test_ChangesOverTime(t *testing.T) {
+	points := func(values ...float64) []promql.FPoint {
+		samples := make([]promql.FPoint, 0, len(values))
+		for i, v := range values {
+			samples = append(samples, promql.FPoint{T: int64(i), F: v})
+		}
+		return samples
+	}
+
+	for _, tc := range []struct {
+		name     string
+		samples  []promql.FPoint
+		expected float64
+	}{
+		{"steps", points(1, 1, 2, 2, 3), 2},
+		{"back and forth", points(1, 2, 1, 2), 3},
+		{"single sample", points(5), 0},
+		{"consecutive NaN", points(math.NaN(), math.NaN(), 1), 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expr := &syntax.RangeAggregationExpr{Left: &syntax.LogRangeExpr{Interval: time.Minute}, Operation: syntax.OpRangeTypeChanges}
+
+			batch, err := aggregator(expr)
+			require.NoError(t, err)
+
+			streaming, err := streamingAggregator(expr)
+			require.NoError(t, err)
+			for _, s := range tc.samples {
+				streaming.agg(s)
+			}
+
+			require.Equal(t, tc.expected, batch(tc.samples))
+			require.Equal(t, tc.expected, streaming.at())
+		})
+	}
+}
+
+func Test_ResetsOverTime(t *testing.T) {
+	points := func(values ...float64) []promql.FPoint {
+		samples := make([]promql.FPoint, 0, len(values))
+		for i, v := range values {
+			samples = append(samples, promql.FPoint{T: int64(i), F: v})
+		}
+		return samples
+	}
+
+	for _, tc := range []struct {
+		name     string
+		samples  []promql.FPoint
+		expected float64
+	}{
+		{"resets", points(1, 2, 1, 2, 1), 2},
+		{"increasing", points(1, 2, 2, 3), 0},
+		{"single sample", points(5), 0},
+		{"reset to zero", points(3, 0, 1), 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expr := &syntax.RangeAggregationExpr{Left: &syntax.LogRangeExpr{Interval: time.Minute}, Operation: syntax.OpRangeTypeResets}
+
+			batch, err := aggregator(expr)
+			require.NoError(t, err)
+
+			streaming, err := streamingAggregator(expr)
+			require.NoError(t, err)
+			for _, s := range tc.samples {
+				streaming.agg(s)
+			}
+
+			require.Equal(t, tc.expected, batch(tc.samples))
+			require.Equal(t, tc.expected, streaming.at())
+		})
+	}
+}
+
+func Test_RangeVectorIterator_Downsample(t *testing.T) {
+	const (
+		n          = 10000
+		maxSamples = 100
+	)
+	// a sample every millisecond with values spread over [0, n).
+	samples := make([]logproto.Sample, 0, n)
+	for i := 0; i < n; i++ {
+		samples = append(samples, logproto.Sample{
+			Timestamp: time.Unix(0, 0).Add(time.Duration(i+1) * time.Millisecond).UnixNano(),
+			Hash:      uint64(i),
+			Value:     float64((i * 7919) % n),
+		})
+	}
+	expr, err := syntax.ParseSampleExpr(`quantile_over_time(0.9, {app="foo"} | unwrap x [10s])`)
+	require.NoError(t, err)
+	rangeExpr := expr.(*syntax.RangeAggregationExpr)
+
+	newIterator := func() *batchRangeVectorIterator {
+		it, err := newRangeVectorIterator(newfakePeekingSampleIterator(samples), rangeExpr,
+			(10 * time.Second).Nanoseconds(), time.Second.Nanoseconds(),
+			time.Unix(5, 0).UnixNano(), time.Unix(12, 0).UnixNano(), 0)
+		require.NoError(t, err)
+		return it.(*batchRangeVectorIterator)
+	}
+
+	exact := newIterator()
+	metadataCtx, ctx := metadata.NewContext(context.Background())
+	downsampled := newIterator()
+	downsampled.downsample(ctx, maxSamples)
+
+	for exact.Next() {
+		require.True(t, downsampled.Next())
+		for _, series := range downsampled.window {
+			require.LessOrEqual(t, len(series.Floats), maxSamples)
+		}
+
+		_, expected := exact.At()
+		_, actual := downsampled.At()
+		expectedVec, actualVec := expected.SampleVector(), actual.SampleVector()
+		sort.Slice(expectedVec, func(i, j int) bool { return labels.Compare(expectedVec[i].Metric, expectedVec[j].Metric) < 0 })
+		sort.Slice(actualVec, func(i, j int) bool { return labels.Compare(actualVec[i].Metric, actualVec[j].Metric) < 0 })
+		require.Len(t, actualVec, len(expectedVec))
+		for i := range expectedVec {
+			require.Equal(t, expectedVec[i].Metric, actualVec[i].Metric)
+			// within 2% of the range of values.
+			require.InDelta(t, expectedVec[i].F, actualVec[i].F, 0.02*n)
+		}
+	}
+	require.False(t, downsampled.Next())
+	require.Equal(t, []metadata.Warning{metadata.DownsampledWarning(maxSamples)}, metadataCtx.StructuredWarnings())
+}
+
+func Test_RangeVectorIterator_DownsampleRestride(t *testing.T) {
+	const maxSamples = 100
+	// a burst of a sample every millisecond for a second, then a sample
+	// every 100ms.
+	var samples []logproto.Sample
+	for i := 1; i <= 1000; i++ {
+		samples = append(samples, logproto.Sample{Timestamp: time.Unix(0, 0).Add(time.Duration(i) * time.Millisecond).UnixNano(), Value: 1})
+	}
+	for i := 11; i <= 300; i++ {
+		samples = append(samples, logproto.Sample{Timestamp: time.Unix(0, 0).Add(time.Duration(i) * 100 * time.Millisecond).UnixNano(), Value: 1})
+	}
+	expr, err := syntax.ParseSampleExpr(`quantile_over_time(0.9, {app="foo"} | unwrap x [5s])`)
+	require.NoError(t, err)
+
+	it, err := newRangeVectorIterator(newfakePeekingSampleIterator(samples), expr.(*syntax.RangeAggregationExpr),
+		(5 * time.Second).Nanoseconds(), time.Second.Nanoseconds(),
+		time.Unix(1, 0).UnixNano(), time.Unix(30, 0).UnixNano(), 0)
+	require.NoError(t, err)
+	downsampled := it.(*batchRangeVectorIterator)
+	_, ctx := metadata.NewContext(context.Background())
+	downsampled.downsample(ctx, maxSamples)
+
+	var last int
+	for downsampled.Next() {
+		for _, series := range downsampled.window {
+			require.LessOrEqual(t, len(series.Floats), maxSamples)
+			last = len(series.Floats)
+		}
+	}
+	// once the burst left the window, every sample of the window is kept.
+	require.Equal(t, 50, last)
+}
+
 func sampleIter(negative bool) iter.PeekingSampleIterator {
 	return iter.NewPeekingSampleIterator(
 		iter.NewSortSampleIterator([]iter.SampleIterator{
@@ -642,3 +969,55 @@ func TestQuantiles(t *testing.T) {
 		}
 	}
 }
+
+func Test_RangeVectorIterator_PropagateNaN(t *testing.T) {
+	// samples 1, NaN and 3 at 1s, 2s and 3s.
+	samples := []logproto.Sample{
+		{Timestamp: time.Unix(1, 0).UnixNano(), Hash: 1, Value: 1},
+		{Timestamp: time.Unix(2, 0).UnixNano(), Hash: 2, Value: math.NaN()},
+		{Timestamp: time.Unix(3, 0).UnixNano(), Hash: 3, Value: 3},
+	}
+
+	for _, tc := range []struct {
+		query    string
+		expected float64
+	}{
+		{`max_over_time({app="foo"} | unwrap x [5s])`, 3},
+		{`min_over_time({app="foo"} | unwrap x [5s])`, 1},
+	} {
+		expr, err := syntax.ParseSampleExpr(tc.query)
+		require.NoError(t, err)
+		rangeExpr := expr.(*syntax.RangeAggregationExpr)
+
+		for _, step := range []time.Duration{time.Second, 10 * time.Second} {
+			for _, propagate := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s step=%s propagate=%v", rangeExpr.Operation, step, propagate), func(t *testing.T) {
+					// a step shorter than the range overlaps windows and is
+					// evaluated by the batch iterator, a longer one by the
+					// streaming iterator.
+					it, err := newRangeVectorIterator(newfakePeekingSampleIterator(samples), rangeExpr,
+						(5 * time.Second).Nanoseconds(), step.Nanoseconds(),
+						time.Unix(5, 0).UnixNano(), time.Unix(5, 0).Add(step).UnixNano(), 0)
+					require.NoError(t, err)
+					_, batch := it.(*batchRangeVectorIterator)
+					require.Equal(t, step < 5*time.Second, batch)
+					if propagate {
+						propagateNaN(it)
+					}
+
+					require.True(t, it.Next())
+					_, res := it.At()
+					vec := res.SampleVector()
+					require.Len(t, vec, 2)
+					for _, s := range vec {
+						if propagate {
+							require.True(t, math.IsNaN(s.F))
+						} else {
+							require.Equal(t, tc.expected, s.F)
+						}
+					}
+				})
+			}
+		}
+	}
+}
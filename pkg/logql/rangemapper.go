@@ -25,13 +25,14 @@ var splittableVectorOp = map[string]struct{}{
 }
 
 var splittableRangeVectorOp = map[string]struct{}{
-	syntax.OpRangeTypeRate:      {},
-	syntax.OpRangeTypeBytesRate: {},
-	syntax.OpRangeTypeBytes:     {},
-	syntax.OpRangeTypeCount:     {},
-	syntax.OpRangeTypeSum:       {},
-	syntax.OpRangeTypeMax:       {},
-	syntax.OpRangeTypeMin:       {},
+	syntax.OpRangeTypeRate:         {},
+	syntax.OpRangeTypeBytesRate:    {},
+	syntax.OpRangeTypeBytes:        {},
+	syntax.OpRangeTypeCount:        {},
+	syntax.OpRangeTypeMatchedBytes: {},
+	syntax.OpRangeTypeSum:          {},
+	syntax.OpRangeTypeMax:          {},
+	syntax.OpRangeTypeMin:          {},
 }
 
 // RangeMapper is used to rewrite LogQL sample expressions into multiple
@@ -175,6 +176,12 @@ func (m RangeMapper) Map(expr syntax.SampleExpr, vectorAggrPushdown *syntax.Vect
 		}
 		e.Left = lhsMapped
 		return e, nil
+	case syntax.WrapperExpr:
+		lhsMapped, err := m.Map(e.Inner(), vectorAggrPushdown, recorder)
+		if err != nil {
+			return nil, err
+		}
+		return e.WithInner(lhsMapped), nil
 	case *syntax.LiteralExpr:
 		return e, nil
 	case *syntax.VectorExpr:
@@ -511,7 +518,7 @@ func (m RangeMapper) mapRangeAggregationExpr(expr *syntax.RangeAggregationExpr,
 	switch expr.Operation {
 	case syntax.OpRangeTypeSum:
 		return m.vectorAggrWithRangeDownstreams(expr, vectorAggrPushdown, syntax.OpTypeSum, rangeInterval, recorder)
-	case syntax.OpRangeTypeBytes, syntax.OpRangeTypeCount:
+	case syntax.OpRangeTypeBytes, syntax.OpRangeTypeCount, syntax.OpRangeTypeMatchedBytes:
 		// Downstream queries with label extractors use concat as aggregation operator instead of sum
 		// in order to merge the resultant label sets
 		if labelExtractor {
@@ -579,6 +586,8 @@ func isSplittableByRange(expr syntax.SampleExpr) bool {
 		return isSplittableByRange(e.SampleExpr) || literalLHS && isSplittableByRange(e.RHS) || literalRHS
 	case *syntax.LabelReplaceExpr:
 		return isSplittableByRange(e.Left)
+	case syntax.WrapperExpr:
+		return isSplittableByRange(e.Inner())
 	case *syntax.VectorExpr:
 		return false
 	default:
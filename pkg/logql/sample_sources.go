@@ -0,0 +1,106 @@
+package logql
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	promql_parser "github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/grafana/loki/v3/pkg/util"
+)
+
+const (
+	// maxSampleSourcesSeries is the number of series of an instant query
+	// result above which its sample sources are not captured.
+	maxSampleSourcesSeries = 10
+	// maxSampleSources is the number of log lines captured per sample.
+	maxSampleSources = 10
+)
+
+// sampleSources returns up to maxSampleSources log lines that contributed to
+// each sample of the vector result of an instant query, keyed by the labels of
+// its series. A line contributed to a sample if it was selected by a range of
+// the query and its labels include those of the series of the sample.
+func (q *query) sampleSources(ctx context.Context, data promql_parser.Value) (map[string][]logproto.Entry, error) {
+	vec, ok := data.(promql.Vector)
+	if !ok || len(vec) == 0 || len(vec) > maxSampleSourcesSeries || GetRangeType(q.params) != InstantType {
+		return nil, nil
+	}
+	expr, ok := q.params.GetExpression().(syntax.SampleExpr)
+	if !ok {
+		return nil, nil
+	}
+
+	sources := make(map[string][]logproto.Entry, len(vec))
+	var err error
+	expr.Walk(func(e syntax.Expr) bool {
+		if err != nil {
+			return false
+		}
+		if r, ok := e.(*syntax.RangeAggregationExpr); ok {
+			err = q.captureSampleSources(ctx, r.Left, vec, sources)
+			return false
+		}
+		return true
+	})
+	return sources, err
+}
+
+// captureSampleSources adds the lines selected by the range to the sources of
+// the samples of vec they contributed to.
+func (q *query) captureSampleSources(ctx context.Context, r *syntax.LogRangeExpr, vec promql.Vector, sources map[string][]logproto.Entry) error {
+	end := q.params.Start().Add(-r.Offset)
+	start := end.Add(-r.Interval)
+	it, err := q.evaluator.NewIterator(ctx, r.Left, LiteralParams{
+		queryString: r.Left.String(),
+		start:       start,
+		// add leap nanosecond to include lines exactly at the end of the range.
+		end:         end.Add(time.Nanosecond),
+		direction:   logproto.FORWARD,
+		limit:       maxSampleSourcesSeries * maxSampleSources,
+		shards:      q.params.Shards(),
+		queryExpr:   r.Left,
+		storeChunks: q.params.GetStoreChunks(),
+	})
+	if err != nil {
+		return err
+	}
+	defer util.LogErrorWithContext(ctx, "closing iterator", it.Close)
+
+	keys := make([]string, len(vec))
+	for i, s := range vec {
+		keys[i] = s.Metric.String()
+	}
+	for it.Next() {
+		entry := it.At()
+		// ranges exclude their start.
+		if !entry.Timestamp.After(start) {
+			continue
+		}
+		lbs, err := syntax.ParseLabels(it.Labels())
+		if err != nil {
+			return err
+		}
+		for i, s := range vec {
+			if len(sources[keys[i]]) < maxSampleSources && labelsSubset(s.Metric, lbs) {
+				sources[keys[i]] = append(sources[keys[i]], entry)
+			}
+		}
+	}
+	return it.Err()
+}
+
+// labelsSubset reports whether all labels of sub are in lbs.
+func labelsSubset(sub, lbs labels.Labels) bool {
+	subset := true
+	sub.Range(func(l labels.Label) {
+		if lbs.Get(l.Name) != l.Value {
+			subset = false
+		}
+	})
+	return subset
+}
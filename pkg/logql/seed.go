@@ -0,0 +1,33 @@
+package logql
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+type seedCtxKey struct{}
+
+// InjectSeed returns a context carrying the seed of the query. The engine
+// injects the seed of its params into the context passed to the querier.
+func InjectSeed(ctx context.Context, seed int64) context.Context {
+	return context.WithValue(ctx, seedCtxKey{}, seed)
+}
+
+// ExtractSeed returns the seed of the query, if any.
+func ExtractSeed(ctx context.Context) (int64, bool) {
+	seed, ok := ctx.Value(seedCtxKey{}).(int64)
+	return seed, ok
+}
+
+// RandFromContext returns a source of randomness for a querier taking
+// randomized decisions, such as sampling the selected lines. It is seeded with
+// the seed of the query if there is one, so that the same query takes the same
+// decisions. The engine itself takes no randomized decisions.
+func RandFromContext(ctx context.Context) *rand.Rand {
+	seed, ok := ExtractSeed(ctx)
+	if !ok {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed)) //#nosec G404 -- Randomized query decisions, no need for a cryptographic PRNG -- nosemgrep: math-random-used
+}
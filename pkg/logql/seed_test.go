@@ -0,0 +1,100 @@
+package logql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/v3/pkg/iter"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logqlmodel"
+	"github.com/grafana/loki/v3/pkg/logqlmodel/metadata"
+	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase/definitions"
+)
+
+// samplingQuerier randomly keeps half of the lines of its stream.
+type samplingQuerier struct {
+	stream logproto.Stream
+}
+
+func (q samplingQuerier) SelectLogs(ctx context.Context, _ SelectLogParams) (iter.EntryIterator, error) {
+	rnd := RandFromContext(ctx)
+	sampled := logproto.Stream{Labels: q.stream.Labels}
+	for _, e := range q.stream.Entries {
+		if rnd.Intn(2) == 0 {
+			sampled.Entries = append(sampled.Entries, e)
+		}
+	}
+	return iter.NewStreamIterator(sampled), nil
+}
+
+func (samplingQuerier) SelectSamples(context.Context, SelectSampleParams) (iter.SampleIterator, error) {
+	return iter.NoopSampleIterator, nil
+}
+
+func TestEngine_Seed(t *testing.T) {
+	eng := NewEngine(EngineOpts{}, samplingQuerier{stream: newStream(testSize, identity, `{app="foo"}`)}, NoLimits, log.NewNopLogger())
+	params, err := NewLiteralParams(`{app="foo"}`, time.Unix(0, 0), time.Unix(testSize, 0), 0, 0, logproto.FORWARD, uint32(testSize), nil, nil)
+	require.NoError(t, err)
+
+	exec := func(t *testing.T, seed int64) logqlmodel.Result {
+		res, err := eng.Query(params.WithSeed(seed)).Exec(user.InjectOrgID(context.Background(), "fake"))
+		require.NoError(t, err)
+		return res
+	}
+
+	first, second := exec(t, 42), exec(t, 42)
+	require.NotEmpty(t, first.Data.(logqlmodel.Streams))
+	require.Equal(t, first.Data, second.Data)
+	require.Equal(t, []*definitions.PrometheusResponseHeader{{Name: metadata.QuerySeedHeader, Values: []string{"42"}}}, first.Headers)
+
+	// a different seed takes different decisions.
+	require.NotEqual(t, first.Data, exec(t, 7).Data)
+
+	// without a seed the query is not recorded as seeded.
+	res, err := eng.Query(params).Exec(user.InjectOrgID(context.Background(), "fake"))
+	require.NoError(t, err)
+	require.Empty(t, res.Headers)
+}
+
+func TestGetSeed_WrappedParams(t *testing.T) {
+	params, err := NewLiteralParams(`{app="foo"}`, time.Unix(0, 0), time.Unix(testSize, 0), time.Second, 0, logproto.FORWARD, 10, nil, nil)
+	require.NoError(t, err)
+
+	var wrapped Params = params.WithSeed(42).WithHold(time.Minute)
+	wrapped = ParamsWithStepOverride{Params: wrapped, StepOverride: time.Minute}
+	wrapped = ParamsWithShardsOverride{Params: wrapped, ShardsOverride: []string{"0_of_2"}}
+	wrapped = ParamsWithChunkOverrides{Params: wrapped}
+	wrapped = ParamsWithAtOverride{Params: wrapped, AtOverride: time.Unix(60, 0)}
+
+	seed, ok := GetSeed(wrapped)
+	require.True(t, ok)
+	require.Equal(t, int64(42), seed)
+	require.Equal(t, time.Minute, GetHold(wrapped))
+
+	_, ok = GetSeed(ParamsWithStepOverride{Params: params})
+	require.False(t, ok)
+}
+
+func TestEngine_ExecRange_Seed(t *testing.T) {
+	eng := NewEngine(EngineOpts{}, samplingQuerier{stream: newStream(testSize, identity, `{app="foo"}`)}, NoLimits, log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "fake")
+	params, err := NewLiteralParams(`{app="foo"}`, time.Unix(0, 0), time.Unix(testSize, 0), 0, 0, logproto.FORWARD, uint32(testSize), nil, nil)
+	require.NoError(t, err)
+	q := eng.Query(params.WithSeed(42)).(RangeExecutor)
+
+	for _, end := range []time.Time{time.Unix(testSize, 0), time.Unix(testSize/2, 0)} {
+		res, err := q.ExecRange(ctx, time.Unix(0, 0), end, 0)
+		require.NoError(t, err)
+
+		expected, err := eng.Query(params.WithRange(time.Unix(0, 0), end, 0).WithSeed(42)).Exec(ctx)
+		require.NoError(t, err)
+		require.NotEmpty(t, expected.Data.(logqlmodel.Streams))
+		require.Equal(t, expected.Data, res.Data)
+		require.Equal(t, expected.Headers, res.Headers)
+	}
+}
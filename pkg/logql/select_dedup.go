@@ -0,0 +1,266 @@
+package logql
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/grafana/loki/v3/pkg/iter"
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+// teeTrimSize is the number of samples read by all readers of a tee after
+// which they are dropped from its buffer.
+const teeTrimSize = 512
+
+// teeMaxBuffered is the number of samples a tee buffers at most for its
+// slowest readers. The evaluators of a query read the samples of a request
+// step by step, so a reader usually lags behind the others by the samples of
+// a range window at most. Past the bound, the slowest readers are detached
+// from the tee and read the samples from a request of their own instead.
+const teeMaxBuffered = 64 * 1024
+
+type selectCacheCtxKey struct{}
+
+// withSelectCache returns a context de-duplicating the sample requests of the
+// query evaluated with it: identical requests are sent to the querier once
+// and their samples are shared by all evaluators requesting them.
+func withSelectCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, selectCacheCtxKey{}, &selectCache{
+		tees: map[selectKey]*sampleTee{},
+	})
+}
+
+func selectCacheFromContext(ctx context.Context) (*selectCache, bool) {
+	c, ok := ctx.Value(selectCacheCtxKey{}).(*selectCache)
+	return c, ok
+}
+
+// selectKey identifies a sample request by its plan and its bounds. The plan
+// is keyed as a string rather than by its hash, as requests sharing a key
+// share their samples.
+type selectKey struct {
+	plan       string
+	start, end int64
+	shards     string
+}
+
+func newSelectKey(params SelectSampleParams) selectKey {
+	var plan string
+	if params.Plan != nil {
+		plan = params.Plan.String()
+	}
+	return selectKey{
+		plan:   plan,
+		start:  params.Start.UnixNano(),
+		end:    params.End.UnixNano(),
+		shards: strings.Join(params.Shards, ","),
+	}
+}
+
+type selectCache struct {
+	mtx  sync.Mutex
+	tees map[selectKey]*sampleTee
+}
+
+// selectSamples returns a reader of the samples of an identical request sent
+// earlier, if they can still be read from the start, or sends the request.
+func (c *selectCache) selectSamples(ctx context.Context, selectFn func(context.Context, SelectSampleParams) (iter.SampleIterator, error), params SelectSampleParams) (iter.SampleIterator, error) {
+	key := newSelectKey(params)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if t, ok := c.tees[key]; ok {
+		if r, ok := t.reader(); ok {
+			return r, nil
+		}
+	}
+	it, err := selectFn(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	t := &sampleTee{
+		src:         it,
+		maxBuffered: teeMaxBuffered,
+		reselect:    func() (iter.SampleIterator, error) { return selectFn(ctx, params) },
+	}
+	c.tees[key] = t
+	r, _ := t.reader()
+	return r, nil
+}
+
+type teeSample struct {
+	sample     logproto.Sample
+	labels     string
+	streamHash uint64
+}
+
+// sampleTee shares the samples of an iterator between readers. Samples are
+// buffered until all readers have read them, up to maxBuffered samples, see
+// detachSlowest. Readers can only be added until the first samples are
+// dropped from the buffer.
+type sampleTee struct {
+	mtx         sync.Mutex
+	src         iter.SampleIterator
+	maxBuffered int
+	// reselect sends the request of the tee again for a detached reader.
+	reselect func() (iter.SampleIterator, error)
+
+	buf     []teeSample
+	offset  int // position of buf[0]
+	readers []*teeReader
+	open    int
+	done    bool
+	closed  bool
+	err     error
+}
+
+func (t *sampleTee) reader() (*teeReader, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.offset > 0 || t.closed {
+		return nil, false
+	}
+	r := &teeReader{tee: t}
+	t.readers = append(t.readers, r)
+	t.open++
+	return r, true
+}
+
+func (t *sampleTee) next(r *teeReader) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if r.own != nil {
+		if !r.own.Next() {
+			return false
+		}
+		r.cur = teeSample{sample: r.own.At(), labels: r.own.Labels(), streamHash: r.own.StreamHash()}
+		return true
+	}
+	if r.pos-t.offset >= len(t.buf) {
+		if t.done || t.closed {
+			return false
+		}
+		if !t.src.Next() {
+			t.done = true
+			t.err = t.src.Err()
+			return false
+		}
+		t.buf = append(t.buf, teeSample{
+			sample:     t.src.At(),
+			labels:     t.src.Labels(),
+			streamHash: t.src.StreamHash(),
+		})
+	}
+	r.cur = t.buf[r.pos-t.offset]
+	r.pos++
+	t.trim()
+	if len(t.buf) > t.maxBuffered {
+		t.detachSlowest()
+		t.trim()
+	}
+	return true
+}
+
+// lowest returns the position of the slowest attached reader.
+func (t *sampleTee) lowest() int {
+	low := t.offset + len(t.buf)
+	for _, r := range t.readers {
+		if !r.closed && r.own == nil && r.pos < low {
+			low = r.pos
+		}
+	}
+	return low
+}
+
+// trim drops the samples read by all attached readers once there are enough
+// of them.
+func (t *sampleTee) trim() {
+	low := t.lowest()
+	drop := low - t.offset
+	if drop < teeTrimSize {
+		return
+	}
+	n := copy(t.buf, t.buf[drop:])
+	clear(t.buf[n:])
+	t.buf = t.buf[:n]
+	t.offset = low
+}
+
+// detachSlowest detaches the slowest readers from the tee, so that the
+// samples they have not read yet can be dropped from its buffer. Each of them
+// sends the request again and skips the samples it has already read.
+func (t *sampleTee) detachSlowest() {
+	low := t.lowest()
+	if low == t.offset+len(t.buf) {
+		// the buffered samples are read by all attached readers.
+		return
+	}
+	for _, r := range t.readers {
+		if r.closed || r.own != nil || r.pos != low {
+			continue
+		}
+		it, err := t.reselect()
+		if err != nil {
+			r.own, r.err = iter.NoopSampleIterator, err
+			continue
+		}
+		skipped := 0
+		for skipped < r.pos && it.Next() {
+			skipped++
+		}
+		r.own = it
+	}
+}
+
+func (t *sampleTee) close(r *teeReader) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	var err error
+	if r.own != nil {
+		err = r.own.Close()
+	}
+	t.open--
+	if t.open > 0 {
+		return err
+	}
+	t.closed = true
+	t.buf = nil
+	if srcErr := t.src.Close(); srcErr != nil {
+		return srcErr
+	}
+	return err
+}
+
+// teeReader is an iterator over the samples of a sampleTee, or over the
+// samples of its own request once it is detached from the tee.
+type teeReader struct {
+	tee    *sampleTee
+	pos    int
+	cur    teeSample
+	closed bool
+	own    iter.SampleIterator
+	err    error
+}
+
+func (r *teeReader) Next() bool          { return r.tee.next(r) }
+func (r *teeReader) At() logproto.Sample { return r.cur.sample }
+func (r *teeReader) Labels() string      { return r.cur.labels }
+func (r *teeReader) StreamHash() uint64  { return r.cur.streamHash }
+func (r *teeReader) Close() error        { return r.tee.close(r) }
+
+func (r *teeReader) Err() error {
+	r.tee.mtx.Lock()
+	defer r.tee.mtx.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if r.own != nil {
+		return r.own.Err()
+	}
+	return r.tee.err
+}
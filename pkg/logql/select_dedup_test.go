@@ -0,0 +1,56 @@
+package logql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/v3/pkg/iter"
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+func TestSampleTee_DetachSlowest(t *testing.T) {
+	series := logproto.Series{Labels: `{app="foo"}`, StreamHash: 1}
+	for i := int64(0); i < 2000; i++ {
+		series.Samples = append(series.Samples, logproto.Sample{Timestamp: i, Value: float64(i), Hash: uint64(i)})
+	}
+	var reselected int
+	tee := &sampleTee{
+		src:         iter.NewSeriesIterator(series),
+		maxBuffered: 10,
+		reselect: func() (iter.SampleIterator, error) {
+			reselected++
+			return iter.NewSeriesIterator(series), nil
+		},
+	}
+	fast, ok := tee.reader()
+	require.True(t, ok)
+	slow, ok := tee.reader()
+	require.True(t, ok)
+
+	read := func(r *teeReader, n int) []logproto.Sample {
+		var samples []logproto.Sample
+		for len(samples) < n && r.Next() {
+			samples = append(samples, r.At())
+			require.Equal(t, series.Labels, r.Labels())
+		}
+		return samples
+	}
+
+	// the slow reader lags behind by more than the buffer bound.
+	require.Equal(t, series.Samples[:5], read(slow, 5))
+	var samples []logproto.Sample
+	for fast.Next() {
+		samples = append(samples, fast.At())
+		require.LessOrEqual(t, len(tee.buf), teeTrimSize+tee.maxBuffered)
+	}
+	require.NoError(t, fast.Err())
+	require.Equal(t, series.Samples, samples)
+	require.Equal(t, 1, reselected)
+
+	// the detached reader resumes where it stopped.
+	require.Equal(t, series.Samples[5:], read(slow, len(series.Samples)))
+	require.NoError(t, slow.Err())
+	require.NoError(t, fast.Close())
+	require.NoError(t, slow.Close())
+}
@@ -99,6 +99,8 @@ func (m ShardMapper) Map(expr syntax.Expr, r *downstreamRecorder, topLevel bool)
 		return m.mapVectorAggregationExpr(e, r, topLevel)
 	case *syntax.LabelReplaceExpr:
 		return m.mapLabelReplaceExpr(e, r, topLevel)
+	case syntax.WrapperExpr:
+		return m.mapWrapperExpr(e, r, topLevel)
 	case *syntax.RangeAggregationExpr:
 		return m.mapRangeAggregationExpr(e, r, topLevel)
 	case *syntax.BinOpExpr:
@@ -227,12 +229,9 @@ func (m ShardMapper) wrappedShardedVectorAggr(expr *syntax.VectorAggregationExpr
 	if err != nil {
 		return nil, 0, err
 	}
-	return &syntax.VectorAggregationExpr{
-		Left:      sharded,
-		Grouping:  expr.Grouping,
-		Params:    expr.Params,
-		Operation: expr.Operation,
-	}, bytesPerShard, nil
+	cpy := *expr
+	cpy.Left = sharded
+	return &cpy, bytesPerShard, nil
 }
 
 // technically, std{dev,var} are also parallelizable if there is no cross-shard merging
@@ -286,11 +285,10 @@ func (m ShardMapper) mapVectorAggregationExpr(expr *syntax.VectorAggregationExpr
 			if err != nil {
 				return nil, 0, err
 			}
-			return &syntax.VectorAggregationExpr{
-				Left:      sharded,
-				Grouping:  expr.Grouping,
-				Operation: syntax.OpTypeSum,
-			}, bytesPerShard, nil
+			cpy := *expr
+			cpy.Left = sharded
+			cpy.Operation = syntax.OpTypeSum
+			return &cpy, bytesPerShard, nil
 		case syntax.OpTypeApproxTopK:
 			if !m.approxTopkSupport {
 				return nil, 0, fmt.Errorf("approx_topk is not enabled. See -limits.shard_aggregations")
@@ -334,12 +332,9 @@ func (m ShardMapper) mapVectorAggregationExpr(expr *syntax.VectorAggregationExpr
 		return nil, 0, badASTMapping(subMapped)
 	}
 
-	return &syntax.VectorAggregationExpr{
-		Left:      sampleExpr,
-		Grouping:  expr.Grouping,
-		Params:    expr.Params,
-		Operation: expr.Operation,
-	}, bytesPerShard, nil
+	cpy := *expr
+	cpy.Left = sampleExpr
+	return &cpy, bytesPerShard, nil
 }
 
 func (m ShardMapper) mapApproxTopk(expr *syntax.VectorAggregationExpr, forceNoShard bool) (*syntax.VectorAggregationExpr, uint64, error) {
@@ -415,6 +410,16 @@ func (m ShardMapper) mapLabelReplaceExpr(expr *syntax.LabelReplaceExpr, r *downs
 	return &cpy, bytesPerShard, nil
 }
 
+// mapWrapperExpr maps the inner expression of a function applied to the series
+// of a single sample expression.
+func (m ShardMapper) mapWrapperExpr(expr syntax.WrapperExpr, r *downstreamRecorder, topLevel bool) (syntax.SampleExpr, uint64, error) {
+	subMapped, bytesPerShard, err := m.Map(expr.Inner(), r, topLevel)
+	if err != nil {
+		return nil, 0, err
+	}
+	return expr.WithInner(subMapped.(syntax.SampleExpr)), bytesPerShard, nil
+}
+
 // These functions require a different merge strategy than the default
 // concatenation.
 // This is because the same label sets may exist on multiple shards when label-reducing parsing is applied or when
@@ -422,11 +427,12 @@ func (m ShardMapper) mapLabelReplaceExpr(expr *syntax.LabelReplaceExpr, r *downs
 // series and we need to combine them appropriately given a particular operation.
 var rangeMergeMap = map[string]string{
 	// all these may be summed
-	syntax.OpRangeTypeCount:     syntax.OpTypeSum,
-	syntax.OpRangeTypeRate:      syntax.OpTypeSum,
-	syntax.OpRangeTypeBytes:     syntax.OpTypeSum,
-	syntax.OpRangeTypeBytesRate: syntax.OpTypeSum,
-	syntax.OpRangeTypeSum:       syntax.OpTypeSum,
+	syntax.OpRangeTypeCount:        syntax.OpTypeSum,
+	syntax.OpRangeTypeRate:         syntax.OpTypeSum,
+	syntax.OpRangeTypeBytes:        syntax.OpTypeSum,
+	syntax.OpRangeTypeBytesRate:    syntax.OpTypeSum,
+	syntax.OpRangeTypeSum:          syntax.OpTypeSum,
+	syntax.OpRangeTypeMatchedBytes: syntax.OpTypeSum,
 
 	// min & max require taking the min|max of the shards
 	syntax.OpRangeTypeMin: syntax.OpTypeMin,
@@ -440,7 +446,8 @@ func (m ShardMapper) mapRangeAggregationExpr(expr *syntax.RangeAggregationExpr,
 
 	switch expr.Operation {
 
-	case syntax.OpRangeTypeCount, syntax.OpRangeTypeRate, syntax.OpRangeTypeBytes, syntax.OpRangeTypeBytesRate, syntax.OpRangeTypeSum, syntax.OpRangeTypeMax, syntax.OpRangeTypeMin:
+	case syntax.OpRangeTypeCount, syntax.OpRangeTypeRate, syntax.OpRangeTypeBytes, syntax.OpRangeTypeBytesRate, syntax.OpRangeTypeSum, syntax.OpRangeTypeMax, syntax.OpRangeTypeMin,
+		syntax.OpRangeTypeMatchedBytes:
 		// if the expr can reduce labels, it can cause the same labelset to
 		// exist on separate shards and we'll need to merge the results
 		// accordingly. If it does not reduce labels and has no special grouping
@@ -478,6 +485,11 @@ func (m ShardMapper) mapRangeAggregationExpr(expr *syntax.RangeAggregationExpr,
 		if !potentialConflict && (expr.Grouping == nil || expr.Grouping.Noop()) {
 			return m.mapSampleExpr(expr, r)
 		}
+		// the count_over_time() of the split would also count the lines not
+		// matching the regex of unwrap_regex.
+		if expr.Left.Unwrap != nil && expr.Left.Unwrap.Regex != "" {
+			return noOp(expr, m.shards.Resolver())
+		}
 
 		grouping := expr.Grouping
 		if grouping == nil {
@@ -509,6 +521,9 @@ func (m ShardMapper) mapRangeAggregationExpr(expr *syntax.RangeAggregationExpr,
 		if rhsGrouping.Without {
 			if expr.Left.Unwrap != nil {
 				rhsGrouping.Groups = append(rhsGrouping.Groups, expr.Left.Unwrap.Identifier)
+				if expr.Left.Unwrap.RHS != "" {
+					rhsGrouping.Groups = append(rhsGrouping.Groups, expr.Left.Unwrap.RHS)
+				}
 			}
 		}
 
@@ -139,6 +139,11 @@ func TestMappingStrings(t *testing.T) {
 			out: `downstream<{foo="bar"}, shard=0_of_2>
 					++ downstream<{foo="bar"}, shard=1_of_2>`,
 		},
+		{
+			// each shard would fill its empty windows with the default.
+			in:  `last_over_time({a=~".+"} | logfmt | unwrap value [1s], default=0)`,
+			out: `last_over_time({a=~".+"}|logfmt|unwrapvalue[1s],default=0)`,
+		},
 		{
 			in: `{foo="bar"} |= "foo" |~ "bar" | json | latency >= 10s or foo<5 and bar="t" | line_format "b{{.blip}}"`,
 			out: `downstream<{foo="bar"} |="foo" |~"bar" | json | (latency>=10s or (foo<5,bar="t")) | line_format "b{{.blip}}", shard=0_of_2>
@@ -432,6 +437,11 @@ func TestMappingStrings(t *testing.T) {
 				)
 			)`,
 		},
+		// should be noop as count_over_time would count lines not matching the regex
+		{
+			in:  `avg_over_time({job=~"myapps.*"} | unwrap_regex "busy=(?P<busy>[0-9.]+)" as busy [5m]) by (cluster)`,
+			out: `avg_over_time({job=~"myapps.*"} | unwrap_regex "busy=(?P<busy>[0-9.]+)" as busy [5m]) by (cluster)`,
+		},
 		// should be noop if VectorExpr
 		{
 			in:  `vector(0)`,
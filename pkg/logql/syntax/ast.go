@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -52,11 +53,20 @@ func (VectorAggregationExpr) isExpr()      {}
 func (LiteralExpr) isExpr()                {}
 func (VectorExpr) isExpr()                 {}
 func (LabelReplaceExpr) isExpr()           {}
+func (HistogramQuantileExpr) isExpr()      {}
+func (LabelDropRegexExpr) isExpr()         {}
+func (LabelModeExpr) isExpr()              {}
+func (RoundExpr) isExpr()                  {}
+func (AbsentExpr) isExpr()                 {}
+func (ScalarExpr) isExpr()                 {}
+func (MetricLabelFmtExpr) isExpr()         {}
 func (LineParserExpr) isExpr()             {}
 func (LogfmtParserExpr) isExpr()           {}
 func (LineFilterExpr) isExpr()             {}
 func (LabelFilterExpr) isExpr()            {}
 func (DecolorizeExpr) isExpr()             {}
+func (UnitExpr) isExpr()                   {}
+func (JSONSchemaExpr) isExpr()             {}
 func (DropLabelsExpr) isExpr()             {}
 func (KeepLabelsExpr) isExpr()             {}
 func (LineFmtExpr) isExpr()                {}
@@ -101,6 +111,13 @@ func (VectorAggregationExpr) isSampleExpr() {}
 func (LiteralExpr) isSampleExpr()           {}
 func (VectorExpr) isSampleExpr()            {}
 func (LabelReplaceExpr) isSampleExpr()      {}
+func (HistogramQuantileExpr) isSampleExpr() {}
+func (LabelDropRegexExpr) isSampleExpr()    {}
+func (LabelModeExpr) isSampleExpr()         {}
+func (RoundExpr) isSampleExpr()             {}
+func (AbsentExpr) isSampleExpr()            {}
+func (ScalarExpr) isSampleExpr()            {}
+func (MetricLabelFmtExpr) isSampleExpr()    {}
 func (MultiVariantExpr) isSampleExpr()      {}
 
 // StageExpr is an expression defining a single step into a log pipeline
@@ -117,6 +134,8 @@ func (LogfmtParserExpr) isStageExpr()           {}
 func (LineFilterExpr) isStageExpr()             {}
 func (LabelFilterExpr) isStageExpr()            {}
 func (DecolorizeExpr) isStageExpr()             {}
+func (UnitExpr) isStageExpr()                   {}
+func (JSONSchemaExpr) isStageExpr()             {}
 func (DropLabelsExpr) isStageExpr()             {}
 func (KeepLabelsExpr) isStageExpr()             {}
 func (LineFmtExpr) isStageExpr()                {}
@@ -842,6 +861,94 @@ func (e *DecolorizeExpr) Walk(f WalkFn) { f(e) }
 
 func (e *DecolorizeExpr) Accept(v RootVisitor) { v.VisitDecolorize(e) }
 
+// UnitExpr declares the unit of the samples extracted from a pipeline. It
+// doesn't change log lines or labels.
+type UnitExpr struct {
+	Unit string
+}
+
+func newUnitExpr(unit string) *UnitExpr {
+	return &UnitExpr{Unit: unit}
+}
+
+func (e *UnitExpr) Shardable(_ bool) bool { return true }
+
+func (e *UnitExpr) Stage() (log.Stage, error) {
+	return log.NoopStage, nil
+}
+
+func (e *UnitExpr) String() string {
+	return fmt.Sprintf("%s %s(%s)", OpPipe, OpUnit, strconv.Quote(e.Unit))
+}
+func (e *UnitExpr) Walk(f WalkFn) { f(e) }
+
+func (e *UnitExpr) Accept(v RootVisitor) { v.VisitUnit(e) }
+
+// JSONSchemaExpr validates log lines against a JSON schema registered for the
+// tenant under Name. The schema itself is resolved from the tenant limits
+// before the pipeline is built and is not part of the query string.
+type JSONSchemaExpr struct {
+	Name   string
+	Schema string
+}
+
+func newJSONSchemaExpr(name string) *JSONSchemaExpr {
+	return &JSONSchemaExpr{Name: name}
+}
+
+func (e *JSONSchemaExpr) Shardable(_ bool) bool { return true }
+
+func (e *JSONSchemaExpr) Stage() (log.Stage, error) {
+	if e.Schema == "" {
+		return nil, fmt.Errorf("json schema %q has not been resolved", e.Name)
+	}
+	return log.NewJSONSchemaValidator(e.Name, e.Schema)
+}
+
+func (e *JSONSchemaExpr) String() string {
+	return fmt.Sprintf("%s %s %s", OpPipe, OpJSONSchema, strconv.Quote(e.Name))
+}
+func (e *JSONSchemaExpr) Walk(f WalkFn) { f(e) }
+
+func (e *JSONSchemaExpr) Accept(v RootVisitor) { v.VisitJSONSchema(e) }
+
+// ResolveJSONSchemas sets the schema of every json_schema stage of the
+// expression using lookup. It fails on the first schema lookup doesn't know.
+func ResolveJSONSchemas(e Expr, lookup func(name string) (string, bool)) error {
+	var err error
+	e.Walk(func(e Expr) bool {
+		if err != nil {
+			return false
+		}
+		if s, ok := e.(*JSONSchemaExpr); ok {
+			schema, known := lookup(s.Name)
+			if !known {
+				err = logqlmodel.NewParseError(fmt.Sprintf("unknown json schema %q", s.Name), 0, 0)
+				return false
+			}
+			s.Schema = schema
+		}
+		return true
+	})
+	return err
+}
+
+// jsonSchemas returns the resolved schemas of the json_schema stages of the
+// expression by name.
+func jsonSchemas(e Expr) map[string]string {
+	var schemas map[string]string
+	e.Walk(func(e Expr) bool {
+		if s, ok := e.(*JSONSchemaExpr); ok && s.Schema != "" {
+			if schemas == nil {
+				schemas = map[string]string{}
+			}
+			schemas[s.Name] = s.Schema
+		}
+		return true
+	})
+	return schemas
+}
+
 type DropLabelsExpr struct {
 	dropLabels []log.NamedLabelMatcher
 }
@@ -1114,16 +1221,40 @@ type UnwrapExpr struct {
 	Identifier string
 	Operation  string
 
+	// Arithmetic, if set, is the operation (+, -, * or /) between the values
+	// of the Identifier and RHS labels whose result is unwrapped.
+	Arithmetic string
+	RHS        string
+
+	// Regex, if set, is the regular expression matched against the log line
+	// whose capture group named Identifier is unwrapped. Lines not matching
+	// it are dropped.
+	Regex string
+
+	// Default, if set, is the value unwrapped from lines without the
+	// Identifier label, which are otherwise dropped.
+	Default *float64
+
 	PostFilters []log.LabelFilterer
+
+	err error
 }
 
 func (u UnwrapExpr) String() string {
 	var sb strings.Builder
-	if u.Operation != "" {
+	switch {
+	case u.Regex != "":
+		sb.WriteString(fmt.Sprintf(" %s %s %s %s %s", OpPipe, OpUnwrapRegex, strconv.Quote(u.Regex), OpAs, u.Identifier))
+	case u.Arithmetic != "":
+		sb.WriteString(fmt.Sprintf(" %s %s (%s %s %s)", OpPipe, OpUnwrap, u.Identifier, u.Arithmetic, u.RHS))
+	case u.Operation != "":
 		sb.WriteString(fmt.Sprintf(" %s %s %s(%s)", OpPipe, OpUnwrap, u.Operation, u.Identifier))
-	} else {
+	default:
 		sb.WriteString(fmt.Sprintf(" %s %s %s", OpPipe, OpUnwrap, u.Identifier))
 	}
+	if u.Default != nil {
+		sb.WriteString(fmt.Sprintf(" %s %s", OpDefault, strconv.FormatFloat(*u.Default, 'f', -1, 64)))
+	}
 	for _, f := range u.PostFilters {
 		sb.WriteString(fmt.Sprintf(" %s %s", OpPipe, f))
 	}
@@ -1139,11 +1270,45 @@ func newUnwrapExpr(id string, operation string) *UnwrapExpr {
 	return &UnwrapExpr{Identifier: id, Operation: operation}
 }
 
+// newUnwrapExprWithDefault returns the unwrap of `unwrap <id> default <value>`.
+// Default is not a keyword, so that labels can still be named default.
+func newUnwrapExprWithDefault(id, operation, name, value string) *UnwrapExpr {
+	if name != OpDefault {
+		return &UnwrapExpr{err: fmt.Errorf("syntax error: unexpected %s, expecting %s", name, OpDefault)}
+	}
+	def, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return &UnwrapExpr{err: fmt.Errorf("invalid %s value for %s: %s", OpDefault, OpUnwrap, err)}
+	}
+	return &UnwrapExpr{Identifier: id, Operation: operation, Default: &def}
+}
+
+func newUnwrapArithmeticExpr(lhs, op, rhs string) *UnwrapExpr {
+	return &UnwrapExpr{Identifier: lhs, Arithmetic: op, RHS: rhs}
+}
+
+// newUnwrapRegexExpr returns the unwrap of `unwrap_regex "<re>" as <id>`. As
+// is not a keyword, so that labels can still be named as.
+func newUnwrapRegexExpr(re, as, id string) *UnwrapExpr {
+	if as != OpAs {
+		return &UnwrapExpr{err: fmt.Errorf("syntax error: unexpected %s, expecting %s", as, OpAs)}
+	}
+	if _, err := log.NewRegexpParser(re); err != nil {
+		return &UnwrapExpr{err: fmt.Errorf("invalid %s: %s", OpUnwrapRegex, err.Error())}
+	}
+	if !slices.Contains(regexp.MustCompile(re).SubexpNames(), id) {
+		return &UnwrapExpr{err: fmt.Errorf("invalid %s: no capture group named %s", OpUnwrapRegex, id)}
+	}
+	return &UnwrapExpr{Identifier: id, Regex: re}
+}
+
 type LogRangeExpr struct {
 	Left     LogSelectorExpr
 	Interval time.Duration
 	Offset   time.Duration
-	Unwrap   *UnwrapExpr
+	// At is the evaluation timestamp in milliseconds set by the @ modifier.
+	At     *int64
+	Unwrap *UnwrapExpr
 }
 
 // impls Stringer
@@ -1154,8 +1319,8 @@ func (r LogRangeExpr) String() string {
 		sb.WriteString(r.Unwrap.String())
 	}
 	sb.WriteString(fmt.Sprintf("[%v]", model.Duration(r.Interval)))
-	if r.Offset != 0 {
-		offsetExpr := OffsetExpr{Offset: r.Offset}
+	if r.Offset != 0 || r.At != nil {
+		offsetExpr := OffsetExpr{Offset: r.Offset, At: r.At}
 		sb.WriteString(offsetExpr.String())
 	}
 	return sb.String()
@@ -1186,29 +1351,41 @@ func (r *LogRangeExpr) WithoutUnwrap() (*LogRangeExpr, error) {
 		Left:     left,
 		Interval: r.Interval,
 		Offset:   r.Offset,
+		At:       r.At,
 	}, nil
 }
 
 func newLogRange(left LogSelectorExpr, interval time.Duration, u *UnwrapExpr, o *OffsetExpr) *LogRangeExpr {
 	var offset time.Duration
+	var at *int64
 	if o != nil {
 		offset = o.Offset
+		at = o.At
 	}
 	return &LogRangeExpr{
 		Left:     left,
 		Interval: interval,
 		Unwrap:   u,
 		Offset:   offset,
+		At:       at,
 	}
 }
 
+// OffsetExpr holds the modifiers of a log range: the offset and the optional
+// @ evaluation timestamp in milliseconds.
 type OffsetExpr struct {
 	Offset time.Duration
+	At     *int64
 }
 
 func (o *OffsetExpr) String() string {
 	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf(" %s %s", OpOffset, o.Offset.String()))
+	if o.Offset != 0 {
+		sb.WriteString(fmt.Sprintf(" %s %s", OpOffset, o.Offset.String()))
+	}
+	if o.At != nil {
+		sb.WriteString(fmt.Sprintf(" %s %s", OpAt, formatAt(*o.At)))
+	}
 	return sb.String()
 }
 
@@ -1218,6 +1395,21 @@ func newOffsetExpr(offset time.Duration) *OffsetExpr {
 	}
 }
 
+// newAtExpr returns the modifiers of a log range evaluated at the given unix
+// timestamp in seconds.
+func newAtExpr(ts string, offset time.Duration) *OffsetExpr {
+	at := int64(math.Round(mustNewFloat(ts) * 1000))
+	return &OffsetExpr{
+		Offset: offset,
+		At:     &at,
+	}
+}
+
+// formatAt formats an @ timestamp in milliseconds as unix seconds.
+func formatAt(at int64) string {
+	return strconv.FormatFloat(float64(at)/1000, 'f', -1, 64)
+}
+
 const (
 	// vector ops
 	OpTypeSum      = "sum"
@@ -1231,23 +1423,34 @@ const (
 	OpTypeTopK     = "topk"
 	OpTypeSort     = "sort"
 	OpTypeSortDesc = "sort_desc"
+	OpTypeQuantile = "quantile"
 
 	// range vector ops
-	OpRangeTypeCount       = "count_over_time"
-	OpRangeTypeRate        = "rate"
-	OpRangeTypeRateCounter = "rate_counter"
-	OpRangeTypeBytes       = "bytes_over_time"
-	OpRangeTypeBytesRate   = "bytes_rate"
-	OpRangeTypeAvg         = "avg_over_time"
-	OpRangeTypeSum         = "sum_over_time"
-	OpRangeTypeMin         = "min_over_time"
-	OpRangeTypeMax         = "max_over_time"
-	OpRangeTypeStdvar      = "stdvar_over_time"
-	OpRangeTypeStddev      = "stddev_over_time"
-	OpRangeTypeQuantile    = "quantile_over_time"
-	OpRangeTypeFirst       = "first_over_time"
-	OpRangeTypeLast        = "last_over_time"
-	OpRangeTypeAbsent      = "absent_over_time"
+	OpRangeTypeCount        = "count_over_time"
+	OpRangeTypeRate         = "rate"
+	OpRangeTypeRateCounter  = "rate_counter"
+	OpRangeTypeBytes        = "bytes_over_time"
+	OpRangeTypeBytesRate    = "bytes_rate"
+	OpRangeTypeAvg          = "avg_over_time"
+	OpRangeTypeSum          = "sum_over_time"
+	OpRangeTypeMin          = "min_over_time"
+	OpRangeTypeMax          = "max_over_time"
+	OpRangeTypeStdvar       = "stdvar_over_time"
+	OpRangeTypeStddev       = "stddev_over_time"
+	OpRangeTypeQuantile     = "quantile_over_time"
+	OpRangeTypeFirst        = "first_over_time"
+	OpRangeTypeLast         = "last_over_time"
+	OpRangeTypeAbsent       = "absent_over_time"
+	OpRangeTypeCountValues  = "count_values_over_time"
+	OpRangeTypeCV           = "cv_over_time"
+	OpRangeTypeZScore       = "zscore_over_time"
+	OpRangeTypeMatchedBytes = "matched_bytes_over_time"
+	OpRangeTypeAutocorr     = "autocorr_over_time"
+	OpRangeTypeChanges      = "changes_over_time"
+	OpRangeTypeDelta        = "delta"
+	OpRangeTypeIdelta       = "idelta"
+	OpRangeTypeDeriv        = "deriv"
+	OpRangeTypeResets       = "resets_over_time"
 
 	// vector
 	OpTypeVector = "vector"
@@ -1283,10 +1486,16 @@ const (
 	OpFmtLine    = "line_format"
 	OpFmtLabel   = "label_format"
 	OpDecolorize = "decolorize"
+	OpUnit       = "__unit__"
+	OpJSONSchema = "json_schema"
 
-	OpPipe   = "|"
-	OpUnwrap = "unwrap"
-	OpOffset = "offset"
+	OpPipe        = "|"
+	OpUnwrap      = "unwrap"
+	OpUnwrapRegex = "unwrap_regex"
+	OpAs          = "as"
+	OpDefault     = "default"
+	OpOffset      = "offset"
+	OpAt          = "@"
 
 	OpOn       = "on"
 	OpIgnoring = "ignoring"
@@ -1299,7 +1508,16 @@ const (
 	OpConvDuration        = "duration"
 	OpConvDurationSeconds = "duration_seconds"
 
-	OpLabelReplace = "label_replace"
+	OpLabelReplace   = "label_replace"
+	OpLabelDropRegex = "label_drop_regex"
+	OpLabelMode      = "label_mode"
+
+	OpRound = "round"
+
+	OpTypeAbsent = "absent"
+	OpTypeScalar = "scalar"
+
+	OpTypeHistogramQuantile = "histogram_quantile"
 
 	// function filters
 	OpFilterIP = "ip"
@@ -1327,8 +1545,9 @@ const (
 	OpTypeApproxTopK = "approx_topk"
 
 	// variants
-	OpVariants = "variants"
-	VariantsOf = "of"
+	OpVariants     = "variants"
+	VariantsOf     = "of"
+	VariantsMerged = "merged"
 )
 
 func IsComparisonOperator(op string) bool {
@@ -1356,9 +1575,15 @@ type RangeAggregationExpr struct {
 	Left      *LogRangeExpr
 	Operation string
 
+	// Params is the parameter of quantile_over_time or the lag of
+	// autocorr_over_time.
 	Params   *float64
 	Grouping *Grouping
-	err      error
+	// Label is the name of the output label of count_values_over_time.
+	Label string
+	// Default is the value of last_over_time for the windows without samples.
+	Default *float64
+	err     error
 }
 
 func newRangeAggregationExpr(left *LogRangeExpr, operation string, gr *Grouping, stringParams *string) SampleExpr {
@@ -1375,7 +1600,7 @@ func newRangeAggregationExpr(left *LogRangeExpr, operation string, gr *Grouping,
 		}
 
 	} else {
-		if operation == OpRangeTypeQuantile {
+		if operation == OpRangeTypeQuantile || operation == OpRangeTypeCountValues || operation == OpRangeTypeAutocorr {
 			return &RangeAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("parameter required for operation %s", operation), 0, 0)}
 		}
 	}
@@ -1391,6 +1616,72 @@ func newRangeAggregationExpr(left *LogRangeExpr, operation string, gr *Grouping,
 	return e
 }
 
+func newRangeAggregationExprWithLabel(left *LogRangeExpr, operation string, label string) SampleExpr {
+	if operation != OpRangeTypeCountValues {
+		return &RangeAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("parameter %q not supported for operation %s", label, operation), 0, 0)}
+	}
+	if !model.LabelName(label).IsValid() {
+		return &RangeAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("invalid label name %q for operation %s", label, operation), 0, 0)}
+	}
+	e := &RangeAggregationExpr{
+		Left:      left,
+		Operation: operation,
+		Label:     label,
+	}
+	if err := e.validate(); err != nil {
+		return &RangeAggregationExpr{err: logqlmodel.NewParseError(err.Error(), 0, 0)}
+	}
+	return e
+}
+
+// newRangeAggregationExprWithLag builds an autocorr_over_time aggregation
+// at the given lag in seconds.
+func newRangeAggregationExprWithLag(left *LogRangeExpr, operation string, gr *Grouping, stringLag string) SampleExpr {
+	if operation != OpRangeTypeAutocorr {
+		return &RangeAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("parameter %s not supported for operation %s", stringLag, operation), 0, 0)}
+	}
+	lag, err := strconv.ParseFloat(stringLag, 64)
+	if err != nil {
+		return &RangeAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("invalid parameter for operation %s: %s", operation, err), 0, 0)}
+	}
+	if lag <= 0 || lag >= left.Interval.Seconds() {
+		return &RangeAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("lag of operation %s must be positive and shorter than the range, got %s", operation, stringLag), 0, 0)}
+	}
+	e := &RangeAggregationExpr{
+		Left:      left,
+		Operation: operation,
+		Grouping:  gr,
+		Params:    &lag,
+	}
+	if err := e.validate(); err != nil {
+		return &RangeAggregationExpr{err: logqlmodel.NewParseError(err.Error(), 0, 0)}
+	}
+	return e
+}
+
+// newRangeAggregationExprWithDefault builds a last_over_time aggregation
+// returning a default value for the windows without samples, e.g.
+// `last_over_time({app="foo"} | unwrap v [1m], default=0)`.
+func newRangeAggregationExprWithDefault(left *LogRangeExpr, operation string, gr *Grouping, name, stringDefault string) SampleExpr {
+	if operation != OpRangeTypeLast || name != "default" {
+		return &RangeAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("parameter %s not supported for operation %s", name, operation), 0, 0)}
+	}
+	def, err := strconv.ParseFloat(stringDefault, 64)
+	if err != nil {
+		return &RangeAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("invalid parameter for operation %s: %s", operation, err), 0, 0)}
+	}
+	e := &RangeAggregationExpr{
+		Left:      left,
+		Operation: operation,
+		Grouping:  gr,
+		Default:   &def,
+	}
+	if err := e.validate(); err != nil {
+		return &RangeAggregationExpr{err: logqlmodel.NewParseError(err.Error(), 0, 0)}
+	}
+	return e
+}
+
 func (e *RangeAggregationExpr) Selector() (LogSelectorExpr, error) {
 	if e.err != nil {
 		return nil, e.err
@@ -1416,11 +1707,16 @@ func (e *RangeAggregationExpr) MatcherGroups() ([]MatcherRange, error) {
 }
 
 func (e RangeAggregationExpr) validate() error {
+	if e.Left.Unwrap != nil && e.Left.Unwrap.err != nil {
+		return e.Left.Unwrap.err
+	}
 	if e.Grouping != nil {
 		switch e.Operation {
 		case OpRangeTypeAvg, OpRangeTypeStddev, OpRangeTypeStdvar, OpRangeTypeQuantile,
 			OpRangeTypeQuantileSketch, OpRangeTypeMax, OpRangeTypeMin, OpRangeTypeFirst,
-			OpRangeTypeLast, OpRangeTypeFirstWithTimestamp, OpRangeTypeLastWithTimestamp:
+			OpRangeTypeLast, OpRangeTypeFirstWithTimestamp, OpRangeTypeLastWithTimestamp, OpRangeTypeCV,
+			OpRangeTypeZScore, OpRangeTypeAutocorr, OpRangeTypeChanges, OpRangeTypeDelta, OpRangeTypeIdelta,
+			OpRangeTypeDeriv, OpRangeTypeResets:
 		default:
 			return fmt.Errorf("grouping not allowed for %s aggregation", e.Operation)
 		}
@@ -1430,14 +1726,16 @@ func (e RangeAggregationExpr) validate() error {
 		case OpRangeTypeAvg, OpRangeTypeSum, OpRangeTypeMax, OpRangeTypeMin, OpRangeTypeStddev,
 			OpRangeTypeStdvar, OpRangeTypeQuantile, OpRangeTypeRate, OpRangeTypeRateCounter,
 			OpRangeTypeAbsent, OpRangeTypeFirst, OpRangeTypeLast, OpRangeTypeQuantileSketch,
-			OpRangeTypeFirstWithTimestamp, OpRangeTypeLastWithTimestamp:
+			OpRangeTypeFirstWithTimestamp, OpRangeTypeLastWithTimestamp, OpRangeTypeCountValues,
+			OpRangeTypeCV, OpRangeTypeZScore, OpRangeTypeAutocorr, OpRangeTypeChanges, OpRangeTypeDelta,
+			OpRangeTypeIdelta, OpRangeTypeDeriv, OpRangeTypeResets:
 			return nil
 		default:
 			return fmt.Errorf("invalid aggregation %s with unwrap", e.Operation)
 		}
 	}
 	switch e.Operation {
-	case OpRangeTypeBytes, OpRangeTypeBytesRate, OpRangeTypeCount, OpRangeTypeRate, OpRangeTypeAbsent:
+	case OpRangeTypeBytes, OpRangeTypeBytesRate, OpRangeTypeCount, OpRangeTypeRate, OpRangeTypeAbsent, OpRangeTypeMatchedBytes:
 		return nil
 	default:
 		return fmt.Errorf("invalid aggregation %s without unwrap", e.Operation)
@@ -1453,11 +1751,24 @@ func (e *RangeAggregationExpr) String() string {
 	var sb strings.Builder
 	sb.WriteString(e.Operation)
 	sb.WriteString("(")
-	if e.Params != nil {
+	if e.Params != nil && e.Operation != OpRangeTypeAutocorr {
 		sb.WriteString(strconv.FormatFloat(*e.Params, 'f', -1, 64))
 		sb.WriteString(",")
 	}
+	if e.Label != "" {
+		sb.WriteString(strconv.Quote(e.Label))
+		sb.WriteString(",")
+	}
 	sb.WriteString(e.Left.String())
+	if e.Params != nil && e.Operation == OpRangeTypeAutocorr {
+		// the lag follows the range.
+		sb.WriteString(",")
+		sb.WriteString(strconv.FormatFloat(*e.Params, 'f', -1, 64))
+	}
+	if e.Default != nil {
+		sb.WriteString(", default=")
+		sb.WriteString(strconv.FormatFloat(*e.Default, 'f', -1, 64))
+	}
 	sb.WriteString(")")
 	if e.Grouping != nil {
 		sb.WriteString(e.Grouping.String())
@@ -1474,6 +1785,11 @@ func (e *RangeAggregationExpr) Shardable(topLevel bool) bool {
 	if e.Operation == OpRangeTypeQuantile && !topLevel {
 		return false
 	}
+	// each shard would fill the windows without samples with the default of
+	// last_over_time.
+	if e.Default != nil {
+		return false
+	}
 	return shardableOps[e.Operation] && e.Left.Shardable(topLevel)
 }
 
@@ -1536,13 +1852,25 @@ type VectorAggregationExpr struct {
 	Grouping  *Grouping `json:"grouping,omitempty"`
 	Params    int       `json:"params"`
 	Operation string    `json:"operation"`
-	err       error
+	// Quantile is the φ parameter of the quantile operation.
+	Quantile float64 `json:"quantile,omitempty"`
+	err      error
 }
 
 func mustNewVectorAggregationExpr(left SampleExpr, operation string, gr *Grouping, params *string) SampleExpr {
 	var p int
+	var q float64
 	var err error
 	switch operation {
+	case OpTypeQuantile:
+		if params == nil {
+			return &VectorAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("parameter required for operation %s", operation), 0, 0)}
+		}
+		q, err = strconv.ParseFloat(*params, 64)
+		if err != nil {
+			return &VectorAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("invalid parameter %s(%s,", operation, *params), 0, 0)}
+		}
+
 	case OpTypeBottomK, OpTypeTopK, OpTypeApproxTopK:
 		if params == nil {
 			return &VectorAggregationExpr{err: logqlmodel.NewParseError(fmt.Sprintf("parameter required for operation %s", operation), 0, 0)}
@@ -1571,6 +1899,7 @@ func mustNewVectorAggregationExpr(left SampleExpr, operation string, gr *Groupin
 		Operation: operation,
 		Grouping:  gr,
 		Params:    p,
+		Quantile:  q,
 	}
 }
 
@@ -1613,7 +1942,7 @@ func canInjectVectorGrouping(vecOp, rangeOp string) bool {
 		return false
 	}
 	switch rangeOp {
-	case OpRangeTypeBytes, OpRangeTypeBytesRate, OpRangeTypeSum, OpRangeTypeRate, OpRangeTypeCount:
+	case OpRangeTypeBytes, OpRangeTypeBytesRate, OpRangeTypeSum, OpRangeTypeRate, OpRangeTypeCount, OpRangeTypeMatchedBytes:
 		return true
 	default:
 		return false
@@ -1626,6 +1955,8 @@ func (e *VectorAggregationExpr) String() string {
 	// bottomK and topk can have first parameter as 0
 	case OpTypeBottomK, OpTypeTopK, OpTypeApproxTopK:
 		params = []string{fmt.Sprintf("%d", e.Params), e.Left.String()}
+	case OpTypeQuantile:
+		params = []string{strconv.FormatFloat(e.Quantile, 'f', -1, 64), e.Left.String()}
 	default:
 		if e.Params != 0 {
 			params = []string{fmt.Sprintf("%d", e.Params), e.Left.String()}
@@ -1879,6 +2210,13 @@ func mustNewBinOpExpr(op string, opts *BinOpOptions, lhs, rhs Expr) SampleExpr {
 				rightVal,
 			), 0, 0)}
 		}
+
+		if opts != nil && opts.VectorMatching != nil && opts.VectorMatching.Card != CardOneToOne {
+			return &BinOpExpr{err: logqlmodel.NewParseError(fmt.Sprintf(
+				"no grouping allowed for logical/set binary operation (%s)",
+				op,
+			), 0, 0)}
+		}
 	}
 
 	// map expr like (1+1) -> 2
@@ -2270,122 +2608,683 @@ func (e *LabelReplaceExpr) String() string {
 	return sb.String()
 }
 
-// shardableOps lists the operations which may be sharded, but are not
-// guaranteed to be. See the `Shardable()` implementations
-// on the respective expr types for more details.
-// topk, botk, max, & min all must be concatenated and then evaluated in order to avoid
-// potential data loss due to series distribution across shards.
-// For example, grouping by `cluster` for a `max` operation may yield
-// 2 results on the first shard and 10 results on the second. If we prematurely
-// calculated `max`s on each shard, the shard/label combination with `2` may be
-// discarded and some other combination with `11` may be reported falsely as the max.
-//
-// Explanation: this is my (owen-d) best understanding.
-//
-// For an operation to be shardable, first the sample-operation itself must be associative like (+, *) but not (%, /, ^).
-// Secondly, if the operation is part of a vector aggregation expression or utilizes logical/set binary ops,
-// the vector operation must be distributive over the sample-operation.
-// This ensures that the vector merging operation can be applied repeatedly to data in different shards.
-// references:
-// https://en.wikipedia.org/wiki/Associative_property
-// https://en.wikipedia.org/wiki/Distributive_property
-var shardableOps = map[string]bool{
-	// vector ops
-	OpTypeSum: true,
-	// avg is only marked as shardable because we remap it into sum/count.
-	OpTypeAvg:   true,
-	OpTypeCount: true,
-	OpTypeMax:   true,
-	OpTypeMin:   true,
-
-	OpTypeApproxTopK: true,
+// LabelDropRegexExpr removes all labels whose names match Regex from each
+// series of its inner expression.
+type LabelDropRegexExpr struct {
+	Left  SampleExpr
+	Regex string
+	Re    *regexp.Regexp
+	err   error
+}
 
-	// range vector ops
-	OpRangeTypeAvg:       true,
-	OpRangeTypeCount:     true,
-	OpRangeTypeFirst:     true,
-	OpRangeTypeLast:      true,
-	OpRangeTypeRate:      true,
-	OpRangeTypeBytes:     true,
-	OpRangeTypeBytesRate: true,
-	OpRangeTypeSum:       true,
-	OpRangeTypeMax:       true,
-	OpRangeTypeMin:       true,
-	OpRangeTypeQuantile:  true,
+func mustNewLabelDropRegexExpr(left SampleExpr, regex string) *LabelDropRegexExpr {
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return &LabelDropRegexExpr{
+			err: logqlmodel.NewParseError(fmt.Sprintf("invalid regex in %s: %s", OpLabelDropRegex, err.Error()), 0, 0),
+		}
+	}
+	return &LabelDropRegexExpr{
+		Left:  left,
+		Regex: regex,
+		Re:    re,
+	}
+}
 
-	// binops - arith
-	OpTypeAdd: true,
-	OpTypeMul: true,
+func (e *LabelDropRegexExpr) Selector() (LogSelectorExpr, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.Left.Selector()
 }
 
-type MatcherRange struct {
-	Matchers         []*labels.Matcher
-	Interval, Offset time.Duration
+func (e *LabelDropRegexExpr) MatcherGroups() ([]MatcherRange, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.Left.MatcherGroups()
 }
 
-func MatcherGroups(expr Expr) ([]MatcherRange, error) {
-	switch e := expr.(type) {
-	case SampleExpr:
-		return e.MatcherGroups()
-	case LogSelectorExpr:
-		if xs := e.Matchers(); len(xs) > 0 {
-			return []MatcherRange{
-				{
-					Matchers: xs,
-				},
-			}, nil
-		}
-		return nil, nil
-	default:
-		return nil, nil
+func (e *LabelDropRegexExpr) Extractors() ([]SampleExtractor, error) {
+	if e.err != nil {
+		return []SampleExtractor{}, e.err
 	}
+	return e.Left.Extractors()
 }
 
-type VectorExpr struct {
-	Val float64
-	err error
+func (e *LabelDropRegexExpr) Shardable(_ bool) bool {
+	return false
 }
 
-func NewVectorExpr(scalar string) *VectorExpr {
-	n, err := strconv.ParseFloat(scalar, 64)
-	if err != nil {
-		err = logqlmodel.NewParseError(fmt.Sprintf("unable to parse vectorExpr as a float: %s", err.Error()), 0, 0)
+func (e *LabelDropRegexExpr) Walk(f WalkFn) {
+	if !f(e) {
+		return
 	}
-	return &VectorExpr{
-		Val: n,
-		err: err,
+	if e.Left != nil {
+		e.Left.Walk(f)
 	}
 }
 
-func (e *VectorExpr) Err() error {
-	return e.err
+func (e *LabelDropRegexExpr) Accept(v RootVisitor) { v.VisitLabelDropRegex(e) }
+
+func (e *LabelDropRegexExpr) Inner() SampleExpr { return e.Left }
+
+func (e *LabelDropRegexExpr) WithInner(inner SampleExpr) SampleExpr {
+	cpy := *e
+	cpy.Left = inner
+	return &cpy
 }
 
-func (e *VectorExpr) String() string {
+func (e *LabelDropRegexExpr) String() string {
 	var sb strings.Builder
-	sb.WriteString(OpTypeVector)
+	sb.WriteString(OpLabelDropRegex)
 	sb.WriteString("(")
-	sb.WriteString(fmt.Sprintf("%f", e.Val))
+	sb.WriteString(e.Left.String())
+	sb.WriteString(",")
+	sb.WriteString(strconv.Quote(e.Regex))
 	sb.WriteString(")")
 	return sb.String()
 }
 
-func (e *VectorExpr) Value() (float64, error) {
+// LabelModeExpr returns the value of Label held by the most series of its
+// inner expression, as a single series labeled with that value whose sample is
+// the number of series holding it.
+type LabelModeExpr struct {
+	Left  SampleExpr
+	Label string
+	err   error
+}
+
+func mustNewLabelModeExpr(left SampleExpr, label string) *LabelModeExpr {
+	if !model.LabelName(label).IsValid() {
+		return &LabelModeExpr{
+			err: logqlmodel.NewParseError(fmt.Sprintf("invalid label name in %s: %s", OpLabelMode, label), 0, 0),
+		}
+	}
+	return &LabelModeExpr{
+		Left:  left,
+		Label: label,
+	}
+}
+
+func (e *LabelModeExpr) Selector() (LogSelectorExpr, error) {
 	if e.err != nil {
-		return 0, e.err
+		return nil, e.err
 	}
-	return e.Val, nil
+	return e.Left.Selector()
 }
 
-func (e *VectorExpr) Selector() (LogSelectorExpr, error) { return e, e.err }
-func (e *VectorExpr) HasFilter() bool                    { return false }
-func (e *VectorExpr) Shardable(_ bool) bool              { return false }
-func (e *VectorExpr) Walk(f WalkFn)                      { f(e) }
-func (e *VectorExpr) Accept(v RootVisitor)               { v.VisitVector(e) }
+func (e *LabelModeExpr) MatcherGroups() ([]MatcherRange, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.Left.MatcherGroups()
+}
 
-func (e *VectorExpr) Pipeline() (log.Pipeline, error)        { return log.NewNoopPipeline(), nil }
-func (e *VectorExpr) Matchers() []*labels.Matcher            { return nil }
-func (e *VectorExpr) MatcherGroups() ([]MatcherRange, error) { return nil, e.err }
+func (e *LabelModeExpr) Extractors() ([]SampleExtractor, error) {
+	if e.err != nil {
+		return []SampleExtractor{}, e.err
+	}
+	return e.Left.Extractors()
+}
+
+func (e *LabelModeExpr) Shardable(_ bool) bool {
+	return false
+}
+
+func (e *LabelModeExpr) Walk(f WalkFn) {
+	if !f(e) {
+		return
+	}
+	if e.Left != nil {
+		e.Left.Walk(f)
+	}
+}
+
+func (e *LabelModeExpr) Accept(v RootVisitor) { v.VisitLabelMode(e) }
+
+func (e *LabelModeExpr) Inner() SampleExpr { return e.Left }
+
+func (e *LabelModeExpr) WithInner(inner SampleExpr) SampleExpr {
+	cpy := *e
+	cpy.Left = inner
+	return &cpy
+}
+
+func (e *LabelModeExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(OpLabelMode)
+	sb.WriteString("(")
+	sb.WriteString(e.Left.String())
+	sb.WriteString(",")
+	sb.WriteString(strconv.Quote(e.Label))
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// RoundExpr rounds the samples of its inner expression to the nearest
+// multiple of ToNearest, the same way as the Prometheus round function.
+type RoundExpr struct {
+	Left      SampleExpr
+	ToNearest float64
+	err       error
+}
+
+func mustNewRoundExpr(left SampleExpr, toNearest *string) *RoundExpr {
+	e := &RoundExpr{
+		Left:      left,
+		ToNearest: 1,
+	}
+	if toNearest != nil {
+		n, err := strconv.ParseFloat(*toNearest, 64)
+		if err != nil {
+			return &RoundExpr{
+				err: logqlmodel.NewParseError(fmt.Sprintf("invalid step in %s: %s", OpRound, err.Error()), 0, 0),
+			}
+		}
+		e.ToNearest = n
+	}
+	return e
+}
+
+func (e *RoundExpr) Selector() (LogSelectorExpr, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.Left.Selector()
+}
+
+func (e *RoundExpr) MatcherGroups() ([]MatcherRange, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.Left.MatcherGroups()
+}
+
+func (e *RoundExpr) Extractors() ([]SampleExtractor, error) {
+	if e.err != nil {
+		return []SampleExtractor{}, e.err
+	}
+	return e.Left.Extractors()
+}
+
+func (e *RoundExpr) Shardable(_ bool) bool {
+	return false
+}
+
+func (e *RoundExpr) Walk(f WalkFn) {
+	if !f(e) {
+		return
+	}
+	if e.Left != nil {
+		e.Left.Walk(f)
+	}
+}
+
+func (e *RoundExpr) Accept(v RootVisitor) { v.VisitRound(e) }
+
+func (e *RoundExpr) Inner() SampleExpr { return e.Left }
+
+func (e *RoundExpr) WithInner(inner SampleExpr) SampleExpr {
+	cpy := *e
+	cpy.Left = inner
+	return &cpy
+}
+
+func (e *RoundExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(OpRound)
+	sb.WriteString("(")
+	sb.WriteString(e.Left.String())
+	if e.ToNearest != 1 {
+		sb.WriteString(",")
+		sb.WriteString(strconv.FormatFloat(e.ToNearest, 'f', -1, 64))
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// WrapperExpr is a function applied to the series of a single inner sample
+// expression, such as round or absent, that mappers rewrite by rewriting its
+// inner expression.
+type WrapperExpr interface {
+	SampleExpr
+	Inner() SampleExpr
+	// WithInner returns a copy of the function applied to inner.
+	WithInner(inner SampleExpr) SampleExpr
+}
+
+// AbsentExpr returns a single sample of value 1 at the steps its inner
+// expression has no sample at, and nothing at the other steps.
+type AbsentExpr struct {
+	Left SampleExpr
+	// Labels are the labels of the sample, derived from the inner expression
+	// when it is parsed so that they are kept when it is mapped.
+	Labels labels.Labels
+}
+
+func newAbsentExpr(left SampleExpr) *AbsentExpr {
+	lbs := labels.EmptyLabels()
+	// like in Prometheus, the labels are only derived from the matchers of a
+	// selector that is not aggregated.
+	if rangeExpr, ok := left.(*RangeAggregationExpr); ok && rangeExpr.Grouping == nil {
+		if l, err := AbsentLabels(rangeExpr); err == nil {
+			lbs = l
+		}
+	}
+	return &AbsentExpr{Left: left, Labels: lbs}
+}
+
+// AbsentLabels returns the labels of the samples replacing the missing series
+// of expr in absent_over_time and absent: the labels of the equality matchers
+// of its selector, except the ones matched more than once.
+func AbsentLabels(expr SampleExpr) (labels.Labels, error) {
+	m := labels.Labels{}
+
+	selector, err := expr.Selector()
+	if err != nil {
+		return labels.EmptyLabels(), err
+	}
+	lm := selector.Matchers()
+	if len(lm) == 0 {
+		return m, nil
+	}
+
+	empty := []string{}
+	for _, ma := range lm {
+		if ma.Name == labels.MetricName {
+			continue
+		}
+		if ma.Type == labels.MatchEqual && !m.Has(ma.Name) {
+			m = labels.NewBuilder(m).Set(ma.Name, ma.Value).Labels()
+		} else {
+			empty = append(empty, ma.Name)
+		}
+	}
+
+	for _, v := range empty {
+		m = labels.NewBuilder(m).Del(v).Labels()
+	}
+	return m, nil
+}
+
+func (e *AbsentExpr) Selector() (LogSelectorExpr, error) {
+	return e.Left.Selector()
+}
+
+func (e *AbsentExpr) MatcherGroups() ([]MatcherRange, error) {
+	return e.Left.MatcherGroups()
+}
+
+func (e *AbsentExpr) Extractors() ([]SampleExtractor, error) {
+	return e.Left.Extractors()
+}
+
+func (e *AbsentExpr) Shardable(_ bool) bool {
+	return false
+}
+
+func (e *AbsentExpr) Walk(f WalkFn) {
+	if !f(e) {
+		return
+	}
+	if e.Left != nil {
+		e.Left.Walk(f)
+	}
+}
+
+func (e *AbsentExpr) Accept(v RootVisitor) { v.VisitAbsent(e) }
+
+func (e *AbsentExpr) Inner() SampleExpr { return e.Left }
+
+func (e *AbsentExpr) WithInner(inner SampleExpr) SampleExpr {
+	cpy := *e
+	cpy.Left = inner
+	return &cpy
+}
+
+func (e *AbsentExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(OpTypeAbsent)
+	sb.WriteString("(")
+	sb.WriteString(e.Left.String())
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// ScalarExpr collapses its inner expression to a single sample without
+// labels per step: the value of the only sample of the step, or NaN when the
+// step has no sample or more than one. The result of an instant query is a
+// scalar, unless Vector is set by wrapping it in vector().
+type ScalarExpr struct {
+	Left   SampleExpr
+	Vector bool
+}
+
+func newScalarExpr(left SampleExpr, vector bool) *ScalarExpr {
+	return &ScalarExpr{Left: left, Vector: vector}
+}
+
+func (e *ScalarExpr) Selector() (LogSelectorExpr, error) {
+	return e.Left.Selector()
+}
+
+func (e *ScalarExpr) MatcherGroups() ([]MatcherRange, error) {
+	return e.Left.MatcherGroups()
+}
+
+func (e *ScalarExpr) Extractors() ([]SampleExtractor, error) {
+	return e.Left.Extractors()
+}
+
+func (e *ScalarExpr) Shardable(_ bool) bool {
+	return false
+}
+
+func (e *ScalarExpr) Walk(f WalkFn) {
+	if !f(e) {
+		return
+	}
+	if e.Left != nil {
+		e.Left.Walk(f)
+	}
+}
+
+func (e *ScalarExpr) Accept(v RootVisitor) { v.VisitScalar(e) }
+
+func (e *ScalarExpr) Inner() SampleExpr { return e.Left }
+
+func (e *ScalarExpr) WithInner(inner SampleExpr) SampleExpr {
+	cpy := *e
+	cpy.Left = inner
+	return &cpy
+}
+
+func (e *ScalarExpr) String() string {
+	var sb strings.Builder
+	if e.Vector {
+		sb.WriteString(OpTypeVector)
+		sb.WriteString("(")
+	}
+	sb.WriteString(OpTypeScalar)
+	sb.WriteString("(")
+	sb.WriteString(e.Left.String())
+	sb.WriteString(")")
+	if e.Vector {
+		sb.WriteString(")")
+	}
+	return sb.String()
+}
+
+// MetricLabelFmtExpr formats the labels of the series of its inner expression
+// with a label_format stage, after the inner expression is evaluated. Series
+// failing a template get the __error__ label. The stage applies to the metric
+// expression right before it, so the result of a binary operation must be
+// parenthesized to be formatted.
+type MetricLabelFmtExpr struct {
+	Left SampleExpr
+	Fmt  *LabelFmtExpr
+	err  error
+}
+
+func mustNewMetricLabelFmtExpr(left SampleExpr, format *LabelFmtExpr) *MetricLabelFmtExpr {
+	if _, err := format.Stage(); err != nil {
+		return &MetricLabelFmtExpr{
+			err: logqlmodel.NewParseError(err.Error(), 0, 0),
+		}
+	}
+	return &MetricLabelFmtExpr{
+		Left: left,
+		Fmt:  format,
+	}
+}
+
+func (e *MetricLabelFmtExpr) Selector() (LogSelectorExpr, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.Left.Selector()
+}
+
+func (e *MetricLabelFmtExpr) MatcherGroups() ([]MatcherRange, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.Left.MatcherGroups()
+}
+
+func (e *MetricLabelFmtExpr) Extractors() ([]SampleExtractor, error) {
+	if e.err != nil {
+		return []SampleExtractor{}, e.err
+	}
+	return e.Left.Extractors()
+}
+
+func (e *MetricLabelFmtExpr) Shardable(_ bool) bool {
+	return false
+}
+
+func (e *MetricLabelFmtExpr) Walk(f WalkFn) {
+	if !f(e) {
+		return
+	}
+	if e.Left != nil {
+		e.Left.Walk(f)
+	}
+}
+
+func (e *MetricLabelFmtExpr) Accept(v RootVisitor) { v.VisitMetricLabelFmt(e) }
+
+func (e *MetricLabelFmtExpr) Inner() SampleExpr { return e.Left }
+
+func (e *MetricLabelFmtExpr) WithInner(inner SampleExpr) SampleExpr {
+	cpy := *e
+	cpy.Left = inner
+	return &cpy
+}
+
+func (e *MetricLabelFmtExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(e.Left.String())
+	sb.WriteString(" ")
+	sb.WriteString(e.Fmt.String())
+	return sb.String()
+}
+
+// HistogramQuantileExpr computes the φ-quantile from the buckets of a histogram
+// that is encoded as series carrying an `le` (upper bound) label.
+type HistogramQuantileExpr struct {
+	Left     SampleExpr
+	Quantile float64
+	err      error
+}
+
+func mustNewHistogramQuantileExpr(quantile string, left SampleExpr) *HistogramQuantileExpr {
+	q, err := strconv.ParseFloat(quantile, 64)
+	if err != nil {
+		return &HistogramQuantileExpr{
+			err: logqlmodel.NewParseError(fmt.Sprintf("invalid quantile in %s: %s", OpTypeHistogramQuantile, err.Error()), 0, 0),
+		}
+	}
+	return &HistogramQuantileExpr{
+		Left:     left,
+		Quantile: q,
+	}
+}
+
+func (e *HistogramQuantileExpr) Selector() (LogSelectorExpr, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.Left.Selector()
+}
+
+func (e *HistogramQuantileExpr) MatcherGroups() ([]MatcherRange, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.Left.MatcherGroups()
+}
+
+func (e *HistogramQuantileExpr) Extractors() ([]SampleExtractor, error) {
+	if e.err != nil {
+		return []SampleExtractor{}, e.err
+	}
+	return e.Left.Extractors()
+}
+
+// Shardable returns false since all buckets of a histogram must be known to compute a quantile.
+func (e *HistogramQuantileExpr) Shardable(_ bool) bool {
+	return false
+}
+
+func (e *HistogramQuantileExpr) Walk(f WalkFn) {
+	if !f(e) {
+		return
+	}
+	if e.Left != nil {
+		e.Left.Walk(f)
+	}
+}
+
+func (e *HistogramQuantileExpr) Accept(v RootVisitor) { v.VisitHistogramQuantile(e) }
+
+func (e *HistogramQuantileExpr) Inner() SampleExpr { return e.Left }
+
+func (e *HistogramQuantileExpr) WithInner(inner SampleExpr) SampleExpr {
+	cpy := *e
+	cpy.Left = inner
+	return &cpy
+}
+
+func (e *HistogramQuantileExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(OpTypeHistogramQuantile)
+	sb.WriteString("(")
+	sb.WriteString(strconv.FormatFloat(e.Quantile, 'f', -1, 64))
+	sb.WriteString(",")
+	sb.WriteString(e.Left.String())
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// shardableOps lists the operations which may be sharded, but are not
+// guaranteed to be. See the `Shardable()` implementations
+// on the respective expr types for more details.
+// topk, botk, max, & min all must be concatenated and then evaluated in order to avoid
+// potential data loss due to series distribution across shards.
+// For example, grouping by `cluster` for a `max` operation may yield
+// 2 results on the first shard and 10 results on the second. If we prematurely
+// calculated `max`s on each shard, the shard/label combination with `2` may be
+// discarded and some other combination with `11` may be reported falsely as the max.
+//
+// Explanation: this is my (owen-d) best understanding.
+//
+// For an operation to be shardable, first the sample-operation itself must be associative like (+, *) but not (%, /, ^).
+// Secondly, if the operation is part of a vector aggregation expression or utilizes logical/set binary ops,
+// the vector operation must be distributive over the sample-operation.
+// This ensures that the vector merging operation can be applied repeatedly to data in different shards.
+// references:
+// https://en.wikipedia.org/wiki/Associative_property
+// https://en.wikipedia.org/wiki/Distributive_property
+var shardableOps = map[string]bool{
+	// vector ops
+	OpTypeSum: true,
+	// avg is only marked as shardable because we remap it into sum/count.
+	OpTypeAvg:   true,
+	OpTypeCount: true,
+	OpTypeMax:   true,
+	OpTypeMin:   true,
+
+	OpTypeApproxTopK: true,
+
+	// range vector ops
+	OpRangeTypeAvg:          true,
+	OpRangeTypeCount:        true,
+	OpRangeTypeFirst:        true,
+	OpRangeTypeLast:         true,
+	OpRangeTypeRate:         true,
+	OpRangeTypeBytes:        true,
+	OpRangeTypeBytesRate:    true,
+	OpRangeTypeSum:          true,
+	OpRangeTypeMatchedBytes: true,
+	OpRangeTypeMax:          true,
+	OpRangeTypeMin:          true,
+	OpRangeTypeQuantile:     true,
+
+	// binops - arith
+	OpTypeAdd: true,
+	OpTypeMul: true,
+}
+
+type MatcherRange struct {
+	Matchers         []*labels.Matcher
+	Interval, Offset time.Duration
+}
+
+func MatcherGroups(expr Expr) ([]MatcherRange, error) {
+	switch e := expr.(type) {
+	case SampleExpr:
+		return e.MatcherGroups()
+	case LogSelectorExpr:
+		if xs := e.Matchers(); len(xs) > 0 {
+			return []MatcherRange{
+				{
+					Matchers: xs,
+				},
+			}, nil
+		}
+		return nil, nil
+	default:
+		return nil, nil
+	}
+}
+
+type VectorExpr struct {
+	Val float64
+	err error
+}
+
+func NewVectorExpr(scalar string) *VectorExpr {
+	n, err := strconv.ParseFloat(scalar, 64)
+	if err != nil {
+		err = logqlmodel.NewParseError(fmt.Sprintf("unable to parse vectorExpr as a float: %s", err.Error()), 0, 0)
+	}
+	return &VectorExpr{
+		Val: n,
+		err: err,
+	}
+}
+
+func (e *VectorExpr) Err() error {
+	return e.err
+}
+
+func (e *VectorExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(OpTypeVector)
+	sb.WriteString("(")
+	sb.WriteString(fmt.Sprintf("%f", e.Val))
+	sb.WriteString(")")
+	return sb.String()
+}
+
+func (e *VectorExpr) Value() (float64, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	return e.Val, nil
+}
+
+func (e *VectorExpr) Selector() (LogSelectorExpr, error) { return e, e.err }
+func (e *VectorExpr) HasFilter() bool                    { return false }
+func (e *VectorExpr) Shardable(_ bool) bool              { return false }
+func (e *VectorExpr) Walk(f WalkFn)                      { f(e) }
+func (e *VectorExpr) Accept(v RootVisitor)               { v.VisitVector(e) }
+
+func (e *VectorExpr) Pipeline() (log.Pipeline, error)        { return log.NewNoopPipeline(), nil }
+func (e *VectorExpr) Matchers() []*labels.Matcher            { return nil }
+func (e *VectorExpr) MatcherGroups() ([]MatcherRange, error) { return nil, e.err }
 
 func (e *VectorExpr) Extractors() ([]log.SampleExtractor, error) { return []log.SampleExtractor{}, nil }
 
@@ -2453,12 +3352,20 @@ type VariantsExpr interface {
 	SetVariant(i int, e SampleExpr) error
 	Variants() []SampleExpr
 	Selector() (LogSelectorExpr, error)
+	// Merge returns the aggregation merging the series of the variants that
+	// share their other labels, or "" if the variants are not merged.
+	Merge() string
+	// Grouping returns the grouping of the outer aggregation merging the
+	// series of the variants, or nil if they are merged by their other labels.
+	Grouping() *Grouping
 	Expr
 }
 
 type MultiVariantExpr struct {
 	logRange *LogRangeExpr
 	variants []SampleExpr
+	merge    string
+	grouping *Grouping
 	err      error
 }
 
@@ -2496,6 +3403,22 @@ func (m *MultiVariantExpr) Variants() []SampleExpr {
 	return m.variants
 }
 
+func (m *MultiVariantExpr) Merge() string {
+	return m.merge
+}
+
+func (m *MultiVariantExpr) SetMerge(op string) {
+	m.merge = op
+}
+
+func (m *MultiVariantExpr) Grouping() *Grouping {
+	return m.grouping
+}
+
+func (m *MultiVariantExpr) SetGrouping(g *Grouping) {
+	m.grouping = g
+}
+
 func (m *MultiVariantExpr) AddVariant(v SampleExpr) {
 	m.variants = append(m.variants, v)
 }
@@ -2554,6 +3477,17 @@ func (m *MultiVariantExpr) String() string {
 	sb.WriteString(m.logRange.String())
 	sb.WriteString(")")
 
+	if m.grouping != nil {
+		return formatVectorOperation(m.merge, m.grouping, sb.String())
+	}
+	if m.merge != "" {
+		sb.WriteString(" ")
+		sb.WriteString(VariantsMerged)
+		sb.WriteString("(")
+		sb.WriteString(m.merge)
+		sb.WriteString(")")
+	}
+
 	return sb.String()
 }
 
@@ -2563,6 +3497,18 @@ func (m *MultiVariantExpr) Accept(v RootVisitor) {
 
 // Pretty prettyfies any LogQL expression at given `level` of the whole LogQL query.
 func (m *MultiVariantExpr) Pretty(level int) string {
+	if m.grouping != nil {
+		s := Indent(level) + m.merge + m.grouping.Pretty(level)
+		return s + "(\n" + m.prettyVariants(level+1) + "\n" + Indent(level) + ")"
+	}
+	s := m.prettyVariants(level)
+	if m.merge != "" {
+		s += " " + VariantsMerged + "(" + m.merge + ")"
+	}
+	return s
+}
+
+func (m *MultiVariantExpr) prettyVariants(level int) string {
 	s := Indent(level)
 
 	s += OpVariants + "(\n"
@@ -2583,7 +3529,7 @@ func (m *MultiVariantExpr) Pretty(level int) string {
 
 	s += Indent(level) + ") of (\n"
 	s += m.logRange.Pretty(level + 1)
-	s += Indent(level) + "\n)"
+	s += "\n" + Indent(level) + ")"
 
 	return s
 }
@@ -2611,8 +3557,50 @@ func (m *MultiVariantExpr) Selector() (LogSelectorExpr, error) {
 }
 
 func newVariantsExpr(variants []SampleExpr, logRange *LogRangeExpr) VariantsExpr {
+	if logRange.Unwrap != nil && logRange.Unwrap.err != nil {
+		return &MultiVariantExpr{err: logqlmodel.NewParseError(logRange.Unwrap.err.Error(), 0, 0)}
+	}
+	return &MultiVariantExpr{
+		variants: variants,
+		logRange: logRange,
+	}
+}
+
+// newMergedVariantsExpr returns variants whose series sharing their other
+// labels are merged into a single series with the aggregation op.
+func newMergedVariantsExpr(variants []SampleExpr, logRange *LogRangeExpr, op string) VariantsExpr {
+	switch op {
+	case OpTypeSum, OpTypeAvg, OpTypeMin, OpTypeMax, OpTypeCount:
+	default:
+		return &MultiVariantExpr{
+			err: logqlmodel.NewParseError(fmt.Sprintf("unsupported aggregation to merge variants: %s", op), 0, 0),
+		}
+	}
+	if logRange.Unwrap != nil && logRange.Unwrap.err != nil {
+		return &MultiVariantExpr{err: logqlmodel.NewParseError(logRange.Unwrap.err.Error(), 0, 0)}
+	}
 	return &MultiVariantExpr{
 		variants: variants,
 		logRange: logRange,
+		merge:    op,
+	}
+}
+
+// newGroupedVariantsExpr returns the variants whose series are aggregated with
+// the op of an outer aggregation by its grouping, across variants.
+func newGroupedVariantsExpr(e VariantsExpr, op string, gr *Grouping) VariantsExpr {
+	m, ok := e.(*MultiVariantExpr)
+	if !ok || m.err != nil {
+		return e
+	}
+	if m.merge != "" {
+		return &MultiVariantExpr{
+			err: logqlmodel.NewParseError("merged variants cannot be aggregated again", 0, 0),
+		}
+	}
+	merged, ok := newMergedVariantsExpr(m.variants, m.logRange, op).(*MultiVariantExpr)
+	if ok && merged.err == nil {
+		merged.grouping = gr
 	}
+	return merged
 }
@@ -88,6 +88,8 @@ func Test_SampleExpr_String(t *testing.T) {
 		`sum by(a) (rate( ( {job="mysql"} |="error" !="timeout" ) [10s] ) )`,
 		`sum(count_over_time({job="mysql"}[5m]))`,
 		`sum(count_over_time({job="mysql"}[5m] offset 10m))`,
+		`sum(count_over_time({job="mysql"}[5m] @ 1609746000))`,
+		`sum(count_over_time({job="mysql"}[5m] offset 10m @ 1609746000.5))`,
 		`sum(count_over_time({job="mysql"} | json [5m]))`,
 		`sum(count_over_time({job="mysql"} | json [5m] offset 10m))`,
 		`sum(count_over_time({job="mysql"} | logfmt [5m]))`,
@@ -1174,6 +1176,9 @@ func Test_VariantsExpr_String(t *testing.T) {
 		{
 			`variants(sum by (app) (count_over_time({baz="qux", foo!="bar"}[5m])),rate({baz="qux", foo!="bar"}[5m])) of ({baz="qux", foo!="bar"} |= "that" [5m])`,
 		},
+		{`sum by (app) (variants(count_over_time({foo="bar"}[5m]), bytes_over_time({foo="bar"}[5m])) of ({foo="bar"}[5m]))`},
+		{`avg(variants(count_over_time({foo="bar"}[5m])) of ({foo="bar"}[5m])) without (host)`},
+		{`count(variants(count_over_time({foo="bar"}[5m])) of ({foo="bar"}[5m]))`},
 	}
 
 	for _, tt := range tests {
@@ -1208,6 +1213,17 @@ variants(
   bytes_over_time({baz="qux", foo=~"bar"}[5m])
 ) of (
   {baz="qux", foo=~"bar"} | logfmt | this="that" [5m]
+)`,
+		},
+		{
+			`sum by (app) (variants(count_over_time({foo="bar"}[5m]), bytes_over_time({foo="bar"}[5m])) of ({foo="bar"}[5m]))`,
+			`sum by (app)(
+  variants(
+    count_over_time({foo="bar"}[5m]),
+    bytes_over_time({foo="bar"}[5m])
+  ) of (
+    {foo="bar"} [5m]
+  )
 )`,
 		},
 	}
@@ -1222,3 +1238,28 @@ variants(
 		})
 	}
 }
+
+func TestAbsentExpr_Labels(t *testing.T) {
+	expr, err := ParseSampleExpr(`absent(rate({app="foo", env=~"prod.*"}[1m]))`)
+	require.NoError(t, err)
+	absent := expr.(*AbsentExpr)
+	want := labels.FromStrings("app", "foo")
+	require.Equal(t, want, absent.Labels)
+
+	// the labels are kept when the inner expression is mapped, cloned or
+	// serialized.
+	mapped := absent.WithInner(MustParseExpr(`sum(rate({app="foo"}[1m]))`).(SampleExpr))
+	require.Equal(t, want, mapped.(*AbsentExpr).Labels)
+	cloned, err := Clone[SampleExpr](absent)
+	require.NoError(t, err)
+	require.Equal(t, want, cloned.(*AbsentExpr).Labels)
+	var buf strings.Builder
+	require.NoError(t, EncodeJSON(absent, &buf))
+	decoded, err := DecodeJSON(buf.String())
+	require.NoError(t, err)
+	require.Equal(t, want, decoded.(*AbsentExpr).Labels)
+
+	expr, err = ParseSampleExpr(`absent(sum(rate({app="foo"}[1m])))`)
+	require.NoError(t, err)
+	require.Equal(t, labels.EmptyLabels(), expr.(*AbsentExpr).Labels)
+}
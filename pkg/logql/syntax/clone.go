@@ -55,6 +55,7 @@ func (v *cloneVisitor) VisitVectorAggregation(e *VectorAggregationExpr) {
 		Left:      MustClone[SampleExpr](e.Left),
 		Params:    e.Params,
 		Operation: e.Operation,
+		Quantile:  e.Quantile,
 	}
 
 	if e.Grouping != nil {
@@ -68,6 +69,7 @@ func (v *cloneVisitor) VisitRangeAggregation(e *RangeAggregationExpr) {
 	copied := &RangeAggregationExpr{
 		Left:      MustClone[*LogRangeExpr](e.Left),
 		Operation: e.Operation,
+		Label:     e.Label,
 	}
 
 	if e.Grouping != nil {
@@ -79,6 +81,11 @@ func (v *cloneVisitor) VisitRangeAggregation(e *RangeAggregationExpr) {
 		copied.Params = &tmp
 	}
 
+	if e.Default != nil {
+		tmp := *e.Default
+		copied.Default = &tmp
+	}
+
 	v.cloned = copied
 }
 
@@ -87,6 +94,41 @@ func (v *cloneVisitor) VisitLabelReplace(e *LabelReplaceExpr) {
 	v.cloned = mustNewLabelReplaceExpr(left, e.Dst, e.Replacement, e.Src, e.Regex)
 }
 
+func (v *cloneVisitor) VisitHistogramQuantile(e *HistogramQuantileExpr) {
+	v.cloned = &HistogramQuantileExpr{
+		Left:     MustClone[SampleExpr](e.Left),
+		Quantile: e.Quantile,
+	}
+}
+
+func (v *cloneVisitor) VisitLabelDropRegex(e *LabelDropRegexExpr) {
+	left := MustClone[SampleExpr](e.Left)
+	v.cloned = mustNewLabelDropRegexExpr(left, e.Regex)
+}
+
+func (v *cloneVisitor) VisitLabelMode(e *LabelModeExpr) {
+	left := MustClone[SampleExpr](e.Left)
+	v.cloned = mustNewLabelModeExpr(left, e.Label)
+}
+
+func (v *cloneVisitor) VisitRound(e *RoundExpr) {
+	left := MustClone[SampleExpr](e.Left)
+	v.cloned = &RoundExpr{Left: left, ToNearest: e.ToNearest}
+}
+
+func (v *cloneVisitor) VisitAbsent(e *AbsentExpr) {
+	v.cloned = &AbsentExpr{Left: MustClone[SampleExpr](e.Left), Labels: e.Labels.Copy()}
+}
+
+func (v *cloneVisitor) VisitScalar(e *ScalarExpr) {
+	v.cloned = newScalarExpr(MustClone[SampleExpr](e.Left), e.Vector)
+}
+
+func (v *cloneVisitor) VisitMetricLabelFmt(e *MetricLabelFmtExpr) {
+	left := MustClone[SampleExpr](e.Left)
+	v.cloned = &MetricLabelFmtExpr{Left: left, Fmt: MustClone[*LabelFmtExpr](e.Fmt)}
+}
+
 func (v *cloneVisitor) VisitLiteral(e *LiteralExpr) {
 	v.cloned = &LiteralExpr{Val: e.Val}
 }
@@ -101,10 +143,21 @@ func (v *cloneVisitor) VisitLogRange(e *LogRangeExpr) {
 		Interval: e.Interval,
 		Offset:   e.Offset,
 	}
+	if e.At != nil {
+		at := *e.At
+		copied.At = &at
+	}
 	if e.Unwrap != nil {
 		copied.Unwrap = &UnwrapExpr{
 			Identifier: e.Unwrap.Identifier,
 			Operation:  e.Unwrap.Operation,
+			Arithmetic: e.Unwrap.Arithmetic,
+			RHS:        e.Unwrap.RHS,
+			Regex:      e.Unwrap.Regex,
+		}
+		if e.Unwrap.Default != nil {
+			def := *e.Unwrap.Default
+			copied.Unwrap.Default = &def
 		}
 		if e.Unwrap.PostFilters != nil {
 			copied.Unwrap.PostFilters = make([]log.LabelFilterer, len(e.Unwrap.PostFilters))
@@ -144,6 +197,14 @@ func (v *cloneVisitor) VisitDecolorize(*DecolorizeExpr) {
 	v.cloned = &DecolorizeExpr{}
 }
 
+func (v *cloneVisitor) VisitUnit(e *UnitExpr) {
+	v.cloned = &UnitExpr{Unit: e.Unit}
+}
+
+func (v *cloneVisitor) VisitJSONSchema(e *JSONSchemaExpr) {
+	v.cloned = &JSONSchemaExpr{Name: e.Name, Schema: e.Schema}
+}
+
 func (v *cloneVisitor) VisitDropLabels(e *DropLabelsExpr) {
 	copied := &DropLabelsExpr{
 		dropLabels: make([]log.NamedLabelMatcher, len(e.dropLabels)),
@@ -305,6 +366,10 @@ func (v *cloneVisitor) VisitVariants(e *MultiVariantExpr) {
 	copied := &MultiVariantExpr{
 		logRange: MustClone[*LogRangeExpr](e.logRange),
 		variants: make([]SampleExpr, len(e.variants)),
+		merge:    e.merge,
+	}
+	if e.grouping != nil {
+		copied.grouping = cloneGrouping(e.grouping)
 	}
 
 	for i, v := range e.variants {
@@ -23,6 +23,15 @@ func TestClone(t *testing.T) {
 		"simple aggregation with unwrap": {
 			query: `sum_over_time({env="prod", app=~"loki.*"} | unwrap bytes[5m])`,
 		},
+		"unwrap default": {
+			query: `rate({app="foo"} | logfmt | unwrap bytes(size) default 0 [5m])`,
+		},
+		"unwrap arithmetic": {
+			query: `avg_over_time({app="foo"} | logfmt | unwrap (bytes_sent / duration)[5m])`,
+		},
+		"unwrap regex": {
+			query: `avg_over_time({app="foo"} | unwrap_regex "latency_p99=(?P<v>[0-9.]+)" as v [5m])`,
+		},
 		"bin op": {
 			query: `(count_over_time({env="prod", app=~"loki.*"}[5m]) >= 0)`,
 		},
@@ -50,6 +59,45 @@ func TestClone(t *testing.T) {
 		"label replace": {
 			query: `label_replace(vector(0.000000),"foo","bar","","")`,
 		},
+		"histogram quantile": {
+			query: `histogram_quantile(0.9,sum by (le)(rate({app="foo"} | unwrap count[5m])))`,
+		},
+		"label drop regex": {
+			query: `label_drop_regex(count_over_time({app="foo"}[5m]),"tmp_.*")`,
+		},
+		"label mode": {
+			query: `label_mode(count_over_time({app="foo"}[5m]),"version")`,
+		},
+		"round": {
+			query: `round(rate({app="foo"}[5m]),0.01)`,
+		},
+		"round default step": {
+			query: `round(rate({app="foo"}[5m]))`,
+		},
+		"absent": {
+			query: `absent(sum(rate({app="foo"}[5m])))`,
+		},
+		"scalar": {
+			query: `scalar(sum(rate({app="foo"}[5m])))`,
+		},
+		"vector of scalar": {
+			query: `vector(scalar(sum(rate({app="foo"}[5m]))))`,
+		},
+		"metric label format": {
+			query: `sum by (app,namespace)(rate({app="foo"}[5m])) | label_format new="{{.app}}-{{.namespace}}",ns=namespace`,
+		},
+		"unit": {
+			query: `bytes_over_time({app="foo"} | __unit__("bytes")[5m])`,
+		},
+		"json schema": {
+			query: `count_over_time({app="foo"} | json_schema "access_log" | __error__=""[5m])`,
+		},
+		"count values over time": {
+			query: `count_values_over_time("val",{app="foo"} | unwrap x[5m])`,
+		},
+		"at modifier": {
+			query: `count_over_time({app="foo"}[1m] offset 5m @ 60.5)`,
+		},
 		"filters with bytes": {
 			query: `{app="foo"} |= "bar" | json | ( status_code <500 or ( status_code>200 , size>=2.5KiB ) )`,
 		},
@@ -73,6 +121,12 @@ func TestClone(t *testing.T) {
 		"multiple variants with filters": {
 			query: `variants(bytes_over_time({foo="bar"}[5m]), count_over_time({foo="bar"}[5m])) of ({foo="bar"} | logfmt[5m])`,
 		},
+		"merged variants": {
+			query: `variants(count_over_time({foo="bar"}[5m]), count_over_time({foo="bar"} |= "error"[5m])) of ({foo="bar"}[5m]) merged(avg)`,
+		},
+		"grouped variants": {
+			query: `sum by (app) (variants(count_over_time({foo="bar"}[5m]), count_over_time({foo="bar"} |= "error"[5m])) of ({foo="bar"}[5m]))`,
+		},
 	}
 
 	for name, test := range tests {
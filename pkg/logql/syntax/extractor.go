@@ -70,6 +70,28 @@ func (r RangeAggregationExpr) extractor(override *Grouping) (log.SampleExtractor
 			convOp = log.ConvertFloat
 		}
 
+		if r.Left.Unwrap.Regex != "" {
+			// extract the capture group as a label from the line first.
+			re, err := log.NewRegexpParser(r.Left.Unwrap.Regex)
+			if err != nil {
+				return nil, err
+			}
+			stages = append(stages, re)
+		}
+		if r.Left.Unwrap.Arithmetic != "" {
+			return log.LabelArithmeticExtractorWithStages(
+				r.Left.Unwrap.Identifier, r.Left.Unwrap.Arithmetic, r.Left.Unwrap.RHS,
+				groups, without, noLabels, stages,
+				log.ReduceAndLabelFilter(r.Left.Unwrap.PostFilters),
+			)
+		}
+		if r.Left.Unwrap.Default != nil {
+			return log.LabelExtractorWithDefault(
+				r.Left.Unwrap.Identifier,
+				convOp, *r.Left.Unwrap.Default, groups, without, noLabels, stages,
+				log.ReduceAndLabelFilter(r.Left.Unwrap.PostFilters),
+			)
+		}
 		return log.LabelExtractorWithStages(
 			r.Left.Unwrap.Identifier,
 			convOp, groups, without, noLabels, stages,
@@ -82,11 +104,47 @@ func (r RangeAggregationExpr) extractor(override *Grouping) (log.SampleExtractor
 		return log.NewLineSampleExtractor(log.CountExtractor, stages, groups, without, noLabels)
 	case OpRangeTypeBytes, OpRangeTypeBytesRate:
 		return log.NewLineSampleExtractor(log.BytesExtractor, stages, groups, without, noLabels)
+	case OpRangeTypeMatchedBytes:
+		matchers, err := r.substringMatchers()
+		if err != nil {
+			return nil, err
+		}
+		return log.NewLineSampleExtractor(log.NewMatchedBytesExtractor(matchers), stages, groups, without, noLabels)
 	default:
 		return nil, fmt.Errorf(UnsupportedErr, r.Operation)
 	}
 }
 
+// substringMatchers returns a matcher for each `|=` and `|~` line filter of
+// the pipeline, including their `or` alternatives. Negated and pattern filters
+// don't match substrings and are ignored.
+func (r RangeAggregationExpr) substringMatchers() ([]log.Matcher, error) {
+	p, ok := r.Left.Left.(*PipelineExpr)
+	if !ok {
+		return nil, nil
+	}
+	var matchers []log.Matcher
+	for _, stage := range p.MultiStages {
+		filter, ok := stage.(*LineFilterExpr)
+		if !ok {
+			continue
+		}
+		for curr := filter; curr != nil; curr = curr.Left {
+			for alt := curr; alt != nil; alt = alt.Or {
+				if alt.Op != "" || (alt.Ty != log.LineMatchEqual && alt.Ty != log.LineMatchRegexp) {
+					continue
+				}
+				m, err := log.NewSubstringMatcher(alt.Match, alt.Ty)
+				if err != nil {
+					return nil, err
+				}
+				matchers = append(matchers, m)
+			}
+		}
+	}
+	return matchers, nil
+}
+
 func (m *MultiVariantExpr) Extractors() ([]log.SampleExtractor, error) {
 	if m.err != nil {
 		return nil, m.err
@@ -177,13 +235,46 @@ func variantRangeAggExprExtractor(rangeAgg *RangeAggregationExpr) (log.SampleExt
 
 		// Create label extractor without the common pipeline stages
 		// The common pipeline will be applied separately
+		var stages []log.Stage
+		if rangeAgg.Left.Unwrap.Regex != "" {
+			// extract the capture group as a label from the line first.
+			re, err := log.NewRegexpParser(rangeAgg.Left.Unwrap.Regex)
+			if err != nil {
+				return nil, err
+			}
+			stages = append(stages, re)
+		}
+		if rangeAgg.Left.Unwrap.Arithmetic != "" {
+			return log.LabelArithmeticExtractorWithStages(
+				rangeAgg.Left.Unwrap.Identifier,
+				rangeAgg.Left.Unwrap.Arithmetic,
+				rangeAgg.Left.Unwrap.RHS,
+				groups,
+				without,
+				noLabels,
+				stages,
+				log.ReduceAndLabelFilter(rangeAgg.Left.Unwrap.PostFilters),
+			)
+		}
+		if rangeAgg.Left.Unwrap.Default != nil {
+			return log.LabelExtractorWithDefault(
+				rangeAgg.Left.Unwrap.Identifier,
+				convOp,
+				*rangeAgg.Left.Unwrap.Default,
+				groups,
+				without,
+				noLabels,
+				stages,
+				log.ReduceAndLabelFilter(rangeAgg.Left.Unwrap.PostFilters),
+			)
+		}
 		return log.LabelExtractorWithStages(
 			rangeAgg.Left.Unwrap.Identifier,
 			convOp,
 			groups,
 			without,
 			noLabels,
-			nil, // No stages here - common pipeline will be applied separately
+			stages,
 			log.ReduceAndLabelFilter(rangeAgg.Left.Unwrap.PostFilters),
 		)
 	}
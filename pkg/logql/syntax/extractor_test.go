@@ -139,6 +139,11 @@ func Test_MultiVariantExpr_Extractors(t *testing.T) {
 				variantQuery: `variants(sum by (method) (sum_over_time({app="foo"} | logfmt | unwrap duration(latency) [5m]))) of ({app="foo"} | json [5m])`,
 				testLine:     `error=true method="GET" size=1024 latency="250s"`,
 			},
+			{
+				query:        `sum_over_time({app="foo"} | logfmt | unwrap_regex "latency=(?P<v>[0-9]+)" as v [5m])`,
+				variantQuery: `variants(sum_over_time({app="foo"} | logfmt | unwrap_regex "latency=(?P<v>[0-9]+)" as v [5m])) of ({app="foo"} | logfmt [5m])`,
+				testLine:     `error=true method="GET" size=1024 latency=250`,
+			},
 		} {
 			t.Run(tc.query, func(t *testing.T) {
 				now := time.Now()
@@ -29,6 +29,7 @@ var tokens = map[string]int{
 	"|>":           PIPE_PATTERN,
 	OpPipe:         PIPE,
 	OpUnwrap:       UNWRAP,
+	OpUnwrapRegex:  UNWRAP_REGEX,
 	"(":            OPEN_PARENTHESIS,
 	")":            CLOSE_PARENTHESIS,
 	"by":           BY,
@@ -38,6 +39,7 @@ var tokens = map[string]int{
 	"]":            CLOSE_BRACKET,
 	OpLabelReplace: LABEL_REPLACE,
 	OpOffset:       OFFSET,
+	OpAt:           AT,
 	OpOn:           ON,
 	OpIgnoring:     IGNORING,
 	OpGroupLeft:    GROUP_LEFT,
@@ -75,6 +77,9 @@ var tokens = map[string]int{
 	OpFilterIP:   IP,
 	OpDecolorize: DECOLORIZE,
 
+	// validation
+	OpJSONSchema: JSON_SCHEMA,
+
 	// drop labels
 	OpDrop: DROP,
 
@@ -94,22 +99,32 @@ var parserFlags = map[string]struct{}{
 // functionTokens are tokens that needs to be suffixes with parenthesis
 var functionTokens = map[string]int{
 	// range vec ops
-	OpRangeTypeRate:        RATE,
-	OpRangeTypeRateCounter: RATE_COUNTER,
-	OpRangeTypeCount:       COUNT_OVER_TIME,
-	OpRangeTypeBytesRate:   BYTES_RATE,
-	OpRangeTypeBytes:       BYTES_OVER_TIME,
-	OpRangeTypeAvg:         AVG_OVER_TIME,
-	OpRangeTypeSum:         SUM_OVER_TIME,
-	OpRangeTypeMin:         MIN_OVER_TIME,
-	OpRangeTypeMax:         MAX_OVER_TIME,
-	OpRangeTypeStdvar:      STDVAR_OVER_TIME,
-	OpRangeTypeStddev:      STDDEV_OVER_TIME,
-	OpRangeTypeQuantile:    QUANTILE_OVER_TIME,
-	OpRangeTypeFirst:       FIRST_OVER_TIME,
-	OpRangeTypeLast:        LAST_OVER_TIME,
-	OpRangeTypeAbsent:      ABSENT_OVER_TIME,
-	OpTypeVector:           VECTOR,
+	OpRangeTypeRate:         RATE,
+	OpRangeTypeRateCounter:  RATE_COUNTER,
+	OpRangeTypeCount:        COUNT_OVER_TIME,
+	OpRangeTypeBytesRate:    BYTES_RATE,
+	OpRangeTypeBytes:        BYTES_OVER_TIME,
+	OpRangeTypeAvg:          AVG_OVER_TIME,
+	OpRangeTypeSum:          SUM_OVER_TIME,
+	OpRangeTypeMin:          MIN_OVER_TIME,
+	OpRangeTypeMax:          MAX_OVER_TIME,
+	OpRangeTypeStdvar:       STDVAR_OVER_TIME,
+	OpRangeTypeStddev:       STDDEV_OVER_TIME,
+	OpRangeTypeQuantile:     QUANTILE_OVER_TIME,
+	OpRangeTypeFirst:        FIRST_OVER_TIME,
+	OpRangeTypeLast:         LAST_OVER_TIME,
+	OpRangeTypeAbsent:       ABSENT_OVER_TIME,
+	OpRangeTypeCountValues:  COUNT_VALUES_OVER_TIME,
+	OpRangeTypeCV:           CV_OVER_TIME,
+	OpRangeTypeZScore:       ZSCORE_OVER_TIME,
+	OpRangeTypeMatchedBytes: MATCHED_BYTES_OVER_TIME,
+	OpRangeTypeAutocorr:     AUTOCORR_OVER_TIME,
+	OpRangeTypeChanges:      CHANGES_OVER_TIME,
+	OpRangeTypeDelta:        DELTA,
+	OpRangeTypeIdelta:       IDELTA,
+	OpRangeTypeDeriv:        DERIV,
+	OpRangeTypeResets:       RESETS_OVER_TIME,
+	OpTypeVector:            VECTOR,
 
 	// vec ops
 	OpTypeSum:      SUM,
@@ -123,10 +138,21 @@ var functionTokens = map[string]int{
 	OpTypeTopK:     TOPK,
 	OpTypeSort:     SORT,
 	OpTypeSortDesc: SORT_DESC,
+	OpTypeQuantile: QUANTILE,
 	OpLabelReplace: LABEL_REPLACE,
 
 	OpTypeApproxTopK: APPROX_TOPK,
 
+	OpTypeHistogramQuantile: HISTOGRAM_QUANTILE,
+
+	OpLabelDropRegex: LABEL_DROP_REGEX,
+	OpLabelMode:      LABEL_MODE,
+	OpRound:          ROUND,
+	OpTypeAbsent:     ABSENT,
+	OpTypeScalar:     SCALAR,
+
+	OpUnit: UNIT,
+
 	// conversion Op
 	OpConvBytes:           BYTES_CONV,
 	OpConvDuration:        DURATION_CONV,
@@ -134,6 +160,9 @@ var functionTokens = map[string]int{
 
 	// filterOp
 	OpFilterIP: IP,
+
+	// variants
+	VariantsMerged: MERGED,
 }
 
 type lexer struct {
@@ -126,6 +126,9 @@ func validateExpr(expr Expr) error {
 }
 
 func validateVariantsExpr(e VariantsExpr) error {
+	if mv, ok := e.(*MultiVariantExpr); ok && mv.err != nil {
+		return mv.err
+	}
 	err := validateLogSelectorExpression(e.LogRange().Left)
 	if err != nil {
 		return err
@@ -227,6 +230,35 @@ func validateSampleExpr(expr SampleExpr) error {
 			return e.err
 		}
 		return validateSampleExpr(e.Left)
+	case *HistogramQuantileExpr:
+		if e.err != nil {
+			return e.err
+		}
+		return validateSampleExpr(e.Left)
+	case *LabelDropRegexExpr:
+		if e.err != nil {
+			return e.err
+		}
+		return validateSampleExpr(e.Left)
+	case *LabelModeExpr:
+		if e.err != nil {
+			return e.err
+		}
+		return validateSampleExpr(e.Left)
+	case *RoundExpr:
+		if e.err != nil {
+			return e.err
+		}
+		return validateSampleExpr(e.Left)
+	case *AbsentExpr:
+		return validateSampleExpr(e.Left)
+	case *ScalarExpr:
+		return validateSampleExpr(e.Left)
+	case *MetricLabelFmtExpr:
+		if e.err != nil {
+			return e.err
+		}
+		return validateSampleExpr(e.Left)
 	default:
 		selector, err := e.Selector()
 		if err != nil {
@@ -50,6 +50,15 @@ var ParseTestCases = []struct {
 			},
 		),
 	},
+	{
+		in: `{ foo = "bar" } | json_schema "access_log"`,
+		exp: newPipelineExpr(
+			newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}),
+			MultiStageExpr{
+				newJSONSchemaExpr("access_log"),
+			},
+		),
+	},
 	{
 		// test [12h] before filter expr
 		in: `count_over_time({foo="bar"}[12h] |= "error")`,
@@ -666,6 +675,19 @@ var ParseTestCases = []struct {
 		in:  `topk(count_over_time({ foo = "bar" }[5h]))`,
 		err: logqlmodel.NewParseError("parameter required for operation topk", 0, 0),
 	},
+	{
+		in: `quantile(0.95, count_over_time({ foo = "bar" }[5h])) by (foo)`,
+		exp: &VectorAggregationExpr{
+			Left:      newRangeAggregationExpr(newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}), 5*time.Hour, nil, nil), OpRangeTypeCount, nil, nil),
+			Operation: OpTypeQuantile,
+			Grouping:  &Grouping{Groups: []string{"foo"}},
+			Quantile:  0.95,
+		},
+	},
+	{
+		in:  `quantile(count_over_time({ foo = "bar" }[5h]))`,
+		err: logqlmodel.NewParseError("parameter required for operation quantile", 0, 0),
+	},
 	{
 		in:  `bottomk(he,count_over_time({ foo = "bar" }[5h]))`,
 		err: logqlmodel.NewParseError("syntax error: unexpected IDENTIFIER", 1, 9),
@@ -1741,6 +1763,69 @@ var ParseTestCases = []struct {
 			OpRangeTypeStdvar, nil, nil,
 		),
 	},
+	{
+		in: `avg_over_time({app="foo"} | logfmt | unwrap (bytes_sent / duration) [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(&PipelineExpr{
+				Left: newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				MultiStages: MultiStageExpr{
+					newLogfmtParserExpr(nil),
+				},
+			},
+				5*time.Minute,
+				newUnwrapArithmeticExpr("bytes_sent", OpTypeDiv, "duration"),
+				nil),
+			OpRangeTypeAvg, nil, nil,
+		),
+	},
+	{
+		in: `avg_over_time({app="foo"} | unwrap_regex "latency_p99=(?P<v>[0-9.]+)" as v [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapRegexExpr("latency_p99=(?P<v>[0-9.]+)", OpAs, "v"),
+				nil),
+			OpRangeTypeAvg, nil, nil,
+		),
+	},
+	{
+		in: `rate({app="foo"} | logfmt | unwrap latency default 0 [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(newPipelineExpr(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				MultiStageExpr{newLogfmtParserExpr(nil)}),
+				5*time.Minute,
+				newUnwrapExprWithDefault("latency", "", OpDefault, "0"),
+				nil),
+			OpRangeTypeRate, nil, nil,
+		),
+	},
+	{
+		in: `sum_over_time({app="foo"} | unwrap bytes(size) default 1.5 | size > 0 [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapExprWithDefault("size", OpConvBytes, OpDefault, "1.5").addPostFilter(log.NewNumericLabelFilter(log.LabelFilterGreaterThan, "size", 0)),
+				nil),
+			OpRangeTypeSum, nil, nil,
+		),
+	},
+	{
+		in:  `rate({app="foo"} | unwrap latency otherwise 0 [5m])`,
+		err: logqlmodel.NewParseError("syntax error: unexpected otherwise, expecting default", 0, 0),
+	},
+	{
+		in:  `avg_over_time({app="foo"} | unwrap_regex "latency_p99=(?P<v>[0-9.]+)" as w [5m])`,
+		err: logqlmodel.NewParseError("invalid unwrap_regex: no capture group named w", 0, 0),
+	},
+	{
+		in:  `avg_over_time({app="foo"} | unwrap_regex "latency_p99=(?P<v>[0-9.]+)" to v [5m])`,
+		err: logqlmodel.NewParseError("syntax error: unexpected to, expecting as", 0, 0),
+	},
+	{
+		in:  `avg_over_time({app="foo"} | unwrap_regex "latency_p99=[0-9.]+" as v [5m])`,
+		err: logqlmodel.NewParseError("invalid unwrap_regex: at least one named capture must be supplied", 0, 0),
+	},
 	{
 		in: `sum_over_time({namespace="tns"} |= "level=error" | json |foo>=5,bar<25ms| unwrap bytes(foo) [5m])`,
 		exp: newRangeAggregationExpr(
@@ -1844,6 +1929,177 @@ var ParseTestCases = []struct {
 			OpRangeTypeStddev, nil, nil,
 		),
 	},
+	{
+		in: `cv_over_time({app="foo"} | unwrap bar [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapExpr("bar", ""),
+				nil),
+			OpRangeTypeCV, nil, nil,
+		),
+	},
+	{
+		in:  `cv_over_time({app="foo"}[5m])`,
+		err: logqlmodel.NewParseError("invalid aggregation cv_over_time without unwrap", 0, 0),
+	},
+	{
+		in: `zscore_over_time({app="foo"} | unwrap bar [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapExpr("bar", ""),
+				nil),
+			OpRangeTypeZScore, nil, nil,
+		),
+	},
+	{
+		in:  `zscore_over_time({app="foo"}[5m])`,
+		err: logqlmodel.NewParseError("invalid aggregation zscore_over_time without unwrap", 0, 0),
+	},
+	{
+		in: `autocorr_over_time({app="foo"} | unwrap bar [1h], 300) by (namespace)`,
+		exp: newRangeAggregationExprWithLag(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				time.Hour,
+				newUnwrapExpr("bar", ""),
+				nil),
+			OpRangeTypeAutocorr, &Grouping{Groups: []string{"namespace"}}, "300",
+		),
+	},
+	{
+		in:  `autocorr_over_time({app="foo"} | unwrap bar [1h])`,
+		err: logqlmodel.NewParseError("parameter required for operation autocorr_over_time", 0, 0),
+	},
+	{
+		in:  `autocorr_over_time(300, {app="foo"} | unwrap bar [1h])`,
+		err: logqlmodel.NewParseError("parameter 300 not supported for operation autocorr_over_time", 0, 0),
+	},
+	{
+		in:  `autocorr_over_time({app="foo"} | unwrap bar [5m], 300)`,
+		err: logqlmodel.NewParseError("lag of operation autocorr_over_time must be positive and shorter than the range, got 300", 0, 0),
+	},
+	{
+		in: `last_over_time({app="foo"} | unwrap bar [5m], default=0) by (namespace)`,
+		exp: newRangeAggregationExprWithDefault(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapExpr("bar", ""),
+				nil),
+			OpRangeTypeLast, &Grouping{Groups: []string{"namespace"}}, "default", "0",
+		),
+	},
+	{
+		in:  `last_over_time({app="foo"} | unwrap bar [5m], fallback=0)`,
+		err: logqlmodel.NewParseError("parameter fallback not supported for operation last_over_time", 0, 0),
+	},
+	{
+		in:  `first_over_time({app="foo"} | unwrap bar [5m], default=0)`,
+		err: logqlmodel.NewParseError("parameter default not supported for operation first_over_time", 0, 0),
+	},
+	{
+		in: `changes_over_time({app="foo"} | unwrap bar [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapExpr("bar", ""),
+				nil),
+			OpRangeTypeChanges, nil, nil,
+		),
+	},
+	{
+		in:  `changes_over_time({app="foo"}[5m])`,
+		err: logqlmodel.NewParseError("invalid aggregation changes_over_time without unwrap", 0, 0),
+	},
+	{
+		in: `resets_over_time({app="foo"} | unwrap bar [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapExpr("bar", ""),
+				nil),
+			OpRangeTypeResets, nil, nil,
+		),
+	},
+	{
+		in:  `resets_over_time({app="foo"}[5m])`,
+		err: logqlmodel.NewParseError("invalid aggregation resets_over_time without unwrap", 0, 0),
+	},
+	{
+		in: `delta({app="foo"} | unwrap bar [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapExpr("bar", ""),
+				nil),
+			OpRangeTypeDelta, nil, nil,
+		),
+	},
+	{
+		in: `idelta({app="foo"} | unwrap bar [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapExpr("bar", ""),
+				nil),
+			OpRangeTypeIdelta, nil, nil,
+		),
+	},
+	{
+		in: `deriv({app="foo"} | unwrap bar [5m]) by (namespace)`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapExpr("bar", ""),
+				nil),
+			OpRangeTypeDeriv, &Grouping{Groups: []string{"namespace"}}, nil,
+		),
+	},
+	{
+		in:  `deriv({app="foo"}[5m])`,
+		err: logqlmodel.NewParseError("invalid aggregation deriv without unwrap", 0, 0),
+	},
+	{
+		in: `sum by (delta) (count_over_time({app="foo"}[5m]))`,
+		exp: mustNewVectorAggregationExpr(
+			newRangeAggregationExpr(
+				newLogRange(newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}), 5*time.Minute, nil, nil),
+				OpRangeTypeCount, nil, nil,
+			),
+			OpTypeSum, &Grouping{Groups: []string{"delta"}}, nil,
+		),
+	},
+	{
+		in:  `max_over_time({app="foo"} | unwrap bar [1h], 300)`,
+		err: logqlmodel.NewParseError("parameter 300 not supported for operation max_over_time", 0, 0),
+	},
+	{
+		in: `matched_bytes_over_time({app="foo"} |~ "token" [5m])`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newPipelineExpr(
+					newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+					MultiStageExpr{newLineFilterExpr(log.LineMatchRegexp, "", "token")},
+				),
+				5*time.Minute,
+				nil,
+				nil),
+			OpRangeTypeMatchedBytes, nil, nil,
+		),
+	},
+	{
+		in:  `matched_bytes_over_time({app="foo"} |~ "token" | unwrap bar [5m])`,
+		err: logqlmodel.NewParseError("invalid aggregation matched_bytes_over_time with unwrap", 0, 0),
+	},
 	{
 		in: `min_over_time({app="foo"} | unwrap bar [5m])`,
 		exp: newRangeAggregationExpr(
@@ -1899,6 +2155,42 @@ var ParseTestCases = []struct {
 			OpRangeTypeMax, &Grouping{Without: true, Groups: []string{"foo", "bar"}}, nil,
 		),
 	},
+	{
+		in: `count_over_time({app="foo"}[1m] @ 60)`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				time.Minute,
+				nil,
+				newAtExpr("60", 0)),
+			OpRangeTypeCount, nil, nil,
+		),
+	},
+	{
+		in: `count_over_time({app="foo"} |= "bar" [1m] offset 5m @ 60.5)`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newPipelineExpr(
+					newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+					MultiStageExpr{newLineFilterExpr(log.LineMatchEqual, "", "bar")},
+				),
+				time.Minute,
+				nil,
+				newAtExpr("60.5", 5*time.Minute)),
+			OpRangeTypeCount, nil, nil,
+		),
+	},
+	{
+		in: `max_over_time({app="foo"} | unwrap bar [5m] @ 60 offset 5m) without (foo,bar)`,
+		exp: newRangeAggregationExpr(
+			newLogRange(
+				newMatcherExpr([]*labels.Matcher{{Type: labels.MatchEqual, Name: "app", Value: "foo"}}),
+				5*time.Minute,
+				newUnwrapExpr("bar", ""),
+				newAtExpr("60", 5*time.Minute)),
+			OpRangeTypeMax, &Grouping{Without: true, Groups: []string{"foo", "bar"}}, nil,
+		),
+	},
 	{
 		in: `max_over_time({app="foo"} | unwrap bar [5m] offset -5m) without (foo,bar)`,
 		exp: newRangeAggregationExpr(
@@ -2809,6 +3101,37 @@ var ParseTestCases = []struct {
 		in:  `sum(count_over_time({foo="bar"}[5m])) by (foo) + 1 or 1`,
 		err: logqlmodel.NewParseError(`unexpected literal for right leg of logical/set binary operation (or): 1.000000`, 0, 0),
 	},
+	{
+		in: `count_over_time({foo="bar"}[5m]) unless on (app) count_over_time({app="bar"}[5m])`,
+		exp: mustNewBinOpExpr(
+			OpTypeUnless,
+			&BinOpOptions{VectorMatching: &VectorMatching{Card: CardOneToOne, On: true, MatchingLabels: []string{"app"}}},
+			newRangeAggregationExpr(newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}), 5*time.Minute, nil, nil), OpRangeTypeCount, nil, nil),
+			newRangeAggregationExpr(newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "bar")}), 5*time.Minute, nil, nil), OpRangeTypeCount, nil, nil),
+		),
+	},
+	{
+		in: `count_over_time({foo="bar"}[5m]) or ignoring (pod) count_over_time({app="bar"}[5m])`,
+		exp: mustNewBinOpExpr(
+			OpTypeOr,
+			&BinOpOptions{VectorMatching: &VectorMatching{Card: CardOneToOne, MatchingLabels: []string{"pod"}}},
+			newRangeAggregationExpr(newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}), 5*time.Minute, nil, nil), OpRangeTypeCount, nil, nil),
+			newRangeAggregationExpr(newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "bar")}), 5*time.Minute, nil, nil), OpRangeTypeCount, nil, nil),
+		),
+	},
+	{
+		in:  `count_over_time({foo="bar"}[5m]) and on (app) group_left count_over_time({app="bar"}[5m])`,
+		err: logqlmodel.NewParseError(`no grouping allowed for logical/set binary operation (and)`, 0, 0),
+	},
+	{
+		in: `count_over_time({foo="bar"}[5m]) and bool count_over_time({app="bar"}[5m])`,
+		exp: mustNewBinOpExpr(
+			OpTypeAnd,
+			&BinOpOptions{ReturnBool: true, VectorMatching: &VectorMatching{Card: CardOneToOne}},
+			newRangeAggregationExpr(newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}), 5*time.Minute, nil, nil), OpRangeTypeCount, nil, nil),
+			newRangeAggregationExpr(newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "bar")}), 5*time.Minute, nil, nil), OpRangeTypeCount, nil, nil),
+		),
+	},
 	{
 		in: `count_over_time({ foo ="bar" }[12m]) > count_over_time({ foo = "bar" }[12m])`,
 		exp: &BinOpExpr{
@@ -2917,11 +3240,11 @@ var ParseTestCases = []struct {
 	},
 	{
 		in:  `quantile_over_time(foo,{namespace="tns"} |= "level=error" | json |foo>=5,bar<25ms| unwrap latency [5m])`,
-		err: logqlmodel.NewParseError("syntax error: unexpected IDENTIFIER, expecting NUMBER or { or (", 1, 20),
+		err: logqlmodel.NewParseError("syntax error: unexpected IDENTIFIER, expecting STRING or NUMBER or { or (", 1, 20),
 	},
 	{
 		in:  `vector(abc)`,
-		err: logqlmodel.NewParseError("syntax error: unexpected IDENTIFIER, expecting NUMBER", 1, 8),
+		err: logqlmodel.NewParseError("syntax error: unexpected IDENTIFIER, expecting NUMBER or SCALAR", 1, 8),
 	},
 	{
 		in:  `vector(1)`,
@@ -2931,6 +3254,166 @@ var ParseTestCases = []struct {
 		in:  `label_replace(vector(0), "foo", "bar", "", "")`,
 		exp: mustNewLabelReplaceExpr(&VectorExpr{Val: 0, err: nil}, "foo", "bar", "", ""),
 	},
+	{
+		in: `histogram_quantile(0.9, sum by (le) (rate({app="foo"} | unwrap count [5m])))`,
+		exp: mustNewHistogramQuantileExpr("0.9", &VectorAggregationExpr{
+			Left: newRangeAggregationExpr(
+				newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), 5*time.Minute, newUnwrapExpr("count", ""), nil),
+				OpRangeTypeRate, nil, nil,
+			),
+			Grouping:  &Grouping{Groups: []string{"le"}},
+			Operation: OpTypeSum,
+		}),
+	},
+	{
+		in: `label_drop_regex(count_over_time({app="foo"}[5m]), "tmp_.*")`,
+		exp: mustNewLabelDropRegexExpr(
+			newRangeAggregationExpr(
+				newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), 5*time.Minute, nil, nil),
+				OpRangeTypeCount, nil, nil,
+			),
+			"tmp_.*",
+		),
+	},
+	{
+		in: `label_mode(count_over_time({app="foo"}[5m]), "version")`,
+		exp: mustNewLabelModeExpr(
+			newRangeAggregationExpr(
+				newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), 5*time.Minute, nil, nil),
+				OpRangeTypeCount, nil, nil,
+			),
+			"version",
+		),
+	},
+	{
+		in: `round(rate({app="foo"}[1m]), 0.01)`,
+		exp: mustNewRoundExpr(
+			newRangeAggregationExpr(
+				newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), time.Minute, nil, nil),
+				OpRangeTypeRate, nil, nil,
+			),
+			NewStringLabelFilter("0.01"),
+		),
+	},
+	{
+		in: `round(rate({app="foo"}[1m]))`,
+		exp: &RoundExpr{
+			Left: newRangeAggregationExpr(
+				newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), time.Minute, nil, nil),
+				OpRangeTypeRate, nil, nil,
+			),
+			ToNearest: 1,
+		},
+	},
+	{
+		in: `absent(sum(rate({app="foo"}[1m])))`,
+		exp: newAbsentExpr(
+			mustNewVectorAggregationExpr(
+				newRangeAggregationExpr(
+					newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), time.Minute, nil, nil),
+					OpRangeTypeRate, nil, nil,
+				),
+				OpTypeSum, nil, nil,
+			),
+		),
+	},
+	{
+		in: `scalar(sum(rate({app="foo"}[1m])))`,
+		exp: newScalarExpr(
+			mustNewVectorAggregationExpr(
+				newRangeAggregationExpr(
+					newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), time.Minute, nil, nil),
+					OpRangeTypeRate, nil, nil,
+				),
+				OpTypeSum, nil, nil,
+			),
+			false,
+		),
+	},
+	{
+		in: `vector(scalar(sum(rate({app="foo"}[1m]))))`,
+		exp: newScalarExpr(
+			mustNewVectorAggregationExpr(
+				newRangeAggregationExpr(
+					newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), time.Minute, nil, nil),
+					OpRangeTypeRate, nil, nil,
+				),
+				OpTypeSum, nil, nil,
+			),
+			true,
+		),
+	},
+	{
+		in: `sum by (app, namespace) (rate({app="foo"}[1m])) | label_format new="{{.app}}-{{.namespace}}"`,
+		exp: mustNewMetricLabelFmtExpr(
+			mustNewVectorAggregationExpr(
+				newRangeAggregationExpr(
+					newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), time.Minute, nil, nil),
+					OpRangeTypeRate, nil, nil,
+				),
+				OpTypeSum, &Grouping{Groups: []string{"app", "namespace"}}, nil,
+			),
+			newLabelFmtExpr([]log.LabelFmt{log.NewTemplateLabelFmt("new", "{{.app}}-{{.namespace}}")}),
+		),
+	},
+	{
+		// the label_format stage applies to the right-hand side of the division.
+		in: `rate({app="foo"}[1m]) / rate({app="bar"}[1m]) | label_format app=src`,
+		exp: mustNewBinOpExpr(
+			OpTypeDiv,
+			&BinOpOptions{VectorMatching: &VectorMatching{Card: CardOneToOne}},
+			newRangeAggregationExpr(
+				newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), time.Minute, nil, nil),
+				OpRangeTypeRate, nil, nil,
+			),
+			mustNewMetricLabelFmtExpr(
+				newRangeAggregationExpr(
+					newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "bar")}), time.Minute, nil, nil),
+					OpRangeTypeRate, nil, nil,
+				),
+				newLabelFmtExpr([]log.LabelFmt{log.NewRenameLabelFmt("app", "src")}),
+			),
+		),
+	},
+	{
+		in:  `sum(rate({app="foo"}[1m])) | label_format __error__="foo"`,
+		err: logqlmodel.NewParseError("__error__ cannot be formatted", 0, 0),
+	},
+	{
+		in:  `label_mode(count_over_time({app="foo"}[5m]), "")`,
+		err: logqlmodel.NewParseError("invalid label name in label_mode: ", 0, 0),
+	},
+	{
+		in:  `label_drop_regex(count_over_time({app="foo"}[5m]), "(tmp")`,
+		err: logqlmodel.NewParseError("invalid regex in label_drop_regex: error parsing regexp: missing closing ): `^(?:(tmp)$`", 0, 0),
+	},
+	{
+		in:  `histogram_quantile(sum by (le) (rate({app="foo"} | unwrap count [5m])))`,
+		err: logqlmodel.NewParseError("syntax error: unexpected SUM, expecting NUMBER", 1, 20),
+	},
+	{
+		in: `count_values_over_time("val", {app="foo"} | unwrap x [5m])`,
+		exp: newRangeAggregationExprWithLabel(
+			newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "app", "foo")}), 5*time.Minute, newUnwrapExpr("x", ""), nil),
+			OpRangeTypeCountValues, "val",
+		),
+	},
+	{
+		in:  `count_values_over_time("val", {app="foo"} [5m])`,
+		err: logqlmodel.NewParseError("invalid aggregation count_values_over_time without unwrap", 0, 0),
+	},
+	{
+		in:  `count_values_over_time({app="foo"} | unwrap x [5m])`,
+		err: logqlmodel.NewParseError("parameter required for operation count_values_over_time", 0, 0),
+	},
+	{
+		in:  `count_values_over_time("", {app="foo"} | unwrap x [5m])`,
+		err: logqlmodel.NewParseError(`invalid label name "" for operation count_values_over_time`, 0, 0),
+	},
+	{
+		in:  `sum_over_time("val", {app="foo"} | unwrap x [5m])`,
+		err: logqlmodel.NewParseError(`parameter "val" not supported for operation sum_over_time`, 0, 0),
+	},
 	{
 		in: `sum(vector(0))`,
 		exp: &VectorAggregationExpr{
@@ -3364,6 +3847,54 @@ var ParseTestCases = []struct {
 		},
 		err: nil,
 	},
+	{
+		in: `variants(count_over_time({foo="bar"}[5m]), count_over_time({foo="bar"} |= "error" [5m])) of ({foo="bar"}[5m]) merged(sum)`,
+		exp: newMergedVariantsExpr(
+			[]SampleExpr{
+				newRangeAggregationExpr(
+					newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}), 5*time.Minute, nil, nil),
+					OpRangeTypeCount, nil, nil,
+				),
+				newRangeAggregationExpr(
+					newLogRange(&PipelineExpr{
+						Left:        newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}),
+						MultiStages: MultiStageExpr{newLineFilterExpr(log.LineMatchEqual, "", "error")},
+					}, 5*time.Minute, nil, nil),
+					OpRangeTypeCount, nil, nil,
+				),
+			},
+			newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}), 5*time.Minute, nil, nil),
+			OpTypeSum,
+		),
+	},
+	{
+		in:  `variants(count_over_time({foo="bar"}[5m])) of ({foo="bar"}[5m]) merged(topk)`,
+		err: logqlmodel.NewParseError("unsupported aggregation to merge variants: topk", 0, 0),
+	},
+	{
+		in: `sum by (app) (variants(count_over_time({foo="bar"}[5m]), bytes_over_time({foo="bar"}[5m])) of ({foo="bar"}[5m]))`,
+		exp: newGroupedVariantsExpr(
+			newVariantsExpr(
+				[]SampleExpr{
+					newRangeAggregationExpr(
+						newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}), 5*time.Minute, nil, nil),
+						OpRangeTypeCount, nil, nil,
+					),
+					newRangeAggregationExpr(
+						newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}), 5*time.Minute, nil, nil),
+						OpRangeTypeBytes, nil, nil,
+					),
+				},
+				newLogRange(newMatcherExpr([]*labels.Matcher{mustNewMatcher(labels.MatchEqual, "foo", "bar")}), 5*time.Minute, nil, nil),
+			),
+			OpTypeSum,
+			&Grouping{Groups: []string{"app"}},
+		),
+	},
+	{
+		in:  `max (variants(count_over_time({foo="bar"}[5m])) of ({foo="bar"}[5m]) merged(sum)) without (app)`,
+		err: logqlmodel.NewParseError("merged variants cannot be aggregated again", 0, 0),
+	},
 }
 
 func TestParse(t *testing.T) {
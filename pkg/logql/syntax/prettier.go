@@ -43,6 +43,18 @@ func Prettify(e Expr) string {
 	return e.Pretty(0)
 }
 
+// NormalizeQuery returns the canonical pretty-printed form of a query, so that
+// semantically equal queries such as `sum by (a) (...)` and `sum(...) by (a)`
+// have the same representation. Queries that can't be parsed are returned as
+// is.
+func NormalizeQuery(qs string) string {
+	expr, err := ParseExpr(qs)
+	if err != nil {
+		return qs
+	}
+	return Prettify(expr)
+}
+
 // e.g: `{foo="bar"}`
 func (e *MatchersExpr) Pretty(level int) string {
 	return commonPrefixIndent(level, e)
@@ -136,6 +148,16 @@ func (e *DecolorizeExpr) Pretty(_ int) string {
 	return e.String()
 }
 
+// e.g: | __unit__("bytes")
+func (e *UnitExpr) Pretty(_ int) string {
+	return e.String()
+}
+
+// e.g: | json_schema "access_log"
+func (e *JSONSchemaExpr) Pretty(_ int) string {
+	return e.String()
+}
+
 // e.g: | label_format dst="{{ .src }}"
 func (e *LabelFmtExpr) Pretty(level int) string {
 	return commonPrefixIndent(level, e)
@@ -155,11 +177,19 @@ func (e *LogfmtExpressionParserExpr) Pretty(level int) string {
 func (e *UnwrapExpr) Pretty(level int) string {
 	s := Indent(level)
 
-	if e.Operation != "" {
+	switch {
+	case e.Regex != "":
+		s += fmt.Sprintf("%s %s %s %s %s", OpPipe, OpUnwrapRegex, strconv.Quote(e.Regex), OpAs, e.Identifier)
+	case e.Arithmetic != "":
+		s += fmt.Sprintf("%s %s (%s %s %s)", OpPipe, OpUnwrap, e.Identifier, e.Arithmetic, e.RHS)
+	case e.Operation != "":
 		s += fmt.Sprintf("%s %s %s(%s)", OpPipe, OpUnwrap, e.Operation, e.Identifier)
-	} else {
+	default:
 		s += fmt.Sprintf("%s %s %s", OpPipe, OpUnwrap, e.Identifier)
 	}
+	if e.Default != nil {
+		s += fmt.Sprintf(" %s %s", OpDefault, strconv.FormatFloat(*e.Default, 'f', -1, 64))
+	}
 	for _, f := range e.PostFilters {
 		s += fmt.Sprintf("\n%s%s %s", Indent(level), OpPipe, f)
 	}
@@ -180,8 +210,8 @@ func (e *LogRangeExpr) Pretty(level int) string {
 	// TODO: this will put [1m] on the same line, not in new line as people used to now.
 	s = fmt.Sprintf("%s [%s]", s, model.Duration(e.Interval))
 
-	if e.Offset != 0 {
-		oe := OffsetExpr{Offset: e.Offset}
+	if e.Offset != 0 || e.At != nil {
+		oe := OffsetExpr{Offset: e.Offset, At: e.At}
 		s += oe.Pretty(level)
 	}
 
@@ -195,7 +225,14 @@ func (e *OffsetExpr) Pretty(_ int) string {
 	// using `model.Duration` as it can format ignoring zero units.
 	// e.g: time.Duration(2 * Hour) -> "2h0m0s"
 	// but model.Duration(2 * Hour) -> "2h"
-	return fmt.Sprintf(" %s %s", OpOffset, model.Duration(e.Offset))
+	var s string
+	if e.Offset != 0 {
+		s = fmt.Sprintf(" %s %s", OpOffset, model.Duration(e.Offset))
+	}
+	if e.At != nil {
+		s += fmt.Sprintf(" %s %s", OpAt, formatAt(*e.At))
+	}
+	return s
 }
 
 // e.g: count_over_time({foo="bar"}[5m])
@@ -210,13 +247,25 @@ func (e *RangeAggregationExpr) Pretty(level int) string {
 	s += "(\n"
 
 	// print args to the function.
-	if e.Params != nil {
+	if e.Params != nil && e.Operation != OpRangeTypeAutocorr {
 		s = fmt.Sprintf("%s%s%s,", s, Indent(level+1), fmt.Sprint(*e.Params))
 		s += "\n"
 	}
+	if e.Label != "" {
+		s = fmt.Sprintf("%s%s%s,", s, Indent(level+1), strconv.Quote(e.Label))
+		s += "\n"
+	}
 
 	s += e.Left.Pretty(level + 1)
 
+	// the lag of autocorr_over_time follows the range.
+	if e.Params != nil && e.Operation == OpRangeTypeAutocorr {
+		s = fmt.Sprintf("%s,\n%s%s", s, Indent(level+1), fmt.Sprint(*e.Params))
+	}
+	if e.Default != nil {
+		s = fmt.Sprintf("%s,\n%sdefault=%s", s, Indent(level+1), fmt.Sprint(*e.Default))
+	}
+
 	s += "\n" + Indent(level) + ")"
 
 	if e.Grouping != nil {
@@ -251,6 +300,9 @@ func (e *VectorAggregationExpr) Pretty(level int) string {
 	case OpTypeBottomK, OpTypeTopK:
 		params = []string{fmt.Sprintf("%s%d", Indent(level+1), e.Params), left}
 
+	case OpTypeQuantile:
+		params = []string{Indent(level+1) + strconv.FormatFloat(e.Quantile, 'f', -1, 64), left}
+
 	default:
 		if e.Params != 0 {
 			params = []string{fmt.Sprintf("%s%d", Indent(level+1), e.Params), left}
@@ -338,6 +390,126 @@ func (e *LabelReplaceExpr) Pretty(level int) string {
 	return s
 }
 
+// e.g: histogram_quantile(0.99, sum by (le) (rate({job="api-server"} | unwrap count [5m])))
+func (e *HistogramQuantileExpr) Pretty(level int) string {
+	s := Indent(level)
+
+	if !NeedSplit(e) {
+		return s + e.String()
+	}
+
+	s += OpTypeHistogramQuantile + "(\n"
+	s += Indent(level+1) + strconv.FormatFloat(e.Quantile, 'f', -1, 64) + ",\n"
+	s += e.Left.Pretty(level+1) + "\n"
+	s += Indent(level) + ")"
+
+	return s
+}
+
+// e.g: label_drop_regex(sum by (tmp_id, job) (rate({job="api-server"}[5m])), "tmp_.*")
+func (e *LabelDropRegexExpr) Pretty(level int) string {
+	s := Indent(level)
+
+	if !NeedSplit(e) {
+		return s + e.String()
+	}
+
+	s += OpLabelDropRegex + "(\n"
+	s += e.Left.Pretty(level+1) + ",\n"
+	s += Indent(level+1) + strconv.Quote(e.Regex) + "\n"
+	s += Indent(level) + ")"
+
+	return s
+}
+
+// e.g: label_mode(sum by (pod, version) (rate({job="api-server"}[5m])), "version")
+func (e *LabelModeExpr) Pretty(level int) string {
+	s := Indent(level)
+
+	if !NeedSplit(e) {
+		return s + e.String()
+	}
+
+	s += OpLabelMode + "(\n"
+	s += e.Left.Pretty(level+1) + ",\n"
+	s += Indent(level+1) + strconv.Quote(e.Label) + "\n"
+	s += Indent(level) + ")"
+
+	return s
+}
+
+// e.g: round(sum by (app) (rate({job="api-server"}[5m])), 0.01)
+func (e *RoundExpr) Pretty(level int) string {
+	s := Indent(level)
+
+	if !NeedSplit(e) {
+		return s + e.String()
+	}
+
+	s += OpRound + "(\n"
+	if e.ToNearest == 1 {
+		s += e.Left.Pretty(level+1) + "\n"
+	} else {
+		s += e.Left.Pretty(level+1) + ",\n"
+		s += Indent(level+1) + strconv.FormatFloat(e.ToNearest, 'f', -1, 64) + "\n"
+	}
+	s += Indent(level) + ")"
+
+	return s
+}
+
+// e.g: absent(sum by (app) (rate({job="api-server"}[5m])))
+func (e *AbsentExpr) Pretty(level int) string {
+	s := Indent(level)
+
+	if !NeedSplit(e) {
+		return s + e.String()
+	}
+
+	s += OpTypeAbsent + "(\n"
+	s += e.Left.Pretty(level+1) + "\n"
+	s += Indent(level) + ")"
+
+	return s
+}
+
+// e.g: vector(scalar(sum(rate({job="api-server"}[5m]))))
+func (e *ScalarExpr) Pretty(level int) string {
+	s := Indent(level)
+
+	if !NeedSplit(e) {
+		return s + e.String()
+	}
+
+	if e.Vector {
+		s += OpTypeVector + "("
+	}
+	s += OpTypeScalar + "(\n"
+	s += e.Left.Pretty(level+1) + "\n"
+	s += Indent(level) + ")"
+	if e.Vector {
+		s += ")"
+	}
+
+	return s
+}
+
+// e.g: sum by (app, namespace) (rate({job="api-server"}[5m])) | label_format app_ns="{{.app}}-{{.namespace}}"
+func (e *MetricLabelFmtExpr) Pretty(level int) string {
+	s := Indent(level)
+
+	if !NeedSplit(e) {
+		return s + e.String()
+	}
+
+	s += "(\n"
+	s += e.Left.Pretty(level+1) + "\n"
+	s += Indent(level+1) + e.Fmt.String() + "\n"
+	s += Indent(level) + ")"
+
+	return s
+}
+
 // e.g: vector(5)
 func (e *VectorExpr) Pretty(level int) string {
 	return commonPrefixIndent(level, e)
@@ -1,10 +1,13 @@
 package syntax
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/v3/pkg/util"
 )
 
 func TestFormat(t *testing.T) {
@@ -64,6 +67,14 @@ func TestFormat(t *testing.T) {
 			exp: `count_over_time(
   {job="loki", instance="localhost"}
     |= "error" [5m] offset 20m
+)`,
+		},
+		{
+			name: "aggregation_with_at_modifier",
+			in:   `count_over_time({job="loki", instance="localhost"}|= "error"[5m] @ 1609746000 offset 20m)`,
+			exp: `count_over_time(
+  {job="loki", instance="localhost"}
+    |= "error" [5m] offset 20m @ 1609746000
 )`,
 		},
 		{
@@ -76,6 +87,48 @@ func TestFormat(t *testing.T) {
     | unwrap response_latency_seconds
     | __error__="" [1m]
 ) by (cluster)`,
+		},
+		{
+			name: "unwrap_trailing_param",
+			in:   `autocorr_over_time({container="ingress-nginx",service="hosted-grafana"}| json| unwrap response_latency_seconds| __error__=""[1h], 300) by (cluster)`,
+			exp: `autocorr_over_time(
+  {container="ingress-nginx", service="hosted-grafana"}
+    | json
+    | unwrap response_latency_seconds
+    | __error__="" [1h],
+  300
+) by (cluster)`,
+		},
+		{
+			name: "unwrap_default_param",
+			in:   `last_over_time({container="ingress-nginx",service="hosted-grafana"}| json| unwrap response_latency_seconds| __error__=""[1m], default=0) by (cluster)`,
+			exp: `last_over_time(
+  {container="ingress-nginx", service="hosted-grafana"}
+    | json
+    | unwrap response_latency_seconds
+    | __error__="" [1m],
+  default=0
+) by (cluster)`,
+		},
+		{
+			name: "unwrap_regex",
+			in:   `avg_over_time({container="ingress-nginx",service="hosted-grafana"}|= "latency_p99"| unwrap_regex "latency_p99=(?P<v>[0-9.]+)" as v| __error__=""[1m])`,
+			exp: `avg_over_time(
+  {container="ingress-nginx", service="hosted-grafana"}
+    |= "latency_p99"
+    | unwrap_regex "latency_p99=(?P<v>[0-9.]+)" as v
+    | __error__="" [1m]
+)`,
+		},
+		{
+			name: "unwrap_with_default",
+			in:   `sum_over_time({container="ingress-nginx",service="hosted-grafana"}| json| unwrap bytes(size) default 1.5| __error__=""[1m])`,
+			exp: `sum_over_time(
+  {container="ingress-nginx", service="hosted-grafana"}
+    | json
+    | unwrap bytes(size) default 1.5
+    | __error__="" [1m]
+)`,
 		},
 		{
 			name: "pipeline_aggregation_line_filter",
@@ -122,6 +175,16 @@ func TestFormat_VectorAggregation(t *testing.T) {
   count_over_time(
     {foo="bar", namespace="loki", instance="localhost"} [5m]
   )
+)`,
+		},
+		{
+			name: "quantile",
+			in:   `quantile(0.95, count_over_time({foo="bar",namespace="loki",instance="localhost"}[5m])) by (container)`,
+			exp: `quantile by (container)(
+  0.95,
+  count_over_time(
+    {foo="bar", namespace="loki", instance="localhost"} [5m]
+  )
 )`,
 		},
 		{
@@ -404,3 +467,20 @@ func TestFormat_BinOp(t *testing.T) {
 		})
 	}
 }
+
+func TestNormalizeQuery(t *testing.T) {
+	const (
+		grouped  = `sum by(query_hash) (count_over_time({app="myapp",env="myenv"} |= "error" |= "metrics.go" | logfmt [10s]))`
+		trailing = `sum (count_over_time({app="myapp",env="myenv"} |= "error" |= "metrics.go" | logfmt [10s])) by(query_hash)`
+	)
+	require.Equal(t, NormalizeQuery(grouped), NormalizeQuery(trailing))
+	require.Equal(t, `{app="foo"`, NormalizeQuery(`{app="foo"`))
+
+	ctx := context.Background()
+	require.NotEqual(t, util.HashedNormalizedQuery(ctx, grouped), util.HashedNormalizedQuery(ctx, trailing))
+
+	ctx = util.InjectQueryNormalizer(ctx, NormalizeQuery)
+	require.Equal(t, util.HashedNormalizedQuery(ctx, grouped), util.HashedNormalizedQuery(ctx, trailing))
+	// other hashes of queries are not normalized.
+	require.NotEqual(t, util.HashedQuery(grouped), util.HashedQuery(trailing))
+}
@@ -35,17 +35,27 @@ const (
 	Binary              = "binary"
 	Bytes               = "bytes"
 	And                 = "and"
+	Absent              = "absent"
+	Arithmetic          = "arithmetic"
+	AtMillis            = "at_millis"
 	Card                = "cardinality"
+	Default             = "default"
 	Dst                 = "dst"
 	Duration            = "duration"
 	Groups              = "groups"
 	GroupingField       = "grouping"
+	HistogramQuantile   = "histogram_quantile"
 	Include             = "include"
 	Identifier          = "identifier"
 	Inner               = "inner"
 	IntervalNanos       = "interval_nanos"
 	IPField             = "ip"
+	JSONSchemas         = "json_schemas"
+	Formats             = "formats"
 	Label               = "label"
+	LabelFormat         = "label_format"
+	LabelDropRegex      = "label_drop_regex"
+	LabelMode           = "label_mode"
 	LabelReplace        = "label_replace"
 	LHS                 = "lhs"
 	Literal             = "literal"
@@ -53,6 +63,7 @@ const (
 	Name                = "name"
 	Numeric             = "numeric"
 	MatchingLabels      = "matching_labels"
+	Merge               = "merge"
 	On                  = "on"
 	Op                  = "operation"
 	Options             = "options"
@@ -60,13 +71,16 @@ const (
 	Params              = "params"
 	Pattern             = "pattern"
 	PostFilterers       = "post_filterers"
+	QuantileField       = "quantile"
 	Range               = "range"
 	RangeAgg            = "range_agg"
 	Raw                 = "raw"
 	RegexField          = "regex"
 	Replacement         = "replacement"
+	Round               = "round"
 	ReturnBool          = "return_bool"
 	RHS                 = "rhs"
+	Scalar              = "scalar"
 	Src                 = "src"
 	StringField         = "string"
 	NoopField           = "noop"
@@ -98,6 +112,20 @@ func DecodeJSON(raw string) (Expr, error) {
 		return decodeVector(iter)
 	case LabelReplace:
 		return decodeLabelReplace(iter)
+	case HistogramQuantile:
+		return decodeHistogramQuantile(iter)
+	case LabelDropRegex:
+		return decodeLabelDropRegex(iter)
+	case LabelMode:
+		return decodeLabelMode(iter)
+	case Round:
+		return decodeRound(iter)
+	case Absent:
+		return decodeAbsent(iter)
+	case Scalar:
+		return decodeScalar(iter)
+	case LabelFormat:
+		return decodeMetricLabelFmt(iter)
 	case LogSelector:
 		return decodeLogSelector(iter)
 	case Variants:
@@ -163,6 +191,12 @@ func (v *JSONSerializer) VisitVectorAggregation(e *VectorAggregationExpr) {
 	v.WriteObjectField(Op)
 	v.WriteString(e.Operation)
 
+	if e.Operation == OpTypeQuantile {
+		v.WriteMore()
+		v.WriteObjectField(QuantileField)
+		v.WriteFloat64(e.Quantile)
+	}
+
 	if e.Grouping != nil {
 		v.WriteMore()
 		v.WriteObjectField(GroupingField)
@@ -199,6 +233,18 @@ func (v *JSONSerializer) VisitRangeAggregation(e *RangeAggregationExpr) {
 		v.WriteFloat64(*e.Params)
 	}
 
+	if e.Label != "" {
+		v.WriteMore()
+		v.WriteObjectField(Label)
+		v.WriteString(e.Label)
+	}
+
+	if e.Default != nil {
+		v.WriteMore()
+		v.WriteObjectField(Default)
+		v.WriteFloat64(*e.Default)
+	}
+
 	v.WriteMore()
 	v.WriteObjectField(Range)
 	v.VisitLogRange(e.Left)
@@ -217,6 +263,12 @@ func (v *JSONSerializer) VisitLogRange(e *LogRangeExpr) {
 	v.WriteObjectField(OffsetNanos)
 	v.WriteInt64(int64(e.Offset))
 
+	if e.At != nil {
+		v.WriteMore()
+		v.WriteObjectField(AtMillis)
+		v.WriteInt64(*e.At)
+	}
+
 	// Serialize log selector pipeline as string.
 	v.WriteMore()
 	v.WriteObjectField(LogSelector)
@@ -262,6 +314,128 @@ func (v *JSONSerializer) VisitLabelReplace(e *LabelReplaceExpr) {
 	v.Flush()
 }
 
+func (v *JSONSerializer) VisitHistogramQuantile(e *HistogramQuantileExpr) {
+	v.WriteObjectStart()
+
+	v.WriteObjectField(HistogramQuantile)
+	v.WriteObjectStart()
+
+	v.WriteObjectField(Params)
+	v.WriteFloat64(e.Quantile)
+
+	v.WriteMore()
+	v.WriteObjectField(Inner)
+	e.Left.Accept(v)
+
+	v.WriteObjectEnd()
+	v.WriteObjectEnd()
+	v.Flush()
+}
+
+func (v *JSONSerializer) VisitLabelDropRegex(e *LabelDropRegexExpr) {
+	v.WriteObjectStart()
+
+	v.WriteObjectField(LabelDropRegex)
+	v.WriteObjectStart()
+
+	v.WriteObjectField(Inner)
+	e.Left.Accept(v)
+
+	v.WriteMore()
+	v.WriteObjectField(RegexField)
+	v.WriteString(e.Regex)
+
+	v.WriteObjectEnd()
+	v.WriteObjectEnd()
+	v.Flush()
+}
+
+func (v *JSONSerializer) VisitLabelMode(e *LabelModeExpr) {
+	v.WriteObjectStart()
+
+	v.WriteObjectField(LabelMode)
+	v.WriteObjectStart()
+
+	v.WriteObjectField(Inner)
+	e.Left.Accept(v)
+
+	v.WriteMore()
+	v.WriteObjectField(Label)
+	v.WriteString(e.Label)
+
+	v.WriteObjectEnd()
+	v.WriteObjectEnd()
+	v.Flush()
+}
+
+func (v *JSONSerializer) VisitRound(e *RoundExpr) {
+	v.WriteObjectStart()
+
+	v.WriteObjectField(Round)
+	v.WriteObjectStart()
+
+	v.WriteObjectField(Params)
+	v.WriteFloat64(e.ToNearest)
+
+	v.WriteMore()
+	v.WriteObjectField(Inner)
+	e.Left.Accept(v)
+
+	v.WriteObjectEnd()
+	v.WriteObjectEnd()
+	v.Flush()
+}
+
+func (v *JSONSerializer) VisitAbsent(e *AbsentExpr) {
+	v.WriteObjectStart()
+
+	v.WriteObjectField(Absent)
+	v.WriteObjectStart()
+
+	v.WriteObjectField(Inner)
+	e.Left.Accept(v)
+
+	v.WriteObjectEnd()
+	v.WriteObjectEnd()
+	v.Flush()
+}
+
+func (v *JSONSerializer) VisitScalar(e *ScalarExpr) {
+	v.WriteObjectStart()
+
+	v.WriteObjectField(Scalar)
+	v.WriteObjectStart()
+
+	v.WriteObjectField(Vector)
+	v.WriteBool(e.Vector)
+
+	v.WriteMore()
+	v.WriteObjectField(Inner)
+	e.Left.Accept(v)
+
+	v.WriteObjectEnd()
+	v.WriteObjectEnd()
+	v.Flush()
+}
+
+func (v *JSONSerializer) VisitMetricLabelFmt(e *MetricLabelFmtExpr) {
+	v.WriteObjectStart()
+
+	v.WriteObjectField(LabelFormat)
+	v.WriteObjectStart()
+
+	v.WriteObjectField(Formats)
+	v.WriteVal(e.Fmt.Formats)
+
+	v.WriteMore()
+	v.WriteObjectField(Inner)
+	e.Left.Accept(v)
+
+	v.WriteObjectEnd()
+	v.WriteObjectEnd()
+	v.Flush()
+}
+
 func (v *JSONSerializer) VisitLiteral(e *LiteralExpr) {
 	v.WriteObjectStart()
 
@@ -330,6 +504,17 @@ func (v *JSONSerializer) VisitVariants(e *MultiVariantExpr) {
 	}
 	v.WriteArrayEnd()
 
+	if e.Merge() != "" {
+		v.WriteMore()
+		v.WriteObjectField(Merge)
+		v.WriteString(e.Merge())
+	}
+	if e.Grouping() != nil {
+		v.WriteMore()
+		v.WriteObjectField(GroupingField)
+		encodeGrouping(v.Stream, e.Grouping())
+	}
+
 	v.WriteObjectEnd()
 	v.WriteObjectEnd()
 	v.Flush()
@@ -338,6 +523,8 @@ func (v *JSONSerializer) VisitVariants(e *MultiVariantExpr) {
 // Below are StageExpr visitors that we are skipping since a pipeline is
 // serialized as a string.
 func (*JSONSerializer) VisitDecolorize(*DecolorizeExpr)                         {}
+func (*JSONSerializer) VisitUnit(*UnitExpr)                                     {}
+func (*JSONSerializer) VisitJSONSchema(*JSONSchemaExpr)                         {}
 func (*JSONSerializer) VisitDropLabels(*DropLabelsExpr)                         {}
 func (*JSONSerializer) VisitJSONExpressionParser(*JSONExpressionParserExpr)     {}
 func (*JSONSerializer) VisitKeepLabel(*KeepLabelsExpr)                          {}
@@ -393,6 +580,28 @@ func encodeUnwrap(s *jsoniter.Stream, u *UnwrapExpr) {
 	s.WriteObjectField(Op)
 	s.WriteString(u.Operation)
 
+	if u.Arithmetic != "" {
+		s.WriteMore()
+		s.WriteObjectField(Arithmetic)
+		s.WriteString(u.Arithmetic)
+
+		s.WriteMore()
+		s.WriteObjectField(RHS)
+		s.WriteString(u.RHS)
+	}
+
+	if u.Regex != "" {
+		s.WriteMore()
+		s.WriteObjectField(RegexField)
+		s.WriteString(u.Regex)
+	}
+
+	if u.Default != nil {
+		s.WriteMore()
+		s.WriteObjectField(Default)
+		s.WriteFloat64(*u.Default)
+	}
+
 	s.WriteMore()
 	s.WriteObjectField(PostFilterers)
 	s.WriteArrayStart()
@@ -415,6 +624,15 @@ func decodeUnwrap(iter *jsoniter.Iterator) *UnwrapExpr {
 			e.Identifier = iter.ReadString()
 		case Op:
 			e.Operation = iter.ReadString()
+		case Arithmetic:
+			e.Arithmetic = iter.ReadString()
+		case RHS:
+			e.RHS = iter.ReadString()
+		case RegexField:
+			e.Regex = iter.ReadString()
+		case Default:
+			def := iter.ReadFloat64()
+			e.Default = &def
 		case PostFilterers:
 			iter.ReadArrayCB(func(i *jsoniter.Iterator) bool {
 				e.PostFilters = append(e.PostFilters, decodeLabelFilter(i))
@@ -703,12 +921,21 @@ func encodeLogSelector(s *jsoniter.Stream, e LogSelectorExpr) {
 
 	s.WriteString(e.String())
 
+	// Schemas are resolved from the limits of the tenant and aren't part of
+	// the raw query, so they are sent alongside it.
+	if schemas := jsonSchemas(e); len(schemas) > 0 {
+		s.WriteMore()
+		s.WriteObjectField(JSONSchemas)
+		s.WriteVal(schemas)
+	}
+
 	s.WriteObjectEnd()
 	s.Flush()
 }
 
 func decodeLogSelector(iter *jsoniter.Iterator) (LogSelectorExpr, error) {
 	var e LogSelectorExpr
+	var schemas map[string]string
 
 	for f := iter.ReadObject(); f != ""; f = iter.ReadObject() {
 		switch f {
@@ -725,6 +952,18 @@ func decodeLogSelector(iter *jsoniter.Iterator) (LogSelectorExpr, error) {
 			if !ok {
 				return nil, fmt.Errorf("unexpected expression type: want(LogSelectorExpr), got(%T)", expr)
 			}
+		case JSONSchemas:
+			iter.ReadVal(&schemas)
+		}
+	}
+
+	if e != nil && len(schemas) > 0 {
+		err := ResolveJSONSchemas(e, func(name string) (string, bool) {
+			schema, ok := schemas[name]
+			return schema, ok
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -748,6 +987,20 @@ func decodeSample(iter *jsoniter.Iterator) (SampleExpr, error) {
 			expr, err = decodeVector(iter)
 		case LabelReplace:
 			expr, err = decodeLabelReplace(iter)
+		case HistogramQuantile:
+			expr, err = decodeHistogramQuantile(iter)
+		case LabelDropRegex:
+			expr, err = decodeLabelDropRegex(iter)
+		case LabelMode:
+			expr, err = decodeLabelMode(iter)
+		case Round:
+			expr, err = decodeRound(iter)
+		case Absent:
+			expr, err = decodeAbsent(iter)
+		case Scalar:
+			expr, err = decodeScalar(iter)
+		case LabelFormat:
+			expr, err = decodeMetricLabelFmt(iter)
 		default:
 			return nil, fmt.Errorf("unknown sample expression type: %s", key)
 		}
@@ -858,6 +1111,8 @@ func decodeVectorAgg(iter *jsoniter.Iterator) (*VectorAggregationExpr, error) {
 			expr.Operation = iter.ReadString()
 		case Params:
 			expr.Params = iter.ReadInt()
+		case QuantileField:
+			expr.Quantile = iter.ReadFloat64()
 		case GroupingField:
 			expr.Grouping, err = decodeGrouping(iter)
 		case Inner:
@@ -879,6 +1134,11 @@ func decodeRangeAgg(iter *jsoniter.Iterator) (*RangeAggregationExpr, error) {
 		case Params:
 			tmp := iter.ReadFloat64()
 			expr.Params = &tmp
+		case Label:
+			expr.Label = iter.ReadString()
+		case Default:
+			def := iter.ReadFloat64()
+			expr.Default = &def
 		case Range:
 			expr.Left, err = decodeLogRange(iter)
 		case GroupingField:
@@ -901,6 +1161,9 @@ func decodeLogRange(iter *jsoniter.Iterator) (*LogRangeExpr, error) {
 			expr.Interval = time.Duration(iter.ReadInt64())
 		case OffsetNanos:
 			expr.Offset = time.Duration(iter.ReadInt64())
+		case AtMillis:
+			at := iter.ReadInt64()
+			expr.At = &at
 		case Unwrap:
 			expr.Unwrap = decodeUnwrap(iter)
 		}
@@ -935,6 +1198,126 @@ func decodeLabelReplace(iter *jsoniter.Iterator) (*LabelReplaceExpr, error) {
 	return mustNewLabelReplaceExpr(left, dst, replacement, src, regex), nil
 }
 
+func decodeHistogramQuantile(iter *jsoniter.Iterator) (*HistogramQuantileExpr, error) {
+	expr := &HistogramQuantileExpr{}
+	var err error
+
+	for f := iter.ReadObject(); f != ""; f = iter.ReadObject() {
+		switch f {
+		case Params:
+			expr.Quantile = iter.ReadFloat64()
+		case Inner:
+			expr.Left, err = decodeSample(iter)
+		}
+	}
+
+	return expr, err
+}
+
+func decodeLabelDropRegex(iter *jsoniter.Iterator) (*LabelDropRegexExpr, error) {
+	var err error
+	var left SampleExpr
+	var regex string
+
+	for f := iter.ReadObject(); f != ""; f = iter.ReadObject() {
+		switch f {
+		case Inner:
+			left, err = decodeSample(iter)
+			if err != nil {
+				return nil, err
+			}
+		case RegexField:
+			regex = iter.ReadString()
+		}
+	}
+
+	return mustNewLabelDropRegexExpr(left, regex), nil
+}
+
+func decodeLabelMode(iter *jsoniter.Iterator) (*LabelModeExpr, error) {
+	var err error
+	var left SampleExpr
+	var label string
+
+	for f := iter.ReadObject(); f != ""; f = iter.ReadObject() {
+		switch f {
+		case Inner:
+			left, err = decodeSample(iter)
+			if err != nil {
+				return nil, err
+			}
+		case Label:
+			label = iter.ReadString()
+		}
+	}
+
+	return mustNewLabelModeExpr(left, label), nil
+}
+
+func decodeRound(iter *jsoniter.Iterator) (*RoundExpr, error) {
+	expr := &RoundExpr{}
+	var err error
+
+	for f := iter.ReadObject(); f != ""; f = iter.ReadObject() {
+		switch f {
+		case Params:
+			expr.ToNearest = iter.ReadFloat64()
+		case Inner:
+			expr.Left, err = decodeSample(iter)
+		}
+	}
+
+	return expr, err
+}
+
+func decodeAbsent(iter *jsoniter.Iterator) (*AbsentExpr, error) {
+	expr := &AbsentExpr{}
+	var err error
+
+	for f := iter.ReadObject(); f != ""; f = iter.ReadObject() {
+		if f == Inner {
+			expr.Left, err = decodeSample(iter)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newAbsentExpr(expr.Left), nil
+}
+
+func decodeScalar(iter *jsoniter.Iterator) (*ScalarExpr, error) {
+	expr := &ScalarExpr{}
+	var err error
+
+	for f := iter.ReadObject(); f != ""; f = iter.ReadObject() {
+		switch f {
+		case Vector:
+			expr.Vector = iter.ReadBool()
+		case Inner:
+			expr.Left, err = decodeSample(iter)
+		}
+	}
+
+	return expr, err
+}
+
+func decodeMetricLabelFmt(iter *jsoniter.Iterator) (*MetricLabelFmtExpr, error) {
+	expr := &MetricLabelFmtExpr{Fmt: &LabelFmtExpr{}}
+	var err error
+
+	for f := iter.ReadObject(); f != ""; f = iter.ReadObject() {
+		switch f {
+		case Formats:
+			iter.ReadVal(&expr.Fmt.Formats)
+		case Inner:
+			expr.Left, err = decodeSample(iter)
+		}
+	}
+
+	return expr, err
+}
+
 func decodeLiteral(iter *jsoniter.Iterator) (*LiteralExpr, error) {
 	expr := &LiteralExpr{}
 
@@ -990,6 +1373,15 @@ func decodeVariants(iter *jsoniter.Iterator) (VariantsExpr, error) {
 			}
 
 			e.SetLogSelector(logRange)
+		case Merge:
+			e.SetMerge(iter.ReadString())
+		case GroupingField:
+			grouping, err := decodeGrouping(iter)
+			if err != nil {
+				return nil, err
+			}
+
+			e.SetGrouping(grouping)
 		}
 	}
 
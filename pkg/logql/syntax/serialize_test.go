@@ -21,6 +21,21 @@ func TestJSONSerializationRoundTrip(t *testing.T) {
 		"simple aggregation with unwrap": {
 			query: `sum_over_time({env="prod", app=~"loki.*"} | unwrap bytes[5m])`,
 		},
+		"unwrap arithmetic": {
+			query: `avg_over_time({app="foo"} | logfmt | unwrap (bytes_sent / duration)[5m])`,
+		},
+		"quantile": {
+			query: `quantile without (pod) (0.9, rate({app="foo"}[5m]))`,
+		},
+		"unwrap regex": {
+			query: `avg_over_time({app="foo"} | unwrap_regex "latency_p99=(?P<v>[0-9.]+)" as v [5m])`,
+		},
+		"unwrap default": {
+			query: `rate({app="foo"} | logfmt | unwrap bytes(size) default 0 [5m])`,
+		},
+		"last_over_time default": {
+			query: `last_over_time({app="foo"} | unwrap bytes [5m], default=0)`,
+		},
 		"bin op": {
 			query: `(count_over_time({env="prod", app=~"loki.*"}[5m]) >= 0)`,
 		},
@@ -42,6 +57,45 @@ func TestJSONSerializationRoundTrip(t *testing.T) {
 		"label replace": {
 			query: `label_replace(vector(0.000000),"foo","bar","","")`,
 		},
+		"histogram quantile": {
+			query: `histogram_quantile(0.9,sum by (le)(rate({app="foo"} | unwrap count[5m])))`,
+		},
+		"label drop regex": {
+			query: `label_drop_regex(count_over_time({app="foo"}[5m]),"tmp_.*")`,
+		},
+		"label mode": {
+			query: `label_mode(count_over_time({app="foo"}[5m]),"version")`,
+		},
+		"round": {
+			query: `round(rate({app="foo"}[5m]),0.01)`,
+		},
+		"round default step": {
+			query: `round(rate({app="foo"}[5m]))`,
+		},
+		"absent": {
+			query: `absent(sum(rate({app="foo"}[5m])))`,
+		},
+		"scalar": {
+			query: `scalar(sum(rate({app="foo"}[5m])))`,
+		},
+		"vector of scalar": {
+			query: `vector(scalar(sum(rate({app="foo"}[5m]))))`,
+		},
+		"metric label format": {
+			query: `sum by (app,namespace)(rate({app="foo"}[5m])) | label_format new="{{.app}}-{{.namespace}}",ns=namespace`,
+		},
+		"unit": {
+			query: `bytes_over_time({app="foo"} | __unit__("bytes")[5m])`,
+		},
+		"json schema": {
+			query: `count_over_time({app="foo"} | json_schema "access_log" | __error__=""[5m])`,
+		},
+		"count values over time": {
+			query: `count_values_over_time("val",{app="foo"} | unwrap x[5m])`,
+		},
+		"at modifier": {
+			query: `count_over_time({app="foo"}[1m] offset 5m @ 60.5)`,
+		},
 		"filters with bytes": {
 			query: `{app="foo"} |= "bar" | json | ( status_code <500 or ( status_code>200 , size>=2.5KiB ) )`,
 		},
@@ -68,6 +122,12 @@ func TestJSONSerializationRoundTrip(t *testing.T) {
 		"multiple variants with filters": {
 			query: `variants(bytes_over_time({foo="bar"}[5m]), count_over_time({foo="bar"}[5m])) of ({foo="bar"} | logfmt[5m])`,
 		},
+		"merged variants": {
+			query: `variants(count_over_time({foo="bar"}[5m]), count_over_time({foo="bar"} |= "error"[5m])) of ({foo="bar"}[5m]) merged(avg)`,
+		},
+		"grouped variants": {
+			query: `sum by (app) (variants(count_over_time({foo="bar"}[5m]), count_over_time({foo="bar"} |= "error"[5m])) of ({foo="bar"}[5m]))`,
+		},
 	}
 
 	for name, test := range tests {
@@ -113,3 +173,29 @@ func TestJSONSerializationParseTestCases(t *testing.T) {
 		}
 	}
 }
+
+func TestJSONSerializationResolvedJSONSchemas(t *testing.T) {
+	expr, err := ParseExpr(`count_over_time({app="foo"} | json_schema "access_log"[5m])`)
+	require.NoError(t, err)
+
+	schema := `{"type": "object"}`
+	require.NoError(t, ResolveJSONSchemas(expr, func(name string) (string, bool) {
+		return schema, name == "access_log"
+	}))
+
+	var buf bytes.Buffer
+	require.NoError(t, EncodeJSON(expr, &buf))
+	actual, err := DecodeJSON(buf.String())
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]string{"access_log": schema}, jsonSchemas(actual))
+	require.Equal(t, expr.String(), actual.String())
+}
+
+func TestResolveJSONSchemas_Unknown(t *testing.T) {
+	expr, err := ParseExpr(`{app="foo"} | json_schema "access_log"`)
+	require.NoError(t, err)
+
+	err = ResolveJSONSchemas(expr, func(string) (string, bool) { return "", false })
+	require.EqualError(t, err, `parse error : unknown json schema "access_log"`)
+}
@@ -49,9 +49,9 @@ import (
 
 %type <expr> expr
 %type <logExpr> logExpr
-%type <metricExpr> metricExpr rangeAggregationExpr vectorAggregationExpr binOpExpr labelReplaceExpr vectorExpr
+%type <metricExpr> metricExpr rangeAggregationExpr vectorAggregationExpr binOpExpr labelReplaceExpr histogramQuantileExpr labelDropRegexExpr labelModeExpr roundExpr absentExpr scalarExpr vectorExpr
 %type <variantsExpr> variantsExpr
-%type <stage> pipelineStage logfmtParser labelParser jsonExpressionParser logfmtExpressionParser lineFormatExpr decolorizeExpr labelFormatExpr dropLabelsExpr keepLabelsExpr
+%type <stage> pipelineStage logfmtParser labelParser jsonExpressionParser logfmtExpressionParser lineFormatExpr decolorizeExpr unitExpr jsonSchemaExpr dropLabelsExpr keepLabelsExpr
 %type <stages> pipelineExpr
 %type <lineFilterExpr> lineFilter lineFilters orFilter
 %type <op> rangeOp convOp vectorOp filterOp
@@ -66,6 +66,7 @@ import (
 %type <namedMatchers> namedMatchers
 %type <labelFormat> labelFormat
 %type <labelsFormat> labelsFormat
+%type <labelFormatExpr> labelFormatExpr
 %type <grouping> grouping
 %type <logRangeExpr> logRangeExpr
 %type <literalExpr> literalExpr
@@ -81,10 +82,12 @@ import (
 %token <val> MATCHERS LABELS EQ RE NRE NPA OPEN_BRACE CLOSE_BRACE OPEN_BRACKET CLOSE_BRACKET COMMA DOT PIPE_MATCH PIPE_EXACT PIPE_PATTERN
              OPEN_PARENTHESIS CLOSE_PARENTHESIS BY WITHOUT COUNT_OVER_TIME RATE RATE_COUNTER SUM SORT SORT_DESC AVG
              MAX MIN COUNT STDDEV STDVAR BOTTOMK TOPK APPROX_TOPK
-             BYTES_OVER_TIME BYTES_RATE BOOL JSON REGEXP LOGFMT PIPE LINE_FMT LABEL_FMT UNWRAP AVG_OVER_TIME SUM_OVER_TIME MIN_OVER_TIME
+             BYTES_OVER_TIME BYTES_RATE BOOL JSON REGEXP LOGFMT PIPE LINE_FMT LABEL_FMT UNWRAP UNWRAP_REGEX AVG_OVER_TIME SUM_OVER_TIME MIN_OVER_TIME
              MAX_OVER_TIME STDVAR_OVER_TIME STDDEV_OVER_TIME QUANTILE_OVER_TIME BYTES_CONV DURATION_CONV DURATION_SECONDS_CONV
-             FIRST_OVER_TIME LAST_OVER_TIME ABSENT_OVER_TIME VECTOR LABEL_REPLACE UNPACK OFFSET PATTERN IP ON IGNORING GROUP_LEFT GROUP_RIGHT
-             DECOLORIZE DROP KEEP VARIANTS OF
+             FIRST_OVER_TIME LAST_OVER_TIME ABSENT_OVER_TIME VECTOR LABEL_REPLACE UNPACK OFFSET AT PATTERN IP ON IGNORING GROUP_LEFT GROUP_RIGHT
+             DECOLORIZE DROP KEEP VARIANTS OF MERGED HISTOGRAM_QUANTILE COUNT_VALUES_OVER_TIME CV_OVER_TIME ZSCORE_OVER_TIME
+             LABEL_DROP_REGEX MATCHED_BYTES_OVER_TIME UNIT JSON_SCHEMA AUTOCORR_OVER_TIME LABEL_MODE ROUND ABSENT SCALAR
+             CHANGES_OVER_TIME DELTA IDELTA DERIV RESETS_OVER_TIME QUANTILE
 
 // Operators are listed with increasing precedence.
 %left <binOp> OR
@@ -117,12 +120,24 @@ metricExpr:
     | binOpExpr                                     { $$ = $1 }
     | literalExpr                                   { $$ = $1 }
     | labelReplaceExpr                              { $$ = $1 }
+    | histogramQuantileExpr                         { $$ = $1 }
+    | labelDropRegexExpr                            { $$ = $1 }
+    | labelModeExpr                                 { $$ = $1 }
+    | roundExpr                                     { $$ = $1 }
+    | absentExpr                                    { $$ = $1 }
+    | scalarExpr                                    { $$ = $1 }
+    | metricExpr PIPE labelFormatExpr               { $$ = mustNewMetricLabelFmtExpr($1, $3) }
     | vectorExpr                                    { $$ = $1 }
     | OPEN_PARENTHESIS metricExpr CLOSE_PARENTHESIS { $$ = $2 }
     ;
 
 variantsExpr:
       VARIANTS OPEN_PARENTHESIS metricExprs CLOSE_PARENTHESIS OF OPEN_PARENTHESIS logRangeExpr CLOSE_PARENTHESIS { $$ = newVariantsExpr($3, $7) }
+    | VARIANTS OPEN_PARENTHESIS metricExprs CLOSE_PARENTHESIS OF OPEN_PARENTHESIS logRangeExpr CLOSE_PARENTHESIS MERGED OPEN_PARENTHESIS IDENTIFIER CLOSE_PARENTHESIS
+      { $$ = newMergedVariantsExpr($3, $7, $11) }
+    | vectorOp OPEN_PARENTHESIS variantsExpr CLOSE_PARENTHESIS                             { $$ = newGroupedVariantsExpr($3, $1, &Grouping{}) }
+    | vectorOp grouping OPEN_PARENTHESIS variantsExpr CLOSE_PARENTHESIS                    { $$ = newGroupedVariantsExpr($4, $1, $2) }
+    | vectorOp OPEN_PARENTHESIS variantsExpr CLOSE_PARENTHESIS grouping                    { $$ = newGroupedVariantsExpr($3, $1, $5) }
     ;
 
 logRangeExpr:
@@ -156,7 +171,15 @@ logRangeExpr:
 
 unwrapExpr:
     PIPE UNWRAP IDENTIFIER                                                   { $$ = newUnwrapExpr($3, "")}
+  | PIPE UNWRAP IDENTIFIER IDENTIFIER NUMBER                                 { $$ = newUnwrapExprWithDefault($3, "", $4, $5)}
   | PIPE UNWRAP convOp OPEN_PARENTHESIS IDENTIFIER CLOSE_PARENTHESIS         { $$ = newUnwrapExpr($5, $3)}
+  | PIPE UNWRAP convOp OPEN_PARENTHESIS IDENTIFIER CLOSE_PARENTHESIS IDENTIFIER NUMBER
+                                                                             { $$ = newUnwrapExprWithDefault($5, $3, $7, $8)}
+  | PIPE UNWRAP OPEN_PARENTHESIS IDENTIFIER ADD IDENTIFIER CLOSE_PARENTHESIS  { $$ = newUnwrapArithmeticExpr($4, OpTypeAdd, $6)}
+  | PIPE UNWRAP OPEN_PARENTHESIS IDENTIFIER SUB IDENTIFIER CLOSE_PARENTHESIS  { $$ = newUnwrapArithmeticExpr($4, OpTypeSub, $6)}
+  | PIPE UNWRAP OPEN_PARENTHESIS IDENTIFIER MUL IDENTIFIER CLOSE_PARENTHESIS  { $$ = newUnwrapArithmeticExpr($4, OpTypeMul, $6)}
+  | PIPE UNWRAP OPEN_PARENTHESIS IDENTIFIER DIV IDENTIFIER CLOSE_PARENTHESIS  { $$ = newUnwrapArithmeticExpr($4, OpTypeDiv, $6)}
+  | PIPE UNWRAP_REGEX STRING IDENTIFIER IDENTIFIER                          { $$ = newUnwrapRegexExpr($3, $4, $5)}
   | unwrapExpr PIPE labelFilter                                              { $$ = $1.addPostFilter($3) }
   ;
 
@@ -171,6 +194,11 @@ rangeAggregationExpr:
     | rangeOp OPEN_PARENTHESIS NUMBER COMMA logRangeExpr CLOSE_PARENTHESIS           { $$ = newRangeAggregationExpr($5, $1, nil, &$3) }
     | rangeOp OPEN_PARENTHESIS logRangeExpr CLOSE_PARENTHESIS grouping               { $$ = newRangeAggregationExpr($3, $1, $5, nil) }
     | rangeOp OPEN_PARENTHESIS NUMBER COMMA logRangeExpr CLOSE_PARENTHESIS grouping  { $$ = newRangeAggregationExpr($5, $1, $7, &$3) }
+    | rangeOp OPEN_PARENTHESIS STRING COMMA logRangeExpr CLOSE_PARENTHESIS           { $$ = newRangeAggregationExprWithLabel($5, $1, $3) }
+    | rangeOp OPEN_PARENTHESIS logRangeExpr COMMA NUMBER CLOSE_PARENTHESIS           { $$ = newRangeAggregationExprWithLag($3, $1, nil, $5) }
+    | rangeOp OPEN_PARENTHESIS logRangeExpr COMMA NUMBER CLOSE_PARENTHESIS grouping  { $$ = newRangeAggregationExprWithLag($3, $1, $7, $5) }
+    | rangeOp OPEN_PARENTHESIS logRangeExpr COMMA IDENTIFIER EQ NUMBER CLOSE_PARENTHESIS           { $$ = newRangeAggregationExprWithDefault($3, $1, nil, $5, $7) }
+    | rangeOp OPEN_PARENTHESIS logRangeExpr COMMA IDENTIFIER EQ NUMBER CLOSE_PARENTHESIS grouping  { $$ = newRangeAggregationExprWithDefault($3, $1, $9, $5, $7) }
     ;
 
 vectorAggregationExpr:
@@ -189,6 +217,35 @@ labelReplaceExpr:
       { $$ = mustNewLabelReplaceExpr($3, $5, $7, $9, $11)}
     ;
 
+histogramQuantileExpr:
+    HISTOGRAM_QUANTILE OPEN_PARENTHESIS NUMBER COMMA metricExpr CLOSE_PARENTHESIS
+      { $$ = mustNewHistogramQuantileExpr($3, $5) }
+    ;
+
+labelDropRegexExpr:
+    LABEL_DROP_REGEX OPEN_PARENTHESIS metricExpr COMMA STRING CLOSE_PARENTHESIS
+      { $$ = mustNewLabelDropRegexExpr($3, $5) }
+    ;
+
+labelModeExpr:
+    LABEL_MODE OPEN_PARENTHESIS metricExpr COMMA STRING CLOSE_PARENTHESIS
+      { $$ = mustNewLabelModeExpr($3, $5) }
+    ;
+
+roundExpr:
+      ROUND OPEN_PARENTHESIS metricExpr CLOSE_PARENTHESIS              { $$ = mustNewRoundExpr($3, nil) }
+    | ROUND OPEN_PARENTHESIS metricExpr COMMA NUMBER CLOSE_PARENTHESIS { $$ = mustNewRoundExpr($3, &$5) }
+    ;
+
+absentExpr:
+    ABSENT OPEN_PARENTHESIS metricExpr CLOSE_PARENTHESIS { $$ = newAbsentExpr($3) }
+    ;
+
+scalarExpr:
+      SCALAR OPEN_PARENTHESIS metricExpr CLOSE_PARENTHESIS                                         { $$ = newScalarExpr($3, false) }
+    | vector OPEN_PARENTHESIS SCALAR OPEN_PARENTHESIS metricExpr CLOSE_PARENTHESIS CLOSE_PARENTHESIS { $$ = newScalarExpr($5, true) }
+    ;
+
 selector:
       OPEN_BRACE matchers CLOSE_BRACE  { $$ = $2 }
     | OPEN_BRACE matchers error        { $$ = $2 }
@@ -221,6 +278,8 @@ pipelineStage:
   | PIPE labelFilter             { $$ = &LabelFilterExpr{LabelFilterer: $2 }}
   | PIPE lineFormatExpr          { $$ = $2 }
   | PIPE decolorizeExpr          { $$ = $2 }
+  | PIPE unitExpr                { $$ = $2 }
+  | PIPE jsonSchemaExpr          { $$ = $2 }
   | PIPE labelFormatExpr         { $$ = $2 }
   | PIPE dropLabelsExpr          { $$ = $2 }
   | PIPE keepLabelsExpr          { $$ = $2 }
@@ -285,6 +344,10 @@ lineFormatExpr: LINE_FMT STRING { $$ = newLineFmtExpr($2) };
 
 decolorizeExpr: DECOLORIZE { $$ = newDecolorizeExpr() };
 
+unitExpr: UNIT OPEN_PARENTHESIS STRING CLOSE_PARENTHESIS { $$ = newUnitExpr($3) };
+
+jsonSchemaExpr: JSON_SCHEMA STRING { $$ = newJSONSchemaExpr($2) };
+
 labelFormat:
      IDENTIFIER EQ IDENTIFIER { $$ = log.NewRenameLabelFmt($1, $3)}
   |  IDENTIFIER EQ STRING     { $$ = log.NewTemplateLabelFmt($1, $3)}
@@ -487,6 +550,7 @@ vectorOp:
       | SORT    { $$ = OpTypeSort }
       | SORT_DESC    { $$ = OpTypeSortDesc }
       | APPROX_TOPK  { $$ = OpTypeApproxTopK }
+      | QUANTILE     { $$ = OpTypeQuantile }
       ;
 
 rangeOp:
@@ -505,10 +569,24 @@ rangeOp:
     | FIRST_OVER_TIME    { $$ = OpRangeTypeFirst }
     | LAST_OVER_TIME     { $$ = OpRangeTypeLast }
     | ABSENT_OVER_TIME   { $$ = OpRangeTypeAbsent }
+    | COUNT_VALUES_OVER_TIME { $$ = OpRangeTypeCountValues }
+    | CV_OVER_TIME       { $$ = OpRangeTypeCV }
+    | ZSCORE_OVER_TIME   { $$ = OpRangeTypeZScore }
+    | MATCHED_BYTES_OVER_TIME { $$ = OpRangeTypeMatchedBytes }
+    | AUTOCORR_OVER_TIME { $$ = OpRangeTypeAutocorr }
+    | CHANGES_OVER_TIME  { $$ = OpRangeTypeChanges }
+    | DELTA              { $$ = OpRangeTypeDelta }
+    | IDELTA             { $$ = OpRangeTypeIdelta }
+    | DERIV              { $$ = OpRangeTypeDeriv }
+    | RESETS_OVER_TIME   { $$ = OpRangeTypeResets }
     ;
 
 offsetExpr:
-    OFFSET DURATION { $$ = newOffsetExpr( $2 ) }
+      OFFSET DURATION               { $$ = newOffsetExpr( $2 ) }
+    | AT NUMBER                     { $$ = newAtExpr( $2, 0 ) }
+    | OFFSET DURATION AT NUMBER     { $$ = newAtExpr( $4, $2 ) }
+    | AT NUMBER OFFSET DURATION     { $$ = newAtExpr( $2, $4 ) }
+    ;
 
 labels:
       IDENTIFIER                 { $$ = []string{ $1 } }
@@ -0,0 +1,83 @@
+package syntax
+
+// Unit returns the unit of the samples of a sample expression as declared by
+// `__unit__` stages. The unit of a binary operation is derived from the units
+// of its legs. An empty unit means the samples are dimensionless or their
+// unit was not declared.
+func Unit(expr SampleExpr) string {
+	switch e := expr.(type) {
+	case *RangeAggregationExpr:
+		var unit string
+		if p, ok := e.Left.Left.(*PipelineExpr); ok {
+			for _, stage := range p.MultiStages {
+				if u, ok := stage.(*UnitExpr); ok {
+					unit = u.Unit
+				}
+			}
+		}
+		return unit
+	case *VectorAggregationExpr:
+		return Unit(e.Left)
+	case *LabelReplaceExpr:
+		return Unit(e.Left)
+	case *LabelDropRegexExpr:
+		return Unit(e.Left)
+	case *LabelModeExpr:
+		// the samples count series.
+		return ""
+	case *RoundExpr:
+		return Unit(e.Left)
+	case *AbsentExpr:
+		return ""
+	case *ScalarExpr:
+		return Unit(e.Left)
+	case *MetricLabelFmtExpr:
+		return Unit(e.Left)
+	case *HistogramQuantileExpr:
+		return Unit(e.Left)
+	case *BinOpExpr:
+		unit, _ := BinOpUnit(e.Op, Unit(e.SampleExpr), Unit(e.RHS))
+		return unit
+	default:
+		return ""
+	}
+}
+
+// BinOpUnit returns the unit of the result of a binary operation between
+// samples of the given units and whether these units are consistent.
+// Additive and comparison operations require both legs to have the same unit
+// unless one of them is dimensionless. Multiplication and division combine the
+// units of their legs.
+func BinOpUnit(op, left, right string) (string, bool) {
+	switch op {
+	case OpTypeMul:
+		switch {
+		case left == "":
+			return right, true
+		case right == "":
+			return left, true
+		}
+		return left + "*" + right, true
+	case OpTypeDiv:
+		switch {
+		case right == "":
+			return left, true
+		case left == right:
+			return "", true
+		case left == "":
+			return "1/" + right, true
+		}
+		return left + "/" + right, true
+	case OpTypeAdd, OpTypeSub, OpTypeCmpEQ, OpTypeNEQ, OpTypeGT, OpTypeGTE, OpTypeLT, OpTypeLTE:
+		switch {
+		case left == "":
+			return right, true
+		case right == "":
+			return left, true
+		}
+		return left, left == right
+	default:
+		// set operations, modulo and power keep the unit of the left leg.
+		return left, true
+	}
+}
@@ -0,0 +1,36 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnit(t *testing.T) {
+	for _, tc := range []struct {
+		query      string
+		unit       string
+		consistent bool
+	}{
+		{`rate({app="foo"} | __unit__("lines/s") [1m])`, "lines/s", true},
+		{`sum by (app) (bytes_over_time({app="foo"} | __unit__("bytes") [1m]))`, "bytes", true},
+		{`count_over_time({app="foo"}[1m])`, "", true},
+		{`sum(bytes_over_time({app="foo"} | __unit__("bytes") [1m])) + sum(bytes_over_time({app="bar"} | __unit__("bytes") [1m]))`, "bytes", true},
+		{`sum(bytes_over_time({app="foo"} | __unit__("bytes") [1m])) > sum(count_over_time({app="bar"}[1m]))`, "bytes", true},
+		{`sum(bytes_over_time({app="foo"} | __unit__("bytes") [1m])) / sum(count_over_time({app="bar"} | __unit__("lines") [1m]))`, "bytes/lines", true},
+		{`sum(bytes_over_time({app="foo"} | __unit__("bytes") [1m])) / sum(bytes_over_time({app="bar"} | __unit__("bytes") [1m]))`, "", true},
+		{`sum(bytes_over_time({app="foo"} | __unit__("bytes") [1m])) * 2`, "bytes", true},
+		{`sum(bytes_over_time({app="foo"} | __unit__("bytes") [1m])) + sum(sum_over_time({app="bar"} | __unit__("s") | unwrap duration(d) [1m]))`, "bytes", false},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := ParseSampleExpr(tc.query)
+			require.NoError(t, err)
+			require.Equal(t, tc.unit, Unit(expr))
+
+			if e, ok := expr.(*BinOpExpr); ok {
+				_, consistent := BinOpUnit(e.Op, Unit(e.SampleExpr), Unit(e.RHS))
+				require.Equal(t, tc.consistent, consistent)
+			}
+		})
+	}
+}
@@ -18,6 +18,13 @@ type SampleExprVisitor interface {
 	VisitVectorAggregation(*VectorAggregationExpr)
 	VisitRangeAggregation(*RangeAggregationExpr)
 	VisitLabelReplace(*LabelReplaceExpr)
+	VisitHistogramQuantile(*HistogramQuantileExpr)
+	VisitLabelDropRegex(*LabelDropRegexExpr)
+	VisitLabelMode(*LabelModeExpr)
+	VisitRound(*RoundExpr)
+	VisitAbsent(*AbsentExpr)
+	VisitScalar(*ScalarExpr)
+	VisitMetricLabelFmt(*MetricLabelFmtExpr)
 	VisitLiteral(*LiteralExpr)
 	VisitVector(*VectorExpr)
 }
@@ -31,6 +38,8 @@ type LogSelectorExprVisitor interface {
 
 type StageExprVisitor interface {
 	VisitDecolorize(*DecolorizeExpr)
+	VisitUnit(*UnitExpr)
+	VisitJSONSchema(*JSONSchemaExpr)
 	VisitDropLabels(*DropLabelsExpr)
 	VisitJSONExpressionParser(*JSONExpressionParserExpr)
 	VisitKeepLabel(*KeepLabelsExpr)
@@ -50,11 +59,18 @@ type VariantsExprVisitor interface {
 var _ RootVisitor = &DepthFirstTraversal{}
 
 type DepthFirstTraversal struct {
+	VisitAbsentFn                 func(v RootVisitor, e *AbsentExpr)
+	VisitScalarFn                 func(v RootVisitor, e *ScalarExpr)
 	VisitBinOpFn                  func(v RootVisitor, e *BinOpExpr)
 	VisitDecolorizeFn             func(v RootVisitor, e *DecolorizeExpr)
+	VisitUnitFn                   func(v RootVisitor, e *UnitExpr)
+	VisitJSONSchemaFn             func(v RootVisitor, e *JSONSchemaExpr)
 	VisitDropLabelsFn             func(v RootVisitor, e *DropLabelsExpr)
+	VisitHistogramQuantileFn      func(v RootVisitor, e *HistogramQuantileExpr)
 	VisitJSONExpressionParserFn   func(v RootVisitor, e *JSONExpressionParserExpr)
 	VisitKeepLabelFn              func(v RootVisitor, e *KeepLabelsExpr)
+	VisitLabelDropRegexFn         func(v RootVisitor, e *LabelDropRegexExpr)
+	VisitLabelModeFn              func(v RootVisitor, e *LabelModeExpr)
 	VisitLabelFilterFn            func(v RootVisitor, e *LabelFilterExpr)
 	VisitLabelFmtFn               func(v RootVisitor, e *LabelFmtExpr)
 	VisitLabelParserFn            func(v RootVisitor, e *LineParserExpr)
@@ -66,8 +82,10 @@ type DepthFirstTraversal struct {
 	VisitLogfmtExpressionParserFn func(v RootVisitor, e *LogfmtExpressionParserExpr)
 	VisitLogfmtParserFn           func(v RootVisitor, e *LogfmtParserExpr)
 	VisitMatchersFn               func(v RootVisitor, e *MatchersExpr)
+	VisitMetricLabelFmtFn         func(v RootVisitor, e *MetricLabelFmtExpr)
 	VisitPipelineFn               func(v RootVisitor, e *PipelineExpr)
 	VisitRangeAggregationFn       func(v RootVisitor, e *RangeAggregationExpr)
+	VisitRoundFn                  func(v RootVisitor, e *RoundExpr)
 	VisitVectorFn                 func(v RootVisitor, e *VectorExpr)
 	VisitVectorAggregationFn      func(v RootVisitor, e *VectorAggregationExpr)
 	VisitVariantsFn               func(v RootVisitor, e *MultiVariantExpr)
@@ -96,6 +114,26 @@ func (v *DepthFirstTraversal) VisitDecolorize(e *DecolorizeExpr) {
 	}
 }
 
+// VisitUnit implements RootVisitor.
+func (v *DepthFirstTraversal) VisitUnit(e *UnitExpr) {
+	if e == nil {
+		return
+	}
+	if v.VisitUnitFn != nil {
+		v.VisitUnitFn(v, e)
+	}
+}
+
+// VisitJSONSchema implements RootVisitor.
+func (v *DepthFirstTraversal) VisitJSONSchema(e *JSONSchemaExpr) {
+	if e == nil {
+		return
+	}
+	if v.VisitJSONSchemaFn != nil {
+		v.VisitJSONSchemaFn(v, e)
+	}
+}
+
 // VisitDropLabels implements RootVisitor.
 func (v *DepthFirstTraversal) VisitDropLabels(e *DropLabelsExpr) {
 	if e == nil {
@@ -106,6 +144,18 @@ func (v *DepthFirstTraversal) VisitDropLabels(e *DropLabelsExpr) {
 	}
 }
 
+// VisitHistogramQuantile implements RootVisitor.
+func (v *DepthFirstTraversal) VisitHistogramQuantile(e *HistogramQuantileExpr) {
+	if e == nil {
+		return
+	}
+	if v.VisitHistogramQuantileFn != nil {
+		v.VisitHistogramQuantileFn(v, e)
+	} else {
+		e.Left.Accept(v)
+	}
+}
+
 // VisitJSONExpressionParser implements RootVisitor.
 func (v *DepthFirstTraversal) VisitJSONExpressionParser(e *JSONExpressionParserExpr) {
 	if e == nil {
@@ -156,6 +206,78 @@ func (v *DepthFirstTraversal) VisitLabelParser(e *LineParserExpr) {
 	}
 }
 
+// VisitLabelDropRegex implements RootVisitor.
+func (v *DepthFirstTraversal) VisitLabelDropRegex(e *LabelDropRegexExpr) {
+	if e == nil {
+		return
+	}
+	if v.VisitLabelDropRegexFn != nil {
+		v.VisitLabelDropRegexFn(v, e)
+	} else {
+		e.Left.Accept(v)
+	}
+}
+
+// VisitLabelMode implements RootVisitor.
+func (v *DepthFirstTraversal) VisitLabelMode(e *LabelModeExpr) {
+	if e == nil {
+		return
+	}
+	if v.VisitLabelModeFn != nil {
+		v.VisitLabelModeFn(v, e)
+	} else {
+		e.Left.Accept(v)
+	}
+}
+
+// VisitRound implements RootVisitor.
+func (v *DepthFirstTraversal) VisitRound(e *RoundExpr) {
+	if e == nil {
+		return
+	}
+	if v.VisitRoundFn != nil {
+		v.VisitRoundFn(v, e)
+	} else {
+		e.Left.Accept(v)
+	}
+}
+
+// VisitAbsent implements RootVisitor.
+func (v *DepthFirstTraversal) VisitAbsent(e *AbsentExpr) {
+	if e == nil {
+		return
+	}
+	if v.VisitAbsentFn != nil {
+		v.VisitAbsentFn(v, e)
+	} else {
+		e.Left.Accept(v)
+	}
+}
+
+// VisitScalar implements RootVisitor.
+func (v *DepthFirstTraversal) VisitScalar(e *ScalarExpr) {
+	if e == nil {
+		return
+	}
+	if v.VisitScalarFn != nil {
+		v.VisitScalarFn(v, e)
+	} else {
+		e.Left.Accept(v)
+	}
+}
+
+// VisitMetricLabelFmt implements RootVisitor.
+func (v *DepthFirstTraversal) VisitMetricLabelFmt(e *MetricLabelFmtExpr) {
+	if e == nil {
+		return
+	}
+	if v.VisitMetricLabelFmtFn != nil {
+		v.VisitMetricLabelFmtFn(v, e)
+	} else {
+		e.Left.Accept(v)
+	}
+}
+
 // VisitLabelReplace implements RootVisitor.
 func (v *DepthFirstTraversal) VisitLabelReplace(e *LabelReplaceExpr) {
 	if e == nil {
@@ -20,6 +20,7 @@ import (
 	"github.com/grafana/loki/v3/pkg/logproto"
 	"github.com/grafana/loki/v3/pkg/logql/log"
 	"github.com/grafana/loki/v3/pkg/logqlmodel"
+	"github.com/grafana/loki/v3/pkg/logqlmodel/stats"
 	"github.com/grafana/loki/v3/pkg/storage/stores/shipper/indexshipper/tsdb/index"
 )
 
@@ -51,7 +52,7 @@ func (q MockQuerier) extractOldShard(xs []string) (*index.ShardAnnotation, error
 	return parsed[0].PowerOfTwo, nil
 }
 
-func (q MockQuerier) SelectLogs(_ context.Context, req SelectLogParams) (iter.EntryIterator, error) {
+func (q MockQuerier) SelectLogs(ctx context.Context, req SelectLogParams) (iter.EntryIterator, error) {
 	expr, err := req.LogSelector()
 	if err != nil {
 		return nil, err
@@ -90,6 +91,8 @@ outer:
 		matched = append(matched, stream)
 	}
 
+	recordLinesProcessed(ctx, matched, req.Start, req.End)
+
 	// apply the LineFilter
 	filtered := processStream(matched, pipeline)
 
@@ -112,6 +115,21 @@ outer:
 	return iter.NewSortEntryIterator(streamIters, req.Direction), nil
 }
 
+// recordLinesProcessed records the lines of the streams within [start, end)
+// in the statistics, like the stores do for the lines they read before
+// applying the pipelines.
+func recordLinesProcessed(ctx context.Context, streams []logproto.Stream, start, end time.Time) {
+	var lines int64
+	for _, stream := range streams {
+		for _, e := range stream.Entries {
+			if !e.Timestamp.Before(start) && e.Timestamp.Before(end) {
+				lines++
+			}
+		}
+	}
+	stats.FromContext(ctx).AddDecompressedLines(lines)
+}
+
 func processStream(in []logproto.Stream, pipeline log.Pipeline) []logproto.Stream {
 	resByStream := map[string]*logproto.Stream{}
 
@@ -182,7 +200,7 @@ func processSeries(in []logproto.Stream, ex []log.SampleExtractor) ([]logproto.S
 	return series, nil
 }
 
-func (q MockQuerier) SelectSamples(_ context.Context, req SelectSampleParams) (iter.SampleIterator, error) {
+func (q MockQuerier) SelectSamples(ctx context.Context, req SelectSampleParams) (iter.SampleIterator, error) {
 	selector, err := req.LogSelector()
 	if err != nil {
 		return nil, err
@@ -227,6 +245,8 @@ outer:
 		matched = append(matched, stream)
 	}
 
+	recordLinesProcessed(ctx, matched, req.Start, req.End.Add(time.Nanosecond))
+
 	filtered, err := processSeries(matched, extractors)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,94 @@
+package logqlmodel
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+// EncodingCSV is the format encoding a matrix result as CSV.
+const EncodingCSV = "csv"
+
+const (
+	// NonFiniteString encodes NaN and infinite sample values in JSON as the
+	// "NaN", "+Inf" and "-Inf" strings, like Prometheus does.
+	NonFiniteString = "string"
+	// NonFiniteNull encodes NaN and infinite sample values in JSON as null,
+	// see httpreq.FlagNonFiniteNull.
+	NonFiniteNull = "null"
+)
+
+// ValidateNonFiniteEncoding returns an error if encoding is not a known
+// encoding of NaN and infinite sample values. The empty encoding is
+// NonFiniteString.
+func ValidateNonFiniteEncoding(encoding string) error {
+	switch encoding {
+	case "", NonFiniteString, NonFiniteNull:
+		return nil
+	default:
+		return fmt.Errorf("invalid non-finite JSON encoding %q, must be one of %q or %q", encoding, NonFiniteString, NonFiniteNull)
+	}
+}
+
+// Encode encodes the data of the result in the given format. Only matrix
+// results can be encoded, as CSV.
+func (r Result) Encode(format string) ([]byte, error) {
+	if format != EncodingCSV {
+		return nil, fmt.Errorf("unsupported result encoding: %s", format)
+	}
+	if r.Data == nil {
+		return nil, fmt.Errorf("cannot encode a result without data as %s", format)
+	}
+	m, ok := r.Data.(promql.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %s result as %s", r.Data.Type(), format)
+	}
+	return encodeMatrixCSV(m)
+}
+
+// encodeMatrixCSV encodes the matrix with one row per series keyed by its
+// labels and one column per timestamp of any of its points, preceded by a
+// header row of the timestamps. Missing points are left empty.
+func encodeMatrixCSV(m promql.Matrix) ([]byte, error) {
+	columns := map[int64]int{}
+	for _, s := range m {
+		for _, p := range s.Floats {
+			columns[p.T] = 0
+		}
+	}
+	timestamps := make([]int64, 0, len(columns))
+	for t := range columns {
+		timestamps = append(timestamps, t)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	header := make([]string, 0, len(timestamps)+1)
+	header = append(header, "series")
+	for i, t := range timestamps {
+		columns[t] = i + 1
+		header = append(header, time.UnixMilli(t).UTC().Format(time.RFC3339Nano))
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+	for _, s := range m {
+		row := make([]string, len(header))
+		row[0] = s.Metric.String()
+		for _, p := range s.Floats {
+			row[columns[p.T]] = strconv.FormatFloat(p.F, 'f', -1, 64)
+		}
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
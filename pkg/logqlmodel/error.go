@@ -1,8 +1,10 @@
 package logqlmodel
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/prometheus/prometheus/model/labels"
 )
@@ -15,6 +17,7 @@ var (
 	ErrLimit                            = errors.New("limit reached while evaluating the query")
 	ErrIntervalLimit                    = errors.New("[interval] value exceeds limit")
 	ErrBlocked                          = errors.New("query blocked by policy")
+	ErrLabelPolicy                      = errors.New("query rejected by the selector label policy")
 	ErrParseMatchers                    = errors.New("only label matchers are supported")
 	ErrUnsupportedSyntaxForInstantQuery = errors.New(
 		"log queries are not supported as an instant query type, please change your query to a range query type",
@@ -22,6 +25,9 @@ var (
 	ErrVariantsDisabled = errors.New(
 		"multi variant queries are disabled for this instance",
 	)
+	ErrQueryTimeout    = errors.New("query timed out")
+	ErrQueryTooComplex = errors.New("query too complex")
+	ErrNegativeOffset  = errors.New("negative offsets are disabled")
 	ErrorLabel         = "__error__"
 	PreserveErrorLabel = "__preserve_error__"
 	ErrorDetailsLabel  = "__error_details__"
@@ -97,7 +103,49 @@ func NewSeriesLimitError(limit int) *LimitError {
 	}
 }
 
+func NewSeriesPerStepLimitError(limit int) *LimitError {
+	return &LimitError{
+		error: fmt.Errorf("maximum number of series (%d) reached for a single step of a query; consider reducing query cardinality by adding more specific stream selectors or aggregating results with functions like sum(), count() or topk()", limit),
+	}
+}
+
+func NewResultLimitError(limit int) *LimitError {
+	return &LimitError{
+		error: fmt.Errorf("maximum number of data points (%d) reached for a single query; consider increasing the step, reducing the time range or aggregating results with functions like sum(), count() or topk()", limit),
+	}
+}
+
+func NewLabelLengthLimitError(lbs string) *LimitError {
+	return &LimitError{
+		error: fmt.Errorf("maximum label name or value length gives several series of the query result the labels %s; consider shortening or dropping the long labels with label_format, label_replace or drop", lbs),
+	}
+}
+
 // Is allows to use errors.Is(err,ErrLimit) on this error.
 func (e LimitError) Is(target error) bool {
 	return target == ErrLimit
 }
+
+// QueryTimeoutError is returned when a query is cancelled because it ran longer
+// than the configured query timeout.
+type QueryTimeoutError struct {
+	Elapsed time.Duration
+	Limit   time.Duration
+}
+
+func NewQueryTimeoutError(elapsed, limit time.Duration) *QueryTimeoutError {
+	return &QueryTimeoutError{
+		Elapsed: elapsed,
+		Limit:   limit,
+	}
+}
+
+func (e QueryTimeoutError) Error() string {
+	return fmt.Sprintf("%s after %s: the configured query timeout is %s", ErrQueryTimeout, e.Elapsed, e.Limit)
+}
+
+// Is allows to use errors.Is(err,ErrQueryTimeout) on this error.
+// It also matches context.DeadlineExceeded so callers mapping deadline errors keep working.
+func (e QueryTimeoutError) Is(target error) bool {
+	return target == ErrQueryTimeout || target == context.DeadlineExceeded
+}
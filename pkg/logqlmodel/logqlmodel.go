@@ -1,10 +1,14 @@
 package logqlmodel
 
 import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/grafana/loki/pkg/push"
 
+	"github.com/grafana/loki/v3/pkg/logqlmodel/metadata"
 	"github.com/grafana/loki/v3/pkg/logqlmodel/stats"
 	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase/definitions"
 )
@@ -21,8 +25,120 @@ type Result struct {
 	Statistics stats.Result
 	Headers    []*definitions.PrometheusResponseHeader
 	Warnings   []string
+	// StructuredWarnings holds the same warnings as Warnings with their code
+	// and fields.
+	StructuredWarnings []metadata.Warning
+	// LabelNames holds the sorted names of all labels of the series of a
+	// vector or matrix result.
+	LabelNames []string
+	// Unit is the unit of the samples of a metric query result as declared by
+	// the `__unit__` stages of the query.
+	Unit string
+	// SampleSources holds, for debugging, log lines that contributed to each
+	// sample of an instant metric query result, keyed by the labels of its
+	// series. It is only set when the engine includes sample sources.
+	SampleSources map[string][]push.Entry
+	// EmptyReason tells whether the result is empty because no streams
+	// matched the selectors of the query or because the pipelines filtered
+	// out all the lines of the matched streams.
+	EmptyReason EmptyReason
+}
+
+// ResultType is the type of the data of a query result.
+type ResultType int
+
+// The values of ResultType are stable and never reused.
+const (
+	ResultTypeUnknown ResultType = iota
+	ResultTypeStreams
+	ResultTypeVector
+	ResultTypeMatrix
+	ResultTypeScalar
+)
+
+// Type returns the type of the data of the result, ResultTypeUnknown if it
+// has no data or data of another type.
+func (r Result) Type() ResultType {
+	switch r.Data.(type) {
+	case Streams:
+		return ResultTypeStreams
+	case promql.Vector:
+		return ResultTypeVector
+	case promql.Matrix:
+		return ResultTypeMatrix
+	case promql.Scalar:
+		return ResultTypeScalar
+	default:
+		return ResultTypeUnknown
+	}
+}
+
+// ValueType returns the type of the data of the result as named by the
+// resultType field of the Prometheus query API, `streams`, `vector`,
+// `matrix` or `scalar`, or an empty string if it is unknown.
+func (r Result) ValueType() string {
+	switch r.Type() {
+	case ResultTypeStreams:
+		return ValueTypeStreams
+	case ResultTypeVector:
+		return string(parser.ValueTypeVector)
+	case ResultTypeMatrix:
+		return string(parser.ValueTypeMatrix)
+	case ResultTypeScalar:
+		return string(parser.ValueTypeScalar)
+	default:
+		return ""
+	}
+}
+
+// Streams returns the data of a log query result, or an error if the result
+// holds data of another type.
+func (r Result) Streams() (Streams, error) {
+	if s, ok := r.Data.(Streams); ok {
+		return s, nil
+	}
+	return nil, r.typeError(ValueTypeStreams)
 }
 
+// Vector returns the data of an instant metric query result, or an error if
+// the result holds data of another type.
+func (r Result) Vector() (promql.Vector, error) {
+	if v, ok := r.Data.(promql.Vector); ok {
+		return v, nil
+	}
+	return nil, r.typeError(parser.ValueTypeVector)
+}
+
+// Matrix returns the data of a range metric query result, or an error if the
+// result holds data of another type.
+func (r Result) Matrix() (promql.Matrix, error) {
+	if m, ok := r.Data.(promql.Matrix); ok {
+		return m, nil
+	}
+	return nil, r.typeError(parser.ValueTypeMatrix)
+}
+
+func (r Result) typeError(expected parser.ValueType) error {
+	if r.Data == nil {
+		return fmt.Errorf("result has no data, expected %s", expected)
+	}
+	return fmt.Errorf("result of type %s, expected %s", r.Data.Type(), expected)
+}
+
+// EmptyReason tells why the data of a query result is empty.
+type EmptyReason int
+
+const (
+	// EmptyReasonNotEmpty is the reason of results that are not empty.
+	EmptyReasonNotEmpty EmptyReason = iota
+	// EmptyReasonNoStreams is the reason of results for which no streams
+	// matched the selectors of the query.
+	EmptyReasonNoStreams
+	// EmptyReasonFilteredOut is the reason of results for which streams
+	// matched the selectors but all their lines were filtered out.
+	EmptyReasonFilteredOut
+)
+
 // Streams is promql.Value
 type Streams []push.Stream
 
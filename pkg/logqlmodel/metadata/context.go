@@ -7,9 +7,9 @@ package metadata
 import (
 	"context"
 	"errors"
-	"maps"
 	"slices"
 	"sort"
+	"strconv"
 	"sync"
 
 	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase/definitions"
@@ -23,6 +23,10 @@ const (
 	metadataKey ctxKeyType = "metadata"
 )
 
+// QuerySeedHeader is the header recording the seed of the randomized
+// decisions of a query.
+const QuerySeedHeader = "X-Loki-Query-Seed"
+
 var (
 	ErrNoCtxData = errors.New("unable to add headers to context: no existing context data")
 )
@@ -31,14 +35,17 @@ var (
 type Context struct {
 	mtx      sync.Mutex
 	headers  map[string][]string
-	warnings map[string]struct{}
+	warnings map[string]Warning
+	// order holds the message of each warning in the order it first
+	// occurred.
+	order []string
 }
 
 // NewContext creates a new metadata context
 func NewContext(ctx context.Context) (*Context, context.Context) {
 	contextData := &Context{
 		headers:  map[string][]string{},
-		warnings: map[string]struct{}{},
+		warnings: map[string]Warning{},
 	}
 	ctx = context.WithValue(ctx, metadataKey, contextData)
 	return contextData, ctx
@@ -50,7 +57,7 @@ func FromContext(ctx context.Context) *Context {
 	if !ok {
 		return &Context{
 			headers:  map[string][]string{},
-			warnings: map[string]struct{}{},
+			warnings: map[string]Warning{},
 		}
 	}
 	return v
@@ -77,17 +84,61 @@ func (c *Context) Headers() []*definitions.PrometheusResponseHeader {
 	return headers
 }
 
+// SetSeed records the seed of the randomized decisions of the query.
+func (c *Context) SetSeed(seed int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.headers[QuerySeedHeader] = []string{strconv.FormatInt(seed, 10)}
+}
+
 func (c *Context) AddWarning(warning string) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	c.warnings[warning] = struct{}{}
+	c.addWarning(Warning{Message: warning})
+}
+
+// AddStructuredWarning records a warning together with its code and fields.
+func (c *Context) AddStructuredWarning(warning Warning) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, ok := c.warnings[warning.Message]; !ok {
+		c.order = append(c.order, warning.Message)
+	}
+	c.warnings[warning.Message] = warning
+}
+
+// addWarning records a warning unless one with the same message was already
+// recorded, which keeps the code and fields of a structured warning.
+func (c *Context) addWarning(warning Warning) {
+	if _, ok := c.warnings[warning.Message]; !ok {
+		c.order = append(c.order, warning.Message)
+		c.warnings[warning.Message] = warning
+	}
 }
+
+// Warnings returns the messages of the warnings accumulated so far, each
+// once and in the order they first occurred.
 func (c *Context) Warnings() []string {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	warnings := slices.Sorted(maps.Keys(c.warnings))
+	return slices.Clone(c.order)
+}
+
+// StructuredWarnings returns the warnings accumulated so far, each once and
+// in the order they first occurred. Warnings recorded as plain strings have
+// no code nor fields.
+func (c *Context) StructuredWarnings() []Warning {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var warnings []Warning
+	for _, message := range c.order {
+		warnings = append(warnings, c.warnings[message])
+	}
 
 	return warnings
 }
@@ -98,6 +149,7 @@ func (c *Context) Reset() {
 
 	clear(c.headers)
 	clear(c.warnings)
+	c.order = nil
 }
 
 // JoinHeaders merges a Headers with the embedded Headers in a context in a concurrency-safe manner.
@@ -137,7 +189,7 @@ func AddWarnings(ctx context.Context, warnings ...string) error {
 	defer context.mtx.Unlock()
 
 	for _, w := range warnings {
-		context.warnings[w] = struct{}{}
+		context.addWarning(Warning{Message: w})
 	}
 
 	return nil
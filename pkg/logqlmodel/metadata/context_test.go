@@ -56,3 +56,33 @@ func TestHeadersNoKey(t *testing.T) {
 
 	require.True(t, errors.Is(err, ErrNoCtxData))
 }
+
+func TestStructuredWarnings(t *testing.T) {
+	metadata, ctx := NewContext(context.Background())
+	metadata.AddStructuredWarning(MaxSeriesPerVariantWarning(3, "0"))
+	// a plain warning with the same message keeps the structured one.
+	require.NoError(t, AddWarnings(ctx, "maximum of series (3) reached for variant (0)", "plain warning"))
+
+	require.Equal(t, []string{"maximum of series (3) reached for variant (0)", "plain warning"}, metadata.Warnings())
+	require.Equal(t, []Warning{
+		{
+			Code:    WarningCodeMaxSeriesPerVariant,
+			Message: "maximum of series (3) reached for variant (0)",
+			Fields:  map[string]string{"limit": "3", "variant": "0"},
+		},
+		{Message: "plain warning"},
+	}, metadata.StructuredWarnings())
+}
+
+func TestWarningsFirstOccurrenceOrder(t *testing.T) {
+	metadata, ctx := NewContext(context.Background())
+	require.NoError(t, AddWarnings(ctx, "b", "a", "b"))
+	metadata.AddWarning("c")
+	metadata.AddStructuredWarning(Warning{Code: "code", Message: "a"})
+
+	require.Equal(t, []string{"b", "a", "c"}, metadata.Warnings())
+	require.Equal(t, []Warning{{Message: "b"}, {Code: "code", Message: "a"}, {Message: "c"}}, metadata.StructuredWarnings())
+
+	metadata.Reset()
+	require.Empty(t, metadata.Warnings())
+}
@@ -0,0 +1,183 @@
+package metadata
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Warning codes identify the kind of a warning for clients that must not
+// parse its message.
+const (
+	WarningCodeMaxSeries           = "max_series"
+	WarningCodeMaxSeriesPerVariant = "max_series_per_variant"
+	WarningCodeMaxSeriesPerStep    = "max_series_per_step"
+	WarningCodeMinStep             = "min_step"
+	WarningCodeSoftTimeout         = "soft_timeout"
+	WarningCodeUnitMismatch        = "unit_mismatch"
+	WarningCodeDownsampled         = "downsampled"
+	WarningCodeInterpolated        = "interpolated"
+	WarningCodeMaxDistinctValues   = "max_distinct_values"
+	WarningCodeLabelLength         = "label_length"
+	WarningCodeUnderSampled        = "under_sampled"
+	WarningCodeResultLimit         = "result_limit"
+	WarningCodeZeroMean            = "zero_mean"
+)
+
+// Warning is a machine-readable warning. Message is the legacy string form of
+// the warning and Fields carries the values it was built from.
+type Warning struct {
+	Code    string            `json:"code,omitempty"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+func (w Warning) String() string {
+	return w.Message
+}
+
+// MaxSeriesWarning is returned when a query reached the maximum number of
+// series and returns partial results.
+func MaxSeriesWarning(limit int) Warning {
+	return Warning{
+		Code:    WarningCodeMaxSeries,
+		Message: fmt.Sprintf("maximum number of series (%d) reached for a single query; returning partial results", limit),
+		Fields:  map[string]string{"limit": strconv.Itoa(limit)},
+	}
+}
+
+// MaxSeriesPerStepWarning is returned when steps of a query reached the
+// maximum number of series per step and were truncated.
+func MaxSeriesPerStepWarning(limit int) Warning {
+	return Warning{
+		Code:    WarningCodeMaxSeriesPerStep,
+		Message: fmt.Sprintf("maximum number of series per step (%d) reached; returning partial results", limit),
+		Fields:  map[string]string{"limit": strconv.Itoa(limit)},
+	}
+}
+
+// MaxSeriesPerVariantWarning is returned when a variant reached the maximum
+// number of series and was dropped from the results.
+func MaxSeriesPerVariantWarning(limit int, variant string) Warning {
+	return Warning{
+		Code:    WarningCodeMaxSeriesPerVariant,
+		Message: fmt.Sprintf("maximum of series (%d) reached for variant (%s)", limit, variant),
+		Fields:  map[string]string{"limit": strconv.Itoa(limit), "variant": variant},
+	}
+}
+
+// MinStepWarning is returned when the step of a query was rounded up to the
+// minimum step.
+func MinStepWarning(step, minStep time.Duration) Warning {
+	return Warning{
+		Code:    WarningCodeMinStep,
+		Message: fmt.Sprintf("query step [%s] is below the minimum step [%s] and has been rounded up", model.Duration(step), model.Duration(minStep)),
+		Fields:  map[string]string{"step": model.Duration(step).String(), "min_step": model.Duration(minStep).String()},
+	}
+}
+
+// SoftTimeoutWarning is returned when a range query exhausted its time budget
+// and returns the steps evaluated until then.
+func SoftTimeoutWarning(budget time.Duration, steps int) Warning {
+	return Warning{
+		Code:    WarningCodeSoftTimeout,
+		Message: fmt.Sprintf("query time budget [%s] exhausted after %d steps; returning partial results", model.Duration(budget), steps),
+		Fields:  map[string]string{"budget": model.Duration(budget).String(), "steps": strconv.Itoa(steps)},
+	}
+}
+
+// UnitMismatchWarning is returned when the legs of a binary operation have
+// inconsistent units.
+func UnitMismatchWarning(op, left, right string) Warning {
+	return Warning{
+		Code:    WarningCodeUnitMismatch,
+		Message: fmt.Sprintf("binary operation %s between inconsistent units [%s] and [%s]", op, left, right),
+		Fields:  map[string]string{"op": op, "left": left, "right": right},
+	}
+}
+
+// DownsampledWarning is returned when the samples of a range aggregation were
+// downsampled to at most target samples per series and window.
+func DownsampledWarning(target int) Warning {
+	return Warning{
+		Code:    WarningCodeDownsampled,
+		Message: fmt.Sprintf("samples were downsampled to at most %d per series and window; results are approximate", target),
+		Fields:  map[string]string{"target": strconv.Itoa(target)},
+	}
+}
+
+// ResultLimitWarning is returned when the result of a range query exceeded
+// the maximum number of data points and was downsampled to a step every times
+// its step.
+func ResultLimitWarning(limit, every int) Warning {
+	return Warning{
+		Code:    WarningCodeResultLimit,
+		Message: fmt.Sprintf("maximum number of data points (%d) reached; returning the points at a step %d times the query step", limit, every),
+		Fields:  map[string]string{"limit": strconv.Itoa(limit), "every": strconv.Itoa(every)},
+	}
+}
+
+// InterpolatedWarning is returned when a range query was evaluated at a
+// coarser step and interpolated to its step.
+func InterpolatedWarning(step, evaluatedStep time.Duration) Warning {
+	return Warning{
+		Code:    WarningCodeInterpolated,
+		Message: fmt.Sprintf("query was evaluated at step [%s] and linearly interpolated to step [%s]; results are approximate", model.Duration(evaluatedStep), model.Duration(step)),
+		Fields:  map[string]string{"step": model.Duration(step).String(), "evaluated_step": model.Duration(evaluatedStep).String()},
+	}
+}
+
+// UnderSampledWarning is returned when the step of a range query exceeds the
+// range of one of its range aggregations, so that the logs in the gap between
+// the windows of consecutive steps are not sampled.
+func UnderSampledWarning(step, rng time.Duration) Warning {
+	gap := step - rng
+	return Warning{
+		Code:    WarningCodeUnderSampled,
+		Message: fmt.Sprintf("query step [%s] exceeds the range [%s] of a range aggregation; the logs of a gap of [%s] between steps are not sampled", model.Duration(step), model.Duration(rng), model.Duration(gap)),
+		Fields:  map[string]string{"step": model.Duration(step).String(), "range": model.Duration(rng).String(), "gap": model.Duration(gap).String()},
+	}
+}
+
+// ZeroMeanWarning is returned when windows of a range aggregation relative to
+// the mean had a mean of zero and evaluated to NaN.
+func ZeroMeanWarning(op string) Warning {
+	return Warning{
+		Code:    WarningCodeZeroMean,
+		Message: fmt.Sprintf("%s is NaN for windows with a mean of zero", op),
+		Fields:  map[string]string{"op": op},
+	}
+}
+
+// MaxDistinctValuesWarning is returned when count_values_over_time reached the
+// maximum number of distinct values of a series and window and dropped the
+// further values.
+func MaxDistinctValuesWarning(limit, dropped int) Warning {
+	return Warning{
+		Code:    WarningCodeMaxDistinctValues,
+		Message: fmt.Sprintf("maximum number of distinct values (%d) reached; %d distinct values were dropped", limit, dropped),
+		Fields:  map[string]string{"limit": strconv.Itoa(limit), "dropped": strconv.Itoa(dropped)},
+	}
+}
+
+// LabelLengthWarning is returned when labels of the result exceeded the
+// maximum label name or value length and were truncated, or dropped if
+// dropped is true.
+func LabelLengthWarning(maxName, maxValue, labels int, dropped bool) Warning {
+	action := "truncated"
+	if dropped {
+		action = "dropped"
+	}
+	return Warning{
+		Code:    WarningCodeLabelLength,
+		Message: fmt.Sprintf("%d labels exceeded the maximum label name length (%d) or value length (%d) and were %s", labels, maxName, maxValue, action),
+		Fields: map[string]string{
+			"max_name_length":  strconv.Itoa(maxName),
+			"max_value_length": strconv.Itoa(maxValue),
+			"labels":           strconv.Itoa(labels),
+			"action":           action,
+		},
+	}
+}
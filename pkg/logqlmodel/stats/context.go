@@ -45,6 +45,7 @@ type Context struct {
 	ingester Ingester
 	caches   Caches
 	index    Index
+	estimate Estimate
 
 	// store is the store statistics collected across the query path
 	store Store
@@ -140,6 +141,7 @@ func (c *Context) Reset() {
 	c.result.Reset()
 	c.caches.Reset()
 	c.index.Reset()
+	c.estimate.Reset()
 }
 
 // Result calculates the summary based on store and ingester data.
@@ -153,6 +155,7 @@ func (c *Context) Result(execTime time.Duration, queueTime time.Duration, totalE
 		Ingester: c.ingester,
 		Caches:   c.caches,
 		Index:    c.index,
+		Estimate: c.estimate,
 	})
 
 	r.ComputeSummary(execTime, queueTime, totalEntriesReturned)
@@ -246,6 +249,7 @@ func (s *Store) ChunksDownloadDuration() time.Duration {
 func (s *Summary) Merge(m Summary) {
 	s.Splits += m.Splits
 	s.Shards += m.Shards
+	s.DroppedSeries += m.DroppedSeries
 }
 
 func (q *Querier) Merge(m Querier) {
@@ -269,6 +273,13 @@ func (i *Index) Merge(m Index) {
 	}
 }
 
+func (e *Estimate) Merge(m Estimate) {
+	e.Selectors += m.Selectors
+	e.Series += m.Series
+	e.Samples += m.Samples
+	e.EvaluatorNodes += m.EvaluatorNodes
+}
+
 func (c *Caches) Merge(m Caches) {
 	c.Chunk.Merge(m.Chunk)
 	c.Index.Merge(m.Index)
@@ -311,6 +322,7 @@ func (r *Result) Merge(m Result) {
 	r.Caches.Merge(m.Caches)
 	r.Summary.Merge(m.Summary)
 	r.Index.Merge(m.Index)
+	r.Estimate.Merge(m.Estimate)
 	r.ComputeSummary(ConvertSecondsToNanoseconds(r.Summary.ExecTime+m.Summary.ExecTime),
 		ConvertSecondsToNanoseconds(r.Summary.QueueTime+m.Summary.QueueTime), int(r.Summary.TotalEntriesReturned))
 }
@@ -442,6 +454,26 @@ func (c *Context) AddIndexPostFilterChunkRefs(i int64) {
 	atomic.AddInt64(&c.index.PostFilterChunks, i)
 }
 
+// AddEstimateSelectors counts the log selectors executed.
+func (c *Context) AddEstimateSelectors(i int64) {
+	atomic.AddInt64(&c.estimate.Selectors, i)
+}
+
+// AddEstimateSeries counts the distinct series selected.
+func (c *Context) AddEstimateSeries(i int64) {
+	atomic.AddInt64(&c.estimate.Series, i)
+}
+
+// AddEstimateSamples counts the samples selected.
+func (c *Context) AddEstimateSamples(i int64) {
+	atomic.AddInt64(&c.estimate.Samples, i)
+}
+
+// AddEstimateEvaluatorNodes counts the evaluators built.
+func (c *Context) AddEstimateEvaluatorNodes(i int64) {
+	atomic.AddInt64(&c.estimate.EvaluatorNodes, i)
+}
+
 // AddCacheEntriesFound counts the number of cache entries requested and found
 func (c *Context) AddCacheEntriesFound(t CacheType, i int) {
 	stats := c.getCacheStatsByType(t)
@@ -530,6 +562,12 @@ func (c *Context) AddSplitQueries(num int64) {
 	atomic.AddInt64(&c.result.Summary.Splits, num)
 }
 
+// AddDroppedSeries counts series dropped from the result by the maximum number
+// of series.
+func (c *Context) AddDroppedSeries(num int64) {
+	atomic.AddInt64(&c.result.Summary.DroppedSeries, num)
+}
+
 func (c *Context) AddPrePredicateDecompressedRows(i int64) {
 	atomic.AddInt64(&c.store.Dataobj.PrePredicateDecompressedRows, i)
 }
@@ -220,6 +220,12 @@ func TestResult_Merge(t *testing.T) {
 				QueryLengthServed: int64(3 * time.Hour),
 			},
 		},
+		Estimate: Estimate{
+			Selectors:      1,
+			Series:         8,
+			Samples:        80,
+			EvaluatorNodes: 2,
+		},
 		Summary: Summary{
 			ExecTime:                2 * time.Second.Seconds(),
 			QueueTime:               2 * time.Nanosecond.Seconds(),
@@ -285,6 +291,12 @@ func TestResult_Merge(t *testing.T) {
 				QueryLengthServed: int64(2 * 3 * time.Hour),
 			},
 		},
+		Estimate: Estimate{
+			Selectors:      2 * 1,
+			Series:         2 * 8,
+			Samples:        2 * 80,
+			EvaluatorNodes: 2 * 2,
+		},
 		Summary: Summary{
 			ExecTime:                2 * 2 * time.Second.Seconds(),
 			QueueTime:               2 * 2 * time.Nanosecond.Seconds(),
@@ -33,6 +33,7 @@ type Result struct {
 	Ingester Ingester `protobuf:"bytes,3,opt,name=ingester,proto3" json:"ingester"`
 	Caches   Caches   `protobuf:"bytes,4,opt,name=caches,proto3" json:"cache"`
 	Index    Index    `protobuf:"bytes,5,opt,name=index,proto3" json:"index"`
+	Estimate Estimate `protobuf:"bytes,6,opt,name=estimate,proto3" json:"estimate"`
 }
 
 func (m *Result) Reset()      { *m = Result{} }
@@ -102,6 +103,13 @@ func (m *Result) GetIndex() Index {
 	return Index{}
 }
 
+func (m *Result) GetEstimate() Estimate {
+	if m != nil {
+		return m.Estimate
+	}
+	return Estimate{}
+}
+
 type Caches struct {
 	Chunk               Cache `protobuf:"bytes,1,opt,name=chunk,proto3" json:"chunk"`
 	Index               Cache `protobuf:"bytes,2,opt,name=index,proto3" json:"index"`
@@ -232,6 +240,8 @@ type Summary struct {
 	TotalPostFilterLines int64 `protobuf:"varint,11,opt,name=totalPostFilterLines,proto3" json:"totalPostFilterLines"`
 	// Total bytes processed of metadata.
 	TotalStructuredMetadataBytesProcessed int64 `protobuf:"varint,12,opt,name=totalStructuredMetadataBytesProcessed,proto3" json:"totalStructuredMetadataBytesProcessed"`
+	// Total number of series dropped by the maximum number of series.
+	DroppedSeries int64 `protobuf:"varint,13,opt,name=droppedSeries,proto3" json:"droppedSeries"`
 }
 
 func (m *Summary) Reset()      { *m = Summary{} }
@@ -350,6 +360,13 @@ func (m *Summary) GetTotalStructuredMetadataBytesProcessed() int64 {
 	return 0
 }
 
+func (m *Summary) GetDroppedSeries() int64 {
+	if m != nil {
+		return m.DroppedSeries
+	}
+	return 0
+}
+
 // Statistics from Index queries
 // TODO(owen-d): include bytes.
 // Needs some index methods added to return _sized_ chunk refs to know
@@ -1027,6 +1044,78 @@ func (m *Cache) GetQueryLengthServed() int64 {
 	return 0
 }
 
+// Estimate is the cost of an executed query.
+type Estimate struct {
+	// Total number of log selectors.
+	Selectors int64 `protobuf:"varint,1,opt,name=selectors,proto3" json:"selectors"`
+	// Total number of distinct series selected.
+	Series int64 `protobuf:"varint,2,opt,name=series,proto3" json:"series"`
+	// Total number of samples selected within the range windows.
+	Samples int64 `protobuf:"varint,3,opt,name=samples,proto3" json:"samples"`
+	// Total number of evaluator nodes.
+	EvaluatorNodes int64 `protobuf:"varint,4,opt,name=evaluatorNodes,proto3" json:"evaluatorNodes"`
+}
+
+func (m *Estimate) Reset()      { *m = Estimate{} }
+func (*Estimate) ProtoMessage() {}
+func (*Estimate) Descriptor() ([]byte, []int) {
+	return fileDescriptor_6cdfe5d2aea33ebb, []int{10}
+}
+func (m *Estimate) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Estimate) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Estimate.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Estimate) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Estimate.Merge(m, src)
+}
+func (m *Estimate) XXX_Size() int {
+	return m.Size()
+}
+func (m *Estimate) XXX_DiscardUnknown() {
+	xxx_messageInfo_Estimate.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Estimate proto.InternalMessageInfo
+
+func (m *Estimate) GetSelectors() int64 {
+	if m != nil {
+		return m.Selectors
+	}
+	return 0
+}
+
+func (m *Estimate) GetSeries() int64 {
+	if m != nil {
+		return m.Series
+	}
+	return 0
+}
+
+func (m *Estimate) GetSamples() int64 {
+	if m != nil {
+		return m.Samples
+	}
+	return 0
+}
+
+func (m *Estimate) GetEvaluatorNodes() int64 {
+	if m != nil {
+		return m.EvaluatorNodes
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Result)(nil), "stats.Result")
 	proto.RegisterType((*Caches)(nil), "stats.Caches")
@@ -1038,115 +1127,123 @@ func init() {
 	proto.RegisterType((*Dataobj)(nil), "stats.Dataobj")
 	proto.RegisterType((*Chunk)(nil), "stats.Chunk")
 	proto.RegisterType((*Cache)(nil), "stats.Cache")
+	proto.RegisterType((*Estimate)(nil), "stats.Estimate")
 }
 
 func init() { proto.RegisterFile("pkg/logqlmodel/stats/stats.proto", fileDescriptor_6cdfe5d2aea33ebb) }
 
 var fileDescriptor_6cdfe5d2aea33ebb = []byte{
-	// 1646 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x58, 0xcd, 0x6f, 0xdc, 0x44,
-	0x14, 0xcf, 0x66, 0xeb, 0x4d, 0x3a, 0xf9, 0x6a, 0x27, 0x29, 0xdd, 0xd2, 0xb2, 0x4e, 0x97, 0x56,
-	0x14, 0x21, 0x65, 0x55, 0x8a, 0x84, 0x40, 0x54, 0x02, 0x27, 0x44, 0xaa, 0x94, 0x8a, 0xf0, 0x02,
-	0x02, 0xc1, 0xc9, 0xb1, 0x27, 0x1b, 0xb7, 0x5e, 0x7b, 0x63, 0x8f, 0xd3, 0x46, 0x42, 0x82, 0x3f,
-	0x81, 0x3b, 0xe2, 0x8a, 0xb8, 0x70, 0xe2, 0x80, 0x38, 0x73, 0xe9, 0xb1, 0xc7, 0x9e, 0x2c, 0x9a,
-	0x5e, 0x90, 0x4f, 0x15, 0x47, 0x4e, 0x68, 0xde, 0xcc, 0xfa, 0x7b, 0x37, 0xdb, 0x4b, 0xd6, 0xef,
-	0xf7, 0x7e, 0xef, 0x8d, 0xfd, 0xfc, 0xbe, 0x1c, 0xb2, 0x3e, 0x7c, 0xd8, 0xef, 0xb9, 0x7e, 0xff,
-	0xc8, 0x1d, 0xf8, 0x36, 0x73, 0x7b, 0x21, 0x37, 0x79, 0x28, 0xff, 0x6e, 0x0c, 0x03, 0x9f, 0xfb,
-	0x54, 0x43, 0xe1, 0xf5, 0xb5, 0xbe, 0xdf, 0xf7, 0x11, 0xe9, 0x89, 0x2b, 0xa9, 0xec, 0xfe, 0x32,
-	0x4b, 0x5a, 0xc0, 0xc2, 0xc8, 0xe5, 0xf4, 0x03, 0x32, 0x17, 0x46, 0x83, 0x81, 0x19, 0x9c, 0xb4,
-	0x1b, 0xeb, 0x8d, 0x5b, 0x0b, 0xef, 0x2e, 0x6f, 0x48, 0x37, 0x7b, 0x12, 0x35, 0x56, 0x9e, 0xc4,
-	0xfa, 0x4c, 0x12, 0xeb, 0x23, 0x1a, 0x8c, 0x2e, 0x84, 0xe9, 0x51, 0xc4, 0x02, 0x87, 0x05, 0xed,
-	0xd9, 0x82, 0xe9, 0xe7, 0x12, 0xcd, 0x4c, 0x15, 0x0d, 0x46, 0x17, 0xf4, 0x2e, 0x99, 0x77, 0xbc,
-	0x3e, 0x0b, 0x39, 0x0b, 0xda, 0x4d, 0xb4, 0x5d, 0x51, 0xb6, 0xf7, 0x14, 0x6c, 0x5c, 0x50, 0xc6,
-	0x29, 0x11, 0xd2, 0x2b, 0xfa, 0x1e, 0x69, 0x59, 0xa6, 0x75, 0xc8, 0xc2, 0xf6, 0x39, 0x34, 0x5e,
-	0x52, 0xc6, 0x9b, 0x08, 0x1a, 0x4b, 0xca, 0x54, 0x43, 0x12, 0x28, 0x2e, 0xbd, 0x4d, 0x34, 0xc7,
-	0xb3, 0xd9, 0xe3, 0xb6, 0x86, 0x46, 0x8b, 0xe9, 0x89, 0x36, 0x7b, 0x9c, 0xd9, 0x20, 0x05, 0xe4,
-	0x4f, 0xf7, 0xa7, 0x73, 0xa4, 0xb5, 0x99, 0x5a, 0x5b, 0x87, 0x91, 0xf7, 0x50, 0x85, 0x69, 0x31,
-	0x7f, 0x64, 0xee, 0x44, 0x41, 0x01, 0xf9, 0x93, 0x1d, 0x38, 0x3b, 0xc9, 0x24, 0x7f, 0xa0, 0x78,
-	0xb2, 0x00, 0x5f, 0x8c, 0x0a, 0x4b, 0xd1, 0x66, 0x59, 0xd9, 0x28, 0x0e, 0xa8, 0x5f, 0xba, 0x49,
-	0x16, 0x90, 0x26, 0xdf, 0xa9, 0x0a, 0x4a, 0xd1, 0x74, 0x55, 0x99, 0xe6, 0x89, 0x90, 0x17, 0xe8,
-	0x36, 0x59, 0x3c, 0xf6, 0xdd, 0x68, 0xc0, 0x94, 0x17, 0xad, 0xc6, 0xcb, 0x9a, 0xf2, 0x52, 0x60,
-	0x42, 0x41, 0x12, 0x7e, 0x42, 0xf1, 0x96, 0x47, 0x77, 0xd3, 0x9a, 0xe4, 0x27, 0xcf, 0x84, 0x82,
-	0x24, 0x1e, 0xca, 0x35, 0xf7, 0x99, 0xab, 0xdc, 0xcc, 0x4d, 0x7a, 0xa8, 0x1c, 0x11, 0xf2, 0x02,
-	0xfd, 0x96, 0xac, 0x3a, 0x5e, 0xc8, 0x4d, 0x8f, 0xdf, 0x67, 0x3c, 0x70, 0x2c, 0xe5, 0x6c, 0xbe,
-	0xc6, 0xd9, 0x55, 0xe5, 0xac, 0xce, 0x00, 0xea, 0xc0, 0xee, 0x9f, 0x2d, 0x32, 0xa7, 0xca, 0x84,
-	0x7e, 0x49, 0x2e, 0xef, 0x9f, 0x70, 0x16, 0xee, 0x06, 0xbe, 0xc5, 0xc2, 0x90, 0xd9, 0xbb, 0x2c,
-	0xd8, 0x63, 0x96, 0xef, 0xd9, 0x98, 0x30, 0x4d, 0xe3, 0x6a, 0x12, 0xeb, 0xe3, 0x28, 0x30, 0x4e,
-	0x21, 0xdc, 0xba, 0x8e, 0x57, 0xeb, 0x76, 0x36, 0x73, 0x3b, 0x86, 0x02, 0xe3, 0x14, 0xf4, 0x1e,
-	0x59, 0xe5, 0x3e, 0x37, 0x5d, 0xa3, 0x70, 0x2c, 0xe6, 0x5c, 0xd3, 0xb8, 0x2c, 0x82, 0x50, 0xa3,
-	0x86, 0x3a, 0x30, 0x75, 0xb5, 0x53, 0x38, 0x0a, 0x73, 0x30, 0xef, 0xaa, 0xa8, 0x86, 0x3a, 0x90,
-	0xde, 0x22, 0xf3, 0xec, 0x31, 0xb3, 0xbe, 0x70, 0x06, 0x0c, 0xb3, 0xaf, 0x61, 0x2c, 0x8a, 0x06,
-	0x30, 0xc2, 0x20, 0xbd, 0xa2, 0xef, 0x90, 0xf3, 0x47, 0x11, 0x8b, 0x18, 0x52, 0x5b, 0x48, 0x5d,
-	0x4a, 0x62, 0x3d, 0x03, 0x21, 0xbb, 0xa4, 0x1b, 0x84, 0x84, 0xd1, 0xbe, 0x6c, 0x3d, 0x21, 0xe6,
-	0x51, 0xd3, 0x58, 0x4e, 0x62, 0x3d, 0x87, 0x42, 0xee, 0x9a, 0xee, 0x90, 0x35, 0xbc, 0xbb, 0x4f,
-	0x3d, 0x2e, 0xd3, 0x91, 0x47, 0x81, 0xc7, 0x6c, 0x4c, 0x9a, 0xa6, 0xd1, 0x4e, 0x62, 0xbd, 0x56,
-	0x0f, 0xb5, 0x28, 0xed, 0x92, 0x56, 0x38, 0x74, 0x1d, 0x1e, 0xb6, 0xcf, 0xa3, 0x3d, 0x11, 0xf5,
-	0x2b, 0x11, 0x50, 0xbf, 0xc8, 0x39, 0x34, 0x03, 0x3b, 0x6c, 0x93, 0x1c, 0x07, 0x11, 0x50, 0xbf,
-	0xe9, 0x5d, 0xed, 0xfa, 0x21, 0xdf, 0x76, 0x5c, 0xce, 0x02, 0x8c, 0x5e, 0x7b, 0xa1, 0x74, 0x57,
-	0x25, 0x3d, 0xd4, 0xa2, 0xf4, 0x7b, 0x72, 0x13, 0xf1, 0x3d, 0x1e, 0x44, 0x16, 0x8f, 0x02, 0x66,
-	0xdf, 0x67, 0xdc, 0xb4, 0x4d, 0x6e, 0x96, 0x52, 0x62, 0x11, 0xdd, 0xbf, 0x9d, 0xc4, 0xfa, 0x74,
-	0x06, 0x30, 0x1d, 0xad, 0xfb, 0x5f, 0x83, 0x68, 0xd8, 0x79, 0xe9, 0x6d, 0xb2, 0x80, 0x26, 0x9b,
-	0xa2, 0x67, 0x86, 0xaa, 0x5a, 0x56, 0x44, 0x55, 0xe7, 0x60, 0xc8, 0x0b, 0xf4, 0x63, 0x72, 0x61,
-	0x98, 0x3e, 0x90, 0xb2, 0x93, 0xe5, 0xb0, 0x96, 0xc4, 0x7a, 0x45, 0x07, 0x15, 0x84, 0x7e, 0x48,
-	0x96, 0x65, 0x5c, 0xb7, 0xa2, 0xc0, 0xe4, 0x8e, 0xef, 0xa9, 0xdc, 0xa7, 0x49, 0xac, 0x97, 0x34,
-	0x50, 0x92, 0xc5, 0xe9, 0x51, 0xc8, 0x6c, 0xc3, 0xf5, 0xfd, 0x81, 0x74, 0x2a, 0xe7, 0xd0, 0xbc,
-	0x3c, 0xbd, 0xac, 0x83, 0x0a, 0xd2, 0xfd, 0x88, 0xcc, 0xa9, 0x19, 0x29, 0x66, 0x44, 0xc8, 0xfd,
-	0x80, 0x95, 0xc6, 0xca, 0x9e, 0xc0, 0xb2, 0x19, 0x81, 0x14, 0x90, 0x3f, 0xdd, 0xdf, 0x66, 0xc9,
-	0xfc, 0xbd, 0x6c, 0x14, 0x2e, 0x62, 0x64, 0x80, 0x89, 0x26, 0x26, 0x9b, 0x8d, 0x66, 0x5c, 0x10,
-	0xbd, 0x35, 0x8f, 0x43, 0x41, 0xa2, 0xdb, 0x84, 0xe6, 0xe2, 0x79, 0xdf, 0xe4, 0x68, 0x2b, 0x43,
-	0xf8, 0x5a, 0x12, 0xeb, 0x35, 0x5a, 0xa8, 0xc1, 0xd2, 0xd3, 0x0d, 0x94, 0x43, 0x15, 0xc4, 0xec,
-	0x74, 0x85, 0x43, 0x41, 0x12, 0xc1, 0xcf, 0xca, 0x7f, 0x8f, 0x79, 0x5c, 0x75, 0x0b, 0x0c, 0x7e,
-	0x51, 0x03, 0x25, 0x39, 0x8b, 0x97, 0x36, 0x75, 0xbc, 0xfe, 0xd0, 0x88, 0x86, 0xfa, 0xf4, 0x60,
-	0x95, 0x16, 0xec, 0x40, 0x65, 0x5b, 0x76, 0x70, 0xaa, 0x81, 0x92, 0x4c, 0x3f, 0x23, 0x97, 0x72,
-	0xc8, 0x96, 0xff, 0xc8, 0x73, 0x7d, 0xd3, 0x4e, 0xa3, 0x76, 0x25, 0x89, 0xf5, 0x7a, 0x02, 0xd4,
-	0xc3, 0xe2, 0x1d, 0x58, 0x05, 0x0c, 0x9b, 0x59, 0x33, 0x7b, 0x07, 0x55, 0x2d, 0xd4, 0x60, 0xd4,
-	0x22, 0x57, 0x44, 0xe7, 0x3a, 0x01, 0x76, 0xc0, 0x02, 0xe6, 0x59, 0xcc, 0xce, 0x8a, 0xaf, 0xbd,
-	0x84, 0x79, 0x79, 0x33, 0x89, 0xf5, 0xeb, 0x63, 0x49, 0xa3, 0x0a, 0x85, 0xf1, 0x7e, 0xb2, 0xed,
-	0xa7, 0xb4, 0x5b, 0x08, 0x6c, 0xcc, 0xf6, 0x33, 0x7a, 0x3e, 0x60, 0x07, 0xe1, 0x36, 0xe3, 0xd6,
-	0x61, 0xda, 0xd7, 0xf3, 0xcf, 0x57, 0xd0, 0x42, 0x0d, 0x46, 0xbf, 0x26, 0x6d, 0xcb, 0xc7, 0x74,
-	0x77, 0x7c, 0x6f, 0xd3, 0xf7, 0x78, 0xe0, 0xbb, 0x3b, 0x26, 0x67, 0x9e, 0x75, 0x82, 0xad, 0xbf,
-	0x69, 0x5c, 0x4b, 0x62, 0x7d, 0x2c, 0x07, 0xc6, 0x6a, 0xa8, 0x4d, 0xae, 0x0d, 0x9d, 0x21, 0x13,
-	0x43, 0xf2, 0xab, 0xc0, 0x1c, 0x0e, 0x59, 0x20, 0x0b, 0x94, 0xd9, 0xb2, 0xb5, 0xca, 0x51, 0xb1,
-	0x9e, 0xc4, 0xfa, 0x44, 0x1e, 0x4c, 0xd4, 0x8a, 0x35, 0x59, 0x44, 0xd7, 0xdf, 0x7f, 0xa0, 0xd6,
-	0x8e, 0xd1, 0x9a, 0xbc, 0x25, 0xd1, 0x6c, 0x4d, 0x56, 0x34, 0x18, 0x5d, 0x74, 0xff, 0x9d, 0x27,
-	0x73, 0x8a, 0x85, 0x37, 0x1b, 0xb0, 0xdd, 0x80, 0xd9, 0x8e, 0x65, 0x72, 0xb6, 0xc5, 0x2c, 0x7f,
-	0x30, 0x0c, 0x64, 0xcf, 0xf5, 0x1f, 0x8d, 0xfa, 0xa6, 0xbc, 0xd9, 0x09, 0x3c, 0x98, 0xa8, 0xa5,
-	0x7d, 0xf2, 0xc6, 0x38, 0x3d, 0x36, 0x70, 0x95, 0xed, 0xd7, 0x93, 0x58, 0x9f, 0x4c, 0x84, 0xc9,
-	0x6a, 0xfa, 0x73, 0x83, 0xf4, 0xc6, 0x31, 0xc6, 0x0c, 0x0f, 0x55, 0x1b, 0x77, 0x92, 0x58, 0x7f,
-	0x55, 0x53, 0x78, 0x55, 0x03, 0xba, 0x49, 0x2e, 0x8a, 0xa1, 0x91, 0xda, 0x60, 0x8c, 0x65, 0x9b,
-	0xba, 0x94, 0xc4, 0x7a, 0x55, 0x09, 0x55, 0x88, 0x3e, 0x20, 0x9d, 0x02, 0x58, 0x0d, 0xa7, 0x2c,
-	0x87, 0x6e, 0x12, 0xeb, 0x67, 0x30, 0xe1, 0x0c, 0x3d, 0xfd, 0x8e, 0xdc, 0x28, 0x30, 0xc6, 0x05,
-	0x51, 0x96, 0xcc, 0xad, 0x24, 0xd6, 0xa7, 0xe2, 0xc3, 0x54, 0x2c, 0xd1, 0x59, 0xb3, 0x19, 0x8b,
-	0xb1, 0x9a, 0xcb, 0x3a, 0x6b, 0x51, 0x03, 0x25, 0x59, 0x0c, 0x91, 0xa1, 0xd9, 0x67, 0xe1, 0x9e,
-	0x65, 0x7a, 0xd9, 0x9e, 0x85, 0x43, 0x24, 0x8f, 0x43, 0x41, 0xa2, 0x77, 0xc9, 0x0a, 0xca, 0xb9,
-	0x4e, 0x2c, 0x17, 0xac, 0xd5, 0x24, 0xd6, 0xcb, 0x2a, 0x28, 0x03, 0x62, 0x9d, 0x2a, 0x41, 0x32,
-	0x3c, 0x24, 0x5b, 0xa7, 0xea, 0xf4, 0x50, 0x8b, 0x8a, 0x1d, 0x46, 0xe0, 0xa3, 0x31, 0xb8, 0x90,
-	0xed, 0x30, 0x39, 0x18, 0xf2, 0x42, 0x3a, 0x82, 0x45, 0x08, 0x3e, 0x39, 0x36, 0x1d, 0xd7, 0xdc,
-	0x77, 0x99, 0x5a, 0xb7, 0xb2, 0x11, 0x5c, 0xd0, 0x42, 0x0d, 0x96, 0xce, 0xa5, 0x5d, 0xb3, 0xcf,
-	0x0a, 0x93, 0x64, 0xa9, 0x34, 0x97, 0xca, 0x04, 0xa8, 0x87, 0xbb, 0xbf, 0x6b, 0x44, 0xc3, 0xbe,
-	0x2e, 0x5e, 0xea, 0x21, 0x33, 0x6d, 0xd9, 0xe4, 0x31, 0x3a, 0xb9, 0x39, 0x5d, 0xd4, 0x40, 0x49,
-	0x2e, 0xd8, 0xca, 0x6e, 0xaa, 0xd5, 0xd8, 0xca, 0xfe, 0x59, 0x92, 0x45, 0xed, 0xd9, 0x95, 0x4a,
-	0x69, 0x65, 0xb5, 0x57, 0x51, 0x42, 0x15, 0x2a, 0x3b, 0xc9, 0x77, 0xf4, 0x8a, 0x13, 0x79, 0x1b,
-	0x55, 0x48, 0x24, 0x59, 0xf9, 0x3e, 0xe6, 0xb3, 0x24, 0x2b, 0xdf, 0x45, 0x19, 0x10, 0xe6, 0x18,
-	0xe3, 0xad, 0x68, 0xe8, 0x62, 0xf9, 0x84, 0xf9, 0x1c, 0x2d, 0xa9, 0xa0, 0x0c, 0x60, 0x8a, 0x97,
-	0xb6, 0x7d, 0x92, 0x4b, 0xf1, 0xd2, 0xa2, 0x5f, 0x06, 0xe8, 0x90, 0xac, 0xa7, 0x81, 0x1d, 0xd7,
-	0x0d, 0x64, 0xa6, 0xde, 0x48, 0x62, 0xfd, 0x4c, 0x2e, 0x9c, 0xc9, 0xa0, 0x27, 0xe4, 0x4d, 0x7b,
-	0x8a, 0x3e, 0x2e, 0x93, 0xfc, 0xad, 0x24, 0xd6, 0xa7, 0xa1, 0xc3, 0x34, 0xa4, 0xee, 0x5f, 0x4d,
-	0xa2, 0xe1, 0x77, 0xbc, 0x68, 0x27, 0x4c, 0x7e, 0x83, 0x6d, 0xfb, 0x91, 0x57, 0xd8, 0x88, 0xf3,
-	0x38, 0x14, 0x24, 0xb1, 0xd4, 0xb3, 0xd1, 0x97, 0xdb, 0x51, 0x24, 0x76, 0x6b, 0xb9, 0xd9, 0x69,
-	0x72, 0xa9, 0x2f, 0xeb, 0xa0, 0x82, 0xd0, 0xf7, 0xc9, 0x92, 0xc2, 0x70, 0xd9, 0x94, 0x5f, 0xd3,
-	0x9a, 0x71, 0x31, 0x89, 0xf5, 0xa2, 0x02, 0x8a, 0xa2, 0x30, 0xc4, 0xcf, 0x7f, 0x60, 0x16, 0x73,
-	0x8e, 0xd3, 0x6f, 0x67, 0x34, 0x2c, 0x28, 0xa0, 0x28, 0x8a, 0xaf, 0x60, 0x04, 0x70, 0x85, 0x96,
-	0xe5, 0x85, 0x5f, 0xc1, 0x29, 0x08, 0xd9, 0xa5, 0xf8, 0xb8, 0x0e, 0xe4, 0xbd, 0xca, 0x5a, 0xd2,
-	0xe4, 0xc7, 0xf5, 0x08, 0x83, 0xf4, 0x4a, 0x04, 0xd0, 0xce, 0x37, 0x92, 0xb9, 0xac, 0x1f, 0xe7,
-	0x71, 0x28, 0x48, 0xa2, 0xde, 0x70, 0x7d, 0xdc, 0x61, 0x5e, 0x9f, 0x1f, 0xee, 0xb1, 0xe0, 0x38,
-	0x6d, 0xe5, 0x58, 0x6f, 0x15, 0x25, 0x54, 0x21, 0x83, 0x3d, 0x7d, 0xde, 0x99, 0x79, 0xf6, 0xbc,
-	0x33, 0xf3, 0xf2, 0x79, 0xa7, 0xf1, 0xc3, 0x69, 0xa7, 0xf1, 0xeb, 0x69, 0xa7, 0xf1, 0xe4, 0xb4,
-	0xd3, 0x78, 0x7a, 0xda, 0x69, 0xfc, 0x7d, 0xda, 0x69, 0xfc, 0x73, 0xda, 0x99, 0x79, 0x79, 0xda,
-	0x69, 0xfc, 0xf8, 0xa2, 0x33, 0xf3, 0xf4, 0x45, 0x67, 0xe6, 0xd9, 0x8b, 0xce, 0xcc, 0x37, 0xbd,
-	0xbe, 0xc3, 0x0f, 0xa3, 0xfd, 0x0d, 0xcb, 0x1f, 0xf4, 0xfa, 0x81, 0x79, 0x60, 0x7a, 0x66, 0xcf,
-	0xf5, 0x1f, 0x3a, 0xbd, 0xe3, 0x3b, 0xbd, 0xba, 0x7f, 0x94, 0xee, 0xb7, 0xf0, 0xdf, 0xa0, 0x77,
-	0xfe, 0x0f, 0x00, 0x00, 0xff, 0xff, 0x61, 0x8c, 0x00, 0x50, 0x47, 0x15, 0x00, 0x00,
+	// 1760 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x58, 0xcf, 0x8f, 0xe4, 0x46,
+	0x15, 0x9e, 0x9e, 0x1e, 0xf7, 0x74, 0x6a, 0x66, 0x76, 0x37, 0xb5, 0x1b, 0xe2, 0x90, 0xd0, 0xde,
+	0x34, 0x59, 0xb1, 0x08, 0x69, 0x5b, 0x61, 0x23, 0x21, 0x10, 0x91, 0xa0, 0x67, 0x32, 0xd2, 0x4a,
+	0xbb, 0x30, 0xbc, 0x01, 0x81, 0xe0, 0xe4, 0xb1, 0xdf, 0xf6, 0x38, 0xeb, 0xb6, 0x7b, 0xed, 0xf2,
+	0x64, 0x47, 0x42, 0x82, 0x3f, 0x81, 0x3b, 0xe2, 0xce, 0x85, 0x13, 0x07, 0x6e, 0x5c, 0xb8, 0xe4,
+	0xb8, 0xc7, 0x9c, 0x2c, 0x76, 0x56, 0x48, 0xc8, 0xa7, 0x28, 0x47, 0x4e, 0xa8, 0x5e, 0x55, 0xdb,
+	0x2e, 0xdb, 0xdd, 0xd3, 0xb9, 0xb4, 0xeb, 0x7d, 0xef, 0x7b, 0x55, 0xd5, 0xcf, 0xf5, 0x7e, 0x94,
+	0xd9, 0xdd, 0xc5, 0xb3, 0xd9, 0x24, 0x8c, 0x67, 0xcf, 0xc3, 0x79, 0xec, 0x63, 0x38, 0x49, 0x85,
+	0x2b, 0x52, 0xf5, 0xfb, 0x60, 0x91, 0xc4, 0x22, 0xe6, 0x16, 0x09, 0xdf, 0xbc, 0x33, 0x8b, 0x67,
+	0x31, 0x21, 0x13, 0x39, 0x52, 0xca, 0xf1, 0x7f, 0xb6, 0xd9, 0x00, 0x30, 0xcd, 0x42, 0xc1, 0x7f,
+	0xc8, 0x76, 0xd3, 0x6c, 0x3e, 0x77, 0x93, 0x4b, 0xbb, 0x77, 0xb7, 0x77, 0x7f, 0xef, 0xfb, 0x37,
+	0x1e, 0xa8, 0x69, 0x4e, 0x15, 0x3a, 0xbd, 0xf9, 0x79, 0xee, 0x6c, 0x15, 0xb9, 0xb3, 0xa4, 0xc1,
+	0x72, 0x20, 0x4d, 0x9f, 0x67, 0x98, 0x04, 0x98, 0xd8, 0xdb, 0x86, 0xe9, 0x2f, 0x14, 0x5a, 0x99,
+	0x6a, 0x1a, 0x2c, 0x07, 0xfc, 0x63, 0x36, 0x0c, 0xa2, 0x19, 0xa6, 0x02, 0x13, 0xbb, 0x4f, 0xb6,
+	0x37, 0xb5, 0xed, 0x23, 0x0d, 0x4f, 0x6f, 0x69, 0xe3, 0x92, 0x08, 0xe5, 0x88, 0x7f, 0xc4, 0x06,
+	0x9e, 0xeb, 0x9d, 0x63, 0x6a, 0xef, 0x90, 0xf1, 0x81, 0x36, 0x3e, 0x24, 0x70, 0x7a, 0xa0, 0x4d,
+	0x2d, 0x22, 0x81, 0xe6, 0xf2, 0x0f, 0x99, 0x15, 0x44, 0x3e, 0xbe, 0xb0, 0x2d, 0x32, 0xda, 0x2f,
+	0x57, 0xf4, 0xf1, 0x45, 0x65, 0x43, 0x14, 0x50, 0x0f, 0xb9, 0x4f, 0x4c, 0x45, 0x30, 0x77, 0x05,
+	0xda, 0x03, 0x63, 0x9f, 0x9f, 0x68, 0xb8, 0xda, 0xe7, 0x92, 0x08, 0xe5, 0x68, 0xfc, 0xe7, 0x1d,
+	0x36, 0x38, 0x2c, 0x17, 0xf7, 0xce, 0xb3, 0xe8, 0x99, 0xdd, 0x33, 0x16, 0x27, 0x6d, 0x6d, 0xc3,
+	0x92, 0x02, 0xea, 0x51, 0xed, 0x77, 0x7b, 0x9d, 0x89, 0xb1, 0xdf, 0x8f, 0xd8, 0x20, 0xa1, 0xf7,
+	0x6a, 0xf7, 0x3b, 0x6c, 0x6e, 0x68, 0x1b, 0xcd, 0x01, 0xfd, 0xe4, 0x87, 0x6c, 0x8f, 0x68, 0xea,
+	0x48, 0xd8, 0x3b, 0x1d, 0xa6, 0xb7, 0xb5, 0x69, 0x9d, 0x08, 0x75, 0x81, 0x1f, 0xb3, 0xfd, 0x8b,
+	0x38, 0xcc, 0xe6, 0xa8, 0x67, 0xb1, 0x3a, 0x66, 0xb9, 0xa3, 0x67, 0x31, 0x98, 0x60, 0x48, 0x72,
+	0x9e, 0x54, 0x1e, 0x92, 0xe5, 0x6e, 0x06, 0xeb, 0xe6, 0xa9, 0x33, 0xc1, 0x90, 0xe4, 0x9f, 0x0a,
+	0xdd, 0x33, 0x0c, 0xf5, 0x34, 0xbb, 0xeb, 0xfe, 0x54, 0x8d, 0x08, 0x75, 0x81, 0xff, 0x8e, 0xdd,
+	0x0e, 0xa2, 0x54, 0xb8, 0x91, 0x78, 0x82, 0x22, 0x09, 0x3c, 0x3d, 0xd9, 0xb0, 0x63, 0xb2, 0x77,
+	0xf5, 0x64, 0x5d, 0x06, 0xd0, 0x05, 0x8e, 0xbf, 0x1a, 0xb0, 0x5d, 0x1d, 0x65, 0xfc, 0x57, 0xec,
+	0xed, 0xb3, 0x4b, 0x81, 0xe9, 0x49, 0x12, 0x7b, 0x98, 0xa6, 0xe8, 0x9f, 0x60, 0x72, 0x8a, 0x5e,
+	0x1c, 0xf9, 0x74, 0x60, 0xfa, 0xd3, 0x77, 0x8b, 0xdc, 0x59, 0x45, 0x81, 0x55, 0x0a, 0x39, 0x6d,
+	0x18, 0x44, 0x9d, 0xd3, 0x6e, 0x57, 0xd3, 0xae, 0xa0, 0xc0, 0x2a, 0x05, 0x7f, 0xc4, 0x6e, 0x8b,
+	0x58, 0xb8, 0xe1, 0xd4, 0x58, 0x96, 0xce, 0x5c, 0x7f, 0xfa, 0xb6, 0x74, 0x42, 0x87, 0x1a, 0xba,
+	0xc0, 0x72, 0xaa, 0xc7, 0xc6, 0x52, 0xf6, 0x4e, 0x63, 0x2a, 0x53, 0x0d, 0x5d, 0x20, 0xbf, 0xcf,
+	0x86, 0xf8, 0x02, 0xbd, 0x5f, 0x06, 0x73, 0xa4, 0xd3, 0xd7, 0x9b, 0xee, 0x53, 0x5c, 0x6a, 0x0c,
+	0xca, 0x11, 0xff, 0x1e, 0x7b, 0xe3, 0x79, 0x86, 0x19, 0x12, 0x75, 0x40, 0xd4, 0x83, 0x22, 0x77,
+	0x2a, 0x10, 0xaa, 0x21, 0x7f, 0xc0, 0x58, 0x9a, 0x9d, 0xa9, 0xcc, 0x95, 0xd2, 0x39, 0xea, 0x4f,
+	0x6f, 0x14, 0xb9, 0x53, 0x43, 0xa1, 0x36, 0xe6, 0x8f, 0xd9, 0x1d, 0xda, 0xdd, 0x27, 0x91, 0x20,
+	0x1d, 0x8a, 0x2c, 0x89, 0xd0, 0xa7, 0x43, 0xd3, 0x9f, 0xda, 0x45, 0xee, 0x74, 0xea, 0xa1, 0x13,
+	0xe5, 0x63, 0x36, 0x48, 0x17, 0x61, 0x20, 0x52, 0xfb, 0x0d, 0xb2, 0x67, 0x32, 0x7e, 0x15, 0x02,
+	0xfa, 0x49, 0x9c, 0x73, 0x37, 0xf1, 0x53, 0x9b, 0xd5, 0x38, 0x84, 0x80, 0x7e, 0x96, 0xbb, 0x3a,
+	0x89, 0x53, 0x71, 0x1c, 0x84, 0x02, 0x13, 0xf2, 0x9e, 0xbd, 0xd7, 0xd8, 0x55, 0x43, 0x0f, 0x9d,
+	0x28, 0xff, 0x03, 0xbb, 0x47, 0xf8, 0xa9, 0x48, 0x32, 0x4f, 0x64, 0x09, 0xfa, 0x4f, 0x50, 0xb8,
+	0xbe, 0x2b, 0xdc, 0xc6, 0x91, 0xd8, 0xa7, 0xe9, 0xbf, 0x5b, 0xe4, 0xce, 0x66, 0x06, 0xb0, 0x19,
+	0x8d, 0xff, 0x80, 0x1d, 0xf8, 0x49, 0xbc, 0x58, 0xa0, 0x7f, 0xaa, 0xde, 0xcb, 0x01, 0x2d, 0xf4,
+	0x66, 0x91, 0x3b, 0xa6, 0x02, 0x4c, 0x71, 0xfc, 0xbf, 0x1e, 0xb3, 0x28, 0xe3, 0xf3, 0x0f, 0xd9,
+	0x1e, 0xad, 0x75, 0x28, 0x93, 0x6d, 0xaa, 0xc3, 0xec, 0xa6, 0x4c, 0x07, 0x35, 0x18, 0xea, 0x02,
+	0xff, 0x09, 0xbb, 0xb5, 0x28, 0x3d, 0xa1, 0xed, 0x54, 0x1c, 0xdd, 0x29, 0x72, 0xa7, 0xa5, 0x83,
+	0x16, 0xc2, 0x7f, 0xc4, 0x6e, 0xa8, 0x17, 0x72, 0x94, 0x25, 0xae, 0x08, 0xe2, 0x48, 0x07, 0x0d,
+	0x2f, 0x72, 0xa7, 0xa1, 0x81, 0x86, 0x2c, 0x57, 0xcf, 0x52, 0xf4, 0xa7, 0x61, 0x1c, 0xcf, 0xd5,
+	0xa4, 0xaa, 0xfe, 0x0d, 0xd5, 0xea, 0x4d, 0x1d, 0xb4, 0x90, 0xf1, 0x8f, 0xd9, 0xae, 0xae, 0xcd,
+	0xb2, 0xb8, 0xa4, 0x22, 0x4e, 0xb0, 0x51, 0x8f, 0x4e, 0x25, 0x56, 0x15, 0x17, 0xa2, 0x80, 0x7a,
+	0x8c, 0xff, 0xb6, 0xcd, 0x86, 0x8f, 0xaa, 0x12, 0xbc, 0x4f, 0x9e, 0x01, 0x94, 0xd9, 0x4f, 0x65,
+	0x29, 0x6b, 0x7a, 0x4b, 0x26, 0xe5, 0x3a, 0x0e, 0x86, 0xc4, 0x8f, 0x19, 0xaf, 0xf9, 0xf3, 0x89,
+	0x2b, 0xc8, 0x56, 0xb9, 0xf0, 0x1b, 0x45, 0xee, 0x74, 0x68, 0xa1, 0x03, 0x2b, 0x57, 0x9f, 0x92,
+	0x9c, 0x6a, 0x27, 0x56, 0xab, 0x6b, 0x1c, 0x0c, 0x49, 0x3a, 0xbf, 0xca, 0x1b, 0xa7, 0x18, 0x09,
+	0x7b, 0xa7, 0x72, 0xbe, 0xa9, 0x81, 0x86, 0x5c, 0xf9, 0xcb, 0xda, 0xd8, 0x5f, 0xff, 0xb0, 0x98,
+	0x45, 0xfa, 0x72, 0x61, 0x7d, 0x2c, 0xf0, 0xa9, 0xdd, 0x6b, 0x2c, 0x5c, 0x6a, 0xa0, 0x21, 0xf3,
+	0x9f, 0xb3, 0xb7, 0x6a, 0xc8, 0x51, 0xfc, 0x59, 0x14, 0xc6, 0xae, 0x5f, 0x7a, 0xed, 0x9d, 0x22,
+	0x77, 0xba, 0x09, 0xd0, 0x0d, 0xcb, 0x77, 0xe0, 0x19, 0x18, 0x65, 0xc1, 0x7e, 0xf5, 0x0e, 0xda,
+	0x5a, 0xe8, 0xc0, 0xb8, 0xc7, 0xde, 0x91, 0x29, 0xef, 0x12, 0xf0, 0x29, 0x26, 0x18, 0x79, 0xe8,
+	0x57, 0x51, 0x4b, 0xe1, 0x38, 0x9c, 0xde, 0x2b, 0x72, 0xe7, 0xfd, 0x95, 0xa4, 0x65, 0x68, 0xc3,
+	0xea, 0x79, 0xaa, 0xb6, 0xa9, 0xd1, 0x94, 0x48, 0x6c, 0x45, 0xdb, 0xb4, 0xfc, 0x7f, 0x80, 0x4f,
+	0xd3, 0x63, 0x14, 0xde, 0x79, 0x59, 0x10, 0xea, 0xff, 0xcf, 0xd0, 0x42, 0x07, 0xc6, 0x7f, 0xc3,
+	0x6c, 0x2f, 0xa6, 0xe3, 0x1e, 0xc4, 0xd1, 0x61, 0x1c, 0x89, 0x24, 0x0e, 0x1f, 0xbb, 0x02, 0x23,
+	0xef, 0x92, 0x6a, 0x46, 0x7f, 0xfa, 0x5e, 0x91, 0x3b, 0x2b, 0x39, 0xb0, 0x52, 0xc3, 0x7d, 0xf6,
+	0xde, 0x22, 0x58, 0xa0, 0xac, 0xae, 0xbf, 0x4e, 0xdc, 0xc5, 0x02, 0x13, 0x15, 0xa0, 0xe8, 0xab,
+	0x9c, 0xac, 0x6a, 0xcc, 0xdd, 0x22, 0x77, 0xd6, 0xf2, 0x60, 0xad, 0x56, 0xb6, 0xe7, 0xd2, 0xbb,
+	0xf1, 0xd9, 0xa7, 0xf6, 0xd0, 0x68, 0xcf, 0x8f, 0x14, 0x5a, 0xb5, 0xe7, 0x9a, 0x06, 0xcb, 0xc1,
+	0xf8, 0xab, 0x21, 0xdb, 0xd5, 0x2c, 0xda, 0x6c, 0x82, 0x27, 0x09, 0xfa, 0x81, 0xe7, 0x0a, 0x3c,
+	0x42, 0x2f, 0x9e, 0x2f, 0x12, 0x95, 0xac, 0xe3, 0xcf, 0x96, 0x79, 0x53, 0x6d, 0x76, 0x0d, 0x0f,
+	0xd6, 0x6a, 0xf9, 0x8c, 0x7d, 0x6b, 0x95, 0x9e, 0x32, 0xbf, 0x3e, 0xed, 0xef, 0x17, 0xb9, 0xb3,
+	0x9e, 0x08, 0xeb, 0xd5, 0xfc, 0x2f, 0x3d, 0x36, 0x59, 0xc5, 0x58, 0x51, 0x75, 0x74, 0x6c, 0x3c,
+	0x2c, 0x72, 0xe7, 0xeb, 0x9a, 0xc2, 0xd7, 0x35, 0xe0, 0x87, 0xec, 0x4d, 0x59, 0x34, 0x4a, 0x1b,
+	0xf2, 0xb1, 0x4a, 0x53, 0x6f, 0x15, 0xb9, 0xd3, 0x56, 0x42, 0x1b, 0xe2, 0x9f, 0xb2, 0x91, 0x01,
+	0xb6, 0xdd, 0xa9, 0xc2, 0x61, 0x5c, 0xe4, 0xce, 0x35, 0x4c, 0xb8, 0x46, 0xcf, 0x7f, 0xcf, 0x3e,
+	0x30, 0x18, 0xab, 0x9c, 0xa8, 0x42, 0xe6, 0x7e, 0x91, 0x3b, 0x1b, 0xf1, 0x61, 0x23, 0x96, 0xcc,
+	0xac, 0x55, 0x8d, 0x25, 0x5f, 0xed, 0x56, 0x99, 0xd5, 0xd4, 0x40, 0x43, 0x96, 0x45, 0x64, 0xe1,
+	0xce, 0x30, 0x3d, 0xf5, 0xdc, 0xa8, 0x6a, 0xd0, 0xa8, 0x88, 0xd4, 0x71, 0x30, 0x24, 0xfe, 0x31,
+	0xbb, 0x49, 0x72, 0x2d, 0x13, 0xab, 0xce, 0xec, 0x76, 0x91, 0x3b, 0x4d, 0x15, 0x34, 0x01, 0xd9,
+	0x87, 0x35, 0x20, 0xe5, 0x1e, 0x56, 0xf5, 0x61, 0x5d, 0x7a, 0xe8, 0x44, 0x65, 0x0f, 0x23, 0xf1,
+	0x65, 0x19, 0xdc, 0xab, 0x7a, 0x98, 0x1a, 0x0c, 0x75, 0xa1, 0x2c, 0xc1, 0xd2, 0x05, 0x3f, 0xbd,
+	0x70, 0x83, 0xd0, 0x3d, 0x0b, 0xd1, 0xde, 0xaf, 0xd2, 0x63, 0x5b, 0x0b, 0x1d, 0x58, 0x59, 0x97,
+	0x4e, 0xdc, 0x19, 0x1a, 0x95, 0xe4, 0xa0, 0x51, 0x97, 0x9a, 0x04, 0xe8, 0x86, 0xc7, 0x7f, 0xb7,
+	0x98, 0x45, 0x79, 0x5d, 0xbe, 0xd4, 0x73, 0x74, 0x7d, 0x12, 0x94, 0x77, 0x6a, 0x75, 0xda, 0xd4,
+	0x40, 0x43, 0x36, 0x6c, 0x55, 0x36, 0xb5, 0x3a, 0x6c, 0x49, 0x03, 0x0d, 0x59, 0xc6, 0x9e, 0xdf,
+	0x8a, 0x94, 0x41, 0x15, 0x7b, 0x2d, 0x25, 0xb4, 0xa1, 0xe6, 0x24, 0xf5, 0x8c, 0xde, 0x9a, 0x44,
+	0x6d, 0xa3, 0x0d, 0xc9, 0x43, 0xd6, 0xdc, 0xc7, 0xb0, 0x3a, 0x64, 0xcd, 0x5d, 0x34, 0x01, 0x69,
+	0x4e, 0x3e, 0x3e, 0xca, 0x16, 0x21, 0x85, 0x4f, 0x5a, 0x3f, 0xa3, 0x0d, 0x15, 0x34, 0x01, 0x3a,
+	0xe2, 0x8d, 0x6b, 0x02, 0xab, 0x1d, 0x71, 0x53, 0x05, 0x4d, 0x80, 0x2f, 0xd8, 0xdd, 0xd2, 0xb1,
+	0xab, 0xb2, 0x81, 0x3a, 0xa9, 0x1f, 0x14, 0xb9, 0x73, 0x2d, 0x17, 0xae, 0x65, 0xf0, 0x4b, 0xf6,
+	0x6d, 0x7f, 0x83, 0x3c, 0xae, 0x0e, 0xf9, 0x77, 0x8a, 0xdc, 0xd9, 0x84, 0x0e, 0x9b, 0x90, 0xc6,
+	0xff, 0xea, 0x33, 0x8b, 0x3e, 0x00, 0xc8, 0x74, 0x82, 0xea, 0xf2, 0x76, 0x1c, 0x67, 0x91, 0xd1,
+	0x11, 0xd7, 0x71, 0x30, 0x24, 0xd9, 0xd4, 0xe3, 0xf2, 0xca, 0xf7, 0x3c, 0xc3, 0x54, 0xe8, 0xce,
+	0xce, 0x52, 0x4d, 0x7d, 0x53, 0x07, 0x2d, 0x44, 0x5e, 0x85, 0x34, 0x46, 0xcd, 0xa6, 0xba, 0x86,
+	0x5b, 0xea, 0x2a, 0x64, 0x28, 0xc0, 0x14, 0xa5, 0x21, 0x7d, 0x37, 0x00, 0xf4, 0x30, 0xb8, 0x28,
+	0x2f, 0xdd, 0x64, 0x68, 0x28, 0xc0, 0x14, 0xe5, 0xf5, 0x99, 0x00, 0x6a, 0xa1, 0x55, 0x78, 0xd1,
+	0xf5, 0xb9, 0x04, 0xa1, 0x1a, 0xca, 0x5b, 0x79, 0xa2, 0xf6, 0xaa, 0x62, 0xc9, 0x52, 0xb7, 0xf2,
+	0x25, 0x06, 0xe5, 0x48, 0x3a, 0xd0, 0xaf, 0x27, 0x92, 0xdd, 0x2a, 0x1f, 0xd7, 0x71, 0x30, 0x24,
+	0x19, 0x6f, 0xd4, 0x3e, 0x3e, 0xc6, 0x68, 0x26, 0xce, 0x4f, 0x31, 0xb9, 0x28, 0x53, 0x39, 0xc5,
+	0x5b, 0x4b, 0x09, 0x6d, 0x68, 0xfc, 0xcf, 0x1e, 0x1b, 0x2e, 0xbf, 0xe8, 0xc9, 0xbf, 0x97, 0x62,
+	0x88, 0x9e, 0x88, 0x93, 0x65, 0x7b, 0x43, 0x7f, 0xaf, 0x04, 0xa1, 0x1a, 0xd2, 0xdd, 0x5b, 0xdd,
+	0x40, 0xb7, 0x6b, 0x77, 0x6f, 0x42, 0x40, 0x3f, 0xf9, 0x3d, 0xb6, 0x9b, 0xba, 0xf3, 0x45, 0x58,
+	0xb6, 0x12, 0x7b, 0xf4, 0x3d, 0x55, 0x41, 0xb0, 0x1c, 0xc8, 0xd4, 0x85, 0x17, 0x6e, 0x98, 0xb9,
+	0x22, 0x4e, 0x7e, 0x16, 0xfb, 0x66, 0xda, 0x33, 0x35, 0xd0, 0x90, 0xa7, 0xf8, 0xf2, 0xd5, 0x68,
+	0xeb, 0x8b, 0x57, 0xa3, 0xad, 0x2f, 0x5f, 0x8d, 0x7a, 0x7f, 0xbc, 0x1a, 0xf5, 0xfe, 0x7a, 0x35,
+	0xea, 0x7d, 0x7e, 0x35, 0xea, 0xbd, 0xbc, 0x1a, 0xf5, 0xfe, 0x7d, 0x35, 0xea, 0xfd, 0xf7, 0x6a,
+	0xb4, 0xf5, 0xe5, 0xd5, 0xa8, 0xf7, 0xa7, 0xd7, 0xa3, 0xad, 0x97, 0xaf, 0x47, 0x5b, 0x5f, 0xbc,
+	0x1e, 0x6d, 0xfd, 0x76, 0x32, 0x0b, 0xc4, 0x79, 0x76, 0xf6, 0xc0, 0x8b, 0xe7, 0x93, 0x59, 0xe2,
+	0x3e, 0x75, 0x23, 0x77, 0x12, 0xc6, 0xcf, 0x82, 0xc9, 0xc5, 0xc3, 0x49, 0xd7, 0x17, 0xe6, 0xb3,
+	0x01, 0x7d, 0x3f, 0x7e, 0xf8, 0xff, 0x01, 0x00, 0x13, 0xcb, 0xe6, 0x7e, 0x80, 0x16, 0x00, 0x00,
 }
 
 func (this *Result) Equal(that interface{}) bool {
@@ -1183,6 +1280,9 @@ func (this *Result) Equal(that interface{}) bool {
 	if !this.Index.Equal(&that1.Index) {
 		return false
 	}
+	if !this.Estimate.Equal(&that1.Estimate) {
+		return false
+	}
 	return true
 }
 func (this *Caches) Equal(that interface{}) bool {
@@ -1285,6 +1385,9 @@ func (this *Summary) Equal(that interface{}) bool {
 	if this.TotalStructuredMetadataBytesProcessed != that1.TotalStructuredMetadataBytesProcessed {
 		return false
 	}
+	if this.DroppedSeries != that1.DroppedSeries {
+		return false
+	}
 	return true
 }
 func (this *Index) Equal(that interface{}) bool {
@@ -1581,17 +1684,51 @@ func (this *Cache) Equal(that interface{}) bool {
 	}
 	return true
 }
+func (this *Estimate) Equal(that interface{}) bool {
+	if that == nil {
+		return this == nil
+	}
+
+	that1, ok := that.(*Estimate)
+	if !ok {
+		that2, ok := that.(Estimate)
+		if ok {
+			that1 = &that2
+		} else {
+			return false
+		}
+	}
+	if that1 == nil {
+		return this == nil
+	} else if this == nil {
+		return false
+	}
+	if this.Selectors != that1.Selectors {
+		return false
+	}
+	if this.Series != that1.Series {
+		return false
+	}
+	if this.Samples != that1.Samples {
+		return false
+	}
+	if this.EvaluatorNodes != that1.EvaluatorNodes {
+		return false
+	}
+	return true
+}
 func (this *Result) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 9)
+	s := make([]string, 0, 10)
 	s = append(s, "&stats.Result{")
 	s = append(s, "Summary: "+strings.Replace(this.Summary.GoString(), `&`, ``, 1)+",\n")
 	s = append(s, "Querier: "+strings.Replace(this.Querier.GoString(), `&`, ``, 1)+",\n")
 	s = append(s, "Ingester: "+strings.Replace(this.Ingester.GoString(), `&`, ``, 1)+",\n")
 	s = append(s, "Caches: "+strings.Replace(this.Caches.GoString(), `&`, ``, 1)+",\n")
 	s = append(s, "Index: "+strings.Replace(this.Index.GoString(), `&`, ``, 1)+",\n")
+	s = append(s, "Estimate: "+strings.Replace(this.Estimate.GoString(), `&`, ``, 1)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -1616,7 +1753,7 @@ func (this *Summary) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 16)
+	s := make([]string, 0, 17)
 	s = append(s, "&stats.Summary{")
 	s = append(s, "BytesProcessedPerSecond: "+fmt.Sprintf("%#v", this.BytesProcessedPerSecond)+",\n")
 	s = append(s, "LinesProcessedPerSecond: "+fmt.Sprintf("%#v", this.LinesProcessedPerSecond)+",\n")
@@ -1630,6 +1767,7 @@ func (this *Summary) GoString() string {
 	s = append(s, "Shards: "+fmt.Sprintf("%#v", this.Shards)+",\n")
 	s = append(s, "TotalPostFilterLines: "+fmt.Sprintf("%#v", this.TotalPostFilterLines)+",\n")
 	s = append(s, "TotalStructuredMetadataBytesProcessed: "+fmt.Sprintf("%#v", this.TotalStructuredMetadataBytesProcessed)+",\n")
+	s = append(s, "DroppedSeries: "+fmt.Sprintf("%#v", this.DroppedSeries)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -1745,6 +1883,19 @@ func (this *Cache) GoString() string {
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
+func (this *Estimate) GoString() string {
+	if this == nil {
+		return "nil"
+	}
+	s := make([]string, 0, 8)
+	s = append(s, "&stats.Estimate{")
+	s = append(s, "Selectors: "+fmt.Sprintf("%#v", this.Selectors)+",\n")
+	s = append(s, "Series: "+fmt.Sprintf("%#v", this.Series)+",\n")
+	s = append(s, "Samples: "+fmt.Sprintf("%#v", this.Samples)+",\n")
+	s = append(s, "EvaluatorNodes: "+fmt.Sprintf("%#v", this.EvaluatorNodes)+",\n")
+	s = append(s, "}")
+	return strings.Join(s, "")
+}
 func valueToGoStringStats(v interface{}, typ string) string {
 	rv := reflect.ValueOf(v)
 	if rv.IsNil() {
@@ -1773,6 +1924,16 @@ func (m *Result) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	{
+		size, err := m.Estimate.MarshalToSizedBuffer(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarintStats(dAtA, i, uint64(size))
+	}
+	i--
+	dAtA[i] = 0x32
 	{
 		size, err := m.Index.MarshalToSizedBuffer(dAtA[:i])
 		if err != nil {
@@ -1949,6 +2110,11 @@ func (m *Summary) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.DroppedSeries != 0 {
+		i = encodeVarintStats(dAtA, i, uint64(m.DroppedSeries))
+		i--
+		dAtA[i] = 0x68
+	}
 	if m.TotalStructuredMetadataBytesProcessed != 0 {
 		i = encodeVarintStats(dAtA, i, uint64(m.TotalStructuredMetadataBytesProcessed))
 		i--
@@ -2450,6 +2616,49 @@ func (m *Cache) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *Estimate) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Estimate) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Estimate) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.EvaluatorNodes != 0 {
+		i = encodeVarintStats(dAtA, i, uint64(m.EvaluatorNodes))
+		i--
+		dAtA[i] = 0x20
+	}
+	if m.Samples != 0 {
+		i = encodeVarintStats(dAtA, i, uint64(m.Samples))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Series != 0 {
+		i = encodeVarintStats(dAtA, i, uint64(m.Series))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.Selectors != 0 {
+		i = encodeVarintStats(dAtA, i, uint64(m.Selectors))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintStats(dAtA []byte, offset int, v uint64) int {
 	offset -= sovStats(v)
 	base := offset
@@ -2477,6 +2686,8 @@ func (m *Result) Size() (n int) {
 	n += 1 + l + sovStats(uint64(l))
 	l = m.Index.Size()
 	n += 1 + l + sovStats(uint64(l))
+	l = m.Estimate.Size()
+	n += 1 + l + sovStats(uint64(l))
 	return n
 }
 
@@ -2547,6 +2758,9 @@ func (m *Summary) Size() (n int) {
 	if m.TotalStructuredMetadataBytesProcessed != 0 {
 		n += 1 + sovStats(uint64(m.TotalStructuredMetadataBytesProcessed))
 	}
+	if m.DroppedSeries != 0 {
+		n += 1 + sovStats(uint64(m.DroppedSeries))
+	}
 	return n
 }
 
@@ -2756,6 +2970,27 @@ func (m *Cache) Size() (n int) {
 	return n
 }
 
+func (m *Estimate) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Selectors != 0 {
+		n += 1 + sovStats(uint64(m.Selectors))
+	}
+	if m.Series != 0 {
+		n += 1 + sovStats(uint64(m.Series))
+	}
+	if m.Samples != 0 {
+		n += 1 + sovStats(uint64(m.Samples))
+	}
+	if m.EvaluatorNodes != 0 {
+		n += 1 + sovStats(uint64(m.EvaluatorNodes))
+	}
+	return n
+}
+
 func sovStats(x uint64) (n int) {
 	return (math_bits.Len64(x|1) + 6) / 7
 }
@@ -2772,6 +3007,7 @@ func (this *Result) String() string {
 		`Ingester:` + strings.Replace(strings.Replace(this.Ingester.String(), "Ingester", "Ingester", 1), `&`, ``, 1) + `,`,
 		`Caches:` + strings.Replace(strings.Replace(this.Caches.String(), "Caches", "Caches", 1), `&`, ``, 1) + `,`,
 		`Index:` + strings.Replace(strings.Replace(this.Index.String(), "Index", "Index", 1), `&`, ``, 1) + `,`,
+		`Estimate:` + strings.Replace(strings.Replace(this.Estimate.String(), "Estimate", "Estimate", 1), `&`, ``, 1) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -2810,6 +3046,7 @@ func (this *Summary) String() string {
 		`Shards:` + fmt.Sprintf("%v", this.Shards) + `,`,
 		`TotalPostFilterLines:` + fmt.Sprintf("%v", this.TotalPostFilterLines) + `,`,
 		`TotalStructuredMetadataBytesProcessed:` + fmt.Sprintf("%v", this.TotalStructuredMetadataBytesProcessed) + `,`,
+		`DroppedSeries:` + fmt.Sprintf("%v", this.DroppedSeries) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -2926,6 +3163,19 @@ func (this *Cache) String() string {
 	}, "")
 	return s
 }
+func (this *Estimate) String() string {
+	if this == nil {
+		return "nil"
+	}
+	s := strings.Join([]string{`&Estimate{`,
+		`Selectors:` + fmt.Sprintf("%v", this.Selectors) + `,`,
+		`Series:` + fmt.Sprintf("%v", this.Series) + `,`,
+		`Samples:` + fmt.Sprintf("%v", this.Samples) + `,`,
+		`EvaluatorNodes:` + fmt.Sprintf("%v", this.EvaluatorNodes) + `,`,
+		`}`,
+	}, "")
+	return s
+}
 func valueToStringStats(v interface{}) string {
 	rv := reflect.ValueOf(v)
 	if rv.IsNil() {
@@ -3128,6 +3378,39 @@ func (m *Result) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Estimate", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthStats
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthStats
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.Estimate.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipStats(dAtA[iNdEx:])
@@ -3710,6 +3993,25 @@ func (m *Summary) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DroppedSeries", wireType)
+			}
+			m.DroppedSeries = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.DroppedSeries |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipStats(dAtA[iNdEx:])
@@ -5070,6 +5372,132 @@ func (m *Cache) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipStats(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthStats
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Estimate) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowStats
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Estimate: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Estimate: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Selectors", wireType)
+			}
+			m.Selectors = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Selectors |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Series", wireType)
+			}
+			m.Series = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Series |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Samples", wireType)
+			}
+			m.Samples = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Samples |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EvaluatorNodes", wireType)
+			}
+			m.EvaluatorNodes = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.EvaluatorNodes |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipStats(dAtA[iNdEx:])
@@ -89,7 +89,7 @@ func (cfg *Config) Validate() error {
 	if cfg.QueryStoreOnly && cfg.QueryIngesterOnly {
 		return errors.New("querier.query_store_only and querier.query_ingester_only cannot both be true")
 	}
-	return nil
+	return cfg.Engine.Validate()
 }
 
 // Querier can select logs and samples and handle query requests.
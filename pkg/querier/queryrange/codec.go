@@ -1312,7 +1312,7 @@ func encodeResponseJSON(ctx context.Context, version loghttp.Version, res queryr
 func encodeResponseJSONTo(version loghttp.Version, res queryrangebase.Response, w io.Writer, encodeFlags httpreq.EncodingFlags) error {
 	switch response := res.(type) {
 	case *LokiPromResponse:
-		return response.encodeTo(w)
+		return response.encodeTo(w, encodeFlags)
 	case *LokiResponse:
 		streams := make([]logproto.Stream, len(response.Data.Result))
 
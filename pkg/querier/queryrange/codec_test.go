@@ -1996,6 +1996,12 @@ var (
 			"shardsDuration": 0,
 			"usedBloomFilters": false
 		},
+		"estimate": {
+			"selectors": 0,
+			"series": 0,
+			"samples": 0,
+			"evaluatorNodes": 0
+		},
 		"cache": {
 			"chunk": {
 				"entriesFound": 0,
@@ -2080,6 +2086,7 @@ var (
 		},
 		"summary": {
 			"bytesProcessedPerSecond": 20,
+			"droppedSeries": 0,
 			"execTime": 22,
 			"linesProcessedPerSecond": 23,
 			"queueTime": 21,
@@ -19,13 +19,16 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/promql"
 	attribute "go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/semaphore"
 
+	"github.com/grafana/loki/v3/pkg/loghttp"
 	"github.com/grafana/loki/v3/pkg/logproto"
 	"github.com/grafana/loki/v3/pkg/logql"
 	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/grafana/loki/v3/pkg/logqlmodel"
 	"github.com/grafana/loki/v3/pkg/logqlmodel/metadata"
 	queryrange_limits "github.com/grafana/loki/v3/pkg/querier/queryrange/limits"
 	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase"
@@ -415,7 +418,7 @@ func (sl *seriesLimiter) Do(ctx context.Context, req queryrangebase.Request) (qu
 		return nil, httpgrpc.Errorf(http.StatusBadRequest, limitErrTmpl, sl.maxSeries)
 	}
 
-	metadata := metadata.FromContext(ctx)
+	metadataCtx := metadata.FromContext(ctx)
 	//TODO(twhitney): Need a way to propagate skipped variants to the queriers
 	res, err := sl.next.Do(ctx, req)
 	if err != nil {
@@ -471,12 +474,12 @@ func (sl *seriesLimiter) Do(ctx context.Context, req queryrangebase.Request) (qu
 				// Remove this variant from the result slice
 				promResponse.Response.Data.Result = slices.Delete(promResponse.Response.Data.Result, i, i+1)
 				i-- // Adjust the index since we removed an item
-				metadata.AddWarning(fmt.Sprintf("maximum of series (%d) reached for variant (%s)", sl.maxSeries, variant))
+				metadataCtx.AddStructuredWarning(metadata.MaxSeriesPerVariantWarning(sl.maxSeries, variant))
 				continue
 			}
 		} else {
 			if len(sl.hashes) >= sl.maxSeries && httpreq.IsLogsDrilldownRequest(ctx) {
-				metadata.AddWarning(fmt.Sprintf("maximum number of series (%d) reached for a single query; returning partial results", sl.maxSeries))
+				metadataCtx.AddStructuredWarning(metadata.MaxSeriesWarning(sl.maxSeries))
 				return res, nil
 			}
 
@@ -497,6 +500,40 @@ func (sl *seriesLimiter) isLimitReached() bool {
 	return len(sl.hashes) > sl.maxSeries
 }
 
+// NewResultLimitMiddleware enforces the maximum number of data points of the
+// results of range metric queries once they are merged from the split and
+// sharded queries. Logs Drilldown results are downsampled to a coarser step
+// with a warning, the others fail. A limit of 0 disables it.
+func NewResultLimitMiddleware(limit int) queryrangebase.Middleware {
+	return queryrangebase.MiddlewareFunc(func(next queryrangebase.Handler) queryrangebase.Handler {
+		return queryrangebase.HandlerFunc(func(ctx context.Context, r queryrangebase.Request) (queryrangebase.Response, error) {
+			res, err := next.Do(ctx, r)
+			if err != nil || limit <= 0 {
+				return res, err
+			}
+			promResponse, ok := res.(*LokiPromResponse)
+			if !ok || promResponse.Response == nil || promResponse.Response.Data.ResultType != loghttp.ResultTypeMatrix {
+				return res, nil
+			}
+			m := sampleStreamToMatrix(promResponse.Response.Data.Result).(promql.Matrix)
+			if logql.MatrixPoints(m) <= limit {
+				return res, nil
+			}
+			if !httpreq.IsLogsDrilldownRequest(ctx) {
+				return nil, httpgrpc.Errorf(http.StatusBadRequest, "%s", logqlmodel.NewResultLimitError(limit).Error())
+			}
+			m, every := logql.DownsampleMatrix(m, limit, r.GetStart(), time.Duration(r.GetStep())*time.Millisecond)
+			streams, err := queryrangebase.FromValue(m)
+			if err != nil {
+				return nil, err
+			}
+			promResponse.Response.Data.Result = streams
+			metadata.FromContext(ctx).AddStructuredWarning(metadata.ResultLimitWarning(limit, every))
+			return promResponse, nil
+		})
+	})
+}
+
 type limitedRoundTripper struct {
 	configs []config.PeriodConfig
 	next    queryrangebase.Handler
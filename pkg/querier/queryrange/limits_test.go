@@ -302,6 +302,54 @@ func Test_seriesLimiterDrilldown(t *testing.T) {
 	require.Error(t, err)
 }
 
+func Test_resultLimiter(t *testing.T) {
+	series := func(job string) queryrangebase.SampleStream {
+		s := queryrangebase.SampleStream{Labels: []logproto.LabelAdapter{{Name: "job", Value: job}}}
+		for i := int64(0); i < 10; i++ {
+			s.Samples = append(s.Samples, logproto.LegacySample{TimestampMs: i * 1000, Value: float64(i)})
+		}
+		return s
+	}
+	h := queryrangebase.HandlerFunc(func(_ context.Context, _ queryrangebase.Request) (queryrangebase.Response, error) {
+		return &LokiPromResponse{
+			Response: &queryrangebase.PrometheusResponse{
+				Data: queryrangebase.PrometheusData{
+					ResultType: "matrix",
+					Result:     []queryrangebase.SampleStream{series("a"), series("b")},
+				},
+			},
+		}, nil
+	})
+	req := &LokiRequest{StartTs: time.Unix(0, 0), EndTs: time.Unix(9, 0), Step: 1000}
+	tenantCtx := user.InjectOrgID(context.Background(), "1")
+
+	// Within the limit the result is untouched.
+	res, err := NewResultLimitMiddleware(20).Wrap(h).Do(tenantCtx, req)
+	require.NoError(t, err)
+	require.Len(t, res.(*LokiPromResponse).Response.Data.Result[0].Samples, 10)
+
+	// Over the limit Logs Drilldown requests are downsampled with a warning.
+	md, ctx := metadata.NewContext(httpreq.InjectQueryTags(tenantCtx, "Source="+constants.LogsDrilldownAppName))
+	res, err = NewResultLimitMiddleware(10).Wrap(h).Do(ctx, req)
+	require.NoError(t, err)
+	result := res.(*LokiPromResponse).Response.Data.Result
+	require.Len(t, result, 2)
+	for _, s := range result {
+		require.Equal(t, []logproto.LegacySample{
+			{TimestampMs: 0, Value: 0},
+			{TimestampMs: 2000, Value: 2},
+			{TimestampMs: 4000, Value: 4},
+			{TimestampMs: 6000, Value: 6},
+			{TimestampMs: 8000, Value: 8},
+		}, s.Samples)
+	}
+	require.Equal(t, []string{metadata.ResultLimitWarning(10, 2).Message}, md.Warnings())
+
+	// Other requests fail.
+	_, err = NewResultLimitMiddleware(10).Wrap(h).Do(tenantCtx, req)
+	require.Error(t, err)
+}
+
 func TestSeriesLimiter_PerVariantLimits(t *testing.T) {
 	for _, test := range []struct {
 		name             string
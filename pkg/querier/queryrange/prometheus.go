@@ -3,11 +3,14 @@ package queryrange
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
 	"go.opentelemetry.io/otel"
 	attribute "go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -16,6 +19,8 @@ import (
 	"github.com/grafana/loki/v3/pkg/logqlmodel/stats"
 	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase"
 	"github.com/grafana/loki/v3/pkg/storage/chunk/cache/resultscache"
+	"github.com/grafana/loki/v3/pkg/util/httpreq"
+	"github.com/grafana/loki/v3/pkg/util/marshal"
 )
 
 var tracer = otel.Tracer("pkg/querier/queryrange")
@@ -48,7 +53,7 @@ func (PrometheusExtractor) ResponseWithoutHeaders(resp queryrangebase.Response)
 func (p *LokiPromResponse) encode(ctx context.Context) (*http.Response, error) {
 	var buf bytes.Buffer
 
-	err := p.encodeTo(&buf)
+	err := p.encodeTo(&buf, httpreq.ExtractEncodingFlagsFromCtx(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -65,7 +70,11 @@ func (p *LokiPromResponse) encode(ctx context.Context) (*http.Response, error) {
 	return &resp, nil
 }
 
-func (p *LokiPromResponse) encodeTo(w io.Writer) error {
+func (p *LokiPromResponse) encodeTo(w io.Writer, encodeFlags httpreq.EncodingFlags) error {
+	if encodeFlags.Has(httpreq.FlagNonFiniteNull) && p.Response.Error == "" {
+		return p.encodeResultTo(w, encodeFlags)
+	}
+
 	var (
 		b   []byte
 		err error
@@ -87,6 +96,30 @@ func (p *LokiPromResponse) encodeTo(w io.Writer) error {
 	return err
 }
 
+// encodeResultTo encodes the response like the queriers do, which honours
+// all of the encoding flags.
+func (p *LokiPromResponse) encodeResultTo(w io.Writer, encodeFlags httpreq.EncodingFlags) error {
+	var data parser.Value
+	switch p.Response.Data.ResultType {
+	case loghttp.ResultTypeVector:
+		data = sampleStreamToVector(p.Response.Data.Result)
+	case loghttp.ResultTypeMatrix:
+		data = sampleStreamToMatrix(p.Response.Data.Result)
+	case loghttp.ResultTypeScalar:
+		var scalar promql.Scalar
+		for _, r := range p.Response.Data.Result {
+			if len(r.Samples) > 0 {
+				scalar = promql.Scalar{T: r.Samples[0].TimestampMs, V: r.Samples[0].Value}
+				break
+			}
+		}
+		data = scalar
+	default:
+		return fmt.Errorf("unsupported result type %q", p.Response.Data.ResultType)
+	}
+	return marshal.WriteQueryResponseJSON(data, p.Response.Warnings, p.Statistics, w, encodeFlags)
+}
+
 func (p *LokiPromResponse) marshalVector() ([]byte, error) {
 	vec := make(loghttp.Vector, len(p.Response.Data.Result))
 	for i, v := range p.Response.Data.Result {
@@ -1,8 +1,11 @@
 package queryrange
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -10,6 +13,7 @@ import (
 	"github.com/grafana/loki/v3/pkg/loghttp"
 	"github.com/grafana/loki/v3/pkg/logproto"
 	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase"
+	"github.com/grafana/loki/v3/pkg/util/httpreq"
 )
 
 var emptyStats = `"stats": {
@@ -19,6 +23,12 @@ var emptyStats = `"stats": {
 		"shardsDuration": 0,
 		"usedBloomFilters": false
 	},
+	"estimate": {
+		"selectors": 0,
+		"series": 0,
+		"samples": 0,
+		"evaluatorNodes": 0
+	},
 	"ingester" : {
 		"store": {
 			"chunksDownloadTime": 0,
@@ -181,6 +191,7 @@ var emptyStats = `"stats": {
 	},
 	"summary": {
 		"bytesProcessedPerSecond": 0,
+		"droppedSeries": 0,
 		"execTime": 0,
 		"linesProcessedPerSecond": 0,
 		"queueTime": 0,
@@ -310,3 +321,61 @@ func Test_encodePromResponse(t *testing.T) {
 		})
 	}
 }
+
+func Test_encodePromResponse_NonFinite(t *testing.T) {
+	resp := &LokiPromResponse{
+		Response: &queryrangebase.PrometheusResponse{
+			Status: queryrangebase.StatusSuccess,
+			Data: queryrangebase.PrometheusData{
+				ResultType: loghttp.ResultTypeMatrix,
+				Result: []queryrangebase.SampleStream{
+					{
+						Labels: []logproto.LabelAdapter{
+							{Name: "foo", Value: "bar"},
+						},
+						Samples: []logproto.LegacySample{
+							{Value: math.NaN(), TimestampMs: 1000},
+							{Value: math.Inf(1), TimestampMs: 2000},
+							{Value: 1, TimestampMs: 3000},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		flags    httpreq.EncodingFlags
+		expected []any
+	}{
+		{"string", nil, []any{"NaN", "+Inf", "1"}},
+		{"null", httpreq.NewEncodingFlags(httpreq.FlagNonFiniteNull), []any{nil, nil, "1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			require.NoError(t, resp.encodeTo(&b, tc.flags))
+
+			var got struct {
+				Status string `json:"status"`
+				Data   struct {
+					ResultType string `json:"resultType"`
+					Result     []struct {
+						Metric map[string]string `json:"metric"`
+						Values [][]any           `json:"values"`
+					} `json:"result"`
+				} `json:"data"`
+			}
+			require.NoError(t, json.Unmarshal(b.Bytes(), &got))
+			require.Equal(t, "success", got.Status)
+			require.Equal(t, loghttp.ResultTypeMatrix, got.Data.ResultType)
+			require.Len(t, got.Data.Result, 1)
+			require.Equal(t, map[string]string{"foo": "bar"}, got.Data.Result[0].Metric)
+			values := make([]any, 0, len(got.Data.Result[0].Values))
+			for _, v := range got.Data.Result[0].Values {
+				values = append(values, v[1])
+			}
+			require.Equal(t, tc.expected, values)
+		})
+	}
+}
@@ -109,7 +109,7 @@ func (r retry) Do(ctx context.Context, req Request) (Response, error) {
 				"try", tries,
 				"type", logImplementingType(req),
 				"query", query,
-				"query_hash", util.HashedQuery(query),
+				"query_hash", util.HashedNormalizedQuery(ctx, query),
 				"start", start.Format(time.RFC3339Nano),
 				"end", end.Format(time.RFC3339Nano),
 				"start_delta", time.Since(start),
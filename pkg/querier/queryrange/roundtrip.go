@@ -303,7 +303,7 @@ func NewMiddleware(
 			patternRT        = patternTripperware.Wrap(next)
 		)
 
-		return newRoundTripper(
+		rt := newRoundTripper(
 			log,
 			next,
 			limitedRT,
@@ -319,6 +319,8 @@ func NewMiddleware(
 			patternRT,
 			limits,
 		)
+		rt.normalizeQueryHash = engineOpts.NormalizeQueryHash
+		return rt
 	}), StopperWrapper{resultsCache, statsCache, volumeCache}, nil
 }
 
@@ -375,6 +377,10 @@ type roundTripper struct {
 	next, limited, log, metric, series, labels, instantMetric, indexStats, seriesVolume, detectedFields, detectedLabels, pattern base.Handler
 
 	limits Limits
+
+	// normalizeQueryHash hashes the queries of requests in their canonical
+	// form, see logql.EngineOpts.NormalizeQueryHash.
+	normalizeQueryHash bool
 }
 
 // newRoundTripper creates a new queryrange roundtripper
@@ -413,11 +419,14 @@ func logQueryExecution(ctx context.Context, logger log.Logger, values ...interfa
 }
 
 func (r roundTripper) Do(ctx context.Context, req base.Request) (base.Response, error) {
+	if r.normalizeQueryHash {
+		ctx = util.InjectQueryNormalizer(ctx, syntax.NormalizeQuery)
+	}
 	logger := logutil.WithContext(ctx, r.logger)
 
 	switch op := req.(type) {
 	case *LokiRequest:
-		queryHash := util.HashedQuery(op.Query)
+		queryHash := util.HashedNormalizedQuery(ctx, op.Query)
 		logQueryExecution(ctx, logger,
 			"type", "range",
 			"query", op.Query,
@@ -507,7 +516,7 @@ func (r roundTripper) Do(ctx context.Context, req base.Request) (base.Response,
 		)
 		return r.labels.Do(ctx, req)
 	case *LokiInstantRequest:
-		queryHash := util.HashedQuery(op.Query)
+		queryHash := util.HashedNormalizedQuery(ctx, op.Query)
 		logQueryExecution(ctx, logger,
 			"type", "instant",
 			"query", op.Query,
@@ -945,7 +954,7 @@ func NewMetricTripperware(cfg Config, engineOpts logql.EngineOpts, log log.Logge
 			extractor,
 			cacheGenNumLoader,
 			func(_ context.Context, r base.Request) bool {
-				return !r.GetCachingOptions().Disabled
+				return !r.GetCachingOptions().Disabled && !fillsRangeDefault(r)
 			},
 			func(ctx context.Context, tenantIDs []string, r base.Request) int {
 				return MinWeightedParallelism(
@@ -992,6 +1001,7 @@ func NewMetricTripperware(cfg Config, engineOpts logql.EngineOpts, log log.Logge
 		queryRangeMiddleware = append(
 			queryRangeMiddleware,
 			NewQuerySizeLimiterMiddleware(schema.Configs, engineOpts, log, limits, statsHandler),
+			NewResultLimitMiddleware(engineOpts.ResultLimit),
 			base.InstrumentMiddleware("split_by_interval", metrics.InstrumentMiddlewareMetrics),
 			SplitByIntervalMiddleware(schema.Configs, limits, merger, newMetricQuerySplitter(limits, iqo), metrics.SplitByMetrics),
 		)
@@ -1536,6 +1536,18 @@ func (f fakeLimits) EnableMultiVariantQueries(_ string) bool {
 	return f.enableMultiVariantQueries
 }
 
+func (f fakeLimits) MinStep(_ string) time.Duration {
+	return 0
+}
+
+func (f fakeLimits) JSONSchemas(_ string) map[string]string {
+	return nil
+}
+
+func (f fakeLimits) MaxDistinctValues(_ string) int {
+	return 0
+}
+
 type ingesterQueryOpts struct {
 	queryStoreOnly       bool
 	queryIngestersWithin time.Duration
@@ -750,6 +750,7 @@ func Test_splitMetricQuery(t *testing.T) {
 
 	const shortRange = `rate({app="foo"}[1m])`
 	const longRange = `rate({app="foo"}[7d])`
+	const rangeDefault = `last_over_time({app="foo"} | unwrap v [1m], default=0)`
 
 	for i, tc := range []struct {
 		input         *LokiRequest
@@ -757,6 +758,24 @@ func Test_splitMetricQuery(t *testing.T) {
 		splitInterval time.Duration
 		splitter      splitter
 	}{
+		// the default of last_over_time fills the series of the whole range.
+		{
+			input: &LokiRequest{
+				StartTs: time.Unix(0, 0),
+				EndTs:   time.Unix(3*3600, 0),
+				Step:    15 * seconds,
+				Query:   rangeDefault,
+			},
+			expected: []queryrangebase.Request{
+				&LokiRequest{
+					StartTs: time.Unix(0, 0),
+					EndTs:   time.Unix(3*3600, 0),
+					Step:    15 * seconds,
+					Query:   rangeDefault,
+				},
+			},
+			splitInterval: time.Hour,
+		},
 		// the step is lower than the interval therefore we should split only once.
 		{
 			input: &LokiRequest{
@@ -10,6 +10,7 @@ import (
 	util_log "github.com/grafana/loki/v3/pkg/util/log"
 
 	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
 	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase"
 	"github.com/grafana/loki/v3/pkg/util"
 	"github.com/grafana/loki/v3/pkg/util/validation"
@@ -199,6 +200,26 @@ type metricQuerySplitter struct {
 	iqo    util.IngesterQueryOptions
 }
 
+// fillsRangeDefault tells whether the query fills the windows without samples
+// of a range aggregation with a default value, e.g. with
+// `last_over_time(..., default=0)`. The series filled are the ones of the
+// whole range of the query, which is therefore neither split by time nor
+// merged from cached extents.
+func fillsRangeDefault(r queryrangebase.Request) bool {
+	req, ok := r.(*LokiRequest)
+	if !ok || req.Plan == nil || req.Plan.AST == nil {
+		return false
+	}
+	fills := false
+	req.Plan.AST.Walk(func(e syntax.Expr) bool {
+		if rae, ok := e.(*syntax.RangeAggregationExpr); ok && rae.Default != nil {
+			fills = true
+		}
+		return !fills
+	})
+	return fills
+}
+
 func newMetricQuerySplitter(limits Limits, iqo util.IngesterQueryOptions) *metricQuerySplitter {
 	return &metricQuerySplitter{limits, iqo}
 }
@@ -230,6 +251,9 @@ func (s *metricQuerySplitter) split(execTime time.Time, tenantIDs []string, r qu
 	var reqs []queryrangebase.Request
 
 	lokiReq := r.(*LokiRequest)
+	if fillsRangeDefault(lokiReq) {
+		return []queryrangebase.Request{r}
+	}
 
 	interval = s.reduceSplitIntervalForRangeVector(lokiReq, interval)
 
@@ -13,6 +13,9 @@ type MockLimits struct {
 	MaxQueryLengthVal             time.Duration
 	MaxQueryTimeoutVal            time.Duration
 	MaxQueryRangeVal              time.Duration
+	MinStepVal                    time.Duration
+	JSONSchemasVal                map[string]string
+	MaxDistinctValuesVal          int
 	MaxQuerySeriesVal             int
 	MaxConcurrentTailRequestsVal  int
 	MaxEntriesLimitPerQueryVal    int
@@ -44,6 +47,18 @@ func (m *MockLimits) MaxQueryRange(_ context.Context, _ string) time.Duration {
 	return m.MaxQueryRangeVal
 }
 
+func (m *MockLimits) MinStep(_ string) time.Duration {
+	return m.MinStepVal
+}
+
+func (m *MockLimits) JSONSchemas(_ string) map[string]string {
+	return m.JSONSchemasVal
+}
+
+func (m *MockLimits) MaxDistinctValues(_ string) int {
+	return m.MaxDistinctValuesVal
+}
+
 func (m *MockLimits) MaxQuerySeries(_ context.Context, _ string) int {
 	return m.MaxQuerySeriesVal
 }
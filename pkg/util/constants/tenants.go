@@ -0,0 +1,5 @@
+package constants
+
+// TenantLabel is the name of the label used to identify which tenant a series
+// belongs to in queries evaluated separately for each tenant.
+const TenantLabel = "__tenant__"
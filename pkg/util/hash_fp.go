@@ -1,7 +1,9 @@
 package util
 
 import (
+	"context"
 	"hash/fnv"
+	"sync"
 
 	"github.com/prometheus/common/model"
 )
@@ -23,3 +25,46 @@ func HashedQuery(query string) uint32 {
 	_, _ = h.Write([]byte(query))
 	return h.Sum32()
 }
+
+type queryHasherContextKey struct{}
+
+// queryHasher hashes the normalized queries of a request, normalizing each
+// distinct query once.
+type queryHasher struct {
+	normalize func(string) string
+
+	mtx    sync.Mutex
+	hashes map[string]uint32
+}
+
+// InjectQueryNormalizer returns a context whose queries HashedNormalizedQuery
+// hashes once normalized by fn, so that semantically equal queries share a
+// hash. The hash of each query is computed once per context, so retries and
+// repeated log lines of a request do not normalize it again.
+func InjectQueryNormalizer(ctx context.Context, fn func(query string) string) context.Context {
+	if fn == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, queryHasherContextKey{}, &queryHasher{
+		normalize: fn,
+		hashes:    map[string]uint32{},
+	})
+}
+
+// HashedNormalizedQuery returns the hash of the query normalized by the
+// normalizer injected into ctx with InjectQueryNormalizer, or its HashedQuery
+// if there is none, for the query hashes of logs.
+func HashedNormalizedQuery(ctx context.Context, query string) uint32 {
+	h, ok := ctx.Value(queryHasherContextKey{}).(*queryHasher)
+	if !ok {
+		return HashedQuery(query)
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if hash, ok := h.hashes[query]; ok {
+		return hash
+	}
+	hash := HashedQuery(h.normalize(query))
+	h.hashes[query] = hash
+	return hash
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/grafana/dskit/httpgrpc"
+	"github.com/grafana/dskit/middleware"
 )
 
 type EncodingFlag string
@@ -49,6 +50,9 @@ func (ef *EncodingFlags) String() string {
 const (
 	LokiEncodingFlagsHeader              = "X-Loki-Response-Encoding-Flags"
 	FlagCategorizeLabels    EncodingFlag = "categorize-labels"
+	// FlagNonFiniteNull encodes NaN and infinite sample values as null
+	// instead of the "NaN", "+Inf" and "-Inf" strings.
+	FlagNonFiniteNull EncodingFlag = "non-finite-null"
 
 	EncodeFlagsDelimiter = ","
 )
@@ -69,6 +73,21 @@ func AddEncodingFlagsToContext(ctx context.Context, flags EncodingFlags) context
 	return context.WithValue(ctx, headerContextKey(LokiEncodingFlagsHeader), flags.String())
 }
 
+// DefaultEncodingFlagsMiddleware adds the flags to the encoding flags of every
+// request, in addition to the flags the request asks for.
+func DefaultEncodingFlagsMiddleware(flags ...EncodingFlag) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if len(flags) > 0 {
+				encodeFlags := ExtractEncodingFlags(req)
+				encodeFlags.Set(flags...)
+				AddEncodingFlags(req, encodeFlags)
+			}
+			next.ServeHTTP(w, req)
+		})
+	})
+}
+
 func ExtractEncodingFlags(req *http.Request) EncodingFlags {
 	rawValue := req.Header.Get(LokiEncodingFlagsHeader)
 	return ParseEncodingFlags(rawValue)
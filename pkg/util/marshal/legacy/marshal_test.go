@@ -62,6 +62,12 @@ var queryTests = []struct {
 					"usedBloomFilters": false,
 					"shardsDuration": 0
 				},
+				"estimate": {
+					"selectors": 0,
+					"series": 0,
+					"samples": 0,
+					"evaluatorNodes": 0
+				},
 				"ingester" : {
 					"store": {
 						"chunksDownloadTime": 0,
@@ -224,6 +230,7 @@ var queryTests = []struct {
 				},
 				"summary": {
 					"bytesProcessedPerSecond": 0,
+					"droppedSeries": 0,
 					"execTime": 0,
 					"linesProcessedPerSecond": 0,
 					"queueTime": 0,
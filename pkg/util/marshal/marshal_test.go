@@ -3,6 +3,7 @@ package marshal
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -33,6 +34,12 @@ const emptyStats = `{
 		"usedBloomFilters": false,
 		"shardsDuration": 0
 	},
+	"estimate": {
+		"selectors": 0,
+		"series": 0,
+		"samples": 0,
+		"evaluatorNodes": 0
+	},
 	"ingester" : {
 		"store": {
 			"chunksDownloadTime": 0,
@@ -195,6 +202,7 @@ const emptyStats = `{
 	},
 	"summary": {
 		"bytesProcessedPerSecond": 0,
+		"droppedSeries": 0,
 		"execTime": 0,
 		"linesProcessedPerSecond": 0,
 		"queueTime": 0,
@@ -627,6 +635,50 @@ func Test_WriteQueryResponseJSON(t *testing.T) {
 	}
 }
 
+func Test_WriteQueryResponseJSON_NonFinite(t *testing.T) {
+	data := promql.Matrix{
+		{
+			Metric: labels.FromStrings("foo", "bar"),
+			Floats: []promql.FPoint{
+				{T: 1000, F: math.NaN()},
+				{T: 2000, F: math.Inf(1)},
+				{T: 3000, F: math.Inf(-1)},
+				{T: 4000, F: math.Pow(12, 12)},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		flags    httpreq.EncodingFlags
+		expected []any
+	}{
+		{"string", nil, []any{"NaN", "+Inf", "-Inf", "8916100448256"}},
+		{"null", httpreq.NewEncodingFlags(httpreq.FlagNonFiniteNull), []any{nil, nil, nil, "8916100448256"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := WriteQueryResponseJSON(data, nil, stats.Result{}, &b, tc.flags)
+			require.NoError(t, err)
+
+			var resp struct {
+				Data struct {
+					Result []struct {
+						Values [][]any `json:"values"`
+					} `json:"result"`
+				} `json:"data"`
+			}
+			require.NoError(t, json.Unmarshal(b.Bytes(), &resp))
+			require.Len(t, resp.Data.Result, 1)
+			values := make([]any, 0, len(resp.Data.Result[0].Values))
+			for _, v := range resp.Data.Result[0].Values {
+				values = append(values, v[1])
+			}
+			require.Equal(t, tc.expected, values)
+		})
+	}
+}
+
 func Test_WriteLabelResponseJSON(t *testing.T) {
 	for i, labelTest := range labelTests {
 		var b bytes.Buffer
@@ -3,6 +3,7 @@ package marshal
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -345,7 +346,7 @@ func encodeResult(v parser.Value, s *jsoniter.Stream, encodeFlags httpreq.Encodi
 			return fmt.Errorf("unexpected type %T for scalar", scalar)
 		}
 
-		encodeScalar(scalar, s)
+		encodeScalar(scalar, s, encodeFlags)
 
 	case loghttp.ResultTypeVector:
 		vector, ok := v.(promql.Vector)
@@ -354,7 +355,7 @@ func encodeResult(v parser.Value, s *jsoniter.Stream, encodeFlags httpreq.Encodi
 			return fmt.Errorf("unexpected type %T for vector", vector)
 		}
 
-		encodeVector(vector, s)
+		encodeVector(vector, s, encodeFlags)
 
 	case loghttp.ResultTypeMatrix:
 		m, ok := v.(promql.Matrix)
@@ -363,7 +364,7 @@ func encodeResult(v parser.Value, s *jsoniter.Stream, encodeFlags httpreq.Encodi
 			return fmt.Errorf("unexpected type %T for matrix", m)
 		}
 
-		encodeMatrix(m, s)
+		encodeMatrix(m, s, encodeFlags)
 
 	default:
 		s.WriteNil()
@@ -470,16 +471,16 @@ func encodeStream(stream logproto.Stream, s *jsoniter.Stream, encodeFlags httpre
 	return nil
 }
 
-func encodeScalar(v promql.Scalar, s *jsoniter.Stream) {
+func encodeScalar(v promql.Scalar, s *jsoniter.Stream, encodeFlags httpreq.EncodingFlags) {
 	s.WriteArrayStart()
 	defer s.WriteArrayEnd()
 
 	s.WriteRaw(model.Time(v.T).String())
 	s.WriteMore()
-	s.WriteString(model.SampleValue(v.V).String())
+	encodeSampleValue(v.V, s, encodeFlags)
 }
 
-func encodeVector(v promql.Vector, s *jsoniter.Stream) {
+func encodeVector(v promql.Vector, s *jsoniter.Stream, encodeFlags httpreq.EncodingFlags) {
 	s.WriteArrayStart()
 	defer s.WriteArrayEnd()
 
@@ -487,12 +488,12 @@ func encodeVector(v promql.Vector, s *jsoniter.Stream) {
 		if i > 0 {
 			s.WriteMore()
 		}
-		encodeSample(sample, s)
+		encodeSample(sample, s, encodeFlags)
 		s.Flush()
 	}
 }
 
-func encodeSample(sample promql.Sample, s *jsoniter.Stream) {
+func encodeSample(sample promql.Sample, s *jsoniter.Stream, encodeFlags httpreq.EncodingFlags) {
 	s.WriteObjectStart()
 	defer s.WriteObjectEnd()
 
@@ -501,17 +502,27 @@ func encodeSample(sample promql.Sample, s *jsoniter.Stream) {
 
 	s.WriteMore()
 	s.WriteObjectField("value")
-	encodeValue(sample.T, sample.F, s)
+	encodeValue(sample.T, sample.F, s, encodeFlags)
 }
 
-func encodeValue(T int64, V float64, s *jsoniter.Stream) {
+func encodeValue(T int64, V float64, s *jsoniter.Stream, encodeFlags httpreq.EncodingFlags) {
 	s.WriteArrayStart()
 	s.WriteRaw(model.Time(T).String())
 	s.WriteMore()
-	s.WriteString(model.SampleValue(V).String())
+	encodeSampleValue(V, s, encodeFlags)
 	s.WriteArrayEnd()
 }
 
+// encodeSampleValue encodes the value as a string, or NaN and infinite values
+// as null if the encoding flags have httpreq.FlagNonFiniteNull.
+func encodeSampleValue(V float64, s *jsoniter.Stream, encodeFlags httpreq.EncodingFlags) {
+	if encodeFlags.Has(httpreq.FlagNonFiniteNull) && (math.IsNaN(V) || math.IsInf(V, 0)) {
+		s.WriteNil()
+		return
+	}
+	s.WriteString(model.SampleValue(V).String())
+}
+
 func encodeMetric(l labels.Labels, s *jsoniter.Stream) {
 	s.WriteObjectStart()
 	i := 0
@@ -527,7 +538,7 @@ func encodeMetric(l labels.Labels, s *jsoniter.Stream) {
 	s.WriteObjectEnd()
 }
 
-func encodeMatrix(m promql.Matrix, s *jsoniter.Stream) {
+func encodeMatrix(m promql.Matrix, s *jsoniter.Stream, encodeFlags httpreq.EncodingFlags) {
 	s.WriteArrayStart()
 	defer s.WriteArrayEnd()
 
@@ -535,12 +546,12 @@ func encodeMatrix(m promql.Matrix, s *jsoniter.Stream) {
 		if i > 0 {
 			s.WriteMore()
 		}
-		encodeSampleStream(sampleStream, s)
+		encodeSampleStream(sampleStream, s, encodeFlags)
 		s.Flush()
 	}
 }
 
-func encodeSampleStream(stream promql.Series, s *jsoniter.Stream) {
+func encodeSampleStream(stream promql.Series, s *jsoniter.Stream, encodeFlags httpreq.EncodingFlags) {
 	s.WriteObjectStart()
 	defer s.WriteObjectEnd()
 
@@ -554,7 +565,7 @@ func encodeSampleStream(stream promql.Series, s *jsoniter.Stream) {
 		if i > 0 {
 			s.WriteMore()
 		}
-		encodeValue(p.T, p.F, s)
+		encodeValue(p.T, p.F, s, encodeFlags)
 	}
 	s.WriteArrayEnd()
 }
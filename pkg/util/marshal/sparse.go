@@ -0,0 +1,153 @@
+package marshal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// SparseMatrix is the decoded form of a matrix written by WriteResultSparse.
+// Every series only carries its non-empty points together with the index of
+// the step they belong to.
+type SparseMatrix struct {
+	Start  model.Time     `json:"start"`
+	End    model.Time     `json:"end"`
+	Step   model.Duration `json:"step"`
+	Steps  int            `json:"steps"`
+	Result []SparseSeries `json:"result"`
+}
+
+// SparseSeries holds the non-empty points of a series. Values[i] belongs to
+// the step with index Indices[i].
+type SparseSeries struct {
+	Metric  model.Metric        `json:"metric"`
+	Indices []int               `json:"indices"`
+	Values  []model.SampleValue `json:"values"`
+}
+
+// Dense reconstructs the dense matrix, filling the steps without a point
+// with NaN. It fails on indices outside of the steps of the matrix.
+func (m SparseMatrix) Dense() (promql.Matrix, error) {
+	step := time.Duration(m.Step).Milliseconds()
+	result := make(promql.Matrix, 0, len(m.Result))
+	for _, s := range m.Result {
+		if len(s.Indices) != len(s.Values) {
+			return nil, fmt.Errorf("sparse series has %d indices and %d values", len(s.Indices), len(s.Values))
+		}
+		floats := make([]promql.FPoint, max(m.Steps, 0))
+		for i := range floats {
+			floats[i] = promql.FPoint{T: int64(m.Start) + int64(i)*step, F: math.NaN()}
+		}
+		for i, idx := range s.Indices {
+			if idx < 0 || idx >= len(floats) {
+				return nil, fmt.Errorf("sparse series index %d out of range [0, %d)", idx, len(floats))
+			}
+			floats[idx].F = float64(s.Values[i])
+		}
+		lbls := make(map[string]string, len(s.Metric))
+		for k, v := range s.Metric {
+			lbls[string(k)] = string(v)
+		}
+		result = append(result, promql.Series{Metric: labels.FromMap(lbls), Floats: floats})
+	}
+	return result, nil
+}
+
+// WriteResultSparse writes the matrix of a range query from start to end at
+// step in a compact sparse JSON encoding that only contains the non-empty
+// points of each series, each with the index of its step. NaN points and
+// points outside of the steps of the query are treated as empty.
+func WriteResultSparse(w io.Writer, v promql.Matrix, start, end time.Time, step time.Duration) error {
+	steps := 1
+	if step > 0 {
+		steps = int(end.Sub(start)/step) + 1
+	}
+
+	s := jsoniter.ConfigFastest.BorrowStream(w)
+	defer jsoniter.ConfigFastest.ReturnStream(s)
+
+	s.WriteObjectStart()
+	s.WriteObjectField("start")
+	s.WriteRaw(model.TimeFromUnixNano(start.UnixNano()).String())
+	s.WriteMore()
+	s.WriteObjectField("end")
+	s.WriteRaw(model.TimeFromUnixNano(end.UnixNano()).String())
+	s.WriteMore()
+	s.WriteObjectField("step")
+	s.WriteString(model.Duration(step).String())
+	s.WriteMore()
+	s.WriteObjectField("steps")
+	s.WriteInt(steps)
+	s.WriteMore()
+	s.WriteObjectField("result")
+	s.WriteArrayStart()
+	for i, series := range v {
+		if i > 0 {
+			s.WriteMore()
+		}
+		encodeSparseSeries(series, start.UnixMilli(), step.Milliseconds(), steps, s)
+	}
+	s.WriteArrayEnd()
+	s.WriteObjectEnd()
+	s.WriteRaw("\n")
+
+	if err := s.Flush(); err != nil {
+		return fmt.Errorf("could not write sparse JSON response: %w", err)
+	}
+	return nil
+}
+
+func encodeSparseSeries(series promql.Series, start, step int64, steps int, s *jsoniter.Stream) {
+	s.WriteObjectStart()
+	defer s.WriteObjectEnd()
+
+	s.WriteObjectField("metric")
+	encodeMetric(series.Metric, s)
+
+	indices := make([]int, 0, len(series.Floats))
+	values := make([]float64, 0, len(series.Floats))
+	for _, p := range series.Floats {
+		idx := 0
+		if step > 0 {
+			if (p.T-start)%step != 0 {
+				continue
+			}
+			idx = int((p.T - start) / step)
+		} else if p.T != start {
+			continue
+		}
+		if math.IsNaN(p.F) || idx < 0 || idx >= steps {
+			continue
+		}
+		indices = append(indices, idx)
+		values = append(values, p.F)
+	}
+
+	s.WriteMore()
+	s.WriteObjectField("indices")
+	s.WriteArrayStart()
+	for i, idx := range indices {
+		if i > 0 {
+			s.WriteMore()
+		}
+		s.WriteInt(idx)
+	}
+	s.WriteArrayEnd()
+
+	s.WriteMore()
+	s.WriteObjectField("values")
+	s.WriteArrayStart()
+	for i, v := range values {
+		if i > 0 {
+			s.WriteMore()
+		}
+		s.WriteString(model.SampleValue(v).String())
+	}
+	s.WriteArrayEnd()
+}
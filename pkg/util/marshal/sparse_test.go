@@ -0,0 +1,159 @@
+package marshal
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteResultSparse(t *testing.T) {
+	nan := math.NaN()
+	dense := func(start, step int64, values ...float64) []promql.FPoint {
+		points := make([]promql.FPoint, 0, len(values))
+		for i, v := range values {
+			points = append(points, promql.FPoint{T: start + int64(i)*step, F: v})
+		}
+		return points
+	}
+
+	for _, tc := range []struct {
+		name       string
+		input      promql.Matrix
+		start, end int64
+		step       time.Duration
+		expected   promql.Matrix
+		encoded    string
+	}{
+		{
+			name: "sparse series",
+			input: promql.Matrix{
+				{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 60_000, F: 1}, {T: 240_000, F: 2.5}}},
+				{Metric: labels.FromStrings("app", "bar"), Floats: []promql.FPoint{{T: 90_000, F: 3}, {T: 330_000, F: 4}}},
+			},
+			start: 60_000,
+			end:   330_000,
+			step:  30 * time.Second,
+			expected: promql.Matrix{
+				{Metric: labels.FromStrings("app", "foo"), Floats: dense(60_000, 30_000, 1, nan, nan, nan, nan, nan, 2.5, nan, nan, nan)},
+				{Metric: labels.FromStrings("app", "bar"), Floats: dense(60_000, 30_000, nan, 3, nan, nan, nan, nan, nan, nan, nan, 4)},
+			},
+			encoded: `{"start":60,"end":330,"step":"30s","steps":10,"result":[` +
+				`{"metric":{"app":"foo"},"indices":[0,6],"values":["1","2.5"]},` +
+				`{"metric":{"app":"bar"},"indices":[1,9],"values":["3","4"]}]}`,
+		},
+		{
+			name: "NaN gaps are dropped",
+			input: promql.Matrix{
+				{Metric: labels.FromStrings("app", "foo"), Floats: dense(0, 10_000, 1, nan, nan, 2)},
+			},
+			start: 0,
+			end:   30_000,
+			step:  10 * time.Second,
+			expected: promql.Matrix{
+				{Metric: labels.FromStrings("app", "foo"), Floats: dense(0, 10_000, 1, nan, nan, 2)},
+			},
+			encoded: `{"start":0,"end":30,"step":"10s","steps":4,"result":[{"metric":{"app":"foo"},"indices":[0,3],"values":["1","2"]}]}`,
+		},
+		{
+			name: "leading and trailing empty steps",
+			input: promql.Matrix{
+				{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 20_000, F: 7}}},
+			},
+			start: 0,
+			end:   40_000,
+			step:  10 * time.Second,
+			expected: promql.Matrix{
+				{Metric: labels.FromStrings("app", "foo"), Floats: dense(0, 10_000, nan, nan, 7, nan, nan)},
+			},
+			encoded: `{"start":0,"end":40,"step":"10s","steps":5,"result":[{"metric":{"app":"foo"},"indices":[2],"values":["7"]}]}`,
+		},
+		{
+			name: "single step",
+			input: promql.Matrix{
+				{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 1_500, F: 7}}},
+			},
+			start: 1_500,
+			end:   1_500,
+			step:  10 * time.Second,
+			expected: promql.Matrix{
+				{Metric: labels.FromStrings("app", "foo"), Floats: []promql.FPoint{{T: 1_500, F: 7}}},
+			},
+			encoded: `{"start":1.5,"end":1.5,"step":"10s","steps":1,"result":[{"metric":{"app":"foo"},"indices":[0],"values":["7"]}]}`,
+		},
+		{
+			name:     "empty",
+			input:    promql.Matrix{},
+			start:    0,
+			end:      20_000,
+			step:     10 * time.Second,
+			expected: promql.Matrix{},
+			encoded:  `{"start":0,"end":20,"step":"10s","steps":3,"result":[]}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, WriteResultSparse(&buf, tc.input, time.UnixMilli(tc.start), time.UnixMilli(tc.end), tc.step))
+			require.JSONEq(t, tc.encoded, buf.String())
+
+			var sparse SparseMatrix
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &sparse))
+			actual, err := sparse.Dense()
+			require.NoError(t, err)
+
+			require.Len(t, actual, len(tc.expected))
+			for i := range tc.expected {
+				require.Equal(t, tc.expected[i].Metric, actual[i].Metric)
+				require.Len(t, actual[i].Floats, len(tc.expected[i].Floats))
+				for j, p := range tc.expected[i].Floats {
+					require.Equal(t, p.T, actual[i].Floats[j].T)
+					if math.IsNaN(p.F) {
+						require.True(t, math.IsNaN(actual[i].Floats[j].F))
+						continue
+					}
+					require.Equal(t, p.F, actual[i].Floats[j].F)
+				}
+			}
+		})
+	}
+}
+
+func TestSparseMatrix_Dense(t *testing.T) {
+	m := SparseMatrix{
+		Start:  model.TimeFromUnix(10),
+		Step:   model.Duration(5 * time.Second),
+		Steps:  3,
+		Result: []SparseSeries{{Metric: model.Metric{"app": "foo"}, Indices: []int{1}, Values: []model.SampleValue{42}}},
+	}
+	actual, err := m.Dense()
+	require.NoError(t, err)
+	require.Len(t, actual, 1)
+	require.Equal(t, labels.FromStrings("app", "foo"), actual[0].Metric)
+	require.Equal(t, []int64{10_000, 15_000, 20_000}, []int64{actual[0].Floats[0].T, actual[0].Floats[1].T, actual[0].Floats[2].T})
+	require.True(t, math.IsNaN(actual[0].Floats[0].F))
+	require.Equal(t, 42.0, actual[0].Floats[1].F)
+	require.True(t, math.IsNaN(actual[0].Floats[2].F))
+}
+
+func TestSparseMatrix_DenseInvalid(t *testing.T) {
+	for _, m := range []SparseMatrix{
+		{Steps: 0, Result: []SparseSeries{{Indices: []int{0}, Values: []model.SampleValue{1}}}},
+		{Steps: 2, Result: []SparseSeries{{Indices: []int{2}, Values: []model.SampleValue{1}}}},
+		{Steps: 2, Result: []SparseSeries{{Indices: []int{-1}, Values: []model.SampleValue{1}}}},
+		{Steps: 2, Result: []SparseSeries{{Indices: []int{0, 1}, Values: []model.SampleValue{1}}}},
+	} {
+		_, err := m.Dense()
+		require.Error(t, err)
+	}
+
+	actual, err := SparseMatrix{Steps: -1, Result: []SparseSeries{{}}}.Dense()
+	require.NoError(t, err)
+	require.Len(t, actual, 1)
+	require.Empty(t, actual[0].Floats)
+}
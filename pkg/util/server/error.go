@@ -93,7 +93,10 @@ func ClientHTTPStatusAndError(err error) (int, error) {
 		errors.Is(err, logqlmodel.ErrParse) ||
 		errors.Is(err, logqlmodel.ErrPipeline) ||
 		errors.Is(err, logqlmodel.ErrBlocked) ||
+		errors.Is(err, logqlmodel.ErrLabelPolicy) ||
 		errors.Is(err, logqlmodel.ErrParseMatchers) ||
+		errors.Is(err, logqlmodel.ErrQueryTooComplex) ||
+		errors.Is(err, logqlmodel.ErrNegativeOffset) ||
 		errors.Is(err, logqlmodel.ErrUnsupportedSyntaxForInstantQuery):
 		return http.StatusBadRequest, err
 	case errors.Is(err, user.ErrNoOrgID):
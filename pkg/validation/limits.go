@@ -111,6 +111,8 @@ type Limits struct {
 	MaxQueryLookback           model.Duration   `yaml:"max_query_lookback" json:"max_query_lookback"`
 	MaxQueryLength             model.Duration   `yaml:"max_query_length" json:"max_query_length"`
 	MaxQueryRange              model.Duration   `yaml:"max_query_range" json:"max_query_range"`
+	MinQueryStep               model.Duration   `yaml:"min_query_step" json:"min_query_step"`
+	MaxDistinctValues          int              `yaml:"max_distinct_values" json:"max_distinct_values"`
 	MaxQueryParallelism        int              `yaml:"max_query_parallelism" json:"max_query_parallelism"`
 	TSDBMaxQueryParallelism    int              `yaml:"tsdb_max_query_parallelism" json:"tsdb_max_query_parallelism"`
 	TSDBMaxBytesPerShard       flagext.ByteSize `yaml:"tsdb_max_bytes_per_shard" json:"tsdb_max_bytes_per_shard"`
@@ -209,6 +211,8 @@ type Limits struct {
 	RequiredLabels       []string `yaml:"required_labels,omitempty" json:"required_labels,omitempty" doc:"description=Define a list of required selector labels."`
 	RequiredNumberLabels int      `yaml:"minimum_labels_number,omitempty" json:"minimum_labels_number,omitempty" doc:"description=Minimum number of label matchers a query should contain."`
 
+	JSONSchemas map[string]string `yaml:"json_schemas,omitempty" json:"json_schemas,omitempty" doc:"description=Map of JSON schemas by name that log lines can be validated against with the json_schema stage of a query."`
+
 	IndexGatewayShardSize int `yaml:"index_gateway_shard_size" json:"index_gateway_shard_size"`
 
 	BloomGatewayEnabled bool `yaml:"bloom_gateway_enable_filtering" json:"bloom_gateway_enable_filtering" category:"experimental"`
@@ -338,6 +342,9 @@ func (l *Limits) RegisterFlags(f *flag.FlagSet) {
 	f.IntVar(&l.MaxQuerySeries, "querier.max-query-series", 500, "Limit the maximum of unique series that is returned by a metric query. When the limit is reached an error is returned.")
 	_ = l.MaxQueryRange.Set("0s")
 	f.Var(&l.MaxQueryRange, "querier.max-query-range", "Limit the length of the [range] inside a range query. Default is 0 or unlimited")
+	_ = l.MinQueryStep.Set("0s")
+	f.Var(&l.MinQueryStep, "querier.min-query-step", "Minimum step of a range query. Smaller steps are rounded up to this value, or rejected if the query engine is configured to do so. Default is 0 or no minimum.")
+	f.IntVar(&l.MaxDistinctValues, "querier.max-distinct-values", 0, "Maximum number of distinct values count_values_over_time counts per series and window. Further values are dropped with a warning. 0 to disable.")
 	_ = l.QueryTimeout.Set(DefaultPerTenantQueryTimeout)
 	f.Var(&l.QueryTimeout, "querier.query-timeout", "Timeout when querying backends (ingesters or storage) during the execution of a query request. When a specific per-tenant timeout is used, the global timeout is ignored.")
 
@@ -725,6 +732,17 @@ func (o *Overrides) MaxQueryRange(_ context.Context, userID string) time.Duratio
 	return time.Duration(o.getOverridesForUser(userID).MaxQueryRange)
 }
 
+// MinStep returns the minimum step of a range query.
+func (o *Overrides) MinStep(userID string) time.Duration {
+	return time.Duration(o.getOverridesForUser(userID).MinQueryStep)
+}
+
+// MaxDistinctValues returns the maximum number of distinct values counted by
+// count_values_over_time per series and window.
+func (o *Overrides) MaxDistinctValues(userID string) int {
+	return o.getOverridesForUser(userID).MaxDistinctValues
+}
+
 // MaxQueriersPerUser returns the maximum number of queriers that can handle requests for this user.
 func (o *Overrides) MaxQueriersPerUser(userID string) uint {
 	return o.getOverridesForUser(userID).MaxQueriersPerTenant
@@ -1034,6 +1052,11 @@ func (o *Overrides) RequiredLabels(_ context.Context, userID string) []string {
 	return o.getOverridesForUser(userID).RequiredLabels
 }
 
+// JSONSchemas returns the JSON schemas usable by the json_schema stage by name.
+func (o *Overrides) JSONSchemas(userID string) map[string]string {
+	return o.getOverridesForUser(userID).JSONSchemas
+}
+
 func (o *Overrides) RequiredNumberLabels(_ context.Context, userID string) int {
 	return o.getOverridesForUser(userID).RequiredNumberLabels
 }